@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/rs/zerolog"
+)
+
+// with ACCESS_LOG set to some route classes (reads, writes and payments, like
+// the rate limits, or all) each request of those is logged when it is done,
+// with its query, headers and the first ACCESS_LOG_MAX_BODY bytes of the
+// request and response bodies, for debugging integrations. keys, preimages,
+// secrets and auth headers are replaced with "[redacted]" before logging.
+
+const redacted = "[redacted]"
+
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	"X-Masterkey":         true,
+	"X-Admin-Key":         true,
+}
+
+var redactedParams = map[string]bool{
+	"api-key": true,
+	"key":     true,
+}
+
+// names of fields and params with secrets in them. the drain is an LNURL with
+// the admin key in it.
+const sensitiveNames = `[a-z_-]*(preimage|adminkey|admin_key|invoicekey|invoice_key|masterkey|master_key|apikey|api_key|secret|password|token|macaroon|mnemonic|seed|drain)[a-z_-]*`
+
+var (
+	sensitiveName = regexp.MustCompile(`(?i)^` + sensitiveNames + `$`)
+	// this also works on JSON bodies cut at ACCESS_LOG_MAX_BODY
+	sensitiveJSONField = regexp.MustCompile(`(?i)("` + sensitiveNames + `"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+)
+
+// routes whose bodies are all secret, like the pairing URI and its QR code.
+var unloggedBodies = map[string]bool{
+	"/api/wallet/pairing": true,
+}
+
+func accessLogged(class string) bool {
+	for _, c := range live().AccessLog {
+		if c == class || (c == "all" && class != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyCapture keeps the first max bytes read from a request body.
+type bodyCapture struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	max  int
+	size int
+}
+
+func (bc *bodyCapture) Read(p []byte) (int, error) {
+	n, err := bc.ReadCloser.Read(p)
+	bc.size += n
+	bc.buf.Write(p[:capture(n, bc.max-bc.buf.Len())])
+	return n, err
+}
+
+// responseCapture keeps the first max bytes written to a response.
+type responseCapture struct {
+	*apiutils.StatusRecorder
+	buf  bytes.Buffer
+	max  int
+	size int
+}
+
+func (rc *responseCapture) Write(p []byte) (int, error) {
+	n, err := rc.StatusRecorder.Write(p)
+	rc.size += n
+	rc.buf.Write(p[:capture(n, rc.max-rc.buf.Len())])
+	return n, err
+}
+
+// capture is how many of the n bytes fit in the room left.
+func capture(n, room int) int {
+	if room <= 0 {
+		return 0
+	}
+	if n < room {
+		return n
+	}
+	return room
+}
+
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := apiutils.RouteTemplate(r)
+		class := routeClass(route)
+		if len(live().AccessLog) == 0 || !accessLogged(class) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		maxBody := live().AccessLogMaxBody
+		if streamingRoutes[route] || unloggedBodies[route] {
+			// streams never end, their events would only fill the buffer
+			maxBody = 0
+		}
+
+		request := &bodyCapture{ReadCloser: r.Body, max: maxBody}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = request
+		}
+		response := &responseCapture{StatusRecorder: apiutils.NewStatusRecorder(w), max: maxBody}
+
+		start := time.Now()
+		next.ServeHTTP(response, r)
+
+		event := zerolog.Ctx(r.Context()).Info().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("route", route).
+			Str("class", class).
+			Str("ip", apiutils.ClientIP(r)).
+			Int("status", response.Status).
+			Dur("duration", time.Since(start)).
+			Int("request_size", request.size).
+			Int("response_size", response.size)
+		if r.URL.RawQuery != "" {
+			event = event.Str("query", redactQuery(r.URL.Query()).Encode())
+		}
+		event = event.Interface("request_headers", redactHeaders(r.Header))
+		if maxBody > 0 {
+			event = logBody(event, "request_body", r.Header.Get("Content-Type"),
+				request.buf.Bytes(), request.size)
+			event = logBody(event, "response_body", response.Header().Get("Content-Type"),
+				response.buf.Bytes(), response.size)
+		}
+		event.Msg("request")
+	})
+}
+
+func redactHeaders(header http.Header) map[string]string {
+	result := make(map[string]string, len(header))
+	for name, values := range header {
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			result[name] = redacted
+		} else {
+			result[name] = strings.Join(values, ", ")
+		}
+	}
+	return result
+}
+
+func redactQuery(query url.Values) url.Values {
+	for name := range query {
+		if redactedParams[strings.ToLower(name)] || sensitiveName.MatchString(name) {
+			query[name] = []string{redacted}
+		}
+	}
+	return query
+}
+
+func logBody(event *zerolog.Event, field, contentType string, body []byte, size int) *zerolog.Event {
+	if size == 0 {
+		return event
+	}
+	truncated := len(body) < size
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil || truncated {
+			return event.Str(field, fmt.Sprintf("[%d bytes of form data]", size))
+		}
+		body = []byte(redactQuery(values).Encode())
+	case mediaType == "", mediaType == "application/json", strings.HasSuffix(mediaType, "+json"),
+		strings.HasPrefix(mediaType, "text/") && mediaType != "text/event-stream":
+		// the client sends JSON without saying so
+		body = sensitiveJSONField.ReplaceAll(body, []byte(`$1"`+redacted+`"`))
+		if !truncated && json.Valid(body) {
+			return event.RawJSON(field, bytes.TrimSpace(body))
+		}
+	default:
+		return event.Str(field, fmt.Sprintf("[%d bytes of %s]", size, contentType))
+	}
+
+	if truncated {
+		return event.Str(field, string(body)+"…")
+	}
+	return event.Str(field, string(body))
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/ledger"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	"gorm.io/gorm"
+)
+
+func ListBackups(w http.ResponseWriter, r *http.Request) {
+	backups, err := storage.ListBackups()
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "%s", err.Error())
+		return
+	}
+	if backups == nil {
+		backups = make([]storage.Backup, 0)
+	}
+
+	apiutils.SendJSON(w, backups)
+}
+
+func CreateBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiutils.SendJSONError(w, 405, "use POST to create a backup")
+		return
+	}
+
+	backup, err := storage.CreateBackup()
+	if err == storage.ErrBackupRunning {
+		apiutils.SendJSONError(w, 409, "%s", err.Error())
+		return
+	}
+	if err != nil && backup == nil {
+		apiutils.SendJSONError(w, 500, "%s", err.Error())
+		return
+	}
+	// otherwise the backup was created even if removing the old ones failed
+
+	apiutils.SendJSON(w, backup)
+}
+
+func DatabasePool(w http.ResponseWriter, r *http.Request) {
+	stats, err := storage.Pool()
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "%s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, stats)
+}
+
+// AuditLog returns the latest audit entries, optionally filtered by user, wallet,
+// action and time. pass the id of the last entry as `before` to get the next page.
+func AuditLog(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	q := storage.DB.Model(&models.AuditEntry{})
+	if user := qs.Get("user"); user != "" {
+		q = q.Where("user_id = ?", user)
+	}
+	if wallet := qs.Get("wallet"); wallet != "" {
+		q = q.Where("wallet_id = ?", wallet)
+	}
+	if action := qs.Get("action"); action != "" {
+		q = q.Where("action = ?", action)
+	}
+	for param, op := range map[string]string{"since": ">=", "until": "<"} {
+		if v := qs.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				apiutils.SendJSONError(w, 400, "invalid %s, must be RFC3339: %s", param, err.Error())
+				return
+			}
+			q = q.Where("created_at "+op+" ?", t)
+		}
+	}
+	if before := qs.Get("before"); before != "" {
+		id, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			apiutils.SendJSONError(w, 400, "invalid before: %s", err.Error())
+			return
+		}
+		q = q.Where("id < ?", id)
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(qs.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	entries := make([]models.AuditEntry, 0, limit)
+	if err := q.Order("id desc").Limit(limit).Find(&entries).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, entries)
+}
+
+// Ledger returns the balance of every ledger account and whether they add up to
+// zero, as they always should.
+func Ledger(w http.ResponseWriter, r *http.Request) {
+	balances, err := ledger.Balances()
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	var total int64
+	for _, balance := range balances {
+		total += balance.Balance
+	}
+
+	apiutils.SendJSON(w, struct {
+		Balanced bool                    `json:"balanced"`
+		Accounts []ledger.AccountBalance `json:"accounts"`
+	}{total == 0, balances})
+}
+
+// CheckLedger validates the ledger invariants, and with a POST also repairs
+// what it can before reporting.
+func CheckLedger(w http.ResponseWriter, r *http.Request) {
+	report, err := ledger.Check(r.Method == "POST")
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "check failed: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		OK bool `json:"ok"`
+		ledger.CheckReport
+	}{report.OK(), report})
+}
+
+// LedgerEntries returns the latest ledger entries, optionally filtered by wallet,
+// account, payment and transaction. `before` works like in AuditLog.
+func LedgerEntries(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	q := storage.DB.Model(&models.LedgerEntry{})
+	for param, column := range map[string]string{
+		"wallet":      "wallet_id",
+		"account":     "account",
+		"checking_id": "checking_id",
+		"tx":          "tx_id",
+	} {
+		if v := qs.Get(param); v != "" {
+			q = q.Where(column+" = ?", v)
+		}
+	}
+	if before := qs.Get("before"); before != "" {
+		id, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			apiutils.SendJSONError(w, 400, "invalid before: %s", err.Error())
+			return
+		}
+		q = q.Where("id < ?", id)
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(qs.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	entries := make([]models.LedgerEntry, 0, limit)
+	if err := q.Order("id desc").Limit(limit).Find(&entries).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, entries)
+}
+
+type deletedItem struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// ListDeleted returns the users and wallets that are deleted but can still be
+// restored.
+func ListDeleted(w http.ResponseWriter, r *http.Request) {
+	users := make([]deletedItem, 0)
+	wallets := make([]deletedItem, 0)
+
+	if err := storage.DB.Unscoped().Model(&models.User{}).
+		Select("id", "deleted_at").Where("deleted_at IS NOT NULL").
+		Order("deleted_at desc").Scan(&users).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+	if err := storage.DB.Unscoped().Model(&models.Wallet{}).
+		Select("id", "user_id", "name", "deleted_at").Where("deleted_at IS NOT NULL").
+		Order("deleted_at desc").Scan(&wallets).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		Users   []deletedItem `json:"users"`
+		Wallets []deletedItem `json:"wallets"`
+	}{users, wallets})
+}
+
+// Restore undeletes the user (with its wallets) or wallet given as `user` or
+// `wallet` in the querystring.
+func Restore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiutils.SendJSONError(w, 405, "use POST to restore")
+		return
+	}
+
+	var err error
+	qs := r.URL.Query()
+	switch {
+	case qs.Get("user") != "":
+		err = services.RestoreUser(qs.Get("user"))
+	case qs.Get("wallet") != "":
+		err = services.RestoreWallet(qs.Get("wallet"))
+	default:
+		apiutils.SendJSONError(w, 400, "pass the user or wallet to restore")
+		return
+	}
+
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		apiutils.SendJSONError(w, 404, "not deleted or already purged")
+	case err == services.ErrOwnerDeleted:
+		apiutils.SendJSONError(w, 409, "%s", err.Error())
+	case err != nil:
+		apiutils.SendJSONError(w, 500, "failed to restore: %s", err.Error())
+	default:
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,303 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	rp "github.com/lnbits/relampago"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"gorm.io/gorm"
+)
+
+// the account endpoints of the Alby Wallet API under /alby/, for the tools
+// written against api.getalby.com, with the wallet key as the bearer token.
+// amounts are in sat. there is no keysend, so value4value has no keysend info.
+
+// AlbyPaymentTimeout is how long payments/bolt11 waits for a payment to settle
+// before answering without the preimage.
+var AlbyPaymentTimeout = time.Second * 45
+
+// SendAlbyError sends errors the way Alby clients understand them.
+func SendAlbyError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error   bool   `json:"error"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{true, status, message})
+}
+
+func AlbyBalance(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	balance, err := services.LoadWalletBalance(wallet.ID)
+	if err != nil {
+		SendAlbyError(w, 500, "failed to load balance")
+		return
+	}
+
+	sendAlby(w, 200, struct {
+		Balance  int64  `json:"balance"`
+		Currency string `json:"currency"`
+		Unit     string `json:"unit"`
+	}{balance / 1000, "BTC", "sat"})
+}
+
+func AlbyValue4Value(w http.ResponseWriter, r *http.Request) {
+	sendAlby(w, 200, struct {
+		KeysendPubkey      string `json:"keysend_pubkey"`
+		KeysendCustomKey   string `json:"keysend_custom_key"`
+		KeysendCustomValue string `json:"keysend_custom_value"`
+		LightningAddress   string `json:"lightning_address"`
+	}{})
+}
+
+type albyInvoice struct {
+	Amount          int64             `json:"amount"`
+	CreatedAt       time.Time         `json:"created_at"`
+	CreationDate    int64             `json:"creation_date"`
+	Currency        string            `json:"currency"`
+	CustomRecords   map[string]string `json:"custom_records"`
+	DescriptionHash string            `json:"description_hash"`
+	ExpiresAt       *time.Time        `json:"expires_at"`
+	Expiry          int64             `json:"expiry"`
+	Fee             int64             `json:"fee,omitempty"`
+	Identifier      string            `json:"identifier"`
+	Memo            string            `json:"memo"`
+	PaymentHash     string            `json:"payment_hash"`
+	PaymentRequest  string            `json:"payment_request"`
+	Preimage        string            `json:"preimage"`
+	RHashStr        string            `json:"r_hash_str"`
+	Settled         bool              `json:"settled"`
+	SettledAt       *time.Time        `json:"settled_at"`
+	State           string            `json:"state"`
+	Type            string            `json:"type"`
+	Value           int64             `json:"value"`
+}
+
+func toAlbyInvoice(payment models.Payment) albyInvoice {
+	invoice := albyInvoice{
+		Amount:         payment.Amount / 1000,
+		CreatedAt:      payment.CreatedAt,
+		CreationDate:   payment.CreatedAt.Unix(),
+		Currency:       "BTC",
+		Identifier:     payment.Hash,
+		Memo:           payment.Description,
+		PaymentHash:    payment.Hash,
+		PaymentRequest: payment.Bolt11,
+		RHashStr:       payment.Hash,
+		Settled:        !payment.Pending,
+		State:          "CREATED",
+		Type:           "incoming",
+	}
+	if payment.Amount < 0 {
+		invoice.Type = "outgoing"
+		invoice.Amount = -payment.Amount / 1000
+		invoice.Fee = payment.Fee / 1000
+		invoice.State = "PENDING"
+	} else {
+		expires := payment.CreatedAt.Add(services.DefaultInvoiceExpiry)
+		invoice.ExpiresAt = &expires
+		invoice.Expiry = int64(services.DefaultInvoiceExpiry.Seconds())
+	}
+	invoice.Value = invoice.Amount
+	if !payment.Pending {
+		settled := payment.UpdatedAt
+		invoice.SettledAt = &settled
+		invoice.Preimage = string(payment.Preimage)
+		invoice.State = "SETTLED"
+	}
+	return invoice
+}
+
+// AlbyInvoices lists the invoices on GET and creates one on POST, as in Alby.
+func AlbyInvoices(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		albyCreateInvoice(w, r)
+		return
+	}
+	albyListInvoices(w, r, "")
+}
+
+func AlbyIncomingInvoices(w http.ResponseWriter, r *http.Request) {
+	albyListInvoices(w, r, "amount > 0")
+}
+
+func AlbyOutgoingInvoices(w http.ResponseWriter, r *http.Request) {
+	albyListInvoices(w, r, "amount < 0")
+}
+
+func albyListInvoices(w http.ResponseWriter, r *http.Request, condition string) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	items := 25
+	if i, err := strconv.Atoi(r.URL.Query().Get("items")); err == nil && i > 0 && i <= 100 {
+		items = i
+	}
+	page := 1
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		page = p
+	}
+
+	query := storage.DB.Where("wallet_id = ?", wallet.ID)
+	if condition != "" {
+		query = query.Where(condition)
+	}
+	var payments []models.Payment
+	if err := query.Order("created_at desc").Limit(items).Offset((page - 1) * items).
+		Find(&payments).Error; err != nil {
+		SendAlbyError(w, 500, "failed to load invoices")
+		return
+	}
+
+	invoices := make([]albyInvoice, len(payments))
+	for i, payment := range payments {
+		invoices[i] = toAlbyInvoice(payment)
+	}
+	sendAlby(w, 200, invoices)
+}
+
+func albyCreateInvoice(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	var params struct {
+		Amount          int64  `json:"amount"` // sat
+		Description     string `json:"description"`
+		Memo            string `json:"memo"`
+		DescriptionHash string `json:"description_hash"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Amount < 0 {
+		SendAlbyError(w, 400, "invalid request body")
+		return
+	}
+	if params.Description == "" {
+		params.Description = params.Memo
+	}
+
+	invoice := services.CreateInvoiceParams{
+		InvoiceParams: rp.InvoiceParams{
+			Msatoshi:    params.Amount * 1000,
+			Description: params.Description,
+		},
+		Tag: "alby",
+	}
+	if params.DescriptionHash != "" {
+		hash, err := hex.DecodeString(params.DescriptionHash)
+		if err != nil || len(hash) != 32 {
+			SendAlbyError(w, 400, "invalid description_hash")
+			return
+		}
+		invoice.DescriptionHash = hash
+	}
+
+	payment, err := services.CreateInvoice(r.Context(), wallet.ID, invoice)
+	if err != nil {
+		SendAlbyError(w, 400, "failed to create invoice: "+err.Error())
+		return
+	}
+
+	sendAlby(w, 201, struct {
+		ExpiresAt      time.Time `json:"expires_at"`
+		PaymentHash    string    `json:"payment_hash"`
+		PaymentRequest string    `json:"payment_request"`
+	}{payment.CreatedAt.Add(services.DefaultInvoiceExpiry), payment.Hash, payment.Bolt11})
+}
+
+func AlbyGetInvoice(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	payment, err := storage.Default.GetPayment(wallet.ID, mux.Vars(r)["hash"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		SendAlbyError(w, 404, "no such invoice")
+		return
+	} else if err != nil {
+		SendAlbyError(w, 500, "failed to load invoice")
+		return
+	}
+
+	sendAlby(w, 200, toAlbyInvoice(*payment))
+}
+
+func AlbyPayBolt11(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	if r.Context().Value("permission").(string) != "admin" {
+		SendAlbyError(w, 401, "paying needs the admin key")
+		return
+	}
+
+	var params struct {
+		Invoice string `json:"invoice"`
+		Amount  int64  `json:"amount"` // sat, for invoices without one
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Invoice == "" {
+		SendAlbyError(w, 400, "invalid request body")
+		return
+	}
+	inv, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		SendAlbyError(w, 400, "invalid invoice")
+		return
+	}
+
+	payment := services.PayInvoiceParams{
+		PaymentParams: rp.PaymentParams{Invoice: params.Invoice},
+		Tag:           "alby",
+	}
+	if inv.MSatoshi == 0 {
+		payment.CustomAmount = params.Amount * 1000
+	}
+	if _, err := services.PayInvoice(r.Context(), wallet.ID, payment); err != nil {
+		switch {
+		case errors.Is(err, services.ErrMaintenance):
+			SendAlbyError(w, 503, err.Error())
+		case strings.Contains(err.Error(), "insufficient balance"):
+			SendAlbyError(w, 400, "not enough balance")
+		default:
+			SendAlbyError(w, 400, "payment failed: "+err.Error())
+		}
+		return
+	}
+
+	paid, err := services.WaitForPayment(wallet.ID, inv.PaymentHash, AlbyPaymentTimeout)
+	if err != nil {
+		SendAlbyError(w, 400, "payment failed")
+		return
+	}
+
+	preimage := ""
+	if !paid.Pending {
+		preimage = string(paid.Preimage)
+	}
+	sendAlby(w, 200, struct {
+		Amount          int64  `json:"amount"`
+		Description     string `json:"description"`
+		Destination     string `json:"destination"`
+		Fee             int64  `json:"fee"`
+		PaymentHash     string `json:"payment_hash"`
+		PaymentPreimage string `json:"payment_preimage"`
+		PaymentRequest  string `json:"payment_request"`
+	}{-paid.Amount / 1000, paid.Description, inv.Payee, paid.Fee / 1000,
+		paid.Hash, preimage, paid.Bolt11})
+}
+
+// AlbyKeysend is not supported, it needs a node of our own.
+func AlbyKeysend(w http.ResponseWriter, r *http.Request) {
+	SendAlbyError(w, 400, "keysend is not supported")
+}
+
+func sendAlby(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
@@ -6,6 +6,10 @@ import (
 	"github.com/lnbits/infinity/utils"
 )
 
+// BasePath is the prefix (from BASE_URL) the server is mounted under, to be
+// added to the urls we give out. request paths don't have it.
+var BasePath string
+
 func SendJSON(w http.ResponseWriter, value interface{}) error {
 	jsonb, err := utils.JSONMarshal(value)
 	if err != nil {
@@ -0,0 +1,299 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"gorm.io/gorm/clause"
+)
+
+// the admin can upload a logo and custom CSS and define color themes besides
+// the ones built into the client. they are kept in the database and the client
+// gets the logo at /branding/logo and the CSS, with the rules for the themes
+// after it, at /branding/custom.css.
+
+var brandingAssets = map[string]struct {
+	maxSize      int64
+	contentTypes []string
+}{
+	"logo": {1 << 20, []string{"image/png", "image/jpeg", "image/webp", "image/gif", "image/svg+xml"}},
+	"css":  {256 << 10, []string{"text/css"}},
+}
+
+// the same colors the built-in themes have
+var themeColors = []string{"primary", "secondary", "dark", "info", "marginal-bg", "marginal-text"}
+
+var (
+	themeNameValidator  = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+	themeColorValidator = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|(rgb|hsl)a?\([0-9., %]+\)|[a-z]{3,20})$`)
+)
+
+// Branding returns what the admin has customized.
+func Branding(w http.ResponseWriter, r *http.Request) {
+	var assets []models.BrandingAsset
+	if err := storage.DB.Select("name, content_type, updated_at").Find(&assets).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+	var themes []models.Theme
+	if err := storage.DB.Order("name").Find(&themes).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		Assets []models.BrandingAsset `json:"assets"`
+		Themes []models.Theme         `json:"themes"`
+	}{assets, themes})
+}
+
+// UploadBrandingAsset replaces the logo or the custom CSS with the request body.
+func UploadBrandingAsset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiutils.SendJSONError(w, 405, "use POST")
+		return
+	}
+
+	name := mux.Vars(r)["asset"]
+	spec, ok := brandingAssets[name]
+	if !ok {
+		apiutils.SendJSONError(w, 404, "unknown asset '%s', must be logo or css", name)
+		return
+	}
+
+	contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	allowed := false
+	for _, ct := range spec.contentTypes {
+		allowed = allowed || ct == contentType
+	}
+	if !allowed {
+		apiutils.SendJSONError(w, 415, "Content-Type must be one of %s",
+			strings.Join(spec.contentTypes, ", "))
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, spec.maxSize+1))
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "failed to read body: %s", err.Error())
+		return
+	}
+	if int64(len(data)) > spec.maxSize {
+		apiutils.SendJSONError(w, 413, "%s can't be bigger than %d bytes", name, spec.maxSize)
+		return
+	}
+	if len(data) == 0 {
+		apiutils.SendJSONError(w, 400, "empty body")
+		return
+	}
+
+	asset := models.BrandingAsset{Name: name, ContentType: contentType, Data: data}
+	if err := storage.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&asset).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, asset)
+}
+
+// DeleteBrandingAsset goes back to the default logo or to no custom CSS.
+func DeleteBrandingAsset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiutils.SendJSONError(w, 405, "use POST")
+		return
+	}
+
+	name := mux.Vars(r)["asset"]
+	if _, ok := brandingAssets[name]; !ok {
+		apiutils.SendJSONError(w, 404, "unknown asset '%s', must be logo or css", name)
+		return
+	}
+	if err := storage.DB.Where("name = ?", name).Delete(&models.BrandingAsset{}).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+// SetTheme creates or replaces a theme, given its colors as
+// `{"primary": "#...", ...}`.
+func SetTheme(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiutils.SendJSONError(w, 405, "use POST")
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if !themeNameValidator.MatchString(name) {
+		apiutils.SendJSONError(w, 400, "theme name must be up to 32 lowercase letters, digits or dashes")
+		return
+	}
+
+	var colors map[string]string
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&colors); err != nil {
+		apiutils.SendJSONError(w, 400, "failed to read colors: %s", err.Error())
+		return
+	}
+	if colors["primary"] == "" {
+		apiutils.SendJSONError(w, 400, "a theme needs at least a primary color")
+		return
+	}
+
+	theme := models.Theme{Name: name, Colors: make(models.JSONObject)}
+	for key, value := range colors {
+		if !isThemeColor(key) {
+			apiutils.SendJSONError(w, 400, "unknown color '%s', must be one of %s",
+				key, strings.Join(themeColors, ", "))
+			return
+		}
+		if !themeColorValidator.MatchString(value) {
+			apiutils.SendJSONError(w, 400, "invalid %s color '%s'", key, value)
+			return
+		}
+		theme.Colors[key] = value
+	}
+
+	if err := storage.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&theme).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, theme)
+}
+
+// DeleteTheme removes a theme. clients that were using it go back to the
+// default colors.
+func DeleteTheme(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiutils.SendJSONError(w, 405, "use POST")
+		return
+	}
+
+	if err := storage.DB.Where("name = ?", mux.Vars(r)["name"]).
+		Delete(&models.Theme{}).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func isThemeColor(name string) bool {
+	for _, color := range themeColors {
+		if color == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Logo serves the uploaded logo.
+func Logo(w http.ResponseWriter, r *http.Request) {
+	var asset models.BrandingAsset
+	result := storage.DB.Where("name = ?", "logo").Limit(1).Find(&asset)
+	if result.Error != nil {
+		http.Error(w, "database error", 500)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// an svg opened directly shouldn't run anything
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("Content-Type", asset.ContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", asset.UpdatedAt, bytes.NewReader(asset.Data))
+}
+
+// CustomCSS serves the uploaded CSS followed by the rules for the themes.
+func CustomCSS(w http.ResponseWriter, r *http.Request) {
+	var asset models.BrandingAsset
+	if err := storage.DB.Where("name = ?", "css").Limit(1).Find(&asset).Error; err != nil {
+		http.Error(w, "database error", 500)
+		return
+	}
+	var themes []models.Theme
+	if err := storage.DB.Order("name").Find(&themes).Error; err != nil {
+		http.Error(w, "database error", 500)
+		return
+	}
+
+	modified := asset.UpdatedAt
+	var css bytes.Buffer
+	css.Write(asset.Data)
+	for _, theme := range themes {
+		if theme.UpdatedAt.After(modified) {
+			modified = theme.UpdatedAt
+		}
+		css.WriteString("\n")
+		css.WriteString(themeCSS(theme))
+	}
+
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", modified, bytes.NewReader(css.Bytes()))
+}
+
+// themeCSS makes the same rules the client stylesheet has for its themes.
+func themeCSS(theme models.Theme) string {
+	names := make([]string, 0, len(theme.Colors))
+	for name := range theme.Colors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var css strings.Builder
+	selector := fmt.Sprintf("[data-theme='%s']", theme.Name)
+	for _, name := range names {
+		color, _ := theme.Colors[name].(string)
+		if !themeColorValidator.MatchString(color) {
+			continue
+		}
+		switch name {
+		case "dark":
+			fmt.Fprintf(&css, "%[1]s .q-drawer--dark, body%[1]s.body--dark, %[1]s .q-menu--dark { background: %[2]s !important; }\n",
+				selector, color)
+		case "info":
+			fmt.Fprintf(&css, "%[1]s .q-card--dark, %[1]s .q-stepper--dark { background: %[2]s !important; }\n",
+				selector, color)
+		}
+		fmt.Fprintf(&css, "%[1]s .bg-%[2]s { background: %[3]s !important; }\n", selector, name, color)
+		fmt.Fprintf(&css, "%[1]s .text-%[2]s { color: %[3]s !important; }\n", selector, name, color)
+	}
+	return css.String()
+}
+
+type ClientTheme struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// ClientBranding is what the client needs to know to show the branding: where
+// the logo is, if there is one, and the extra themes.
+func ClientBranding() (logo string, themes []ClientTheme) {
+	var asset models.BrandingAsset
+	if storage.DB.Select("updated_at").Where("name = ?", "logo").
+		Limit(1).Find(&asset).RowsAffected > 0 {
+		logo = fmt.Sprintf("branding/logo?v=%d", asset.UpdatedAt.Unix())
+	}
+
+	var list []models.Theme
+	storage.DB.Order("name").Find(&list)
+	for _, theme := range list {
+		color, _ := theme.Colors["primary"].(string)
+		themes = append(themes, ClientTheme{theme.Name, color})
+	}
+	return logo, themes
+}
@@ -0,0 +1,323 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/cashu"
+	"github.com/lnbits/infinity/models"
+)
+
+// the HTTP API of the Cashu mint under /cashu, which is the mint URL given to
+// wallets. it needs no key, the ecash itself is the authorization, and is open
+// to any origin so web wallets can use it.
+
+// CashuVersion is the version given by /cashu/v1/info.
+var CashuVersion string
+
+func sendCashu(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// SendCashuError sends errors as the detail and code of NUT-00.
+func SendCashuError(w http.ResponseWriter, err error) {
+	status := 400
+	var cerr *cashu.Error
+	if !errors.As(err, &cerr) {
+		status = 500
+		cerr = &cashu.Error{Detail: err.Error()}
+	} else if cerr == cashu.ErrDisabled {
+		status = 404
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(cerr)
+}
+
+// cashuCORS answers preflight requests, it is true when there is nothing else
+// to do.
+func cashuCORS(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(204)
+		return true
+	}
+	return false
+}
+
+// readCashu decodes a request body, answering with an error when it can't.
+func readCashu(w http.ResponseWriter, r *http.Request, params interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		SendCashuError(w, &cashu.Error{Detail: "invalid request: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+func CashuInfo(w http.ResponseWriter, r *http.Request) {
+	if cashuCORS(w, r) {
+		return
+	}
+	if !cashu.Enabled() {
+		SendCashuError(w, cashu.ErrDisabled)
+		return
+	}
+
+	methods := []map[string]interface{}{{"method": "bolt11", "unit": cashu.Unit}}
+	sendCashu(w, map[string]interface{}{
+		"name":    cashu.Name,
+		"version": "infinity/" + CashuVersion,
+		"nuts": map[string]interface{}{
+			"4": map[string]interface{}{"methods": methods, "disabled": false},
+			"5": map[string]interface{}{"methods": methods, "disabled": false},
+			"7": map[string]interface{}{"supported": true},
+		},
+	})
+}
+
+type cashuKeyset struct {
+	ID     string            `json:"id"`
+	Unit   string            `json:"unit"`
+	Active bool              `json:"active,omitempty"`
+	Keys   map[string]string `json:"keys,omitempty"`
+}
+
+func CashuKeys(w http.ResponseWriter, r *http.Request) {
+	if cashuCORS(w, r) {
+		return
+	}
+	if !cashu.Enabled() {
+		SendCashuError(w, cashu.ErrDisabled)
+		return
+	}
+
+	keysets := cashu.Keysets()
+	if id, ok := mux.Vars(r)["id"]; ok {
+		ks := cashu.GetKeyset(id)
+		if ks == nil {
+			SendCashuError(w, cashu.ErrUnknownKeyset)
+			return
+		}
+		keysets = []*cashu.Keyset{ks}
+	}
+
+	resp := struct {
+		Keysets []cashuKeyset `json:"keysets"`
+	}{make([]cashuKeyset, len(keysets))}
+	for i, ks := range keysets {
+		resp.Keysets[i] = cashuKeyset{ID: ks.ID, Unit: ks.Unit, Keys: ks.PublicKeys()}
+	}
+	sendCashu(w, resp)
+}
+
+func CashuKeysets(w http.ResponseWriter, r *http.Request) {
+	if cashuCORS(w, r) {
+		return
+	}
+	if !cashu.Enabled() {
+		SendCashuError(w, cashu.ErrDisabled)
+		return
+	}
+
+	keysets := cashu.Keysets()
+	resp := struct {
+		Keysets []cashuKeyset `json:"keysets"`
+	}{make([]cashuKeyset, len(keysets))}
+	for i, ks := range keysets {
+		resp.Keysets[i] = cashuKeyset{ID: ks.ID, Unit: ks.Unit, Active: true}
+	}
+	sendCashu(w, resp)
+}
+
+type cashuMintQuote struct {
+	Quote   string `json:"quote"`
+	Request string `json:"request"`
+	Paid    bool   `json:"paid"`
+	State   string `json:"state"`
+	Expiry  int64  `json:"expiry"`
+}
+
+func toCashuMintQuote(quote *models.CashuQuote) cashuMintQuote {
+	return cashuMintQuote{
+		Quote:   quote.ID,
+		Request: quote.Request,
+		Paid:    quote.State == cashu.StatePaid || quote.State == cashu.StateIssued,
+		State:   quote.State,
+		Expiry:  quote.Expiry.Unix(),
+	}
+}
+
+func CashuMintQuote(w http.ResponseWriter, r *http.Request) {
+	if cashuCORS(w, r) {
+		return
+	}
+
+	var quote *models.CashuQuote
+	var err error
+	if id, ok := mux.Vars(r)["quote"]; ok {
+		quote, err = cashu.GetMintQuote(id)
+	} else {
+		var params struct {
+			Amount int64  `json:"amount"`
+			Unit   string `json:"unit"`
+		}
+		if !readCashu(w, r, &params) {
+			return
+		}
+		quote, err = cashu.CreateMintQuote(r.Context(), params.Amount, params.Unit)
+	}
+	if err != nil {
+		SendCashuError(w, err)
+		return
+	}
+	sendCashu(w, toCashuMintQuote(quote))
+}
+
+func CashuMint(w http.ResponseWriter, r *http.Request) {
+	if cashuCORS(w, r) {
+		return
+	}
+
+	var params struct {
+		Quote   string                 `json:"quote"`
+		Outputs []cashu.BlindedMessage `json:"outputs"`
+	}
+	if !readCashu(w, r, &params) {
+		return
+	}
+	signatures, err := cashu.Mint(params.Quote, params.Outputs)
+	if err != nil {
+		SendCashuError(w, err)
+		return
+	}
+	sendCashu(w, struct {
+		Signatures []cashu.BlindSignature `json:"signatures"`
+	}{signatures})
+}
+
+type cashuMeltQuote struct {
+	Quote           string  `json:"quote"`
+	Amount          int64   `json:"amount"`
+	FeeReserve      int64   `json:"fee_reserve"`
+	Paid            bool    `json:"paid"`
+	State           string  `json:"state"`
+	Expiry          int64   `json:"expiry"`
+	PaymentPreimage *string `json:"payment_preimage"`
+}
+
+func toCashuMeltQuote(quote *models.CashuQuote) cashuMeltQuote {
+	resp := cashuMeltQuote{
+		Quote:      quote.ID,
+		Amount:     quote.Amount,
+		FeeReserve: quote.FeeReserve,
+		Paid:       quote.State == cashu.StatePaid,
+		State:      quote.State,
+		Expiry:     quote.Expiry.Unix(),
+	}
+	if quote.Preimage != "" {
+		resp.PaymentPreimage = &quote.Preimage
+	}
+	return resp
+}
+
+func CashuMeltQuote(w http.ResponseWriter, r *http.Request) {
+	if cashuCORS(w, r) {
+		return
+	}
+
+	var quote *models.CashuQuote
+	var err error
+	if id, ok := mux.Vars(r)["quote"]; ok {
+		quote, err = cashu.GetMeltQuote(id)
+	} else {
+		var params struct {
+			Request string `json:"request"`
+			Unit    string `json:"unit"`
+		}
+		if !readCashu(w, r, &params) {
+			return
+		}
+		quote, err = cashu.CreateMeltQuote(params.Request, params.Unit)
+	}
+	if err != nil {
+		SendCashuError(w, err)
+		return
+	}
+	sendCashu(w, toCashuMeltQuote(quote))
+}
+
+func CashuMelt(w http.ResponseWriter, r *http.Request) {
+	if cashuCORS(w, r) {
+		return
+	}
+
+	var params struct {
+		Quote  string        `json:"quote"`
+		Inputs []cashu.Proof `json:"inputs"`
+	}
+	if !readCashu(w, r, &params) {
+		return
+	}
+	quote, err := cashu.Melt(r.Context(), params.Quote, params.Inputs)
+	if err != nil {
+		SendCashuError(w, err)
+		return
+	}
+	sendCashu(w, toCashuMeltQuote(quote))
+}
+
+func CashuSwap(w http.ResponseWriter, r *http.Request) {
+	if cashuCORS(w, r) {
+		return
+	}
+
+	var params struct {
+		Inputs  []cashu.Proof          `json:"inputs"`
+		Outputs []cashu.BlindedMessage `json:"outputs"`
+	}
+	if !readCashu(w, r, &params) {
+		return
+	}
+	signatures, err := cashu.Swap(params.Inputs, params.Outputs)
+	if err != nil {
+		SendCashuError(w, err)
+		return
+	}
+	sendCashu(w, struct {
+		Signatures []cashu.BlindSignature `json:"signatures"`
+	}{signatures})
+}
+
+func CashuCheckState(w http.ResponseWriter, r *http.Request) {
+	if cashuCORS(w, r) {
+		return
+	}
+	if !cashu.Enabled() {
+		SendCashuError(w, cashu.ErrDisabled)
+		return
+	}
+
+	var params struct {
+		Ys []string `json:"Ys"`
+	}
+	if !readCashu(w, r, &params) {
+		return
+	}
+	if len(params.Ys) > 1000 {
+		SendCashuError(w, &cashu.Error{Detail: "too many Ys"})
+		return
+	}
+	states, err := cashu.CheckState(params.Ys)
+	if err != nil {
+		SendCashuError(w, err)
+		return
+	}
+	sendCashu(w, struct {
+		States []cashu.ProofState `json:"states"`
+	}{states})
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/lnbits/infinity/api/apiutils"
+)
+
+// profiles and runtime numbers for diagnosing a live instance, behind the admin
+// key like the rest of /api/admin/.
+
+var started = time.Now()
+
+// Pprof serves the net/http/pprof handlers. it must be mounted with the path
+// stripped down to /debug/pprof/, which is what they expect.
+func Pprof() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+type runtimeStats struct {
+	GoVersion  string    `json:"goVersion"`
+	CPUs       int       `json:"cpus"`
+	Started    time.Time `json:"started"`
+	Uptime     string    `json:"uptime"`
+	Goroutines int       `json:"goroutines"`
+	Sys        uint64    `json:"sys"`
+	Heap       heapStats `json:"heap"`
+	GC         gcStats   `json:"gc"`
+}
+
+type heapStats struct {
+	Alloc    uint64 `json:"alloc"`
+	InUse    uint64 `json:"inUse"`
+	Idle     uint64 `json:"idle"`
+	Released uint64 `json:"released"`
+	Objects  uint64 `json:"objects"`
+}
+
+type gcStats struct {
+	Count       uint32     `json:"count"`
+	Last        *time.Time `json:"last"`
+	LastPause   string     `json:"lastPause"`
+	TotalPause  string     `json:"totalPause"`
+	CPUFraction float64    `json:"cpuFraction"`
+	NextTarget  uint64     `json:"nextTarget"`
+}
+
+func RuntimeStats(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	gc := gcStats{
+		Count:       mem.NumGC,
+		TotalPause:  time.Duration(mem.PauseTotalNs).String(),
+		CPUFraction: mem.GCCPUFraction,
+		NextTarget:  mem.NextGC,
+	}
+	if mem.NumGC > 0 {
+		last := time.Unix(0, int64(mem.LastGC))
+		gc.Last = &last
+		gc.LastPause = time.Duration(mem.PauseNs[(mem.NumGC+255)%256]).String()
+	}
+
+	apiutils.SendJSON(w, runtimeStats{
+		GoVersion:  runtime.Version(),
+		CPUs:       runtime.NumCPU(),
+		Started:    started,
+		Uptime:     time.Since(started).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		Sys:        mem.Sys,
+		Heap: heapStats{
+			Alloc:    mem.HeapAlloc,
+			InUse:    mem.HeapInuse,
+			Idle:     mem.HeapIdle,
+			Released: mem.HeapReleased,
+			Objects:  mem.HeapObjects,
+		},
+		GC: gc,
+	})
+}
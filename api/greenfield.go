@@ -0,0 +1,310 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	rp "github.com/lnbits/relampago"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+// the lightning part of BTCPay's Greenfield API, for a store:
+// /api/v1/stores/{store}/lightning/BTC/..., so what was made for BTCPay can use
+// a wallet here with its key as the API key (`Authorization: token <key>`).
+// the store id can be anything, the key says which wallet it is. amounts are
+// strings of msat, times are unix timestamps and invoices are known by their
+// payment hash.
+
+// GreenfieldPaymentTimeout is how long invoices/pay waits for a payment to
+// settle before answering that it is still pending.
+var GreenfieldPaymentTimeout = time.Second * 45
+
+// SendGreenfieldError sends errors the way Greenfield clients understand them.
+func SendGreenfieldError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{code, message})
+}
+
+// greenfieldAmount is a LightMoney, msat in a string (clients also send numbers).
+type greenfieldAmount int64
+
+func (a greenfieldAmount) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatInt(int64(a), 10) + `"`), nil
+}
+
+func (a *greenfieldAmount) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*a = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*a = greenfieldAmount(v)
+	return nil
+}
+
+// greenfieldWallet checks the crypto code, only BTC exists here.
+func greenfieldWallet(w http.ResponseWriter, r *http.Request) (*models.Wallet, bool) {
+	if !strings.EqualFold(mux.Vars(r)["cryptoCode"], "BTC") {
+		SendGreenfieldError(w, 404, "unsupported-crypto-code", "only BTC is supported")
+		return nil, false
+	}
+	return r.Context().Value("wallet").(*models.Wallet), true
+}
+
+func GreenfieldInfo(w http.ResponseWriter, r *http.Request) {
+	if _, ok := greenfieldWallet(w, r); !ok {
+		return
+	}
+
+	sendGreenfield(w, 200, struct {
+		NodeURIs            []string `json:"nodeURIs"`
+		BlockHeight         int      `json:"blockHeight"`
+		Alias               string   `json:"alias"`
+		Color               string   `json:"color"`
+		Version             string   `json:"version"`
+		PeersCount          int      `json:"peersCount"`
+		ActiveChannelsCount int      `json:"activeChannelsCount"`
+	}{NodeURIs: []string{}, Alias: getSiteTitle()})
+}
+
+func GreenfieldBalance(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := greenfieldWallet(w, r)
+	if !ok {
+		return
+	}
+
+	balance, err := services.LoadWalletBalance(wallet.ID)
+	if err != nil {
+		SendGreenfieldError(w, 500, "generic-error", "failed to load balance")
+		return
+	}
+
+	sendGreenfield(w, 200, map[string]interface{}{
+		"offchain": map[string]interface{}{
+			"local":   greenfieldAmount(balance),
+			"remote":  nil,
+			"opening": nil,
+			"closing": nil,
+		},
+	})
+}
+
+type greenfieldInvoice struct {
+	ID             string           `json:"id"`
+	Status         string           `json:"status"` // Unpaid, Paid or Expired
+	BOLT11         string           `json:"BOLT11"`
+	PaidAt         *int64           `json:"paidAt"`
+	ExpiresAt      int64            `json:"expiresAt"`
+	Amount         greenfieldAmount `json:"amount"`
+	AmountReceived greenfieldAmount `json:"amountReceived"`
+	PaymentHash    string           `json:"paymentHash"`
+	Preimage       *string          `json:"preimage"`
+}
+
+func toGreenfieldInvoice(payment models.Payment) greenfieldInvoice {
+	expires := payment.CreatedAt.Add(services.DefaultInvoiceExpiry)
+	invoice := greenfieldInvoice{
+		ID:          payment.Hash,
+		Status:      "Unpaid",
+		BOLT11:      payment.Bolt11,
+		ExpiresAt:   expires.Unix(),
+		Amount:      greenfieldAmount(payment.Amount),
+		PaymentHash: payment.Hash,
+	}
+	if !payment.Pending {
+		paidAt := payment.UpdatedAt.Unix()
+		preimage := string(payment.Preimage)
+		invoice.Status = "Paid"
+		invoice.PaidAt = &paidAt
+		invoice.AmountReceived = greenfieldAmount(payment.Amount)
+		invoice.Preimage = &preimage
+	} else if time.Now().After(expires) {
+		invoice.Status = "Expired"
+	}
+	return invoice
+}
+
+func GreenfieldCreateInvoice(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := greenfieldWallet(w, r)
+	if !ok {
+		return
+	}
+
+	var params struct {
+		Amount              greenfieldAmount `json:"amount"`
+		Description         string           `json:"description"`
+		DescriptionHashOnly bool             `json:"descriptionHashOnly"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Amount < 0 {
+		SendGreenfieldError(w, 400, "generic-error", "invalid request body")
+		return
+	}
+
+	invoice := services.CreateInvoiceParams{
+		InvoiceParams: rp.InvoiceParams{
+			Msatoshi:    int64(params.Amount),
+			Description: params.Description,
+		},
+		Tag: "greenfield",
+	}
+	if params.DescriptionHashOnly {
+		hash := sha256.Sum256([]byte(params.Description))
+		invoice.DescriptionHash = hash[:]
+	}
+
+	payment, err := services.CreateInvoice(r.Context(), wallet.ID, invoice)
+	if err != nil {
+		SendGreenfieldError(w, 400, "invoice-error", "failed to create invoice: "+err.Error())
+		return
+	}
+
+	sendGreenfield(w, 200, toGreenfieldInvoice(payment))
+}
+
+func GreenfieldGetInvoice(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := greenfieldWallet(w, r)
+	if !ok {
+		return
+	}
+
+	var payment models.Payment
+	result := storage.DB.Where("wallet_id = ? AND hash = ? AND amount > 0", wallet.ID, mux.Vars(r)["id"]).
+		Limit(1).Find(&payment)
+	if result.Error != nil {
+		SendGreenfieldError(w, 500, "generic-error", "failed to load invoice")
+		return
+	}
+	if result.RowsAffected == 0 {
+		SendGreenfieldError(w, 404, "invoice-not-found", "no such invoice")
+		return
+	}
+
+	sendGreenfield(w, 200, toGreenfieldInvoice(payment))
+}
+
+type greenfieldPayment struct {
+	ID          string           `json:"id"`
+	Status      string           `json:"status"` // Pending or Complete, failed ones are gone
+	BOLT11      string           `json:"BOLT11"`
+	PaymentHash string           `json:"paymentHash"`
+	Preimage    *string          `json:"preimage"`
+	CreatedAt   int64            `json:"createdAt"`
+	TotalAmount greenfieldAmount `json:"totalAmount"`
+	FeeAmount   greenfieldAmount `json:"feeAmount"`
+}
+
+func toGreenfieldPayment(payment models.Payment) greenfieldPayment {
+	p := greenfieldPayment{
+		ID:          payment.Hash,
+		Status:      "Pending",
+		BOLT11:      payment.Bolt11,
+		PaymentHash: payment.Hash,
+		CreatedAt:   payment.CreatedAt.Unix(),
+		TotalAmount: greenfieldAmount(-payment.Amount + payment.Fee),
+		FeeAmount:   greenfieldAmount(payment.Fee),
+	}
+	if !payment.Pending {
+		preimage := string(payment.Preimage)
+		p.Status = "Complete"
+		p.Preimage = &preimage
+	}
+	return p
+}
+
+func GreenfieldPayInvoice(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := greenfieldWallet(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Context().Value("permission").(string) != "admin" {
+		SendGreenfieldError(w, 403, "missing-permission", "paying needs the admin key")
+		return
+	}
+
+	var params struct {
+		BOLT11 string           `json:"BOLT11"`
+		Amount greenfieldAmount `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.BOLT11 == "" {
+		SendGreenfieldError(w, 400, "generic-error", "invalid request body")
+		return
+	}
+	inv, err := decodepay.Decodepay(params.BOLT11)
+	if err != nil {
+		SendGreenfieldError(w, 400, "generic-error", "invalid BOLT11")
+		return
+	}
+
+	payment := services.PayInvoiceParams{
+		PaymentParams: rp.PaymentParams{Invoice: params.BOLT11},
+		Tag:           "greenfield",
+	}
+	if inv.MSatoshi == 0 {
+		payment.CustomAmount = int64(params.Amount)
+	}
+	if _, err := services.PayInvoice(r.Context(), wallet.ID, payment); err != nil {
+		if errors.Is(err, services.ErrMaintenance) {
+			SendGreenfieldError(w, 503, "service-unavailable", err.Error())
+			return
+		}
+		SendGreenfieldError(w, 400, "generic-error", "payment failed: "+err.Error())
+		return
+	}
+
+	paid, err := services.WaitForPayment(wallet.ID, inv.PaymentHash, GreenfieldPaymentTimeout)
+	if err != nil {
+		SendGreenfieldError(w, 400, "generic-error", "payment failed")
+		return
+	}
+
+	status := 200
+	if paid.Pending {
+		status = 202
+	}
+	sendGreenfield(w, status, toGreenfieldPayment(paid))
+}
+
+func GreenfieldGetPayment(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := greenfieldWallet(w, r)
+	if !ok {
+		return
+	}
+
+	var payment models.Payment
+	result := storage.DB.Where("wallet_id = ? AND hash = ? AND amount < 0", wallet.ID, mux.Vars(r)["hash"]).
+		Order("created_at desc").Limit(1).Find(&payment)
+	if result.Error != nil {
+		SendGreenfieldError(w, 500, "generic-error", "failed to load payment")
+		return
+	}
+	if result.RowsAffected == 0 {
+		SendGreenfieldError(w, 404, "payment-not-found", "no such payment")
+		return
+	}
+
+	sendGreenfield(w, 200, toGreenfieldPayment(payment))
+}
+
+func sendGreenfield(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/lightning"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/relampago"
+)
+
+// probes for orchestrators. /healthz only says the process is serving requests,
+// /readyz also checks the database and the lightning backend and returns 503 if
+// any of them doesn't answer within ReadinessTimeout.
+
+var ReadinessTimeout = 5 * time.Second
+
+type readiness struct {
+	Ok        bool   `json:"ok"`
+	Database  string `json:"database"`
+	Lightning string `json:"lightning"`
+}
+
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	apiutils.SendJSON(w, struct {
+		Ok bool `json:"ok"`
+	}{true})
+}
+
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ReadinessTimeout)
+	defer cancel()
+
+	status := readiness{Ok: true, Database: "ok", Lightning: "ok"}
+	if err := storage.Ping(ctx); err != nil {
+		status.Ok = false
+		status.Database = err.Error()
+	}
+	if _, err := lightningInfo(ctx); err != nil {
+		status.Ok = false
+		status.Lightning = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ok {
+		w.WriteHeader(503)
+	}
+	apiutils.SendJSON(w, status)
+}
+
+// the backends don't take a context, so we just stop waiting on timeout.
+func lightningInfo(ctx context.Context) (relampago.WalletInfo, error) {
+	if lightning.LN == nil {
+		return relampago.WalletInfo{}, errors.New("not connected")
+	}
+
+	type result struct {
+		info relampago.WalletInfo
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		info, err := lightning.LN.GetInfo()
+		done <- result{info, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.info, res.err
+	case <-ctx.Done():
+		return relampago.WalletInfo{}, errors.New("timed out")
+	}
+}
@@ -2,20 +2,36 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lnbits/infinity/events"
+	"github.com/lnbits/infinity/jobs"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/storage"
-	"github.com/lnbits/infinity/utils"
+	"github.com/lnbits/infinity/webhook"
 )
 
 var walletStreams = sync.Map{}
 
-var SiteTitle string
+// siteTitle can change on reload, it's the alias given to wallets.
+var siteTitle atomic.Value
+
+func SetSiteTitle(title string) {
+	siteTitle.Store(title)
+}
+
+func getSiteTitle() string {
+	title, _ := siteTitle.Load().(string)
+	return title
+}
+
+var PaymentsPageSize = 200
 
 var webhookClient = &http.Client{
 	Timeout: time.Second * 2,
@@ -34,29 +50,13 @@ func init() {
 
 			// webhook
 			if payment.Webhook != "" && payment.WebhookStatus == 0 {
-				j, _ := utils.JSONMarshal(payment)
-				b := bytes.NewBuffer(j)
-				resp, err := webhookClient.Post(payment.Webhook, "application/json", b)
-				var status int
-				if err != nil {
-					status = -1
-				} else {
-					status = resp.StatusCode
-				}
-				storage.DB.
-					Model(&payment).
-					Where(&payment).
-					Update("webhook_status", status)
+				jobs.Enqueue("webhook", webhookJob{payment.WalletID, payment.CheckingID})
 			}
 
 			// balanceNotify
-			var wallet models.Wallet
-			storage.DB.
-				Where("id = ?", payment.WalletID).
-				Where("balance_notify IS NOT NULL").
-				First(&wallet)
-			if wallet.BalanceNotify != "" {
-				go webhookClient.Post(wallet.BalanceNotify, "application/lnurl", nil)
+			if wallet, err := storage.Default.GetWallet(payment.WalletID); err == nil &&
+				wallet.BalanceNotify != "" {
+				jobs.Enqueue("balance_notify", wallet.BalanceNotify)
 			}
 		}
 	}()
@@ -70,19 +70,7 @@ func init() {
 
 			// webhook
 			if payment.Webhook != "" && payment.WebhookStatus == 0 {
-				j, _ := utils.JSONMarshal(payment)
-				b := bytes.NewBuffer(j)
-				resp, err := webhookClient.Post(payment.Webhook, "application/json", b)
-				var status int
-				if err != nil {
-					status = -1
-				} else {
-					status = resp.StatusCode
-				}
-				storage.DB.
-					Model(&payment).
-					Where(&payment).
-					Update("webhook_status", status)
+				jobs.Enqueue("webhook", webhookJob{payment.WalletID, payment.CheckingID})
 			}
 		}
 	}()
@@ -94,4 +82,83 @@ func init() {
 			go SendWalletSSE(payment.WalletID, "payment-failed", payment.CheckingID)
 		}
 	}()
+
+	jobs.Register("webhook", sendWebhook)
+	jobs.Register("balance_notify", sendBalanceNotify)
+}
+
+type webhookJob struct {
+	WalletID   string `json:"wallet_id"`
+	CheckingID string `json:"checking_id"`
+}
+
+// sendWebhook posts the payment to its webhook in its format, the payment is
+// loaded again so what is sent is always its latest state. the response status
+// is stored on the payment, -1 if there was none.
+func sendWebhook(ctx context.Context, payload json.RawMessage) error {
+	var job webhookJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	payment, err := storage.Default.GetPayment(job.WalletID, job.CheckingID)
+	if err != nil {
+		return fmt.Errorf("failed to load payment: %w", err)
+	}
+
+	data := webhook.Data{Event: "payment-sent", Payment: *payment}
+	if payment.Amount > 0 {
+		data.Event = "payment-received"
+	}
+	if wallet, err := storage.Default.GetWallet(payment.WalletID); err == nil {
+		data.WalletName = wallet.Name
+	}
+	body, contentType, err := webhook.Render(payment.WebhookFormat, data)
+	if err != nil {
+		storage.Default.SetWebhookStatus(payment.CheckingID, -1)
+		return fmt.Errorf("failed to render webhook: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", payment.Webhook, bytes.NewBuffer(body))
+	if err != nil {
+		storage.Default.SetWebhookStatus(payment.CheckingID, -1)
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		storage.Default.SetWebhookStatus(payment.CheckingID, -1)
+		return err
+	}
+	resp.Body.Close()
+	storage.Default.SetWebhookStatus(payment.CheckingID, resp.StatusCode)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func sendBalanceNotify(ctx context.Context, payload json.RawMessage) error {
+	var url string
+	if err := json.Unmarshal(payload, &url); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/lnurl")
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("balance notification returned %d", resp.StatusCode)
+	}
+	return nil
 }
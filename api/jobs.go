@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/jobs"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+)
+
+type jobView struct {
+	models.Job
+	Payload json.RawMessage `json:"payload"`
+}
+
+// ListJobs returns how many jobs there are in each status and the latest ones,
+// optionally filtered by `status` and `kind`. pass the id of the last job as
+// `before` to get the next page.
+func ListJobs(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	q := storage.DB.Model(&models.Job{})
+	if status := qs.Get("status"); status != "" {
+		q = q.Where("status = ?", status)
+	}
+	if kind := qs.Get("kind"); kind != "" {
+		q = q.Where("kind = ?", kind)
+	}
+	if before := qs.Get("before"); before != "" {
+		id, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			apiutils.SendJSONError(w, 400, "invalid before: %s", err.Error())
+			return
+		}
+		q = q.Where("id < ?", id)
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(qs.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	var list []models.Job
+	if err := q.Order("id desc").Limit(limit).Find(&list).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	var counts []struct {
+		Status string
+		Count  int64
+	}
+	if err := storage.DB.Model(&models.Job{}).Select("status, count(*) AS count").
+		Group("status").Scan(&counts).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	result := struct {
+		Counts map[string]int64 `json:"counts"`
+		Jobs   []jobView        `json:"jobs"`
+	}{
+		Counts: map[string]int64{
+			jobs.StatusPending: 0,
+			jobs.StatusRunning: 0,
+			jobs.StatusDone:    0,
+			jobs.StatusDead:    0,
+		},
+		Jobs: make([]jobView, len(list)),
+	}
+	for _, count := range counts {
+		result.Counts[count.Status] = count.Count
+	}
+	for i, job := range list {
+		result.Jobs[i] = jobView{job, json.RawMessage(job.Payload)}
+	}
+
+	apiutils.SendJSON(w, result)
+}
+
+// RetryJob makes a dead or pending job run again now.
+func RetryJob(w http.ResponseWriter, r *http.Request) {
+	jobAction(w, r, jobs.Retry)
+}
+
+// DeleteJob removes a job that isn't running.
+func DeleteJob(w http.ResponseWriter, r *http.Request) {
+	jobAction(w, r, jobs.Delete)
+}
+
+func jobAction(w http.ResponseWriter, r *http.Request, action func(uint) error) {
+	if r.Method != "POST" {
+		apiutils.SendJSONError(w, 405, "use POST")
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "invalid job id: %s", err.Error())
+		return
+	}
+
+	switch err := action(uint(id)); {
+	case err == jobs.ErrNotFound:
+		apiutils.SendJSONError(w, 404, "no such job, or it is in the wrong status")
+	case err != nil:
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+	default:
+		w.WriteHeader(200)
+	}
+}
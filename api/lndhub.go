@@ -0,0 +1,395 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	rp "github.com/lnbits/relampago"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+// an LNDhub-compatible API under /lndhub/ext/, so BlueWallet, Zeus and the
+// other wallets that speak it can use a wallet here. the login is "admin" or
+// "invoice" and the password the wallet key of that kind, which is also the
+// token they get back, like on LNbits: lndhub://admin:<adminkey>@<url>/lndhub/ext/.
+// with the invoice key payments can't be made.
+
+// LNDHubPaymentTimeout is how long payinvoice waits for a payment to settle
+// before answering, since LNDhub clients expect the preimage right away.
+var LNDHubPaymentTimeout = time.Second * 45
+
+// SendLNDHubError sends errors the way LNDhub clients understand them.
+func SendLNDHubError(w http.ResponseWriter, status int, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error   bool   `json:"error"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{true, code, message})
+}
+
+// the error codes of LNDhub
+const (
+	lndhubBadAuth       = 1
+	lndhubNotEnough     = 2
+	lndhubBadArguments  = 8
+	lndhubPaymentFailed = 10
+	lndhubServerError   = 6
+)
+
+// lndhubAmount is given by clients as a number or as a string.
+type lndhubAmount int64
+
+func (a *lndhubAmount) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*a = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*a = lndhubAmount(v)
+	return nil
+}
+
+func LNDHubAuth(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Login        string `json:"login"`
+		Password     string `json:"password"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		SendLNDHubError(w, 400, lndhubBadArguments, "bad arguments")
+		return
+	}
+
+	key := params.Password
+	if params.RefreshToken != "" {
+		key = params.RefreshToken
+	}
+	wallet, err := storage.Default.GetWalletByKey(key)
+	if key == "" || err != nil {
+		SendLNDHubError(w, 401, lndhubBadAuth, "bad auth")
+		return
+	}
+	if (params.Login == "admin" && string(wallet.AdminKey) != key) ||
+		(params.Login == "invoice" && string(wallet.InvoiceKey) != key) {
+		SendLNDHubError(w, 401, lndhubBadAuth, "bad auth")
+		return
+	}
+
+	sendLNDHub(w, struct {
+		RefreshToken string `json:"refresh_token"`
+		AccessToken  string `json:"access_token"`
+	}{key, key})
+}
+
+func LNDHubGetInfo(w http.ResponseWriter, r *http.Request) {
+	sendLNDHub(w, struct {
+		Alias             string        `json:"alias"`
+		IdentityPubkey    string        `json:"identity_pubkey"`
+		BlockHeight       int           `json:"block_height"`
+		SyncedToChain     bool          `json:"synced_to_chain"`
+		NumActiveChannels int           `json:"num_active_channels"`
+		URIs              []string      `json:"uris"`
+		Chains            []interface{} `json:"chains"`
+	}{
+		Alias:         getSiteTitle(),
+		SyncedToChain: true,
+		URIs:          []string{},
+		Chains: []interface{}{
+			map[string]string{"chain": "bitcoin", "network": "mainnet"},
+		},
+	})
+}
+
+func LNDHubGetBalance(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	balance, err := services.LoadWalletBalance(wallet.ID)
+	if err != nil {
+		SendLNDHubError(w, 500, lndhubServerError, "failed to load balance")
+		return
+	}
+
+	sendLNDHub(w, map[string]interface{}{
+		"BTC": map[string]int64{"AvailableBalance": balance / 1000},
+	})
+}
+
+func LNDHubAddInvoice(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	var params struct {
+		Amount          lndhubAmount `json:"amt"`
+		Memo            string       `json:"memo"`
+		DescriptionHash string       `json:"description_hash"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Amount < 0 {
+		SendLNDHubError(w, 400, lndhubBadArguments, "bad arguments")
+		return
+	}
+
+	invoice := services.CreateInvoiceParams{
+		InvoiceParams: rp.InvoiceParams{
+			Msatoshi:    int64(params.Amount) * 1000,
+			Description: params.Memo,
+		},
+		Tag: "lndhub",
+	}
+	if params.DescriptionHash != "" {
+		hash, err := hex.DecodeString(params.DescriptionHash)
+		if err != nil || len(hash) != 32 {
+			SendLNDHubError(w, 400, lndhubBadArguments, "invalid description_hash")
+			return
+		}
+		invoice.DescriptionHash = hash
+	}
+
+	payment, err := services.CreateInvoice(r.Context(), wallet.ID, invoice)
+	if err != nil {
+		SendLNDHubError(w, 500, lndhubServerError, "failed to create invoice: "+err.Error())
+		return
+	}
+
+	sendLNDHub(w, struct {
+		PaymentRequest string `json:"payment_request"`
+		PayReq         string `json:"pay_req"`
+		PaymentHash    string `json:"payment_hash"`
+		RHash          string `json:"r_hash"`
+		AddIndex       string `json:"add_index"`
+	}{payment.Bolt11, payment.Bolt11, payment.Hash, payment.Hash,
+		strconv.FormatInt(payment.CreatedAt.Unix(), 10)})
+}
+
+func LNDHubPayInvoice(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	if r.Context().Value("permission").(string) != "admin" {
+		SendLNDHubError(w, 401, lndhubBadAuth, "bad auth")
+		return
+	}
+
+	var params struct {
+		Invoice string       `json:"invoice"`
+		Amount  lndhubAmount `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Invoice == "" {
+		SendLNDHubError(w, 400, lndhubBadArguments, "bad arguments")
+		return
+	}
+	inv, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		SendLNDHubError(w, 400, lndhubBadArguments, "invalid invoice")
+		return
+	}
+
+	payment := services.PayInvoiceParams{
+		PaymentParams: rp.PaymentParams{Invoice: params.Invoice},
+		Tag:           "lndhub",
+	}
+	if inv.MSatoshi == 0 {
+		payment.CustomAmount = int64(params.Amount) * 1000
+	}
+	if _, err := services.PayInvoice(r.Context(), wallet.ID, payment); err != nil {
+		switch {
+		case errors.Is(err, services.ErrMaintenance):
+			SendLNDHubError(w, 503, lndhubPaymentFailed, err.Error())
+		case strings.Contains(err.Error(), "insufficient balance"):
+			SendLNDHubError(w, 400, lndhubNotEnough, "not enough balance")
+		default:
+			SendLNDHubError(w, 400, lndhubPaymentFailed, "payment failed: "+err.Error())
+		}
+		return
+	}
+
+	paid, err := services.WaitForPayment(wallet.ID, inv.PaymentHash, LNDHubPaymentTimeout)
+	if err != nil {
+		SendLNDHubError(w, 400, lndhubPaymentFailed, "payment failed")
+		return
+	}
+
+	sendLNDHub(w, struct {
+		PaymentError string                 `json:"payment_error"`
+		PaymentRoute map[string]interface{} `json:"payment_route"`
+		lndhubTransaction
+	}{"", map[string]interface{}{}, lndhubTx(paid)})
+}
+
+type lndhubTransaction struct {
+	PaymentPreimage string `json:"payment_preimage"`
+	PaymentHash     string `json:"payment_hash"`
+	Type            string `json:"type"`
+	Fee             int64  `json:"fee"`
+	FeeMsat         int64  `json:"fee_msat"`
+	Value           int64  `json:"value"`
+	Timestamp       int64  `json:"timestamp"`
+	Memo            string `json:"memo"`
+	Pending         bool   `json:"pending"`
+}
+
+func lndhubTx(payment models.Payment) lndhubTransaction {
+	return lndhubTransaction{
+		PaymentPreimage: string(payment.Preimage),
+		PaymentHash:     payment.Hash,
+		Type:            "paid_invoice",
+		Fee:             payment.Fee / 1000,
+		FeeMsat:         payment.Fee,
+		Value:           -payment.Amount / 1000,
+		Timestamp:       payment.CreatedAt.Unix(),
+		Memo:            payment.Description,
+		Pending:         payment.Pending,
+	}
+}
+
+// LNDHubGetTxs lists the payments made, newest first.
+func LNDHubGetTxs(w http.ResponseWriter, r *http.Request) {
+	lndhubPayments(w, r, false)
+}
+
+// LNDHubGetPending lists the payments made that aren't settled yet.
+func LNDHubGetPending(w http.ResponseWriter, r *http.Request) {
+	lndhubPayments(w, r, true)
+}
+
+func lndhubPayments(w http.ResponseWriter, r *http.Request, pending bool) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	query := lndhubPage(r)
+	query.Direction = "outgoing"
+	query.Pending = &pending
+	payments, _, err := storage.Default.ListPayments(wallet.ID, query)
+	if err != nil {
+		SendLNDHubError(w, 500, lndhubServerError, "failed to load payments")
+		return
+	}
+
+	txs := make([]lndhubTransaction, len(payments))
+	for i, payment := range payments {
+		txs[i] = lndhubTx(payment)
+	}
+	sendLNDHub(w, txs)
+}
+
+// LNDHubGetUserInvoices lists the invoices created, paid or not, newest first.
+func LNDHubGetUserInvoices(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	query := lndhubPage(r)
+	query.Direction = "incoming"
+	payments, _, err := storage.Default.ListPayments(wallet.ID, query)
+	if err != nil {
+		SendLNDHubError(w, 500, lndhubServerError, "failed to load invoices")
+		return
+	}
+
+	type invoice struct {
+		RHash          string `json:"r_hash"`
+		PaymentHash    string `json:"payment_hash"`
+		PaymentRequest string `json:"payment_request"`
+		PayReq         string `json:"pay_req"`
+		AddIndex       string `json:"add_index"`
+		Description    string `json:"description"`
+		IsPaid         bool   `json:"ispaid"`
+		Amount         int64  `json:"amt"`
+		ExpireTime     int64  `json:"expire_time"`
+		Timestamp      int64  `json:"timestamp"`
+		Type           string `json:"type"`
+	}
+	invoices := make([]invoice, len(payments))
+	for i, payment := range payments {
+		invoices[i] = invoice{
+			RHash:          payment.Hash,
+			PaymentHash:    payment.Hash,
+			PaymentRequest: payment.Bolt11,
+			PayReq:         payment.Bolt11,
+			AddIndex:       strconv.FormatInt(payment.CreatedAt.Unix(), 10),
+			Description:    payment.Description,
+			IsPaid:         !payment.Pending,
+			Amount:         payment.Amount / 1000,
+			ExpireTime:     int64(services.DefaultInvoiceExpiry.Seconds()),
+			Timestamp:      payment.CreatedAt.Unix(),
+			Type:           "user_invoice",
+		}
+	}
+	sendLNDHub(w, invoices)
+}
+
+func LNDHubCheckPayment(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	payment, err := storage.Default.GetPayment(wallet.ID, mux.Vars(r)["hash"])
+	if err != nil {
+		SendLNDHubError(w, 404, lndhubBadArguments, "no such payment")
+		return
+	}
+
+	sendLNDHub(w, struct {
+		Paid bool `json:"paid"`
+	}{!payment.Pending})
+}
+
+func LNDHubDecodeInvoice(w http.ResponseWriter, r *http.Request) {
+	inv, err := decodepay.Decodepay(r.URL.Query().Get("invoice"))
+	if err != nil {
+		SendLNDHubError(w, 400, lndhubBadArguments, "invalid invoice")
+		return
+	}
+
+	sendLNDHub(w, struct {
+		Destination     string `json:"destination"`
+		PaymentHash     string `json:"payment_hash"`
+		NumSatoshis     string `json:"num_satoshis"`
+		NumMsat         string `json:"num_msat"`
+		Timestamp       string `json:"timestamp"`
+		Expiry          string `json:"expiry"`
+		Description     string `json:"description"`
+		DescriptionHash string `json:"description_hash"`
+		CltvExpiry      string `json:"cltv_expiry"`
+	}{
+		inv.Payee,
+		inv.PaymentHash,
+		strconv.FormatInt(inv.MSatoshi/1000, 10),
+		strconv.FormatInt(inv.MSatoshi, 10),
+		strconv.Itoa(inv.CreatedAt),
+		strconv.Itoa(inv.Expiry),
+		inv.Description,
+		inv.DescriptionHash,
+		strconv.Itoa(inv.MinFinalCLTVExpiry),
+	})
+}
+
+// LNDHubGetBtc is for on-chain deposits, which aren't supported.
+func LNDHubGetBtc(w http.ResponseWriter, r *http.Request) {
+	sendLNDHub(w, []interface{}{})
+}
+
+func lndhubPage(r *http.Request) storage.PaymentsQuery {
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	return storage.PaymentsQuery{Limit: limit, Offset: offset}
+}
+
+// LNDhub responses are plain JSON, numbers and not our usual envelope.
+func sendLNDHub(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
@@ -6,7 +6,6 @@ import (
 
 	lnurl "github.com/fiatjaf/go-lnurl"
 	"github.com/lnbits/infinity/api/apiutils"
-	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/services"
 	"github.com/lnbits/infinity/storage"
 	rp "github.com/lnbits/relampago"
@@ -16,9 +15,8 @@ func DrainFunds(w http.ResponseWriter, r *http.Request) {
 	walletKey := r.URL.Query().Get("api-key")
 
 	// only allow admin keys
-	var wallet *models.Wallet
-	result := storage.DB.Where("admin_key", walletKey).First(&wallet)
-	if result.Error != nil {
+	wallet, err := storage.Default.GetWalletByAdminKey(walletKey)
+	if err != nil {
 		apiutils.SendJSON(w, lnurl.LNURLErrorResponse{
 			Status: "ERROR",
 			Reason: "Can't withdraw. Invalid API key.",
@@ -30,13 +28,11 @@ func DrainFunds(w http.ResponseWriter, r *http.Request) {
 		// this is the callback already
 		// save balanceNotify
 		if bn := r.URL.Query().Get("balanceNotify"); bn != "" {
-			storage.DB.Model(&models.Wallet{}).
-				Where("id", wallet.ID).
-				Update("balance_notify", bn)
+			storage.Default.SetBalanceNotify(wallet.ID, bn)
 		}
 
 		// pay invoice
-		_, err := services.PayInvoice(wallet.ID, services.PayInvoiceParams{
+		_, err := services.PayInvoice(r.Context(), wallet.ID, services.PayInvoiceParams{
 			PaymentParams: rp.PaymentParams{Invoice: pr},
 			Tag:           "drain",
 		})
@@ -50,13 +46,13 @@ func DrainFunds(w http.ResponseWriter, r *http.Request) {
 		// return lnurl-withdraw params
 		// load wallet balance
 		balance, _ := services.LoadWalletBalance(wallet.ID)
-		thisURL := r.Host + "/lnurl/wallet/drain?api-key=" + walletKey
+		thisURL := r.Host + apiutils.BasePath + "/lnurl/wallet/drain?api-key=" + walletKey
 		response := lnurl.LNURLWithdrawResponse{
 			Tag:      "withdrawRequest",
 			Callback: thisURL,
 			K1:       "0",
 			DefaultDescription: fmt.Sprintf("balance withdraw from %s @ %s",
-				wallet.Name, SiteTitle),
+				wallet.Name, getSiteTitle()),
 			BalanceCheck: thisURL,
 		}
 
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/services"
+)
+
+// Maintenance returns whether payments are paused, and with POST and
+// `{"enabled": true, "message": "..."}` pauses or resumes them. turning it off
+// here doesn't override MAINTENANCE.
+func Maintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		var params services.MaintenanceState
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			apiutils.SendJSONError(w, 400, "failed to read params: %s", err.Error())
+			return
+		}
+		services.ToggleMaintenance(params.Enabled, params.Message)
+	}
+
+	apiutils.SendJSON(w, services.Maintenance())
+}
+
+// sendPaymentError tells clients about maintenance with a 503.
+func sendPaymentError(w http.ResponseWriter, code int, msg string, err error) {
+	if errors.Is(err, services.ErrMaintenance) {
+		apiutils.SendJSONError(w, 503, "%s", err.Error())
+		return
+	}
+	apiutils.SendJSONError(w, code, "%s: %s", msg, err.Error())
+}
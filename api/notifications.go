@@ -0,0 +1,165 @@
+package api
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/notify"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils/nostr_utils"
+)
+
+func Notifications(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*models.User)
+
+	notifications, err := storage.Default.GetUserNotifications(user.ID)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to load notifications: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		*models.UserNotifications
+		EmailEnabled bool   `json:"email_enabled"`
+		NostrEnabled bool   `json:"nostr_enabled"`
+		NostrSender  string `json:"nostr_sender"`
+	}{notifications, notify.EmailEnabled(), notify.NostrEnabled(), notify.NostrPubKey()})
+}
+
+// SetNotifications changes the notification settings given. a new email is
+// sent a link it must be verified with. nostr is an npub or a hex pubkey.
+func SetNotifications(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*models.User)
+
+	var params struct {
+		Email       *string `json:"email"`
+		Nostr       *string `json:"nostr"`
+		Received    *bool   `json:"received"`
+		ReceivedMin *int64  `json:"received_min"`
+		Sent        *bool   `json:"sent"`
+		Failed      *bool   `json:"failed"`
+		LowBalance  *int64  `json:"low_balance"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		apiutils.SendJSONError(w, 400, "got invalid JSON: %s", err.Error())
+		return
+	}
+
+	notifications, err := storage.Default.GetUserNotifications(user.ID)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to load notifications: %s", err.Error())
+		return
+	}
+
+	verify := false
+	if params.Email != nil {
+		email := strings.TrimSpace(*params.Email)
+		if email != "" {
+			if !notify.EmailEnabled() {
+				apiutils.SendJSONError(w, 400, "this server doesn't send emails")
+				return
+			}
+			if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+				apiutils.SendJSONError(w, 400, "invalid email '%s'", email)
+				return
+			}
+		}
+		if email != notifications.Email {
+			notifications.Email = email
+			notifications.EmailVerified = false
+			verify = email != ""
+		}
+	}
+	if params.Nostr != nil {
+		pubkey := strings.TrimPrefix(strings.TrimSpace(*params.Nostr), "nostr:")
+		if pubkey != "" {
+			if !notify.NostrEnabled() {
+				apiutils.SendJSONError(w, 400, "this server has no nostr relays")
+				return
+			}
+			var err error
+			if pubkey, err = nostr_utils.DecodePubKey(pubkey); err != nil {
+				apiutils.SendJSONError(w, 400, "invalid nostr pubkey: %s", err.Error())
+				return
+			}
+		}
+		notifications.NostrPubKey = pubkey
+	}
+	if params.Received != nil {
+		notifications.Received = *params.Received
+	}
+	if params.ReceivedMin != nil {
+		if *params.ReceivedMin < 0 {
+			apiutils.SendJSONError(w, 400, "received_min can't be negative")
+			return
+		}
+		notifications.ReceivedMin = *params.ReceivedMin
+	}
+	if params.Sent != nil {
+		notifications.Sent = *params.Sent
+	}
+	if params.Failed != nil {
+		notifications.Failed = *params.Failed
+	}
+	if params.LowBalance != nil {
+		if *params.LowBalance < 0 {
+			apiutils.SendJSONError(w, 400, "low_balance can't be negative")
+			return
+		}
+		notifications.LowBalance = *params.LowBalance
+	}
+
+	if err := storage.Default.SetUserNotifications(notifications); err != nil {
+		apiutils.SendJSONError(w, 500, "failed to save notifications: %s", err.Error())
+		return
+	}
+	if verify {
+		if err := notify.SendVerification(user.ID, notifications.Email, serviceBase(r)); err != nil {
+			apiutils.SendJSONError(w, 500, "failed to send verification email: %s", err.Error())
+			return
+		}
+	}
+
+	apiutils.SendJSON(w, notifications)
+}
+
+// VerifyNotificationsEmail is the link sent to a new email, opened from a mail
+// client so it has no key and answers with text.
+func VerifyNotificationsEmail(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID, email := query.Get("user"), query.Get("email")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if !hmac.Equal([]byte(query.Get("token")), []byte(notify.VerificationToken(userID, email))) {
+		w.WriteHeader(400)
+		w.Write([]byte("This link is invalid.\n"))
+		return
+	}
+
+	notifications, err := storage.Default.GetUserNotifications(userID)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("Failed to load the notifications, try again later.\n"))
+		return
+	}
+	if notifications.Email != email {
+		w.WriteHeader(410)
+		w.Write([]byte("This email isn't set for notifications anymore.\n"))
+		return
+	}
+	if !notifications.EmailVerified {
+		notifications.EmailVerified = true
+		if err := storage.Default.SetUserNotifications(notifications); err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte("Failed to save, try again later.\n"))
+			return
+		}
+	}
+
+	w.Write([]byte("Your email is verified, you'll get notifications at " + email + ".\n"))
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/nwc"
+	"gorm.io/gorm"
+)
+
+// the Nostr Wallet Connect connections of a wallet. they can spend from it, so
+// all of this needs the admin key.
+
+func NWCConnections(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	if r.Context().Value("permission").(string) != "admin" {
+		w.WriteHeader(401)
+		return
+	}
+
+	conns, err := nwc.ListConnections(wallet.ID)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to load connections: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		Enabled      bool                   `json:"enabled"`
+		WalletPubKey string                 `json:"wallet_pubkey"`
+		Connections  []models.NWCConnection `json:"connections"`
+	}{nwc.Enabled(), nwc.WalletPubKey(wallet.ID), conns})
+}
+
+func CreateNWCConnection(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	if r.Context().Value("permission").(string) != "admin" {
+		w.WriteHeader(401)
+		return
+	}
+
+	var params struct {
+		Name          string `json:"name"`
+		Budget        int64  `json:"budget"` // msat
+		BudgetRenewal string `json:"budget_renewal"`
+		ExpiresIn     int64  `json:"expires_in"` // seconds
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		apiutils.SendJSONError(w, 400, "got invalid JSON: %s", err.Error())
+		return
+	}
+	if params.Name == "" || len(params.Name) > 64 {
+		apiutils.SendJSONError(w, 400, "name must have between 1 and 64 characters")
+		return
+	}
+
+	conn := models.NWCConnection{
+		Name:          params.Name,
+		Budget:        params.Budget,
+		BudgetRenewal: params.BudgetRenewal,
+	}
+	if params.ExpiresIn > 0 {
+		expires := time.Now().Add(time.Second * time.Duration(params.ExpiresIn))
+		conn.ExpiresAt = &expires
+	}
+
+	conn, err := nwc.CreateConnection(wallet.ID, conn)
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "failed to create connection: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		models.NWCConnection
+		URI string `json:"uri"`
+	}{conn, nwc.ConnectionURI(conn)})
+}
+
+func DeleteNWCConnection(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	if r.Context().Value("permission").(string) != "admin" {
+		w.WriteHeader(401)
+		return
+	}
+
+	if err := nwc.DeleteConnection(wallet.ID, mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			apiutils.SendJSONError(w, 404, "no such connection")
+			return
+		}
+		apiutils.SendJSONError(w, 500, "failed to delete connection: %s", err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
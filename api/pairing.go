@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/nwc"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// ServiceURL is where the server is reached from outside, if configured,
+// otherwise it is taken from the request.
+var ServiceURL string
+
+// Pairing returns the URI to connect a mobile wallet to this wallet, and a QR
+// code of it, so it can be paired with a single scan. `type` is the protocol:
+// for lndhub `scope` is admin or invoice, the kind of key the other wallet gets
+// (only invoice with the invoice key), for nwc `connection` is the id of one of
+// the wallet connections, which needs the admin key. with `format=png` the
+// response is the QR code image.
+func Pairing(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+	permission := r.Context().Value("permission").(string)
+
+	kind := r.URL.Query().Get("type")
+	if kind == "" {
+		kind = "lndhub"
+	}
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = permission
+	}
+
+	var key string
+	switch scope {
+	case "admin":
+		if permission != "admin" {
+			apiutils.SendJSONError(w, 401, "the admin scope needs the admin key")
+			return
+		}
+		key = string(wallet.AdminKey)
+	case "invoice":
+		key = string(wallet.InvoiceKey)
+	default:
+		apiutils.SendJSONError(w, 400, "scope must be admin or invoice")
+		return
+	}
+
+	var uri string
+	switch kind {
+	case "lndhub":
+		uri = "lndhub://" + scope + ":" + key + "@" + serviceBase(r) + "/lndhub/ext/"
+	case "nwc":
+		if permission != "admin" {
+			apiutils.SendJSONError(w, 401, "nwc connections need the admin key")
+			return
+		}
+		conn, err := nwc.GetConnection(wallet.ID, r.URL.Query().Get("connection"))
+		if err != nil {
+			apiutils.SendJSONError(w, 404, "no such connection")
+			return
+		}
+		scope = "admin"
+		uri = nwc.ConnectionURI(conn)
+	default:
+		apiutils.SendJSONError(w, 400, "unknown type '%s', must be lndhub or nwc", kind)
+		return
+	}
+
+	size := 512
+	if s, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil && s >= 128 && s <= 2048 {
+		size = s
+	}
+	png, err := qrcode.Encode(uri, qrcode.Medium, size)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to make QR code: %s", err.Error())
+		return
+	}
+
+	// the uri has a key in it
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Query().Get("format") == "png" {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		Type  string `json:"type"`
+		Scope string `json:"scope"`
+		URI   string `json:"uri"`
+		QR    string `json:"qr"`
+	}{kind, scope, uri, "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)})
+}
+
+// serviceBase is the url of the server, with its base path.
+func serviceBase(r *http.Request) string {
+	if ServiceURL != "" {
+		return strings.TrimSuffix(ServiceURL, "/") + apiutils.BasePath
+	}
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + r.Host + apiutils.BasePath
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/notify"
+	"gorm.io/gorm"
+)
+
+// the web push subscriptions of a wallet, one for each browser that wants its
+// notifications, each with the kinds of payments it wants.
+
+func PushSubscriptions(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	subscriptions, err := notify.ListPushSubscriptions(wallet.ID)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to load subscriptions: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		Enabled       bool                      `json:"enabled"`
+		PublicKey     string                    `json:"public_key"`
+		Subscriptions []models.PushSubscription `json:"subscriptions"`
+	}{notify.WebPushEnabled(), notify.VAPIDPublicKey(), subscriptions})
+}
+
+// SubscribePush takes the PushSubscription of the browser, as given by
+// pushManager.subscribe(), and the kinds of notifications it wants.
+func SubscribePush(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	var params struct {
+		Subscription struct {
+			Endpoint string `json:"endpoint"`
+			Keys     struct {
+				P256DH string `json:"p256dh"`
+				Auth   string `json:"auth"`
+			} `json:"keys"`
+		} `json:"subscription"`
+		models.NotificationKinds
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		apiutils.SendJSONError(w, 400, "got invalid JSON: %s", err.Error())
+		return
+	}
+
+	subscription, err := notify.Subscribe(wallet.ID, models.PushSubscription{
+		Endpoint:          params.Subscription.Endpoint,
+		P256DH:            params.Subscription.Keys.P256DH,
+		Auth:              params.Subscription.Keys.Auth,
+		UserAgent:         r.UserAgent(),
+		NotificationKinds: params.NotificationKinds,
+	})
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "failed to subscribe: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, subscription)
+}
+
+// UnsubscribePush deletes a subscription by its id or its endpoint.
+func UnsubscribePush(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	var params struct {
+		ID       string `json:"id"`
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		apiutils.SendJSONError(w, 400, "got invalid JSON: %s", err.Error())
+		return
+	}
+	which := params.ID
+	if which == "" {
+		which = params.Endpoint
+	}
+	if which == "" {
+		apiutils.SendJSONError(w, 400, "missing id or endpoint")
+		return
+	}
+
+	if err := notify.Unsubscribe(wallet.ID, which); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			apiutils.SendJSONError(w, 404, "no such subscription")
+			return
+		}
+		apiutils.SendJSONError(w, 500, "failed to unsubscribe: %s", err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/splits"
+)
+
+// the value splits of a wallet, which send part of what it receives to other
+// lightning addresses. only the admin key may change them.
+
+func ValueSplits(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	list, err := splits.List(wallet.ID)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to load splits: %s", err.Error())
+		return
+	}
+	payments, err := splits.ListPayments(wallet.ID, PaymentsPageSize)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to load split payments: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		Splits   []models.ValueSplit   `json:"splits"`
+		Payments []models.SplitPayment `json:"payments"`
+	}{list, payments})
+}
+
+func SetValueSplits(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	if r.Context().Value("permission").(string) != "admin" {
+		w.WriteHeader(401)
+		return
+	}
+
+	var params struct {
+		Splits []models.ValueSplit `json:"splits"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		apiutils.SendJSONError(w, 400, "got invalid JSON: %s", err.Error())
+		return
+	}
+
+	list, err := splits.Set(wallet.ID, params.Splits)
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "failed to set splits: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		Splits []models.ValueSplit `json:"splits"`
+	}{list})
+}
@@ -1,9 +1,12 @@
 package api
 
 import (
+	"encoding/json"
 	"net/http"
 	"time"
 
+	"github.com/lnbits/infinity/chaos"
+	"github.com/lnbits/infinity/cluster"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/utils"
 	"gopkg.in/antage/eventsource.v1"
@@ -16,7 +19,7 @@ func SSE(w http.ResponseWriter, r *http.Request) {
 	ies, ok := walletStreams.Load(wallet.ID)
 
 	if !ok {
-		es = eventsource.New(
+		es = utils.ClosableStream(eventsource.New(
 			&eventsource.Settings{
 				Timeout:        5 * time.Second,
 				CloseOnTimeout: true,
@@ -31,7 +34,7 @@ func SSE(w http.ResponseWriter, r *http.Request) {
 					[]byte("Access-Control-Allow-Origin: *"),
 				}
 			},
-		)
+		))
 		go func() {
 			for {
 				time.Sleep(25 * time.Second)
@@ -52,11 +55,49 @@ func SSE(w http.ResponseWriter, r *http.Request) {
 	es.ServeHTTP(w, r)
 }
 
+type walletEvent struct {
+	Wallet  string `json:"wallet"`
+	Type    string `json:"type"`
+	Payload string `json:"payload"`
+}
+
+func init() {
+	cluster.Subscribe("wallet_sse", func(data json.RawMessage) {
+		var event walletEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return
+		}
+		if chaos.DropEvent() {
+			return
+		}
+		if ies, ok := walletStreams.Load(event.Wallet); ok {
+			ies.(eventsource.EventSource).SendEventMessage(event.Payload, event.Type, "")
+		}
+	})
+}
+
+// SendWalletSSE sends an event to the clients of a wallet stream, on all the
+// instances of a cluster.
 func SendWalletSSE(walletID string, typ string, data interface{}) {
 	jpayload, _ := utils.JSONMarshal(data)
-	payload := string(jpayload)
+	cluster.Publish("wallet_sse", walletEvent{walletID, typ, string(jpayload)})
+}
 
-	if ies, ok := walletStreams.Load(walletID); ok {
-		ies.(eventsource.EventSource).SendEventMessage(payload, typ, "")
-	}
+// SSEConnections counts the clients connected to the wallet streams.
+func SSEConnections() int {
+	count := 0
+	walletStreams.Range(func(_, ies interface{}) bool {
+		count += ies.(eventsource.EventSource).ConsumersCount()
+		return true
+	})
+	return count
+}
+
+// CloseSSE disconnects the clients of all wallet streams, they will reconnect
+// after the retry interval they got when connecting.
+func CloseSSE() {
+	walletStreams.Range(func(_, ies interface{}) bool {
+		ies.(eventsource.EventSource).Close()
+		return true
+	})
 }
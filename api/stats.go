@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/ledger"
+	"github.com/lnbits/infinity/metrics"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+)
+
+type appStats struct {
+	URL      string `json:"url"`
+	Installs int64  `json:"installs"`
+}
+
+type backendStats struct {
+	Balance *int64                   `json:"balance,omitempty"`
+	Error   string                   `json:"error,omitempty"`
+	Errors  []metrics.LightningError `json:"errors"`
+}
+
+// Stats returns the instance-wide numbers for an operator's dashboard: users,
+// wallets, the total balance they hold, the daily payment volume of the last
+// `days` (default 30), the most installed apps and how the lightning backend
+// is doing.
+func Stats(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if d, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && d > 0 && d <= 366 {
+		days = d
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Truncate(time.Hour * 24)
+
+	var stats struct {
+		Users        int64           `json:"users"`
+		Wallets      int64           `json:"wallets"`
+		TotalBalance int64           `json:"total_balance"`
+		Volume       []ledger.Volume `json:"volume"`
+		TopApps      []appStats      `json:"top_apps"`
+		Lightning    backendStats    `json:"lightning"`
+	}
+
+	err := storage.DB.Model(&models.User{}).Count(&stats.Users).Error
+	if err == nil {
+		err = storage.DB.Model(&models.Wallet{}).Count(&stats.Wallets).Error
+	}
+	if err == nil {
+		stats.TotalBalance, err = ledger.TotalWalletBalance()
+	}
+	if err == nil {
+		stats.Volume, err = ledger.DailyVolume(since, "")
+	}
+	if err == nil {
+		err = storage.DB.Model(&models.UserApp{}).
+			Select("url, count(*) AS installs").
+			Group("url").
+			Order("installs desc").Order("url").
+			Limit(10).
+			Scan(&stats.TopApps).Error
+	}
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+	if stats.TopApps == nil {
+		stats.TopApps = make([]appStats, 0)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), ReadinessTimeout)
+	defer cancel()
+	if info, err := lightningInfo(ctx); err == nil {
+		stats.Lightning.Balance = &info.Balance
+	} else {
+		stats.Lightning.Error = err.Error()
+	}
+	stats.Lightning.Errors = metrics.LightningErrors()
+
+	apiutils.SendJSON(w, stats)
+}
+
+type walletUsage struct {
+	UserID string `json:"user_id"`
+	ledger.WalletVolume
+}
+
+// UsageReport returns the volume of every wallet in a `month` (2006-01, the
+// current one by default), the busiest first, up to `limit` wallets.
+func UsageReport(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if month := qs.Get("month"); month != "" {
+		t, err := time.Parse("2006-01", month)
+		if err != nil {
+			apiutils.SendJSONError(w, 400, "invalid month, must be like 2006-01: %s", err.Error())
+			return
+		}
+		since = t
+	}
+	until := since.AddDate(0, 1, 0)
+
+	limit := 100
+	if l, err := strconv.Atoi(qs.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	volumes, err := ledger.WalletVolumes(since, until)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	var total ledger.Volume
+	for _, volume := range volumes {
+		total.Merge(volume.Volume)
+	}
+	if len(volumes) > limit {
+		volumes = volumes[0:limit]
+	}
+
+	// deleted wallets still show up, their volume counted too
+	ids := make([]string, len(volumes))
+	for i, volume := range volumes {
+		ids[i] = volume.WalletID
+	}
+	var wallets []models.Wallet
+	if err := storage.DB.Unscoped().Select("id, user_id").
+		Where("id IN ?", ids).Find(&wallets).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+	owners := make(map[string]string, len(wallets))
+	for _, wallet := range wallets {
+		owners[wallet.ID] = wallet.UserID
+	}
+
+	usage := make([]walletUsage, len(volumes))
+	for i, volume := range volumes {
+		usage[i] = walletUsage{owners[volume.WalletID], volume}
+	}
+
+	total.Period = since.Format("2006-01")
+	apiutils.SendJSON(w, struct {
+		Total   ledger.Volume `json:"total"`
+		Wallets []walletUsage `json:"wallets"`
+	}{total, usage})
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/notify"
+	"gorm.io/gorm"
+)
+
+// the telegram chats linked to a wallet. they get its notifications and can
+// create invoices on it, so all of this needs the admin key.
+
+func TelegramChats(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	if r.Context().Value("permission").(string) != "admin" {
+		w.WriteHeader(401)
+		return
+	}
+
+	chats, err := notify.ListTelegramChats(wallet.ID)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to load chats: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		Enabled bool                  `json:"enabled"`
+		Bot     string                `json:"bot"`
+		Chats   []models.TelegramChat `json:"chats"`
+	}{notify.TelegramEnabled(), notify.TelegramBot(), chats})
+}
+
+// LinkTelegramChat makes a code for a chat to be linked to the wallet with,
+// and the link that opens the bot with it.
+func LinkTelegramChat(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	if r.Context().Value("permission").(string) != "admin" {
+		w.WriteHeader(401)
+		return
+	}
+	if !notify.TelegramEnabled() {
+		apiutils.SendJSONError(w, 400, notify.ErrTelegramDisabled.Error())
+		return
+	}
+
+	code, expires := notify.TelegramLinkCode(wallet.ID)
+
+	// the code links chats to the wallet
+	w.Header().Set("Cache-Control", "no-store")
+
+	apiutils.SendJSON(w, struct {
+		Code      string    `json:"code"`
+		Link      string    `json:"link"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{code, "https://t.me/" + notify.TelegramBot() + "?start=" + code, expires})
+}
+
+func UnlinkTelegramChat(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	if r.Context().Value("permission").(string) != "admin" {
+		w.WriteHeader(401)
+		return
+	}
+
+	chatID, err := strconv.ParseInt(mux.Vars(r)["chat"], 10, 64)
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "invalid chat id")
+		return
+	}
+	if err := notify.UnlinkTelegramChat(wallet.ID, chatID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			apiutils.SendJSONError(w, 404, "no such chat")
+			return
+		}
+		apiutils.SendJSONError(w, 500, "failed to unlink chat: %s", err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
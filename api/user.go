@@ -3,36 +3,39 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+	"regexp"
 
 	"github.com/lnbits/infinity/api/apiutils"
 	"github.com/lnbits/infinity/apps"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/services"
 	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils"
 )
 
 func User(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*models.User)
 
 	// load wallets
-	storage.DB.Raw(`
-      SELECT *,
-        (SELECT coalesce(sum(amount), 0) FROM payments AS p
-         WHERE p.wallet_id = w.id
-           AND ( amount < 0
-            OR   ( amount > 0 AND NOT pending )
-               )
-        ) AS balance FROM wallets AS w
-      WHERE w.user_id = ?
-    `, user.ID).Scan(&user.Wallets)
+	user.Wallets, _ = storage.Default.ListUserWallets(user.ID)
 
 	// load apps
-	storage.DB.Raw("SELECT url FROM user_apps WHERE user_id = ?", user.ID).
-		Scan(&user.Apps)
+	user.Apps, _ = storage.Default.ListUserApps(user.ID)
 
 	apiutils.SendJSON(w, user)
 }
 
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*models.User)
+
+	if err := services.DeleteUser(user.ID); err != nil {
+		apiutils.SendJSONError(w, 500, "failed to delete user: %s", err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
 func CreateWallet(w http.ResponseWriter, r *http.Request) {
 	var params struct {
 		Name string `json:"name"`
@@ -55,7 +58,7 @@ func CreateWallet(w http.ResponseWriter, r *http.Request) {
 			apiutils.SendJSONError(w, 500, "error saving user: %s", err.Error())
 			return
 		}
-		masterKey = user.MasterKey
+		masterKey = string(user.MasterKey)
 	}
 
 	// create wallet
@@ -86,20 +89,31 @@ func AddApp(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// try to fetch settings for this app first
-	if _, err := apps.GetAppSettings(params.URL, true); err != nil {
+	settings, err := apps.GetAppSettings(params.URL, true)
+	if err != nil {
 		apiutils.SendJSONError(w, 470, "failed to run app: %s", err.Error())
 		return
 	}
 
+	// the signer, if any, is trusted from now on
+	signer, err := apps.VerifyAppSignature(params.URL, settings.Code)
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "invalid app signature: %s", err.Error())
+		return
+	}
+
 	// add it to the list of apps for this user
-	if resp := storage.DB.Create(&models.UserApp{
+	if err := storage.Default.AddUserApp(&models.UserApp{
 		UserID: user.ID,
 		URL:    params.URL,
-	}); resp.Error != nil {
-		apiutils.SendJSONError(w, 500, "failed to save app: %s", resp.Error.Error())
+		Signer: signer,
+	}); err != nil {
+		apiutils.SendJSONError(w, 500, "failed to save app: %s", err.Error())
 		return
 	}
 
+	go apps.SyncNostrSubscriptions()
+
 	w.WriteHeader(201)
 }
 
@@ -114,13 +128,95 @@ func RemoveApp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result := storage.DB.Where("url = ? AND user_id = ?", params.URL, user.ID).
-		Delete(&models.UserApp{})
-
-	if result.Error != nil {
-		apiutils.SendJSONError(w, 500, "failed to delete app: %s", result.Error.Error())
+	if err := storage.Default.RemoveUserApp(user.ID, params.URL); err != nil {
+		apiutils.SendJSONError(w, 500, "failed to delete app: %s", err.Error())
 		return
 	}
 
 	w.WriteHeader(200)
 }
+
+var localeValidator = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8}){0,3}$`)
+
+func Preferences(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*models.User)
+
+	preferences, err := storage.Default.GetUserPreferences(user.ID)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to load preferences: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, preferences)
+}
+
+// SetPreferences changes the preferences given, an empty string goes back to
+// the default.
+func SetPreferences(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*models.User)
+
+	var params struct {
+		Denomination *string `json:"denomination"`
+		Currency     *string `json:"currency"`
+		Locale       *string `json:"locale"`
+		Theme        *string `json:"theme"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		apiutils.SendJSONError(w, 400, "got invalid JSON: %s", err.Error())
+		return
+	}
+
+	preferences, err := storage.Default.GetUserPreferences(user.ID)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to load preferences: %s", err.Error())
+		return
+	}
+
+	if params.Denomination != nil {
+		switch *params.Denomination {
+		case "", "sat", "msat", "btc":
+			preferences.Denomination = *params.Denomination
+		default:
+			apiutils.SendJSONError(w, 400, "denomination must be sat, msat or btc")
+			return
+		}
+	}
+	if params.Currency != nil {
+		if *params.Currency != "" && !isCurrency(*params.Currency) {
+			apiutils.SendJSONError(w, 400, "unknown currency '%s'", *params.Currency)
+			return
+		}
+		preferences.Currency = *params.Currency
+	}
+	if params.Locale != nil {
+		if *params.Locale != "" && !localeValidator.MatchString(*params.Locale) {
+			apiutils.SendJSONError(w, 400, "invalid locale '%s'", *params.Locale)
+			return
+		}
+		preferences.Locale = *params.Locale
+	}
+	if params.Theme != nil {
+		// built-in themes aren't in the database, so any valid name is allowed
+		if *params.Theme != "" && !themeNameValidator.MatchString(*params.Theme) {
+			apiutils.SendJSONError(w, 400, "invalid theme '%s'", *params.Theme)
+			return
+		}
+		preferences.Theme = *params.Theme
+	}
+
+	if err := storage.Default.SetUserPreferences(preferences); err != nil {
+		apiutils.SendJSONError(w, 500, "failed to save preferences: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, preferences)
+}
+
+func isCurrency(code string) bool {
+	for _, currency := range utils.CURRENCIES {
+		if currency == code {
+			return true
+		}
+	}
+	return false
+}
@@ -6,12 +6,15 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	lnurl "github.com/fiatjaf/go-lnurl"
 	mux "github.com/gorilla/mux"
 	rp "github.com/lnbits/relampago"
 
 	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/ledger"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/services"
 	"github.com/lnbits/infinity/storage"
@@ -24,19 +27,89 @@ func Wallet(w http.ResponseWriter, r *http.Request) {
 	// load wallet balance
 	wallet.Balance, _ = services.LoadWalletBalance(wallet.ID)
 
-	// load wallet payments
-	wallet.Payments, _ = services.LoadWalletPayments(wallet.ID)
+	// load the latest wallet payments, the others are loaded from /api/wallet/payments
+	wallet.Payments, wallet.PaymentsNext, _ = services.ListWalletPayments(
+		wallet.ID, PaymentsPageSize, "", "")
 
 	// load wallet balanceChecks
-	storage.DB.Where("wallet_id = ?", wallet.ID).Find(&wallet.BalanceChecks)
+	wallet.BalanceChecks, _ = storage.Default.ListBalanceChecks(wallet.ID)
 
 	// LNURL drain URL
 	wallet.LNURLDrain, _ = lnurl.LNURLEncode(
-		r.URL.Scheme + "://" + r.Host + "/lnurl/wallet/drain?api-key=" + wallet.AdminKey)
+		r.URL.Scheme + "://" + r.Host + apiutils.BasePath + "/lnurl/wallet/drain?api-key=" + string(wallet.AdminKey))
 
 	apiutils.SendJSON(w, wallet)
 }
 
+func Payments(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	limit := PaymentsPageSize
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	payments, next, err := services.ListWalletPayments(
+		wallet.ID, limit, r.URL.Query().Get("cursor"), r.URL.Query().Get("q"))
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "failed to load payments: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		Payments []models.Payment `json:"payments"`
+		Next     string           `json:"next,omitempty"`
+	}{payments, next})
+}
+
+// BalanceHistory returns the wallet balance at the end of each of the last `days`
+// days (default 30), and the current balance.
+func BalanceHistory(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	days := 30
+	if d, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && d > 0 && d <= 3660 {
+		days = d
+	}
+
+	history, err := ledger.BalanceHistory(wallet.ID, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+	balance, err := services.LoadWalletBalance(wallet.ID)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		History []models.BalanceSnapshot `json:"history"`
+		Balance int64                    `json:"balance"`
+	}{history, balance})
+}
+
+// Usage returns the payment volume, counts and routing fees of the wallet for
+// each of the last `months` (default 12), including the current one.
+func Usage(w http.ResponseWriter, r *http.Request) {
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	months := 12
+	if m, err := strconv.Atoi(r.URL.Query().Get("months")); err == nil && m > 0 && m <= 120 {
+		months = m
+	}
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month()-time.Month(months-1), 1, 0, 0, 0, 0, time.UTC)
+
+	volume, err := ledger.MonthlyVolume(since, wallet.ID)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, volume)
+}
+
 func RenameWallet(w http.ResponseWriter, r *http.Request) {
 	wallet := r.Context().Value("wallet").(*models.Wallet)
 
@@ -46,7 +119,10 @@ func RenameWallet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	wallet.Name = mux.Vars(r)["new-name"]
-	storage.DB.Save(&wallet)
+	if err := storage.Default.RenameWallet(wallet.ID, wallet.Name); err != nil {
+		apiutils.SendJSONError(w, 500, "failed to rename wallet: %s", err.Error())
+		return
+	}
 
 	w.WriteHeader(200)
 }
@@ -59,11 +135,10 @@ func DeleteWallet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	wallet.AdminKey = "del:" + wallet.AdminKey
-	wallet.InvoiceKey = "del:" + wallet.InvoiceKey
-	wallet.UserID = "del:" + wallet.UserID
-
-	storage.DB.Save(&wallet)
+	if err := services.DeleteWallet(wallet.ID); err != nil {
+		apiutils.SendJSONError(w, 500, "failed to delete wallet: %s", err.Error())
+		return
+	}
 
 	w.WriteHeader(200)
 }
@@ -115,7 +190,7 @@ func CreateInvoice(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	payment, err := services.CreateInvoice(wallet.ID, params.CreateInvoiceParams)
+	payment, err := services.CreateInvoice(r.Context(), wallet.ID, params.CreateInvoiceParams)
 	if err != nil {
 		apiutils.SendJSONError(w, 450, fmt.Sprintf("failed to create invoice: %s", err.Error()))
 		return
@@ -149,9 +224,9 @@ func PayInvoice(w http.ResponseWriter, r *http.Request) {
 		params.Invoice = params.Bolt11
 	}
 
-	payment, err := services.PayInvoice(wallet.ID, params.PayInvoiceParams)
+	payment, err := services.PayInvoice(r.Context(), wallet.ID, params.PayInvoiceParams)
 	if err != nil {
-		apiutils.SendJSONError(w, 450, fmt.Sprintf("failed to pay invoice: %s", err.Error()))
+		sendPaymentError(w, 450, "failed to pay invoice", err)
 		return
 	}
 
@@ -234,14 +309,14 @@ func PayLnurl(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// actually pay
-	payment, err := services.PayInvoice(wallet.ID, services.PayInvoiceParams{
+	payment, err := services.PayInvoice(r.Context(), wallet.ID, services.PayInvoiceParams{
 		PaymentParams: rp.PaymentParams{
 			Invoice: values.PR,
 		},
 		Extra: extra,
 	})
 	if err != nil {
-		apiutils.SendJSONError(w, 500, "failed to pay: %s", err.Error())
+		sendPaymentError(w, 500, "failed to pay", err)
 		return
 	}
 
@@ -260,8 +335,10 @@ func GetPayment(w http.ResponseWriter, r *http.Request) {
 	wallet := r.Context().Value("wallet").(*models.Wallet)
 	id := mux.Vars(r)["id"]
 
-	payment := models.Payment{CheckingID: id, WalletID: wallet.ID}
-	storage.DB.Where(&payment).First(&payment)
+	payment, err := storage.Default.GetPayment(wallet.ID, id)
+	if err != nil {
+		payment = &models.Payment{}
+	}
 
 	apiutils.SendJSON(w, payment)
 }
@@ -2,6 +2,7 @@ package apps
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -11,6 +12,7 @@ import (
 )
 
 type KeyValue struct {
+	Model string      `json:"model"`
 	Key   string      `json:"key"`
 	Value interface{} `json:"value"`
 }
@@ -29,15 +31,67 @@ func Info(w http.ResponseWriter, r *http.Request) {
 
 func Refresh(w http.ResponseWriter, r *http.Request) {
 	app := appIDToURL(mux.Vars(r)["appid"])
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+	previous := getCachedAppSettings(app)
 	codeCache.Delete(app)
 	settingsCache.Delete(app)
+	manifestCache.Delete(app)
+	appUpdates.Delete(app)
+
+	// keep running the previous version if the new one can't be trusted
+	rollback := func() {
+		if previous != nil {
+			settingsCache.Set(app, previous)
+			codeCache.Set(app, previous.Code)
+		}
+	}
+
+	// check who signed the latest code before it is loaded, pinning the new
+	// signer if the user trusts it
+	code, err := fetchLatestCode(app)
+	if err != nil {
+		rollback()
+		apiutils.SendJSONError(w, 400, "failed to get app code: %s", err.Error())
+		return
+	}
+	signer, err := VerifyAppSignature(app, code)
+	if err != nil {
+		rollback()
+		apiutils.SendJSONError(w, 400, "invalid app signature: %s", err.Error())
+		return
+	}
+	accept := r.URL.Query().Get("accept_signer") == "true"
+	if err := checkAppSigner(wallet.UserID, app, signer, accept); err != nil {
+		rollback()
+		if errors.Is(err, ErrSignerChanged) {
+			apiutils.SendJSONError(w, 409,
+				"%s. call again with ?accept_signer=true if you trust it.", err.Error())
+		} else {
+			apiutils.SendJSONError(w, 500, "failed to check app signer: %s", err.Error())
+		}
+		return
+	}
+
+	// load the updated app and migrate its data right away
+	settings, err := GetAppSettings(app, true)
+	if err != nil {
+		rollback()
+		apiutils.SendJSONError(w, 400, "failed to get app settings: %s", err.Error())
+		return
+	}
+	if err := ensureMigrated(wallet.ID, settings); err != nil {
+		apiutils.SendJSONError(w, 470, "failed to migrate app data: %s", err.Error())
+		return
+	}
+
+	go SyncNostrSubscriptions()
 }
 
 func ClearData(w http.ResponseWriter, r *http.Request) {
 	app := appIDToURL(mux.Vars(r)["appid"])
 	wallet := r.Context().Value("wallet").(*models.Wallet)
 
-	result := storage.DB.
+	result := storage.DB.Scopes(storage.AppItems(wallet.ID)).
 		Where(&models.AppDataItem{
 			App:      app,
 			WalletID: wallet.ID,
@@ -48,6 +102,10 @@ func ClearData(w http.ResponseWriter, r *http.Request) {
 		apiutils.SendJSONError(w, 500, "database error: %s", result.Error.Error())
 		return
 	}
+
+	storage.DB.Scopes(storage.AppItemTerms(wallet.ID)).
+		Where(&models.AppItemTerm{App: app, WalletID: wallet.ID}).
+		Delete(&models.AppItemTerm{})
 }
 
 func ListItems(w http.ResponseWriter, r *http.Request) {
@@ -56,12 +114,30 @@ func ListItems(w http.ResponseWriter, r *http.Request) {
 	wallet := r.Context().Value("wallet").(*models.Wallet)
 	modelName := mux.Vars(r)["model"]
 
-	items, err := DBList(wallet.ID, app, modelName, qs.Get("startkey"), qs.Get("endkey"))
+	params := make(map[string]interface{}, len(qs))
+	for k := range qs {
+		params[k] = qs.Get(k)
+	}
+	if qs.Has("desc") {
+		params["desc"] = qs.Get("desc") == "true"
+	}
+
+	lp, err := parseListParams(params)
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "%s", err.Error())
+		return
+	}
+
+	items, err := listItems(wallet.ID, app, modelName, lp)
 	if err != nil {
 		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
 		return
 	}
 
+	if lp.Limit > 0 && len(items) == lp.Limit && lp.SortBy == "key" {
+		w.Header().Set("X-Next-Cursor", items[len(items)-1].Key)
+	}
+
 	apiutils.SendJSON(w, items)
 }
 
@@ -99,7 +175,7 @@ func SetItem(w http.ResponseWriter, r *http.Request) {
 	go TriggerEventOnSpecificAppWallet(
 		AppWallet{wallet.ID, app},
 		"api_db_set",
-		KeyValue{key, value},
+		KeyValue{model, key, value},
 	)
 }
 
@@ -124,7 +200,7 @@ func AddItem(w http.ResponseWriter, r *http.Request) {
 	go TriggerEventOnSpecificAppWallet(
 		AppWallet{wallet.ID, app},
 		"api_db_set", // because set and add are the same, let's simplify
-		KeyValue{key, value},
+		KeyValue{model, key, value},
 	)
 }
 
@@ -142,6 +218,6 @@ func DeleteItem(w http.ResponseWriter, r *http.Request) {
 	go TriggerEventOnSpecificAppWallet(
 		AppWallet{wallet.ID, app},
 		"api_db_delete",
-		KeyValue{key, nil},
+		KeyValue{model, key, nil},
 	)
 }
@@ -0,0 +1,84 @@
+package apps
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/lnbits/infinity/api/apiutils"
+)
+
+// first-party apps shipped with the binary, they live under builtin/<name>/app.lua
+// and are referenced by users as builtin:///<name>/app.lua
+//
+//go:embed builtin
+var builtinFS embed.FS
+
+const builtinScheme = "builtin"
+
+func builtinAppURL(name string) string {
+	return builtinScheme + ":///" + name + "/app.lua"
+}
+
+func readBuiltinFile(fileURL string) ([]byte, error) {
+	u, err := url.Parse(fileURL)
+	if err != nil || u.Scheme != builtinScheme {
+		return nil, fmt.Errorf("invalid builtin url '%s'", fileURL)
+	}
+	return fs.ReadFile(builtinFS, path.Join("builtin", path.Clean(u.Path)))
+}
+
+func serveBuiltinFile(w http.ResponseWriter, r *http.Request, fileURL *url.URL) {
+	content, err := readBuiltinFile(fileURL.String())
+	if err != nil {
+		http.Error(w, "file not found: "+fileURL.Path, 404)
+		return
+	}
+	http.ServeContent(w, r, path.Base(fileURL.Path), time.Time{}, bytes.NewReader(content))
+}
+
+type BuiltinApp struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+func listBuiltinApps() []BuiltinApp {
+	entries, _ := fs.ReadDir(builtinFS, "builtin")
+
+	list := make([]BuiltinApp, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		url := builtinAppURL(entry.Name())
+		settings, err := GetAppSettings(url, false)
+		if err != nil {
+			log.Warn().Err(err).Str("app", url).Msg("builtin app is broken")
+			continue
+		}
+
+		list = append(list, BuiltinApp{
+			Name:        entry.Name(),
+			URL:         url,
+			ID:          appURLToID(url),
+			Title:       settings.Title,
+			Description: strings.TrimSpace(settings.Description),
+		})
+	}
+
+	return list
+}
+
+func BuiltinApps(w http.ResponseWriter, r *http.Request) {
+	apiutils.SendJSON(w, listBuiltinApps())
+}
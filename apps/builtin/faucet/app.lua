@@ -0,0 +1,257 @@
+title = 'Faucet'
+
+description = [[
+Give away small amounts to anyone who visits the faucet page, through
+LNURL-withdraw. Claims are limited per IP address and per receiving node over
+a time window, and a captcha can be required before each claim.
+
+[Open the faucet]($extBase/)
+]]
+
+local CAPTCHA_VERIFY_URLS = {
+  hcaptcha = 'https://hcaptcha.com/siteverify',
+  turnstile = 'https://challenges.cloudflare.com/turnstile/v0/siteverify',
+  recaptcha = 'https://www.google.com/recaptcha/api/siteverify',
+}
+
+fetch_domains = { 'hcaptcha.com', 'challenges.cloudflare.com', 'www.google.com' }
+
+models = {
+  {
+    name = 'settings',
+    display = 'Settings',
+    single = true,
+    fields = {
+      { name = 'title', display = 'Title', type = 'string', required = true },
+      { name = 'amount', display = 'Amount per Claim', type = 'msatoshi', required = true },
+      { name = 'window_hours', display = 'Limit Window (hours)', type = 'number', default = 24, required = true },
+      { name = 'ip_limit', display = 'Claims per IP', type = 'number', default = 1, required = true },
+      { name = 'pubkey_limit', display = 'Claims per Node', type = 'number', default = 1, required = true },
+      { name = 'budget', display = 'Budget per Window', type = 'msatoshi' },
+      { name = 'captcha_provider', display = 'Captcha', type = 'select', options = {'none', 'hcaptcha', 'turnstile', 'recaptcha'}, default = 'none' },
+      { name = 'captcha_sitekey', display = 'Captcha Site Key', type = 'string' },
+      { name = 'captcha_secret', display = 'Captcha Secret', type = 'string' },
+    },
+  },
+  {
+    name = 'ticket',
+    display = 'Pending Claim',
+    fields = {
+      { name = 'ip', display = 'IP', type = 'string', required = true },
+      { name = 'created_at', display = 'Date', type = 'datetime', required = true },
+      { name = 'used', display = 'Used', type = 'boolean', required = true },
+    },
+  },
+  {
+    name = 'claim',
+    display = 'Claim',
+    fields = {
+      { name = 'ip', display = 'IP', type = 'string', required = true },
+      { name = 'pubkey', display = 'Node', type = 'string', required = true },
+      { name = 'msatoshi', display = 'Amount', type = 'msatoshi', required = true },
+      { name = 'claimed_at', display = 'Date', type = 'datetime', required = true },
+    },
+    default_sort = 'claimed_at desc',
+  },
+}
+
+local TICKET_TTL = 600
+
+local function base_url(params)
+  return params._url:match('^(.-)/action/')
+end
+
+local function lnurl_error(reason)
+  return { status = 'ERROR', reason = reason }
+end
+
+local function get_settings()
+  local settings, err = db.settings.get()
+  if err or settings == nil then error('faucet not configured') end
+  return settings
+end
+
+-- counts the claims inside the current window, total and by ip and pubkey
+local function recent_claims(settings, ip, pubkey)
+  local all, err = db.claim.list()
+  if err then error(err) end
+
+  local since = os.time() - settings.window_hours * 3600
+  local stats = { by_ip = 0, by_pubkey = 0, total = 0 }
+  for _, item in ipairs(all) do
+    local claim = item.value
+    if claim.claimed_at >= since then
+      stats.total = stats.total + claim.msatoshi
+      if ip and claim.ip == ip then stats.by_ip = stats.by_ip + 1 end
+      if pubkey and claim.pubkey == pubkey then stats.by_pubkey = stats.by_pubkey + 1 end
+    end
+  end
+  return stats
+end
+
+local function check_limits(settings, ip, pubkey)
+  local stats = recent_claims(settings, ip, pubkey)
+  if stats.by_ip >= settings.ip_limit then
+    return 'too many claims from this address, come back later'
+  end
+  if pubkey and stats.by_pubkey >= settings.pubkey_limit then
+    return 'too many claims to this node, come back later'
+  end
+  if settings.budget and stats.total + settings.amount > settings.budget then
+    return 'the faucet is dry for now, come back later'
+  end
+end
+
+local function verify_captcha(settings, token, ip)
+  local verify_url = CAPTCHA_VERIFY_URLS[settings.captcha_provider or 'none']
+  if not verify_url then return true end
+  if not token or token == '' then return false end
+
+  local result, status, err = http.request('POST', verify_url, qs.encode({
+    secret = settings.captcha_secret,
+    response = token,
+    remoteip = ip,
+  }), { ['Content-Type'] = 'application/x-www-form-urlencoded' })
+  if err or status ~= 200 or type(result) ~= 'table' then
+    print('captcha verification failed', status, err)
+    return false
+  end
+  return result.success == true
+end
+
+actions = {
+  getinfo = {
+    handler = function ()
+      local settings = get_settings()
+      local captcha = nil
+      if CAPTCHA_VERIFY_URLS[settings.captcha_provider or 'none'] then
+        captcha = { provider = settings.captcha_provider, sitekey = settings.captcha_sitekey }
+      end
+
+      return {
+        title = settings.title,
+        amount = settings.amount,
+        window_hours = settings.window_hours,
+        captcha = captcha,
+      }
+    end,
+  },
+  request = {
+    fields = {
+      { name = 'captcha', type = 'string' },
+    },
+    handler = function (params)
+      local settings = get_settings()
+
+      local reason = check_limits(settings, params._ip, nil)
+      if reason then error(reason) end
+
+      if not verify_captcha(settings, params.captcha, params._ip) then
+        error('captcha verification failed')
+      end
+
+      local k1 = utils.random_hex(32)
+      local err = db.ticket.set(k1, {
+        ip = params._ip,
+        created_at = os.time(),
+        used = false,
+      })
+      if err then error(err) end
+
+      return {
+        k1 = k1,
+        lnurl = lnurl.bech32_encode(base_url(params) .. '/action/lnurl?k1=' .. k1),
+      }
+    end,
+  },
+  lnurl = {
+    fields = {
+      { name = 'k1', type = 'string', required = true },
+    },
+    handler = function (params)
+      local settings = get_settings()
+      local ticket, err = db.ticket.get(params.k1)
+      if err or ticket.used or ticket.created_at + TICKET_TTL < os.time() then
+        return lnurl_error('claim link expired, get a new one')
+      end
+
+      return {
+        tag = 'withdrawRequest',
+        callback = base_url(params) .. '/action/withdraw',
+        k1 = params.k1,
+        minWithdrawable = settings.amount,
+        maxWithdrawable = settings.amount,
+        defaultDescription = settings.title,
+      }
+    end,
+  },
+  withdraw = {
+    fields = {
+      { name = 'k1', type = 'string', required = true },
+      { name = 'pr', type = 'string', required = true },
+    },
+    handler = function (params)
+      local settings = get_settings()
+
+      local item, err = db.ticket.get_item(params.k1)
+      local ticket = item and item.value
+      if err or ticket.used or ticket.created_at + TICKET_TTL < os.time() then
+        return lnurl_error('claim link expired, get a new one')
+      end
+
+      local invoice, err = utils.decode_invoice(params.pr)
+      if err then return lnurl_error('invalid invoice') end
+      if invoice.msatoshi ~= settings.amount then
+        return lnurl_error('invoice amount must be ' .. settings.amount .. ' msat')
+      end
+
+      -- the ip is the one that requested the ticket, the wallet calling us
+      -- here is usually somewhere else
+      local reason = check_limits(settings, ticket.ip, invoice.payee)
+      if reason then return lnurl_error(reason) end
+
+      -- only the claim that marks the ticket as used at the revision it read
+      -- gets paid, any other one done in parallel fails here
+      ticket.used = true
+      err = db.transaction({
+        { op = 'set', model = 'ticket', key = params.k1, value = ticket, revision = item.revision },
+      })
+      if db.is_conflict(err) then
+        return lnurl_error('claim link already used')
+      elseif err then
+        return lnurl_error('failed to use claim link')
+      end
+
+      local _, err = wallet.pay_invoice({ invoice = params.pr })
+      if err then return lnurl_error('payment failed') end
+
+      db.claim.add({
+        ip = ticket.ip,
+        pubkey = invoice.payee,
+        msatoshi = invoice.msatoshi,
+        claimed_at = os.time(),
+      })
+      app.emit_event('claimed', { k1 = params.k1 })
+
+      return { status = 'OK' }
+    end,
+  },
+}
+
+triggers = {
+  hourly = function ()
+    local all, err = db.ticket.list()
+    if err then error(err) end
+
+    local now = os.time()
+    for _, item in ipairs(all) do
+      if item.value.used or item.value.created_at + TICKET_TTL < now then
+        db.ticket.delete(item.key)
+      end
+    end
+  end,
+}
+
+files = {
+  ['*'] = 'index.html',
+}
@@ -0,0 +1,164 @@
+title = 'Paywall'
+
+description = [[
+Sell access to a URL or to a piece of text.
+
+Visitors pay an invoice and get an access token that stays valid for the
+number of hours you choose. Share the link shown on each paywall.
+]]
+
+models = {
+  {
+    name = 'paywall',
+    display = 'Paywall',
+    fields = {
+      { name = 'description', display = 'Description', type = 'string', required = true },
+      { name = 'url', display = 'Protected URL', type = 'url' },
+      { name = 'content', display = 'Protected Content', type = 'string' },
+      { name = 'price', display = 'Price', type = 'msatoshi', required = true },
+      { name = 'duration', display = 'Access Hours', type = 'number', default = 24 },
+      { name = 'requests', display = 'Invoices', type = 'number', default = 0 },
+      { name = 'purchases', display = 'Purchases', type = 'number', default = 0 },
+      { name = 'earned', display = 'Earned', type = 'msatoshi', default = 0 },
+      {
+        name = 'conversion',
+        display = 'Conversion',
+        type = 'string',
+        computed = function (paywall)
+          local requests = paywall.value.requests or 0
+          if requests == 0 then return '-' end
+          return string.format('%.1f%%', 100 * (paywall.value.purchases or 0) / requests)
+        end,
+      },
+      {
+        name = 'link',
+        display = 'Link',
+        type = 'url',
+        computed = function (paywall) return paywall.key end,
+      },
+    },
+  },
+  {
+    name = 'access',
+    display = 'Access Token',
+    plural = 'Access Tokens',
+    fields = {
+      { name = 'paywall', display = 'Paywall', type = 'ref', ref = 'paywall', as = 'description', required = true },
+      { name = 'paid', display = 'Paid', type = 'boolean', required = true },
+      { name = 'expires_at', display = 'Expires', type = 'datetime' },
+      { name = 'payment_hash', display = 'Payment Hash', type = 'string', required = true },
+    },
+    default_filters = {
+      {'paid', '=', true},
+    },
+  },
+}
+
+local function count(paywall_key, field, amount)
+  local paywall, err = db.paywall.get(paywall_key)
+  if err then error(err) end
+  paywall[field] = (paywall[field] or 0) + amount
+  db.paywall.set(paywall_key, paywall)
+end
+
+actions = {
+  getinfo = {
+    fields = {
+      { name = 'paywall', type = 'string', required = true },
+    },
+    handler = function (params)
+      local paywall, err = db.paywall.get(params.paywall)
+      if err then error('paywall not found') end
+
+      return {
+        description = paywall.description,
+        price = paywall.price,
+        duration = paywall.duration or 24,
+      }
+    end,
+  },
+  requestpay = {
+    fields = {
+      { name = 'paywall', type = 'string', required = true },
+    },
+    handler = function (params)
+      local paywall, err = db.paywall.get(params.paywall)
+      if err then error('paywall not found') end
+
+      -- the token only becomes valid once the invoice is paid and is only
+      -- known to the visitor that requested it
+      local token = utils.random_hex(32)
+
+      local payment, err = wallet.create_invoice({
+        msatoshi = paywall.price,
+        description = 'Access to ' .. paywall.description,
+        extra = { paywall = params.paywall, token = token },
+      })
+      if err then error(err) end
+
+      local err = db.access.set(token, {
+        paywall = params.paywall,
+        paid = false,
+        payment_hash = payment.hash,
+      })
+      if err then error(err) end
+
+      count(params.paywall, 'requests', 1)
+
+      return {
+        bolt11 = payment.bolt11,
+        hash = payment.hash,
+        token = token,
+      }
+    end,
+  },
+  access = {
+    fields = {
+      { name = 'token', type = 'string', required = true },
+    },
+    handler = function (params)
+      local access, err = db.access.get(params.token)
+      if err or not access.paid then error('not paid') end
+      if access.expires_at and access.expires_at < os.time() then
+        error('access expired')
+      end
+
+      local paywall, err = db.paywall.get(access.paywall)
+      if err then error('paywall not found') end
+
+      return {
+        url = paywall.url,
+        content = paywall.content,
+        expires_at = access.expires_at,
+      }
+    end,
+  },
+}
+
+triggers = {
+  payment_received = function (payment)
+    if payment.tag ~= app.id or payment.extra == nil or payment.extra.token == nil then
+      return
+    end
+
+    local access, err = db.access.get(payment.extra.token)
+    if err then error(err) end
+
+    local paywall, err = db.paywall.get(access.paywall)
+    if err then error(err) end
+
+    access.paid = true
+    access.expires_at = os.time() + (paywall.duration or 24) * 3600
+    db.access.set(payment.extra.token, access)
+
+    count(access.paywall, 'purchases', 1)
+    count(access.paywall, 'earned', payment.amount)
+
+    -- only the hash goes out, the visitor holding the token then calls 'access'
+    app.emit_event('paid', { hash = payment.hash })
+  end,
+}
+
+files = {
+  ['*'] = 'index.html',
+}
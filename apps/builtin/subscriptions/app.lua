@@ -0,0 +1,351 @@
+title = 'Subscriptions'
+
+description = [[
+Charge your supporters or customers periodically. Define plans with a price
+and a billing period; subscribers either renew through an LNURL-pay code or
+give a Nostr Wallet Connect string that gets charged automatically.
+
+Subscriptions that aren't renewed go into a grace period and then lapse, at
+which point the plan webhook (if any) is called.
+]]
+
+-- plan webhooks can be anywhere
+fetch_domains = { '*' }
+
+models = {
+  {
+    name = 'plan',
+    display = 'Plan',
+    fields = {
+      { name = 'name', display = 'Name', type = 'string', required = true },
+      { name = 'description', display = 'Description', type = 'string' },
+      { name = 'amount', display = 'Price', type = 'msatoshi', required = true },
+      { name = 'period_days', display = 'Period (days)', type = 'number', default = 30, required = true },
+      { name = 'grace_days', display = 'Grace Period (days)', type = 'number', default = 3, required = true },
+      { name = 'webhook', display = 'Webhook', type = 'url' },
+      { name = 'secret', display = 'API Secret', type = 'string' },
+      {
+        name = 'link',
+        display = 'Subscribe Page',
+        type = 'url',
+        computed = function (plan) return plan.key end,
+      },
+      {
+        name = 'api',
+        display = 'Subscribers API',
+        type = 'url',
+        computed = function (plan)
+          if not plan.value.secret then return nil end
+          return 'api/subscribers/' .. plan.key .. '/' .. plan.value.secret
+        end,
+      },
+    },
+  },
+  {
+    name = 'subscriber',
+    display = 'Subscriber',
+    fields = {
+      { name = 'plan', display = 'Plan', type = 'ref', ref = 'plan', as = 'name', required = true },
+      { name = 'name', display = 'Name', type = 'string', required = true },
+      { name = 'contact', display = 'Contact', type = 'string' },
+      { name = 'nwc', display = 'Wallet Connect', type = 'string' },
+      { name = 'status', display = 'Status', type = 'select', options = {'pending', 'active', 'grace', 'lapsed'}, required = true },
+      { name = 'paid_until', display = 'Paid Until', type = 'datetime' },
+      { name = 'last_pull', display = 'Last Charge Attempt', type = 'datetime' },
+    },
+    default_sort = 'paid_until desc',
+  },
+  {
+    name = 'charge',
+    display = 'Charge',
+    fields = {
+      { name = 'subscriber', display = 'Subscriber', type = 'ref', ref = 'subscriber', as = 'name', required = true },
+      { name = 'msatoshi', display = 'Amount', type = 'msatoshi', required = true },
+      { name = 'method', display = 'Method', type = 'string', required = true },
+      { name = 'paid_at', display = 'Date', type = 'datetime', required = true },
+    },
+    default_sort = 'paid_at desc',
+  },
+}
+
+local DAY = 86400
+
+local function base_url(params)
+  return params._url:match('^(.-)/action/')
+end
+
+local function lnurl_error(reason)
+  return { status = 'ERROR', reason = reason }
+end
+
+local function get_plan(key)
+  local plan, err = db.plan.get(key)
+  if err then error('plan not found') end
+  return plan
+end
+
+local function lnurlp_metadata(plan)
+  return json.encode({ { 'text/plain', 'Subscription to ' .. plan.name } })
+end
+
+local function public_status(key, subscriber)
+  return {
+    subscriber = key,
+    plan = subscriber.plan,
+    name = subscriber.name,
+    status = subscriber.status,
+    paid_until = subscriber.paid_until,
+  }
+end
+
+local function notify(plan, event, key, subscriber)
+  if not plan.webhook then return end
+
+  local _, status, err = http.post(plan.webhook, {
+    event = event,
+    subscriber = public_status(key, subscriber),
+  })
+  if err or status >= 300 then
+    print('webhook to ' .. plan.webhook .. ' failed', status, err)
+  end
+end
+
+local function invoice_for(key, subscriber, plan, method, description_hash)
+  local params = {
+    msatoshi = plan.amount,
+    extra = { subscriber = key, method = method },
+  }
+  if description_hash then
+    params.description_hash = description_hash
+  else
+    params.description = 'Subscription to ' .. plan.name
+  end
+
+  local payment, err = wallet.create_invoice(params)
+  if err then error(err) end
+  return payment
+end
+
+-- tries to charge the subscriber's wallet connect, the payment_received
+-- trigger takes care of extending the subscription when it works
+local function pull(key, subscriber, plan)
+  subscriber.last_pull = os.time()
+  db.subscriber.set(key, subscriber)
+
+  local payment = invoice_for(key, subscriber, plan, 'nwc')
+  local _, err = utils.nwc_pay_invoice(subscriber.nwc, payment.bolt11)
+  if err then
+    print('failed to charge ' .. key .. ' through wallet connect', err)
+    return false
+  end
+  return true
+end
+
+actions = {
+  getplan = {
+    fields = {
+      { name = 'plan', type = 'string', required = true },
+    },
+    handler = function (params)
+      local plan = get_plan(params.plan)
+      return {
+        name = plan.name,
+        description = plan.description,
+        amount = plan.amount,
+        period_days = plan.period_days,
+      }
+    end,
+  },
+  subscribe = {
+    fields = {
+      { name = 'plan', type = 'string', required = true },
+      { name = 'name', type = 'string', required = true },
+      { name = 'contact', type = 'string' },
+      { name = 'nwc', type = 'string' },
+    },
+    handler = function (params)
+      local plan = get_plan(params.plan)
+
+      local key = utils.random_hex(16)
+      local subscriber = {
+        plan = params.plan,
+        name = params.name,
+        contact = params.contact,
+        nwc = params.nwc,
+        status = 'pending',
+      }
+      local err = db.subscriber.set(key, subscriber)
+      if err then error(err) end
+
+      local result = {
+        subscriber = key,
+        lnurl = lnurl.bech32_encode(base_url(params) .. '/action/lnurlp?s=' .. key),
+      }
+
+      if params.nwc then
+        if not pull(key, subscriber, plan) then
+          db.subscriber.delete(key)
+          error('failed to charge the wallet connect')
+        end
+      else
+        local payment = invoice_for(key, subscriber, plan, 'invoice')
+        result.bolt11 = payment.bolt11
+        result.hash = payment.hash
+      end
+
+      return result
+    end,
+  },
+  lnurlp = {
+    fields = {
+      { name = 's', type = 'string', required = true },
+    },
+    handler = function (params)
+      local subscriber, err = db.subscriber.get(params.s)
+      if err then return lnurl_error('subscription not found') end
+      local plan = get_plan(subscriber.plan)
+
+      return {
+        tag = 'payRequest',
+        callback = base_url(params) .. '/action/lnurlp_callback?s=' .. params.s,
+        minSendable = plan.amount,
+        maxSendable = plan.amount,
+        metadata = lnurlp_metadata(plan),
+      }
+    end,
+  },
+  lnurlp_callback = {
+    fields = {
+      { name = 's', type = 'string', required = true },
+      { name = 'amount', type = 'string', required = true },
+    },
+    handler = function (params)
+      local subscriber, err = db.subscriber.get(params.s)
+      if err then return lnurl_error('subscription not found') end
+      local plan = get_plan(subscriber.plan)
+
+      if tonumber(params.amount) ~= plan.amount then
+        return lnurl_error('amount must be ' .. plan.amount .. ' msat')
+      end
+
+      local payment = invoice_for(params.s, subscriber, plan, 'lnurl',
+        utils.sha256(lnurlp_metadata(plan)))
+      return { pr = payment.bolt11, routes = emptyarray() }
+    end,
+  },
+  status = {
+    fields = {
+      { name = 'subscriber', type = 'string', required = true },
+    },
+    handler = function (params)
+      local subscriber, err = db.subscriber.get(params.subscriber)
+      if err then error('subscription not found') end
+      return public_status(params.subscriber, subscriber)
+    end,
+  },
+}
+
+routes = {
+  {
+    method = 'GET',
+    path = '/subscribers/{plan}/{secret}',
+    handler = function (req)
+      local plan, err = db.plan.get(req.params.plan)
+      if err or not plan.secret or plan.secret ~= req.params.secret then
+        error('plan not found')
+      end
+
+      local all, err = db.subscriber.list()
+      if err then error(err) end
+
+      local subscribers = {}
+      for _, item in ipairs(all) do
+        if item.value.plan == req.params.plan and
+          (req.query.status == nil or req.query.status == item.value.status) then
+          table.insert(subscribers, public_status(item.key, item.value))
+        end
+      end
+      if #subscribers == 0 then return emptyarray() end
+      return subscribers
+    end,
+  },
+  {
+    method = 'GET',
+    path = '/status/{subscriber}',
+    handler = function (req)
+      local subscriber, err = db.subscriber.get(req.params.subscriber)
+      if err then error('subscription not found') end
+      return public_status(req.params.subscriber, subscriber)
+    end,
+  },
+}
+
+triggers = {
+  api_db_set = function (kv)
+    if kv.model == 'plan' and not kv.value.secret then
+      kv.value.secret = utils.random_hex(16)
+      db.plan.set(kv.key, kv.value)
+    end
+  end,
+  payment_received = function (payment)
+    if payment.tag ~= app.id or payment.extra == nil or payment.extra.subscriber == nil then
+      return
+    end
+
+    local key = payment.extra.subscriber
+    local subscriber, err = db.subscriber.get(key)
+    if err then error(err) end
+    local plan = get_plan(subscriber.plan)
+
+    local renewed = subscriber.status == 'lapsed'
+    local start = math.max(os.time(), subscriber.paid_until or 0)
+    subscriber.paid_until = start + plan.period_days * DAY
+    subscriber.status = 'active'
+    db.subscriber.set(key, subscriber)
+
+    db.charge.add({
+      subscriber = key,
+      msatoshi = payment.amount,
+      method = payment.extra.method or 'invoice',
+      paid_at = os.time(),
+    })
+
+    app.emit_event('paid', { hash = payment.hash, subscriber = key })
+    if renewed then notify(plan, 'renewed', key, subscriber) end
+  end,
+  hourly = function ()
+    local all, err = db.subscriber.list()
+    if err then error(err) end
+
+    local now = os.time()
+    local plans = {}
+
+    for _, item in ipairs(all) do
+      local subscriber = item.value
+      if subscriber.paid_until and subscriber.paid_until < now and subscriber.status ~= 'lapsed' then
+        plans[subscriber.plan] = plans[subscriber.plan] or get_plan(subscriber.plan)
+        local plan = plans[subscriber.plan]
+
+        if subscriber.paid_until + plan.grace_days * DAY < now then
+          subscriber.status = 'lapsed'
+          db.subscriber.set(item.key, subscriber)
+          notify(plan, 'lapsed', item.key, subscriber)
+        else
+          if subscriber.status ~= 'grace' then
+            subscriber.status = 'grace'
+            db.subscriber.set(item.key, subscriber)
+          end
+
+          -- charge wallet connect subscribers at most once a day during the grace period
+          if subscriber.nwc and (subscriber.last_pull or 0) < now - DAY then
+            pull(item.key, subscriber, plan)
+          end
+        end
+      end
+    end
+  end,
+}
+
+files = {
+  ['*'] = 'index.html',
+}
@@ -0,0 +1,264 @@
+title = 'Events'
+
+description = [[
+Sell tickets to your events. Each paid ticket gets a QR code that is scanned
+at the door using the scanner link of the event.
+
+The attendee list of an event can be downloaded as CSV from its export link.
+]]
+
+models = {
+  {
+    name = 'event',
+    display = 'Event',
+    fields = {
+      { name = 'name', display = 'Name', type = 'string', required = true },
+      { name = 'description', display = 'Description', type = 'string' },
+      { name = 'date', display = 'Date', type = 'datetime', required = true },
+      { name = 'price', display = 'Price', type = 'msatoshi', required = true },
+      { name = 'capacity', display = 'Capacity', type = 'number', required = true },
+      { name = 'sold', display = 'Sold', type = 'number' },
+      { name = 'redeemed', display = 'Checked In', type = 'number' },
+      { name = 'secret', display = 'Staff Secret', type = 'string' },
+      {
+        name = 'link',
+        display = 'Sales Page',
+        type = 'url',
+        computed = function (event) return event.key end,
+      },
+      {
+        name = 'scanner',
+        display = 'Scanner',
+        type = 'url',
+        computed = function (event)
+          if not event.value.secret then return nil end
+          return 'scan/' .. event.key .. '/' .. event.value.secret
+        end,
+      },
+      {
+        name = 'export',
+        display = 'Attendees CSV',
+        type = 'url',
+        computed = function (event)
+          if not event.value.secret then return nil end
+          return 'api/attendees/' .. event.key .. '/' .. event.value.secret
+        end,
+      },
+    },
+    default_sort = 'date desc',
+  },
+  {
+    name = 'ticket',
+    display = 'Ticket',
+    fields = {
+      { name = 'event', display = 'Event', type = 'ref', ref = 'event', as = 'name', required = true },
+      { name = 'name', display = 'Name', type = 'string', required = true },
+      { name = 'email', display = 'Email', type = 'string' },
+      { name = 'paid', display = 'Paid', type = 'boolean', required = true },
+      { name = 'redeemed_at', display = 'Checked In', type = 'datetime' },
+      { name = 'payment_hash', display = 'Payment Hash', type = 'string', required = true },
+    },
+    default_filters = {
+      {'paid', '=', true},
+    },
+  },
+}
+
+local function get_event(key)
+  local event, err = db.event.get(key)
+  if err then error('event not found') end
+  return event
+end
+
+local function get_staff_event(key, secret)
+  local event, err = db.event.get(key)
+  if err or not event.secret or event.secret ~= secret then
+    error('event not found')
+  end
+  return event
+end
+
+local function event_tickets(event_key)
+  local all, err = db.ticket.list()
+  if err then error(err) end
+
+  local tickets = {}
+  for _, item in ipairs(all) do
+    if item.value.event == event_key and item.value.paid then
+      table.insert(tickets, item)
+    end
+  end
+  return tickets
+end
+
+local function csv_field(value)
+  value = tostring(value or '')
+  if value:find('[,"\n]') then
+    value = '"' .. value:gsub('"', '""') .. '"'
+  end
+  return value
+end
+
+actions = {
+  getevent = {
+    fields = {
+      { name = 'event', type = 'string', required = true },
+    },
+    handler = function (params)
+      local event = get_event(params.event)
+      return {
+        name = event.name,
+        description = event.description,
+        date = event.date,
+        price = event.price,
+        available = event.capacity - (event.sold or 0),
+      }
+    end,
+  },
+  buy = {
+    fields = {
+      { name = 'event', type = 'string', required = true },
+      { name = 'name', type = 'string', required = true },
+      { name = 'email', type = 'string' },
+    },
+    handler = function (params)
+      local event = get_event(params.event)
+      if (event.sold or 0) >= event.capacity then error('sold out') end
+      if event.date < os.time() then error('event already happened') end
+
+      -- the ticket code is what goes in the QR code, so it must not be guessable
+      local code = utils.random_hex(24)
+
+      local payment, err = wallet.create_invoice({
+        msatoshi = event.price,
+        description = 'Ticket for ' .. event.name,
+        extra = { ticket = code },
+      })
+      if err then error(err) end
+
+      local err = db.ticket.set(code, {
+        event = params.event,
+        name = params.name,
+        email = params.email,
+        paid = false,
+        payment_hash = payment.hash,
+      })
+      if err then error(err) end
+
+      return {
+        bolt11 = payment.bolt11,
+        hash = payment.hash,
+        ticket = code,
+      }
+    end,
+  },
+  getticket = {
+    fields = {
+      { name = 'ticket', type = 'string', required = true },
+    },
+    handler = function (params)
+      local ticket, err = db.ticket.get(params.ticket)
+      if err then error('ticket not found') end
+      local event = get_event(ticket.event)
+
+      return {
+        event = event.name,
+        date = event.date,
+        name = ticket.name,
+        paid = ticket.paid,
+        redeemed_at = ticket.redeemed_at,
+      }
+    end,
+  },
+  redeem = {
+    fields = {
+      { name = 'event', type = 'string', required = true },
+      { name = 'secret', type = 'string', required = true },
+      { name = 'ticket', type = 'string', required = true },
+    },
+    handler = function (params)
+      local event = get_staff_event(params.event, params.secret)
+
+      local ticket, err = db.ticket.get(params.ticket)
+      if err or ticket.event ~= params.event then error('ticket not valid for this event') end
+      if not ticket.paid then error('ticket not paid') end
+      if ticket.redeemed_at then
+        error('ticket already used at ' .. os.date('!%Y-%m-%d %H:%M UTC', ticket.redeemed_at))
+      end
+
+      ticket.redeemed_at = os.time()
+      db.ticket.set(params.ticket, ticket)
+
+      event.redeemed = (event.redeemed or 0) + 1
+      db.event.set(params.event, event)
+
+      return { name = ticket.name, redeemed = event.redeemed, sold = event.sold or 0 }
+    end,
+  },
+}
+
+routes = {
+  {
+    method = 'GET',
+    path = '/attendees/{event}/{secret}',
+    handler = function (req)
+      local event = get_staff_event(req.params.event, req.params.secret)
+
+      local lines = { 'ticket,name,email,checked_in' }
+      for _, item in ipairs(event_tickets(req.params.event)) do
+        local checked_in = ''
+        if item.value.redeemed_at then
+          checked_in = os.date('!%Y-%m-%dT%H:%M:%SZ', item.value.redeemed_at)
+        end
+
+        table.insert(lines, table.concat({
+          csv_field(item.key),
+          csv_field(item.value.name),
+          csv_field(item.value.email),
+          csv_field(checked_in),
+        }, ','))
+      end
+
+      return {
+        status = 200,
+        headers = {
+          ['Content-Type'] = 'text/csv',
+          ['Content-Disposition'] = 'attachment; filename="attendees.csv"',
+        },
+        body = table.concat(lines, '\n') .. '\n',
+      }
+    end,
+  },
+}
+
+triggers = {
+  api_db_set = function (kv)
+    if kv.model == 'event' and not kv.value.secret then
+      kv.value.secret = utils.random_hex(16)
+      db.event.set(kv.key, kv.value)
+    end
+  end,
+  payment_received = function (payment)
+    if payment.tag ~= app.id or payment.extra == nil or payment.extra.ticket == nil then
+      return
+    end
+
+    local ticket, err = db.ticket.get(payment.extra.ticket)
+    if err then error(err) end
+    if ticket.paid then return end
+
+    ticket.paid = true
+    db.ticket.set(payment.extra.ticket, ticket)
+
+    local event, err = db.event.get(ticket.event)
+    if err then error(err) end
+    event.sold = (event.sold or 0) + 1
+    db.event.set(ticket.event, event)
+
+    app.emit_event('paid', { hash = payment.hash })
+  end,
+}
+
+files = {
+  ['*'] = 'index.html',
+}
@@ -0,0 +1,164 @@
+title = 'Tip Jar'
+
+description = [[
+A public donation page with preset amounts, messages from donors and a
+fundraising goal. [Open the page]($extBase/)
+
+To embed a small widget on your website use:
+`<iframe src="$extBase/widget" width="320" height="420" frameborder="0"></iframe>`
+]]
+
+models = {
+  {
+    name = 'settings',
+    display = 'Settings',
+    single = true,
+    fields = {
+      { name = 'title', display = 'Title', type = 'string', required = true },
+      { name = 'description', display = 'Description', type = 'string' },
+      { name = 'presets', display = 'Preset Amounts (sat, comma-separated)', type = 'string', default = '1000,5000,21000' },
+      { name = 'goal', display = 'Goal', type = 'msatoshi' },
+    },
+  },
+  {
+    name = 'donation',
+    display = 'Donation',
+    fields = {
+      { name = 'name', display = 'Name', type = 'string' },
+      { name = 'message', display = 'Message', type = 'string' },
+      { name = 'msatoshi', display = 'Amount', type = 'msatoshi', required = true },
+      { name = 'paid', display = 'Paid', type = 'boolean', required = true },
+      { name = 'date', display = 'Date', type = 'datetime', required = true },
+    },
+    default_filters = {
+      {'paid', '=', true},
+    },
+    default_sort = 'date desc',
+  },
+}
+
+local MAX_MESSAGE = 280
+local RECENT = 10
+
+local function get_settings()
+  local settings, err = db.settings.get()
+  if err or settings == nil then
+    return { title = 'Tip Jar', presets = '1000,5000,21000' }
+  end
+  return settings
+end
+
+local function presets(settings)
+  local amounts = {}
+  for amount in (settings.presets or ''):gmatch('%d+') do
+    table.insert(amounts, tonumber(amount))
+  end
+  if #amounts == 0 then return emptyarray() end
+  return amounts
+end
+
+local function public_donation(donation)
+  return {
+    name = donation.name,
+    message = donation.message,
+    msatoshi = donation.msatoshi,
+    date = donation.date,
+  }
+end
+
+actions = {
+  getinfo = {
+    handler = function ()
+      local settings = get_settings()
+
+      local all, err = db.donation.list()
+      if err then error(err) end
+
+      local paid = {}
+      local raised = 0
+      for _, item in ipairs(all) do
+        if item.value.paid then
+          table.insert(paid, item.value)
+          raised = raised + item.value.msatoshi
+        end
+      end
+      table.sort(paid, function (a, b) return a.date > b.date end)
+
+      local recent = {}
+      for i = 1, math.min(RECENT, #paid) do
+        table.insert(recent, public_donation(paid[i]))
+      end
+      if #recent == 0 then recent = emptyarray() end
+
+      return {
+        title = settings.title,
+        description = settings.description,
+        presets = presets(settings),
+        goal = settings.goal,
+        raised = raised,
+        donations = #paid,
+        recent = recent,
+      }
+    end,
+  },
+  donate = {
+    fields = {
+      { name = 'sats', type = 'number', required = true },
+      { name = 'name', type = 'string' },
+      { name = 'message', type = 'string' },
+    },
+    handler = function (params)
+      local sats = math.floor(params.sats)
+      if sats < 1 then error('amount must be at least 1 sat') end
+
+      local message = params.message
+      if message and #message > MAX_MESSAGE then
+        message = message:sub(1, MAX_MESSAGE)
+      end
+
+      local settings = get_settings()
+      local payment, err = wallet.create_invoice({
+        msatoshi = sats * 1000,
+        description = 'Donation to ' .. settings.title,
+        extra = { donation = true },
+      })
+      if err then error(err) end
+
+      local err = db.donation.set(payment.hash, {
+        name = params.name,
+        message = message,
+        msatoshi = sats * 1000,
+        paid = false,
+        date = os.time(),
+      })
+      if err then error(err) end
+
+      return { bolt11 = payment.bolt11, hash = payment.hash }
+    end,
+  },
+}
+
+triggers = {
+  payment_received = function (payment)
+    if payment.tag ~= app.id or payment.extra == nil or not payment.extra.donation then
+      return
+    end
+
+    local donation, err = db.donation.get(payment.hash)
+    if err then error(err) end
+    if donation.paid then return end
+
+    donation.paid = true
+    donation.msatoshi = payment.amount
+    db.donation.set(payment.hash, donation)
+
+    app.emit_event('donation', {
+      hash = payment.hash,
+      donation = public_donation(donation),
+    })
+  end,
+}
+
+files = {
+  ['*'] = 'index.html',
+}
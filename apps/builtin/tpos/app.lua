@@ -0,0 +1,158 @@
+title = 'TPoS'
+
+description = [[
+A point-of-sale keypad for shops. Create a terminal for each till, open its
+link on a phone or tablet, type the amount in your currency and show the
+invoice to the customer.
+
+Sales are summarized per terminal and per day.
+]]
+
+models = {
+  {
+    name = 'terminal',
+    display = 'Terminal',
+    fields = {
+      { name = 'name', display = 'Name', type = 'string', required = true },
+      { name = 'currency', display = 'Currency', type = 'select', options = utils.currencies, default = 'USD', required = true },
+      {
+        name = 'link',
+        display = 'Link',
+        type = 'url',
+        computed = function (terminal) return terminal.key end,
+      },
+    },
+  },
+  {
+    name = 'sale',
+    display = 'Sale',
+    fields = {
+      { name = 'terminal', display = 'Terminal', type = 'ref', ref = 'terminal', as = 'name', required = true },
+      { name = 'amount', display = 'Amount', type = 'number', required = true },
+      { name = 'currency', display = 'Currency', type = 'string', required = true },
+      { name = 'msatoshi', display = 'Value', type = 'msatoshi', required = true },
+      { name = 'day', display = 'Day', type = 'string', required = true },
+      { name = 'paid', display = 'Paid', type = 'boolean', required = true },
+      { name = 'payment_hash', display = 'Payment Hash', type = 'string', required = true },
+    },
+    default_filters = {
+      {'paid', '=', true},
+    },
+  },
+  {
+    name = 'summary',
+    display = 'Daily Summary',
+    plural = 'Daily Summaries',
+    fields = {
+      { name = 'terminal', display = 'Terminal', type = 'ref', ref = 'terminal', as = 'name', required = true },
+      { name = 'day', display = 'Day', type = 'string', required = true },
+      { name = 'sales', display = 'Sales', type = 'number', required = true },
+      { name = 'amount', display = 'Total', type = 'number', required = true },
+      { name = 'currency', display = 'Currency', type = 'string', required = true },
+      { name = 'msatoshi', display = 'Received', type = 'msatoshi', required = true },
+    },
+    default_sort = 'day desc',
+  },
+}
+
+local function today()
+  return os.date('!%Y-%m-%d')
+end
+
+local function get_terminal(key)
+  local terminal, err = db.terminal.get(key)
+  if err then error('terminal not found') end
+  return terminal
+end
+
+actions = {
+  getinfo = {
+    fields = {
+      { name = 'terminal', type = 'string', required = true },
+    },
+    handler = function (params)
+      local terminal = get_terminal(params.terminal)
+      return {
+        name = terminal.name,
+        currency = terminal.currency,
+      }
+    end,
+  },
+  invoice = {
+    fields = {
+      { name = 'terminal', type = 'string', required = true },
+      { name = 'amount', type = 'number', required = true },
+    },
+    handler = function (params)
+      local terminal = get_terminal(params.terminal)
+      if params.amount <= 0 then error('amount must be positive') end
+
+      local msatoshi, err = rates.to_msats(params.amount, terminal.currency)
+      if err then error('failed to get exchange rate: ' .. tostring(err)) end
+      msatoshi = math.floor(msatoshi / 1000) * 1000
+
+      local payment, err = wallet.create_invoice({
+        msatoshi = msatoshi,
+        description = terminal.name .. ': ' .. params.amount .. ' ' .. terminal.currency,
+        extra = { terminal = params.terminal },
+      })
+      if err then error(err) end
+
+      local err = db.sale.set(payment.hash, {
+        terminal = params.terminal,
+        amount = params.amount,
+        currency = terminal.currency,
+        msatoshi = msatoshi,
+        day = today(),
+        paid = false,
+        payment_hash = payment.hash,
+      })
+      if err then error(err) end
+
+      return {
+        bolt11 = payment.bolt11,
+        hash = payment.hash,
+        msatoshi = msatoshi,
+      }
+    end,
+  },
+}
+
+triggers = {
+  payment_received = function (payment)
+    if payment.tag ~= app.id or payment.extra == nil or payment.extra.terminal == nil then
+      return
+    end
+
+    local sale, err = db.sale.get(payment.hash)
+    if err then error(err) end
+    if sale.paid then return end
+
+    sale.paid = true
+    db.sale.set(payment.hash, sale)
+
+    -- sales are summarized on the day they were created
+    local summary_key = sale.terminal .. ':' .. sale.day
+    local summary, err = db.summary.get(summary_key)
+    if err then
+      summary = {
+        terminal = sale.terminal,
+        day = sale.day,
+        sales = 0,
+        amount = 0,
+        currency = sale.currency,
+        msatoshi = 0,
+      }
+    end
+    summary.sales = summary.sales + 1
+    summary.amount = summary.amount + sale.amount
+    summary.msatoshi = summary.msatoshi + payment.amount
+    db.summary.set(summary_key, summary)
+
+    app.emit_event('paid', { hash = payment.hash })
+  end,
+}
+
+files = {
+  ['*'] = 'index.html',
+}
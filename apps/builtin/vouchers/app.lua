@@ -0,0 +1,244 @@
+title = 'Vouchers'
+
+description = [[
+Generate batches of printable LNURL-withdraw vouchers for events and
+giveaways. Each voucher can be claimed once or a fixed number of times, for a
+fixed amount or for any amount inside a range, until the batch expires.
+
+After adding a batch open its print link to get the QR codes.
+]]
+
+models = {
+  {
+    name = 'batch',
+    display = 'Batch',
+    plural = 'Batches',
+    fields = {
+      { name = 'title', display = 'Title', type = 'string', required = true },
+      { name = 'amount', display = 'Amount', type = 'msatoshi', required = true },
+      { name = 'max_amount', display = 'Max Amount (for variable vouchers)', type = 'msatoshi' },
+      { name = 'count', display = 'Vouchers', type = 'number', default = 10, required = true },
+      { name = 'uses', display = 'Uses per Voucher', type = 'number', default = 1, required = true },
+      { name = 'expires_at', display = 'Expires', type = 'datetime' },
+      { name = 'generated', display = 'Generated', type = 'number' },
+      { name = 'secret', display = 'Print Secret', type = 'string' },
+      { name = 'claimed', display = 'Claimed', type = 'msatoshi' },
+      {
+        name = 'print',
+        display = 'Print',
+        type = 'url',
+        computed = function (batch)
+          if not batch.value.secret then return nil end
+          return 'print/' .. batch.key .. '/' .. batch.value.secret
+        end,
+      },
+    },
+  },
+  {
+    name = 'voucher',
+    display = 'Voucher',
+    fields = {
+      { name = 'batch', display = 'Batch', type = 'ref', ref = 'batch', as = 'title', required = true },
+      { name = 'uses_left', display = 'Uses Left', type = 'number', required = true },
+    },
+  },
+  {
+    name = 'claim',
+    display = 'Claim',
+    fields = {
+      { name = 'batch', display = 'Batch', type = 'ref', ref = 'batch', as = 'title', required = true },
+      { name = 'voucher', display = 'Voucher', type = 'string', required = true },
+      { name = 'msatoshi', display = 'Amount', type = 'msatoshi', required = true },
+      { name = 'payment_hash', display = 'Payment Hash', type = 'string', required = true },
+      { name = 'claimed_at', display = 'Date', type = 'datetime', required = true },
+    },
+    default_sort = 'claimed_at desc',
+  },
+}
+
+local MAX_VOUCHERS = 500
+
+local function base_url(params)
+  return params._url:match('^(.-)/action/')
+end
+
+local function lnurl_error(reason)
+  return { status = 'ERROR', reason = reason }
+end
+
+-- changes an item only if nobody else wrote it since it was read, reading it
+-- again when they did. change can return a reason not to write it.
+local function update(model, key, change)
+  for _ = 1, 10 do
+    local item, err = db[model].get_item(key)
+    if err then return err end
+
+    local reason = change(item.value)
+    if reason then return reason end
+
+    err = db.transaction({
+      { op = 'set', model = model, key = key, value = item.value, revision = item.revision },
+    })
+    if not db.is_conflict(err) then return err end
+  end
+  return 'too many claims at the same time, try again'
+end
+
+-- returns the voucher and its batch if it can still be claimed
+local function get_claimable(code)
+  local voucher, err = db.voucher.get(code)
+  if err then return nil, nil, 'voucher not found' end
+
+  local batch, err = db.batch.get(voucher.batch)
+  if err then return nil, nil, 'voucher batch not found' end
+
+  if voucher.uses_left <= 0 then
+    return nil, nil, 'voucher already claimed'
+  end
+  if batch.expires_at and batch.expires_at < os.time() then
+    return nil, nil, 'voucher expired'
+  end
+
+  return voucher, batch, nil
+end
+
+local function generate(batch_key, batch)
+  local target = math.min(batch.count, MAX_VOUCHERS)
+  local generated = batch.generated or 0
+
+  while generated < target do
+    local err = db.voucher.set(utils.random_hex(16), {
+      batch = batch_key,
+      uses_left = batch.uses,
+    })
+    if err then error(err) end
+    generated = generated + 1
+  end
+
+  if generated ~= batch.generated or not batch.secret then
+    batch.generated = generated
+    -- the print page lists all the vouchers, so it needs more than the batch key
+    batch.secret = batch.secret or utils.random_hex(16)
+    db.batch.set(batch_key, batch)
+  end
+end
+
+actions = {
+  lnurl = {
+    fields = {
+      { name = 'v', type = 'string', required = true },
+    },
+    handler = function (params)
+      local voucher, batch, reason = get_claimable(params.v)
+      if reason then return lnurl_error(reason) end
+
+      return {
+        tag = 'withdrawRequest',
+        callback = base_url(params) .. '/action/withdraw',
+        k1 = params.v,
+        minWithdrawable = batch.amount,
+        maxWithdrawable = batch.max_amount or batch.amount,
+        defaultDescription = batch.title,
+      }
+    end,
+  },
+  withdraw = {
+    fields = {
+      { name = 'k1', type = 'string', required = true },
+      { name = 'pr', type = 'string', required = true },
+    },
+    handler = function (params)
+      local voucher, batch, reason = get_claimable(params.k1)
+      if reason then return lnurl_error(reason) end
+
+      local invoice, err = utils.decode_invoice(params.pr)
+      if err then return lnurl_error('invalid invoice') end
+
+      local max = batch.max_amount or batch.amount
+      if invoice.msatoshi < batch.amount or invoice.msatoshi > max then
+        return lnurl_error('amount must be between ' .. batch.amount .. ' and ' .. max .. ' msat')
+      end
+
+      -- take the use before paying, the revision check makes sure two claims
+      -- in parallel can't both take the last one
+      local err = update('voucher', params.k1, function (v)
+        if v.uses_left <= 0 then return 'voucher already claimed' end
+        v.uses_left = v.uses_left - 1
+      end)
+      if err then return lnurl_error(tostring(err)) end
+
+      local payment, err = wallet.pay_invoice({
+        invoice = params.pr,
+        extra = { voucher = params.k1 },
+      })
+      if err then
+        update('voucher', params.k1, function (v)
+          v.uses_left = v.uses_left + 1
+        end)
+        return lnurl_error('payment failed')
+      end
+
+      db.claim.add({
+        batch = voucher.batch,
+        voucher = params.k1,
+        msatoshi = invoice.msatoshi,
+        payment_hash = invoice.payment_hash,
+        claimed_at = os.time(),
+      })
+
+      update('batch', voucher.batch, function (b)
+        b.claimed = (b.claimed or 0) + invoice.msatoshi
+      end)
+
+      app.emit_event('claimed', { voucher = params.k1 })
+
+      return { status = 'OK' }
+    end,
+  },
+  getbatch = {
+    fields = {
+      { name = 'batch', type = 'string', required = true },
+      { name = 'secret', type = 'string', required = true },
+    },
+    handler = function (params)
+      local batch, err = db.batch.get(params.batch)
+      if err or batch.secret ~= params.secret then error('batch not found') end
+
+      local all, err = db.voucher.list()
+      if err then error(err) end
+
+      local base = base_url(params)
+      local vouchers = {}
+      for _, item in ipairs(all) do
+        if item.value.batch == params.batch then
+          table.insert(vouchers, {
+            code = item.key,
+            uses_left = item.value.uses_left,
+            lnurl = lnurl.bech32_encode(base .. '/action/lnurl?v=' .. item.key),
+          })
+        end
+      end
+
+      return {
+        title = batch.title,
+        amount = batch.amount,
+        max_amount = batch.max_amount,
+        uses = batch.uses,
+        expires_at = batch.expires_at,
+        vouchers = vouchers,
+      }
+    end,
+  },
+}
+
+triggers = {
+  api_db_set = function (kv)
+    if kv.model == 'batch' then
+      generate(kv.key, kv.value)
+    end
+  end,
+}
+
+files = {
+  ['*'] = 'index.html',
+}
@@ -0,0 +1,85 @@
+package apps
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var busEventNameValidator = regexp.MustCompile(`^[a-z_0-9]+([.:-][a-z_0-9]+)*$`)
+
+// an app handling a bus event can publish another one, up to this many times in
+// a row, so apps subscribed to each other's events don't go on forever.
+const maxBusHops = 4
+
+type BusEvent struct {
+	Name   string      `json:"name"`
+	Data   interface{} `json:"data"`
+	App    string      `json:"app"`
+	Wallet string      `json:"wallet"`
+	Hops   int         `json:"hops"`
+}
+
+// publishBusEvent delivers a named event emitted by an app to all the other apps
+// installed by the same user (on all of their wallets) that have subscribed to it.
+// hops is how many events led to this one, 0 when it wasn't published while
+// handling another.
+func publishBusEvent(walletID, app, name string, data interface{}, hops int) error {
+	if !busEventNameValidator.MatchString(name) {
+		return fmt.Errorf("invalid event name '%s'", name)
+	}
+	if hops >= maxBusHops {
+		return fmt.Errorf("can't publish '%s', it came from %d events in a row", name, hops)
+	}
+
+	appWalletCombinations, err := getUserAppWallets(walletID)
+	if err != nil {
+		return fmt.Errorf("failed to load apps for user: %w", err)
+	}
+
+	event := BusEvent{
+		Name:   name,
+		Data:   data,
+		App:    app,
+		Wallet: walletID,
+		Hops:   hops,
+	}
+
+	go func() {
+		for _, appWallet := range appWalletCombinations {
+			if appWallet.URL == app {
+				// an app doesn't get its own events, not even on other wallets
+				continue
+			}
+
+			deliverBusEvent(appWallet, event)
+		}
+	}()
+
+	return nil
+}
+
+func deliverBusEvent(appWallet AppWallet, event BusEvent) {
+	settings, err := GetAppSettings(appWallet.URL, false)
+	if err != nil {
+		return
+	}
+	if _, subscribed := settings.Subscriptions[event.Name]; !subscribed {
+		return
+	}
+
+	_, err = runlua(RunluaParams{
+		AppURL:          appWallet.URL,
+		WalletID:        appWallet.WalletID,
+		CodeToRun:       fmt.Sprintf("subscriptions['%s'](internal.arg)", event.Name),
+		InjectedGlobals: &map[string]interface{}{"arg": structToMap(event)},
+		BusHops:         event.Hops + 1,
+	})
+	if err != nil && err != CachedFailure {
+		log.Warn().Err(err).
+			Str("wallet", appWallet.WalletID).
+			Str("app", appWallet.URL).
+			Str("event", event.Name).
+			Str("source", event.App).
+			Msg("failed to deliver bus event")
+	}
+}
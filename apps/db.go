@@ -3,6 +3,8 @@ package apps
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/storage"
@@ -16,41 +18,94 @@ func DBGet(wallet, app, model, key string) (map[string]interface{}, error) {
 		return nil, errors.New("key cannot be empty")
 	}
 
-	item := models.AppDataItem{
-		WalletID: wallet,
-		App:      app,
-		Model:    model,
-		Key:      key,
-	}
-
-	result := storage.DB.First(&item)
-	if result.Error != nil {
-		return nil, result.Error
+	item, err := storage.Default.GetAppItem(wallet, app, model, key)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := fillComputedValues(item); err != nil {
+	if err := fillComputedValues(*item); err != nil {
 		return item.Value, fmt.Errorf("failed to compute: %w", err)
 	}
 
 	return item.Value, nil
 }
 
-func DBList(wallet, app, model, startkey, endkey string) ([]models.AppDataItem, error) {
-	q := storage.DB.
-		Where(&models.AppDataItem{WalletID: wallet, App: app, Model: model})
+type ListParams = storage.ItemsQuery
+
+var sortableColumns = map[string]bool{"key": true, "created_at": true, "updated_at": true}
+
+// parseListParams reads {startkey, endkey, prefix, cursor, limit, offset, sort} from
+// a table given by an app or from the querystring. sort is like "created_at desc".
+func parseListParams(params map[string]interface{}) (ListParams, error) {
+	lp := ListParams{SortBy: "key"}
+
+	str := func(name string) string {
+		v, _ := params[name].(string)
+		return v
+	}
+	num := func(name string) (int, error) {
+		switch v := params[name].(type) {
+		case nil:
+			return 0, nil
+		case float64:
+			return int(v), nil
+		case int:
+			return v, nil
+		case string:
+			if v == "" {
+				return 0, nil
+			}
+			return strconv.Atoi(v)
+		}
+		return 0, fmt.Errorf("invalid %s: %v", name, params[name])
+	}
+
+	lp.StartKey = str("startkey")
+	lp.EndKey = str("endkey")
+	lp.Prefix = str("prefix")
+	lp.Cursor = str("cursor")
+
+	var err error
+	if lp.Limit, err = num("limit"); err != nil || lp.Limit < 0 {
+		return lp, fmt.Errorf("invalid limit: %v", params["limit"])
+	}
+	if lp.Offset, err = num("offset"); err != nil || lp.Offset < 0 {
+		return lp, fmt.Errorf("invalid offset: %v", params["offset"])
+	}
+
+	if sort := strings.Fields(strings.ToLower(str("sort"))); len(sort) > 0 {
+		if !sortableColumns[sort[0]] {
+			return lp, fmt.Errorf("can't sort by '%s'", sort[0])
+		}
+		lp.SortBy = sort[0]
+		lp.Descending = len(sort) == 2 && sort[1] == "desc"
+	}
+	if desc, ok := params["desc"].(bool); ok {
+		lp.Descending = desc
+	}
 
-	if startkey != "" {
-		q = q.Where("key > ?", startkey)
+	if lp.Cursor != "" && lp.SortBy != "key" {
+		return lp, errors.New("cursor can only be used when sorting by key, use offset instead")
 	}
-	if endkey != "" {
-		q = q.Where("key < ?", endkey)
+
+	return lp, nil
+}
+
+func DBList(wallet, app, model string, params map[string]interface{}) ([]models.AppDataItem, error) {
+	lp, err := parseListParams(params)
+	if err != nil {
+		return nil, err
 	}
+	return listItems(wallet, app, model, lp)
+}
 
-	var items []models.AppDataItem
-	result := q.Find(&items)
+// "key" is a reserved word on mysql, so it must be quoted by the dialect
+var keyColumn = clause.Column{Name: "key"}
 
-	if result.Error != nil {
-		return nil, result.Error
+func listItems(wallet, app, model string, lp ListParams) ([]models.AppDataItem, error) {
+	items, err := storage.Default.ListAppItems(wallet, app, model, lp)
+	if err != nil {
+		return nil, err
 	}
 
 	for _, item := range items {
@@ -84,15 +139,12 @@ func DBSet(wallet, app, model, key string, value map[string]interface{}) error {
 		return fmt.Errorf("invalid value %s for model %s: %w", string(j), model, err)
 	}
 
-	result := storage.DB.Clauses(clause.OnConflict{
-		Columns: []clause.Column{
-			{Name: "app"}, {Name: "wallet_id"}, {Name: "model"}, {Name: "key"},
-		},
-		DoUpdates: clause.AssignmentColumns([]string{"value"}),
-	}).Create(&item)
+	if err := storage.Default.SetAppItem(&item); err != nil {
+		return err
+	}
 
-	if result.Error != nil {
-		return result.Error
+	if err := indexItem(storage.DB, item); err != nil {
+		log.Warn().Err(err).Str("app", app).Str("key", key).Msg("failed to index item")
 	}
 
 	SendItemSSE(item)
@@ -136,10 +188,12 @@ func DBDelete(wallet, app, model, key string) error {
 		Model:    model,
 		Key:      key,
 	}
-	result := storage.DB.Delete(&models.AppDataItem{}, item)
+	if err := storage.Default.DeleteAppItem(wallet, app, model, key); err != nil {
+		return err
+	}
 
-	if result.Error != nil {
-		return result.Error
+	if err := indexItem(storage.DB, item); err != nil {
+		log.Warn().Err(err).Str("app", app).Str("key", key).Msg("failed to unindex item")
 	}
 
 	// an item with an empty .Value means it was deleted
@@ -0,0 +1,207 @@
+package apps
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils"
+	"gorm.io/gorm"
+)
+
+// every item has a revision that is bumped on each write. apps can read it with
+// db.<model>.get_item(key) and then pass it to db.transaction() so the write only
+// happens if nobody else has changed the item in the meantime.
+
+var ErrRevisionConflict = errors.New("revision conflict")
+
+type dbOperation struct {
+	Op       string
+	Item     models.AppDataItem
+	Revision *int64
+}
+
+func DBGetItem(wallet, app, model, key string) (*models.AppDataItem, error) {
+	if key == "" {
+		return nil, errors.New("key cannot be empty")
+	}
+
+	item, err := storage.Default.GetAppItem(wallet, app, model, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fillComputedValues(*item); err != nil {
+		return item, fmt.Errorf("failed to compute: %w", err)
+	}
+
+	return item, nil
+}
+
+func parseDBOperations(wallet, app string, ops []interface{}) ([]dbOperation, error) {
+	settings, err := GetAppSettings(app, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get app on db.transaction: %w", err)
+	}
+
+	parsed := make([]dbOperation, len(ops))
+	for i, iop := range ops {
+		op, ok := iop.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("operation %d is not a table", i+1)
+		}
+
+		kind, _ := op["op"].(string)
+		modelName, _ := op["model"].(string)
+		key, _ := op["key"].(string)
+
+		model := settings.getModel(modelName)
+		if model.Name == "" {
+			return nil, fmt.Errorf("operation %d: unknown model '%s'", i+1, modelName)
+		}
+		if model.Single {
+			key = "single"
+		}
+		if key == "" {
+			return nil, fmt.Errorf("operation %d: key cannot be empty", i+1)
+		}
+
+		parsed[i] = dbOperation{
+			Op: kind,
+			Item: models.AppDataItem{
+				WalletID: wallet,
+				App:      app,
+				Model:    modelName,
+				Key:      key,
+			},
+		}
+
+		if irev, ok := op["revision"]; ok {
+			rev, ok := irev.(float64)
+			if !ok {
+				return nil, fmt.Errorf("operation %d: invalid revision %v", i+1, irev)
+			}
+			revision := int64(rev)
+			parsed[i].Revision = &revision
+		}
+
+		switch kind {
+		case "set":
+			value, _ := op["value"].(map[string]interface{})
+			if value == nil {
+				return nil, fmt.Errorf("operation %d: missing value", i+1)
+			}
+			parsed[i].Item.Value = value
+			if err := model.validateItem(parsed[i].Item); err != nil {
+				j, _ := utils.JSONMarshal(value)
+				return nil, fmt.Errorf("operation %d: invalid value %s for model %s: %w",
+					i+1, string(j), modelName, err)
+			}
+		case "delete":
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op '%s'", i+1, kind)
+		}
+	}
+
+	return parsed, nil
+}
+
+// DBTransaction applies all the operations or none of them.
+// each operation is a table like {op='set', model=..., key=..., value=..., revision=...}
+// or {op='delete', model=..., key=..., revision=...}. when revision is given the
+// item must currently have that revision (0 means it must not exist), otherwise
+// the whole transaction fails with a conflict error.
+func DBTransaction(wallet, app string, ops []interface{}) error {
+	parsed, err := parseDBOperations(wallet, app, ops)
+	if err != nil {
+		return err
+	}
+
+	err = storage.DB.Transaction(func(tx *gorm.DB) error {
+		for _, op := range parsed {
+			if err := applyDBOperation(tx, op); err != nil {
+				return err
+			}
+			if err := indexItem(tx, op.Item); err != nil {
+				return fmt.Errorf("failed to index %s:%s: %w", op.Item.Model, op.Item.Key, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, op := range parsed {
+		SendItemSSE(op.Item)
+	}
+
+	return nil
+}
+
+func applyDBOperation(tx *gorm.DB, op dbOperation) error {
+	item := op.Item
+	where := models.AppDataItem{
+		WalletID: item.WalletID,
+		App:      item.App,
+		Model:    item.Model,
+		Key:      item.Key,
+	}
+	items := func() *gorm.DB {
+		return tx.Scopes(storage.AppItems(item.WalletID))
+	}
+
+	conflict := func() error {
+		var current models.AppDataItem
+		found := items().Select("revision").Where(&where).Limit(1).Find(&current).RowsAffected
+		if found == 0 {
+			current.Revision = 0
+		}
+		return fmt.Errorf("%w on %s:%s (expected %d, found %d)",
+			ErrRevisionConflict, item.Model, item.Key, *op.Revision, current.Revision)
+	}
+
+	switch {
+	case op.Op == "delete" && op.Revision == nil:
+		return items().Where(&where).Delete(&models.AppDataItem{}).Error
+
+	case op.Op == "delete":
+		result := items().Where(&where).Where("revision = ?", *op.Revision).
+			Delete(&models.AppDataItem{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return conflict()
+		}
+		return nil
+
+	case op.Revision == nil:
+		return items().Clauses(storage.UpsertAppItemClause()).Create(&item).Error
+
+	case *op.Revision == 0:
+		var count int64
+		items().Model(&models.AppDataItem{}).Where(&where).Count(&count)
+		if count > 0 {
+			return conflict()
+		}
+		return items().Create(&item).Error
+
+	default:
+		result := items().Model(&models.AppDataItem{}).
+			Where(&where).
+			Where("revision = ?", *op.Revision).
+			Updates(map[string]interface{}{
+				"value":    item.Value,
+				"revision": gorm.Expr("revision + 1"),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return conflict()
+		}
+		return nil
+	}
+}
@@ -0,0 +1,119 @@
+package apps
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DevMode allows apps to be loaded from file:// URLs and disables caching for
+// apps loaded from the local filesystem or from localhost, so app authors can
+// iterate on their code without reinstalling it every time.
+var DevMode bool
+
+// DevDir is the only directory file:// apps can be loaded from, without it
+// they can't be used even in dev mode.
+var DevDir string
+
+var devHTTPClient = &http.Client{
+	Timeout: time.Second * 5,
+}
+
+var luaErrorLine = regexp.MustCompile(`\[string "[^"]*"\]:(\d+):`)
+
+func isDevApp(appURL string) bool {
+	if !DevMode {
+		return false
+	}
+
+	if strings.HasPrefix(appURL, "file://") {
+		return true
+	}
+
+	if parsed, err := url.Parse(appURL); err == nil {
+		switch parsed.Hostname() {
+		case "localhost", "127.0.0.1", "::1":
+			return true
+		}
+	}
+
+	return false
+}
+
+// devFilePath returns the path of a file:// URL, if it is inside DevDir.
+func devFilePath(fileURL string) (string, error) {
+	if !DevMode {
+		return "", errors.New("file:// apps are only allowed in dev mode")
+	}
+	if DevDir == "" {
+		return "", errors.New("file:// apps need APP_DEV_DIR")
+	}
+
+	parsed, err := url.Parse(fileURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid file URL: %w", err)
+	}
+
+	// links are followed first so they can't point outside either
+	dir, err := filepath.EvalSymlinks(DevDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid APP_DEV_DIR: %w", err)
+	}
+	path, err := filepath.EvalSymlinks(filepath.Clean(parsed.Path))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(dir, path); err != nil ||
+		rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is outside of APP_DEV_DIR", parsed.Path)
+	}
+
+	return path, nil
+}
+
+func readDevFile(fileURL string) ([]byte, error) {
+	path, err := devFilePath(fileURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(path)
+}
+
+// devErrorContext returns the lines of app code around the line a lua error
+// points to, for more helpful error messages in dev mode.
+func devErrorContext(code string, luaErr error) string {
+	match := luaErrorLine.FindStringSubmatch(luaErr.Error())
+	if match == nil {
+		return ""
+	}
+
+	// the app code is prefixed with CUSTOM_ENV_DEF and a newline when we run it
+	line, _ := strconv.Atoi(match[1])
+	line -= strings.Count(CUSTOM_ENV_DEF, "\n") + 1
+	lines := strings.Split(code, "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+
+	context := []string{fmt.Sprintf("at app code line %d:", line)}
+	for i := line - 3; i <= line+2; i++ {
+		if i < 1 || i > len(lines) {
+			continue
+		}
+		marker := "  "
+		if i == line {
+			marker = "> "
+		}
+		context = append(context, fmt.Sprintf("%s%4d | %s", marker, i, lines[i-1]))
+	}
+
+	return strings.Join(context, "\n")
+}
@@ -0,0 +1,262 @@
+package apps
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type AppDataExport struct {
+	App           string         `json:"app"`
+	ExportedAt    time.Time      `json:"exported_at"`
+	SchemaVersion int            `json:"schema_version"`
+	Items         []ExportedItem `json:"items"`
+}
+
+type ExportedItem struct {
+	Model     string            `json:"model"`
+	Key       string            `json:"key"`
+	Value     models.JSONObject `json:"value"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at,omitempty"`
+}
+
+func exportedItem(item models.AppDataItem) ExportedItem {
+	return ExportedItem{
+		Model:     item.Model,
+		Key:       item.Key,
+		Value:     item.Value,
+		CreatedAt: item.CreatedAt,
+		UpdatedAt: item.UpdatedAt,
+	}
+}
+
+// Export returns all the items of an app as a single JSON document, or with
+// ?format=jsonl as a stream of JSON lines, the first one being the export
+// header (without items) and then one item per line. ?model= exports only the
+// items of that model.
+func Export(w http.ResponseWriter, r *http.Request) {
+	app := appIDToURL(mux.Vars(r)["appid"])
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	q := storage.DB.Scopes(storage.AppItems(wallet.ID)).
+		Where(&models.AppDataItem{App: app, WalletID: wallet.ID}).
+		Order("model").Order(clause.OrderByColumn{Column: keyColumn})
+	if model := r.URL.Query().Get("model"); model != "" {
+		q = q.Where("model = ?", model)
+	}
+
+	export := AppDataExport{
+		App:        app,
+		ExportedAt: time.Now(),
+	}
+
+	schema := models.AppSchema{App: app, WalletID: wallet.ID}
+	if storage.DB.Where(&schema).First(&schema).Error == nil {
+		export.SchemaVersion = schema.Version
+	}
+
+	if r.URL.Query().Get("format") == "jsonl" {
+		exportJSONL(w, r, q, export)
+		return
+	}
+
+	var items []models.AppDataItem
+	if err := q.Find(&items).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	export.Items = make([]ExportedItem, len(items))
+	for i, item := range items {
+		export.Items[i] = exportedItem(item)
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="app-data.json"`)
+	apiutils.SendJSON(w, export)
+}
+
+func exportJSONL(w http.ResponseWriter, r *http.Request, q *gorm.DB, header AppDataExport) {
+	rows, err := q.Model(&models.AppDataItem{}).Rows()
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="app-data.jsonl"`)
+
+	enc := json.NewEncoder(w)
+	enc.Encode(struct {
+		App           string    `json:"app"`
+		ExportedAt    time.Time `json:"exported_at"`
+		SchemaVersion int       `json:"schema_version"`
+	}{header.App, header.ExportedAt, header.SchemaVersion})
+
+	flusher, _ := w.(http.Flusher)
+	for count := 1; rows.Next(); count++ {
+		var item models.AppDataItem
+		if err := storage.DB.ScanRows(rows, &item); err != nil {
+			// too late to send an error status, the output just ends here
+			zerolog.Ctx(r.Context()).Warn().Err(err).Str("app", header.App).
+				Msg("failed to export item")
+			return
+		}
+		if err := enc.Encode(exportedItem(item)); err != nil {
+			return
+		}
+		if flusher != nil && count%1000 == 0 {
+			flusher.Flush()
+		}
+	}
+}
+
+func Import(w http.ResponseWriter, r *http.Request) {
+	app := appIDToURL(mux.Vars(r)["appid"])
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	var export AppDataExport
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&export); err != nil {
+		apiutils.SendJSONError(w, 400, "failed to read data: %s", err.Error())
+		return
+	}
+	if r.URL.Query().Get("format") == "jsonl" {
+		// the header was the first line, items come after
+		for {
+			var item ExportedItem
+			if err := dec.Decode(&item); err == io.EOF {
+				break
+			} else if err != nil {
+				apiutils.SendJSONError(w, 400, "failed to read item %d: %s",
+					len(export.Items)+1, err.Error())
+				return
+			}
+			export.Items = append(export.Items, item)
+		}
+	}
+
+	settings, err := GetAppSettings(app, false)
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "failed to get app settings: %s", err.Error())
+		return
+	}
+
+	if export.SchemaVersion > settings.SchemaVersion {
+		apiutils.SendJSONError(w, 400,
+			"exported data is at schema version %d, but app is at %d",
+			export.SchemaVersion, settings.SchemaVersion)
+		return
+	}
+
+	// items can refer to the ones that come with them
+	written := make(map[string]bool, len(export.Items))
+	for _, item := range export.Items {
+		written[item.Model+":"+item.Key] = true
+	}
+
+	invalid := make([]string, 0)
+	for _, item := range export.Items {
+		if len(settings.getModel(item.Model).Fields) == 0 {
+			apiutils.SendJSONError(w, 400, "unknown model '%s'", item.Model)
+			return
+		}
+		if item.Key == "" || item.Value == nil {
+			apiutils.SendJSONError(w, 400, "item on model '%s' is missing key or value",
+				item.Model)
+			return
+		}
+
+		// data from an older schema is checked by the set calls of the app
+		// migrations instead, the fields may have been different back then
+		if export.SchemaVersion == settings.SchemaVersion {
+			err := settings.getModel(item.Model).validateItemWith(models.AppDataItem{
+				App:      app,
+				WalletID: wallet.ID,
+				Model:    item.Model,
+				Key:      item.Key,
+				Value:    item.Value,
+			}, written)
+			if err != nil {
+				invalid = append(invalid, item.Model+" '"+item.Key+"': "+err.Error())
+			}
+		}
+	}
+	if len(invalid) > 0 {
+		apiutils.SendJSONError(w, 400, "invalid items: %s", strings.Join(invalid, "; "))
+		return
+	}
+
+	err = storage.DB.Transaction(func(tx *gorm.DB) error {
+		if r.URL.Query().Get("replace") == "true" {
+			if err := tx.Scopes(storage.AppItems(wallet.ID)).
+				Where(&models.AppDataItem{App: app, WalletID: wallet.ID}).
+				Delete(&models.AppDataItem{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Scopes(storage.AppItemTerms(wallet.ID)).
+				Where(&models.AppItemTerm{App: app, WalletID: wallet.ID}).
+				Delete(&models.AppItemTerm{}).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, item := range export.Items {
+			row := models.AppDataItem{
+				App:       app,
+				WalletID:  wallet.ID,
+				Model:     item.Model,
+				Key:       item.Key,
+				Value:     item.Value,
+				CreatedAt: item.CreatedAt,
+			}
+			if err := tx.Scopes(storage.AppItems(wallet.ID)).Clauses(clause.OnConflict{
+				Columns: []clause.Column{
+					{Name: "app"}, {Name: "wallet_id"}, {Name: "model"}, {Name: "key"},
+				},
+				DoUpdates: clause.AssignmentColumns([]string{"value"}),
+			}).Create(&row).Error; err != nil {
+				return err
+			}
+			if err := indexItem(tx, row); err != nil {
+				return err
+			}
+		}
+
+		// data is now at the exported schema version
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "app"}, {Name: "wallet_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"version", "updated_at"}),
+		}).Create(&models.AppSchema{
+			App:      app,
+			WalletID: wallet.ID,
+			Version:  export.SchemaVersion,
+		}).Error
+	})
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to import: %s", err.Error())
+		return
+	}
+
+	// migrate the imported data if it came from an older version of the app
+	migratedAppWallets.Delete(wallet.ID + ":" + app)
+	if err := ensureMigrated(wallet.ID, settings); err != nil {
+		apiutils.SendJSONError(w, 500, "imported, but failed to migrate: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, struct {
+		Imported int `json:"imported"`
+	}{len(export.Items)})
+}
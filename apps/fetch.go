@@ -0,0 +1,269 @@
+package apps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lnbits/infinity/utils"
+)
+
+var fetchTransport = &http.Transport{
+	Proxy: nil,
+	DialContext: (&net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: denyPrivateAddresses,
+	}).DialContext,
+	TLSHandshakeTimeout: 5 * time.Second,
+	MaxIdleConns:        20,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// special purpose ranges that net.IP doesn't know about: shared address space
+// (carrier-grade nat), ietf protocol assignments, benchmarking, reserved and
+// the nat64 prefixes, which embed an ipv4 address that could be internal.
+var deniedNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"100.64.0.0/10",
+		"192.0.0.0/24",
+		"198.18.0.0/15",
+		"240.0.0.0/4",
+		"64:ff9b::/96",
+		"64:ff9b:1::/48",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// denyPrivateAddresses runs after DNS resolution, so it also catches public
+// domains that resolve to internal addresses.
+func denyPrivateAddresses(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !addressAllowed(net.ParseIP(host)) {
+		return fmt.Errorf("address %s is not allowed", host)
+	}
+
+	return nil
+}
+
+// addressAllowed tells if apps can connect to the address. in dev mode they can
+// reach a server on this machine, but nothing else on the network.
+func addressAllowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	// ::ffff:10.0.0.1 is 10.0.0.1
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	if ip.IsLoopback() {
+		return DevMode
+	}
+	if ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range deniedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// "*" is any domain, the addresses are still checked.
+func domainAllowed(allowlist []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range allowlist {
+		pattern = strings.ToLower(pattern)
+		if pattern == host || pattern == "*" {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// appFetch makes an http request to one of the domains the app has declared on
+// its fetch_domains list, with a timeout and a cap on the response size.
+func appFetch(app string, targetURL string, options map[string]interface{}) (
+	map[string]interface{}, error,
+) {
+	method := "GET"
+	if m, ok := options["method"].(string); ok && m != "" {
+		method = strings.ToUpper(m)
+	}
+
+	headers := make(map[string]string)
+	if h, ok := options["headers"].(map[string]interface{}); ok {
+		for k, v := range h {
+			headers[k] = fmt.Sprint(v)
+		}
+	}
+
+	resp, b, err := fetch(app, method, targetURL, options["body"], headers)
+	if err != nil {
+		return nil, err
+	}
+
+	respHeaders := make(map[string]interface{})
+	for k, v := range resp.Header {
+		respHeaders[strings.ToLower(k)] = v[0]
+	}
+
+	response := map[string]interface{}{
+		"status":  resp.StatusCode,
+		"headers": respHeaders,
+		"body":    string(b),
+	}
+
+	var parsedJSON interface{}
+	if err := json.Unmarshal(b, &parsedJSON); err == nil {
+		response["json"] = parsedJSON
+	}
+
+	return response, nil
+}
+
+// appHTTP is the older http.* helpers of apps, with the same checks as fetch.
+// the result is the json of the response or its text.
+func appHTTP(app, method, targetURL string, data interface{}, headers map[string]string) (
+	interface{}, int, error,
+) {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	if _, ok := headers["Accept"]; !ok {
+		headers["Accept"] = "application/json"
+	}
+
+	resp, b, err := fetch(app, method, targetURL, data, headers)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var result interface{}
+	if err := json.Unmarshal(b, &result); err != nil {
+		result = string(b)
+	}
+	return result, resp.StatusCode, nil
+}
+
+// appFeed fetches and parses an rss or atom feed.
+func appFeed(app, feedURL string) (map[string]interface{}, string, error) {
+	resp, b, err := fetch(app, "GET", feedURL, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("got bad status code %d", resp.StatusCode)
+	}
+	feed, err := utils.ParseFeedString(string(b))
+	return feed, string(b), err
+}
+
+func fetch(app, method, targetURL string, data interface{}, headers map[string]string) (
+	*http.Response, []byte, error,
+) {
+	settings, err := GetAppSettings(app, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get app settings: %w", err)
+	}
+
+	parsed, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return nil, nil, fmt.Errorf("scheme '%s' not allowed", parsed.Scheme)
+	}
+	if !domainAllowed(settings.FetchDomains, parsed.Hostname()) {
+		return nil, nil, fmt.Errorf("domain '%s' is not on this app's fetch_domains",
+			parsed.Hostname())
+	}
+
+	body := &bytes.Buffer{}
+	contentType := ""
+	switch v := data.(type) {
+	case nil:
+	case string:
+		body.WriteString(v)
+		contentType = "text/plain"
+	case int, int64, float64:
+		body.WriteString(fmt.Sprint(v))
+		contentType = "text/plain"
+	default:
+		j, err := utils.JSONMarshal(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("body is not json serializable: %w", err)
+		}
+		body.Write(j)
+		contentType = "application/json"
+	}
+
+	l := limits()
+	ctx, cancel := context.WithTimeout(context.Background(), l.FetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, parsed.String(), body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{
+		Transport: fetchTransport,
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			if !domainAllowed(settings.FetchDomains, r.URL.Hostname()) {
+				return fmt.Errorf("redirect to '%s' not allowed", r.URL.Hostname())
+			}
+			return nil
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, l.FetchMaxBytes+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if int64(len(b)) > l.FetchMaxBytes {
+		return nil, nil, fmt.Errorf("response is bigger than %d bytes", l.FetchMaxBytes)
+	}
+
+	return resp, b, nil
+}
@@ -0,0 +1,69 @@
+package apps
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddressAllowed(t *testing.T) {
+	for _, addr := range []string{
+		"127.0.0.1",
+		"::1",
+		"10.1.2.3",
+		"172.16.0.1",
+		"192.168.1.1",
+		"169.254.169.254",
+		"0.0.0.0",
+		"::",
+		"fd00::1",
+		"fe80::1",
+		"100.64.0.1",
+		"100.127.255.254",
+		"192.0.0.8",
+		"198.18.0.1",
+		"198.19.255.255",
+		"240.0.0.1",
+		"255.255.255.255",
+		"224.0.0.1",
+		"::ffff:127.0.0.1",
+		"::ffff:10.0.0.1",
+		"::ffff:169.254.169.254",
+		"::ffff:100.64.0.1",
+		"64:ff9b::a00:1",
+		"64:ff9b::7f00:1",
+		"64:ff9b:1::a00:1",
+	} {
+		if addressAllowed(net.ParseIP(addr)) {
+			t.Errorf("%s should not be allowed", addr)
+		}
+	}
+
+	for _, addr := range []string{
+		"1.1.1.1",
+		"8.8.8.8",
+		"100.128.0.1",
+		"198.20.0.1",
+		"2606:4700:4700::1111",
+		"::ffff:1.1.1.1",
+	} {
+		if !addressAllowed(net.ParseIP(addr)) {
+			t.Errorf("%s should be allowed", addr)
+		}
+	}
+}
+
+func TestDevModeOnlyAllowsLoopback(t *testing.T) {
+	DevMode = true
+	defer func() { DevMode = false }()
+
+	for _, addr := range []string{"127.0.0.1", "::1", "::ffff:127.0.0.1"} {
+		if !addressAllowed(net.ParseIP(addr)) {
+			t.Errorf("%s should be allowed in dev mode", addr)
+		}
+	}
+	for _, addr := range []string{"10.0.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1", "64:ff9b::a00:1"} {
+		if addressAllowed(net.ParseIP(addr)) {
+			t.Errorf("%s should not be allowed in dev mode", addr)
+		}
+	}
+}
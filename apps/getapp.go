@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/rif/cache2go"
@@ -23,7 +25,7 @@ func getCachedAppSettings(url string) *Settings {
 }
 
 func GetAppSettings(url string, force bool) (*Settings, error) {
-	if AppCacheSize > 0 {
+	if AppCacheSize > 0 && !isDevApp(url) {
 		if settings, ok := settingsCache.Get(url); ok {
 			if !force {
 				if settings == nil {
@@ -72,7 +74,38 @@ func GetAppSettings(url string, force bool) (*Settings, error) {
 var codeCache = cache2go.New(AppCacheSize/3, time.Minute*45)
 
 func getAppCode(url string) (string, error) {
-	if AppCacheSize > 0 {
+	if strings.HasPrefix(url, builtinScheme+":") {
+		body, err := readBuiltinFile(url)
+		if err != nil {
+			return "", fmt.Errorf("failed to read builtin app: %w", err)
+		}
+		return string(body), nil
+	}
+
+	if isNostrApp(url) {
+		manifest, err := getNostrManifest(url)
+		if err != nil {
+			return "", fmt.Errorf("failed to load app from nostr: %w", err)
+		}
+		if err := trustAppCode(url, manifest.Code); err != nil {
+			return trustedCode(url, err)
+		}
+		return manifest.Code, nil
+	}
+
+	if strings.HasPrefix(url, "file://") {
+		body, err := readDevFile(url)
+		if err != nil {
+			return "", fmt.Errorf("failed to read file: %w", err)
+		}
+		return string(body), nil
+	}
+
+	client := httpClient
+	if isDevApp(url) {
+		// always fetch a fresh version
+		client = devHTTPClient
+	} else if AppCacheSize > 0 {
 		if code, ok := codeCache.Get(url); ok {
 			if code == nil {
 				return "", CachedFailure
@@ -82,27 +115,40 @@ func getAppCode(url string) (string, error) {
 		}
 	}
 
-	resp, err := httpClient.Get(url)
+	code, err := fetchAppCode(client, url)
 	if err != nil {
 		codeCache.Set(url, nil)
+		return "", err
+	}
+	if err := trustAppCode(url, code); err != nil {
+		if code, err = trustedCode(url, err); err != nil {
+			codeCache.Set(url, nil)
+			return "", err
+		}
+	}
+
+	if AppCacheSize > 0 && !isDevApp(url) {
+		codeCache.Set(url, code)
+	}
+
+	return code, nil
+}
+
+func fetchAppCode(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
 		return "", fmt.Errorf("http call errored: %w", err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
-		codeCache.Set(url, nil)
 		return "", fmt.Errorf("http call returned status code %d", resp.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		codeCache.Set(url, nil)
 		return "", fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	code := string(body)
-	if AppCacheSize > 0 {
-		codeCache.Set(url, code)
-	}
-
-	return code, nil
+	return string(body), nil
 }
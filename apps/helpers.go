@@ -15,6 +15,7 @@ import (
 	"strings"
 
 	"github.com/aarzilli/golua/lua"
+	"github.com/lnbits/infinity/api/apiutils"
 	"github.com/lnbits/infinity/utils"
 )
 
@@ -57,6 +58,12 @@ func structToMap(v interface{}) map[string]interface{} {
 	return m
 }
 
+// convert map[string]interface{} to struct
+func mapToStruct(m map[string]interface{}, v interface{}) {
+	j, _ := utils.JSONMarshal(m)
+	json.Unmarshal(j, v)
+}
+
 func urljoin(baseURL url.URL, elems ...string) *url.URL {
 	for _, elem := range elems {
 		if strings.HasPrefix(elem, "/") {
@@ -76,7 +83,55 @@ func urljoin(baseURL url.URL, elems ...string) *url.URL {
 	return &baseURL
 }
 
+// setSecurityHeaders applies the app's own content_security_policy and
+// frame_ancestors over the defaults set by the server. frame_ancestors lists
+// the origins allowed to embed the app in an iframe ("*" for any), and since
+// X-Frame-Options can't express that it is dropped.
+func setSecurityHeaders(w http.ResponseWriter, settings *Settings) {
+	h := w.Header()
+	csp := h.Get("Content-Security-Policy")
+	if settings.ContentSecurityPolicy != "" {
+		csp = settings.ContentSecurityPolicy
+	}
+	if len(settings.FrameAncestors) > 0 {
+		directives := make([]string, 0)
+		for _, directive := range strings.Split(csp, ";") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" || strings.HasPrefix(strings.ToLower(directive), "frame-ancestors") {
+				continue
+			}
+			directives = append(directives, directive)
+		}
+		directives = append(directives, "frame-ancestors "+strings.Join(settings.FrameAncestors, " "))
+		csp = strings.Join(directives, "; ")
+		h.Del("X-Frame-Options")
+	}
+	if csp != "" {
+		h.Set("Content-Security-Policy", csp)
+	}
+}
+
 func serveFile(w http.ResponseWriter, r *http.Request, fileURL *url.URL) {
+	if fileURL.Scheme == builtinScheme {
+		serveBuiltinFile(w, r, fileURL)
+		return
+	}
+
+	if fileURL.Scheme == nostrScheme {
+		serveNostrFile(w, r, fileURL)
+		return
+	}
+
+	if fileURL.Scheme == "file" {
+		path, err := devFilePath(fileURL.String())
+		if err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		http.ServeFile(w, r, path)
+		return
+	}
+
 	proxy := &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
 			r.URL = fileURL
@@ -156,5 +211,10 @@ func getOriginalURL(r *http.Request) *url.URL {
 		}
 	}
 
-	return r.URL
+	original := *r.URL
+	original.Path = apiutils.BasePath + original.Path
+	if original.RawPath != "" {
+		original.RawPath = apiutils.BasePath + original.RawPath
+	}
+	return &original
 }
@@ -1,6 +1,7 @@
 package apps
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -9,14 +10,16 @@ import (
 
 	"github.com/gregjones/httpcache"
 	"github.com/gregjones/httpcache/diskcache"
+	"github.com/lnbits/infinity/cluster"
 	"github.com/lnbits/infinity/events"
+	"github.com/lnbits/infinity/jobs"
 	"github.com/lnbits/infinity/models"
 	"github.com/rs/zerolog"
+	"gopkg.in/antage/eventsource.v1"
 )
 
 var (
 	AppCacheSize int
-	LuaQuota     int
 	ServiceURL   string
 )
 
@@ -37,7 +40,10 @@ var (
 	publicAppStreams = sync.Map{}
 )
 
-var nameValidator = regexp.MustCompile("^[a-z_0-9]+$")
+var (
+	nameValidator         = regexp.MustCompile("^[a-z_0-9]+$")
+	routeSegmentValidator = regexp.MustCompile("^[a-zA-Z_0-9.-]*$")
+)
 
 func init() {
 	go func() {
@@ -72,31 +78,68 @@ func init() {
 		}
 	}()
 
+	// periodically trigger apps, at the start of every hour
+	jobs.Recurring("app_triggers", func(last time.Time) time.Time {
+		return last.Truncate(time.Hour).Add(time.Hour)
+	}, func(ctx context.Context, at time.Time) error {
+		go TriggerGlobalEvent("hourly", at.Unix())
+		if at.Hour() == 0 {
+			go TriggerGlobalEvent("daily", at.Unix())
+			if at.Weekday() == time.Sunday {
+				go TriggerGlobalEvent("weekly", at.Unix())
+			}
+		}
+		return nil
+	})
+}
+
+// Start triggers the "init" event of the apps and starts checking them for
+// updates and keeping their nostr subscriptions open, for when the server is
+// running and not for the other commands.
+func Start() {
 	// trigger an event when lnbits starts
 	go func() {
 		time.Sleep(3 * time.Second)
 		TriggerGlobalEvent("init", nil)
 	}()
 
-	// periodically trigger apps
-	hourly := time.NewTicker(time.Hour * 1)
+	// periodically check installed apps for updates
 	go func() {
+		time.Sleep(10 * time.Second)
 		for {
-			now := <-hourly.C
-
-			go TriggerGlobalEvent("hourly", now.Unix())
-			if now.Hour() == 0 {
-				go TriggerGlobalEvent("daily", now.Unix())
-				if now.Weekday() == time.Sunday {
-					go TriggerGlobalEvent("weekly", now.Unix())
-				}
-			}
+			checkInstalledAppsForUpdates()
+			time.Sleep(limits().UpdateCheckInterval)
 		}
+	}()
 
-		hourly.Stop()
+	// keep the nostr subscriptions apps want open
+	go func() {
+		time.Sleep(15 * time.Second)
+		for {
+			if cluster.Leading() {
+				SyncNostrSubscriptions()
+			} else {
+				// the leader has them open, they would also trigger the apps here
+				stopNostrSubscriptions()
+			}
+			time.Sleep(NostrSubscriptionsSync)
+		}
 	}()
 }
 
+// Stop disconnects the clients of all app streams and websockets, for when the
+// server is shutting down.
+func Stop() {
+	for _, streams := range []*sync.Map{&appStreams, &publicAppStreams} {
+		streams.Range(func(_, ies interface{}) bool {
+			ies.(eventsource.EventSource).Close()
+			return true
+		})
+	}
+
+	closeWebSockets()
+}
+
 func SetLogger(logger zerolog.Logger) {
 	log = logger
 }
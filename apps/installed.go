@@ -0,0 +1,154 @@
+package apps
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+)
+
+// installed apps keep running the version that was loaded until the user
+// refreshes them. a background job checks the remote code periodically and
+// flags the apps that have an update available.
+
+type appUpdateState struct {
+	RemoteHash string
+	Signer     string
+	CheckedAt  time.Time
+	Error      string
+}
+
+// appUpdates holds one appUpdateState for each app URL.
+var appUpdates = sync.Map{}
+
+type InstalledApp struct {
+	URL             string    `json:"url"`
+	ID              string    `json:"id"`
+	Title           string    `json:"title"`
+	Description     string    `json:"description,omitempty"`
+	Icon            string    `json:"icon,omitempty"`
+	Manifest        *Settings `json:"manifest,omitempty"`
+	UpdateAvailable bool      `json:"update_available"`
+	Signer          string    `json:"signer,omitempty"`
+	SignerChanged   bool      `json:"signer_changed,omitempty"`
+	CheckedAt       time.Time `json:"checked_at,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+func codeHash(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// fetchLatestCode gets the app code bypassing our caches.
+func fetchLatestCode(url string) (string, error) {
+	if isNostrApp(url) {
+		manifest, err := fetchNostrManifest(url)
+		if err != nil {
+			return "", err
+		}
+		return manifest.Code, nil
+	}
+
+	if strings.HasPrefix(url, builtinScheme+":") || strings.HasPrefix(url, "file://") {
+		return getAppCode(url)
+	}
+
+	return fetchAppCode(httpClient, url)
+}
+
+func checkAppUpdate(url string) {
+	state := appUpdateState{CheckedAt: time.Now()}
+	defer appUpdates.Store(url, state)
+
+	code, err := fetchLatestCode(url)
+	if err != nil {
+		state.Error = err.Error()
+		return
+	}
+	state.RemoteHash = codeHash(code)
+
+	if state.Signer, err = VerifyAppSignature(url, code); err != nil {
+		state.Error = "invalid signature on the latest version: " + err.Error()
+	}
+
+	running := getCachedAppSettings(url)
+	if running == nil {
+		// nothing loaded yet, so just load the latest
+		GetAppSettings(url, false)
+		return
+	}
+
+	// keep the running version cached so requests don't have to fetch it again
+	// and so it isn't silently replaced by the new one
+	settingsCache.Set(url, running)
+	codeCache.Set(url, running.Code)
+}
+
+func updateAvailable(url string, running *Settings) (bool, appUpdateState) {
+	istate, ok := appUpdates.Load(url)
+	if !ok {
+		return false, appUpdateState{}
+	}
+	state := istate.(appUpdateState)
+	return running != nil && state.RemoteHash != "" &&
+		state.RemoteHash != codeHash(running.Code), state
+}
+
+func checkInstalledAppsForUpdates() {
+	var urls []string
+	storage.DB.Model(&models.UserApp{}).Distinct("url").Pluck("url", &urls)
+
+	for _, url := range urls {
+		if isDevApp(url) {
+			continue
+		}
+		checkAppUpdate(url)
+	}
+}
+
+func InstalledApps(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*models.User)
+
+	var userApps []models.UserApp
+	storage.DB.Where("user_id = ?", user.ID).Find(&userApps)
+
+	list := make([]InstalledApp, 0, len(userApps))
+	for _, userApp := range userApps {
+		url := userApp.URL
+		app := InstalledApp{URL: url, ID: appURLToID(url), Signer: userApp.Signer}
+
+		settings, err := GetAppSettings(url, false)
+		if err != nil {
+			app.Error = err.Error()
+		} else {
+			app.Title = settings.Title
+			app.Description = strings.TrimSpace(settings.Description)
+			app.Icon = settings.Icon
+			app.Manifest = settings
+		}
+
+		var state appUpdateState
+		app.UpdateAvailable, state = updateAvailable(url, settings)
+		if state.CheckedAt.IsZero() && !isDevApp(url) {
+			go checkAppUpdate(url)
+		} else {
+			app.CheckedAt = state.CheckedAt
+			app.SignerChanged = app.UpdateAvailable && userApp.Signer != "" &&
+				state.Signer != userApp.Signer
+			if app.Error == "" {
+				app.Error = state.Error
+			}
+		}
+
+		list = append(list, app)
+	}
+
+	apiutils.SendJSON(w, list)
+}
@@ -0,0 +1,145 @@
+package apps
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+)
+
+var (
+	CircuitBreakerThreshold = 5
+	CircuitBreakerCooldown  = time.Minute
+)
+
+// Limits are the settings of apps that can change on reload, they are read
+// while apps run so they are replaced all at once with SetLimits.
+type Limits struct {
+	LuaQuota            int
+	LuaTimeout          time.Duration
+	LuaMemoryLimit      int
+	FetchTimeout        time.Duration
+	FetchMaxBytes       int64
+	UpdateCheckInterval time.Duration
+}
+
+var currentLimits atomic.Value
+
+func SetLimits(l Limits) {
+	currentLimits.Store(l)
+}
+
+func limits() Limits {
+	if l, ok := currentLimits.Load().(Limits); ok {
+		return l
+	}
+	return Limits{
+		FetchTimeout:        5 * time.Second,
+		FetchMaxBytes:       1 << 20,
+		UpdateCheckInterval: time.Minute * 30,
+	}
+}
+
+// how many lua instructions run between each check of the limits
+const limitsHookInterval = 1000
+
+const (
+	errQuotaExceeded = "execution quota exceeded"
+	errTimedOut      = "execution timed out"
+	errMemoryLimit   = "memory limit exceeded"
+)
+
+// setLimits makes the given state abort when it runs LuaQuota instructions, for
+// more than LuaTimeout or uses more than LuaMemoryLimit bytes. calls to host
+// functions (http requests etc) can't be interrupted, so the time limit is only
+// checked when control comes back to lua.
+func setLimits(L *lua.State) {
+	l := limits()
+	executed := 0
+	deadline := time.Now().Add(l.LuaTimeout)
+
+	// a quota smaller than the interval is still counted exactly, as the sandbox
+	// used to do
+	interval := limitsHookInterval
+	if l.LuaQuota > 0 && l.LuaQuota < interval {
+		interval = l.LuaQuota
+	}
+
+	L.SetHook(func(L *lua.State) {
+		executed += interval
+
+		if l.LuaQuota > 0 && executed >= l.LuaQuota {
+			L.RaiseError(fmt.Sprintf("%s: %d", errQuotaExceeded, l.LuaQuota))
+		}
+		if l.LuaTimeout > 0 && time.Now().After(deadline) {
+			L.RaiseError(fmt.Sprintf("%s: %s", errTimedOut, l.LuaTimeout))
+		}
+		if l.LuaMemoryLimit > 0 && L.GC(lua.LUA_GCCOUNT, 0)*1024 > l.LuaMemoryLimit {
+			L.RaiseError(fmt.Sprintf("%s: %d bytes", errMemoryLimit, l.LuaMemoryLimit))
+		}
+	}, interval)
+}
+
+func isLimitError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, errQuotaExceeded) ||
+		strings.Contains(msg, errTimedOut) ||
+		strings.Contains(msg, errMemoryLimit)
+}
+
+// circuits holds one *circuit for each wallet:app combination.
+// only runs that hit the resource limits count as failures, errors raised by
+// the app code itself can usually be triggered by anyone calling its actions,
+// so they shouldn't be able to get an app disabled.
+var circuits = sync.Map{}
+
+type circuit struct {
+	sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func getCircuit(walletID, app string) *circuit {
+	ic, _ := circuits.LoadOrStore(walletID+":"+app, &circuit{})
+	return ic.(*circuit)
+}
+
+// allow returns an error if the app is currently disabled. once the cooldown
+// has passed one run is let through and if it succeeds the circuit closes.
+func (c *circuit) allow() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.openUntil.IsZero() {
+		return nil
+	}
+	if time.Now().Before(c.openUntil) {
+		return fmt.Errorf("app disabled for %s after %d runs exceeded resource limits",
+			time.Until(c.openUntil).Round(time.Second), c.failures)
+	}
+
+	// half-open: if this one fails too we go back to open right away
+	c.failures = CircuitBreakerThreshold - 1
+	c.openUntil = time.Time{}
+	return nil
+}
+
+func (c *circuit) record(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if err == nil || !isLimitError(err) {
+		if err == nil {
+			c.failures = 0
+		}
+		return
+	}
+
+	c.failures++
+	if c.failures >= CircuitBreakerThreshold {
+		c.openUntil = time.Now().Add(CircuitBreakerCooldown)
+	}
+}
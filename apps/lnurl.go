@@ -0,0 +1,380 @@
+package apps
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/go-lnurl"
+	"github.com/fiatjaf/lunatico"
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils"
+	rp "github.com/lnbits/relampago"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/rs/zerolog"
+)
+
+// apps can declare lnurl_endpoints, each served at /ext/{wallet}/{appid}/lnurl/{name}.
+// the app only decides the amounts, description and what to do on the callback,
+// the LNURL protocol itself (metadata, description_hash, invoices, paying) is
+// handled here. each withdraw request gets a random k1 that is stored with its
+// amounts and deleted by the callback that uses it, so it pays once.
+
+// LNURLWithdrawExpiry is how long a k1 can be used after it is given.
+var LNURLWithdrawExpiry = time.Hour
+
+type LNURLEndpoint struct {
+	Type     string                `json:"type"`
+	Handler  *lunatico.LuaFunction `json:"handler"`
+	Callback *lunatico.LuaFunction `json:"callback"`
+}
+
+func (endpoint LNURLEndpoint) validate() error {
+	if endpoint.Type != "pay" && endpoint.Type != "withdraw" {
+		return fmt.Errorf("type must be 'pay' or 'withdraw', not '%s'", endpoint.Type)
+	}
+	if endpoint.Handler == nil {
+		return fmt.Errorf("must have a handler function")
+	}
+	if endpoint.Callback == nil {
+		return fmt.Errorf("must have a callback function")
+	}
+	return nil
+}
+
+// what the app returns from the endpoint handler
+type lnurlEndpointParams struct {
+	Min            int64  `json:"min"`
+	Max            int64  `json:"max"`
+	Description    string `json:"description"`
+	Image          string `json:"image"` // a data URI
+	CommentAllowed int64  `json:"comment_allowed"`
+}
+
+func (p lnurlEndpointParams) metadata() string {
+	metadata := lnurl.Metadata{Description: p.Description}
+	if strings.HasPrefix(p.Image, "data:") && strings.Contains(p.Image, ",") {
+		metadata.Image.DataURI = p.Image
+	}
+	return metadata.Encode()
+}
+
+func getLNURLEndpoint(w http.ResponseWriter, r *http.Request) (
+	walletID string, app string, name string, endpoint *LNURLEndpoint,
+) {
+	walletID = mux.Vars(r)["wallet"]
+	app = appIDToURL(mux.Vars(r)["appid"])
+	name = mux.Vars(r)["name"]
+
+	if !nameValidator.MatchString(name) {
+		apiutils.SendJSON(w, lnurl.ErrorResponse("invalid lnurl endpoint name"))
+		return
+	}
+
+	if installed, err := appInstalled(walletID, app); err != nil {
+		apiutils.SendJSON(w, lnurl.ErrorResponse("failed to check app: "+err.Error()))
+		return
+	} else if !installed {
+		apiutils.SendJSON(w, lnurl.ErrorResponse("app not installed on this wallet"))
+		return
+	}
+
+	settings, err := GetAppSettings(app, false)
+	if err != nil {
+		apiutils.SendJSON(w, lnurl.ErrorResponse("failed to get app: "+err.Error()))
+		return
+	}
+
+	def, ok := settings.LNURLEndpoints[name]
+	if !ok {
+		apiutils.SendJSON(w, lnurl.ErrorResponse("lnurl endpoint '"+name+"' not defined on app"))
+		return
+	}
+
+	return walletID, app, name, &def
+}
+
+// query string parameters are passed to the app and also carried over to the callback
+func lnurlEndpointArgs(r *http.Request, name string) map[string]interface{} {
+	args := make(map[string]interface{})
+	for k, v := range r.URL.Query() {
+		args[k] = v[0]
+	}
+	args["_url"] = getOriginalURL(r).String()
+	args["_ip"] = apiutils.ClientIP(r)
+	args["_lnurl"] = name
+	return args
+}
+
+func runLNURLEndpoint(walletID, app, name, fn string, args map[string]interface{}) (interface{}, error) {
+	return runlua(RunluaParams{
+		AppURL:          app,
+		CodeToRun:       fmt.Sprintf("lnurl_endpoints['%s'].%s(internal.arg)", name, fn),
+		InjectedGlobals: &map[string]interface{}{"arg": args},
+		WalletID:        walletID,
+	})
+}
+
+func loadLNURLEndpointParams(walletID, app, name string, args map[string]interface{}) (
+	*lnurlEndpointParams, error,
+) {
+	returned, err := runLNURLEndpoint(walletID, app, name, "handler", args)
+	if err != nil {
+		return nil, err
+	}
+
+	var params lnurlEndpointParams
+	if m, ok := returned.(map[string]interface{}); ok {
+		mapToStruct(m, &params)
+	}
+	if params.Min <= 0 || params.Max < params.Min {
+		return nil, fmt.Errorf("app returned invalid amounts (min %d, max %d)",
+			params.Min, params.Max)
+	}
+	if params.CommentAllowed < 0 {
+		return nil, fmt.Errorf("app returned an invalid comment_allowed (%d)",
+			params.CommentAllowed)
+	}
+
+	return &params, nil
+}
+
+// the query string params the app got originally, without the ones added by wallets
+func lnurlOriginalQuery(query url.Values) map[string]interface{} {
+	original := make(map[string]interface{})
+	for k, v := range query {
+		if k != "k1" && k != "pr" && k != "amount" && k != "comment" {
+			original[k] = v[0]
+		}
+	}
+	return original
+}
+
+// appInstalled tells if the owner of the wallet has the app.
+func appInstalled(walletID, app string) (bool, error) {
+	appWallets, err := getUserAppWallets(walletID)
+	if err != nil {
+		return false, err
+	}
+	for _, appWallet := range appWallets {
+		if appWallet.URL == app && appWallet.WalletID == walletID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// newWithdraw stores a k1 for the amounts the endpoint gave, deleting the ones
+// that have expired.
+func newWithdraw(walletID, app, name string, params *lnurlEndpointParams, query url.Values) (string, error) {
+	storage.DB.Where("created_at < ?", time.Now().Add(-LNURLWithdrawExpiry)).
+		Delete(&models.AppWithdraw{})
+
+	withdraw := models.AppWithdraw{
+		K1:       utils.RandomHex(32),
+		WalletID: walletID,
+		App:      app,
+		Endpoint: name,
+		Min:      params.Min,
+		Max:      params.Max,
+		Params:   lnurlOriginalQuery(query),
+	}
+	return withdraw.K1, storage.DB.Create(&withdraw).Error
+}
+
+// takeWithdraw deletes the k1, only one of many callbacks with it at the same
+// time gets it.
+func takeWithdraw(withdraw models.AppWithdraw) (bool, error) {
+	result := storage.DB.Where("k1 = ?", withdraw.K1).Delete(&models.AppWithdraw{})
+	return result.RowsAffected == 1, result.Error
+}
+
+func callbackURL(r *http.Request) string {
+	callback := getOriginalURL(r)
+	callback.Path = strings.TrimSuffix(callback.Path, "/") + "/callback"
+	return callback.String()
+}
+
+func AppLNURL(w http.ResponseWriter, r *http.Request) {
+	walletID, app, name, endpoint := getLNURLEndpoint(w, r)
+	if endpoint == nil {
+		return
+	}
+
+	args := lnurlEndpointArgs(r, name)
+	params, err := loadLNURLEndpointParams(walletID, app, name, args)
+	if err != nil {
+		apiutils.SendJSON(w, lnurl.ErrorResponse(err.Error()))
+		return
+	}
+
+	switch endpoint.Type {
+	case "pay":
+		apiutils.SendJSON(w, lnurl.LNURLPayParams{
+			Tag:             "payRequest",
+			Callback:        callbackURL(r),
+			MinSendable:     params.Min,
+			MaxSendable:     params.Max,
+			EncodedMetadata: params.metadata(),
+			CommentAllowed:  params.CommentAllowed,
+		})
+	case "withdraw":
+		k1, err := newWithdraw(walletID, app, name, params, r.URL.Query())
+		if err != nil {
+			apiutils.SendJSON(w, lnurl.ErrorResponse("failed to save withdraw: "+err.Error()))
+			return
+		}
+		apiutils.SendJSON(w, lnurl.LNURLWithdrawResponse{
+			Tag:                "withdrawRequest",
+			K1:                 k1,
+			Callback:           callbackURL(r),
+			MinWithdrawable:    params.Min,
+			MaxWithdrawable:    params.Max,
+			DefaultDescription: params.Description,
+		})
+	}
+}
+
+func AppLNURLCallback(w http.ResponseWriter, r *http.Request) {
+	walletID, app, name, endpoint := getLNURLEndpoint(w, r)
+	if endpoint == nil {
+		return
+	}
+
+	qs := r.URL.Query()
+	args := lnurlEndpointArgs(r, name)
+
+	switch endpoint.Type {
+	case "pay":
+		params, err := loadLNURLEndpointParams(walletID, app, name, args)
+		if err != nil {
+			apiutils.SendJSON(w, lnurl.ErrorResponse(err.Error()))
+			return
+		}
+
+		amount, err := strconv.ParseInt(qs.Get("amount"), 10, 64)
+		if err != nil || amount < params.Min || amount > params.Max {
+			apiutils.SendJSON(w, lnurl.ErrorResponse(fmt.Sprintf(
+				"amount must be between %d and %d msat", params.Min, params.Max)))
+			return
+		}
+		comment := qs.Get("comment")
+		if params.CommentAllowed <= 0 {
+			comment = ""
+		} else if int64(len(comment)) > params.CommentAllowed {
+			comment = comment[0:params.CommentAllowed]
+		}
+
+		args["amount"] = amount
+		args["comment"] = comment
+		returned, err := runLNURLEndpoint(walletID, app, name, "callback", args)
+		if err != nil {
+			apiutils.SendJSON(w, lnurl.ErrorResponse(err.Error()))
+			return
+		}
+
+		var result struct {
+			SuccessAction *lnurl.SuccessAction   `json:"success_action"`
+			Extra         map[string]interface{} `json:"extra"`
+		}
+		if m, ok := returned.(map[string]interface{}); ok {
+			mapToStruct(m, &result)
+		}
+
+		extra := map[string]interface{}{"lnurl": name, "params": lnurlOriginalQuery(qs)}
+		if comment != "" {
+			extra["comment"] = comment
+		}
+		for k, v := range result.Extra {
+			extra[k] = v
+		}
+
+		metadata := params.metadata()
+		descriptionHash := sha256.Sum256([]byte(metadata))
+		payment, err := services.CreateInvoice(r.Context(), walletID, services.CreateInvoiceParams{
+			InvoiceParams: rp.InvoiceParams{
+				Msatoshi:        amount,
+				Description:     params.Description,
+				DescriptionHash: descriptionHash[:],
+			},
+			Tag:   app,
+			Extra: extra,
+		})
+		if err != nil {
+			apiutils.SendJSON(w, lnurl.ErrorResponse(err.Error()))
+			return
+		}
+
+		apiutils.SendJSON(w, lnurl.LNURLPayValues{
+			PR:            payment.Bolt11,
+			Routes:        make([]interface{}, 0),
+			SuccessAction: result.SuccessAction,
+		})
+
+	case "withdraw":
+		var withdraw models.AppWithdraw
+		if err := storage.DB.
+			Where("k1 = ? AND wallet_id = ? AND app = ? AND endpoint = ? AND created_at > ?",
+				qs.Get("k1"), walletID, app, name, time.Now().Add(-LNURLWithdrawExpiry)).
+			First(&withdraw).Error; err != nil {
+			apiutils.SendJSON(w, lnurl.ErrorResponse("invalid or used k1"))
+			return
+		}
+
+		pr := qs.Get("pr")
+		inv, err := decodepay.Decodepay(pr)
+		if err != nil {
+			apiutils.SendJSON(w, lnurl.ErrorResponse("invalid invoice: "+err.Error()))
+			return
+		}
+		if inv.MSatoshi < withdraw.Min || inv.MSatoshi > withdraw.Max {
+			apiutils.SendJSON(w, lnurl.ErrorResponse(fmt.Sprintf(
+				"amount must be between %d and %d msat", withdraw.Min, withdraw.Max)))
+			return
+		}
+
+		if taken, err := takeWithdraw(withdraw); err != nil {
+			apiutils.SendJSON(w, lnurl.ErrorResponse("failed to use k1: "+err.Error()))
+			return
+		} else if !taken {
+			apiutils.SendJSON(w, lnurl.ErrorResponse("invalid or used k1"))
+			return
+		}
+
+		// the app can refuse by raising an error
+		for k, v := range withdraw.Params {
+			args[k] = v
+		}
+		args["pr"] = pr
+		args["amount"] = inv.MSatoshi
+		args["payment_hash"] = inv.PaymentHash
+		if _, err := runLNURLEndpoint(walletID, app, name, "callback", args); err != nil {
+			apiutils.SendJSON(w, lnurl.ErrorResponse(err.Error()))
+			return
+		}
+
+		payment, err := services.PayInvoice(r.Context(), walletID, services.PayInvoiceParams{
+			PaymentParams: rp.PaymentParams{Invoice: pr},
+			Tag:           app,
+			Extra:         map[string]interface{}{"lnurl": name, "params": map[string]interface{}(withdraw.Params)},
+		})
+		if err != nil {
+			zerolog.Ctx(r.Context()).Warn().Err(err).Str("app", app).Str("lnurl", name).
+				Msg("failed to pay lnurl-withdraw invoice")
+			apiutils.SendJSON(w, lnurl.ErrorResponse("failed to pay invoice: "+err.Error()))
+			return
+		}
+		zerolog.Ctx(r.Context()).Info().Str("app", app).Str("lnurl", name).
+			Str("hash", payment.Hash).Bool("pending", payment.Pending).Msg("paid lnurl-withdraw invoice")
+
+		apiutils.SendJSON(w, lnurl.OkResponse())
+	}
+}
@@ -0,0 +1,104 @@
+package apps
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/utils"
+)
+
+const appLogCapacity = 500
+
+type AppLogEntry struct {
+	Time    time.Time     `json:"time"`
+	Level   string        `json:"level"`
+	Wallet  string        `json:"wallet,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Values  []interface{} `json:"values,omitempty"`
+}
+
+// appLogBuffer is a ring buffer holding the most recent log entries for an app
+type appLogBuffer struct {
+	sync.Mutex
+	entries []AppLogEntry
+	next    int
+}
+
+// wallet:app -> *appLogBuffer, wallet can be empty for code that runs outside
+// the context of a wallet, like loading the app settings
+var appLogs = sync.Map{}
+
+func recordAppLog(walletID, app string, entry AppLogEntry) {
+	entry.Wallet = walletID
+	ibuf, _ := appLogs.LoadOrStore(walletID+":"+app, &appLogBuffer{
+		entries: make([]AppLogEntry, 0, appLogCapacity),
+	})
+	buf := ibuf.(*appLogBuffer)
+
+	buf.Lock()
+	if len(buf.entries) < appLogCapacity {
+		buf.entries = append(buf.entries, entry)
+	} else {
+		buf.entries[buf.next] = entry
+		buf.next = (buf.next + 1) % appLogCapacity
+	}
+	buf.Unlock()
+
+	if walletID != "" {
+		jentry, _ := utils.JSONMarshal(entry)
+		SendLogSSE(walletID, jentry)
+	}
+}
+
+func getAppLogs(walletID, app string, since time.Time) []AppLogEntry {
+	entries := make([]AppLogEntry, 0)
+
+	for _, key := range []string{":" + app, walletID + ":" + app} {
+		ibuf, ok := appLogs.Load(key)
+		if !ok {
+			continue
+		}
+		buf := ibuf.(*appLogBuffer)
+
+		buf.Lock()
+		for _, entry := range buf.entries {
+			if entry.Time.After(since) {
+				entries = append(entries, entry)
+			}
+		}
+		buf.Unlock()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+
+	return entries
+}
+
+func Logs(w http.ResponseWriter, r *http.Request) {
+	app := appIDToURL(mux.Vars(r)["appid"])
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+	qs := r.URL.Query()
+
+	// ?since=<unix milliseconds> allows clients to tail the log by polling
+	var since time.Time
+	if ms, err := strconv.ParseInt(qs.Get("since"), 10, 64); err == nil {
+		since = time.UnixMilli(ms)
+	}
+
+	entries := getAppLogs(wallet.ID, app, since)
+
+	if tail, err := strconv.Atoi(qs.Get("tail")); err == nil &&
+		tail > 0 && tail < len(entries) {
+		entries = entries[len(entries)-tail:]
+	}
+
+	apiutils.SendJSON(w, entries)
+}
@@ -0,0 +1,94 @@
+package apps
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// wallet:app -> schema version we know the stored data is at
+	migratedAppWallets = sync.Map{}
+	migrationLocks     = sync.Map{}
+)
+
+// ensureMigrated checks the schema version of the data stored by this app on this
+// wallet and runs the app's migrate() function if the app code declares a newer
+// schema_version than the one the data was last written with.
+func ensureMigrated(walletID string, settings *Settings) error {
+	if walletID == "" || settings.SchemaVersion == 0 {
+		return nil
+	}
+
+	cacheKey := walletID + ":" + settings.URL
+	if version, ok := migratedAppWallets.Load(cacheKey); ok &&
+		version.(int) == settings.SchemaVersion {
+		return nil
+	}
+
+	// only one migration at a time for each app/wallet
+	ilock, _ := migrationLocks.LoadOrStore(cacheKey, &sync.Mutex{})
+	lock := ilock.(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	schema := models.AppSchema{App: settings.URL, WalletID: walletID}
+	result := storage.DB.Where(&schema).First(&schema)
+	if result.Error == gorm.ErrRecordNotFound {
+		// the app didn't have a schema version before. if there is no data
+		// there is nothing to migrate, otherwise we assume data is at version 0
+		var count int64
+		storage.DB.Scopes(storage.AppItems(walletID)).Model(&models.AppDataItem{}).
+			Where(&models.AppDataItem{App: settings.URL, WalletID: walletID}).
+			Count(&count)
+		if count == 0 {
+			schema.Version = settings.SchemaVersion
+		}
+	} else if result.Error != nil {
+		return fmt.Errorf("failed to load schema version: %w", result.Error)
+	}
+
+	if schema.Version > settings.SchemaVersion {
+		return fmt.Errorf(
+			"stored data is at schema version %d, but app code is at %d",
+			schema.Version, settings.SchemaVersion)
+	}
+
+	if schema.Version < settings.SchemaVersion && settings.Migrate != nil {
+		log.Info().Str("wallet", walletID).Str("app", settings.URL).
+			Int("from", schema.Version).Int("to", settings.SchemaVersion).
+			Msg("migrating app data")
+
+		_, err := runlua(RunluaParams{
+			Code:          settings.Code,
+			AppURL:        settings.URL,
+			WalletID:      walletID,
+			CodeToRun:     "migrate(internal.arg.from, internal.arg.to)",
+			SkipMigration: true,
+			InjectedGlobals: &map[string]interface{}{"arg": map[string]interface{}{
+				"from": schema.Version,
+				"to":   settings.SchemaVersion,
+			}},
+		})
+		if err != nil {
+			return fmt.Errorf("migration from %d to %d failed: %w",
+				schema.Version, settings.SchemaVersion, err)
+		}
+	}
+
+	schema.Version = settings.SchemaVersion
+	result = storage.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "app"}, {Name: "wallet_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"version", "updated_at"}),
+	}).Create(&schema)
+	if result.Error != nil {
+		return fmt.Errorf("failed to save schema version: %w", result.Error)
+	}
+
+	migratedAppWallets.Store(cacheKey, settings.SchemaVersion)
+	return nil
+}
@@ -0,0 +1,392 @@
+package apps
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	nostr "github.com/fiatjaf/go-nostr"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/utils/nostr_utils"
+	"github.com/rif/cache2go"
+)
+
+// apps can be published as nostr events and installed from their naddr or
+// nevent reference as nostr:naddr1... or nostr:nevent1...
+// the event content is a json manifest with the app code and its static files.
+
+const (
+	nostrScheme     = "nostr"
+	AppManifestKind = 30078
+	appManifestTag  = "lnbits-infinity-app"
+)
+
+type appManifest struct {
+	Code  string            `json:"code"`
+	Files map[string]string `json:"files"`
+
+	// the pubkey that signed the event
+	Author string `json:"-"`
+}
+
+var manifestCache = cache2go.New(AppCacheSize/3, time.Minute*45)
+
+func isNostrApp(appURL string) bool {
+	return strings.HasPrefix(appURL, nostrScheme+":")
+}
+
+func getNostrManifest(appURL string) (*appManifest, error) {
+	if manifest, ok := manifestCache.Get(appURL); ok {
+		return manifest.(*appManifest), nil
+	}
+
+	manifest, err := fetchNostrManifest(appURL)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestCache.Set(appURL, manifest)
+	return manifest, nil
+}
+
+func fetchNostrManifest(appURL string) (*appManifest, error) {
+	code := strings.TrimPrefix(strings.TrimPrefix(appURL, nostrScheme+":"), "//")
+
+	var filter map[string]interface{}
+	var relays []string
+	var matches func(nostr.Event) bool
+
+	switch {
+	case strings.HasPrefix(code, "naddr1"):
+		pointer, err := nostr_utils.DecodeNaddr(code)
+		if err != nil {
+			return nil, fmt.Errorf("invalid naddr: %w", err)
+		}
+		if pointer.Kind != AppManifestKind {
+			return nil, fmt.Errorf("naddr points to kind %d, not an app", pointer.Kind)
+		}
+		filter = map[string]interface{}{
+			"kinds":   []int{pointer.Kind},
+			"authors": []string{pointer.PubKey},
+			"#d":      []string{pointer.Identifier},
+		}
+		relays = pointer.Relays
+		matches = func(evt nostr.Event) bool {
+			return evt.Kind == pointer.Kind && evt.PubKey == pointer.PubKey &&
+				tagValue(evt, "d") == pointer.Identifier
+		}
+	case strings.HasPrefix(code, "nevent1"):
+		pointer, err := nostr_utils.DecodeNevent(code)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nevent: %w", err)
+		}
+		filter = map[string]interface{}{"ids": []string{pointer.ID}}
+		relays = pointer.Relays
+		matches = func(evt nostr.Event) bool {
+			return evt.ID == pointer.ID
+		}
+	default:
+		return nil, fmt.Errorf("unsupported nostr reference '%s'", code)
+	}
+
+	// relays may send anything, only what was asked for is taken
+	events := make([]nostr.Event, 0)
+	for _, evt := range nostr_utils.QueryEvents(relays, filter) {
+		if matches(evt) {
+			events = append(events, evt)
+		}
+	}
+	if len(events) == 0 {
+		return nil, errors.New("app event not found on any relay")
+	}
+
+	// for replaceable events pick the newest
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].CreatedAt.After(events[j].CreatedAt)
+	})
+	evt := events[0]
+
+	if evt.Kind != AppManifestKind || !hasTag(evt, "t", appManifestTag) {
+		return nil, errors.New("event is not an app manifest")
+	}
+
+	var manifest appManifest
+	if err := json.Unmarshal([]byte(evt.Content), &manifest); err != nil {
+		return nil, fmt.Errorf("invalid app manifest: %w", err)
+	}
+	if manifest.Code == "" {
+		return nil, errors.New("app manifest has no code")
+	}
+
+	manifest.Author = evt.PubKey
+	return &manifest, nil
+}
+
+func hasTag(evt nostr.Event, name, value string) bool {
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == name && tag[1] == value {
+			return true
+		}
+	}
+	return false
+}
+
+func tagValue(evt nostr.Event, name string) string {
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+func manifestFileName(filepath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath), "/")
+}
+
+func serveNostrFile(w http.ResponseWriter, r *http.Request, fileURL *url.URL) {
+	appURL := nostrScheme + ":" + fileURL.Opaque
+	manifest, err := getNostrManifest(appURL)
+	if err != nil {
+		http.Error(w, "failed to load app: "+err.Error(), 404)
+		return
+	}
+
+	name := manifestFileName(fileURL.Path)
+	content, ok := manifest.Files[name]
+	if !ok {
+		http.Error(w, "file not found: "+name, 404)
+		return
+	}
+
+	// big assets can be referenced by URL instead of embedded
+	if strings.HasPrefix(content, "https://") || strings.HasPrefix(content, "http://") {
+		if remote, err := url.Parse(content); err == nil {
+			serveFile(w, r, remote)
+			return
+		}
+	}
+
+	http.ServeContent(w, r, path.Base(name), time.Time{}, bytes.NewReader([]byte(content)))
+}
+
+// readAppFile gets the contents of a file belonging to an app from wherever it is.
+func readAppFile(fileURL *url.URL) ([]byte, error) {
+	switch fileURL.Scheme {
+	case builtinScheme:
+		return readBuiltinFile(fileURL.String())
+	case "file":
+		return readDevFile(fileURL.String())
+	case nostrScheme:
+		manifest, err := getNostrManifest(nostrScheme + ":" + fileURL.Opaque)
+		if err != nil {
+			return nil, err
+		}
+		content, ok := manifest.Files[manifestFileName(fileURL.Path)]
+		if !ok {
+			return nil, errors.New("file not found")
+		}
+		return []byte(content), nil
+	}
+
+	resp, err := httpClient.Get(fileURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("http call returned status code %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func buildManifestEvent(appURL string, identifier string) (*nostr.Event, error) {
+	settings, err := GetAppSettings(appURL, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run app: %w", err)
+	}
+
+	baseURL, err := url.Parse(appURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid app url: %w", err)
+	}
+
+	manifest := appManifest{
+		Code:  settings.Code,
+		Files: make(map[string]string),
+	}
+
+	filenames := []string{"index.html"}
+	for _, file := range settings.Files {
+		filenames = append(filenames, file)
+	}
+	for _, file := range filenames {
+		if strings.HasPrefix(file, "http") {
+			// absolute URLs are kept as they are
+			continue
+		}
+
+		name := manifestFileName(file)
+		if _, ok := manifest.Files[name]; ok {
+			continue
+		}
+
+		content, err := readAppFile(urljoin(*baseURL, file))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file '%s': %w", file, err)
+		}
+		manifest.Files[name] = string(content)
+	}
+
+	content, _ := json.Marshal(manifest)
+
+	if identifier == "" {
+		identifier = appURLToID(appURL)
+	}
+
+	return &nostr.Event{
+		CreatedAt: time.Now(),
+		Kind:      AppManifestKind,
+		Tags: nostr.Tags{
+			nostr.StringList{"d", identifier},
+			nostr.StringList{"t", appManifestTag},
+			nostr.StringList{"title", settings.Title},
+			nostr.StringList{"description", strings.TrimSpace(settings.Description)},
+		},
+		Content: string(content),
+	}, nil
+}
+
+func PublishApp(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*models.User)
+
+	var params struct {
+		URL        string       `json:"url"`
+		Identifier string       `json:"d"`
+		Event      *nostr.Event `json:"event"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		apiutils.SendJSONError(w, 400, "got invalid JSON: %s", err.Error())
+		return
+	}
+
+	evt := params.Event
+	if evt != nil {
+		// signed by the user elsewhere (e.g. with a browser extension)
+		if ok, err := evt.CheckSignature(); !ok {
+			apiutils.SendJSONError(w, 400, "invalid event signature: %v", err)
+			return
+		}
+		if evt.Kind != AppManifestKind || !hasTag(*evt, "t", appManifestTag) {
+			apiutils.SendJSONError(w, 400, "event is not an app manifest")
+			return
+		}
+	} else {
+		var err error
+		evt, err = buildManifestEvent(params.URL, params.Identifier)
+		if err != nil {
+			apiutils.SendJSONError(w, 470, "%s", err.Error())
+			return
+		}
+
+		// otherwise sign with a key that belongs to this user on this instance
+		if err := evt.Sign(nostr_utils.DeriveKey("nostrkey:user:" + user.ID)); err != nil {
+			apiutils.SendJSONError(w, 500, "failed to sign event: %s", err.Error())
+			return
+		}
+	}
+
+	relays := nostr_utils.Broadcast(*evt, nil)
+	if len(relays) == 0 {
+		apiutils.SendJSONError(w, 502, "no relay accepted the event")
+		return
+	}
+
+	naddr, err := nostr_utils.EncodeNaddr(nostr_utils.AddressPointer{
+		Identifier: tagValue(*evt, "d"),
+		PubKey:     evt.PubKey,
+		Kind:       evt.Kind,
+		Relays:     relays,
+	})
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "failed to encode naddr: %s", err.Error())
+		return
+	}
+
+	appURL := nostrScheme + ":" + naddr
+	manifestCache.Delete(appURL)
+
+	apiutils.SendJSON(w, struct {
+		URL    string      `json:"url"`
+		Event  nostr.Event `json:"event"`
+		Relays []string    `json:"relays"`
+	}{appURL, *evt, relays})
+}
+
+type NostrApp struct {
+	URL         string    `json:"url"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Author      string    `json:"author"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func NostrApps(w http.ResponseWriter, r *http.Request) {
+	filter := map[string]interface{}{
+		"kinds": []int{AppManifestKind},
+		"#t":    []string{appManifestTag},
+		"limit": 100,
+	}
+	if author := r.URL.Query().Get("author"); author != "" {
+		filter["authors"] = []string{author}
+	}
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit > 0 {
+		filter["limit"] = limit
+	}
+
+	// keep only the latest version of each app
+	latest := make(map[string]nostr.Event)
+	for _, evt := range nostr_utils.QueryEvents(nil, filter) {
+		key := evt.PubKey + ":" + tagValue(evt, "d")
+		if prev, ok := latest[key]; !ok || evt.CreatedAt.After(prev.CreatedAt) {
+			latest[key] = evt
+		}
+	}
+
+	list := make([]NostrApp, 0, len(latest))
+	for _, evt := range latest {
+		naddr, err := nostr_utils.EncodeNaddr(nostr_utils.AddressPointer{
+			Identifier: tagValue(evt, "d"),
+			PubKey:     evt.PubKey,
+			Kind:       evt.Kind,
+			Relays:     nostr_utils.Relays,
+		})
+		if err != nil {
+			continue
+		}
+
+		list = append(list, NostrApp{
+			URL:         nostrScheme + ":" + naddr,
+			Title:       tagValue(evt, "title"),
+			Description: tagValue(evt, "description"),
+			Author:      evt.PubKey,
+			UpdatedAt:   evt.CreatedAt,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UpdatedAt.After(list[j].UpdatedAt)
+	})
+
+	apiutils.SendJSON(w, list)
+}
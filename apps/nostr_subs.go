@@ -0,0 +1,173 @@
+package apps
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	nostr "github.com/fiatjaf/go-nostr"
+	"github.com/fiatjaf/lunatico"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils"
+	"github.com/lnbits/infinity/utils/nostr_utils"
+)
+
+// apps can declare nostr_subscriptions, each with a filter (or a function that
+// returns one) and a handler that gets called for each matching event. the filters
+// are kept open on the relays for every wallet that has the app installed.
+
+var NostrSubscriptionsSync = time.Minute * 10
+
+type NostrSubscription struct {
+	Handler *lunatico.LuaFunction `json:"handler"`
+	Relays  []string              `json:"relays,omitempty"`
+}
+
+type runningNostrSubscription struct {
+	filterHash string
+	cancel     context.CancelFunc
+}
+
+var (
+	nostrSubscriptionsMutex sync.Mutex
+	nostrSubscriptions      = make(map[string]*runningNostrSubscription)
+)
+
+// SyncNostrSubscriptions starts subscriptions for apps that declare them and
+// stops the ones for apps that were removed or that changed their filters.
+func SyncNostrSubscriptions() {
+	var appWalletCombinations []AppWallet
+	result := storage.DB.Raw(`
+      SELECT wallets.id AS wallet_id, url
+      FROM user_apps
+      LEFT OUTER JOIN users ON user_apps.user_id = users.id
+      LEFT OUTER JOIN wallets ON wallets.user_id = users.id AND wallets.deleted_at IS NULL
+    `).Scan(&appWalletCombinations)
+	if result.Error != nil {
+		log.Error().Err(result.Error).Msg("failed to load apps for nostr subscriptions")
+		return
+	}
+
+	wanted := make(map[string]bool)
+	for _, appWallet := range appWalletCombinations {
+		settings, err := GetAppSettings(appWallet.URL, false)
+		if err != nil || len(settings.NostrSubscriptions) == 0 {
+			continue
+		}
+
+		for name, sub := range settings.NostrSubscriptions {
+			key := appWallet.WalletID + ":" + appWallet.URL + ":" + name
+
+			filter, err := getNostrFilter(appWallet, name)
+			if err != nil {
+				log.Warn().Err(err).Str("app", appWallet.URL).Str("subscription", name).
+					Msg("failed to get nostr subscription filter")
+				continue
+			}
+			wanted[key] = true
+
+			j, _ := utils.JSONMarshal(struct {
+				Filter map[string]interface{}
+				Relays []string
+			}{filter, sub.Relays})
+			hash := sha256.Sum256(j)
+			filterHash := hex.EncodeToString(hash[:])
+
+			nostrSubscriptionsMutex.Lock()
+			running, ok := nostrSubscriptions[key]
+			if ok && running.filterHash == filterHash {
+				nostrSubscriptionsMutex.Unlock()
+				continue
+			}
+			if ok {
+				running.cancel()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			nostrSubscriptions[key] = &runningNostrSubscription{filterHash, cancel}
+			nostrSubscriptionsMutex.Unlock()
+
+			aw, n := appWallet, name
+			if err := nostr_utils.Subscribe(ctx, sub.Relays, filter, func(evt nostr.Event) {
+				handleNostrEvent(aw, n, evt)
+			}); err != nil {
+				log.Warn().Err(err).Str("app", aw.URL).Str("wallet", aw.WalletID).
+					Str("subscription", n).Msg("failed to subscribe")
+			}
+		}
+	}
+
+	nostrSubscriptionsMutex.Lock()
+	for key, running := range nostrSubscriptions {
+		if !wanted[key] {
+			running.cancel()
+			delete(nostrSubscriptions, key)
+		}
+	}
+	nostrSubscriptionsMutex.Unlock()
+}
+
+func stopNostrSubscriptions() {
+	nostrSubscriptionsMutex.Lock()
+	defer nostrSubscriptionsMutex.Unlock()
+	for key, running := range nostrSubscriptions {
+		running.cancel()
+		delete(nostrSubscriptions, key)
+	}
+}
+
+func getNostrFilter(appWallet AppWallet, name string) (map[string]interface{}, error) {
+	returned, err := runlua(RunluaParams{
+		AppURL:    appWallet.URL,
+		WalletID:  appWallet.WalletID,
+		CodeToRun: fmt.Sprintf("internal.get_nostr_filter('%s')", name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	filter, ok := returned.(map[string]interface{})
+	if !ok || len(filter) == 0 {
+		return nil, fmt.Errorf("filter must be a non-empty table, got %v", returned)
+	}
+	return filter, nil
+}
+
+func handleNostrEvent(appWallet AppWallet, name string, evt nostr.Event) {
+	_, err := runlua(RunluaParams{
+		AppURL:          appWallet.URL,
+		WalletID:        appWallet.WalletID,
+		CodeToRun:       fmt.Sprintf("nostr_subscriptions['%s'].handler(internal.arg)", name),
+		InjectedGlobals: &map[string]interface{}{"arg": structToMap(evt)},
+	})
+	if err != nil && err != CachedFailure {
+		log.Warn().Err(err).
+			Str("wallet", appWallet.WalletID).
+			Str("app", appWallet.URL).
+			Str("subscription", name).
+			Str("event", evt.ID).
+			Msg("failed to handle nostr event")
+	}
+}
+
+// helpers exposed to lua, with types lunatico can convert to
+func nostrQuery(irelays []interface{}, filter map[string]interface{}) []nostr.Event {
+	relays := make([]string, 0, len(irelays))
+	for _, irelay := range irelays {
+		if relay, ok := irelay.(string); ok {
+			relays = append(relays, relay)
+		}
+	}
+	return nostr_utils.QueryEvents(relays, filter)
+}
+
+func nostrEncrypt(app, wallet, pubkey, message string) (string, error) {
+	return nostr_utils.NIP04Encrypt(message, nostr_utils.AppKey(app, wallet), pubkey)
+}
+
+func nostrDecrypt(app, wallet, pubkey, content string) (string, error) {
+	return nostr_utils.NIP04Decrypt(content, nostr_utils.AppKey(app, wallet), pubkey)
+}
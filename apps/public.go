@@ -3,6 +3,8 @@ package apps
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
@@ -10,6 +12,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/cluster"
 	"github.com/lnbits/infinity/utils"
 	"gopkg.in/antage/eventsource.v1"
 )
@@ -58,6 +61,7 @@ func CustomAction(w http.ResponseWriter, r *http.Request) {
 	// add special params
 	params["_url"] = getOriginalURL(r).String()
 	params["_action"] = action
+	params["_ip"] = apiutils.ClientIP(r)
 
 	returned, err := runlua(RunluaParams{
 		AppURL:          app,
@@ -70,7 +74,88 @@ func CustomAction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// if the action returns a table with these values we'll interpret it in a special way
+	sendCustomResponse(w, returned)
+}
+
+func CustomRoute(w http.ResponseWriter, r *http.Request) {
+	walletID := mux.Vars(r)["wallet"]
+	app := appIDToURL(mux.Vars(r)["appid"])
+	path := "/" + mux.Vars(r)["path"]
+
+	settings, err := GetAppSettings(app, false)
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "failed to get app settings: %s", err.Error())
+		return
+	}
+
+	setSecurityHeaders(w, settings)
+
+	pathMatched := false
+	for i, route := range settings.Routes {
+		params, ok := route.match(path)
+		if !ok {
+			continue
+		}
+		pathMatched = true
+
+		if route.Method != r.Method {
+			continue
+		}
+
+		query := make(map[string]interface{})
+		for k, v := range r.URL.Query() {
+			query[k] = v[0]
+		}
+
+		headers := make(map[string]interface{})
+		for k, v := range r.Header {
+			headers[strings.ToLower(k)] = v[0]
+		}
+
+		var body interface{}
+		if r.Body != nil {
+			raw, _ := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+				json.Unmarshal(raw, &body)
+			} else if len(raw) > 0 {
+				body = string(raw)
+			}
+		}
+
+		returned, err := runlua(RunluaParams{
+			AppURL:    app,
+			CodeToRun: fmt.Sprintf("routes[%d].handler(internal.arg)", i+1),
+			InjectedGlobals: &map[string]interface{}{"arg": map[string]interface{}{
+				"method":  r.Method,
+				"path":    path,
+				"params":  params,
+				"query":   query,
+				"headers": headers,
+				"body":    body,
+				"_url":    getOriginalURL(r).String(),
+				"_ip":     apiutils.ClientIP(r),
+			}},
+			WalletID: walletID,
+		})
+		if err != nil {
+			apiutils.SendJSONError(w, 470, "failed to run route handler: %s", err.Error())
+			return
+		}
+
+		sendCustomResponse(w, returned)
+		return
+	}
+
+	if pathMatched {
+		apiutils.SendJSONError(w, 405, "method %s not allowed on '%s'", r.Method, path)
+	} else {
+		apiutils.SendJSONError(w, 404, "route '%s' not defined on app", path)
+	}
+}
+
+// sendCustomResponse writes whatever an action or route handler has returned.
+// if it returns a table with {body, status, headers} we'll interpret it in a special way.
+func sendCustomResponse(w http.ResponseWriter, returned interface{}) {
 	if complexResponse, ok := returned.(map[string]interface{}); ok {
 		ibody, ok1 := complexResponse["body"]
 		istatus, ok2 := complexResponse["status"]
@@ -85,14 +170,14 @@ func CustomAction(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			w.WriteHeader(int(status))
-
+			// headers must be set before the status is written
 			for key, ival := range headers {
 				if val, ok := ival.(string); ok {
 					w.Header().Set(key, val)
 				}
 			}
 
+			w.WriteHeader(int(status))
 			fmt.Fprint(w, body)
 
 			return
@@ -110,7 +195,7 @@ func PublicSSE(w http.ResponseWriter, r *http.Request) {
 	ies, ok := publicAppStreams.Load(walletID + ":" + app)
 
 	if !ok {
-		es = eventsource.New(
+		es = utils.ClosableStream(eventsource.New(
 			&eventsource.Settings{
 				Timeout:        5 * time.Second,
 				CloseOnTimeout: true,
@@ -125,7 +210,7 @@ func PublicSSE(w http.ResponseWriter, r *http.Request) {
 					[]byte("Access-Control-Allow-Origin: *"),
 				}
 			},
-		)
+		))
 		go func() {
 			for {
 				time.Sleep(25 * time.Second)
@@ -148,11 +233,7 @@ func PublicSSE(w http.ResponseWriter, r *http.Request) {
 
 func emitPublicEvent(walletID string, app string, typ string, data interface{}) {
 	jpayload, _ := utils.JSONMarshal(data)
-	payload := string(jpayload)
-
-	if ies, ok := publicAppStreams.Load(walletID + ":" + app); ok {
-		ies.(eventsource.EventSource).SendEventMessage(payload, typ, "")
-	}
+	cluster.Publish("app_sse", streamEvent{walletID, app, typ, string(jpayload)})
 }
 
 func StaticFile(w http.ResponseWriter, r *http.Request) {
@@ -171,6 +252,8 @@ func StaticFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setSecurityHeaders(w, settings)
+
 	if specific, ok := settings.Files[subpath]; ok {
 		serveFile(w, r, urljoin(*baseURL, specific))
 		return
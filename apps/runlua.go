@@ -6,16 +6,18 @@ import (
 	"errors"
 	"fmt"
 	"html"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aarzilli/golua/lua"
+	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/fiatjaf/go-lnurl"
-	decodepay "github.com/nbd-wtf/ln-decodepay"
 	"github.com/fiatjaf/lunatico"
+	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/services"
 	"github.com/lnbits/infinity/utils"
 	"github.com/lnbits/infinity/utils/nostr_utils"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
 )
 
 //go:embed sandbox.lua
@@ -28,9 +30,18 @@ type RunluaParams struct {
 	CodeToRun        string
 	InjectedGlobals  *map[string]interface{}
 	ExtractedGlobals interface{}
+	SkipMigration    bool
+
+	// BusHops is the hops an event published by this code will have.
+	BusHops int
 }
 
 func runlua(params RunluaParams) (interface{}, error) {
+	circuit := getCircuit(params.WalletID, params.AppURL)
+	if err := circuit.allow(); err != nil {
+		return nil, err
+	}
+
 	L := lua.NewState()
 	defer L.Close()
 	L.OpenLibs()
@@ -43,6 +54,16 @@ func runlua(params RunluaParams) (interface{}, error) {
 		params.Code = appCode
 	}
 
+	// before running code that can touch this wallet's data for this app,
+	// make sure the data is at the schema version the app expects
+	if params.WalletID != "" && !params.SkipMigration {
+		if settings, err := GetAppSettings(params.AppURL, false); err == nil {
+			if err := ensureMigrated(params.WalletID, settings); err != nil {
+				return nil, fmt.Errorf("failed to migrate app data: %w", err)
+			}
+		}
+	}
+
 	code := CUSTOM_ENV_DEF + "\n" + params.Code + "\n"
 	if params.CodeToRun != "" {
 		code += "return " + params.CodeToRun
@@ -51,10 +72,20 @@ func runlua(params RunluaParams) (interface{}, error) {
 return {
   title = title,
   description = description,
+  icon = icon,
   models = models,
   triggers = triggers,
   actions = actions,
-  files = files
+  routes = routes,
+  lnurl_endpoints = lnurl_endpoints,
+  nostr_subscriptions = nostr_subscriptions,
+  subscriptions = subscriptions,
+  files = files,
+  fetch_domains = fetch_domains,
+  frame_ancestors = frame_ancestors,
+  content_security_policy = content_security_policy,
+  schema_version = schema_version,
+  migrate = migrate
 }`
 	}
 
@@ -63,7 +94,9 @@ return {
 		"app_encoded_id": appURLToID(params.AppURL),
 		"code":           code,
 
-		"debug_print": luaPrint,
+		"debug_print": func(args ...interface{}) {
+			luaPrint(params.WalletID, params.AppURL, args...)
+		},
 
 		"sha256":                  utils.Sha256String,
 		"random_hex":              utils.RandomHex,
@@ -72,13 +105,12 @@ return {
 		"perform_key_auth_flow":   utils.PerformKeyAuthFlow,
 		"currencies":              utils.CURRENCIES,
 		"get_msats_per_fiat_unit": utils.GetMsatsPerFiatUnit,
+		"btc_price":               utils.GetBTCPrice,
+		"fiat_to_msats":           utils.FiatToMsats,
+		"msats_to_fiat": func(msats float64, currency string) (float64, error) {
+			return utils.MsatsToFiat(int64(msats), currency)
+		},
 		"parse_date":              utils.DateStringToTimestamp,
-		"http_get":                utils.HTTPGet,
-		"http_put":                utils.HTTPPut,
-		"http_post":               utils.HTTPPost,
-		"http_patch":              utils.HTTPPatch,
-		"http_delete":             utils.HTTPDelete,
-		"http_request":            utils.HTTP,
 		"qs_parse":                utils.ParseQueryString,
 		"qs_encode":               utils.EncodeQueryString,
 		"json_parse":              utils.JSONParse,
@@ -88,10 +120,38 @@ return {
 		"lnurl_bech32_encode":     lnurl.LNURLEncode,
 		"lnurl_bech32_decode":     lnurl.LNURLDecode,
 		"lnurl_successaction_aes": utils.AESSuccessAction,
-		"feed_parse":              utils.ParseFeed,
 		"html_escape":             html.EscapeString,
 		"html_unescape":           html.UnescapeString,
 		"decode_invoice":          decodepay.Decodepay,
+		"nwc_pay_invoice":         nostr_utils.NWCPayInvoice,
+		"nostr_query":             nostrQuery,
+
+		"app_fetch": func(url string, options map[string]interface{}) (map[string]interface{}, error) {
+			return appFetch(params.AppURL, url, options)
+		},
+
+		// with the same checks as fetch
+		"http_get": func(url string) (interface{}, int, error) {
+			return appHTTP(params.AppURL, "GET", url, nil, nil)
+		},
+		"http_put": func(url string, data interface{}) (interface{}, int, error) {
+			return appHTTP(params.AppURL, "PUT", url, data, nil)
+		},
+		"http_post": func(url string, data interface{}) (interface{}, int, error) {
+			return appHTTP(params.AppURL, "POST", url, data, nil)
+		},
+		"http_patch": func(url string, data interface{}) (interface{}, int, error) {
+			return appHTTP(params.AppURL, "PATCH", url, data, nil)
+		},
+		"http_delete": func(url string) (interface{}, int, error) {
+			return appHTTP(params.AppURL, "DELETE", url, nil, nil)
+		},
+		"http_request": func(method, url string, data interface{}, headers map[string]string) (interface{}, int, error) {
+			return appHTTP(params.AppURL, strings.ToUpper(method), url, data, headers)
+		},
+		"feed_parse": func(url string) (map[string]interface{}, string, error) {
+			return appFeed(params.AppURL, url)
+		},
 	}
 
 	if params.InjectedGlobals != nil {
@@ -106,23 +166,90 @@ return {
 		walletDependentGlobals := map[string]interface{}{
 			"wallet_id": params.WalletID,
 
-			"emit_public_event": emitPublicEvent,
-
-			"auth_key":             services.AuthKey,
-			"pay_invoice":          services.PayInvoiceFromApp,
-			"create_invoice":       services.CreateInvoiceFromApp,
-			"internal_transfer":    services.Transfer,
-			"get_wallet_payment":   services.GetWalletPayment,
-			"load_wallet_balance":  services.LoadWalletBalance,
-			"load_wallet_payments": services.LoadWalletPayments,
-			"nostr_publish":        nostr_utils.Publish,
-
-			"db_get":    DBGet,
-			"db_set":    DBSet,
-			"db_add":    DBAdd,
-			"db_list":   DBList,
-			"db_update": DBUpdate,
-			"db_delete": DBDelete,
+			// bound to this app here, the code could pass any wallet and app
+			"emit_public_event": func(name string, data interface{}) {
+				emitPublicEvent(params.WalletID, params.AppURL, name, data)
+			},
+			"auth_key": func(domain string) *btcec.PrivateKey {
+				return services.AuthKey(params.WalletID, domain)
+			},
+			"pay_invoice": func(args map[string]interface{}) (interface{}, error) {
+				args["tag"] = params.AppURL
+				return services.PayInvoiceFromApp(params.WalletID, args)
+			},
+			"create_invoice": func(args map[string]interface{}) (interface{}, error) {
+				args["tag"] = params.AppURL
+				return services.CreateInvoiceFromApp(params.WalletID, args)
+			},
+			"internal_transfer": func(toWallet string, msatoshi int64, description string) error {
+				return services.Transfer(params.WalletID, toWallet, msatoshi, description)
+			},
+			"get_wallet_payment": func(hashOrCheckingID string) (models.Payment, error) {
+				return services.GetWalletPayment(params.WalletID, hashOrCheckingID)
+			},
+			"load_wallet_balance": func() (int64, error) {
+				return services.LoadWalletBalance(params.WalletID)
+			},
+			"load_wallet_payments": func() ([]models.Payment, error) {
+				return services.LoadWalletPayments(params.WalletID)
+			},
+			"db_get": func(model, key string) (map[string]interface{}, error) {
+				return DBGet(params.WalletID, params.AppURL, model, key)
+			},
+			"db_get_item": func(model, key string) (*models.AppDataItem, error) {
+				return DBGetItem(params.WalletID, params.AppURL, model, key)
+			},
+			"db_set": func(model, key string, value map[string]interface{}) error {
+				return DBSet(params.WalletID, params.AppURL, model, key, value)
+			},
+			"db_add": func(model string, value map[string]interface{}) (string, error) {
+				return DBAdd(params.WalletID, params.AppURL, model, value)
+			},
+			"db_list": func(model string, args map[string]interface{}) ([]models.AppDataItem, error) {
+				return DBList(params.WalletID, params.AppURL, model, args)
+			},
+			"db_update": func(model, key string, updates map[string]interface{}) error {
+				return DBUpdate(params.WalletID, params.AppURL, model, key, updates)
+			},
+			"db_delete": func(model, key string) error {
+				return DBDelete(params.WalletID, params.AppURL, model, key)
+			},
+			"db_transaction": func(ops []interface{}) error {
+				return DBTransaction(params.WalletID, params.AppURL, ops)
+			},
+			"websocket_send": func(data interface{}, connection string) int {
+				return sendWebSocketMessage(params.WalletID, params.AppURL, data, connection)
+			},
+			"websocket_connections": func() []string {
+				return listWebSocketConnections(params.WalletID, params.AppURL)
+			},
+			"bus_publish": func(name string, data interface{}) error {
+				return publishBusEvent(params.WalletID, params.AppURL, name, data, params.BusHops)
+			},
+			"nostr_pubkey": func() (string, error) {
+				return nostr_utils.AppPublicKey(params.AppURL, params.WalletID)
+			},
+			"nostr_publish": func(event map[string]interface{}) (string, error) {
+				return nostr_utils.Publish(params.AppURL, params.WalletID, event)
+			},
+			"nostr_encrypt": func(pubkey, message string) (string, error) {
+				return nostrEncrypt(params.AppURL, params.WalletID, pubkey, message)
+			},
+			"nostr_decrypt": func(pubkey, content string) (string, error) {
+				return nostrDecrypt(params.AppURL, params.WalletID, pubkey, content)
+			},
+			"secret_get": func(name string) (interface{}, error) {
+				return SecretGet(params.WalletID, params.AppURL, name)
+			},
+			"secret_set": func(name, value string) error {
+				return SecretSet(params.WalletID, params.AppURL, name, value)
+			},
+			"secret_delete": func(name string) error {
+				return SecretDelete(params.WalletID, params.AppURL, name)
+			},
+			"secret_list": func() ([]models.AppSecret, error) {
+				return SecretList(params.WalletID, params.AppURL)
+			},
 		}
 
 		for k, v := range walletDependentGlobals {
@@ -140,15 +267,30 @@ return {
 	}
 	sandboxGlobalsInjector += "}\n"
 
+	// the sandbox quota is disabled because setLimits takes care of it
+	setLimits(L)
 	err := L.DoString(sandboxGlobalsInjector + `
 local sandbox = (function () ` + sandboxCode + `end)()
-ret = sandbox.run(code, { quota = ` + strconv.Itoa(LuaQuota) + `, env = injected_globals })
+ret = sandbox.run(code, { quota = false, env = injected_globals })
     `)
+	circuit.record(err)
 	if err != nil {
 		if luaError, ok := err.(*lua.LuaError); ok {
 			err = errors.New(stacktrace(luaError))
 		}
 
+		if isDevApp(params.AppURL) {
+			if context := devErrorContext(params.Code, err); context != "" {
+				err = fmt.Errorf("%w\n\n%s", err, context)
+			}
+		}
+
+		recordAppLog(params.WalletID, params.AppURL, AppLogEntry{
+			Time:    time.Now(),
+			Level:   "error",
+			Message: err.Error(),
+		})
+
 		return nil, fmt.Errorf("lua error: %w", err)
 	}
 
@@ -176,31 +318,27 @@ ret = sandbox.run(code, { quota = ` + strconv.Itoa(LuaQuota) + `, env = injected
 const CUSTOM_ENV_DEF = `
 wallet = {
   id = wallet_id,
-  balance = function () return load_wallet_balance(wallet_id) end,
-  payments = function () return load_wallet_payments(wallet_id) end,
-  get_payment = function (checking_id_or_hash)
-    return get_wallet_payment(wallet_id, checking_id_or_hash)
-  end,
-  auth_key = function (domain) return auth_key(wallet_id, domain) end,
-  pay_invoice = function (params)
-    params.tag = app_id
-    return pay_invoice(wallet_id, params)
-  end,
-  create_invoice = function (params)
-    params.tag = app_id
-    return create_invoice(wallet_id, params)
-  end,
-  transfer = function (to_wallet, msatoshi, description)
-    params.tag = app_id
-    return internal_transfer(wallet_id, to_wallet, msatoshi, description)
-  end,
+  balance = load_wallet_balance,
+  payments = load_wallet_payments,
+  get_payment = get_wallet_payment,
+  auth_key = auth_key,
+  pay_invoice = pay_invoice,
+  create_invoice = create_invoice,
+  transfer = internal_transfer,
 }
 
 app = {
   id = app_id,
   encoded_id = app_encoded_id,
   emit_event = function (name, data)
-    emit_public_event(wallet_id, app_id, name, data)
+    emit_public_event(name, data)
+  end,
+  ws_send = function (data, connection)
+    return websocket_send(data, connection or '')
+  end,
+  ws_connections = websocket_connections,
+  publish = function (name, data)
+    return bus_publish(name, data)
   end,
 }
 
@@ -213,6 +351,10 @@ http = {
   delete = http_delete,
 }
 
+fetch = function (url, options)
+  return app_fetch(url, options or {})
+end
+
 qs = {
   parse = qs_parse,
   encode = qs_encode,
@@ -223,6 +365,13 @@ json = {
   encode = json_encode,
 }
 
+rates = {
+  btc_price = btc_price,
+  to_msats = fiat_to_msats,
+  from_msats = msats_to_fiat,
+  msats_per_unit = get_msats_per_fiat_unit,
+}
+
 lnurl = {
   bech32_encode = lnurl_bech32_encode,
   bech32_decode = lnurl_bech32_decode,
@@ -233,6 +382,8 @@ utils = {
   qs = qs,
   json = json,
   http = http,
+  fetch = fetch,
+  rates = rates,
   sha256 = sha256,
   feed_parse = feed_parse,
   currencies = currencies,
@@ -243,13 +394,21 @@ utils = {
   html_escape = html_escape,
   html_unescape = html_unescape,
   decode_invoice = decode_invoice,
+  nwc_pay_invoice = nwc_pay_invoice,
   snigirev_encrypt = snigirev_encrypt,
   snigirev_decrypt = snigirev_decrypt,
   perform_key_auth_flow = perform_key_auth_flow,
   get_msats_per_fiat_unit = get_msats_per_fiat_unit,
 }
 
-db = setmetatable({}, {
+db = setmetatable({
+  transaction = function (ops)
+    return db_transaction(ops)
+  end,
+  is_conflict = function (err)
+    return err ~= nil and string.find(tostring(err), 'revision conflict', 1, true) ~= nil
+  end,
+}, {
   __index = function (_, model_name)
     return {
       get = function (key)
@@ -257,50 +416,79 @@ db = setmetatable({}, {
           key = 'single'
         end
 
-        return db_get(wallet_id, app_id, model_name, key)
+        return db_get(model_name, key)
+      end,
+      get_item = function (key)
+        if internal.get_model(model_name).single then
+          key = 'single'
+        end
+
+        return db_get_item(model_name, key)
       end,
       set = function (key, value)
         if internal.get_model(model_name).single then
           key = 'single'
         end
 
-        return db_set(wallet_id, app_id, model_name, key, value)
+        return db_set(model_name, key, value)
       end,
       add = function (value)
         if internal.get_model(model_name).single then
           error("can't .add() because " .. model_name .. " is 'single'")
         end
 
-        return db_add(wallet_id, app_id, model_name, value)
+        return db_add(model_name, value)
       end,
       list = function (args)
         if internal.get_model(model_name).single then
           error("can't .list() because " .. model_name .. " is 'single'")
         end
 
-        args = args or {}
-        return db_list(wallet_id, app_id, model_name, args.startkey or "", args.endkey or "")
+        return db_list(model_name, args or {})
       end,
       update = function (key, updates)
         if internal.get_model(model_name).single then
           key = 'single'
         end
 
-        return db_update(wallet_id, app_id, model_name, key, updates)
+        return db_update(model_name, key, updates)
       end,
       delete = function (key)
         if internal.get_model(model_name).single then
           key = 'single'
         end
 
-        return db_delete(wallet_id, app_id, model_name, key)
+        return db_delete(model_name, key)
       end,
     }
   end,
 })
 
+nostr = {
+  pubkey = nostr_pubkey,
+  publish = nostr_publish,
+  query = function (filter, relays) return nostr_query(relays or emptyarray(), filter) end,
+  encrypt = nostr_encrypt,
+  decrypt = nostr_decrypt,
+}
+
+secrets = {
+  get = secret_get,
+  set = secret_set,
+  delete = secret_delete,
+  list = function ()
+    local list, err = secret_list()
+    if err then return nil, err end
+    local names = {}
+    for _, secret in ipairs(list) do
+      table.insert(names, secret.name)
+    end
+    return names
+  end,
+}
+
 print = function (...)
-  debug_print(wallet_id, app_id, ...)
+  debug_print(...)
 end
 
 emptyarray = function ()
@@ -332,6 +520,13 @@ internal = {
     end
     return triggers[trigger_name]
   end,
+  get_nostr_filter = function (name)
+    local filter = nostr_subscriptions[name].filter
+    if type(filter) == 'function' then
+      return filter()
+    end
+    return filter
+  end,
   arg = arg
 }
 `
@@ -359,6 +554,12 @@ func luaPrint(walletID string, app string, args ...interface{}) {
 
 	log.Debug().RawJSON("lua_print", toSSE).Send()
 
+	recordAppLog(walletID, app, AppLogEntry{
+		Time:   prints.Time,
+		Level:  "print",
+		Values: args,
+	})
+
 	if walletID != "" {
 		SendPrintSSE(walletID, toSSE)
 	}
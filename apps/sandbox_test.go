@@ -0,0 +1,260 @@
+package apps
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils/nostr_utils"
+)
+
+const (
+	testWallet   = "wallet1"
+	testApp      = "https://example.com/app.lua"
+	otherWallet  = "wallet2"
+	otherApp     = "https://example.com/other.lua"
+	otherSecret  = "not yours"
+	isolationMsg = "app code reached the data of another app"
+)
+
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	models.MasterKey = make([]byte, 32)
+	if err := storage.Connect(filepath.Join(t.TempDir(), "test.sqlite")); err != nil {
+		t.Fatalf("failed to open the database: %s", err)
+	}
+}
+
+// runSandboxed runs the expression as the code of testApp on testWallet.
+func runSandboxed(t *testing.T, expr string) (interface{}, error) {
+	t.Helper()
+
+	return runlua(RunluaParams{
+		Code:          "title = 'test'",
+		AppURL:        testApp,
+		WalletID:      testWallet,
+		CodeToRun:     expr,
+		SkipMigration: true,
+	})
+}
+
+func TestSecretsAreBoundToTheApp(t *testing.T) {
+	setupTestDB(t)
+
+	if err := SecretSet(otherWallet, otherApp, "token", otherSecret); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expr := range []string{
+		`secret_get('` + otherWallet + `', '` + otherApp + `', 'token')`,
+		`secrets.get('token')`,
+	} {
+		ret, _ := runSandboxed(t, expr)
+		if ret == otherSecret {
+			t.Fatalf("%s: %s", expr, isolationMsg)
+		}
+	}
+
+	if _, err := runSandboxed(t, `secrets.set('token', 'mine')`); err != nil {
+		t.Fatal(err)
+	}
+	ret, err := runSandboxed(t, `secrets.get('token')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret != "mine" {
+		t.Fatalf("expected the secret of the app, got %v", ret)
+	}
+
+	value, _ := SecretGet(otherWallet, otherApp, "token")
+	if value != otherSecret {
+		t.Fatalf("the secret of the other app was changed to %v", value)
+	}
+}
+
+func TestNostrKeyIsBoundToTheApp(t *testing.T) {
+	setupTestDB(t)
+
+	own, _ := nostr_utils.AppPublicKey(testApp, testWallet)
+	other, _ := nostr_utils.AppPublicKey(otherApp, otherWallet)
+
+	ret, err := runSandboxed(t, `nostr.pubkey()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret != own {
+		t.Fatalf("expected the key of the app, got %v", ret)
+	}
+
+	ret, _ = runSandboxed(t, `nostr_pubkey('`+otherApp+`', '`+otherWallet+`')`)
+	if ret == other {
+		t.Fatal(isolationMsg)
+	}
+
+	// a message the other app sent to someone else can only be read with its key
+	someone, _ := nostr_utils.AppPublicKey(testApp, otherWallet)
+	ciphertext, err := nostrEncrypt(otherApp, otherWallet, someone, otherSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, _ = runSandboxed(t, `nostr_decrypt('`+otherApp+`', '`+otherWallet+`', '`+someone+`', '`+ciphertext+`')`)
+	if ret == otherSecret {
+		t.Fatal(isolationMsg)
+	}
+}
+
+// createTestUser makes a user with a wallet and the given apps installed.
+func createTestUser(t *testing.T, userID, walletID string, apps ...string) {
+	t.Helper()
+
+	user := models.User{ID: userID, MasterKey: models.EncryptedString(userID)}
+	user.MasterKeyHash = models.LookupHash(string(user.MasterKey))
+	if err := storage.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	wallet := models.Wallet{
+		ID:         walletID,
+		Name:       walletID,
+		UserID:     userID,
+		InvoiceKey: models.EncryptedString("invoice" + walletID),
+		AdminKey:   models.EncryptedString("admin" + walletID),
+	}
+	wallet.InvoiceKeyHash = models.LookupHash(string(wallet.InvoiceKey))
+	wallet.AdminKeyHash = models.LookupHash(string(wallet.AdminKey))
+	if err := storage.DB.Create(&wallet).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, app := range apps {
+		if err := storage.DB.Create(&models.UserApp{UserID: userID, URL: app}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// devApp writes the code to a file:// app that can be loaded in dev mode.
+func devApp(t *testing.T, name, code string) string {
+	t.Helper()
+
+	DevMode = true
+	DevDir = t.TempDir()
+	t.Cleanup(func() { DevMode = false; DevDir = "" })
+
+	path := filepath.Join(DevDir, name)
+	if err := os.WriteFile(path, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return "file://" + path
+}
+
+func TestBusEventsComeFromTheApp(t *testing.T) {
+	setupTestDB(t)
+
+	// records the events it gets as secrets named after them
+	subscriber := devApp(t, "subscriber.lua", `
+title = 'subscriber'
+subscriptions = {
+  ping = function (event)
+    secrets.set(event.data.tag, event.wallet .. ' ' .. event.app)
+  end,
+}
+`)
+	createTestUser(t, "user2", otherWallet, otherApp, subscriber)
+
+	if _, err := runSandboxed(t, `bus_publish('`+otherWallet+`', '`+otherApp+`', 'ping', { tag = 'forged' })`); err != nil {
+		t.Logf("forged publish failed: %s", err)
+	}
+	if _, err := runlua(RunluaParams{
+		Code:          "title = 'other'",
+		AppURL:        otherApp,
+		WalletID:      otherWallet,
+		CodeToRun:     `app.publish('ping', { tag = 'real' })`,
+		SkipMigration: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		from, _ := SecretGet(otherWallet, subscriber, "real")
+		if from == otherWallet+" "+otherApp {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the event of the other app wasn't delivered, got %v", from)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if from, _ := SecretGet(otherWallet, subscriber, "forged"); from != nil {
+		t.Fatalf("%s: a forged event came from %v", isolationMsg, from)
+	}
+}
+
+func TestDataIsBoundToTheApp(t *testing.T) {
+	setupTestDB(t)
+
+	item := models.AppDataItem{
+		WalletID: otherWallet,
+		App:      otherApp,
+		Model:    "notes",
+		Key:      "k",
+		Value:    models.JSONObject{"text": otherSecret},
+	}
+	if err := storage.Default.SetAppItem(&item); err != nil {
+		t.Fatal(err)
+	}
+
+	other := `'` + otherWallet + `', '` + otherApp + `', `
+	for _, expr := range []string{
+		`db_get(` + other + `'notes', 'k').text`,
+		`db_get_item(` + other + `'notes', 'k').value.text`,
+		`db_list(` + other + `'notes', {})[1].value.text`,
+	} {
+		ret, _ := runSandboxed(t, expr)
+		if ret == otherSecret {
+			t.Fatalf("%s: %s", expr, isolationMsg)
+		}
+	}
+
+	for _, expr := range []string{
+		`db_set(` + other + `'notes', 'k', { text = 'changed' })`,
+		`db_update(` + other + `'notes', 'k', { text = 'changed' })`,
+		`db_delete(` + other + `'notes', 'k')`,
+		`db_transaction(` + other + `{{ op = 'delete', model = 'notes', key = 'k' }})`,
+	} {
+		runSandboxed(t, expr)
+
+		current, err := storage.Default.GetAppItem(otherWallet, otherApp, "notes", "k")
+		if err != nil || current.Value["text"] != otherSecret {
+			t.Fatalf("%s: %s", expr, isolationMsg)
+		}
+	}
+}
+
+func TestWebSocketsAreBoundToTheApp(t *testing.T) {
+	setupTestDB(t)
+
+	sc := &socketConn{id: "other", send: make(chan []byte, 1)}
+	hub := joinSocketHub(otherWallet, otherApp, sc)
+	defer hub.leave(otherWallet, otherApp, sc.id)
+
+	runSandboxed(t, `websocket_send('`+otherWallet+`', '`+otherApp+`', 'hello', '')`)
+	runSandboxed(t, `websocket_send('`+otherWallet+`', '`+otherApp+`')`)
+	select {
+	case message := <-sc.send:
+		t.Fatalf("%s: sent %s", isolationMsg, message)
+	default:
+	}
+
+	ret, _ := runSandboxed(t, `websocket_connections('`+otherWallet+`', '`+otherApp+`')[1]`)
+	if ret == sc.id {
+		t.Fatal(isolationMsg)
+	}
+}
@@ -0,0 +1,263 @@
+package apps
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+const (
+	searchMinTermLength = 2
+	searchMaxTermLength = 64
+	searchDefaultLimit  = 50
+)
+
+// indexedAppWallets tracks which wallet:app combinations have had their items
+// checked against the search index since startup.
+var indexedAppWallets = sync.Map{}
+
+// itemTerms extracts the lowercased words from all string and number values
+// of an item, including the ones nested inside lists and objects.
+func itemTerms(value interface{}) []string {
+	set := make(map[string]struct{})
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch val := v.(type) {
+		case string:
+			for _, term := range splitTerms(val) {
+				set[term] = struct{}{}
+			}
+		case float64:
+			set[strconv.FormatFloat(val, 'f', -1, 64)] = struct{}{}
+		case int:
+			set[strconv.Itoa(val)] = struct{}{}
+		case int64:
+			set[strconv.FormatInt(val, 10)] = struct{}{}
+		case []interface{}:
+			for _, e := range val {
+				walk(e)
+			}
+		case map[string]interface{}:
+			for _, e := range val {
+				walk(e)
+			}
+		case models.JSONObject:
+			for _, e := range val {
+				walk(e)
+			}
+		}
+	}
+	walk(value)
+
+	terms := make([]string, 0, len(set))
+	for term := range set {
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+func splitTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		if len(word) < searchMinTermLength {
+			continue
+		}
+		if len(word) > searchMaxTermLength {
+			word = word[0:searchMaxTermLength]
+		}
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+// indexItem replaces the search terms stored for an item.
+// an item with an empty .Value just gets its terms removed.
+func indexItem(db *gorm.DB, item models.AppDataItem) error {
+	if err := db.Scopes(storage.AppItemTerms(item.WalletID)).Where(&models.AppItemTerm{
+		App:      item.App,
+		WalletID: item.WalletID,
+		Model:    item.Model,
+		Key:      item.Key,
+	}).Delete(&models.AppItemTerm{}).Error; err != nil {
+		return err
+	}
+
+	terms := itemTerms(item.Value)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	rows := make([]models.AppItemTerm, len(terms))
+	for i, term := range terms {
+		rows[i] = models.AppItemTerm{
+			App:      item.App,
+			WalletID: item.WalletID,
+			Model:    item.Model,
+			Key:      item.Key,
+			Term:     term,
+		}
+	}
+	return db.Scopes(storage.AppItemTerms(item.WalletID)).CreateInBatches(rows, 100).Error
+}
+
+// ensureIndexed rebuilds the search index for a wallet:app if it doesn't cover
+// all the items, which happens for data stored before search existed.
+func ensureIndexed(walletID, app string) error {
+	cacheKey := walletID + ":" + app
+	if _, ok := indexedAppWallets.Load(cacheKey); ok {
+		return nil
+	}
+
+	var nitems int64
+	if err := storage.DB.Scopes(storage.AppItems(walletID)).Model(&models.AppDataItem{}).
+		Where(&models.AppDataItem{App: app, WalletID: walletID}).
+		Count(&nitems).Error; err != nil {
+		return err
+	}
+
+	var nindexed int64
+	indexed := storage.DB.Scopes(storage.AppItemTerms(walletID)).Model(&models.AppItemTerm{}).
+		Select("model", "key").
+		Where(&models.AppItemTerm{App: app, WalletID: walletID}).
+		Group("model").Group("key")
+	if err := storage.DB.Table("(?) AS indexed", indexed).
+		Count(&nindexed).Error; err != nil {
+		return err
+	}
+
+	if nindexed < nitems {
+		var items []models.AppDataItem
+		if err := storage.DB.Scopes(storage.AppItems(walletID)).
+			Where(&models.AppDataItem{App: app, WalletID: walletID}).
+			Find(&items).Error; err != nil {
+			return err
+		}
+
+		if err := storage.DB.Transaction(func(tx *gorm.DB) error {
+			for _, item := range items {
+				if err := indexItem(tx, item); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		log.Debug().Str("app", app).Str("wallet", walletID).Int("items", len(items)).
+			Msg("rebuilt search index")
+	}
+
+	indexedAppWallets.Store(cacheKey, true)
+	return nil
+}
+
+type SearchResult struct {
+	Model string                 `json:"model"`
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func Search(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	app := appIDToURL(mux.Vars(r)["appid"])
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	terms := splitTerms(qs.Get("q"))
+	if len(terms) == 0 {
+		apiutils.SendJSONError(w, 400, "query must contain at least one word with %d or more characters",
+			searchMinTermLength)
+		return
+	}
+
+	limit := searchDefaultLimit
+	if l, err := strconv.Atoi(qs.Get("limit")); err == nil && l > 0 && l < limit {
+		limit = l
+	}
+
+	if err := ensureIndexed(wallet.ID, app); err != nil {
+		apiutils.SendJSONError(w, 500, "failed to build search index: %s", err.Error())
+		return
+	}
+
+	// every word in the query must be a prefix of some term in the item
+	var matches map[[2]string]int
+	for _, term := range terms {
+		q := storage.DB.Scopes(storage.AppItemTerms(wallet.ID)).Model(&models.AppItemTerm{}).
+			Where(&models.AppItemTerm{App: app, WalletID: wallet.ID}).
+			Where("term LIKE ?", strings.ReplaceAll(term, "%", "")+"%")
+		if model := qs.Get("model"); model != "" {
+			q = q.Where("model = ?", model)
+		}
+
+		var rows []models.AppItemTerm
+		if err := q.Select("model", "key", "term").Find(&rows).Error; err != nil {
+			apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+			return
+		}
+
+		found := make(map[[2]string]int)
+		for _, row := range rows {
+			k := [2]string{row.Model, row.Key}
+			if matches != nil {
+				if _, ok := matches[k]; !ok {
+					continue
+				}
+			}
+			// exact term matches rank above prefix matches
+			score := 1
+			if row.Term == term {
+				score = 2
+			}
+			if score > found[k] {
+				found[k] = score
+			}
+		}
+		for k := range found {
+			found[k] += matches[k]
+		}
+		matches = found
+	}
+
+	keys := make([][2]string, 0, len(matches))
+	for k := range matches {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if matches[keys[i]] != matches[keys[j]] {
+			return matches[keys[i]] > matches[keys[j]]
+		}
+		return keys[i][1] > keys[j][1]
+	})
+	if len(keys) > limit {
+		keys = keys[0:limit]
+	}
+
+	results := make([]SearchResult, 0, len(keys))
+	for _, k := range keys {
+		value, err := DBGet(wallet.ID, app, k[0], k[1])
+		if err != nil {
+			zerolog.Ctx(r.Context()).Debug().Err(err).
+				Str("app", app).Str("model", k[0]).Str("key", k[1]).
+				Msg("failed to get search result")
+			continue
+		}
+		results = append(results, SearchResult{Model: k[0], Key: k[1], Value: value})
+	}
+
+	apiutils.SendJSON(w, results)
+}
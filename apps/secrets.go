@@ -0,0 +1,167 @@
+package apps
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	"gorm.io/gorm/clause"
+)
+
+// secrets are stored separately from app data, encrypted with the master key.
+// apps can read them, but the API only ever lists their names.
+
+// secrets written before the master key existed were encrypted with a key
+// derived from the server secret.
+const legacySecretsPrefix = "v1:"
+
+func decryptLegacySecret(secret models.AppSecret) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret.Value, legacySecretsPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	key := sha256.Sum256([]byte(services.Secret + ":app-secrets"))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("secret is too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, secret.AdditionalData())
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+
+	return string(plaintext), nil
+}
+
+func decryptSecret(secret models.AppSecret) (string, error) {
+	if strings.HasPrefix(secret.Value, legacySecretsPrefix) {
+		return decryptLegacySecret(secret)
+	}
+	if !models.IsEncrypted(secret.Value) {
+		return "", errors.New("unknown secret format")
+	}
+	return models.Decrypt(secret.Value, secret.AdditionalData())
+}
+
+func SecretGet(wallet, app, name string) (interface{}, error) {
+	if name == "" {
+		return nil, errors.New("name cannot be empty")
+	}
+
+	var secret models.AppSecret
+	result := storage.DB.
+		Where(&models.AppSecret{WalletID: wallet, App: app, Name: name}).
+		Limit(1).Find(&secret)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	value, err := decryptSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func SecretSet(wallet, app, name, value string) error {
+	if name == "" {
+		return errors.New("name cannot be empty")
+	}
+
+	secret := models.AppSecret{WalletID: wallet, App: app, Name: name}
+	encrypted, err := models.Encrypt(value, secret.AdditionalData())
+	if err != nil {
+		return fmt.Errorf("failed to encrypt secret: %w", err)
+	}
+	secret.Value = encrypted
+
+	return storage.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{
+			{Name: "app"}, {Name: "wallet_id"}, {Name: "name"},
+		},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).Create(&secret).Error
+}
+
+func SecretDelete(wallet, app, name string) error {
+	return storage.DB.
+		Where(&models.AppSecret{WalletID: wallet, App: app, Name: name}).
+		Delete(&models.AppSecret{}).Error
+}
+
+func SecretList(wallet, app string) ([]models.AppSecret, error) {
+	var secrets []models.AppSecret
+	result := storage.DB.
+		Select("name", "created_at", "updated_at").
+		Where(&models.AppSecret{WalletID: wallet, App: app}).
+		Order("name").
+		Find(&secrets)
+	return secrets, result.Error
+}
+
+func ListSecrets(w http.ResponseWriter, r *http.Request) {
+	app := appIDToURL(mux.Vars(r)["appid"])
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	secrets, err := SecretList(wallet.ID, app)
+	if err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	apiutils.SendJSON(w, secrets)
+}
+
+func SetSecret(w http.ResponseWriter, r *http.Request) {
+	app := appIDToURL(mux.Vars(r)["appid"])
+	name := mux.Vars(r)["name"]
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	var params struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		apiutils.SendJSONError(w, 400, "got invalid JSON: %s", err.Error())
+		return
+	}
+
+	if err := SecretSet(wallet.ID, app, name, params.Value); err != nil {
+		apiutils.SendJSONError(w, 500, "failed to set secret: %s", err.Error())
+		return
+	}
+}
+
+func DeleteSecret(w http.ResponseWriter, r *http.Request) {
+	app := appIDToURL(mux.Vars(r)["appid"])
+	name := mux.Vars(r)["name"]
+	wallet := r.Context().Value("wallet").(*models.Wallet)
+
+	if err := SecretDelete(wallet.ID, app, name); err != nil {
+		apiutils.SendJSONError(w, 500, "failed to delete secret: %s", err.Error())
+		return
+	}
+}
@@ -0,0 +1,189 @@
+package apps
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"golang.org/x/crypto/openpgp"
+)
+
+// app code can be signed with a nostr key by putting {"pubkey": ..., "sig": ...}
+// (a schnorr signature of the sha256 of the code) at <app url>.sig, or with a PGP
+// key by putting an armored detached signature at <app url>.asc and the armored
+// public key at <app url>.pub.asc. apps installed from nostr are signed by the
+// event author. the signer seen on install is pinned and users are warned when
+// it changes. code that is loaded must be signed by the signers pinned by all the
+// users that have the app, otherwise the last code that was is kept running.
+
+var ErrSignerChanged = errors.New("app signer changed")
+
+// trustedCodes has the last code of each app that passed trustAppCode.
+var trustedCodes = sync.Map{}
+
+type nostrCodeSignature struct {
+	PubKey string `json:"pubkey"`
+	Sig    string `json:"sig"`
+}
+
+// VerifyAppSignature returns the signer of the given code as "nostr:<pubkey>" or
+// "pgp:<fingerprint>", or an empty string if the app isn't signed. it fails if
+// there is a signature and it is not valid.
+func VerifyAppSignature(appURL string, code string) (string, error) {
+	if strings.HasPrefix(appURL, builtinScheme+":") || strings.HasPrefix(appURL, "file://") {
+		return "", nil
+	}
+
+	if isNostrApp(appURL) {
+		manifest, err := getNostrManifest(appURL)
+		if err != nil {
+			return "", err
+		}
+		return "nostr:" + manifest.Author, nil
+	}
+
+	base, err := url.Parse(appURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid app url: %w", err)
+	}
+	sibling := func(suffix string) ([]byte, error) {
+		u := *base
+		u.Path += suffix
+		return readAppFile(&u)
+	}
+
+	if raw, err := sibling(".sig"); err == nil {
+		var sig nostrCodeSignature
+		if err := json.Unmarshal(raw, &sig); err != nil {
+			return "", fmt.Errorf("invalid .sig file: %w", err)
+		}
+		if err := verifyNostrCodeSignature(sig, code); err != nil {
+			return "", err
+		}
+		return "nostr:" + strings.ToLower(sig.PubKey), nil
+	}
+
+	if armoredSig, err := sibling(".asc"); err == nil {
+		armoredKey, err := sibling(".pub.asc")
+		if err != nil {
+			return "", fmt.Errorf("app has a PGP signature but no public key at .pub.asc: %w", err)
+		}
+		keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armoredKey))
+		if err != nil {
+			return "", fmt.Errorf("invalid PGP public key: %w", err)
+		}
+		signer, err := openpgp.CheckArmoredDetachedSignature(
+			keyring, strings.NewReader(code), bytes.NewReader(armoredSig))
+		if err != nil {
+			return "", fmt.Errorf("invalid PGP signature: %w", err)
+		}
+		return fmt.Sprintf("pgp:%X", signer.PrimaryKey.Fingerprint), nil
+	}
+
+	return "", nil
+}
+
+func verifyNostrCodeSignature(sig nostrCodeSignature, code string) error {
+	pubkeyBytes, err := hex.DecodeString(sig.PubKey)
+	if err != nil {
+		return fmt.Errorf("invalid pubkey hex: %w", err)
+	}
+	pubkey, err := schnorr.ParsePubKey(pubkeyBytes)
+	if err != nil {
+		return fmt.Errorf("invalid pubkey: %w", err)
+	}
+
+	sigBytes, err := hex.DecodeString(sig.Sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature hex: %w", err)
+	}
+	signature, err := schnorr.ParseSignature(sigBytes)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	hash := sha256.Sum256([]byte(code))
+	if !signature.Verify(hash[:], pubkey) {
+		return errors.New("signature doesn't match the app code")
+	}
+
+	return nil
+}
+
+// checkAppSigner compares the signer with the one pinned when the user installed
+// the app. if it changed it fails with ErrSignerChanged unless accept is true, in
+// which case the new signer is pinned.
+func checkAppSigner(userID, appURL, signer string, accept bool) error {
+	var userApp models.UserApp
+	result := storage.DB.
+		Where("user_id = ? AND url = ?", userID, appURL).
+		Limit(1).Find(&userApp)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 || userApp.Signer == signer {
+		return nil
+	}
+
+	if userApp.Signer != "" && !accept {
+		if signer == "" {
+			return fmt.Errorf("%w: it was signed by %s and now it isn't signed",
+				ErrSignerChanged, userApp.Signer)
+		}
+		return fmt.Errorf("%w: it was signed by %s and now it is signed by %s",
+			ErrSignerChanged, userApp.Signer, signer)
+	}
+
+	return storage.DB.Model(&models.UserApp{}).
+		Where("user_id = ? AND url = ?", userID, appURL).
+		Update("signer", signer).Error
+}
+
+// trustAppCode checks the signature of code fetched for an app and that it is
+// signed by whoever the users that have the app have pinned. an app nobody has
+// is trusted on first use.
+func trustAppCode(appURL string, code string) error {
+	signer, err := VerifyAppSignature(appURL, code)
+	if err != nil {
+		return fmt.Errorf("invalid app signature: %w", err)
+	}
+
+	var pinned []string
+	if err := storage.DB.Model(&models.UserApp{}).
+		Where("url = ? AND signer != ''", appURL).
+		Distinct("signer").Pluck("signer", &pinned).Error; err != nil {
+		return fmt.Errorf("failed to load app signers: %w", err)
+	}
+	for _, pin := range pinned {
+		if pin != signer {
+			if signer == "" {
+				return fmt.Errorf("%w: it was signed by %s and now it isn't signed",
+					ErrSignerChanged, pin)
+			}
+			return fmt.Errorf("%w: it was signed by %s and now it is signed by %s",
+				ErrSignerChanged, pin, signer)
+		}
+	}
+
+	trustedCodes.Store(appURL, code)
+	return nil
+}
+
+// trustedCode is the code to run for an app after new code failed
+// trustAppCode, the last trusted one if there is any.
+func trustedCode(appURL string, err error) (string, error) {
+	if code, ok := trustedCodes.Load(appURL); ok {
+		log.Warn().Err(err).Str("app", appURL).Msg("keeping the last trusted version of the app")
+		return code.(string), nil
+	}
+	return "", err
+}
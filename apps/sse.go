@@ -1,9 +1,12 @@
 package apps
 
 import (
+	"encoding/json"
 	"net/http"
 	"time"
 
+	"github.com/lnbits/infinity/chaos"
+	"github.com/lnbits/infinity/cluster"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/utils"
 	"gopkg.in/antage/eventsource.v1"
@@ -16,7 +19,7 @@ func SSE(w http.ResponseWriter, r *http.Request) {
 	ies, ok := appStreams.Load(wallet.ID)
 
 	if !ok {
-		es = eventsource.New(
+		es = utils.ClosableStream(eventsource.New(
 			&eventsource.Settings{
 				Timeout:        5 * time.Second,
 				CloseOnTimeout: true,
@@ -31,7 +34,7 @@ func SSE(w http.ResponseWriter, r *http.Request) {
 					[]byte("Access-Control-Allow-Origin: *"),
 				}
 			},
-		)
+		))
 		go func() {
 			for {
 				time.Sleep(25 * time.Second)
@@ -52,17 +55,60 @@ func SSE(w http.ResponseWriter, r *http.Request) {
 	es.ServeHTTP(w, r)
 }
 
+// streamEvent is what goes to the app streams, on all the instances of a
+// cluster. App is only set for the public streams.
+type streamEvent struct {
+	Wallet  string `json:"wallet"`
+	App     string `json:"app,omitempty"`
+	Type    string `json:"type"`
+	Payload string `json:"payload"`
+}
+
+func init() {
+	cluster.Subscribe("app_sse", func(data json.RawMessage) {
+		var event streamEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return
+		}
+		if chaos.DropEvent() {
+			return
+		}
+
+		key, streams := event.Wallet, &appStreams
+		if event.App != "" {
+			key, streams = event.Wallet+":"+event.App, &publicAppStreams
+		}
+		if ies, ok := streams.Load(key); ok {
+			ies.(eventsource.EventSource).SendEventMessage(event.Payload, event.Type, "")
+		}
+	})
+}
+
 func SendItemSSE(item models.AppDataItem) {
 	jpayload, _ := utils.JSONMarshal(item)
-	payload := string(jpayload)
-
-	if ies, ok := appStreams.Load(item.WalletID); ok {
-		ies.(eventsource.EventSource).SendEventMessage(payload, "item", "")
-	}
+	cluster.Publish("app_sse", streamEvent{item.WalletID, "", "item", string(jpayload)})
 }
 
 func SendPrintSSE(walletID string, prints []byte) {
-	if ies, ok := appStreams.Load(walletID); ok {
-		ies.(eventsource.EventSource).SendEventMessage(string(prints[:]), "print", "")
+	cluster.Publish("app_sse", streamEvent{walletID, "", "print", string(prints)})
+}
+
+func SendLogSSE(walletID string, entry []byte) {
+	cluster.Publish("app_sse", streamEvent{walletID, "", "log", string(entry)})
+}
+
+// SSEConnections counts the clients connected to the app streams, the internal
+// ones if public is false.
+func SSEConnections(public bool) int {
+	streams := &appStreams
+	if public {
+		streams = &publicAppStreams
 	}
+
+	count := 0
+	streams.Range(func(_, ies interface{}) bool {
+		count += ies.(eventsource.EventSource).ConsumersCount()
+		return true
+	})
+	return count
 }
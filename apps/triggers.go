@@ -14,16 +14,9 @@ type AppWallet struct {
 
 func TriggerPaymentEvent(trigger string, payment models.Payment) {
 	// get all apps/wallets from from the user that owns this payment's wallet
-	var appWalletCombinations []AppWallet
-	result := storage.DB.Raw(`
-      SELECT wallets.id AS wallet_id, url
-      FROM user_apps
-      LEFT OUTER JOIN users ON user_apps.user_id = users.id
-      LEFT OUTER JOIN wallets ON wallets.user_id = users.id
-      WHERE users.id = (SELECT user_id FROM wallets WHERE id = ?)
-    `, payment.WalletID).Scan(&appWalletCombinations)
-	if result.Error != nil {
-		log.Error().Err(result.Error).Msg("failed to load apps for payment user")
+	appWalletCombinations, err := getUserAppWallets(payment.WalletID)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load apps for payment user")
 		return
 	}
 
@@ -54,6 +47,19 @@ func TriggerPaymentEvent(trigger string, payment models.Payment) {
 	}
 }
 
+// getUserAppWallets returns all apps/wallets from the user that owns the given wallet
+func getUserAppWallets(walletID string) ([]AppWallet, error) {
+	var appWalletCombinations []AppWallet
+	result := storage.DB.Raw(`
+      SELECT wallets.id AS wallet_id, url
+      FROM user_apps
+      LEFT OUTER JOIN users ON user_apps.user_id = users.id
+      LEFT OUTER JOIN wallets ON wallets.user_id = users.id AND wallets.deleted_at IS NULL
+      WHERE users.id = (SELECT user_id FROM wallets WHERE id = ?)
+    `, walletID).Scan(&appWalletCombinations)
+	return appWalletCombinations, result.Error
+}
+
 func TriggerGlobalEvent(trigger string, data interface{}) {
 	// get all apps/wallets from from all users
 	var appWalletCombinations []AppWallet
@@ -61,7 +67,7 @@ func TriggerGlobalEvent(trigger string, data interface{}) {
       SELECT wallets.id AS wallet_id, url
       FROM user_apps
       LEFT OUTER JOIN users ON user_apps.user_id = users.id
-      LEFT OUTER JOIN wallets ON wallets.user_id = users.id
+      LEFT OUTER JOIN wallets ON wallets.user_id = users.id AND wallets.deleted_at IS NULL
     `).Scan(&appWalletCombinations)
 	if result.Error != nil {
 		log.Error().Err(result.Error).Msg("failed to load apps for all users")
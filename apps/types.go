@@ -11,14 +11,24 @@ import (
 )
 
 type Settings struct {
-	URL         string                           `json:"url"`
-	Title       string                           `json:"title"`
-	Description string                           `json:"description,omitempty"`
-	Code        string                           `json:"code"`
-	Models      []Model                          `json:"models"`
-	Triggers    map[string]*lunatico.LuaFunction `json:"triggers"`
-	Actions     map[string]Action                `json:"actions"`
-	Files       map[string]string                `json:"files"`
+	URL                   string                           `json:"url"`
+	Title                 string                           `json:"title"`
+	Description           string                           `json:"description,omitempty"`
+	Icon                  string                           `json:"icon,omitempty"`
+	Code                  string                           `json:"code"`
+	Models                []Model                          `json:"models"`
+	Triggers              map[string]*lunatico.LuaFunction `json:"triggers"`
+	Actions               map[string]Action                `json:"actions"`
+	Routes                []Route                          `json:"routes"`
+	LNURLEndpoints        map[string]LNURLEndpoint         `json:"lnurl_endpoints,omitempty"`
+	NostrSubscriptions    map[string]NostrSubscription     `json:"nostr_subscriptions,omitempty"`
+	Subscriptions         map[string]*lunatico.LuaFunction `json:"subscriptions"`
+	Files                 map[string]string                `json:"files"`
+	FetchDomains          []string                         `json:"fetch_domains,omitempty"`
+	FrameAncestors        []string                         `json:"frame_ancestors,omitempty"`
+	ContentSecurityPolicy string                           `json:"content_security_policy,omitempty"`
+	SchemaVersion         int                              `json:"schema_version,omitempty"`
+	Migrate               *lunatico.LuaFunction            `json:"migrate,omitempty"`
 }
 
 func (s *Settings) normalize() {
@@ -128,6 +138,52 @@ func (s Settings) validate() error {
 
 	}
 
+	for name, endpoint := range s.LNURLEndpoints {
+		if !nameValidator.MatchString(name) {
+			return fmt.Errorf("lnurl endpoint name '%s' is invalid", name)
+		}
+		if err := endpoint.validate(); err != nil {
+			return fmt.Errorf("lnurl endpoint %s validation error: %w", name, err)
+		}
+	}
+
+	for name, sub := range s.NostrSubscriptions {
+		if !nameValidator.MatchString(name) {
+			return fmt.Errorf("nostr subscription name '%s' is invalid", name)
+		}
+		if sub.Handler == nil {
+			return fmt.Errorf("nostr subscription %s must have a handler function", name)
+		}
+	}
+
+	for _, domain := range s.FetchDomains {
+		if domain == "" || strings.Contains(domain, "/") {
+			return fmt.Errorf("fetch_domains entry '%s' is invalid", domain)
+		}
+	}
+
+	if s.SchemaVersion < 0 {
+		return fmt.Errorf("schema_version can't be negative")
+	}
+
+	for name := range s.Subscriptions {
+		if !busEventNameValidator.MatchString(name) {
+			return fmt.Errorf("subscription to invalid event name '%s'", name)
+		}
+	}
+
+	for r, route := range s.Routes {
+		if err := route.validate(); err != nil {
+			return fmt.Errorf("routes[%d] validation error: %w", r, err)
+		}
+
+		for _, previous := range s.Routes[0:r] {
+			if previous.Method == route.Method && previous.Path == route.Path {
+				return fmt.Errorf("route %s %s declared twice", route.Method, route.Path)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -149,6 +205,12 @@ type Model struct {
 }
 
 func (m Model) validateItem(item models.AppDataItem) error {
+	return m.validateItemWith(item, nil)
+}
+
+// validateItemWith also accepts refs to the items in written, as "model:key",
+// which are being saved together with this one and aren't stored yet.
+func (m Model) validateItemWith(item models.AppDataItem, written map[string]bool) error {
 	if len(m.Fields) == 0 {
 		return fmt.Errorf("unknown model")
 	}
@@ -176,7 +238,7 @@ func (m Model) validateItem(item models.AppDataItem) error {
 			if field.Name == fieldName {
 				fieldExpected = true
 				if err := field.validateValue(fieldValue,
-					item.WalletID, item.App); err != nil {
+					item.WalletID, item.App, written); err != nil {
 					return err
 				}
 
@@ -228,7 +290,7 @@ func (action Action) validateParams(
 
 			if field.Name == fieldName {
 				fieldExpected = true
-				if err := field.validateValue(fieldValue, walletID, app); err != nil {
+				if err := field.validateValue(fieldValue, walletID, app, nil); err != nil {
 					return err
 				}
 
@@ -252,6 +314,73 @@ func (action Action) validateParams(
 	return nil
 }
 
+type Route struct {
+	Method  string                `json:"method"`
+	Path    string                `json:"path"`
+	Handler *lunatico.LuaFunction `json:"handler"`
+}
+
+var validMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+func (route Route) validate() error {
+	methodIsValid := false
+	for _, validMethod := range validMethods {
+		if validMethod == route.Method {
+			methodIsValid = true
+			break
+		}
+	}
+	if methodIsValid == false {
+		return fmt.Errorf("method cannot be '%s', must be one of %v",
+			route.Method, validMethods)
+	}
+
+	if !strings.HasPrefix(route.Path, "/") {
+		return fmt.Errorf("path '%s' must start with a '/'", route.Path)
+	}
+
+	for _, segment := range strings.Split(route.Path[1:], "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if !nameValidator.MatchString(segment[1 : len(segment)-1]) {
+				return fmt.Errorf("path parameter '%s' is invalid", segment)
+			}
+		} else if !routeSegmentValidator.MatchString(segment) {
+			return fmt.Errorf("path segment '%s' is invalid", segment)
+		}
+	}
+
+	if route.Handler == nil {
+		return fmt.Errorf("route %s %s must have a handler function",
+			route.Method, route.Path)
+	}
+
+	return nil
+}
+
+// match checks if the given path matches this route's path pattern and
+// returns the values of the path parameters if it does.
+func (route Route) match(path string) (map[string]string, bool) {
+	expected := strings.Split(strings.Trim(route.Path, "/"), "/")
+	actual := strings.Split(strings.Trim(path, "/"), "/")
+	if len(expected) != len(actual) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, segment := range expected {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if actual[i] == "" {
+				return nil, false
+			}
+			params[segment[1:len(segment)-1]] = actual[i]
+		} else if segment != actual[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
 type Field struct {
 	Name     string                `json:"name"`
 	Display  string                `json:"display,omitempty"`
@@ -346,7 +475,7 @@ func (field Field) validate(models []Model) error {
 	return nil
 }
 
-func (field Field) validateValue(value interface{}, walletID, app string) error {
+func (field Field) validateValue(value interface{}, walletID, app string, written map[string]bool) error {
 	valueType := reflect.TypeOf(value)
 	if valueType == nil {
 		return fmt.Errorf("%s=%v has unexpected type %v",
@@ -431,7 +560,7 @@ func (field Field) validateValue(value interface{}, walletID, app string) error
 		if walletID == "" || app == "" {
 			return fmt.Errorf("%s=%v is a ref but we don't accept refs here",
 				field.Name, value)
-		} else {
+		} else if !written[field.Ref+":"+value.(string)] {
 			ref, err := DBGet(
 				walletID, app, field.Ref, value.(string))
 			if err != nil || ref == nil {
@@ -0,0 +1,351 @@
+package apps
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/cluster"
+	"github.com/lnbits/infinity/utils"
+	"github.com/lucsky/cuid"
+	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 25 * time.Second
+	wsMaxMessage = 64 * 1024
+
+	// messages from a client wait here to be handled by the app one at a time
+	wsQueueSize = 16
+)
+
+// limits on the websockets of apps, 0 means no limit. the messages of each
+// client are limited with a token bucket that holds a minute of them.
+var (
+	WebSocketsPerWallet        = 200
+	WebSocketsPerIP            = 20
+	WebSocketMessagesPerMinute = 120
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// appSockets holds one *socketHub for each wallet:app combination, while it
+// has clients.
+var appSockets = sync.Map{}
+
+type socketHub struct {
+	sync.Mutex
+	conns   map[string]*socketConn
+	removed bool
+}
+
+// wsClients counts the open websockets of each wallet and client IP.
+var wsClients = struct {
+	sync.Mutex
+	wallets map[string]int
+	ips     map[string]int
+}{wallets: make(map[string]int), ips: make(map[string]int)}
+
+type socketConn struct {
+	id   string
+	conn *websocket.Conn
+	send chan []byte
+}
+
+type WebSocketMessage struct {
+	Connection string      `json:"connection"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// joinSocketHub adds the client to the hub of this wallet and app, creating it
+// if there is none or if the one found was just removed.
+func joinSocketHub(walletID, app string, sc *socketConn) *socketHub {
+	for {
+		ihub, _ := appSockets.LoadOrStore(walletID+":"+app, &socketHub{
+			conns: make(map[string]*socketConn),
+		})
+		hub := ihub.(*socketHub)
+
+		hub.Lock()
+		if !hub.removed {
+			hub.conns[sc.id] = sc
+			hub.Unlock()
+			return hub
+		}
+		hub.Unlock()
+	}
+}
+
+// leave removes the client and the hub itself once it is empty.
+func (hub *socketHub) leave(walletID, app, id string) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	delete(hub.conns, id)
+	if len(hub.conns) == 0 {
+		hub.removed = true
+		appSockets.Delete(walletID + ":" + app)
+	}
+}
+
+func acquireWebSocket(walletID, ip string) bool {
+	wsClients.Lock()
+	defer wsClients.Unlock()
+
+	if (WebSocketsPerWallet > 0 && wsClients.wallets[walletID] >= WebSocketsPerWallet) ||
+		(WebSocketsPerIP > 0 && wsClients.ips[ip] >= WebSocketsPerIP) {
+		return false
+	}
+	wsClients.wallets[walletID]++
+	wsClients.ips[ip]++
+	return true
+}
+
+func releaseWebSocket(walletID, ip string) {
+	wsClients.Lock()
+	defer wsClients.Unlock()
+
+	if wsClients.wallets[walletID]--; wsClients.wallets[walletID] <= 0 {
+		delete(wsClients.wallets, walletID)
+	}
+	if wsClients.ips[ip]--; wsClients.ips[ip] <= 0 {
+		delete(wsClients.ips, ip)
+	}
+}
+
+func PublicWebSocket(w http.ResponseWriter, r *http.Request) {
+	walletID := mux.Vars(r)["wallet"]
+	app := appIDToURL(mux.Vars(r)["appid"])
+
+	if installed, err := appInstalled(walletID, app); err != nil {
+		http.Error(w, "failed to check app: "+err.Error(), 500)
+		return
+	} else if !installed {
+		http.Error(w, "app not installed on this wallet", 404)
+		return
+	}
+
+	if _, err := GetAppSettings(app, false); err != nil {
+		http.Error(w, "failed to get app settings: "+err.Error(), 400)
+		return
+	}
+
+	ip := apiutils.ClientIP(r)
+	if !acquireWebSocket(walletID, ip) {
+		http.Error(w, "too many websocket connections", 429)
+		return
+	}
+	defer releaseWebSocket(walletID, ip)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Debug().Err(err).Str("app", app).
+			Msg("failed to upgrade websocket")
+		return
+	}
+
+	sc := &socketConn{
+		id:   cuid.Slug(),
+		conn: conn,
+		send: make(chan []byte, 64),
+	}
+
+	hub := joinSocketHub(walletID, app, sc)
+
+	// the app handles the events of this client in order, one at a time
+	appWallet := AppWallet{walletID, app}
+	messages := make(chan WebSocketMessage, wsQueueSize)
+	go func() {
+		TriggerEventOnSpecificAppWallet(appWallet, "ws_connect",
+			WebSocketMessage{Connection: sc.id})
+		for msg := range messages {
+			TriggerEventOnSpecificAppWallet(appWallet, "ws_message", msg)
+		}
+		TriggerEventOnSpecificAppWallet(appWallet, "ws_disconnect",
+			WebSocketMessage{Connection: sc.id})
+	}()
+
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if WebSocketMessagesPerMinute > 0 {
+		limiter = rate.NewLimiter(rate.Limit(float64(WebSocketMessagesPerMinute)/60),
+			WebSocketMessagesPerMinute)
+	}
+
+	go sc.writeLoop()
+
+	// read loop, runs until the client goes away
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		if !limiter.Allow() {
+			log.Debug().Str("app", app).Str("connection", sc.id).
+				Msg("websocket client over the message limit, dropping message")
+			continue
+		}
+
+		var data interface{}
+		if err := json.Unmarshal(message, &data); err != nil {
+			data = string(message)
+		}
+
+		select {
+		case messages <- WebSocketMessage{Connection: sc.id, Data: data}:
+		default:
+			log.Debug().Str("app", app).Str("connection", sc.id).
+				Msg("websocket queue full, dropping message")
+		}
+	}
+
+	hub.leave(walletID, app, sc.id)
+	close(sc.send)
+	close(messages)
+}
+
+func (sc *socketConn) writeLoop() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		sc.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-sc.send:
+			sc.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				sc.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := sc.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			sc.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := sc.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+type socketMessage struct {
+	Wallet     string `json:"wallet"`
+	App        string `json:"app"`
+	Connection string `json:"connection,omitempty"`
+	Message    string `json:"message"`
+}
+
+func init() {
+	cluster.Subscribe("websocket", func(data json.RawMessage) {
+		var msg socketMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return
+		}
+		deliverWebSocketMessage(msg.Wallet, msg.App, []byte(msg.Message), msg.Connection)
+	})
+}
+
+// sendWebSocketMessage pushes data to all clients connected to this app on this
+// wallet, or only to the given connection if it is not empty.
+// returns the number of clients the message was queued to, in a cluster only
+// those connected to this instance are counted.
+func sendWebSocketMessage(walletID, app string, data interface{}, connection string) int {
+	var message []byte
+	if str, ok := data.(string); ok {
+		message = []byte(str)
+	} else {
+		message, _ = utils.JSONMarshal(data)
+	}
+
+	sent := deliverWebSocketMessage(walletID, app, message, connection)
+	if connection == "" || sent == 0 {
+		// the clients may be connected to other instances
+		cluster.Broadcast("websocket", socketMessage{walletID, app, connection, string(message)})
+	}
+	return sent
+}
+
+func deliverWebSocketMessage(walletID, app string, message []byte, connection string) int {
+	ihub, ok := appSockets.Load(walletID + ":" + app)
+	if !ok {
+		return 0
+	}
+	hub := ihub.(*socketHub)
+
+	hub.Lock()
+	defer hub.Unlock()
+
+	sent := 0
+	for id, sc := range hub.conns {
+		if connection != "" && connection != id {
+			continue
+		}
+
+		select {
+		case sc.send <- message:
+			sent++
+		default:
+			// client is too slow, drop this message for it
+			log.Debug().Str("app", app).Str("connection", id).
+				Msg("websocket buffer full, dropping message")
+		}
+	}
+
+	return sent
+}
+
+func listWebSocketConnections(walletID, app string) []string {
+	ids := make([]string, 0)
+
+	ihub, ok := appSockets.Load(walletID + ":" + app)
+	if !ok {
+		return ids
+	}
+	hub := ihub.(*socketHub)
+
+	hub.Lock()
+	defer hub.Unlock()
+	for id := range hub.conns {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// closeWebSockets tells every connected client we are going away. the read loops
+// then fail and clean up as if the clients had disconnected.
+func closeWebSockets() {
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+	deadline := time.Now().Add(wsWriteWait)
+
+	appSockets.Range(func(_, ihub interface{}) bool {
+		hub := ihub.(*socketHub)
+		hub.Lock()
+		for _, sc := range hub.conns {
+			sc.conn.WriteControl(websocket.CloseMessage, message, deadline)
+			sc.conn.Close()
+		}
+		hub.Unlock()
+		return true
+	})
+}
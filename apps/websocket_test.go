@@ -0,0 +1,62 @@
+package apps
+
+import "testing"
+
+func TestEmptySocketHubsAreRemoved(t *testing.T) {
+	first := &socketConn{id: "first", send: make(chan []byte, 1)}
+	second := &socketConn{id: "second", send: make(chan []byte, 1)}
+
+	hub := joinSocketHub(testWallet, testApp, first)
+	if joinSocketHub(testWallet, testApp, second) != hub {
+		t.Fatal("clients of the same app and wallet got different hubs")
+	}
+
+	hub.leave(testWallet, testApp, first.id)
+	if _, ok := appSockets.Load(testWallet + ":" + testApp); !ok {
+		t.Fatal("hub was removed while it still had a client")
+	}
+	if sent := deliverWebSocketMessage(testWallet, testApp, []byte("hi"), ""); sent != 1 {
+		t.Fatalf("expected the message to reach 1 client, got %d", sent)
+	}
+
+	hub.leave(testWallet, testApp, second.id)
+	if _, ok := appSockets.Load(testWallet + ":" + testApp); ok {
+		t.Fatal("empty hub wasn't removed")
+	}
+
+	// a client joining after that gets a new hub
+	third := &socketConn{id: "third", send: make(chan []byte, 1)}
+	if next := joinSocketHub(testWallet, testApp, third); next == hub {
+		t.Fatal("client joined a removed hub")
+	} else {
+		next.leave(testWallet, testApp, third.id)
+	}
+}
+
+func TestWebSocketLimits(t *testing.T) {
+	defer func(wallet, ip int) {
+		WebSocketsPerWallet, WebSocketsPerIP = wallet, ip
+	}(WebSocketsPerWallet, WebSocketsPerIP)
+	WebSocketsPerWallet, WebSocketsPerIP = 2, 1
+
+	if !acquireWebSocket(testWallet, "10.0.0.1") || !acquireWebSocket(testWallet, "10.0.0.2") {
+		t.Fatal("connections under the limits were refused")
+	}
+	if acquireWebSocket(testWallet, "10.0.0.3") {
+		t.Fatal("connection over the wallet limit was accepted")
+	}
+	if acquireWebSocket(otherWallet, "10.0.0.1") {
+		t.Fatal("connection over the ip limit was accepted")
+	}
+
+	releaseWebSocket(testWallet, "10.0.0.1")
+	if !acquireWebSocket(otherWallet, "10.0.0.1") {
+		t.Fatal("connection was refused after another one closed")
+	}
+
+	releaseWebSocket(testWallet, "10.0.0.2")
+	releaseWebSocket(otherWallet, "10.0.0.1")
+	if len(wsClients.wallets) != 0 || len(wsClients.ips) != 0 {
+		t.Fatal("counts weren't cleaned up")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+)
+
+// routes that move funds or change configuration get an entry in the audit log
+var auditedRoutes = map[string]bool{
+	"/api/user/create-wallet":                     true,
+	"/api/user/delete":                            true,
+	"/api/user/set-preferences":                   true,
+	"/api/user/set-notifications":                 true,
+	"/api/user/add-app":                           true,
+	"/api/user/remove-app":                        true,
+	"/api/user/publish-app":                       true,
+	"/api/wallet/delete":                          true,
+	"/api/wallet/rename/{new-name}":               true,
+	"/api/wallet/create-invoice":                  true,
+	"/api/wallet/pay-invoice":                     true,
+	"/api/wallet/lnurlauth":                       true,
+	"/api/wallet/pay-lnurl":                       true,
+	"/api/wallet/nwc/create":                      true,
+	"/api/wallet/nwc/delete/{id}":                 true,
+	"/api/wallet/push/subscribe":                  true,
+	"/api/wallet/push/unsubscribe":                true,
+	"/api/wallet/telegram/link":                   true,
+	"/api/wallet/telegram/unlink/{chat}":          true,
+	"/api/wallet/splits/set":                      true,
+	"/lnurl/wallet/drain":                         true,
+	"/api/wallet/app/{appid}/refresh":             true,
+	"/api/wallet/app/{appid}/clear-data":          true,
+	"/api/wallet/app/{appid}/import":              true,
+	"/api/wallet/app/{appid}/secrets/set/{name}":  true,
+	"/api/wallet/app/{appid}/secrets/del/{name}":  true,
+	"/api/wallet/app/{appid}/set/{model}/{key}":   true,
+	"/api/wallet/app/{appid}/add/{model}":         true,
+	"/api/wallet/app/{appid}/del/{model}/{key}":   true,
+	"/ext/{wallet}/{appid}/lnurl/{name}/callback": true,
+	"/lndhub/ext/addinvoice":                      true,
+	"/lndhub/ext/payinvoice":                      true,
+	"/api/admin/backups/create":                   true,
+	"/api/admin/ledger/check":                     true,
+	"/api/admin/restore":                          true,
+	"/api/admin/reload":                           true,
+	"/api/admin/maintenance":                      true,
+	"/api/admin/jobs/{id}/retry":                  true,
+	"/api/admin/jobs/{id}/delete":                 true,
+	"/api/admin/bans/create":                      true,
+	"/api/admin/bans/{id}/delete":                 true,
+	"/api/admin/branding/{asset}/upload":          true,
+	"/api/admin/branding/{asset}/delete":          true,
+	"/api/admin/branding/themes/set/{name}":       true,
+	"/api/admin/branding/themes/del/{name}":       true,
+
+	// btcpay greenfield
+	"/api/v1/stores/{storeId}/lightning/{cryptoCode}/invoices":     true,
+	"/api/v1/stores/{storeId}/lightning/{cryptoCode}/invoices/pay": true,
+
+	// alby
+	"/alby/invoices":        true,
+	"/alby/payments/bolt11": true,
+}
+
+// routes that list things on GET and make them on POST, only POST is an action.
+var postOnlyRoutes = map[string]bool{
+	"/alby/invoices": true,
+}
+
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		action, _ := route.GetPathTemplate()
+		if !auditedRoutes[action] || (postOnlyRoutes[action] && r.Method == "GET") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := apiutils.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		requestID, _ := r.Context().Value("requestID").(string)
+		entry := models.AuditEntry{
+			RequestID: requestID,
+			Action:    action,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    recorder.Status,
+		}
+		entry.IP = apiutils.ClientIP(r)
+
+		var key string
+		if user, ok := r.Context().Value("user").(*models.User); ok {
+			entry.UserID = user.ID
+			entry.KeyType = "master"
+			key = r.Header.Get("X-MasterKey")
+		}
+		if wallet, ok := r.Context().Value("wallet").(*models.Wallet); ok {
+			entry.UserID = wallet.UserID
+			entry.WalletID = wallet.ID
+			entry.KeyType, _ = r.Context().Value("permission").(string)
+			key = r.Header.Get("X-Api-Key")
+			if key == "" {
+				key = r.URL.Query().Get("api-key")
+			}
+			if key == "" {
+				key = bearerToken(r)
+			}
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/admin/") {
+			entry.KeyType = "admin-api"
+			key = r.Header.Get("X-Admin-Key")
+		}
+		if action == "/lnurl/wallet/drain" {
+			entry.KeyType = "admin"
+			key = r.URL.Query().Get("api-key")
+
+			var wallet models.Wallet
+			if storage.DB.Where("admin_key_hash", models.LookupHash(key)).
+				Limit(1).Find(&wallet).RowsAffected == 1 {
+				entry.UserID = wallet.UserID
+				entry.WalletID = wallet.ID
+			}
+		}
+		if key != "" {
+			entry.KeyHash = models.LookupHash(key)[0:16]
+		}
+
+		if err := storage.DB.Create(&entry).Error; err != nil {
+			log.Error().Err(err).Interface("entry", entry).Msg("failed to write audit entry")
+		}
+	})
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"gorm.io/gorm/clause"
+)
+
+// clients that keep failing to authenticate, scanning LNURLs or creating
+// invoices get banned for BAN_DURATION. each of these counts a strike against
+// the client IP (and the key, for the last two) and whoever gets more than the
+// limit set for it within BAN_WINDOW is banned. a limit of 0 disables that
+// check. bans are kept in the database, so they survive restarts and are seen
+// by all instances, which reload them every half a minute. trusted proxies and
+// requests with the admin key are never banned.
+const (
+	strikeAuth     = "failed authentication"
+	strikeLNURL    = "lnurl scans"
+	strikeInvoices = "invoices"
+)
+
+var lnurlScanRoutes = map[string]bool{
+	"/api/wallet/lnurlscan/{code}": true,
+}
+
+var invoiceRoutes = map[string]bool{
+	"/api/wallet/create-invoice":                  true,
+	"/ext/{wallet}/{appid}/lnurl/{name}/callback": true,
+	"/lndhub/ext/addinvoice":                      true,
+
+	// btcpay greenfield
+	"/api/v1/stores/{storeId}/lightning/{cryptoCode}/invoices": true,
+
+	// alby
+	"/alby/invoices": true,
+
+	// cashu
+	"/cashu/v1/mint/quote/bolt11": true,
+}
+
+func strikeLimit(kind string) int {
+	switch kind {
+	case strikeAuth:
+		return live().BanAuthFailures
+	case strikeLNURL:
+		return live().BanLNURLScans
+	case strikeInvoices:
+		return live().BanInvoices
+	}
+	return 0
+}
+
+type strikeCount struct {
+	count int
+	start time.Time
+}
+
+type banList struct {
+	sync.Mutex
+	strikes map[string]*strikeCount
+	bans    map[string]time.Time // zero for bans that don't expire
+}
+
+var bans = &banList{
+	strikes: make(map[string]*strikeCount),
+	bans:    make(map[string]time.Time),
+}
+
+// banned returns whether the subject is banned and until when.
+func (bl *banList) banned(subject string, now time.Time) (bool, time.Time) {
+	bl.Lock()
+	defer bl.Unlock()
+
+	until, ok := bl.bans[subject]
+	if !ok || (!until.IsZero() && until.Before(now)) {
+		return false, time.Time{}
+	}
+	return true, until
+}
+
+// strike counts a strike and bans the subject if it went over the limit.
+func (bl *banList) strike(subject, kind string, now time.Time) {
+	limit := strikeLimit(kind)
+	if limit <= 0 {
+		return
+	}
+
+	bl.Lock()
+	id := kind + ":" + subject
+	strikes, ok := bl.strikes[id]
+	if !ok || now.Sub(strikes.start) > live().BanWindow {
+		strikes = &strikeCount{start: now}
+		bl.strikes[id] = strikes
+	}
+	strikes.count++
+	over := strikes.count > limit
+	if over {
+		delete(bl.strikes, id)
+	}
+	bl.Unlock()
+
+	if over {
+		until := now.Add(live().BanDuration)
+		log.Warn().Str("subject", subject).Str("reason", kind).Time("until", until).
+			Msg("banning abusive client")
+		if err := saveBan(subject, "too many "+kind, true, &until); err != nil {
+			log.Error().Err(err).Str("subject", subject).Msg("failed to save ban")
+		}
+	}
+}
+
+// forget drops counts whose window is over.
+func (bl *banList) forget(now time.Time) {
+	bl.Lock()
+	defer bl.Unlock()
+	for id, strikes := range bl.strikes {
+		if now.Sub(strikes.start) > live().BanWindow {
+			delete(bl.strikes, id)
+		}
+	}
+}
+
+func (bl *banList) load() error {
+	var list []models.Ban
+	if err := storage.DB.Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Find(&list).Error; err != nil {
+		return err
+	}
+
+	current := make(map[string]time.Time, len(list))
+	for _, ban := range list {
+		var until time.Time
+		if ban.ExpiresAt != nil {
+			until = *ban.ExpiresAt
+		}
+		current[ban.Subject] = until
+	}
+
+	bl.Lock()
+	bl.bans = current
+	bl.Unlock()
+	return nil
+}
+
+func saveBan(subject, reason string, automatic bool, expires *time.Time) error {
+	err := storage.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "subject"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason", "automatic", "expires_at", "updated_at"}),
+	}).Create(&models.Ban{
+		Subject:   subject,
+		Reason:    reason,
+		Automatic: automatic,
+		ExpiresAt: expires,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	var until time.Time
+	if expires != nil {
+		until = *expires
+	}
+	bans.Lock()
+	bans.bans[subject] = until
+	bans.Unlock()
+	return nil
+}
+
+func refreshBans() {
+	for range time.Tick(time.Second * 30) {
+		if err := bans.load(); err != nil {
+			log.Warn().Err(err).Msg("failed to load bans")
+		}
+		bans.forget(time.Now())
+	}
+}
+
+func banSubjects(r *http.Request) (ip, key string) {
+	if addr := apiutils.ClientIP(r); !isTrustedProxy(addr) {
+		ip = "ip:" + addr
+	}
+	if k := requestKey(r); k != "" {
+		key = "key:" + models.LookupHash(k)[0:16]
+	}
+	return ip, key
+}
+
+func banMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hasAdminKey(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		ip, key := banSubjects(r)
+		for _, subject := range []string{ip, key} {
+			if subject == "" {
+				continue
+			}
+			if banned, until := bans.banned(subject, now); banned {
+				if until.IsZero() {
+					apiutils.SendJSONError(w, 403, "banned")
+					return
+				}
+				seconds := int(math.Ceil(until.Sub(now).Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				apiutils.SendJSONError(w, 403, "banned for abuse, try again in %d seconds", seconds)
+				return
+			}
+		}
+
+		recorder := apiutils.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		route := apiutils.RouteTemplate(r)
+		var kind string
+		switch {
+		case recorder.Status == 401:
+			// a wrong key is worthless, so only the IP is counted
+			if ip != "" {
+				bans.strike(ip, strikeAuth, now)
+			}
+			return
+		case lnurlScanRoutes[route]:
+			kind = strikeLNURL
+		case invoiceRoutes[route] && !(postOnlyRoutes[route] && r.Method == "GET"):
+			kind = strikeInvoices
+		default:
+			return
+		}
+		for _, subject := range []string{ip, key} {
+			if subject != "" {
+				bans.strike(subject, kind, now)
+			}
+		}
+	})
+}
+
+// listBans returns the bans in effect.
+func listBans(w http.ResponseWriter, r *http.Request) {
+	var list []models.Ban
+	if err := storage.DB.Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Order("id desc").Find(&list).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+	apiutils.SendJSON(w, list)
+}
+
+// createBan bans an `ip` or a `key` for `duration` (like "24h"), or forever if
+// not given.
+func createBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiutils.SendJSONError(w, 405, "use POST")
+		return
+	}
+
+	var params struct {
+		IP       string `json:"ip"`
+		Key      string `json:"key"`
+		Duration string `json:"duration"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		apiutils.SendJSONError(w, 400, "failed to read params: %s", err.Error())
+		return
+	}
+
+	var subject string
+	switch {
+	case params.IP != "" && params.Key != "":
+		apiutils.SendJSONError(w, 400, "give either an ip or a key, not both")
+		return
+	case params.IP != "":
+		ip := net.ParseIP(params.IP)
+		if ip == nil {
+			apiutils.SendJSONError(w, 400, "invalid ip '%s'", params.IP)
+			return
+		}
+		subject = "ip:" + ip.String()
+	case params.Key != "":
+		subject = "key:" + models.LookupHash(params.Key)[0:16]
+	default:
+		apiutils.SendJSONError(w, 400, "give an ip or a key to ban")
+		return
+	}
+
+	var expires *time.Time
+	if params.Duration != "" {
+		duration, err := time.ParseDuration(params.Duration)
+		if err != nil || duration <= 0 {
+			apiutils.SendJSONError(w, 400, "invalid duration '%s'", params.Duration)
+			return
+		}
+		until := time.Now().Add(duration)
+		expires = &until
+	}
+
+	if err := saveBan(subject, params.Reason, false, expires); err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	var ban models.Ban
+	if err := storage.DB.Where("subject = ?", subject).First(&ban).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+	apiutils.SendJSON(w, ban)
+}
+
+// deleteBan lifts a ban. on other instances it stays until they reload the
+// bans.
+func deleteBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiutils.SendJSONError(w, 405, "use POST")
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "invalid ban id: %s", err.Error())
+		return
+	}
+
+	var ban models.Ban
+	result := storage.DB.Where("id = ?", id).Limit(1).Find(&ban)
+	if result.Error != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		apiutils.SendJSONError(w, 404, "no such ban")
+		return
+	}
+	if err := storage.DB.Delete(&ban).Error; err != nil {
+		apiutils.SendJSONError(w, 500, "database error: %s", err.Error())
+		return
+	}
+
+	bans.Lock()
+	delete(bans.bans, ban.Subject)
+	bans.Unlock()
+
+	w.WriteHeader(200)
+}
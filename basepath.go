@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// with BASE_URL the whole server (api, client, apps, lnurl endpoints) is
+// mounted under its path, for reverse proxies that serve it from a
+// subdirectory. the routes below are registered without it and the prefix is
+// stripped before they are matched.
+
+// parseBaseURL returns the path prefix ("/wallet") given "/wallet/" or a full
+// url like "https://example.com/wallet/", and the origin if there was one.
+func parseBaseURL(baseURL string) (prefix string, origin string, err error) {
+	if baseURL == "" {
+		return "", "", nil
+	}
+
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return "", "", err
+	}
+	if parsed.Host != "" {
+		origin = parsed.Scheme + "://" + parsed.Host
+	}
+
+	prefix = strings.TrimRight(parsed.Path, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+
+	return prefix, origin, nil
+}
+
+func mountAt(prefix string, handler http.Handler) http.Handler {
+	if prefix == "" {
+		return handler
+	}
+
+	stripped := http.StripPrefix(prefix, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, prefix+"/"):
+			stripped.ServeHTTP(w, r)
+		case r.URL.Path == prefix:
+			target := prefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
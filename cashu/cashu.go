@@ -0,0 +1,540 @@
+package cashu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils"
+	rp "github.com/lnbits/relampago"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// a Cashu mint (NUTs 00 to 07) backed by the wallet in WalletID: the invoices
+// of mint quotes are paid to it, so it holds the sats of all the ecash out
+// there, and melt quotes are paid from it. proofs are kept only once spent.
+
+var (
+	// WalletID is the wallet of the mint, the mint is disabled without one.
+	WalletID string
+	Name     string
+
+	// PaymentTimeout is how long a melt waits for its payment to settle.
+	PaymentTimeout = time.Second * 45
+	QuoteExpiry    = time.Hour
+
+	// the fee reserve of a melt is this percent of the amount but at least
+	// MinFeeReserve, it is kept by the mint whatever the fee that was paid.
+	FeeReservePercent int64 = 1
+	MinFeeReserve     int64 = 2
+)
+
+const (
+	StateUnpaid  = "UNPAID"
+	StatePending = "PENDING"
+	StatePaid    = "PAID"
+	StateIssued  = "ISSUED"
+)
+
+var log zerolog.Logger
+
+func SetLogger(logger zerolog.Logger) {
+	log = logger.With().Str("s", "cashu").Logger()
+}
+
+// Error is an error of NUT-00, with the code wallets look at.
+type Error struct {
+	Code   int    `json:"code"`
+	Detail string `json:"detail"`
+}
+
+func (e *Error) Error() string { return e.Detail }
+
+var (
+	ErrDisabled        = &Error{0, "the mint is disabled"}
+	ErrInvalidMessage  = &Error{10001, "invalid blinded message"}
+	ErrAlreadySigned   = &Error{10002, "blinded message already signed"}
+	ErrInvalidProof    = &Error{10003, "proof could not be verified"}
+	ErrAlreadySpent    = &Error{11001, "token already spent"}
+	ErrNotBalanced     = &Error{11002, "transaction is not balanced"}
+	ErrUnit            = &Error{11005, "unit not supported"}
+	ErrAmount          = &Error{11006, "amount outside of limit range"}
+	ErrDuplicateInputs = &Error{11007, "duplicate inputs provided"}
+	ErrUnknownKeyset   = &Error{12001, "keyset is not known"}
+	ErrQuoteNotPaid    = &Error{20001, "quote request is not paid"}
+	ErrAlreadyIssued   = &Error{20002, "tokens have already been issued for quote"}
+	ErrQuoteNotFound   = &Error{20004, "quote not found"}
+	ErrQuotePending    = &Error{20005, "quote is pending"}
+	ErrInvoicePaid     = &Error{20006, "invoice already paid"}
+	ErrQuoteExpired    = &Error{20007, "quote is expired"}
+)
+
+func Enabled() bool {
+	return WalletID != ""
+}
+
+type BlindedMessage struct {
+	Amount int64  `json:"amount"`
+	ID     string `json:"id"`
+	B_     string `json:"B_"`
+}
+
+type BlindSignature struct {
+	Amount int64  `json:"amount"`
+	ID     string `json:"id"`
+	C_     string `json:"C_"`
+}
+
+type Proof struct {
+	Amount int64  `json:"amount"`
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	C      string `json:"C"`
+}
+
+// CreateMintQuote makes the invoice the wallet pays to get amount in ecash.
+func CreateMintQuote(ctx context.Context, amount int64, unit string) (*models.CashuQuote, error) {
+	if !Enabled() {
+		return nil, ErrDisabled
+	}
+	if unit != Unit {
+		return nil, ErrUnit
+	}
+	if amount <= 0 || amount >= int64(1)<<MaxOrder {
+		return nil, ErrAmount
+	}
+
+	id := utils.RandomHex(16)
+	payment, err := services.CreateInvoice(ctx, WalletID, services.CreateInvoiceParams{
+		InvoiceParams: rp.InvoiceParams{
+			Msatoshi:    amount * 1000,
+			Description: Name + " ecash",
+		},
+		Tag:   "cashu",
+		Extra: models.JSONObject{"quote": id, "kind": "mint"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	quote := &models.CashuQuote{
+		ID:      id,
+		Kind:    "mint",
+		Request: payment.Bolt11,
+		Hash:    payment.Hash,
+		Amount:  amount,
+		State:   StateUnpaid,
+		Expiry:  time.Now().Add(services.DefaultInvoiceExpiry),
+	}
+	if err := storage.DB.Create(quote).Error; err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
+
+// GetMintQuote finds a mint quote, PAID once its invoice is.
+func GetMintQuote(id string) (*models.CashuQuote, error) {
+	quote, err := getQuote("mint", id)
+	if err != nil {
+		return nil, err
+	}
+	if quote.State != StateUnpaid {
+		return quote, nil
+	}
+
+	var payment models.Payment
+	result := storage.DB.Where("wallet_id = ? AND hash = ? AND amount > 0", WalletID, quote.Hash).
+		Limit(1).Find(&payment)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 1 && !payment.Pending {
+		if err := storage.DB.Model(quote).Where("state = ?", StateUnpaid).
+			Update("state", StatePaid).Error; err != nil {
+			return nil, err
+		}
+		quote.State = StatePaid
+	}
+	return quote, nil
+}
+
+// Mint signs the outputs of a paid mint quote, which must add up to its amount.
+func Mint(quoteID string, outputs []BlindedMessage) ([]BlindSignature, error) {
+	quote, err := GetMintQuote(quoteID)
+	if err != nil {
+		return nil, err
+	}
+	switch quote.State {
+	case StateIssued:
+		return nil, ErrAlreadyIssued
+	case StateUnpaid:
+		return nil, ErrQuoteNotPaid
+	}
+
+	total, err := outputsAmount(outputs)
+	if err != nil {
+		return nil, err
+	}
+	if total != quote.Amount {
+		return nil, ErrNotBalanced
+	}
+	signatures, err := signOutputs(outputs)
+	if err != nil {
+		return nil, err
+	}
+
+	// only one of concurrent mints on the same quote gets the signatures
+	result := storage.DB.Model(quote).Where("state = ?", StatePaid).Update("state", StateIssued)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrAlreadyIssued
+	}
+	return signatures, nil
+}
+
+// CreateMeltQuote says how much ecash paying an invoice costs.
+func CreateMeltQuote(request string, unit string) (*models.CashuQuote, error) {
+	if !Enabled() {
+		return nil, ErrDisabled
+	}
+	if unit != Unit {
+		return nil, ErrUnit
+	}
+	inv, err := decodepay.Decodepay(request)
+	if err != nil {
+		return nil, &Error{0, "invalid invoice: " + err.Error()}
+	}
+	if inv.MSatoshi <= 0 {
+		return nil, &Error{0, "invoices without an amount are not supported"}
+	}
+
+	amount := (inv.MSatoshi + 999) / 1000
+	quote := &models.CashuQuote{
+		ID:         utils.RandomHex(16),
+		Kind:       "melt",
+		Request:    request,
+		Hash:       inv.PaymentHash,
+		Amount:     amount,
+		FeeReserve: feeReserve(amount),
+		State:      StateUnpaid,
+		Expiry:     time.Now().Add(QuoteExpiry),
+	}
+	if err := storage.DB.Create(quote).Error; err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
+
+func feeReserve(amount int64) int64 {
+	reserve := (amount*FeeReservePercent + 99) / 100
+	if reserve < MinFeeReserve {
+		return MinFeeReserve
+	}
+	return reserve
+}
+
+// GetMeltQuote finds a melt quote. a pending one is settled here if its payment
+// ended since.
+func GetMeltQuote(id string) (*models.CashuQuote, error) {
+	quote, err := getQuote("melt", id)
+	if err != nil {
+		return nil, err
+	}
+	if quote.State == StatePending {
+		// a melt being made may not have its payment yet, so a missing one is
+		// only taken as failed after the melt stopped waiting for it
+		if err := settleMelt(quote, 0, time.Since(quote.UpdatedAt) > PaymentTimeout); err != nil {
+			return nil, err
+		}
+	}
+	return quote, nil
+}
+
+// Melt pays the invoice of a quote with the inputs, which must cover its amount
+// and fee reserve.
+func Melt(ctx context.Context, quoteID string, inputs []Proof) (*models.CashuQuote, error) {
+	quote, err := GetMeltQuote(quoteID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case quote.State == StatePaid:
+		return nil, ErrInvoicePaid
+	case quote.State == StatePending:
+		return nil, ErrQuotePending
+	case time.Now().After(quote.Expiry):
+		return nil, ErrQuoteExpired
+	}
+
+	total, err := verifyInputs(inputs)
+	if err != nil {
+		return nil, err
+	}
+	if total < quote.Amount+quote.FeeReserve {
+		return nil, ErrNotBalanced
+	}
+
+	result := storage.DB.Model(quote).Where("state = ?", StateUnpaid).Update("state", StatePending)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrQuotePending
+	}
+	quote.State = StatePending
+	if err := spend(inputs, quote.ID); err != nil {
+		storage.DB.Model(quote).Update("state", StateUnpaid)
+		return nil, err
+	}
+
+	if _, err := services.PayInvoice(ctx, WalletID, services.PayInvoiceParams{
+		PaymentParams: rp.PaymentParams{Invoice: quote.Request},
+		Tag:           "cashu",
+		Extra:         models.JSONObject{"quote": quote.ID, "kind": "melt"},
+	}); err != nil {
+		if err := unspend(quote); err != nil {
+			log.Error().Err(err).Str("quote", quote.ID).Msg("failed to give back the proofs of a failed melt")
+		}
+		return nil, &Error{0, "failed to pay invoice: " + err.Error()}
+	}
+
+	if err := settleMelt(quote, PaymentTimeout, true); err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
+
+// settleMelt waits for the payment of a pending melt quote and marks it paid,
+// or unpaid with its proofs back if the payment failed. it stays pending if the
+// payment does.
+func settleMelt(quote *models.CashuQuote, timeout time.Duration, mayFail bool) error {
+	payment, err := services.WaitForPayment(WalletID, quote.Hash, timeout)
+	if errors.Is(err, services.ErrPaymentFailed) {
+		if !mayFail {
+			return nil
+		}
+		return unspend(quote)
+	} else if err != nil {
+		return err
+	}
+	if payment.Pending {
+		return nil
+	}
+
+	if err := storage.DB.Model(quote).Updates(map[string]interface{}{
+		"state":    StatePaid,
+		"preimage": string(payment.Preimage),
+	}).Error; err != nil {
+		return err
+	}
+	quote.State = StatePaid
+	quote.Preimage = string(payment.Preimage)
+	return nil
+}
+
+func unspend(quote *models.CashuQuote) error {
+	return storage.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("quote = ?", quote.ID).Delete(&models.CashuProof{}).Error; err != nil {
+			return err
+		}
+		quote.State = StateUnpaid
+		return tx.Model(quote).Update("state", StateUnpaid).Error
+	})
+}
+
+// Swap spends the inputs for signatures on outputs of the same total.
+func Swap(inputs []Proof, outputs []BlindedMessage) ([]BlindSignature, error) {
+	if !Enabled() {
+		return nil, ErrDisabled
+	}
+
+	total, err := verifyInputs(inputs)
+	if err != nil {
+		return nil, err
+	}
+	outputsTotal, err := outputsAmount(outputs)
+	if err != nil {
+		return nil, err
+	}
+	if total != outputsTotal {
+		return nil, ErrNotBalanced
+	}
+	signatures, err := signOutputs(outputs)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := spend(inputs, ""); err != nil {
+		return nil, err
+	}
+	return signatures, nil
+}
+
+// CheckState says of each Y (NUT-07) whether it was spent, or is being spent
+// on a pending melt.
+func CheckState(ys []string) ([]ProofState, error) {
+	var spent []models.CashuProof
+	if err := storage.DB.Where("y IN ?", ys).Find(&spent).Error; err != nil {
+		return nil, err
+	}
+	quotes := make(map[string]string, len(spent)) // y -> melt quote
+	ids := make([]string, 0, len(spent))
+	for _, proof := range spent {
+		quotes[proof.Y] = proof.Quote
+		if proof.Quote != "" {
+			ids = append(ids, proof.Quote)
+		}
+	}
+
+	pending := make(map[string]bool)
+	if len(ids) > 0 {
+		var pendingIDs []string
+		if err := storage.DB.Model(&models.CashuQuote{}).
+			Where("id IN ? AND state = ?", ids, StatePending).
+			Pluck("id", &pendingIDs).Error; err != nil {
+			return nil, err
+		}
+		for _, id := range pendingIDs {
+			pending[id] = true
+		}
+	}
+
+	states := make([]ProofState, len(ys))
+	for i, y := range ys {
+		states[i] = ProofState{Y: y, State: "UNSPENT"}
+		if quote, ok := quotes[y]; ok {
+			states[i].State = "SPENT"
+			if pending[quote] {
+				states[i].State = "PENDING"
+			}
+		}
+	}
+	return states, nil
+}
+
+type ProofState struct {
+	Y     string `json:"Y"`
+	State string `json:"state"`
+}
+
+func getQuote(kind, id string) (*models.CashuQuote, error) {
+	if !Enabled() {
+		return nil, ErrDisabled
+	}
+	var quote models.CashuQuote
+	err := storage.DB.Where("kind = ? AND id = ?", kind, id).First(&quote).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrQuoteNotFound
+	}
+	return &quote, err
+}
+
+func outputsAmount(outputs []BlindedMessage) (int64, error) {
+	if len(outputs) == 0 {
+		return 0, ErrInvalidMessage
+	}
+	var total int64
+	seen := make(map[string]bool, len(outputs))
+	for _, output := range outputs {
+		ks := GetKeyset(output.ID)
+		if ks == nil {
+			return 0, ErrUnknownKeyset
+		}
+		if _, ok := ks.keys[output.Amount]; !ok {
+			return 0, ErrAmount
+		}
+		if seen[output.B_] {
+			return 0, ErrAlreadySigned
+		}
+		seen[output.B_] = true
+		total += output.Amount
+	}
+	return total, nil
+}
+
+func signOutputs(outputs []BlindedMessage) ([]BlindSignature, error) {
+	signatures := make([]BlindSignature, len(outputs))
+	for i, output := range outputs {
+		c, err := sign(GetKeyset(output.ID).keys[output.Amount], output.B_)
+		if err != nil {
+			return nil, ErrInvalidMessage
+		}
+		signatures[i] = BlindSignature{output.Amount, output.ID, c}
+	}
+	return signatures, nil
+}
+
+// verifyInputs checks the signatures of the proofs and returns their total.
+// whether they were spent is checked when spending them.
+func verifyInputs(inputs []Proof) (int64, error) {
+	if len(inputs) == 0 {
+		return 0, ErrInvalidProof
+	}
+	var total int64
+	seen := make(map[string]bool, len(inputs))
+	for _, proof := range inputs {
+		ks := GetKeyset(proof.ID)
+		if ks == nil {
+			return 0, ErrUnknownKeyset
+		}
+		key, ok := ks.keys[proof.Amount]
+		if !ok || !verify(key, proof.Secret, proof.C) {
+			return 0, ErrInvalidProof
+		}
+		if seen[proof.Secret] {
+			return 0, ErrDuplicateInputs
+		}
+		seen[proof.Secret] = true
+		total += proof.Amount
+	}
+	return total, nil
+}
+
+// spend records the proofs as spent, failing if any already was.
+func spend(inputs []Proof, quoteID string) error {
+	proofs := make([]models.CashuProof, len(inputs))
+	ys := make([]string, len(inputs))
+	for i, input := range inputs {
+		y, err := secretY(input.Secret)
+		if err != nil {
+			return ErrInvalidProof
+		}
+		ys[i] = y
+		proofs[i] = models.CashuProof{
+			Y:        y,
+			KeysetID: input.ID,
+			Amount:   input.Amount,
+			Secret:   input.Secret,
+			Quote:    quoteID,
+		}
+	}
+
+	return storage.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.CashuProof{}).Where("y IN ?", ys).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadySpent
+		}
+		// another instance may spend them between the count and the insert, the
+		// primary key stops it then
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&proofs)
+		if result.Error != nil {
+			return fmt.Errorf("failed to spend proofs: %w", result.Error)
+		}
+		if result.RowsAffected != int64(len(proofs)) {
+			return ErrAlreadySpent
+		}
+		return nil
+	})
+}
@@ -0,0 +1,74 @@
+package cashu
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// the blind signatures of NUT-00: the wallet sends B_ = Y + rG for a secret
+// whose point is Y, the mint answers C_ = kB_ and the wallet unblinds it into
+// C = kY, which the mint can check later knowing only the secret.
+
+var domainSeparator = []byte("Secp256k1_HashToCurve_Cashu_")
+
+// HashToCurve is Y, the point of a secret.
+func HashToCurve(message []byte) (*btcec.PublicKey, error) {
+	msgHash := sha256.Sum256(append(append([]byte{}, domainSeparator...), message...))
+	counter := make([]byte, 4)
+	for i := uint32(0); i < 1<<16; i++ {
+		binary.LittleEndian.PutUint32(counter, i)
+		hash := sha256.Sum256(append(msgHash[:], counter...))
+		if point, err := btcec.ParsePubKey(append([]byte{0x02}, hash[:]...)); err == nil {
+			return point, nil
+		}
+	}
+	return nil, errors.New("no point found for the secret")
+}
+
+// secretY is the hex of the compressed Y of a secret, how spent proofs are kept.
+func secretY(secret string) (string, error) {
+	y, err := HashToCurve([]byte(secret))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(y.SerializeCompressed()), nil
+}
+
+func multiply(key *btcec.PrivateKey, point *btcec.PublicKey) *btcec.PublicKey {
+	var p, result btcec.JacobianPoint
+	point.AsJacobian(&p)
+	btcec.ScalarMultNonConst(&key.Key, &p, &result)
+	result.ToAffine()
+	return btcec.NewPublicKey(&result.X, &result.Y)
+}
+
+// sign makes C_ for the hex B_ of a blinded message.
+func sign(key *btcec.PrivateKey, blinded string) (string, error) {
+	b, err := hex.DecodeString(blinded)
+	if err != nil {
+		return "", errors.New("invalid B_")
+	}
+	point, err := btcec.ParsePubKey(b)
+	if err != nil {
+		return "", errors.New("invalid B_")
+	}
+	return hex.EncodeToString(multiply(key, point).SerializeCompressed()), nil
+}
+
+// verify checks that the hex C of a proof is kY for its secret.
+func verify(key *btcec.PrivateKey, secret, signature string) bool {
+	c, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	y, err := HashToCurve([]byte(secret))
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(multiply(key, y).SerializeCompressed(), c)
+}
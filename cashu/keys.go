@@ -0,0 +1,88 @@
+package cashu
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/lnbits/infinity/utils/nostr_utils"
+)
+
+// the mint has one keyset, in sat, with a key for each power of 2 up to
+// 2^(MaxOrder-1). the keys are derived from the instance secret, so they are
+// the same on every instance and after a restart.
+
+const Unit = "sat"
+
+var MaxOrder = 32
+
+type Keyset struct {
+	ID   string
+	Unit string
+	keys map[int64]*btcec.PrivateKey
+}
+
+var (
+	keyset     *Keyset
+	keysetOnce sync.Once
+)
+
+func activeKeyset() *Keyset {
+	keysetOnce.Do(func() {
+		keyset = deriveKeyset(nostr_utils.DeriveKey("cashu:keyset:0"))
+	})
+	return keyset
+}
+
+func deriveKeyset(seed string) *Keyset {
+	ks := &Keyset{Unit: Unit, keys: make(map[int64]*btcec.PrivateKey, MaxOrder)}
+	for i := 0; i < MaxOrder; i++ {
+		amount := int64(1) << i
+		secret := sha256.Sum256([]byte(seed + ":" + strconv.FormatInt(amount, 10)))
+		ks.keys[amount], _ = btcec.PrivKeyFromBytes(secret[:])
+	}
+
+	// NUT-02: the id is the version byte and the start of the hash of the
+	// public keys ordered by amount
+	h := sha256.New()
+	for _, amount := range ks.amounts() {
+		h.Write(ks.keys[amount].PubKey().SerializeCompressed())
+	}
+	ks.ID = "00" + hex.EncodeToString(h.Sum(nil))[0:14]
+	return ks
+}
+
+func (ks *Keyset) amounts() []int64 {
+	amounts := make([]int64, 0, len(ks.keys))
+	for amount := range ks.keys {
+		amounts = append(amounts, amount)
+	}
+	sort.Slice(amounts, func(i, j int) bool { return amounts[i] < amounts[j] })
+	return amounts
+}
+
+// PublicKeys are the public keys of the amounts, as NUT-01 gives them.
+func (ks *Keyset) PublicKeys() map[string]string {
+	keys := make(map[string]string, len(ks.keys))
+	for amount, key := range ks.keys {
+		keys[strconv.FormatInt(amount, 10)] = hex.EncodeToString(key.PubKey().SerializeCompressed())
+	}
+	return keys
+}
+
+// Keysets are all the keysets of the mint, only the active one for now.
+func Keysets() []*Keyset {
+	return []*Keyset{activeKeyset()}
+}
+
+func GetKeyset(id string) *Keyset {
+	for _, ks := range Keysets() {
+		if ks.ID == id {
+			return ks
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package chaos
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	mrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	rp "github.com/lnbits/relampago"
+	"github.com/rs/zerolog"
+)
+
+// with CHAOS=true and the void backend the server misbehaves on purpose, so
+// the developers of apps and clients can see how they cope: invoices are
+// sometimes not created, payments take a random time up to MaxDelay to settle
+// and some of them fail (either right away or later), and stream events are
+// sometimes not delivered. the invoices are real regtest invoices signed by a
+// key made on startup, so they can be paid between wallets of the instance, but
+// nothing is ever paid to them from outside. it is never enabled with a real
+// backend.
+
+var Enabled bool
+
+// Rates are how often each thing goes wrong, they can change on reload.
+type Rates struct {
+	InvoiceFailure float64
+	PaymentFailure float64
+	EventDrop      float64
+	MaxDelay       time.Duration
+}
+
+var currentRates atomic.Value
+
+func SetRates(r Rates) {
+	currentRates.Store(r)
+}
+
+func rates() Rates {
+	if r, ok := currentRates.Load().(Rates); ok {
+		return r
+	}
+	return Rates{
+		InvoiceFailure: 0.05,
+		PaymentFailure: 0.1,
+		EventDrop:      0.1,
+		MaxDelay:       time.Second * 30,
+	}
+}
+
+var ErrInjected = errors.New("failure injected by chaos mode")
+
+var log zerolog.Logger
+
+func SetLogger(logger zerolog.Logger) {
+	log = logger.With().Str("s", "chaos").Logger()
+}
+
+var (
+	random   = mrand.New(mrand.NewSource(time.Now().UnixNano()))
+	randomMu sync.Mutex
+)
+
+func chance(probability float64) bool {
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	return random.Float64() < probability
+}
+
+func delay() time.Duration {
+	maxDelay := rates().MaxDelay
+	if maxDelay <= 0 {
+		return 0
+	}
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	return time.Duration(random.Int63n(int64(maxDelay)))
+}
+
+// DropEvent says whether a stream event should be thrown away.
+func DropEvent() bool {
+	if !Enabled || !chance(rates().EventDrop) {
+		return false
+	}
+	log.Debug().Msg("dropping stream event")
+	return true
+}
+
+type wallet struct {
+	rp.Wallet
+
+	key      *btcec.PrivateKey
+	invoices sync.Map // checking id: struct{}
+	payments sync.Map // checking id: rp.PaymentStatus
+	stream   chan rp.PaymentStatus
+}
+
+// Wrap puts the failure injection around the void backend.
+func Wrap(backend rp.Wallet) (rp.Wallet, error) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return &wallet{
+		Wallet: backend,
+		key:    key,
+		stream: make(chan rp.PaymentStatus),
+	}, nil
+}
+
+func (w *wallet) Kind() string {
+	return "chaos"
+}
+
+func (w *wallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
+	if chance(rates().InvoiceFailure) {
+		log.Debug().Int64("msat", params.Msatoshi).Msg("failing invoice creation")
+		return rp.InvoiceData{}, ErrInjected
+	}
+
+	var preimage, secret [32]byte
+	rand.Read(preimage[:])
+	rand.Read(secret[:])
+	hash := sha256.Sum256(preimage[:])
+
+	options := []func(*zpay32.Invoice){zpay32.PaymentAddr(secret)}
+	if params.Msatoshi > 0 {
+		options = append(options, zpay32.Amount(lnwire.MilliSatoshi(params.Msatoshi)))
+	}
+	if len(params.DescriptionHash) == 32 {
+		var descriptionHash [32]byte
+		copy(descriptionHash[:], params.DescriptionHash)
+		options = append(options, zpay32.DescriptionHash(descriptionHash))
+	} else {
+		options = append(options, zpay32.Description(params.Description))
+	}
+	if params.Expiry != nil {
+		options = append(options, zpay32.Expiry(*params.Expiry))
+	}
+
+	invoice, err := zpay32.NewInvoice(&chaincfg.RegressionNetParams, hash, time.Now(), options...)
+	if err != nil {
+		return rp.InvoiceData{}, err
+	}
+	bolt11, err := invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			digest := sha256.Sum256(msg)
+			return ecdsa.SignCompact(w.key, digest[:], true)
+		},
+	})
+	if err != nil {
+		return rp.InvoiceData{}, err
+	}
+
+	checkingID := hex.EncodeToString(hash[:])
+	w.invoices.Store(checkingID, struct{}{})
+	return rp.InvoiceData{
+		CheckingID: checkingID,
+		Preimage:   hex.EncodeToString(preimage[:]),
+		Invoice:    bolt11,
+	}, nil
+}
+
+func (w *wallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error) {
+	_, exists := w.invoices.Load(checkingID)
+	return rp.InvoiceStatus{CheckingID: checkingID, Exists: exists}, nil
+}
+
+func (w *wallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
+	fail := chance(rates().PaymentFailure)
+	if fail && chance(0.5) {
+		log.Debug().Msg("failing payment right away")
+		return rp.PaymentData{}, ErrInjected
+	}
+
+	var id [16]byte
+	rand.Read(id[:])
+	checkingID := "chaos_" + hex.EncodeToString(id[:])
+	w.payments.Store(checkingID, rp.PaymentStatus{CheckingID: checkingID, Status: rp.Pending})
+
+	wait := delay()
+	log.Debug().Str("id", checkingID).Bool("fail", fail).Str("in", wait.String()).
+		Msg("payment will settle")
+	go func() {
+		time.Sleep(wait)
+
+		status := rp.PaymentStatus{CheckingID: checkingID, Status: rp.Failed}
+		if !fail {
+			var preimage [32]byte
+			rand.Read(preimage[:])
+			status.Status = rp.Complete
+			status.Preimage = hex.EncodeToString(preimage[:])
+		}
+		w.payments.Store(checkingID, status)
+		w.stream <- status
+	}()
+
+	return rp.PaymentData{CheckingID: checkingID}, nil
+}
+
+func (w *wallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error) {
+	if status, ok := w.payments.Load(checkingID); ok {
+		return status.(rp.PaymentStatus), nil
+	}
+	return rp.PaymentStatus{CheckingID: checkingID, Status: rp.Unknown}, nil
+}
+
+func (w *wallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
+	return w.stream, nil
+}
@@ -0,0 +1,34 @@
+// shows the web push notifications of the wallets, even with the client
+// closed. the server sends {title, body, kind, wallet, hash}.
+
+self.addEventListener('push', event => {
+  let data = {}
+  try {
+    data = event.data.json()
+  } catch (_) {
+    data = {body: event.data && event.data.text()}
+  }
+
+  event.waitUntil(
+    self.registration.showNotification(data.title || 'Payment', {
+      body: data.body,
+      tag: data.hash || undefined,
+      icon: 'favicon.ico',
+      data
+    })
+  )
+})
+
+self.addEventListener('notificationclick', event => {
+  event.notification.close()
+
+  event.waitUntil(
+    self.clients.matchAll({type: 'window'}).then(clients => {
+      for (const client of clients) {
+        if (client.url.startsWith(self.registration.scope) && 'focus' in client)
+          return client.focus()
+      }
+      return self.clients.openWindow(self.registration.scope)
+    })
+  )
+})
@@ -44,6 +44,10 @@ module.exports = configure(function (ctx) {
     build: {
       vueRouterMode: 'history', // available values: 'hash', 'history'
 
+      // assets are loaded relative to the <base> the server puts in index.html,
+      // so the same build works under any BASE_URL
+      publicPath: '',
+
       // transpile: false,
 
       // Add dependencies for transpiling with Babel (Array of string/regex)
@@ -1,5 +1,5 @@
 import store from './store'
-import {appURLToId} from './helpers'
+import {appURLToId, baseURL} from './helpers'
 
 const request = async (path, opts = {}, key = null) => {
   opts.headers = opts.headers || {}
@@ -11,7 +11,7 @@ const request = async (path, opts = {}, key = null) => {
       key || new URLSearchParams(location.search).get('key')
   }
 
-  const r = await fetch(path, opts)
+  const r = await fetch(baseURL + path, opts)
   const text = await r.text()
 
   if (!r.ok) {
@@ -44,6 +44,15 @@ export const loadSettings = async () => await request('/v/settings')
 
 export const loadUser = async key => await request('/api/user', {}, key)
 
+export const loadPreferences = async () =>
+  await request('/api/user/preferences')
+
+export const setPreferences = async preferences =>
+  await request('/api/user/set-preferences', {
+    method: 'POST',
+    body: JSON.stringify(preferences)
+  })
+
 export const createWallet = async name =>
   await request('/api/user/create-wallet', {
     method: 'POST',
@@ -64,6 +73,11 @@ export const removeApp = async url =>
 
 export const loadWallet = async () => await request(`/api/wallet`)
 
+export const loadPayments = async (cursor = '', limit = 200) =>
+  await request(
+    `/api/wallet/payments?` + new URLSearchParams({cursor, limit}).toString()
+  )
+
 export const createInvoice = async params =>
   await request(`/api/wallet/create-invoice`, {
     method: 'POST',
@@ -91,6 +105,35 @@ export const authLnurl = async callback =>
 export const renameWallet = async name =>
   await request(`/api/wallet/rename/${name}`, {method: 'POST'})
 
+export const loadPairing = async (type, scope) =>
+  await request(`/api/wallet/pairing?type=${type}&scope=${scope}`)
+
+export const loadNWCConnections = async () => await request(`/api/wallet/nwc`)
+
+export const createNWCConnection = async params =>
+  await request(`/api/wallet/nwc/create`, {
+    method: 'POST',
+    body: JSON.stringify(params)
+  })
+
+export const deleteNWCConnection = async id =>
+  await request(`/api/wallet/nwc/delete/${id}`, {method: 'POST'})
+
+export const loadPushSubscriptions = async () =>
+  await request(`/api/wallet/push`)
+
+export const subscribePush = async params =>
+  await request(`/api/wallet/push/subscribe`, {
+    method: 'POST',
+    body: JSON.stringify(params)
+  })
+
+export const unsubscribePush = async params =>
+  await request(`/api/wallet/push/unsubscribe`, {
+    method: 'POST',
+    body: JSON.stringify(params)
+  })
+
 export const deleteWallet = async () =>
   await request(`/api/wallet/delete`, {
     method: 'POST'
@@ -99,6 +142,8 @@ export const deleteWallet = async () =>
 export const scanLnurl = async lnurl =>
   await request(`/api/wallet/lnurlscan/${lnurl}`, {})
 
+export const installedApps = async () => await request(`/api/user/apps`)
+
 export const appInfo = async appid => {
   const appSettings = await request(`/api/wallet/app/${appid}`)
   appSettings.id = appid
@@ -112,8 +157,12 @@ export const appRefresh = async appid =>
 export const appClearData = async appid =>
   await request(`/api/wallet/app/${appid}/clear-data`)
 
-export const listAppItems = async (appURL, model) =>
-  await request(`/api/wallet/app/${appURLToId(appURL)}/list/${model}`)
+export const listAppItems = async (appURL, model, params = {}) =>
+  await request(
+    `/api/wallet/app/${appURLToId(appURL)}/list/${model}?${new URLSearchParams(
+      params
+    )}`
+  )
 
 export const getAppItem = async (appURL, model, key) =>
   await request(`/api/wallet/app/${appURLToId(appURL)}/set/${model}/${key}`)
@@ -133,6 +182,18 @@ export const addAppItem = async (appURL, model, value) =>
 export const delAppItem = async (appURL, model, key) =>
   await request(`/api/wallet/app/${appURLToId(appURL)}/del/${model}/${key}`)
 
+export const listAppSecrets = async appURL =>
+  await request(`/api/wallet/app/${appURLToId(appURL)}/secrets`)
+
+export const setAppSecret = async (appURL, name, value) =>
+  await request(`/api/wallet/app/${appURLToId(appURL)}/secrets/set/${name}`, {
+    method: 'POST',
+    body: JSON.stringify({value})
+  })
+
+export const delAppSecret = async (appURL, name) =>
+  await request(`/api/wallet/app/${appURLToId(appURL)}/secrets/del/${name}`)
+
 export const callAppAction = async (wallet, appid, action, params) =>
   await request(`/ext/${wallet}/${appid}/action/${action}`, {
     method: 'POST',
@@ -157,6 +157,17 @@ export const appURLToId = url =>
 export const fieldLabel = field =>
   (field.display || field.name) + (field.required ? ' *' : '')
 
+// set by the server in index.html when it's mounted under BASE_URL
+export const baseURL = window.BASE_URL || ''
+
+// the public url of the current app: /wallet/<id>/app/<appid> -> /ext/<id>/<appid>
+export const extPath = () =>
+  baseURL +
+  location.pathname
+    .slice(baseURL.length)
+    .replace('/app/', '/')
+    .replace('/wallet/', '/ext/')
+
 export const md = MarkdownIt({
   linkify: true
 })
@@ -1,6 +1,7 @@
 import {route} from 'quasar/wrappers'
 import {createRouter, createWebHistory, createWebHashHistory} from 'vue-router'
 import routes from './routes'
+import {baseURL} from '../helpers'
 
 export default route(() => {
   const createHistory =
@@ -12,12 +13,9 @@ export default route(() => {
     scrollBehavior: () => ({left: 0, top: 0}),
     routes,
 
-    // Leave this as is and make changes in quasar.conf.js instead!
-    // quasar.conf.js -> build -> vueRouterMode
+    // the base comes from the server (BASE_URL), not from
     // quasar.conf.js -> build -> publicPath
-    history: createHistory(
-      process.env.MODE === 'ssr' ? void 0 : process.env.VUE_ROUTER_BASE
-    )
+    history: createHistory(process.env.MODE === 'ssr' ? void 0 : baseURL + '/')
   })
 
   return Router
@@ -1,14 +1,22 @@
 import {LocalStorage, Dark} from 'quasar'
 import {createStore} from 'vuex'
 
-import {notifyError} from './helpers'
-import {loadSettings, loadWallet, loadUser, appInfo, listAppItems} from './api'
+import {notifyError, baseURL} from './helpers'
+import {
+  loadSettings,
+  loadWallet,
+  loadUser,
+  loadPreferences,
+  appInfo,
+  listAppItems
+} from './api'
 
 export default createStore({
   state() {
     return {
       settings: {},
       user: null,
+      preferences: {},
       wallet: null,
       app: null,
       hasListeners: {}, // { [walletID]: true },
@@ -27,6 +35,9 @@ export default createStore({
     setUser(state, user) {
       state.user = user
     },
+    setPreferences(state, preferences) {
+      state.preferences = preferences
+    },
     setWallet(state, wallet) {
       if (!wallet) return
       state.wallet = wallet
@@ -81,6 +92,7 @@ export default createStore({
         notifyError(err)
       }
       commit('setUser', user)
+      dispatch('fetchPreferences')
 
       let keys = LocalStorage.getItem('lnbits.storedkeys')
       keys = keys.filter(k => k !== key)
@@ -92,6 +104,20 @@ export default createStore({
         dispatch('fetchWallet', user.wallets[0].id)
       }
     },
+    async fetchPreferences({commit}) {
+      try {
+        const preferences = await loadPreferences()
+        commit('setPreferences', preferences)
+
+        // the theme saved on the server wins over this browser's
+        if (preferences.theme) {
+          document.body.setAttribute('data-theme', preferences.theme)
+          LocalStorage.set('lnbits.theme', preferences.theme)
+        }
+      } catch (err) {
+        notifyError(err)
+      }
+    },
     async fetchWallet({state, commit, dispatch}, walletID) {
       try {
         const wallet = await loadWallet(walletID)
@@ -125,7 +151,7 @@ export default createStore({
 
       // listen for payments sent and received, and failures
       const payments = new EventSource(
-        `/api/wallet/sse?api-key=${state.wallet.adminkey}`
+        `${baseURL}/api/wallet/sse?api-key=${state.wallet.adminkey}`
       )
 
       payments.addEventListener('payment-sent', ev => {
@@ -148,7 +174,7 @@ export default createStore({
 
       // listen for app db changes (all apps for this wallet)
       const apps = new EventSource(
-        `/api/wallet/app/sse?api-key=${state.wallet.adminkey}`
+        `${baseURL}/api/wallet/app/sse?api-key=${state.wallet.adminkey}`
       )
       apps.addEventListener('print', ev => {
         const item = JSON.parse(ev.data)
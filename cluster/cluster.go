@@ -0,0 +1,296 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils"
+	"github.com/lucsky/cuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// with CLUSTER=true many instances can run against the same postgres database
+// behind a load balancer. whatever an instance sends to its stream and
+// websocket clients is also broadcast to the others with LISTEN/NOTIFY, so
+// clients get it no matter which instance they are connected to. payment events
+// already happen only once, on the instance that settles the payment in the
+// ledger. the background jobs that must also run only once are left to a
+// leader, elected by holding an advisory lock.
+//
+// broadcasts are best-effort like the streams themselves: what is sent while
+// an instance is reconnecting to the database is lost for its clients.
+
+const (
+	channel    = "lnbits_cluster"
+	leaderLock = 0x6c6e62 // "lnb", any number shared by all instances works
+
+	// postgres takes payloads of up to 8000 bytes, bigger messages are split
+	maxChunk = 7900
+)
+
+var ElectionInterval = time.Second * 10
+
+var (
+	Enabled bool
+
+	instance   = cuid.New()
+	sequence   int64
+	leading    int32
+	handlers   = make(map[string]func(json.RawMessage))
+	connString string
+	ctx        context.Context
+	cancel     context.CancelFunc
+)
+
+var log zerolog.Logger
+
+func SetLogger(logger zerolog.Logger) {
+	log = logger.With().Str("s", "cluster").Logger()
+}
+
+type envelope struct {
+	Topic string          `json:"t"`
+	Data  json.RawMessage `json:"d"`
+}
+
+// Start joins the cluster: it starts listening for the broadcasts of the other
+// instances and trying to become the leader.
+func Start(databaseConnectionString string) error {
+	if !strings.HasPrefix(databaseConnectionString, "postgres") {
+		return errors.New("cluster mode requires a postgres database")
+	}
+	connString = databaseConnectionString
+	ctx, cancel = context.WithCancel(context.Background())
+
+	conn, err := pgx.Connect(ctx, connString)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	conn.Close(ctx)
+
+	Enabled = true
+	go listen()
+	go elect()
+	return nil
+}
+
+// Stop leaves the cluster, releasing the leadership if we had it.
+func Stop() {
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Leading tells if this instance should run the jobs that must run only once,
+// which is always the case when not in a cluster.
+func Leading() bool {
+	return !Enabled || atomic.LoadInt32(&leading) == 1
+}
+
+// Subscribe sets the handler for a topic, called with whatever is published to
+// it on any instance. it must be called on init.
+func Subscribe(topic string, handler func(data json.RawMessage)) {
+	handlers[topic] = handler
+}
+
+// Publish calls the handler of topic on this instance and on all the others.
+func Publish(topic string, v interface{}) {
+	data, err := utils.JSONMarshal(v)
+	if err != nil {
+		log.Warn().Err(err).Str("topic", topic).Msg("failed to encode message")
+		return
+	}
+	if handler, ok := handlers[topic]; ok {
+		handler(data)
+	}
+	broadcast(topic, data)
+}
+
+// Broadcast calls the handler of topic only on the other instances.
+func Broadcast(topic string, v interface{}) {
+	data, err := utils.JSONMarshal(v)
+	if err != nil {
+		log.Warn().Err(err).Str("topic", topic).Msg("failed to encode message")
+		return
+	}
+	broadcast(topic, data)
+}
+
+func broadcast(topic string, data []byte) {
+	if !Enabled {
+		return
+	}
+
+	message, _ := json.Marshal(envelope{topic, data})
+	chunks := split(string(message))
+	id := instance + ":" + strconv.FormatInt(atomic.AddInt64(&sequence, 1), 10)
+
+	// notifications sent in a transaction are delivered together and in order
+	err := storage.DB.Transaction(func(tx *gorm.DB) error {
+		for i, chunk := range chunks {
+			payload := fmt.Sprintf("%s %d %d %s", id, i+1, len(chunks), chunk)
+			if err := tx.Exec("SELECT pg_notify(?, ?)", channel, payload).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("topic", topic).Msg("failed to broadcast message")
+	}
+}
+
+// split cuts message in chunks postgres accepts, without breaking characters.
+func split(message string) []string {
+	var chunks []string
+	for len(message) > maxChunk {
+		cut := maxChunk
+		for cut > 0 && !utf8.RuneStart(message[cut]) {
+			cut--
+		}
+		chunks = append(chunks, message[0:cut])
+		message = message[cut:]
+	}
+	return append(chunks, message)
+}
+
+func listen() {
+	for {
+		err := listenOn()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn().Err(err).Msg("lost the connection for cluster messages, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * 5):
+		}
+	}
+}
+
+func listenOn() error {
+	conn, err := pgx.Connect(ctx, connString)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+channel); err != nil {
+		return err
+	}
+
+	var assembler assembler
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		message, ok := assembler.add(notification.Payload)
+		if !ok {
+			continue
+		}
+
+		var env envelope
+		if err := json.Unmarshal([]byte(message), &env); err != nil {
+			log.Warn().Err(err).Msg("got an invalid cluster message")
+			continue
+		}
+		if handler, ok := handlers[env.Topic]; ok {
+			handler(env.Data)
+		}
+	}
+}
+
+// assembler puts split messages back together, skipping our own.
+type assembler struct {
+	id     string
+	chunks []string
+}
+
+func (a *assembler) add(payload string) (message string, complete bool) {
+	spl := strings.SplitN(payload, " ", 4)
+	if len(spl) != 4 || strings.HasPrefix(spl[0], instance+":") {
+		return "", false
+	}
+	i, _ := strconv.Atoi(spl[1])
+	n, _ := strconv.Atoi(spl[2])
+
+	if i == 1 {
+		a.id = spl[0]
+		a.chunks = make([]string, 0, n)
+	} else if spl[0] != a.id || i != len(a.chunks)+1 {
+		// we missed the beginning
+		return "", false
+	}
+	a.chunks = append(a.chunks, spl[3])
+
+	if len(a.chunks) < n {
+		return "", false
+	}
+	message = strings.Join(a.chunks, "")
+	a.id, a.chunks = "", nil
+	return message, true
+}
+
+// elect keeps trying to take the leader lock. the lock is held by the
+// connection, so it is released when the leader stops or loses its database.
+func elect() {
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+	}()
+
+	for {
+		if conn == nil {
+			var err error
+			if conn, err = pgx.Connect(ctx, connString); err != nil {
+				log.Warn().Err(err).Msg("failed to connect for leader election")
+				conn = nil
+			}
+		}
+
+		if conn != nil {
+			if atomic.LoadInt32(&leading) == 1 {
+				if _, err := conn.Exec(ctx, "SELECT 1"); err != nil {
+					atomic.StoreInt32(&leading, 0)
+					log.Warn().Err(err).Msg("lost the connection holding the leader lock, not leading anymore")
+					conn.Close(context.Background())
+					conn = nil
+				}
+			} else {
+				var got bool
+				if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", leaderLock).
+					Scan(&got); err != nil {
+					log.Warn().Err(err).Msg("failed to try the leader lock")
+					conn.Close(context.Background())
+					conn = nil
+				} else if got {
+					atomic.StoreInt32(&leading, 1)
+					log.Info().Msg("this instance is now the cluster leader")
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&leading, 0)
+			return
+		case <-time.After(ElectionInterval):
+		}
+	}
+}
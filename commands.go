@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/lnbits/infinity/ledger"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+)
+
+// commands are given as the first argument, without one the server is started.
+var commands = map[string]func(args []string){
+	"serve":             serve,
+	"migrate":           func(args []string) { migrate() },
+	"rotate-master-key": func(args []string) { rotateMasterKey() },
+	"export":            exportData,
+	"import":            importData,
+	"backup":            func(args []string) { createBackup() },
+	"restore":           restoreBackup,
+	"create-user":       createUser,
+	"create-wallet":     createWallet,
+	"check-ledger":      checkLedger,
+	"check":             checkLedger,
+	"help":              printUsage,
+}
+
+var usage = `usage: lnbits [--config <file>] [command]
+
+commands:
+  serve                            run the server (the default)
+  migrate                          apply the pending database migrations
+  rotate-master-key                re-encrypt the database with a new master key
+  export [file]                    write everything in the database to an archive
+  import <file>                    load an archive into an empty database
+  backup                           back up the database to BACKUP_DIR or S3
+  restore <backup>                 replace the database with a backup
+  create-user [wallet name]        create a user with one wallet
+  create-wallet <user id> [name]   create a wallet for a user
+  check-ledger [--repair]          check the ledger against the payments
+`
+
+func printUsage(args []string) {
+	os.Stderr.WriteString(usage)
+}
+
+// migrate applies the pending database migrations and exits, for deployments
+// that run with DATABASE_AUTO_MIGRATE=false.
+func migrate() {
+	if err := storage.Open(s.Database); err != nil {
+		log.Fatal().Err(err).Str("database", s.Database).
+			Msg("couldn't open database.")
+		return
+	}
+
+	applied, err := storage.Migrate()
+	for _, migration := range applied {
+		log.Info().Int("version", migration.Version).Str("name", migration.Name).
+			Msg("applied migration")
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("migration failed.")
+		return
+	}
+
+	version, _ := storage.SchemaVersion()
+	log.Info().Int("version", version).Int("applied", len(applied)).
+		Msg("database is up to date")
+}
+
+// exportData writes an archive with everything in the database to the given
+// file, or to stdout.
+func exportData(args []string) {
+	if err := storage.Connect(s.Database); err != nil {
+		log.Fatal().Err(err).Str("database", s.Database).
+			Msg("couldn't open database.")
+		return
+	}
+
+	var out io.Writer = os.Stdout
+	if len(args) > 0 && args[0] != "-" {
+		file, err := os.OpenFile(args[0], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal().Err(err).Msg("couldn't create export file.")
+			return
+		}
+		defer file.Close()
+		out = file
+	}
+
+	count, err := storage.Export(out)
+	if err != nil {
+		log.Fatal().Err(err).Msg("export failed.")
+		return
+	}
+	log.Info().Int("rows", count).Msg("exported")
+}
+
+// importData loads an archive created by export into an empty database.
+func importData(args []string) {
+	if len(args) == 0 {
+		log.Fatal().Msg("usage: lnbits import <file>")
+		return
+	}
+
+	if err := storage.Connect(s.Database); err != nil {
+		log.Fatal().Err(err).Str("database", s.Database).
+			Msg("couldn't open database.")
+		return
+	}
+
+	var in io.Reader = os.Stdin
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal().Err(err).Msg("couldn't open import file.")
+			return
+		}
+		defer file.Close()
+		in = file
+	}
+
+	count, err := storage.Import(in)
+	if err != nil {
+		log.Fatal().Err(err).Msg("import failed, nothing was changed.")
+		return
+	}
+	log.Info().Int("rows", count).Msg("imported")
+}
+
+// checkLedger validates the ledger against the payments and prints a report,
+// exiting with an error if anything is wrong. with --repair it fixes what it can.
+func checkLedger(args []string) {
+	repair := len(args) > 0 && args[0] == "--repair"
+
+	if err := storage.Connect(s.Database); err != nil {
+		log.Fatal().Err(err).Str("database", s.Database).
+			Msg("couldn't open database.")
+		return
+	}
+
+	report, err := ledger.Check(repair)
+	if err != nil {
+		log.Fatal().Err(err).Msg("check failed.")
+		return
+	}
+
+	printJSON(report)
+
+	if report.Repaired > 0 {
+		log.Info().Int("repaired", report.Repaired).Msg("repaired ledger")
+	}
+	if !report.OK() {
+		log.Fatal().Msg("ledger has problems.")
+		return
+	}
+	log.Info().Msg("ledger is consistent")
+}
+
+// createBackup creates a backup like the scheduled ones.
+func createBackup() {
+	if err := storage.Connect(s.Database); err != nil {
+		log.Fatal().Err(err).Str("database", s.Database).
+			Msg("couldn't open database.")
+		return
+	}
+
+	backup, err := storage.CreateBackup()
+	if err != nil {
+		log.Fatal().Err(err).Msg("backup failed.")
+		return
+	}
+	log.Info().Str("name", backup.Name).Int64("size", backup.Size).
+		Str("location", backup.Location).Msg("database backed up")
+}
+
+// restoreBackup replaces the database with a backup, the server must not be
+// running.
+func restoreBackup(args []string) {
+	if len(args) == 0 {
+		log.Fatal().Msg("usage: lnbits restore <backup name or file>")
+		return
+	}
+
+	if err := storage.RestoreBackup(s.Database, args[0]); err != nil {
+		log.Fatal().Err(err).Msg("restore failed.")
+		return
+	}
+	log.Info().Str("backup", args[0]).Msg("database restored")
+}
+
+// createUser creates a user with a wallet and prints their keys.
+func createUser(args []string) {
+	if err := storage.Connect(s.Database); err != nil {
+		log.Fatal().Err(err).Str("database", s.Database).
+			Msg("couldn't open database.")
+		return
+	}
+
+	name := s.DefaultWalletName
+	if len(args) > 0 {
+		name = strings.Join(args, " ")
+	}
+
+	user, err := services.CreateUser()
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't create user.")
+		return
+	}
+	wallet, err := services.CreateWallet(user.ID, name)
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't create wallet.")
+		return
+	}
+
+	printJSON(struct {
+		ID        string         `json:"id"`
+		MasterKey string         `json:"masterkey"`
+		Wallet    *models.Wallet `json:"wallet"`
+	}{user.ID, string(user.MasterKey), wallet})
+}
+
+// createWallet adds a wallet to an existing user and prints its keys.
+func createWallet(args []string) {
+	if len(args) == 0 {
+		log.Fatal().Msg("usage: lnbits create-wallet <user id> [name]")
+		return
+	}
+
+	if err := storage.Connect(s.Database); err != nil {
+		log.Fatal().Err(err).Str("database", s.Database).
+			Msg("couldn't open database.")
+		return
+	}
+
+	var user models.User
+	if err := storage.DB.Where("id = ?", args[0]).First(&user).Error; err != nil {
+		log.Fatal().Err(err).Str("user", args[0]).Msg("couldn't find user.")
+		return
+	}
+
+	name := s.DefaultWalletName
+	if len(args) > 1 {
+		name = strings.Join(args[1:], " ")
+	}
+	wallet, err := services.CreateWallet(user.ID, name)
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't create wallet.")
+		return
+	}
+
+	printJSON(wallet)
+}
+
+func printJSON(value interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(value)
+}
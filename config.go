@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// settings can also be given in a YAML or TOML file, passed with --config or in
+// CONFIG_FILE. its keys are the environment variable names, in any case, and
+// nested tables are joined with "_" (so `lnd: {host: ...}` is LND_HOST). lists
+// become comma-separated values. environment variables take precedence over the
+// file, which takes precedence over the defaults.
+
+// configFileArg removes --config from the arguments and returns its value.
+func configFileArg() string {
+	path := os.Getenv("CONFIG_FILE")
+
+	args := []string{os.Args[0]}
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		switch {
+		case arg == "--config" && i+1 < len(os.Args):
+			path = os.Args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--config="):
+			path = strings.TrimPrefix(arg, "--config=")
+		default:
+			args = append(args, arg)
+		}
+	}
+	os.Args = args
+
+	return path
+}
+
+var configPath string
+
+// the variables we took from the file, so on reload they can be replaced with
+// the new values while real environment variables still take precedence.
+var configFileVars = make(map[string]bool)
+
+// loadConfigFile sets the environment variables from the file that aren't
+// already set.
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	vars := make(map[string]string)
+	flattenConfig("", values, vars)
+
+	for name := range configFileVars {
+		os.Unsetenv(name)
+	}
+	configFileVars = make(map[string]bool)
+	for name, value := range vars {
+		if _, set := os.LookupEnv(name); !set {
+			os.Setenv(name, value)
+			configFileVars[name] = true
+		}
+	}
+
+	return nil
+}
+
+func flattenConfig(prefix string, values map[string]interface{}, vars map[string]string) {
+	for key, value := range values {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenConfig(name, v, vars)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			vars[name] = strings.Join(items, ",")
+		case nil:
+			vars[name] = ""
+		default:
+			vars[name] = fmt.Sprint(v)
+		}
+	}
+}
+
+// secrets can also be read from files, for docker secrets and credentials
+// mounted by kubernetes: if NAME_FILE is set, NAME gets the contents of that
+// file without the trailing newline. the lnd macaroon and certificate are
+// files already, and MASTER_KEY_FILE is read along with the master key.
+var secretSettings = []string{
+	"DATABASE",
+	"SECRET",
+	"ADMIN_KEY",
+	"METRICS_TOKEN",
+	"PREVIOUS_MASTER_KEYS",
+	"TOR_CONTROL_PASSWORD",
+	"BACKUP_S3_ACCESS_KEY",
+	"BACKUP_S3_SECRET_KEY",
+	"SPARKO_TOKEN",
+	"ECLAIR_PASSWORD",
+	"VAULT_TOKEN",
+	"SMTP_PASSWORD",
+	"TELEGRAM_TOKEN",
+	"MATRIX_ACCESS_TOKEN",
+	"RATE_URL",
+	"MQTT_URL",
+	"REDIS_URL",
+	"AMQP_URL",
+}
+
+// the variables we read from files, so on reload they are read again.
+var secretFileVars = make(map[string]bool)
+
+// loadSecretFiles sets the secret environment variables from their files.
+func loadSecretFiles() error {
+	for name := range secretFileVars {
+		os.Unsetenv(name)
+	}
+	secretFileVars = make(map[string]bool)
+
+	for _, name := range secretSettings {
+		path := os.Getenv(name + "_FILE")
+		if path == "" {
+			continue
+		}
+		if _, set := os.LookupEnv(name); set {
+			return fmt.Errorf("both %s and %s_FILE are set", name, name)
+		}
+
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_FILE: %w", name, err)
+		}
+		os.Setenv(name, strings.TrimRight(string(contents), "\r\n"))
+		secretFileVars[name] = true
+	}
+
+	return nil
+}
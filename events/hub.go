@@ -3,6 +3,7 @@ package events
 import (
 	"os"
 
+	"github.com/lnbits/infinity/ledger"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/storage"
 	"github.com/lnbits/relampago"
@@ -23,10 +24,15 @@ var log = zerolog.
 	Str("s", "events").
 	Logger()
 
+func SetLogger(logger zerolog.Logger) {
+	log = logger.With().Str("s", "events").Logger()
+}
+
 var subs = struct {
 	paymentReceived []chan models.Payment
 	paymentSent     []chan models.Payment
 	paymentFailed   []chan models.Payment
+	invoiceCreated  []chan models.Payment
 	genericEvent    []chan GenericEvent
 }{}
 
@@ -42,6 +48,10 @@ func OnPaymentFailed(c chan models.Payment) {
 	subs.paymentFailed = append(subs.paymentFailed, c)
 }
 
+func OnInvoiceCreated(c chan models.Payment) {
+	subs.invoiceCreated = append(subs.invoiceCreated, c)
+}
+
 func OnGenericEvent(c chan GenericEvent) {
 	subs.genericEvent = append(subs.genericEvent, c)
 }
@@ -63,20 +73,18 @@ func NotifyInvoicePaid(status relampago.InvoiceStatus) {
 
 	log = log.With().Interface("payment", payment).Logger()
 
-	result = storage.DB.
-		Model(&models.Payment{}).
-		Where("checking_id = ?", status.CheckingID).
-		Where("amount > 0"). // means this is the receiver side of a payment, just in case
-		Where("pending").
-		Updates(map[string]interface{}{
-			"pending": false,
-			"amount":  status.MSatoshiReceived,
-		})
-	if result.Error != nil {
-		log.Warn().Err(result.Error).Interface("payment", payment).
+	settled, err := ledger.SettleIncoming(status.CheckingID, status.MSatoshiReceived)
+	if err != nil {
+		log.Warn().Err(err).Interface("payment", payment).
 			Msg("failed to update payment received")
 	}
+	if !settled {
+		// not pending anymore, someone else has already handled it
+		return
+	}
 
+	payment.Pending = false
+	payment.Amount = status.MSatoshiReceived
 	EmitPaymentReceived(payment)
 }
 
@@ -99,39 +107,34 @@ func NotifyPaymentSentStatus(status relampago.PaymentStatus) {
 
 	switch status.Status {
 	case relampago.Failed:
-		result := storage.DB.
-			Model(&payment).
-			Where("checking_id = ?", status.CheckingID).
-			Where("pending").
-			Delete(&models.Payment{})
-
-		if result.Error != nil {
-			log.Warn().Err(result.Error).
+		failed, err := ledger.FailOutgoing(status.CheckingID)
+		if err != nil {
+			log.Warn().Err(err).
 				Msg("failed to delete failed sent payment")
 			return
 		}
+		if !failed {
+			return
+		}
 
 		EmitPaymentFailed(payment)
 
 		return
 
 	case relampago.Complete:
-		result := storage.DB.
-			Model(&payment).
-			Where("checking_id = ?", status.CheckingID).
-			Where("amount < 0"). // means this is the sender side of a payment, just in case
-			Where("pending").
-			Updates(map[string]interface{}{
-				"pending":  false,
-				"preimage": status.Preimage,
-				"fee":      status.FeePaid,
-			})
-
-		if result.Error != nil {
-			log.Warn().Err(result.Error).
+		completed, err := ledger.CompleteOutgoing(
+			status.CheckingID, status.Preimage, status.FeePaid)
+		if err != nil {
+			log.Warn().Err(err).
 				Msg("failed to update payment successfully sent sent")
 		}
+		if !completed {
+			return
+		}
 
+		payment.Pending = false
+		payment.Preimage = models.EncryptedString(status.Preimage)
+		payment.Fee = status.FeePaid
 		EmitPaymentSent(payment)
 	}
 }
@@ -154,6 +157,12 @@ func EmitPaymentFailed(payment models.Payment) {
 	}
 }
 
+func EmitInvoiceCreated(payment models.Payment) {
+	for _, c := range subs.invoiceCreated {
+		c <- payment
+	}
+}
+
 func EmitGenericEvent(name string, data interface{}) {
 	for _, c := range subs.genericEvent {
 		c <- GenericEvent{
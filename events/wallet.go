@@ -0,0 +1,62 @@
+package events
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+)
+
+// WalletEvent is an invoice or payment as given to brokers outside, without
+// the preimage and the webhook of the payment.
+type WalletEvent struct {
+	Event       string            `json:"event"`
+	WalletID    string            `json:"wallet"`
+	CheckingID  string            `json:"checking_id"`
+	Hash        string            `json:"hash"`
+	Amount      int64             `json:"amount"` // msat, negative when outgoing
+	Fee         int64             `json:"fee"`
+	Pending     bool              `json:"pending"`
+	Description string            `json:"description"`
+	Bolt11      string            `json:"bolt11,omitempty"`
+	Tag         string            `json:"tag,omitempty"`
+	Extra       models.JSONObject `json:"extra,omitempty"`
+	Time        int64             `json:"time"`
+}
+
+// OnWalletEvents calls handle with every invoice-created, payment-received,
+// payment-sent and payment-failed. handle must not block, the payments wait
+// for it.
+func OnWalletEvents(handle func(WalletEvent)) {
+	forward := func(event string, register func(chan models.Payment)) {
+		c := make(chan models.Payment)
+		register(c)
+		go func() {
+			for payment := range c {
+				handle(WalletEvent{
+					Event:       event,
+					WalletID:    payment.WalletID,
+					CheckingID:  payment.CheckingID,
+					Hash:        payment.Hash,
+					Amount:      payment.Amount,
+					Fee:         payment.Fee,
+					Pending:     payment.Pending,
+					Description: payment.Description,
+					Bolt11:      payment.Bolt11,
+					Tag:         payment.Tag,
+					Extra:       payment.Extra,
+					Time:        time.Now().Unix(),
+				})
+			}
+		}()
+	}
+	forward("invoice-created", OnInvoiceCreated)
+	forward("payment-received", OnPaymentReceived)
+	forward("payment-sent", OnPaymentSent)
+	forward("payment-failed", OnPaymentFailed)
+}
+
+// Expand replaces {wallet} and {event} in a topic or channel name.
+func (e WalletEvent) Expand(template string) string {
+	return strings.NewReplacer("{wallet}", e.WalletID, "{event}", e.Event).Replace(template)
+}
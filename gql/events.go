@@ -0,0 +1,117 @@
+package gql
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/lnbits/infinity/cluster"
+	"github.com/lnbits/infinity/events"
+	"github.com/lnbits/infinity/models"
+)
+
+// payment events go through the cluster like the ones of rpc, so a subscription
+// gets the payments of its wallet from every instance. the payment is encoded
+// with encoding/json on its own since the cluster messages have their times as
+// unix numbers, which a models.Payment can't be decoded from.
+
+type paymentEvent struct {
+	Type     string `json:"type"`
+	WalletID string `json:"wallet"`
+	Payment  []byte `json:"payment"`
+}
+
+var (
+	subscriptionsMutex sync.Mutex
+	subscriptions      = make(map[string]map[chan *paymentEventResolver]bool) // wallet id -> subscriptions
+	stopping           = make(chan struct{})
+	stopOnce           sync.Once
+)
+
+func init() {
+	cluster.Subscribe("graphql_payments", func(data json.RawMessage) {
+		var event paymentEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return
+		}
+		dispatch(event)
+	})
+}
+
+// Start sends the payments of this instance to the subscriptions.
+func Start() {
+	forward := func(typ string, register func(chan models.Payment)) {
+		c := make(chan models.Payment)
+		register(c)
+		go func() {
+			for payment := range c {
+				encoded, err := json.Marshal(payment)
+				if err != nil {
+					log.Warn().Err(err).Str("payment", payment.CheckingID).Msg("failed to encode payment event")
+					continue
+				}
+				cluster.Publish("graphql_payments", paymentEvent{typ, payment.WalletID, encoded})
+			}
+		}()
+	}
+	forward("RECEIVED", events.OnPaymentReceived)
+	forward("SENT", events.OnPaymentSent)
+	forward("FAILED", events.OnPaymentFailed)
+}
+
+// Stop closes the websockets, the server doesn't wait for them when stopping.
+func Stop() {
+	stopOnce.Do(func() { close(stopping) })
+}
+
+func subscribe(walletID string) (<-chan *paymentEventResolver, func()) {
+	c := make(chan *paymentEventResolver, 16)
+
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+	if subscriptions[walletID] == nil {
+		subscriptions[walletID] = make(map[chan *paymentEventResolver]bool)
+	}
+	subscriptions[walletID][c] = true
+
+	return c, func() {
+		subscriptionsMutex.Lock()
+		defer subscriptionsMutex.Unlock()
+		delete(subscriptions[walletID], c)
+		if len(subscriptions[walletID]) == 0 {
+			delete(subscriptions, walletID)
+		}
+	}
+}
+
+func dispatch(event paymentEvent) {
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+	if len(subscriptions[event.WalletID]) == 0 {
+		return
+	}
+
+	var payment models.Payment
+	if err := json.Unmarshal(event.Payment, &payment); err != nil {
+		log.Warn().Err(err).Msg("failed to decode payment event")
+		return
+	}
+	for c := range subscriptions[event.WalletID] {
+		select {
+		case c <- &paymentEventResolver{event.Type, paymentResolver{payment}}:
+		default:
+			// a subscription that doesn't keep up misses events instead of holding the others
+			log.Warn().Str("wallet", event.WalletID).Msg("graphql payment subscription is full")
+		}
+	}
+}
+
+// Subscriptions counts the payment subscriptions open on this instance.
+func Subscriptions() int {
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+	count := 0
+	for _, set := range subscriptions {
+		count += len(set)
+	}
+	return count
+}
@@ -0,0 +1,158 @@
+package gql
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"github.com/rs/zerolog"
+)
+
+// the wallets, payments and app items in one schema, for frontends that want to
+// get all a view needs with one request. it is read-only, what changes anything
+// goes through the REST API. queries are served on /api/graphql and the payment
+// subscription also on /api/graphql/ws, with the graphql-transport-ws protocol.
+
+var log zerolog.Logger
+
+func SetLogger(logger zerolog.Logger) {
+	log = logger.With().Str("s", "graphql").Logger()
+}
+
+//go:embed schema.graphql
+var schemaString string
+
+var schema = graphql.MustParseSchema(schemaString, &resolver{},
+	graphql.MaxDepth(8),
+	graphql.Logger(panicLogger{}),
+)
+
+type panicLogger struct{}
+
+func (panicLogger) LogPanic(ctx context.Context, value interface{}) {
+	log.Error().Interface("panic", value).Msg("panic resolving a query")
+}
+
+type request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Handler runs the queries of a GET querystring or a POST JSON body.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	var req request
+	switch r.Method {
+	case "GET":
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				apiutils.SendJSONError(w, 400, "invalid variables: %s", err.Error())
+				return
+			}
+		}
+	case "POST":
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			apiutils.SendJSONError(w, 400, "failed to read request: %s", err.Error())
+			return
+		}
+	default:
+		apiutils.SendJSONError(w, 405, "use GET or POST")
+		return
+	}
+	if req.Query == "" {
+		apiutils.SendJSONError(w, 400, "query is empty")
+		return
+	}
+
+	a, err := authenticate(requestKeys(r))
+	if err != nil {
+		apiutils.SendJSONError(w, 401, "%s", err.Error())
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), accessKey{}, a)
+	response := schema.Exec(ctx, req.Query, req.OperationName, req.Variables)
+	json.NewEncoder(w).Encode(response)
+}
+
+// access is what the keys of a request can see: the wallet of a wallet key or
+// all the wallets of a master key, with admin permission.
+type access struct {
+	wallets    []*models.Wallet
+	permission string
+}
+
+type accessKey struct{}
+
+func accessFrom(ctx context.Context) *access {
+	return ctx.Value(accessKey{}).(*access)
+}
+
+func (a *access) wallet(id *graphql.ID) (*walletResolver, error) {
+	if id == nil {
+		if len(a.wallets) != 1 {
+			return nil, errors.New("the wallet id is needed with a master key")
+		}
+		return &walletResolver{a.wallets[0], a.permission}, nil
+	}
+	for _, wallet := range a.wallets {
+		if wallet.ID == string(*id) {
+			return &walletResolver{wallet, a.permission}, nil
+		}
+	}
+	return nil, errors.New("wallet not found")
+}
+
+type keys struct {
+	apiKey    string
+	masterKey string
+}
+
+func requestKeys(r *http.Request) keys {
+	k := keys{
+		apiKey:    r.Header.Get("X-Api-Key"),
+		masterKey: r.Header.Get("X-MasterKey"),
+	}
+	if k.apiKey == "" {
+		k.apiKey = r.URL.Query().Get("api-key")
+	}
+	return k
+}
+
+func authenticate(k keys) (*access, error) {
+	switch {
+	case k.apiKey != "":
+		wallet, err := storage.Default.GetWalletByKey(k.apiKey)
+		if err != nil {
+			return nil, errors.New("invalid X-Api-Key")
+		}
+		permission := "invoice"
+		if string(wallet.AdminKey) == k.apiKey {
+			permission = "admin"
+		}
+		return &access{[]*models.Wallet{wallet}, permission}, nil
+	case k.masterKey != "":
+		user, err := storage.Default.GetUserByMasterKey(k.masterKey)
+		if err != nil {
+			return nil, errors.New("invalid X-MasterKey")
+		}
+		list, err := storage.Default.ListUserWallets(user.ID)
+		if err != nil {
+			return nil, errors.New("failed to load wallets")
+		}
+		a := &access{make([]*models.Wallet, len(list)), "admin"}
+		for i := range list {
+			a.wallets[i] = &list[i]
+		}
+		return a, nil
+	}
+	return nil, errors.New("X-Api-Key or X-MasterKey header not provided")
+}
@@ -0,0 +1,299 @@
+package gql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/lnbits/infinity/apps"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	"gorm.io/gorm"
+)
+
+// MaxPageSize is the most payments or items a connection returns at once.
+var MaxPageSize = 1000
+
+type resolver struct{}
+
+func (resolver) Wallet(ctx context.Context, args struct{ ID *graphql.ID }) (*walletResolver, error) {
+	return accessFrom(ctx).wallet(args.ID)
+}
+
+func (resolver) Wallets(ctx context.Context) []*walletResolver {
+	a := accessFrom(ctx)
+	wallets := make([]*walletResolver, len(a.wallets))
+	for i, wallet := range a.wallets {
+		wallets[i] = &walletResolver{wallet, a.permission}
+	}
+	return wallets
+}
+
+func (resolver) Payments(ctx context.Context, args struct{ WalletID *graphql.ID }) (
+	<-chan *paymentEventResolver, error,
+) {
+	w, err := accessFrom(ctx).wallet(args.WalletID)
+	if err != nil {
+		return nil, err
+	}
+
+	events, cancel := subscribe(w.wallet.ID)
+	c := make(chan *paymentEventResolver)
+	go func() {
+		defer close(c)
+		defer cancel()
+		for {
+			select {
+			case event := <-events:
+				select {
+				case c <- event:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-stopping:
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+type walletResolver struct {
+	wallet     *models.Wallet
+	permission string
+}
+
+func (w *walletResolver) ID() graphql.ID     { return graphql.ID(w.wallet.ID) }
+func (w *walletResolver) Name() string       { return w.wallet.Name }
+func (w *walletResolver) Permission() string { return w.permission }
+
+func (w *walletResolver) Balance() (float64, error) {
+	balance, err := services.LoadWalletBalance(w.wallet.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load balance: %w", err)
+	}
+	return float64(balance), nil
+}
+
+type paymentsArgs struct {
+	First     int32
+	After     *string
+	Search    *string
+	Pending   *bool
+	Direction *string
+	Tag       *string
+	Since     *graphql.Time
+	Until     *graphql.Time
+}
+
+func (w *walletResolver) Payments(args paymentsArgs) (*paymentConnection, error) {
+	query := storage.PaymentsQuery{
+		Limit:   pageSize(args.First),
+		Cursor:  deref(args.After),
+		Search:  deref(args.Search),
+		Pending: args.Pending,
+		Tag:     deref(args.Tag),
+	}
+	if args.Direction != nil {
+		query.Direction = strings.ToLower(*args.Direction)
+	}
+	if args.Since != nil {
+		query.Since = args.Since.Time
+	}
+	if args.Until != nil {
+		query.Until = args.Until.Time
+	}
+
+	payments, next, err := storage.Default.ListPayments(w.wallet.ID, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load payments: %w", err)
+	}
+
+	connection := &paymentConnection{nodes: make([]*paymentResolver, len(payments))}
+	for i, payment := range payments {
+		connection.nodes[i] = &paymentResolver{payment}
+	}
+	if next != "" {
+		connection.next = &next
+	}
+	return connection, nil
+}
+
+func (w *walletResolver) Payment(args struct{ ID string }) (*paymentResolver, error) {
+	payment, err := storage.Default.GetPayment(w.wallet.ID, args.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load payment: %w", err)
+	}
+	return &paymentResolver{*payment}, nil
+}
+
+func (w *walletResolver) Apps() ([]string, error) {
+	if err := w.requireAdmin(); err != nil {
+		return nil, err
+	}
+	list, err := storage.Default.ListUserApps(w.wallet.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load apps: %w", err)
+	}
+	return list, nil
+}
+
+type itemsArgs struct {
+	App    string
+	Model  string
+	First  int32
+	After  *string
+	Prefix *string
+	Sort   *string
+}
+
+func (w *walletResolver) Items(args itemsArgs) (*itemConnection, error) {
+	if err := w.requireAdmin(); err != nil {
+		return nil, err
+	}
+
+	limit := pageSize(args.First)
+	sort := deref(args.Sort)
+	items, err := apps.DBList(w.wallet.ID, args.App, args.Model, map[string]interface{}{
+		"cursor": deref(args.After),
+		"prefix": deref(args.Prefix),
+		"sort":   sort,
+		"limit":  limit,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list items: %w", err)
+	}
+
+	connection := &itemConnection{nodes: make([]*itemResolver, len(items))}
+	for i, item := range items {
+		connection.nodes[i] = &itemResolver{item}
+	}
+	if len(items) == limit && (sort == "" || sort == "key") {
+		connection.next = &items[len(items)-1].Key
+	}
+	return connection, nil
+}
+
+func (w *walletResolver) Item(args struct{ App, Model, Key string }) (*itemResolver, error) {
+	if err := w.requireAdmin(); err != nil {
+		return nil, err
+	}
+
+	item, err := storage.Default.GetAppItem(w.wallet.ID, args.App, args.Model, args.Key)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get item: %w", err)
+	}
+
+	// the computed values are filled in by DBGet
+	value, err := apps.DBGet(w.wallet.ID, args.App, args.Model, args.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get item: %w", err)
+	}
+	item.Value = value
+	return &itemResolver{*item}, nil
+}
+
+func (w *walletResolver) requireAdmin() error {
+	if w.permission != "admin" {
+		return errors.New("this needs the admin key")
+	}
+	return nil
+}
+
+type paymentConnection struct {
+	nodes []*paymentResolver
+	next  *string
+}
+
+func (c *paymentConnection) Nodes() []*paymentResolver { return c.nodes }
+func (c *paymentConnection) Next() *string             { return c.next }
+
+type paymentResolver struct{ p models.Payment }
+
+func (r *paymentResolver) CheckingID() string      { return r.p.CheckingID }
+func (r *paymentResolver) Hash() string            { return r.p.Hash }
+func (r *paymentResolver) Pending() bool           { return r.p.Pending }
+func (r *paymentResolver) Amount() float64         { return float64(r.p.Amount) }
+func (r *paymentResolver) Fee() float64            { return float64(r.p.Fee) }
+func (r *paymentResolver) Description() string     { return r.p.Description }
+func (r *paymentResolver) Bolt11() string          { return r.p.Bolt11 }
+func (r *paymentResolver) Preimage() string        { return string(r.p.Preimage) }
+func (r *paymentResolver) Tag() string             { return r.p.Tag }
+func (r *paymentResolver) Extra() *jsonValue       { return toJSON(r.p.Extra) }
+func (r *paymentResolver) Webhook() string         { return r.p.Webhook }
+func (r *paymentResolver) CreatedAt() graphql.Time { return graphql.Time{Time: r.p.CreatedAt} }
+func (r *paymentResolver) WalletID() graphql.ID    { return graphql.ID(r.p.WalletID) }
+
+type itemConnection struct {
+	nodes []*itemResolver
+	next  *string
+}
+
+func (c *itemConnection) Nodes() []*itemResolver { return c.nodes }
+func (c *itemConnection) Next() *string          { return c.next }
+
+type itemResolver struct{ item models.AppDataItem }
+
+func (r *itemResolver) Model() string           { return r.item.Model }
+func (r *itemResolver) Key() string             { return r.item.Key }
+func (r *itemResolver) Value() *jsonValue       { return toJSON(r.item.Value) }
+func (r *itemResolver) CreatedAt() graphql.Time { return graphql.Time{Time: r.item.CreatedAt} }
+func (r *itemResolver) UpdatedAt() graphql.Time { return graphql.Time{Time: r.item.UpdatedAt} }
+
+type paymentEventResolver struct {
+	typ     string
+	payment paymentResolver
+}
+
+func (r *paymentEventResolver) Type() string              { return r.typ }
+func (r *paymentEventResolver) Payment() *paymentResolver { return &r.payment }
+
+// jsonValue is the JSON scalar, an object given as it is.
+type jsonValue struct{ value map[string]interface{} }
+
+func toJSON(value map[string]interface{}) *jsonValue {
+	if value == nil {
+		return nil
+	}
+	return &jsonValue{value}
+}
+
+func (jsonValue) ImplementsGraphQLType(name string) bool { return name == "JSON" }
+
+func (j *jsonValue) UnmarshalGraphQL(input interface{}) error {
+	value, ok := input.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("a JSON must be an object, not %T", input)
+	}
+	j.value = value
+	return nil
+}
+
+func (j jsonValue) MarshalJSON() ([]byte, error) { return json.Marshal(j.value) }
+
+func pageSize(first int32) int {
+	if first <= 0 {
+		return 50
+	}
+	if int(first) > MaxPageSize {
+		return MaxPageSize
+	}
+	return int(first)
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,200 @@
+package gql
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+// the graphql-transport-ws protocol: the client sends connection_init, which
+// may have the keys in its payload since browsers can't set headers on a
+// websocket, then subscribe messages that get next messages until complete.
+
+const (
+	wsInitWait   = 10 * time.Second
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 25 * time.Second
+	wsMaxMessage = 64 * 1024
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{"graphql-transport-ws"},
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type wsConn struct {
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+
+	mutex      sync.Mutex
+	operations map[string]context.CancelFunc
+}
+
+// WebSocket serves queries and subscriptions over graphql-transport-ws.
+func WebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Debug().Err(err).Msg("failed to upgrade graphql websocket")
+		return
+	}
+	wc := &wsConn{conn: conn, operations: make(map[string]context.CancelFunc)}
+	defer conn.Close()
+
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsInitWait))
+
+	// the first message must be connection_init
+	var init wsMessage
+	if err := conn.ReadJSON(&init); err != nil || init.Type != "connection_init" {
+		wc.close(4400, "expected connection_init")
+		return
+	}
+	k := requestKeys(r)
+	if len(init.Payload) > 0 {
+		var payload map[string]string
+		json.Unmarshal(init.Payload, &payload)
+		for name, value := range payload {
+			switch name {
+			case "X-Api-Key", "apiKey", "api-key":
+				k.apiKey = value
+			case "X-MasterKey", "masterKey":
+				k.masterKey = value
+			}
+		}
+	}
+	a, err := authenticate(k)
+	if err != nil {
+		wc.close(4403, err.Error())
+		return
+	}
+	wc.send(wsMessage{Type: "connection_ack"})
+
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), accessKey{}, a))
+	defer cancel()
+	go wc.keepAlive(ctx)
+
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+	for {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case "ping":
+			wc.send(wsMessage{Type: "pong"})
+		case "pong":
+		case "subscribe":
+			var req request
+			if err := json.Unmarshal(msg.Payload, &req); err != nil || msg.ID == "" {
+				wc.close(4400, "invalid subscribe message")
+				return
+			}
+			if !wc.start(ctx, msg.ID, req) {
+				wc.close(4409, "subscriber for "+msg.ID+" already exists")
+				return
+			}
+		case "complete":
+			wc.stop(msg.ID)
+		default:
+			wc.close(4400, "unexpected "+msg.Type+" message")
+			return
+		}
+	}
+}
+
+func (wc *wsConn) start(ctx context.Context, id string, req request) bool {
+	wc.mutex.Lock()
+	defer wc.mutex.Unlock()
+	if _, exists := wc.operations[id]; exists {
+		return false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	wc.operations[id] = cancel
+
+	go func() {
+		responses, err := schema.Subscribe(ctx, req.Query, req.OperationName, req.Variables)
+		if err != nil {
+			payload, _ := json.Marshal([]map[string]string{{"message": err.Error()}})
+			wc.send(wsMessage{ID: id, Type: "error", Payload: payload})
+			wc.stop(id)
+			return
+		}
+		for response := range responses {
+			payload, _ := json.Marshal(response)
+			wc.send(wsMessage{ID: id, Type: "next", Payload: payload})
+		}
+		// the client doesn't want a complete for what it completed itself
+		if ctx.Err() == nil {
+			wc.send(wsMessage{ID: id, Type: "complete"})
+		}
+		wc.stop(id)
+	}()
+	return true
+}
+
+func (wc *wsConn) stop(id string) {
+	wc.mutex.Lock()
+	defer wc.mutex.Unlock()
+	if cancel, ok := wc.operations[id]; ok {
+		cancel()
+		delete(wc.operations, id)
+	}
+}
+
+func (wc *wsConn) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			wc.writeMutex.Lock()
+			wc.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err := wc.conn.WriteMessage(websocket.PingMessage, nil)
+			wc.writeMutex.Unlock()
+			if err != nil {
+				return
+			}
+		case <-stopping:
+			wc.close(websocket.CloseGoingAway, "server is shutting down")
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (wc *wsConn) send(msg wsMessage) {
+	wc.writeMutex.Lock()
+	defer wc.writeMutex.Unlock()
+	wc.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	wc.conn.WriteJSON(msg)
+}
+
+// close ends the connection with one of the codes of the protocol, which also
+// stops the read loop.
+func (wc *wsConn) close(code int, reason string) {
+	wc.writeMutex.Lock()
+	defer wc.writeMutex.Unlock()
+	wc.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+	wc.conn.Close()
+}
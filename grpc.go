@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"net"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/rpc"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// with GRPC_PORT set the services of rpc/infinity.proto are served on it, with
+// the certificate of the http server when there is one. calls go through the
+// same bans and rate limits as http requests and the ones that change
+// something are in the audit log, with the method as the action.
+
+// the rate limit classes of the methods, the ones here are audited too.
+var grpcWriteMethods = map[string]string{
+	"/infinity.Wallets/CreateInvoice": classWrites,
+	"/infinity.Wallets/PayInvoice":    classPayments,
+	"/infinity.Apps/SetItem":          classWrites,
+	"/infinity.Apps/AddItem":          classWrites,
+	"/infinity.Apps/DeleteItem":       classWrites,
+}
+
+var grpcServer *grpc.Server
+
+func serveGRPC(tlsConfig *tls.Config) {
+	options := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig.Clone())))
+	}
+	grpcServer = grpc.NewServer(options...)
+	rpc.Register(grpcServer)
+	rpc.Start()
+
+	listener, err := net.Listen("tcp", s.Host+":"+s.GRPCPort)
+	if err != nil {
+		log.Fatal().Err(err).Str("port", s.GRPCPort).Msg("couldn't listen for grpc.")
+		return
+	}
+	log.Info().Str("host", listener.Addr().String()).Bool("tls", tlsConfig != nil).
+		Msg("grpc listening")
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Fatal().Err(err).Msg("error serving grpc")
+		}
+	}()
+}
+
+// stopGRPC waits for the calls being served, streams are ended right away.
+func stopGRPC(ctx context.Context) {
+	if grpcServer == nil {
+		return
+	}
+	rpc.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn().Msg("grpc calls still running after shutdown timeout")
+		grpcServer.Stop()
+	}
+}
+
+func grpcUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx, err := authorizeGRPC(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := handler(ctx, req)
+	if _, ok := grpcWriteMethods[info.FullMethod]; ok {
+		auditGRPC(ctx, info.FullMethod, err)
+	}
+	if info.FullMethod == "/infinity.Wallets/CreateInvoice" {
+		ip, key := grpcBanSubjects(ctx)
+		for _, subject := range []string{ip, key} {
+			if subject != "" {
+				bans.strike(subject, strikeInvoices, time.Now())
+			}
+		}
+	}
+	return resp, err
+}
+
+func grpcStreamInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx, err := authorizeGRPC(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authorizedStream{stream, ctx})
+}
+
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (as *authorizedStream) Context() context.Context { return as.ctx }
+
+// authorizeGRPC does for a call what the ban, rate limit and wallet middlewares
+// do for a request.
+func authorizeGRPC(ctx context.Context, method string) (context.Context, error) {
+	requestID := firstMetadata(ctx, "x-request-id")
+	if !requestIDValidator.MatchString(requestID) {
+		requestID = utils.RandomHex(8)
+	}
+	ctx = context.WithValue(ctx, "requestID", requestID)
+
+	now := time.Now()
+	ip, key := grpcBanSubjects(ctx)
+	for _, subject := range []string{ip, key} {
+		if subject == "" {
+			continue
+		}
+		if banned, until := bans.banned(subject, now); banned {
+			if until.IsZero() {
+				return ctx, status.Error(codes.PermissionDenied, "banned")
+			}
+			return ctx, status.Errorf(codes.PermissionDenied,
+				"banned for abuse, try again in %d seconds", int(math.Ceil(until.Sub(now).Seconds())))
+		}
+	}
+
+	class, ok := grpcWriteMethods[method]
+	if !ok {
+		class = classReads
+	}
+	if limit := classLimit(class); limit > 0 {
+		if wait := limiter.wait(class, limit, grpcClientIP(ctx), rpc.Key(ctx)); wait > 0 {
+			return ctx, status.Errorf(codes.ResourceExhausted,
+				"too many requests, try again in %d seconds", int(math.Ceil(wait.Seconds())))
+		}
+	}
+
+	ctx, err := rpc.Authenticate(ctx)
+	if err != nil && ip != "" {
+		// a wrong key is worthless, so only the IP is counted
+		bans.strike(ip, strikeAuth, now)
+	}
+	return ctx, err
+}
+
+func grpcBanSubjects(ctx context.Context) (ip, key string) {
+	if addr := grpcClientIP(ctx); addr != "" && !isTrustedProxy(addr) {
+		ip = "ip:" + addr
+	}
+	if k := rpc.Key(ctx); k != "" {
+		key = "key:" + models.LookupHash(k)[0:16]
+	}
+	return ip, key
+}
+
+func grpcClientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+func firstMetadata(ctx context.Context, name string) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(name); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+func auditGRPC(ctx context.Context, method string, err error) {
+	wallet := ctx.Value("wallet").(*models.Wallet)
+	entry := models.AuditEntry{
+		RequestID: ctx.Value("requestID").(string),
+		UserID:    wallet.UserID,
+		WalletID:  wallet.ID,
+		KeyType:   ctx.Value("permission").(string),
+		KeyHash:   models.LookupHash(rpc.Key(ctx))[0:16],
+		IP:        grpcClientIP(ctx),
+		Action:    method,
+		Method:    "GRPC",
+		Path:      method,
+		Status:    grpcHTTPStatus(err),
+	}
+	if err := storage.DB.Create(&entry).Error; err != nil {
+		log.Error().Err(err).Interface("entry", entry).Msg("failed to write audit entry")
+	}
+}
+
+// grpcHTTPStatus is the http status of the result of a call, since the audit
+// log has those.
+func grpcHTTPStatus(err error) int {
+	switch status.Code(err) {
+	case codes.OK:
+		return 200
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		return 400
+	case codes.Unauthenticated:
+		return 401
+	case codes.PermissionDenied:
+		return 403
+	case codes.NotFound:
+		return 404
+	case codes.ResourceExhausted:
+		return 429
+	case codes.Unavailable:
+		return 503
+	}
+	return 500
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// every response gets a Content-Security-Policy, X-Frame-Options,
+// Referrer-Policy and X-Content-Type-Options, and over https a
+// Strict-Transport-Security. the client and its assets get
+// CONTENT_SECURITY_POLICY, app pages under /ext/ get the looser
+// APP_CONTENT_SECURITY_POLICY (apps load scripts from CDNs) and the API gets a
+// policy that allows nothing, since it never serves pages. apps can change
+// their own policy and who may embed them in their manifest. an empty setting
+// means the header isn't sent.
+
+const apiContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'"
+
+type securityHeaders struct {
+	csp            string
+	appCSP         string
+	frameOptions   string
+	referrerPolicy string
+	hsts           string
+}
+
+var currentSecurityHeaders atomic.Value
+
+func setSecurityHeaders(cfg *Settings) {
+	headers := securityHeaders{
+		csp:            cfg.ContentSecurityPolicy,
+		appCSP:         cfg.AppContentSecurityPolicy,
+		frameOptions:   cfg.FrameOptions,
+		referrerPolicy: cfg.ReferrerPolicy,
+	}
+	if cfg.HSTSMaxAge > 0 {
+		headers.hsts = "max-age=" + strconv.FormatInt(int64(cfg.HSTSMaxAge/time.Second), 10)
+	}
+	currentSecurityHeaders.Store(headers)
+}
+
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers, _ := currentSecurityHeaders.Load().(securityHeaders)
+		h := w.Header()
+
+		csp := headers.csp
+		frameOptions := headers.frameOptions
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/ext/"):
+			csp = headers.appCSP
+		case strings.HasPrefix(r.URL.Path, "/api/"),
+			strings.HasPrefix(r.URL.Path, "/v/"),
+			strings.HasPrefix(r.URL.Path, "/lnurl"):
+			csp = apiContentSecurityPolicy
+			frameOptions = "DENY"
+		}
+
+		if csp != "" {
+			h.Set("Content-Security-Policy", csp)
+		}
+		if frameOptions != "" {
+			h.Set("X-Frame-Options", frameOptions)
+		}
+		if headers.referrerPolicy != "" {
+			h.Set("Referrer-Policy", headers.referrerPolicy)
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		if headers.hsts != "" && (r.TLS != nil || r.URL.Scheme == "https") {
+			h.Set("Strict-Transport-Security", headers.hsts)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/fiatjaf/go-lnurl"
+	"github.com/lnbits/infinity/api/apiutils"
 	"github.com/lnbits/infinity/services"
 	rp "github.com/lnbits/relampago"
 )
@@ -39,7 +40,7 @@ func instawallet(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// create invoice
-		invoice, err := services.CreateInvoice(wallet.ID, services.CreateInvoiceParams{
+		invoice, err := services.CreateInvoice(r.Context(), wallet.ID, services.CreateInvoiceParams{
 			InvoiceParams: rp.InvoiceParams{
 				Msatoshi:    params.MaxWithdrawable,
 				Description: params.DefaultDescription,
@@ -61,7 +62,7 @@ func instawallet(w http.ResponseWriter, r *http.Request) {
 
 		// redirect to wallet interface
 		http.Redirect(w, r,
-			fmt.Sprintf("%s/wallet/%s?key=%s", s.ServiceURL, wallet.ID, user.MasterKey),
+			fmt.Sprintf("%s%s/wallet/%s?key=%s", s.ServiceURL, apiutils.BasePath, wallet.ID, user.MasterKey),
 			http.StatusFound)
 	}
 }
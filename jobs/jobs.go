@@ -0,0 +1,370 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils"
+	"github.com/lucsky/cuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm/clause"
+)
+
+// jobs are stored in the database and taken by workers when due, so they
+// survive restarts and each one runs on a single instance even in a cluster.
+// a job that fails is tried again later, waiting twice as long each time, and
+// after the maximum attempts it is left dead until an operator retries or
+// deletes it.
+// handlers may run more than once for the same job (if the instance running it
+// dies, for example), so they must not mind that.
+
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusDead    = "dead"
+)
+
+var (
+	Workers      = 4
+	PollInterval = time.Second * 5
+	RetryDelay   = time.Second * 30
+	MaxDelay     = time.Hour * 6
+)
+
+// the attempts and the time each job gets can change on reload.
+var (
+	maxAttempts int64 = 8
+	timeout           = int64(time.Minute)
+)
+
+func SetLimits(attempts int, jobTimeout time.Duration) {
+	atomic.StoreInt64(&maxAttempts, int64(attempts))
+	atomic.StoreInt64(&timeout, int64(jobTimeout))
+}
+
+func jobTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&timeout))
+}
+
+type Handler func(ctx context.Context, payload json.RawMessage) error
+
+var (
+	handlers  = make(map[string]Handler)
+	recurring = make(map[string]func(time.Time) time.Time)
+
+	stop    context.CancelFunc
+	running sync.WaitGroup
+	wake    = make(chan struct{}, 1)
+)
+
+var log zerolog.Logger
+
+func SetLogger(logger zerolog.Logger) {
+	log = logger.With().Str("s", "jobs").Logger()
+}
+
+// Register sets the handler for a kind of job. it must be called on init.
+func Register(kind string, handler Handler) {
+	handlers[kind] = handler
+}
+
+// Recurring registers a job that runs at the times given by next, which gets
+// the time of the last run and returns the following one. the handler gets the
+// time the run was scheduled for, which may be some time ago if we were down.
+func Recurring(kind string, next func(last time.Time) time.Time,
+	handler func(ctx context.Context, at time.Time) error,
+) {
+	recurring[kind] = next
+	handlers[kind] = func(ctx context.Context, payload json.RawMessage) error {
+		var unix int64
+		if err := json.Unmarshal(payload, &unix); err != nil {
+			return err
+		}
+		at := time.Unix(unix, 0)
+
+		// the next one is scheduled first so a failure doesn't break the chain
+		if err := scheduleNext(kind, next(maxTime(at, time.Now()))); err != nil {
+			log.Warn().Err(err).Str("kind", kind).Msg("failed to schedule next run")
+		}
+		return handler(ctx, at)
+	}
+}
+
+func scheduleNext(kind string, at time.Time) error {
+	// the key makes instances agree on a single job for each run
+	return EnqueueAt(kind, at.Unix(), at, fmt.Sprintf("%s:%d", kind, at.Unix()))
+}
+
+// Enqueue adds a job to run as soon as possible.
+func Enqueue(kind string, payload interface{}) error {
+	return EnqueueAt(kind, payload, time.Now(), "")
+}
+
+// EnqueueAt adds a job to run at the given time. if key is set and a job with
+// the same key already exists nothing is added. failures are also logged, so
+// callers that can't do anything about them may ignore the error.
+func EnqueueAt(kind string, payload interface{}, at time.Time, key string) error {
+	if _, ok := handlers[kind]; !ok {
+		return fmt.Errorf("unknown job kind '%s'", kind)
+	}
+
+	j, err := utils.JSONMarshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+	if key == "" {
+		key = cuid.New()
+	}
+
+	err = storage.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Job{
+		Key:     key,
+		Kind:    kind,
+		Payload: string(j),
+		Status:  StatusPending,
+		RunAt:   at,
+	}).Error
+	if err != nil {
+		log.Error().Err(err).Str("kind", kind).RawJSON("payload", j).Msg("failed to enqueue job")
+		return err
+	}
+
+	if !at.After(time.Now()) {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Start schedules the recurring jobs and starts the workers.
+func Start() {
+	scheduleRecurring(time.Now())
+
+	var ctx context.Context
+	ctx, stop = context.WithCancel(context.Background())
+	for i := 0; i < Workers; i++ {
+		go work(ctx)
+	}
+}
+
+// scheduleRecurring starts the chain of each recurring job, unless one is
+// already going from an earlier start or from another instance.
+func scheduleRecurring(now time.Time) {
+	for kind, next := range recurring {
+		var pending int64
+		if err := storage.DB.Model(&models.Job{}).
+			Where("kind = ? AND status IN ?", kind, []string{StatusPending, StatusRunning}).
+			Count(&pending).Error; err != nil {
+			log.Warn().Err(err).Str("kind", kind).Msg("failed to check recurring job")
+			continue
+		}
+		if pending > 0 {
+			continue
+		}
+
+		if err := scheduleNext(kind, next(now)); err != nil {
+			log.Warn().Err(err).Str("kind", kind).Msg("failed to schedule recurring job")
+		}
+	}
+}
+
+// Stop stops taking jobs and waits for the running ones to finish or for ctx
+// to be done. those that don't finish are taken again after their timeout.
+func Stop(ctx context.Context) error {
+	if stop == nil {
+		return nil
+	}
+	stop()
+
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func work(ctx context.Context) {
+	for {
+		job, err := claim()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to take a job")
+		}
+		if job != nil {
+			run(job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-time.After(PollInterval):
+		}
+	}
+}
+
+// claim takes the next due job, or one whose worker died while running it.
+func claim() (*models.Job, error) {
+	for {
+		now := time.Now()
+
+		var due []models.Job
+		if err := storage.DB.
+			Where("(status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?)",
+				StatusPending, now, StatusRunning, now).
+			Order("run_at").
+			Limit(1).
+			Find(&due).Error; err != nil {
+			return nil, err
+		}
+		if len(due) == 0 {
+			return nil, nil
+		}
+		job := due[0]
+
+		lockedUntil := now.Add(jobTimeout())
+		result := storage.DB.Model(&models.Job{}).
+			Where("id = ? AND status = ? AND attempts = ?", job.ID, job.Status, job.Attempts).
+			Updates(map[string]interface{}{
+				"status":       StatusRunning,
+				"attempts":     job.Attempts + 1,
+				"locked_until": lockedUntil,
+			})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			// another worker got it first
+			continue
+		}
+
+		job.Status = StatusRunning
+		job.Attempts++
+		job.LockedUntil = &lockedUntil
+		return &job, nil
+	}
+}
+
+func run(job *models.Job) {
+	running.Add(1)
+	defer running.Done()
+
+	log := log.With().Uint("job", job.ID).Str("kind", job.Kind).Int("attempt", job.Attempts).Logger()
+
+	err := call(job)
+	now := time.Now()
+	updates := map[string]interface{}{"locked_until": nil}
+	switch {
+	case err == nil:
+		updates["status"] = StatusDone
+		updates["finished_at"] = now
+		updates["last_error"] = ""
+	case int64(job.Attempts) >= atomic.LoadInt64(&maxAttempts):
+		log.Error().Err(err).Msg("job failed too many times, giving up")
+		updates["status"] = StatusDead
+		updates["finished_at"] = now
+		updates["last_error"] = err.Error()
+	default:
+		delay := RetryDelay << (job.Attempts - 1)
+		if delay > MaxDelay || delay <= 0 {
+			delay = MaxDelay
+		}
+		log.Warn().Err(err).Str("retry_in", delay.String()).Msg("job failed")
+		updates["status"] = StatusPending
+		updates["run_at"] = now.Add(delay)
+		updates["last_error"] = err.Error()
+	}
+
+	if err := storage.DB.Model(&models.Job{}).
+		Where("id = ? AND attempts = ?", job.ID, job.Attempts).
+		Updates(updates).Error; err != nil {
+		log.Warn().Err(err).Msg("failed to save job result")
+	}
+}
+
+func call(job *models.Job) (err error) {
+	handler, ok := handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind '%s'", job.Kind)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout())
+	defer cancel()
+	return handler(ctx, json.RawMessage(job.Payload))
+}
+
+var ErrNotFound = errors.New("job not found")
+
+// Retry makes a dead or pending job run again as soon as possible, with all
+// its attempts.
+func Retry(id uint) error {
+	result := storage.DB.Model(&models.Job{}).
+		Where("id = ? AND status IN ?", id, []string{StatusDead, StatusPending}).
+		Updates(map[string]interface{}{
+			"status":      StatusPending,
+			"attempts":    0,
+			"run_at":      time.Now(),
+			"finished_at": nil,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Delete removes a job that isn't running.
+func Delete(id uint) error {
+	result := storage.DB.Where("id = ? AND status <> ?", id, StatusRunning).Delete(&models.Job{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Purge deletes the jobs that were done before the given time, dead ones are
+// kept.
+func Purge(before time.Time) (int64, error) {
+	result := storage.DB.Where("status = ? AND finished_at < ?", StatusDone, before).
+		Delete(&models.Job{})
+	return result.RowsAffected, result.Error
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,89 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+)
+
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	if err := storage.Connect(filepath.Join(t.TempDir(), "test.sqlite")); err != nil {
+		t.Fatalf("failed to open the database: %s", err)
+	}
+}
+
+func countJobs(t *testing.T, kind string) int64 {
+	t.Helper()
+
+	var count int64
+	if err := storage.DB.Model(&models.Job{}).
+		Where("kind = ? AND status = ?", kind, StatusPending).
+		Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestRecurringJobIsScheduledOnce(t *testing.T) {
+	setupTestDB(t)
+
+	// not aligned to anything, so each start would pick a different time
+	Recurring("test_unaligned", func(last time.Time) time.Time {
+		return last.Add(time.Hour)
+	}, func(ctx context.Context, at time.Time) error { return nil })
+	defer delete(recurring, "test_unaligned")
+	defer delete(handlers, "test_unaligned")
+
+	now := time.Now()
+	scheduleRecurring(now)
+	scheduleRecurring(now.Add(time.Minute))
+	scheduleRecurring(now.Add(time.Minute * 7))
+
+	if count := countJobs(t, "test_unaligned"); count != 1 {
+		t.Fatalf("expected 1 pending job after restarts, got %d", count)
+	}
+}
+
+func TestRecurringJobContinuesItsChain(t *testing.T) {
+	setupTestDB(t)
+
+	runs := 0
+	Recurring("test_chain", func(last time.Time) time.Time {
+		return last.Truncate(time.Hour).Add(time.Hour)
+	}, func(ctx context.Context, at time.Time) error {
+		runs++
+		return nil
+	})
+	defer delete(recurring, "test_chain")
+	defer delete(handlers, "test_chain")
+
+	// a run that is due schedules the next one and only that
+	at := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := scheduleNext("test_chain", at); err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(strconv.FormatInt(at.Unix(), 10))
+	if err := handlers["test_chain"](context.Background(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DB.Model(&models.Job{}).Where("key = ?", fmt.Sprintf("test_chain:%d", at.Unix())).
+		Update("status", StatusDone).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	scheduleRecurring(time.Now())
+	if runs != 1 {
+		t.Fatalf("expected the handler to run once, got %d", runs)
+	}
+	if count := countJobs(t, "test_chain"); count != 1 {
+		t.Fatalf("expected only the next run to be pending, got %d", count)
+	}
+}
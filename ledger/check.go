@@ -0,0 +1,176 @@
+package ledger
+
+import (
+	"sort"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"gorm.io/gorm"
+)
+
+// the ledger and the payments table are written together, so they must always
+// agree. Check looks for places where they don't, or where the ledger itself
+// is broken, and can fix the ledger to match the payments, which are taken as
+// the source of truth. each fix is a repair transaction against
+// equity:adjustments, nothing is ever deleted.
+
+type UnbalancedTx struct {
+	TxID string `json:"tx_id"`
+	Sum  int64  `json:"sum"`
+}
+
+type BalanceMismatch struct {
+	WalletID string `json:"wallet_id"`
+	Ledger   int64  `json:"ledger"`
+	Payments int64  `json:"payments"`
+}
+
+type NegativeBalance struct {
+	WalletID string `json:"wallet_id"`
+	Balance  int64  `json:"balance"`
+}
+
+type CheckReport struct {
+	UnbalancedTxs     []UnbalancedTx    `json:"unbalanced_txs"`
+	BalanceMismatches []BalanceMismatch `json:"balance_mismatches"`
+	NegativeBalances  []NegativeBalance `json:"negative_balances"`
+	// wallet entries with a balance and payments that belong to wallets that
+	// don't exist
+	OrphanedEntries  int64 `json:"orphaned_entries"`
+	OrphanedPayments int64 `json:"orphaned_payments"`
+	Repaired         int   `json:"repaired"`
+}
+
+func (report CheckReport) OK() bool {
+	return len(report.UnbalancedTxs) == 0 &&
+		len(report.BalanceMismatches) == 0 &&
+		len(report.NegativeBalances) == 0 &&
+		report.OrphanedEntries == 0 &&
+		report.OrphanedPayments == 0
+}
+
+// Check validates the ledger invariants. with repair it balances broken
+// transactions and makes wallet balances match their payments, then reports what
+// is still wrong. negative balances and orphans are only reported since there is
+// no right way to fix them automatically.
+func Check(repair bool) (report CheckReport, err error) {
+	err = storage.DB.Transaction(func(tx *gorm.DB) error {
+		if err := check(tx, &report); err != nil {
+			return err
+		}
+		if !repair || (len(report.UnbalancedTxs) == 0 && len(report.BalanceMismatches) == 0) {
+			return nil
+		}
+
+		for _, unbalanced := range report.UnbalancedTxs {
+			// the missing leg goes in the same transaction
+			if err := tx.Create(&models.LedgerEntry{
+				TxID:    unbalanced.TxID,
+				Kind:    KindRepair,
+				Account: AccountAdjustments,
+				Amount:  -unbalanced.Sum,
+			}).Error; err != nil {
+				return err
+			}
+			report.Repaired++
+		}
+		for _, mismatch := range report.BalanceMismatches {
+			diff := mismatch.Payments - mismatch.Ledger
+			if err := Post(tx, KindRepair, "",
+				Wallet(mismatch.WalletID, diff),
+				Account(AccountAdjustments, -diff),
+			); err != nil {
+				return err
+			}
+			report.Repaired++
+		}
+
+		repaired := report.Repaired
+		report = CheckReport{Repaired: repaired}
+		return check(tx, &report)
+	})
+	return report, err
+}
+
+func check(tx *gorm.DB, report *CheckReport) error {
+	report.UnbalancedTxs = make([]UnbalancedTx, 0)
+	if err := tx.Model(&models.LedgerEntry{}).
+		Select("tx_id, sum(amount) AS sum").
+		Group("tx_id").
+		Having("sum(amount) <> 0").
+		Scan(&report.UnbalancedTxs).Error; err != nil {
+		return err
+	}
+
+	var ledgerBalances, paymentBalances []struct {
+		WalletID string
+		Balance  int64
+	}
+	if err := tx.Model(&models.LedgerEntry{}).
+		Select("wallet_id, sum(amount) AS balance").
+		Where("account = ?", AccountWallet).
+		Group("wallet_id").
+		Scan(&ledgerBalances).Error; err != nil {
+		return err
+	}
+	// same as services.LoadWalletBalance before the ledger
+	if err := tx.Model(&models.Payment{}).
+		Select("wallet_id, sum(amount) AS balance").
+		Where("amount < 0 OR (amount > 0 AND NOT pending)").
+		Group("wallet_id").
+		Scan(&paymentBalances).Error; err != nil {
+		return err
+	}
+
+	balances := make(map[string]*BalanceMismatch)
+	get := func(walletID string) *BalanceMismatch {
+		if _, ok := balances[walletID]; !ok {
+			balances[walletID] = &BalanceMismatch{WalletID: walletID}
+		}
+		return balances[walletID]
+	}
+	for _, b := range ledgerBalances {
+		get(b.WalletID).Ledger = b.Balance
+	}
+	for _, b := range paymentBalances {
+		get(b.WalletID).Payments = b.Balance
+	}
+
+	report.BalanceMismatches = make([]BalanceMismatch, 0)
+	report.NegativeBalances = make([]NegativeBalance, 0)
+	for _, b := range balances {
+		if b.Ledger != b.Payments {
+			report.BalanceMismatches = append(report.BalanceMismatches, *b)
+		}
+		if b.Ledger < 0 {
+			report.NegativeBalances = append(report.NegativeBalances,
+				NegativeBalance{b.WalletID, b.Ledger})
+		}
+	}
+	sort.Slice(report.BalanceMismatches, func(i, j int) bool {
+		return report.BalanceMismatches[i].WalletID < report.BalanceMismatches[j].WalletID
+	})
+	sort.Slice(report.NegativeBalances, func(i, j int) bool {
+		return report.NegativeBalances[i].WalletID < report.NegativeBalances[j].WalletID
+	})
+
+	// deleted wallets still count, and purged ones have their balance zeroed
+	wallets := tx.Unscoped().Model(&models.Wallet{}).Select("id")
+	if err := tx.Model(&models.LedgerEntry{}).
+		Where("account = ?", AccountWallet).
+		Where("wallet_id IN (?)", tx.Model(&models.LedgerEntry{}).
+			Select("wallet_id").
+			Where("account = ? AND wallet_id NOT IN (?)", AccountWallet, wallets).
+			Group("wallet_id").
+			Having("sum(amount) <> 0")).
+		Count(&report.OrphanedEntries).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.Payment{}).
+		Where("wallet_id NOT IN (?)", wallets).
+		Count(&report.OrphanedPayments).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
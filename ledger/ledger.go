@@ -0,0 +1,114 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils"
+	"gorm.io/gorm"
+)
+
+// every movement of funds is a ledger transaction made of legs that add up to
+// zero. wallets are accounts, and so is the lightning node: money received from
+// the network comes from node:incoming, money sent goes to node:outgoing and
+// routing fees paid by the operator come from operator:fees. a wallet balance is
+// the sum of its entries.
+
+const (
+	AccountWallet       = "wallet"
+	AccountNodeIncoming = "node:incoming"
+	AccountNodeOutgoing = "node:outgoing"
+	AccountOperatorFees = "operator:fees"
+	AccountOpening      = "equity:opening"
+	AccountAdjustments  = "equity:adjustments"
+	AccountForfeited    = "equity:forfeited"
+)
+
+// transaction kinds
+const (
+	KindReceive  = "receive"
+	KindSend     = "send"
+	KindRefund   = "refund"
+	KindFee      = "fee"
+	KindInternal = "internal"
+	KindTransfer = "transfer"
+	KindOpening  = "opening"
+	KindRepair   = "repair"
+	KindPurge    = "purge"
+)
+
+var ErrUnbalanced = errors.New("ledger transaction legs don't add up to zero")
+
+type Leg struct {
+	Account  string
+	WalletID string
+	Amount   int64
+}
+
+func Wallet(walletID string, amount int64) Leg {
+	return Leg{Account: AccountWallet, WalletID: walletID, Amount: amount}
+}
+
+func Account(account string, amount int64) Leg {
+	return Leg{Account: account, Amount: amount}
+}
+
+// Post writes a transaction with the given legs.
+func Post(tx *gorm.DB, kind string, checkingID string, legs ...Leg) error {
+	var sum int64
+	for _, leg := range legs {
+		sum += leg.Amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("%w: %v", ErrUnbalanced, legs)
+	}
+
+	txID := utils.RandomHex(16)
+	entries := make([]models.LedgerEntry, 0, len(legs))
+	for _, leg := range legs {
+		if leg.Amount == 0 {
+			continue
+		}
+		entries = append(entries, models.LedgerEntry{
+			TxID:       txID,
+			Kind:       kind,
+			Account:    leg.Account,
+			WalletID:   leg.WalletID,
+			Amount:     leg.Amount,
+			CheckingID: checkingID,
+		})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return tx.Create(&entries).Error
+}
+
+func WalletBalance(walletID string) (int64, error) {
+	var balance int64
+	err := storage.DB.Model(&models.LedgerEntry{}).
+		Select("coalesce(sum(amount), 0)").
+		Where("account = ? AND wallet_id = ?", AccountWallet, walletID).
+		Scan(&balance).Error
+	return balance, err
+}
+
+type AccountBalance struct {
+	Account  string `json:"account"`
+	WalletID string `json:"wallet_id,omitempty"`
+	Balance  int64  `json:"balance"`
+}
+
+// Balances returns the balance of every account, which must add up to zero.
+func Balances() ([]AccountBalance, error) {
+	var balances []AccountBalance
+	err := storage.DB.Model(&models.LedgerEntry{}).
+		Select("account, wallet_id, sum(amount) AS balance").
+		Group("account").Group("wallet_id").
+		Order("account").Order("wallet_id").
+		Scan(&balances).Error
+	return balances, err
+}
@@ -0,0 +1,117 @@
+package ledger
+
+import (
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"gorm.io/gorm"
+)
+
+// the payment state changes that move funds, each one updating the payment and
+// posting to the ledger in the same database transaction.
+
+// RecordOutgoing debits the wallet as soon as an outgoing payment is created,
+// even while it is still pending.
+func RecordOutgoing(tx *gorm.DB, payment models.Payment) error {
+	return Post(tx, KindSend, payment.CheckingID,
+		Wallet(payment.WalletID, payment.Amount),
+		Account(AccountNodeOutgoing, -payment.Amount),
+	)
+}
+
+// SettleIncoming marks a pending invoice as paid with the amount received and
+// credits the wallet. it returns false if the invoice wasn't pending anymore.
+func SettleIncoming(checkingID string, amount int64) (settled bool, err error) {
+	err = storage.DB.Transaction(func(tx *gorm.DB) error {
+		var payment models.Payment
+		result := tx.
+			Where("checking_id = ? AND amount > 0 AND pending", checkingID).
+			Limit(1).Find(&payment)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		result = tx.Model(&models.Payment{}).
+			Where("checking_id = ? AND pending", checkingID).
+			Updates(map[string]interface{}{"pending": false, "amount": amount})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		settled = true
+		return Post(tx, KindReceive, checkingID,
+			Account(AccountNodeIncoming, -amount),
+			Wallet(payment.WalletID, amount),
+		)
+	})
+	return settled, err
+}
+
+// CompleteOutgoing marks a pending outgoing payment as sent. the routing fee is
+// paid by the operator.
+func CompleteOutgoing(checkingID string, preimage string, fee int64) (completed bool, err error) {
+	err = storage.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Payment{}).
+			Where("checking_id = ? AND amount < 0 AND pending", checkingID).
+			Updates(map[string]interface{}{
+				"pending":  false,
+				"preimage": models.EncryptedString(preimage),
+				"fee":      fee,
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		completed = true
+		return Post(tx, KindFee, checkingID,
+			Account(AccountOperatorFees, -fee),
+			Account(AccountNodeOutgoing, fee),
+		)
+	})
+	return completed, err
+}
+
+// FailOutgoing deletes a pending outgoing payment and refunds the wallet. it
+// returns false if there was no such payment.
+func FailOutgoing(checkingID string) (failed bool, err error) {
+	err = storage.DB.Transaction(func(tx *gorm.DB) error {
+		var payment models.Payment
+		result := tx.
+			Where("checking_id = ? AND amount < 0 AND pending", checkingID).
+			Limit(1).Find(&payment)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		result = tx.Where("checking_id = ? AND pending", checkingID).
+			Delete(&models.Payment{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		failed = true
+		return Post(tx, KindRefund, checkingID,
+			Account(AccountNodeOutgoing, payment.Amount),
+			Wallet(payment.WalletID, -payment.Amount),
+		)
+	})
+	return failed, err
+}
+
+// SettleInternal settles an invoice paid by another wallet of this instance: the
+// funds that were sent to the node by the payer go to the receiver instead.
+func SettleInternal(tx *gorm.DB, receiving models.Payment) error {
+	result := tx.Model(&models.Payment{}).
+		Where("checking_id = ? AND pending", receiving.CheckingID).
+		Update("pending", false)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return Post(tx, KindInternal, receiving.CheckingID,
+		Account(AccountNodeOutgoing, -receiving.Amount),
+		Wallet(receiving.WalletID, receiving.Amount),
+	)
+}
@@ -0,0 +1,137 @@
+package ledger
+
+import (
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"gorm.io/gorm/clause"
+)
+
+// once a day the balance of every wallet is saved, so the balance history can be
+// shown without adding up the whole ledger. each snapshot remembers the last
+// entry it included, so the next day the same entries can be added up again to
+// make sure nothing has changed them since.
+
+const snapshotDay = "2006-01-02"
+
+type BalanceDrift struct {
+	WalletID string `json:"wallet_id"`
+	Day      string `json:"day"`
+	Snapshot int64  `json:"snapshot"`
+	Ledger   int64  `json:"ledger"`
+}
+
+type walletSum struct {
+	WalletID string
+	Balance  int64
+}
+
+func walletSums(lastEntryID uint) ([]walletSum, error) {
+	var sums []walletSum
+	err := storage.DB.Model(&models.LedgerEntry{}).
+		Select("wallet_id, sum(amount) AS balance").
+		Where("account = ? AND id <= ?", AccountWallet, lastEntryID).
+		Group("wallet_id").
+		Scan(&sums).Error
+	return sums, err
+}
+
+// Snapshot saves the current balance of every wallet as today's snapshot,
+// replacing the one taken earlier today if any. before that it checks the
+// previous snapshot against the ledger and returns the wallets where they
+// differ, which means past entries were changed.
+func Snapshot() ([]BalanceDrift, error) {
+	today := time.Now().UTC().Format(snapshotDay)
+
+	drifts, err := checkDrift(today)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastEntryID uint
+	if err := storage.DB.Model(&models.LedgerEntry{}).
+		Select("coalesce(max(id), 0)").Scan(&lastEntryID).Error; err != nil {
+		return drifts, err
+	}
+
+	sums, err := walletSums(lastEntryID)
+	if err != nil {
+		return drifts, err
+	}
+	if len(sums) == 0 {
+		return drifts, nil
+	}
+
+	snapshots := make([]models.BalanceSnapshot, len(sums))
+	for i, sum := range sums {
+		snapshots[i] = models.BalanceSnapshot{
+			WalletID:    sum.WalletID,
+			Day:         today,
+			Balance:     sum.Balance,
+			LastEntryID: lastEntryID,
+		}
+	}
+
+	return drifts, storage.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "wallet_id"}, {Name: "day"}},
+		DoUpdates: clause.AssignmentColumns([]string{"balance", "last_entry_id", "created_at"}),
+	}).CreateInBatches(snapshots, 500).Error
+}
+
+func checkDrift(before string) ([]BalanceDrift, error) {
+	var latest models.BalanceSnapshot
+	result := storage.DB.Where("day < ?", before).Order("day desc").Limit(1).Find(&latest)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+
+	var snapshots []models.BalanceSnapshot
+	if err := storage.DB.Where("day = ?", latest.Day).Find(&snapshots).Error; err != nil {
+		return nil, err
+	}
+	sums, err := walletSums(latest.LastEntryID)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]int64, len(sums))
+	for _, sum := range sums {
+		current[sum.WalletID] = sum.Balance
+	}
+
+	var drifts []BalanceDrift
+	for _, snapshot := range snapshots {
+		if balance := current[snapshot.WalletID]; balance != snapshot.Balance {
+			drifts = append(drifts, BalanceDrift{
+				WalletID: snapshot.WalletID,
+				Day:      snapshot.Day,
+				Snapshot: snapshot.Balance,
+				Ledger:   balance,
+			})
+		}
+		delete(current, snapshot.WalletID)
+	}
+	for walletID, balance := range current {
+		if balance != 0 {
+			drifts = append(drifts, BalanceDrift{
+				WalletID: walletID,
+				Day:      latest.Day,
+				Ledger:   balance,
+			})
+		}
+	}
+
+	return drifts, nil
+}
+
+// BalanceHistory returns the daily balances of a wallet since the given day,
+// oldest first.
+func BalanceHistory(walletID string, since time.Time) ([]models.BalanceSnapshot, error) {
+	snapshots := make([]models.BalanceSnapshot, 0)
+	err := storage.DB.
+		Where("wallet_id = ? AND day >= ?", walletID, since.UTC().Format(snapshotDay)).
+		Order("day").
+		Find(&snapshots).Error
+	return snapshots, err
+}
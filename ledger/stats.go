@@ -0,0 +1,212 @@
+package ledger
+
+import (
+	"sort"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+)
+
+// payment volume is taken from the ledger instead of the payments table since
+// old payments may have been purged, while their entries are kept forever.
+// days are grouped by the database, in the time zone it stores dates in (UTC
+// unless configured otherwise).
+
+// Volume is what moved in a period, in msatoshis, with the number of
+// transactions of each kind. Sent is every payment attempted, including those
+// to other wallets of this instance and those that failed later: Internal is
+// what was received from other wallets, Failed what was refunded. Fees are the
+// routing fees the operator paid.
+type Volume struct {
+	Period        string `json:"period,omitempty"`
+	Received      int64  `json:"received"`
+	ReceivedCount int64  `json:"received_count"`
+	Internal      int64  `json:"internal"`
+	InternalCount int64  `json:"internal_count"`
+	Sent          int64  `json:"sent"`
+	SentCount     int64  `json:"sent_count"`
+	Failed        int64  `json:"failed"`
+	FailedCount   int64  `json:"failed_count"`
+	Fees          int64  `json:"fees"`
+	FeesCount     int64  `json:"fees_count"`
+}
+
+type volumeRow struct {
+	Bucket string // the day or the wallet
+	Kind   string
+	Count  int64
+	Amount int64
+}
+
+func (volume *Volume) add(row volumeRow) {
+	switch row.Kind {
+	case KindReceive:
+		volume.Received += row.Amount
+		volume.ReceivedCount += row.Count
+	case KindInternal:
+		volume.Internal += row.Amount
+		volume.InternalCount += row.Count
+	case KindSend:
+		volume.Sent -= row.Amount
+		volume.SentCount += row.Count
+	case KindRefund:
+		volume.Failed += row.Amount
+		volume.FailedCount += row.Count
+	case KindFee:
+		volume.Fees += row.Amount
+		volume.FeesCount += row.Count
+	}
+}
+
+// Merge adds the numbers of other to volume.
+func (volume *Volume) Merge(other Volume) {
+	volume.Received += other.Received
+	volume.ReceivedCount += other.ReceivedCount
+	volume.Internal += other.Internal
+	volume.InternalCount += other.InternalCount
+	volume.Sent += other.Sent
+	volume.SentCount += other.SentCount
+	volume.Failed += other.Failed
+	volume.FailedCount += other.FailedCount
+	volume.Fees += other.Fees
+	volume.FeesCount += other.FeesCount
+}
+
+// volumeRows sums the entries between since and until by kind and by day or by
+// wallet, for all wallets or only for walletID.
+func volumeRows(since, until time.Time, walletID string, byWallet bool) ([]volumeRow, error) {
+	var rows []volumeRow
+
+	key := "date(created_at)"
+	if byWallet {
+		key = "wallet_id"
+	}
+	query := storage.DB.Model(&models.LedgerEntry{}).
+		Select(key+" AS bucket, kind, count(*) AS count, sum(amount) AS amount").
+		Where("created_at >= ? AND created_at < ? AND account = ?", since, until, AccountWallet).
+		Where("kind IN ?", []string{KindReceive, KindInternal, KindSend, KindRefund})
+	if walletID != "" {
+		query = query.Where("wallet_id = ?", walletID)
+	}
+	if err := query.Group(key).Group("kind").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	// fees are on the operator's accounts, we find the wallet through the
+	// payment they were paid for
+	var fees []volumeRow
+	key = "date(fee.created_at)"
+	if byWallet {
+		key = "sent.wallet_id"
+	}
+	query = storage.DB.Table("ledger_entries AS fee").
+		Select(key+" AS bucket, fee.kind, count(*) AS count, sum(fee.amount) AS amount").
+		Joins("JOIN ledger_entries AS sent ON sent.checking_id = fee.checking_id AND sent.kind = ? AND sent.account = ?",
+			KindSend, AccountWallet).
+		Where("fee.created_at >= ? AND fee.created_at < ? AND fee.account = ? AND fee.kind = ?",
+			since, until, AccountNodeOutgoing, KindFee)
+	if walletID != "" {
+		query = query.Where("sent.wallet_id = ?", walletID)
+	}
+	if err := query.Group(key).Group("fee.kind").Scan(&fees).Error; err != nil {
+		return nil, err
+	}
+
+	rows = append(rows, fees...)
+	if !byWallet {
+		// postgres and mysql may give us a full timestamp
+		for i := range rows {
+			if len(rows[i].Bucket) > 10 {
+				rows[i].Bucket = rows[i].Bucket[0:10]
+			}
+		}
+	}
+	return rows, nil
+}
+
+// DailyVolume returns the volume of each day since the given time that had any,
+// for all wallets or only for walletID.
+func DailyVolume(since time.Time, walletID string) ([]Volume, error) {
+	return periodVolume(since, walletID, len("2006-01-02"))
+}
+
+// MonthlyVolume is like DailyVolume, by month (2006-01).
+func MonthlyVolume(since time.Time, walletID string) ([]Volume, error) {
+	return periodVolume(since, walletID, len("2006-01"))
+}
+
+func periodVolume(since time.Time, walletID string, periodLength int) ([]Volume, error) {
+	rows, err := volumeRows(since, time.Now().Add(time.Hour), walletID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	periods := make(map[string]*Volume)
+	for _, row := range rows {
+		period := row.Bucket[0:periodLength]
+		volume, ok := periods[period]
+		if !ok {
+			volume = &Volume{Period: period}
+			periods[period] = volume
+		}
+		volume.add(row)
+	}
+
+	volumes := make([]Volume, 0, len(periods))
+	for _, volume := range periods {
+		volumes = append(volumes, *volume)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Period < volumes[j].Period
+	})
+	return volumes, nil
+}
+
+type WalletVolume struct {
+	WalletID string `json:"wallet_id"`
+	Volume
+}
+
+// WalletVolumes returns the volume of every wallet that had any between since
+// and until, the busiest first.
+func WalletVolumes(since, until time.Time) ([]WalletVolume, error) {
+	rows, err := volumeRows(since, until, "", true)
+	if err != nil {
+		return nil, err
+	}
+
+	wallets := make(map[string]*WalletVolume)
+	for _, row := range rows {
+		volume, ok := wallets[row.Bucket]
+		if !ok {
+			volume = &WalletVolume{WalletID: row.Bucket}
+			wallets[row.Bucket] = volume
+		}
+		volume.add(row)
+	}
+
+	volumes := make([]WalletVolume, 0, len(wallets))
+	for _, volume := range wallets {
+		volumes = append(volumes, *volume)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		a := volumes[i].Received + volumes[i].Internal + volumes[i].Sent
+		b := volumes[j].Received + volumes[j].Internal + volumes[j].Sent
+		if a != b {
+			return a > b
+		}
+		return volumes[i].WalletID < volumes[j].WalletID
+	})
+	return volumes, nil
+}
+
+// TotalWalletBalance is what the instance owes to all its wallets together.
+func TotalWalletBalance() (int64, error) {
+	var total int64
+	err := storage.DB.Model(&models.LedgerEntry{}).
+		Select("coalesce(sum(amount), 0)").
+		Where("account = ?", AccountWallet).
+		Scan(&total).Error
+	return total, err
+}
@@ -5,7 +5,9 @@ import (
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/lnbits/infinity/chaos"
 	"github.com/lnbits/infinity/events"
+	"github.com/lnbits/infinity/metrics"
 	"github.com/lnbits/relampago"
 	"github.com/lnbits/relampago/cliche"
 	"github.com/lnbits/relampago/eclair"
@@ -69,10 +71,14 @@ func Connect(backendType string) {
 	default:
 		// use void wallet that does nothing
 		LN, err = void.Start()
+		if err == nil && chaos.Enabled {
+			LN, err = chaos.Wrap(LN)
+		}
 	}
 	if err != nil {
 		log.Fatalf("failed to initialize %s backend with %v: %s", backendType, lbs, err)
 	}
+	LN = metrics.WrapLightning(LN)
 
 	paymentsStream, err := LN.PaymentsStream()
 	if err != nil {
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lnbits/infinity/amqp"
+	"github.com/lnbits/infinity/apps"
+	"github.com/lnbits/infinity/cashu"
+	"github.com/lnbits/infinity/chaos"
+	"github.com/lnbits/infinity/cluster"
+	"github.com/lnbits/infinity/events"
+	"github.com/lnbits/infinity/gql"
+	"github.com/lnbits/infinity/jobs"
+	"github.com/lnbits/infinity/mqtt"
+	"github.com/lnbits/infinity/notify"
+	"github.com/lnbits/infinity/nwc"
+	"github.com/lnbits/infinity/redis"
+	"github.com/lnbits/infinity/rpc"
+	"github.com/lnbits/infinity/splits"
+	"github.com/lnbits/infinity/storage"
+	"github.com/rs/zerolog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logs go to stdout, in color for people (LOG_FORMAT=console) or as one JSON
+// object per line for log shippers (LOG_FORMAT=json). with LOG_FILE they are
+// also written to that file, in the same format without colors, and the file
+// is rotated when it reaches LOG_FILE_MAX_SIZE megabytes.
+
+var logFile *lumberjack.Logger
+
+func setupLogger() error {
+	if _, err := zerolog.ParseLevel(s.LogLevel); err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL: %w", err)
+	}
+	setLogLevel(s.LogLevel)
+
+	var output io.Writer
+	switch s.LogFormat {
+	case "console":
+		output = zerolog.ConsoleWriter{Out: os.Stdout}
+	case "json":
+		output = os.Stdout
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT '%s', use 'console' or 'json'", s.LogFormat)
+	}
+
+	if s.LogFile != "" {
+		logFile = &lumberjack.Logger{
+			Filename:   s.LogFile,
+			MaxSize:    s.LogFileMaxSize,
+			MaxBackups: s.LogFileMaxBackups,
+			MaxAge:     s.LogFileMaxAge,
+			Compress:   s.LogFileCompress,
+		}
+
+		var file io.Writer = logFile
+		if s.LogFormat == "console" {
+			file = zerolog.ConsoleWriter{Out: logFile, NoColor: true}
+		}
+		output = zerolog.MultiLevelWriter(output, file)
+	}
+
+	if s.LogBufferSize > 0 {
+		logTail = newLogBuffer(s.LogBufferSize)
+		output = zerolog.MultiLevelWriter(output, logTail)
+	}
+
+	log = zerolog.New(output).With().Timestamp().Logger()
+	zerolog.DefaultContextLogger = &log
+	apps.SetLogger(log)
+	storage.SetLogger(log)
+	events.SetLogger(log)
+	cluster.SetLogger(log)
+	jobs.SetLogger(log)
+	chaos.SetLogger(log)
+	nwc.SetLogger(log)
+	mqtt.SetLogger(log)
+	amqp.SetLogger(log)
+	notify.SetLogger(log)
+	redis.SetLogger(log)
+	splits.SetLogger(log)
+	rpc.SetLogger(log)
+	gql.SetLogger(log)
+	cashu.SetLogger(log)
+
+	return nil
+}
+
+// setLogLevel is also called on reload.
+func setLogLevel(name string) {
+	if level, err := zerolog.ParseLevel(name); err == nil {
+		zerolog.SetGlobalLevel(level)
+	} else {
+		log.Warn().Str("LOG_LEVEL", name).Msg("invalid log level, keeping the previous one")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/rs/zerolog"
+)
+
+// the last LOG_BUFFER_SIZE log lines are kept in memory, as JSON whatever the
+// LOG_FORMAT, so the admin can see them without access to the host:
+// /api/admin/logs returns them and /api/admin/logs/stream follows them as they
+// are written. both take the minimum `level` and the `component` (the "s" field
+// of the packages that have one, "main" for everything else, comma-separated
+// for many) to show. only lines at LOG_LEVEL or above are ever written.
+
+type logLine struct {
+	level     zerolog.Level
+	component string
+	raw       []byte
+}
+
+type logBuffer struct {
+	sync.Mutex
+	lines       []logLine
+	next        int
+	full        bool
+	subscribers map[chan logLine]struct{}
+}
+
+var logTail *logBuffer
+
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{
+		lines:       make([]logLine, size),
+		subscribers: make(map[chan logLine]struct{}),
+	}
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	return lb.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (lb *logBuffer) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	var fields struct {
+		S string `json:"s"`
+	}
+	json.Unmarshal(p, &fields)
+	if fields.S == "" {
+		fields.S = "main"
+	}
+
+	// zerolog reuses p
+	line := logLine{level, fields.S, append([]byte(nil), p...)}
+
+	lb.Lock()
+	defer lb.Unlock()
+	lb.lines[lb.next] = line
+	lb.next = (lb.next + 1) % len(lb.lines)
+	lb.full = lb.full || lb.next == 0
+	for ch := range lb.subscribers {
+		// a stream that can't keep up misses lines instead of blocking the logs
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// recent returns up to limit of the last lines, oldest first.
+func (lb *logBuffer) recent(filter logFilter, limit int) []logLine {
+	lb.Lock()
+	defer lb.Unlock()
+	return lb.last(filter, limit)
+}
+
+func (lb *logBuffer) last(filter logFilter, limit int) []logLine {
+	var lines []logLine
+	for i := 1; i <= len(lb.lines) && len(lines) < limit; i++ {
+		index := (lb.next - i + len(lb.lines)) % len(lb.lines)
+		if !lb.full && index >= lb.next {
+			break
+		}
+		if line := lb.lines[index]; filter.matches(line) {
+			lines = append(lines, line)
+		}
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// follow returns the last limit lines and a channel with the ones that come
+// after them.
+func (lb *logBuffer) follow(filter logFilter, limit int) ([]logLine, chan logLine) {
+	ch := make(chan logLine, 256)
+	lb.Lock()
+	defer lb.Unlock()
+	lb.subscribers[ch] = struct{}{}
+	return lb.last(filter, limit), ch
+}
+
+func (lb *logBuffer) unsubscribe(ch chan logLine) {
+	lb.Lock()
+	delete(lb.subscribers, ch)
+	lb.Unlock()
+}
+
+type logFilter struct {
+	level      zerolog.Level
+	components map[string]bool
+}
+
+func (f logFilter) matches(line logLine) bool {
+	// lines logged without a level are always shown
+	if line.level != zerolog.NoLevel && line.level < f.level {
+		return false
+	}
+	return len(f.components) == 0 || f.components[line.component]
+}
+
+func parseLogFilter(r *http.Request) (logFilter, error) {
+	filter := logFilter{level: zerolog.TraceLevel}
+	if param := r.URL.Query().Get("level"); param != "" {
+		level, err := zerolog.ParseLevel(param)
+		if err != nil {
+			return filter, fmt.Errorf("invalid level '%s'", param)
+		}
+		filter.level = level
+	}
+	if param := r.URL.Query().Get("component"); param != "" {
+		filter.components = make(map[string]bool)
+		for _, component := range strings.Split(param, ",") {
+			filter.components[strings.TrimSpace(component)] = true
+		}
+	}
+	return filter, nil
+}
+
+// listLogs returns the last `limit` (default 100) lines.
+func listLogs(w http.ResponseWriter, r *http.Request) {
+	if logTail == nil {
+		apiutils.SendJSONError(w, 404, "log buffer is disabled, set LOG_BUFFER_SIZE to enable it")
+		return
+	}
+	filter, err := parseLogFilter(r)
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "%s", err.Error())
+		return
+	}
+	limit := 100
+	if param := r.URL.Query().Get("limit"); param != "" {
+		if limit, err = strconv.Atoi(param); err != nil || limit <= 0 {
+			apiutils.SendJSONError(w, 400, "invalid limit '%s'", param)
+			return
+		}
+	}
+
+	lines := logTail.recent(filter, limit)
+	list := make([]json.RawMessage, len(lines))
+	for i, line := range lines {
+		list[i] = line.raw
+	}
+	apiutils.SendJSON(w, list)
+}
+
+// streamLogs sends the lines as `log` events as they are written, starting
+// with the last `limit` (default 0) ones.
+func streamLogs(w http.ResponseWriter, r *http.Request) {
+	if logTail == nil {
+		apiutils.SendJSONError(w, 404, "log buffer is disabled, set LOG_BUFFER_SIZE to enable it")
+		return
+	}
+	filter, err := parseLogFilter(r)
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "%s", err.Error())
+		return
+	}
+	limit := 0
+	if param := r.URL.Query().Get("limit"); param != "" {
+		if limit, err = strconv.Atoi(param); err != nil || limit < 0 {
+			apiutils.SendJSONError(w, 400, "invalid limit '%s'", param)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiutils.SendJSONError(w, 500, "streaming not supported")
+		return
+	}
+
+	backlog, ch := logTail.follow(filter, limit)
+	defer logTail.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+
+	for _, line := range backlog {
+		fmt.Fprintf(w, "event: log\ndata: %s\n\n", strings.TrimSpace(string(line.raw)))
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(25 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case line := <-ch:
+			if filter.matches(line) {
+				fmt.Fprintf(w, "event: log\ndata: %s\n\n", strings.TrimSpace(string(line.raw)))
+				flusher.Flush()
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, "event: keepalive\ndata: \n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -1,43 +1,235 @@
 package main
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/lnbits/infinity/amqp"
 	"github.com/lnbits/infinity/api"
+	"github.com/lnbits/infinity/api/apiutils"
 	"github.com/lnbits/infinity/apps"
+	"github.com/lnbits/infinity/cashu"
+	"github.com/lnbits/infinity/chaos"
+	"github.com/lnbits/infinity/cluster"
+	"github.com/lnbits/infinity/gql"
+	"github.com/lnbits/infinity/jobs"
 	"github.com/lnbits/infinity/lightning"
+	"github.com/lnbits/infinity/metrics"
+	"github.com/lnbits/infinity/mqtt"
+	"github.com/lnbits/infinity/notify"
+	"github.com/lnbits/infinity/nwc"
+	"github.com/lnbits/infinity/redis"
+	"github.com/lnbits/infinity/rpc"
 	"github.com/lnbits/infinity/services"
 	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/systemd"
+	"github.com/lnbits/infinity/tor"
+	"github.com/lnbits/infinity/tracing"
+	"github.com/lnbits/infinity/utils"
 	"github.com/lnbits/infinity/utils/nostr_utils"
-	"github.com/rs/cors"
+	"github.com/lnbits/infinity/webhook"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 )
 
 type Settings struct {
-	Host            string   `envconfig:"HOST" default:"0.0.0.0"`
-	Port            string   `envconfig:"PORT" default:"5000"`
-	QuasarDevServer *url.URL `envconfig:"QUASAR_DEV_SERVER"`
-	ServiceURL      string   `envconfig:"SERVICE_URL"`
-
-	Database string `envconfig:"DATABASE" default:"dev.sqlite"`
-	Secret   string `envconfig:"SECRET" required:"true"`
-
-	SiteTitle         string   `envconfig:"SITE_TITLE" default:"LNBitsLocal"`
-	SiteTagline       string   `envconfig:"SITE_TAGLINE" default:"Locally-hosted lightning wallet"`
-	SiteDescription   string   `envconfig:"SITE_DESCRIPTION" default:""`
-	DefaultWalletName string   `envconfig:"DEFAULT_WALLET_NAME" default:"LNbits Wallet"`
-	AppCacheSize      int      `envconfig:"APP_CACHE_SIZE" default:"200"`
-	LuaQuota          int      `envconfig:"LUA_QUOTA" default:"2000"`
-	NostrRelays       []string `envconfig:"NOSTR_RELAYS"`
+	Host            string        `envconfig:"HOST" default:"0.0.0.0"`
+	Port            string        `envconfig:"PORT" default:"5000"`
+	QuasarDevServer *url.URL      `envconfig:"QUASAR_DEV_SERVER"`
+	StaticDir       string        `envconfig:"LNBITS_STATIC_DIR"`
+	ServiceURL      string        `envconfig:"SERVICE_URL"`
+	BaseURL         string        `envconfig:"BASE_URL"`
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+
+	LogLevel          string `envconfig:"LOG_LEVEL" default:"debug"`
+	LogFormat         string `envconfig:"LOG_FORMAT" default:"console"`
+	LogFile           string `envconfig:"LOG_FILE"`
+	LogFileMaxSize    int    `envconfig:"LOG_FILE_MAX_SIZE" default:"100"`
+	LogFileMaxBackups int    `envconfig:"LOG_FILE_MAX_BACKUPS" default:"5"`
+	LogFileMaxAge     int    `envconfig:"LOG_FILE_MAX_AGE" default:"30"`
+	LogFileCompress   bool   `envconfig:"LOG_FILE_COMPRESS"`
+	LogBufferSize     int    `envconfig:"LOG_BUFFER_SIZE" default:"1000"`
+
+	AccessLog        []string `envconfig:"ACCESS_LOG"`
+	AccessLogMaxBody int      `envconfig:"ACCESS_LOG_MAX_BODY" default:"4096"`
+
+	HTTPReadTimeout  time.Duration `envconfig:"HTTP_READ_TIMEOUT" default:"10s"`
+	HTTPWriteTimeout time.Duration `envconfig:"HTTP_WRITE_TIMEOUT" default:"10s"`
+	HTTPLongTimeout  time.Duration `envconfig:"HTTP_LONG_TIMEOUT" default:"2m"`
+	HTTPIdleTimeout  time.Duration `envconfig:"HTTP_IDLE_TIMEOUT" default:"2m"`
+
+	TLSDomains  []string `envconfig:"TLS_DOMAINS"`
+	TLSEmail    string   `envconfig:"TLS_EMAIL"`
+	TLSCacheDir string   `envconfig:"TLS_CACHE_DIR" default:"certs"`
+	TLSCertFile string   `envconfig:"TLS_CERT_FILE"`
+	TLSKeyFile  string   `envconfig:"TLS_KEY_FILE"`
+	TLSHTTPPort string   `envconfig:"TLS_HTTP_PORT"`
+
+	GRPCPort string `envconfig:"GRPC_PORT"`
+
+	TorControl         string `envconfig:"TOR_CONTROL"`
+	TorControlPassword string `envconfig:"TOR_CONTROL_PASSWORD"`
+	TorKeyFile         string `envconfig:"TOR_KEY_FILE" default:"onion.key"`
+
+	Database            string `envconfig:"DATABASE" default:"dev.sqlite"`
+	DatabaseAutoMigrate bool   `envconfig:"DATABASE_AUTO_MIGRATE" default:"true"`
+	TenantSchemas       bool   `envconfig:"TENANT_SCHEMAS" default:"false"`
+
+	Cluster bool `envconfig:"CLUSTER"`
+
+	DatabaseMaxOpenConns    int           `envconfig:"DATABASE_MAX_OPEN_CONNS" default:"20"`
+	DatabaseMaxIdleConns    int           `envconfig:"DATABASE_MAX_IDLE_CONNS" default:"5"`
+	DatabaseConnMaxLifetime time.Duration `envconfig:"DATABASE_CONN_MAX_LIFETIME" default:"30m"`
+	DatabaseConnMaxIdleTime time.Duration `envconfig:"DATABASE_CONN_MAX_IDLE_TIME" default:"5m"`
+
+	Secret       string `envconfig:"SECRET" required:"true"`
+	AdminKey     string `envconfig:"ADMIN_KEY"`
+	MetricsToken string `envconfig:"METRICS_TOKEN"`
+
+	CORSOrigins    []string `envconfig:"CORS_ORIGINS"`
+	TrustedProxies []string `envconfig:"TRUSTED_PROXIES" default:"127.0.0.0/8,::1"`
+
+	ContentSecurityPolicy    string        `envconfig:"CONTENT_SECURITY_POLICY" default:"default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; img-src 'self' data: blob: https:; font-src 'self' data:; object-src 'none'; base-uri 'self'; frame-ancestors 'self'"`
+	AppContentSecurityPolicy string        `envconfig:"APP_CONTENT_SECURITY_POLICY" default:"default-src 'self' https: data: blob: 'unsafe-inline' 'unsafe-eval'; connect-src 'self' https: wss:; object-src 'none'; base-uri 'self'; frame-ancestors 'self'"`
+	FrameOptions             string        `envconfig:"FRAME_OPTIONS" default:"SAMEORIGIN"`
+	ReferrerPolicy           string        `envconfig:"REFERRER_POLICY" default:"strict-origin-when-cross-origin"`
+	HSTSMaxAge               time.Duration `envconfig:"HSTS_MAX_AGE" default:"8760h"`
+
+	RateLimitReads    int `envconfig:"RATE_LIMIT_READS" default:"600"`
+	RateLimitWrites   int `envconfig:"RATE_LIMIT_WRITES" default:"120"`
+	RateLimitPayments int `envconfig:"RATE_LIMIT_PAYMENTS" default:"30"`
+
+	BanAuthFailures int           `envconfig:"BAN_AUTH_FAILURES" default:"20"`
+	BanLNURLScans   int           `envconfig:"BAN_LNURL_SCANS" default:"120"`
+	BanInvoices     int           `envconfig:"BAN_INVOICES" default:"600"`
+	BanWindow       time.Duration `envconfig:"BAN_WINDOW" default:"10m"`
+	BanDuration     time.Duration `envconfig:"BAN_DURATION" default:"1h"`
+
+	OTELEndpoint    string `envconfig:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OTELServiceName string `envconfig:"OTEL_SERVICE_NAME" default:"lnbits"`
+
+	MasterKey          string   `envconfig:"MASTER_KEY"`
+	MasterKeyFile      string   `envconfig:"MASTER_KEY_FILE"`
+	PreviousMasterKeys []string `envconfig:"PREVIOUS_MASTER_KEYS"`
+
+	// SECRETS_PROVIDER and its settings are read in secrets.go
+	SecretsRefreshInterval time.Duration `envconfig:"SECRETS_REFRESH_INTERVAL"`
+
+	SQLiteJournalMode        string        `envconfig:"SQLITE_JOURNAL_MODE" default:"WAL"`
+	SQLiteBusyTimeout        time.Duration `envconfig:"SQLITE_BUSY_TIMEOUT" default:"5s"`
+	SQLiteSynchronous        string        `envconfig:"SQLITE_SYNCHRONOUS" default:"NORMAL"`
+	SQLiteCheckpointInterval time.Duration `envconfig:"SQLITE_CHECKPOINT_INTERVAL" default:"5m"`
+
+	LitestreamReplica string `envconfig:"LITESTREAM_REPLICA"`
+	LitestreamBinary  string `envconfig:"LITESTREAM_BINARY" default:"litestream"`
+
+	PaymentRetentionDays int    `envconfig:"PAYMENT_RETENTION_DAYS"`
+	PaymentArchiveDir    string `envconfig:"PAYMENT_ARCHIVE_DIR"`
+	DeletedRetentionDays int    `envconfig:"DELETED_RETENTION_DAYS" default:"30"`
+
+	JobWorkers       int           `envconfig:"JOB_WORKERS" default:"4"`
+	JobMaxAttempts   int           `envconfig:"JOB_MAX_ATTEMPTS" default:"8"`
+	JobTimeout       time.Duration `envconfig:"JOB_TIMEOUT" default:"1m"`
+	JobRetentionDays int           `envconfig:"JOB_RETENTION_DAYS" default:"7"`
+
+	BackupInterval    time.Duration `envconfig:"BACKUP_INTERVAL" default:"24h"`
+	BackupDir         string        `envconfig:"BACKUP_DIR" default:"backups"`
+	BackupKeep        int           `envconfig:"BACKUP_KEEP" default:"7"`
+	BackupS3Endpoint  string        `envconfig:"BACKUP_S3_ENDPOINT"`
+	BackupS3Region    string        `envconfig:"BACKUP_S3_REGION"`
+	BackupS3Bucket    string        `envconfig:"BACKUP_S3_BUCKET"`
+	BackupS3Prefix    string        `envconfig:"BACKUP_S3_PREFIX"`
+	BackupS3AccessKey string        `envconfig:"BACKUP_S3_ACCESS_KEY"`
+	BackupS3SecretKey string        `envconfig:"BACKUP_S3_SECRET_KEY"`
+
+	SiteTitle         string        `envconfig:"SITE_TITLE" default:"LNBitsLocal"`
+	SiteTagline       string        `envconfig:"SITE_TAGLINE" default:"Locally-hosted lightning wallet"`
+	SiteDescription   string        `envconfig:"SITE_DESCRIPTION" default:""`
+	DefaultWalletName string        `envconfig:"DEFAULT_WALLET_NAME" default:"LNbits Wallet"`
+	AppCacheSize      int           `envconfig:"APP_CACHE_SIZE" default:"200"`
+	LuaQuota          int           `envconfig:"LUA_QUOTA" default:"50000000"`
+	LuaTimeout        time.Duration `envconfig:"LUA_TIMEOUT" default:"10s"`
+	LuaMemoryLimit    int           `envconfig:"LUA_MEMORY_LIMIT" default:"67108864"`
+	AppDevMode        bool          `envconfig:"APP_DEV_MODE" default:"false"`
+	AppDevDir         string        `envconfig:"APP_DEV_DIR"`
+	AppFetchTimeout   time.Duration `envconfig:"APP_FETCH_TIMEOUT" default:"5s"`
+	AppFetchMaxBytes  int64         `envconfig:"APP_FETCH_MAX_BYTES" default:"1048576"`
+	AppUpdateInterval time.Duration `envconfig:"APP_UPDATE_INTERVAL" default:"30m"`
+	AppWSPerWallet    int           `envconfig:"APP_WS_PER_WALLET" default:"200"`
+	AppWSPerIP        int           `envconfig:"APP_WS_PER_IP" default:"20"`
+	AppWSMessages     int           `envconfig:"APP_WS_MESSAGES_PER_MINUTE" default:"120"`
+	NostrRelays       []string      `envconfig:"NOSTR_RELAYS"`
+
+	CashuMintWallet string `envconfig:"CASHU_MINT_WALLET"`
+
+	MQTTURL      string   `envconfig:"MQTT_URL"`
+	MQTTTopic    string   `envconfig:"MQTT_TOPIC" default:"infinity/{wallet}/{event}"`
+	MQTTQoS      byte     `envconfig:"MQTT_QOS" default:"1"`
+	MQTTRetain   bool     `envconfig:"MQTT_RETAIN"`
+	MQTTClientID string   `envconfig:"MQTT_CLIENT_ID"`
+	MQTTWallets  []string `envconfig:"MQTT_WALLETS"`
+
+	RedisURL     string   `envconfig:"REDIS_URL"`
+	RedisChannel string   `envconfig:"REDIS_CHANNEL" default:"infinity:{wallet}:{event}"`
+	RedisWallets []string `envconfig:"REDIS_WALLETS"`
+
+	AMQPURL          string   `envconfig:"AMQP_URL"`
+	AMQPExchange     string   `envconfig:"AMQP_EXCHANGE" default:"infinity"`
+	AMQPExchangeType string   `envconfig:"AMQP_EXCHANGE_TYPE" default:"topic"`
+	AMQPRoutingKey   string   `envconfig:"AMQP_ROUTING_KEY" default:"{wallet}.{event}"`
+	AMQPWallets      []string `envconfig:"AMQP_WALLETS"`
+
+	SMTPHost        string `envconfig:"SMTP_HOST"`
+	SMTPPort        int    `envconfig:"SMTP_PORT" default:"587"`
+	SMTPUsername    string `envconfig:"SMTP_USERNAME"`
+	SMTPPassword    string `envconfig:"SMTP_PASSWORD"`
+	SMTPFrom        string `envconfig:"SMTP_FROM"`
+	SMTPSecurity    string `envconfig:"SMTP_SECURITY" default:"starttls"`
+	NotifyTemplates string `envconfig:"NOTIFY_TEMPLATES"`
+	TelegramToken   string `envconfig:"TELEGRAM_TOKEN"`
+
+	NotifyNostrRelays []string `envconfig:"NOTIFY_NOSTR_RELAYS"`
+	WebPushSubject    string   `envconfig:"WEB_PUSH_SUBJECT"`
+
+	MatrixHomeserver  string   `envconfig:"MATRIX_HOMESERVER"`
+	MatrixAccessToken string   `envconfig:"MATRIX_ACCESS_TOKEN"`
+	MatrixRoom        string   `envconfig:"MATRIX_ROOM"`
+	MatrixWallets     []string `envconfig:"MATRIX_WALLETS"`
+
+	WebhookTemplates string `envconfig:"WEBHOOK_TEMPLATES"`
+
+	RateProviders []string      `envconfig:"RATE_PROVIDERS" default:"coingecko,kraken,bitstamp,coinbase,bitfinex,coinmate,exir"`
+	RateURL       string        `envconfig:"RATE_URL"`
+	RatePath      string        `envconfig:"RATE_PATH"`
+	RateTimeout   time.Duration `envconfig:"RATE_TIMEOUT" default:"3s"`
+	RateMaxChange float64       `envconfig:"RATE_MAX_CHANGE" default:"0.25"`
+
+	Maintenance        bool   `envconfig:"MAINTENANCE"`
+	MaintenanceMessage string `envconfig:"MAINTENANCE_MESSAGE"`
+
+	UpdateCheckFeed     string        `envconfig:"UPDATE_CHECK_FEED"`
+	UpdateCheckInterval time.Duration `envconfig:"UPDATE_CHECK_INTERVAL" default:"24h"`
+
+	StartupCheck           string        `envconfig:"STARTUP_CHECK" default:"warn"`
+	StartupCheckTolerance  int64         `envconfig:"STARTUP_CHECK_TOLERANCE" default:"1000"`
+	StartupCheckPendingAge time.Duration `envconfig:"STARTUP_CHECK_PENDING_AGE" default:"24h"`
 
 	LightningBackend string `envconfig:"LIGHTNING_BACKEND" default:"void"`
 	// -- other env vars are defined in the 'lightning' package
+
+	Chaos               bool          `envconfig:"CHAOS"`
+	ChaosInvoiceFailure float64       `envconfig:"CHAOS_INVOICE_FAILURE" default:"0.05"`
+	ChaosPaymentFailure float64       `envconfig:"CHAOS_PAYMENT_FAILURE" default:"0.1"`
+	ChaosEventDrop      float64       `envconfig:"CHAOS_EVENT_DROP" default:"0.1"`
+	ChaosMaxDelay       time.Duration `envconfig:"CHAOS_MAX_DELAY" default:"30s"`
 }
 
 var (
@@ -45,34 +237,153 @@ var (
 	log    = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stdout})
 	router = mux.NewRouter()
 	commit string // will be set at compile time
+
+	flushTraces func(context.Context) error
 )
 
 func main() {
-	// environment variables
+	// config file and environment variables
+	if configPath = configFileArg(); configPath != "" {
+		if err := loadConfigFile(configPath); err != nil {
+			log.Fatal().Err(err).Str("path", configPath).Msg("couldn't load config file.")
+			return
+		}
+	}
+	if err := loadSecretFiles(); err != nil {
+		log.Fatal().Err(err).Msg("couldn't load secret files.")
+		return
+	}
+	if err := loadProviderSecrets(); err != nil {
+		log.Fatal().Err(err).Msg("couldn't load secrets from the provider.")
+		return
+	}
 	err := envconfig.Process("", &s)
 	if err != nil {
 		log.Fatal().Err(err).Msg("couldn't process envconfig.")
 		return
 	}
+	basePath, origin, err := parseBaseURL(s.BaseURL)
+	if err != nil {
+		log.Fatal().Err(err).Str("BASE_URL", s.BaseURL).Msg("invalid BASE_URL.")
+		return
+	}
+	if s.ServiceURL == "" {
+		s.ServiceURL = origin
+	}
+	apiutils.BasePath = basePath
+	if trustedProxies, err = parseTrustedProxies(s.TrustedProxies); err != nil {
+		log.Fatal().Err(err).Msg("invalid TRUSTED_PROXIES.")
+		return
+	}
+	applySettings(&s, nil)
 	apps.AppCacheSize = s.AppCacheSize
 	apps.ServiceURL = s.ServiceURL
-	api.SiteTitle = s.SiteTitle
+	api.ServiceURL = s.ServiceURL
+	apps.DevMode = s.AppDevMode
+	apps.DevDir = s.AppDevDir
+	apps.WebSocketsPerWallet = s.AppWSPerWallet
+	apps.WebSocketsPerIP = s.AppWSPerIP
+	apps.WebSocketMessagesPerMinute = s.AppWSMessages
+	jobs.Workers = s.JobWorkers
 	services.Secret = s.Secret
+	tor.ControlAddr = s.TorControl
+	tor.ControlPassword = s.TorControlPassword
+	tor.KeyFile = s.TorKeyFile
 	nostr_utils.Relays = s.NostrRelays
+	utils.RateProviders = s.RateProviders
+	utils.RateURL = s.RateURL
+	utils.RatePath = s.RatePath
+	utils.RateTimeout = s.RateTimeout
+	utils.RateMaxChange = s.RateMaxChange
+	if err := utils.SetupRateProviders(); err != nil {
+		log.Fatal().Err(err).Msg("invalid exchange rate settings.")
+		return
+	}
 	nostr_utils.Secret = s.Secret
+	storage.MaxOpenConns = s.DatabaseMaxOpenConns
+	storage.MaxIdleConns = s.DatabaseMaxIdleConns
+	storage.ConnMaxLifetime = s.DatabaseConnMaxLifetime
+	storage.ConnMaxIdleTime = s.DatabaseConnMaxIdleTime
+	storage.TenantSchemas = s.TenantSchemas
+	storage.SQLiteJournalMode = s.SQLiteJournalMode
+	storage.SQLiteBusyTimeout = s.SQLiteBusyTimeout
+	storage.SQLiteSynchronous = s.SQLiteSynchronous
+	storage.SQLiteCheckpointInterval = s.SQLiteCheckpointInterval
+	storage.LitestreamReplica = s.LitestreamReplica
+	storage.LitestreamBinary = s.LitestreamBinary
+	storage.BackupDir = s.BackupDir
+	if s.BackupS3Bucket != "" {
+		storage.BackupS3 = &storage.S3Config{
+			Endpoint:  s.BackupS3Endpoint,
+			Region:    s.BackupS3Region,
+			Bucket:    s.BackupS3Bucket,
+			Prefix:    s.BackupS3Prefix,
+			AccessKey: s.BackupS3AccessKey,
+			SecretKey: s.BackupS3SecretKey,
+		}
+	}
 
 	// setup logger
-	zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	log = log.With().Timestamp().Logger()
-	apps.SetLogger(log)
+	if err := setupLogger(); err != nil {
+		log.Fatal().Err(err).Msg("couldn't setup logger.")
+		return
+	}
 
 	// database
+	if err := loadMasterKey(); err != nil {
+		log.Fatal().Err(err).Msg("couldn't load master key.")
+		return
+	}
+	name, args := "serve", []string{}
+	if len(os.Args) > 1 {
+		name, args = os.Args[1], os.Args[2:]
+	}
+	command, ok := commands[name]
+	if !ok {
+		printUsage(nil)
+		log.Fatal().Str("command", name).Msg("unknown command.")
+		return
+	}
+	command(args)
+}
+
+// serve runs the server until it gets a signal to stop.
+func serve(args []string) {
+	storage.AutoMigrate = s.DatabaseAutoMigrate
 	if err := storage.Connect(s.Database); err != nil {
 		log.Fatal().Err(err).Str("database", s.Database).
 			Msg("couldn't open database.")
 	}
+	if s.Cluster {
+		if err := cluster.Start(s.Database); err != nil {
+			log.Fatal().Err(err).Msg("couldn't join the cluster.")
+		}
+	}
+	if err := metrics.InstrumentDB(storage.DB); err != nil {
+		log.Warn().Err(err).Msg("couldn't instrument database for metrics.")
+	}
+
+	// tracing
+	if s.OTELEndpoint != "" {
+		var err error
+		if flushTraces, err = tracing.Start(s.OTELServiceName, commit); err != nil {
+			log.Warn().Err(err).Msg("couldn't start tracing.")
+		} else if err := tracing.InstrumentDB(storage.DB); err != nil {
+			log.Warn().Err(err).Msg("couldn't instrument database for tracing.")
+		}
+	}
+	storage.StartReplication()
 
 	// lightning backend
+	if s.Chaos {
+		if s.LightningBackend != "void" {
+			log.Fatal().Str("lightning", s.LightningBackend).
+				Msg("CHAOS can only be used with the void backend.")
+			return
+		}
+		chaos.Enabled = true
+		log.Warn().Msg("chaos mode: invoices, payments and events will fail on purpose")
+	}
 	lightning.Connect(s.LightningBackend)
 	if info, err := lightning.LN.GetInfo(); err != nil {
 		log.Fatal().Err(err).Str("lightning", s.LightningBackend).
@@ -81,25 +392,169 @@ func main() {
 	} else {
 		log.Info().Int64("msat", info.Balance).Str("kind", lightning.LN.Kind()).
 			Msg("initialized lightning backend")
+		startupCheck(info.Balance)
 	}
 
 	// start nostr
 	nostr_utils.Start()
+	nwc.Start()
+
+	// cashu mint
+	if s.CashuMintWallet != "" {
+		if _, err := storage.Default.GetWallet(s.CashuMintWallet); err != nil {
+			log.Fatal().Err(err).Str("wallet", s.CashuMintWallet).
+				Msg("couldn't find the CASHU_MINT_WALLET.")
+			return
+		}
+		cashu.WalletID = s.CashuMintWallet
+		cashu.Name = s.SiteTitle
+		api.CashuVersion = apiVersion()
+		log.Info().Str("wallet", s.CashuMintWallet).Msg("cashu mint enabled")
+	}
+
+	// mqtt
+	mqtt.URL = s.MQTTURL
+	mqtt.Topic = s.MQTTTopic
+	mqtt.QoS = s.MQTTQoS
+	mqtt.Retain = s.MQTTRetain
+	mqtt.ClientID = s.MQTTClientID
+	mqtt.Wallets = s.MQTTWallets
+	if err := mqtt.Start(); err != nil {
+		log.Fatal().Err(err).Msg("couldn't start mqtt.")
+		return
+	}
+
+	// redis
+	redis.URL = s.RedisURL
+	redis.Channel = s.RedisChannel
+	redis.Wallets = s.RedisWallets
+	if err := redis.Start(); err != nil {
+		log.Fatal().Err(err).Msg("couldn't start redis.")
+		return
+	}
+
+	// amqp
+	amqp.URL = s.AMQPURL
+	amqp.Exchange = s.AMQPExchange
+	amqp.ExchangeType = s.AMQPExchangeType
+	amqp.RoutingKey = s.AMQPRoutingKey
+	amqp.Wallets = s.AMQPWallets
+	if err := amqp.Start(); err != nil {
+		log.Fatal().Err(err).Msg("couldn't start amqp.")
+		return
+	}
+
+	// webhook formats
+	webhook.SiteTitle = s.SiteTitle
+	webhook.Templates = s.WebhookTemplates
+	if err := webhook.Load(); err != nil {
+		log.Fatal().Err(err).Msg("couldn't load webhook templates.")
+		return
+	}
+
+	// notifications
+	notify.SiteTitle = s.SiteTitle
+	notify.ServiceURL = s.ServiceURL + apiutils.BasePath
+	notify.SMTPHost = s.SMTPHost
+	notify.SMTPPort = s.SMTPPort
+	notify.SMTPUsername = s.SMTPUsername
+	notify.SMTPPassword = s.SMTPPassword
+	notify.SMTPFrom = s.SMTPFrom
+	notify.SMTPSecurity = s.SMTPSecurity
+	notify.Templates = s.NotifyTemplates
+	notify.TelegramToken = s.TelegramToken
+	notify.NostrRelays = s.NotifyNostrRelays
+	notify.WebPushSubject = s.WebPushSubject
+	if notify.WebPushSubject == "" {
+		notify.WebPushSubject = s.ServiceURL
+	}
+	notify.MatrixHomeserver = s.MatrixHomeserver
+	notify.MatrixAccessToken = s.MatrixAccessToken
+	notify.MatrixRoom = s.MatrixRoom
+	notify.MatrixWallets = s.MatrixWallets
+	if err := notify.Start(); err != nil {
+		log.Fatal().Err(err).Msg("couldn't start notifications.")
+		return
+	}
+
+	// metrics
+	metrics.Start()
+	metrics.GaugeFunc("sse_connections", "Clients connected to event streams.",
+		prometheus.Labels{"stream": "wallet"},
+		func() float64 { return float64(api.SSEConnections()) })
+	metrics.GaugeFunc("sse_connections", "Clients connected to event streams.",
+		prometheus.Labels{"stream": "app"},
+		func() float64 { return float64(apps.SSEConnections(false)) })
+	metrics.GaugeFunc("sse_connections", "Clients connected to event streams.",
+		prometheus.Labels{"stream": "public"},
+		func() float64 { return float64(apps.SSEConnections(true)) })
+	metrics.GaugeFunc("sse_connections", "Clients connected to event streams.",
+		prometheus.Labels{"stream": "grpc"},
+		func() float64 { return float64(rpc.Streams()) })
+	metrics.GaugeFunc("sse_connections", "Clients connected to event streams.",
+		prometheus.Labels{"stream": "graphql"},
+		func() float64 { return float64(gql.Subscriptions()) })
+	metrics.GaugeFunc("update_available", "Whether a release newer than this build was found.",
+		nil, updateAvailable)
 
 	// start routines
 	go routines()
 
+	// daily balance snapshots
+	go snapshotBalances()
+
+	// scheduled database backups
+	if s.BackupInterval > 0 {
+		go backups()
+	}
+
 	// do an initial check for pending invoices and payments
 	go initialPaymentCheck()
 
+	// webhooks, app triggers and other jobs
+	jobs.Start()
+
+	// the app "init" event, app updates and the nostr subscriptions of apps
+	apps.Start()
+
+	// payment events for the graphql subscriptions
+	gql.Start()
+
+	// look for new releases
+	if s.UpdateCheckFeed != "" && s.UpdateCheckInterval > 0 {
+		go checkForUpdates()
+	}
+
+	// clean up the rate limit buckets of clients that went away
+	go forgetIdleRateLimits()
+
+	// bans, from here and from the other instances
+	if err := bans.load(); err != nil {
+		log.Fatal().Err(err).Msg("failed to load bans.")
+		return
+	}
+	go refreshBans()
+
 	// serve http routes
 	//
 	// api
 	router.Path("/v/settings").HandlerFunc(viewSettings)
+	router.Path("/api/version").HandlerFunc(versionInfo)
+	router.Path("/api/openapi.json").HandlerFunc(serveOpenAPI)
+	router.Path("/api/docs").HandlerFunc(serveAPIDocs)
+	router.Path("/api/graphql").HandlerFunc(gql.Handler)
+	router.Path("/api/graphql/ws").HandlerFunc(gql.WebSocket)
 	router.Path("/api/user").HandlerFunc(api.User)
+	router.Path("/api/user/apps").HandlerFunc(apps.InstalledApps)
 	router.Path("/api/user/create-wallet").HandlerFunc(api.CreateWallet)
+	router.Path("/api/user/delete").HandlerFunc(api.DeleteUser)
+	router.Path("/api/user/preferences").HandlerFunc(api.Preferences)
+	router.Path("/api/user/set-preferences").HandlerFunc(api.SetPreferences)
+	router.Path("/api/user/notifications").HandlerFunc(api.Notifications)
+	router.Path("/api/user/set-notifications").HandlerFunc(api.SetNotifications)
 	router.Path("/api/user/add-app").HandlerFunc(api.AddApp)
 	router.Path("/api/user/remove-app").HandlerFunc(api.RemoveApp)
+	router.Path("/api/user/publish-app").HandlerFunc(apps.PublishApp)
 	router.Path("/api/wallet").HandlerFunc(api.Wallet)
 	router.Path("/api/wallet/delete").HandlerFunc(api.DeleteWallet)
 	router.Path("/api/wallet/rename/{new-name}").HandlerFunc(api.RenameWallet)
@@ -107,15 +562,112 @@ func main() {
 	router.Path("/api/wallet/pay-invoice").HandlerFunc(api.PayInvoice)
 	router.Path("/api/wallet/lnurlauth").HandlerFunc(api.LnurlAuth)
 	router.Path("/api/wallet/pay-lnurl").HandlerFunc(api.PayLnurl)
+	router.Path("/api/wallet/payments").HandlerFunc(api.Payments)
+	router.Path("/api/wallet/balance-history").HandlerFunc(api.BalanceHistory)
+	router.Path("/api/wallet/usage").HandlerFunc(api.Usage)
+	router.Path("/api/wallet/pairing").HandlerFunc(api.Pairing)
+	router.Path("/api/wallet/nwc").HandlerFunc(api.NWCConnections)
+	router.Path("/api/wallet/nwc/create").HandlerFunc(api.CreateNWCConnection)
+	router.Path("/api/wallet/nwc/delete/{id}").HandlerFunc(api.DeleteNWCConnection)
+	router.Path("/api/wallet/push").HandlerFunc(api.PushSubscriptions)
+	router.Path("/api/wallet/push/subscribe").HandlerFunc(api.SubscribePush)
+	router.Path("/api/wallet/push/unsubscribe").HandlerFunc(api.UnsubscribePush)
+	router.Path("/api/wallet/telegram").HandlerFunc(api.TelegramChats)
+	router.Path("/api/wallet/telegram/link").HandlerFunc(api.LinkTelegramChat)
+	router.Path("/api/wallet/telegram/unlink/{chat}").HandlerFunc(api.UnlinkTelegramChat)
+	router.Path("/api/wallet/splits").HandlerFunc(api.ValueSplits)
+	router.Path("/api/wallet/splits/set").HandlerFunc(api.SetValueSplits)
 	router.Path("/api/wallet/payment/{id}").HandlerFunc(api.GetPayment)
 	router.Path("/api/wallet/lnurlscan/{code}").HandlerFunc(api.LnurlScan)
 	router.Path("/api/wallet/sse").HandlerFunc(api.SSE)
 	router.Path("/lnurl/wallet/drain").HandlerFunc(api.DrainFunds)
+	// lndhub
+	router.Path("/lndhub/ext/auth").HandlerFunc(api.LNDHubAuth)
+	router.Path("/lndhub/ext/getinfo").HandlerFunc(api.LNDHubGetInfo)
+	router.Path("/lndhub/ext/getbalance").HandlerFunc(api.LNDHubGetBalance)
+	router.Path("/lndhub/ext/addinvoice").HandlerFunc(api.LNDHubAddInvoice)
+	router.Path("/lndhub/ext/payinvoice").HandlerFunc(api.LNDHubPayInvoice)
+	router.Path("/lndhub/ext/gettxs").HandlerFunc(api.LNDHubGetTxs)
+	router.Path("/lndhub/ext/getpending").HandlerFunc(api.LNDHubGetPending)
+	router.Path("/lndhub/ext/getuserinvoices").HandlerFunc(api.LNDHubGetUserInvoices)
+	router.Path("/lndhub/ext/checkpayment/{hash}").HandlerFunc(api.LNDHubCheckPayment)
+	router.Path("/lndhub/ext/decodeinvoice").HandlerFunc(api.LNDHubDecodeInvoice)
+	router.Path("/lndhub/ext/getbtc").HandlerFunc(api.LNDHubGetBtc)
+
+	// btcpay greenfield
+	router.Path("/api/v1/stores/{storeId}/lightning/{cryptoCode}/info").HandlerFunc(api.GreenfieldInfo)
+	router.Path("/api/v1/stores/{storeId}/lightning/{cryptoCode}/balance").HandlerFunc(api.GreenfieldBalance)
+	router.Path("/api/v1/stores/{storeId}/lightning/{cryptoCode}/invoices").HandlerFunc(api.GreenfieldCreateInvoice)
+	router.Path("/api/v1/stores/{storeId}/lightning/{cryptoCode}/invoices/pay").HandlerFunc(api.GreenfieldPayInvoice)
+	router.Path("/api/v1/stores/{storeId}/lightning/{cryptoCode}/invoices/{id}").HandlerFunc(api.GreenfieldGetInvoice)
+	router.Path("/api/v1/stores/{storeId}/lightning/{cryptoCode}/payments/{hash}").HandlerFunc(api.GreenfieldGetPayment)
+
+	// alby
+	router.Path("/alby/balance").HandlerFunc(api.AlbyBalance)
+	router.Path("/alby/user/value4value").HandlerFunc(api.AlbyValue4Value)
+	router.Path("/alby/invoices").HandlerFunc(api.AlbyInvoices)
+	router.Path("/alby/invoices/incoming").HandlerFunc(api.AlbyIncomingInvoices)
+	router.Path("/alby/invoices/outgoing").HandlerFunc(api.AlbyOutgoingInvoices)
+	router.Path("/alby/invoices/{hash}").HandlerFunc(api.AlbyGetInvoice)
+	router.Path("/alby/payments/bolt11").HandlerFunc(api.AlbyPayBolt11)
+	router.Path("/alby/payments/keysend").HandlerFunc(api.AlbyKeysend)
+
+	// cashu mint
+	router.Path("/cashu/v1/info").HandlerFunc(api.CashuInfo)
+	router.Path("/cashu/v1/keys").HandlerFunc(api.CashuKeys)
+	router.Path("/cashu/v1/keys/{id}").HandlerFunc(api.CashuKeys)
+	router.Path("/cashu/v1/keysets").HandlerFunc(api.CashuKeysets)
+	router.Path("/cashu/v1/mint/quote/bolt11").HandlerFunc(api.CashuMintQuote)
+	router.Path("/cashu/v1/mint/quote/bolt11/{quote}").HandlerFunc(api.CashuMintQuote)
+	router.Path("/cashu/v1/mint/bolt11").HandlerFunc(api.CashuMint)
+	router.Path("/cashu/v1/melt/quote/bolt11").HandlerFunc(api.CashuMeltQuote)
+	router.Path("/cashu/v1/melt/quote/bolt11/{quote}").HandlerFunc(api.CashuMeltQuote)
+	router.Path("/cashu/v1/melt/bolt11").HandlerFunc(api.CashuMelt)
+	router.Path("/cashu/v1/swap").HandlerFunc(api.CashuSwap)
+	router.Path("/cashu/v1/checkstate").HandlerFunc(api.CashuCheckState)
+	// admin
+	router.Path("/api/admin/backups").HandlerFunc(api.ListBackups)
+	router.Path("/api/admin/backups/create").HandlerFunc(api.CreateBackup)
+	router.Path("/api/admin/audit").HandlerFunc(api.AuditLog)
+	router.Path("/api/admin/logs").HandlerFunc(listLogs)
+	router.Path("/api/admin/logs/stream").HandlerFunc(streamLogs)
+	router.Path("/api/admin/deleted").HandlerFunc(api.ListDeleted)
+	router.Path("/api/admin/db").HandlerFunc(api.DatabasePool)
+	router.Path("/api/admin/restore").HandlerFunc(api.Restore)
+	router.Path("/api/admin/ledger").HandlerFunc(api.Ledger)
+	router.Path("/api/admin/ledger/entries").HandlerFunc(api.LedgerEntries)
+	router.Path("/api/admin/ledger/check").HandlerFunc(api.CheckLedger)
+	router.Path("/api/admin/reload").HandlerFunc(reloadConfig)
+	router.Path("/api/admin/runtime").HandlerFunc(api.RuntimeStats)
+	router.Path("/api/admin/stats").HandlerFunc(api.Stats)
+	router.Path("/api/admin/usage").HandlerFunc(api.UsageReport)
+	router.Path("/api/admin/maintenance").HandlerFunc(api.Maintenance)
+	router.Path("/api/admin/jobs").HandlerFunc(api.ListJobs)
+	router.Path("/api/admin/jobs/{id}/retry").HandlerFunc(api.RetryJob)
+	router.Path("/api/admin/jobs/{id}/delete").HandlerFunc(api.DeleteJob)
+	router.Path("/api/admin/bans").HandlerFunc(listBans)
+	router.Path("/api/admin/bans/create").HandlerFunc(createBan)
+	router.Path("/api/admin/bans/{id}/delete").HandlerFunc(deleteBan)
+	router.Path("/api/admin/branding").HandlerFunc(api.Branding)
+	router.Path("/api/admin/branding/{asset}/upload").HandlerFunc(api.UploadBrandingAsset)
+	router.Path("/api/admin/branding/{asset}/delete").HandlerFunc(api.DeleteBrandingAsset)
+	router.Path("/api/admin/branding/themes/set/{name}").HandlerFunc(api.SetTheme)
+	router.Path("/api/admin/branding/themes/del/{name}").HandlerFunc(api.DeleteTheme)
+	router.PathPrefix("/api/admin/debug/pprof/").Handler(http.StripPrefix("/api/admin", api.Pprof()))
 	// app endpoints
+	router.Path("/api/apps/builtin").HandlerFunc(apps.BuiltinApps)
+	router.Path("/api/apps/nostr").HandlerFunc(apps.NostrApps)
 	router.Path("/api/wallet/app/sse").HandlerFunc(apps.SSE)
 	router.Path("/api/wallet/app/{appid}").HandlerFunc(apps.Info)
 	router.Path("/api/wallet/app/{appid}/refresh").HandlerFunc(apps.Refresh)
 	router.Path("/api/wallet/app/{appid}/clear-data").HandlerFunc(apps.ClearData)
+	router.Path("/api/wallet/app/{appid}/logs").HandlerFunc(apps.Logs)
+	router.Path("/api/wallet/app/{appid}/export").HandlerFunc(apps.Export)
+	router.Path("/api/wallet/app/{appid}/import").HandlerFunc(apps.Import)
+	router.Path("/api/wallet/app/{appid}/search").HandlerFunc(apps.Search)
+	router.Path("/api/wallet/app/{appid}/secrets").HandlerFunc(apps.ListSecrets)
+	router.Path("/api/wallet/app/{appid}/secrets/set/{name}").HandlerFunc(apps.SetSecret)
+	router.Path("/api/wallet/app/{appid}/secrets/del/{name}").HandlerFunc(apps.DeleteSecret)
 	router.Path("/api/wallet/app/{appid}/list/{model}").HandlerFunc(apps.ListItems)
 	router.Path("/api/wallet/app/{appid}/get/{model}/{key}").HandlerFunc(apps.GetItem)
 	router.Path("/api/wallet/app/{appid}/set/{model}/{key}").HandlerFunc(apps.SetItem)
@@ -123,28 +675,191 @@ func main() {
 	router.Path("/api/wallet/app/{appid}/del/{model}/{key}").HandlerFunc(apps.DeleteItem)
 	router.Path("/ext/{wallet}/{appid}/action/{action}").HandlerFunc(apps.CustomAction)
 	router.Path("/ext/{wallet}/{appid}/sse").HandlerFunc(apps.PublicSSE)
+	router.Path("/ext/{wallet}/{appid}/ws").HandlerFunc(apps.PublicWebSocket)
+	router.Path("/ext/{wallet}/{appid}/lnurl/{name}").HandlerFunc(apps.AppLNURL)
+	router.Path("/ext/{wallet}/{appid}/lnurl/{name}/callback").HandlerFunc(apps.AppLNURLCallback)
+	router.Path("/ext/{wallet}/{appid}/api/{path:.*}").HandlerFunc(apps.CustomRoute)
 	router.PathPrefix("/ext/{wallet}/{appid}/").HandlerFunc(apps.StaticFile)
 	// instawallet
 	router.Path("/lnurlwallet").HandlerFunc(instawallet)
+	router.Path("/metrics").Handler(metrics.Handler())
+	router.Path("/healthz").HandlerFunc(api.Healthz)
+	router.Path("/branding/logo").HandlerFunc(api.Logo)
+	router.Path("/branding/custom.css").HandlerFunc(api.CustomCSS)
+	router.Path("/readyz").HandlerFunc(api.Readyz)
+	router.Path("/notifications/verify").HandlerFunc(api.VerifyNotificationsEmail)
 
 	// middleware
-	router.Use(handlers.ProxyHeaders)
+	router.Use(proxyHeadersMiddleware)
+	router.Use(securityHeadersMiddleware)
+	router.Use(tracing.Middleware)
+	router.Use(requestIDMiddleware)
+	router.Use(accessLogMiddleware)
+	router.Use(metrics.Middleware)
 	router.Use(jsonHeaderMiddleware)
+	router.Use(banMiddleware)
+	router.Use(rateLimitMiddleware)
+	router.Use(adminMiddleware)
 	router.Use(userMiddleware)
 	router.Use(walletMiddleware)
-	router.Use(cors.AllowAll().Handler)
+	router.Use(auditMiddleware)
+	router.Use(corsMiddleware())
+	router.Use(timeoutMiddleware)
 
 	serveStaticClient(router)
 
 	// start http server
-	log.Info().Str("host", s.Host+":"+s.Port).Msg("http listening")
-	srv := &http.Server{
-		Handler:      router,
-		Addr:         s.Host + ":" + s.Port,
-		WriteTimeout: 10 * time.Second,
-		ReadTimeout:  10 * time.Second,
-	}
-	if err := srv.ListenAndServe(); err != nil {
-		log.Error().Err(err).Msg("error serving http")
+	srv := serverTimeouts(&http.Server{
+		Handler: mountAt(apiutils.BasePath, router),
+		Addr:    s.Host + ":" + s.Port,
+	})
+	servers := []*http.Server{srv}
+
+	// with socket activation systemd gives us the sockets, the first for the
+	// server and the second for the http redirect, otherwise we open them
+	inherited, err := systemd.Listeners()
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't use the systemd sockets.")
+		return
+	}
+	listen := func(i int, addr string) net.Listener {
+		if i < len(inherited) {
+			return inherited[i]
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal().Err(err).Str("host", addr).Msg("couldn't listen.")
+		}
+		return listener
+	}
+
+	listener := listen(0, srv.Addr)
+	if tlsEnabled() {
+		redirect, err := configureTLS(srv)
+		if err != nil {
+			log.Fatal().Err(err).Msg("couldn't configure tls.")
+			return
+		}
+		if redirect != nil {
+			redirectListener := listen(1, redirect.Addr)
+			log.Info().Str("host", redirectListener.Addr().String()).
+				Msg("http listening, redirecting to https")
+			go func() {
+				if err := redirect.Serve(redirectListener); err != nil && err != http.ErrServerClosed {
+					log.Fatal().Err(err).Msg("error serving http")
+				}
+			}()
+			servers = append(servers, redirect)
+		}
+
+		log.Info().Str("host", listener.Addr().String()).Msg("https listening")
+		go func() {
+			if err := srv.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
+				log.Fatal().Err(err).Msg("error serving https")
+			}
+		}()
+	} else {
+		log.Info().Str("host", listener.Addr().String()).Msg("http listening")
+		go func() {
+			if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Fatal().Err(err).Msg("error serving http")
+			}
+		}()
+	}
+
+	// grpc
+	if s.GRPCPort != "" {
+		serveGRPC(srv.TLSConfig)
+	}
+
+	// onion service
+	if s.TorControl != "" {
+		target := listener.Addr().String()
+		if host, port, err := net.SplitHostPort(target); err == nil {
+			if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+				target = "127.0.0.1:" + port
+			}
+		}
+		if err := tor.Publish(target); err != nil {
+			log.Error().Err(err).Str("control", s.TorControl).
+				Msg("couldn't publish onion service.")
+		} else {
+			log.Info().Str("address", "http://"+tor.Address).Msg("onion service published")
+		}
+	}
+
+	// reload settings on SIGHUP
+	go reloadOnSIGHUP()
+	if s.SecretsRefreshInterval > 0 {
+		go refreshSecrets(s.SecretsRefreshInterval)
+	}
+
+	// tell systemd we're up (with Type=notify) and keep its watchdog happy
+	systemd.Notify("READY=1")
+	go systemd.Watchdog()
+
+	// wait for a signal to stop
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	log.Info().Str("signal", sig.String()).Dur("timeout", live().ShutdownTimeout).
+		Msg("shutting down")
+	systemd.Notify("STOPPING=1")
+	shutdown(servers...)
+}
+
+// shutdown stops accepting requests and waits for the ones being served and for
+// payments in flight, then stops the background work and closes the database.
+// everything shares the same deadline.
+func shutdown(servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), live().ShutdownTimeout)
+	defer cancel()
+
+	tor.Close()
+
+	// streams and websockets are hijacked so the server doesn't wait for them
+	go func() {
+		api.CloseSSE()
+		apps.Stop()
+		gql.Stop()
+	}()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warn().Err(err).Str("host", srv.Addr).
+				Msg("requests still running after shutdown timeout")
+		}
+	}
+	stopGRPC(ctx)
+
+	if err := services.Drain(ctx); err != nil {
+		log.Warn().Err(err).Msg("payments still in flight after shutdown timeout")
+	}
+	if err := jobs.Stop(ctx); err != nil {
+		log.Warn().Err(err).Msg("jobs still running after shutdown timeout")
+	}
+	notify.Stop()
+	mqtt.Stop()
+	amqp.Stop()
+	if err := redis.Stop(ctx); err != nil {
+		log.Warn().Err(err).Msg("redis events still queued after shutdown timeout")
+	}
+
+	if flushTraces != nil {
+		if err := flushTraces(ctx); err != nil {
+			log.Warn().Err(err).Msg("failed to flush traces")
+		}
+	}
+
+	cluster.Stop()
+	if err := storage.StopReplication(ctx); err != nil {
+		log.Warn().Err(err).Msg("failed to stop litestream")
+	}
+	if err := storage.Close(); err != nil {
+		log.Warn().Err(err).Msg("failed to close database")
+	}
+
+	log.Info().Msg("bye")
+	if logFile != nil {
+		logFile.Close()
 	}
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"gorm.io/gorm"
+)
+
+// the master key encrypts the sensitive database columns. it can be given as
+// 64 hex characters in MASTER_KEY or in the file at MASTER_KEY_FILE, otherwise
+// it is derived from SECRET.
+func loadMasterKey() error {
+	var err error
+	if models.MasterKey, err = readMasterKey(s.MasterKey, s.MasterKeyFile); err != nil {
+		return err
+	}
+
+	for _, previous := range s.PreviousMasterKeys {
+		key, err := parseMasterKey(previous)
+		if err != nil {
+			return fmt.Errorf("invalid key in PREVIOUS_MASTER_KEYS: %w", err)
+		}
+		models.PreviousMasterKeys = append(models.PreviousMasterKeys, key)
+	}
+
+	return nil
+}
+
+func readMasterKey(value string, file string) ([]byte, error) {
+	if value != "" {
+		return parseMasterKey(value)
+	}
+
+	if file != "" {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MASTER_KEY_FILE: %w", err)
+		}
+		return parseMasterKey(string(contents))
+	}
+
+	key := sha256.Sum256([]byte(s.Secret + ":master-key"))
+	return key[:], nil
+}
+
+func parseMasterKey(value string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("master key must be hex: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must have 32 bytes, not %d", len(key))
+	}
+	return key, nil
+}
+
+// rotateMasterKey re-encrypts everything with the current master key. the old
+// one must be in PREVIOUS_MASTER_KEYS while this runs.
+func rotateMasterKey() {
+	if len(models.PreviousMasterKeys) == 0 {
+		log.Fatal().Msg("set the old master key in PREVIOUS_MASTER_KEYS and the new one in MASTER_KEY.")
+		return
+	}
+
+	if err := storage.Connect(s.Database); err != nil {
+		log.Fatal().Err(err).Str("database", s.Database).
+			Msg("couldn't open database.")
+		return
+	}
+
+	var count int
+	if err := storage.DB.Transaction(func(tx *gorm.DB) (err error) {
+		count, err = storage.ReencryptAll(tx)
+		return err
+	}); err != nil {
+		log.Fatal().Err(err).Msg("failed to rotate master key, nothing was changed.")
+		return
+	}
+
+	log.Info().Int("rows", count).
+		Msg("re-encrypted with the new master key, PREVIOUS_MASTER_KEYS can be removed now")
+}
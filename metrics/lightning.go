@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lnbits/relampago"
+)
+
+type lightningWallet struct {
+	relampago.Wallet
+}
+
+// WrapLightning times the calls made to the backend.
+func WrapLightning(wallet relampago.Wallet) relampago.Wallet {
+	return lightningWallet{wallet}
+}
+
+func observe(method string, start time.Time, err error) {
+	lightningCalls.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		lightningErrors.WithLabelValues(method).Inc()
+		recordLightningError(method, err)
+	}
+}
+
+// LightningError tells how often a backend method failed since we started and
+// what the last error was, for the admin stats.
+type LightningError struct {
+	Method    string    `json:"method"`
+	Count     int64     `json:"count"`
+	LastError string    `json:"last_error"`
+	LastAt    time.Time `json:"last_at"`
+}
+
+var lightningFailures = struct {
+	sync.Mutex
+	byMethod map[string]*LightningError
+}{byMethod: make(map[string]*LightningError)}
+
+func recordLightningError(method string, err error) {
+	lightningFailures.Lock()
+	defer lightningFailures.Unlock()
+
+	failure, ok := lightningFailures.byMethod[method]
+	if !ok {
+		failure = &LightningError{Method: method}
+		lightningFailures.byMethod[method] = failure
+	}
+	failure.Count++
+	failure.LastError = err.Error()
+	failure.LastAt = time.Now()
+}
+
+func LightningErrors() []LightningError {
+	lightningFailures.Lock()
+	defer lightningFailures.Unlock()
+
+	failures := make([]LightningError, 0, len(lightningFailures.byMethod))
+	for _, failure := range lightningFailures.byMethod {
+		failures = append(failures, *failure)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Method < failures[j].Method
+	})
+	return failures
+}
+
+func (l lightningWallet) GetInfo() (info relampago.WalletInfo, err error) {
+	defer func(start time.Time) { observe("get_info", start, err) }(time.Now())
+	return l.Wallet.GetInfo()
+}
+
+func (l lightningWallet) CreateInvoice(params relampago.InvoiceParams) (
+	data relampago.InvoiceData, err error,
+) {
+	defer func(start time.Time) { observe("create_invoice", start, err) }(time.Now())
+	return l.Wallet.CreateInvoice(params)
+}
+
+func (l lightningWallet) GetInvoiceStatus(checkingID string) (
+	status relampago.InvoiceStatus, err error,
+) {
+	defer func(start time.Time) { observe("get_invoice_status", start, err) }(time.Now())
+	return l.Wallet.GetInvoiceStatus(checkingID)
+}
+
+func (l lightningWallet) MakePayment(params relampago.PaymentParams) (
+	data relampago.PaymentData, err error,
+) {
+	defer func(start time.Time) { observe("make_payment", start, err) }(time.Now())
+	return l.Wallet.MakePayment(params)
+}
+
+func (l lightningWallet) GetPaymentStatus(checkingID string) (
+	status relampago.PaymentStatus, err error,
+) {
+	defer func(start time.Time) { observe("get_payment_status", start, err) }(time.Now())
+	return l.Wallet.GetPaymentStatus(checkingID)
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/events"
+	"github.com/lnbits/infinity/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// everything is exported at /metrics in the prometheus format. payments are
+// counted from the events, the lightning backend and the database are wrapped
+// so every call is timed, and the http middleware times every route.
+
+const namespace = "lnbits"
+
+var (
+	payments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payments_total",
+		Help:      "Settled or failed payments, by direction (received, sent) and status.",
+	}, []string{"direction", "status"})
+
+	paymentVolume = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payment_volume_msat_total",
+		Help:      "Amount moved by settled payments, in millisatoshis.",
+	}, []string{"direction"})
+
+	paymentFees = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payment_fees_msat_total",
+		Help:      "Routing fees paid on sent payments, in millisatoshis.",
+	})
+
+	settlementLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "payment_settlement_seconds",
+		Help:      "Time between creating an invoice or payment and it being settled.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 15, 60, 300, 1800, 3600, 21600, 86400},
+	}, []string{"direction"})
+
+	lightningCalls = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "lightning_call_seconds",
+		Help:      "Duration of calls to the lightning backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	lightningErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lightning_call_errors_total",
+		Help:      "Calls to the lightning backend that failed.",
+	}, []string{"method"})
+
+	dbQueries = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_seconds",
+		Help:      "Duration of database queries, by operation and table.",
+		Buckets:   []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+	}, []string{"operation", "table"})
+
+	dbErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_query_errors_total",
+		Help:      "Database queries that failed, not counting records not found.",
+	}, []string{"operation", "table"})
+
+	httpRequests = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_seconds",
+		Help:      "Duration of http requests, by route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+// the token, if set, must be given as a bearer token to read the metrics. it
+// can change on reload.
+var token atomic.Value
+
+func SetToken(t string) {
+	token.Store(t)
+}
+
+func Handler() http.Handler {
+	handler := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, _ := token.Load().(string)
+		if t != "" && r.Header.Get("Authorization") != "Bearer "+t {
+			w.WriteHeader(401)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// GaugeFunc exports a value that is read when the metrics are collected.
+func GaugeFunc(name, help string, labels prometheus.Labels, fn func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	}, fn)
+}
+
+// Start counts payments as they are settled.
+func Start() {
+	received := make(chan models.Payment)
+	sent := make(chan models.Payment)
+	failed := make(chan models.Payment)
+	events.OnPaymentReceived(received)
+	events.OnPaymentSent(sent)
+	events.OnPaymentFailed(failed)
+
+	go func() {
+		for {
+			select {
+			case payment := <-received:
+				payments.WithLabelValues("received", "settled").Inc()
+				paymentVolume.WithLabelValues("received").Add(float64(payment.Amount))
+				settlementLatency.WithLabelValues("received").
+					Observe(time.Since(payment.CreatedAt).Seconds())
+			case payment := <-sent:
+				payments.WithLabelValues("sent", "settled").Inc()
+				paymentVolume.WithLabelValues("sent").Add(float64(-payment.Amount))
+				paymentFees.Add(float64(payment.Fee))
+				settlementLatency.WithLabelValues("sent").
+					Observe(time.Since(payment.CreatedAt).Seconds())
+			case <-failed:
+				payments.WithLabelValues("sent", "failed").Inc()
+			}
+		}
+	}()
+}
+
+// Middleware times every request by its route template, so paths with ids
+// don't each become a different series.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := apiutils.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		httpRequests.WithLabelValues(apiutils.RouteTemplate(r), r.Method,
+			strconv.Itoa(recorder.Status)).Observe(time.Since(start).Seconds())
+	})
+}
@@ -2,15 +2,43 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
 
+	"github.com/lnbits/infinity/api"
 	"github.com/lnbits/infinity/api/apiutils"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var requestIDValidator = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// requestIDMiddleware takes the X-Request-Id given by the client or a proxy, or
+// makes one, returns it in the response and puts it in the logger of the
+// request context, so errors reported by users can be found in the logs.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-Id")
+		if !requestIDValidator.MatchString(requestID) {
+			requestID = utils.RandomHex(8)
+		}
+		w.Header().Set("X-Request-Id", requestID)
+
+		ctx := context.WithValue(r.Context(), "requestID", requestID)
+		logger := log.With().Str("request_id", requestID).Logger()
+		ctx = logger.WithContext(ctx)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("request.id", requestID))
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func jsonHeaderMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/v/") {
@@ -21,6 +49,46 @@ func jsonHeaderMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if s.AdminKey == "" {
+			apiutils.SendJSONError(w, 404, "admin API is disabled, set ADMIN_KEY to enable it")
+			return
+		}
+		if !hasAdminKey(r) {
+			apiutils.SendJSONError(w, 401, "invalid X-Admin-Key")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bearerToken is the key in Authorization, which BTCPay's Greenfield clients
+// send as "token <key>" instead of "Bearer <key>".
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	for _, scheme := range []string{"Bearer ", "token "} {
+		if strings.HasPrefix(auth, scheme) {
+			return strings.TrimSpace(strings.TrimPrefix(auth, scheme))
+		}
+	}
+	return ""
+}
+
+// hasAdminKey says whether the request has the right X-Admin-Key.
+func hasAdminKey(r *http.Request) bool {
+	return s.AdminKey != "" && subtle.ConstantTimeCompare(
+		[]byte(r.Header.Get("X-Admin-Key")),
+		[]byte(s.AdminKey),
+	) == 1
+}
+
 func userMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !strings.HasPrefix(r.URL.Path, "/api/user") {
@@ -28,13 +96,13 @@ func userMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		var user models.User
+		var user *models.User
 		var err error
 		masterKey := r.Header.Get("X-MasterKey")
 		if masterKey == "" {
 			err = fmt.Errorf("X-MasterKey header not provided")
 		} else {
-			err = storage.DB.Where("master_key", masterKey).First(&user).Error
+			user, err = storage.Default.GetUserByMasterKey(masterKey)
 		}
 
 		if err != nil {
@@ -48,7 +116,7 @@ func userMiddleware(next http.Handler) http.Handler {
 				context.WithValue(
 					r.Context(),
 					"user",
-					&user,
+					user,
 				),
 			)
 		}
@@ -59,14 +127,20 @@ func userMiddleware(next http.Handler) http.Handler {
 
 func walletMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// lndhub-compatibility, its auth route takes the key in the body
+		lndhub := strings.HasPrefix(r.URL.Path, "/lndhub/ext/")
+		greenfield := strings.HasPrefix(r.URL.Path, "/api/v1/stores/")
+		alby := strings.HasPrefix(r.URL.Path, "/alby/")
 		if !strings.HasPrefix(r.URL.Path, "/api/wallet") && // better API routes
-			!strings.HasPrefix(r.URL.Path, "/api/v1/") { // lnbits-compatibility
+			!strings.HasPrefix(r.URL.Path, "/api/v1/") && // lnbits-compatibility
+			!alby &&
+			(!lndhub || r.URL.Path == "/lndhub/ext/auth") {
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		var permission string
-		var wallet models.Wallet
+		var wallet *models.Wallet
 		var err error
 
 		// try header
@@ -75,18 +149,18 @@ func walletMiddleware(next http.Handler) http.Handler {
 			// try querystring
 			walletKey = r.URL.Query().Get("api-key")
 		}
+		if walletKey == "" && (lndhub || greenfield || alby) {
+			// the lndhub, greenfield and alby tokens are the key itself
+			walletKey = bearerToken(r)
+		}
 
 		if walletKey == "" {
 			err = fmt.Errorf("X-Api-Key header not provided")
 		} else {
-			result := storage.DB.
-				Where("admin_key", walletKey).Or("invoice_key", walletKey).
-				First(&wallet)
-			if result.Error != nil {
-				err = result.Error
-			} else if wallet.AdminKey == walletKey {
+			wallet, err = storage.Default.GetWalletByKey(walletKey)
+			if err == nil && string(wallet.AdminKey) == walletKey {
 				permission = "admin"
-			} else if wallet.InvoiceKey == walletKey {
+			} else if err == nil && string(wallet.InvoiceKey) == walletKey {
 				permission = "invoice"
 			}
 		}
@@ -97,7 +171,16 @@ func walletMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		if err != nil {
+		if err != nil && lndhub {
+			api.SendLNDHubError(w, 401, 1, "bad auth")
+			return
+		} else if err != nil && greenfield {
+			api.SendGreenfieldError(w, 401, "unauthenticated", "invalid api key")
+			return
+		} else if err != nil && alby {
+			api.SendAlbyError(w, 401, "invalid token")
+			return
+		} else if err != nil {
 			apiutils.SendJSONError(w, 401, "error fetching wallet: %s", err.Error())
 			return
 		} else {
@@ -106,7 +189,7 @@ func walletMiddleware(next http.Handler) http.Handler {
 					context.WithValue(
 						r.Context(),
 						"wallet",
-						&wallet,
+						wallet,
 					),
 					"permission",
 					permission,
@@ -11,9 +11,13 @@ import (
 type StringList []string
 
 func (sl *StringList) Scan(src interface{}) error {
-	if jstr, ok := src.(string); ok {
-		return json.Unmarshal([]byte(jstr), &sl)
-	} else {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), &sl)
+	case []byte:
+		// postgres drivers may return text as bytes
+		return json.Unmarshal(v, &sl)
+	default:
 		return errors.New("value is not a string")
 	}
 }
@@ -29,9 +33,12 @@ func (sl StringList) Value() (driver.Value, error) {
 type JSONObject map[string]interface{}
 
 func (jo *JSONObject) Scan(src interface{}) error {
-	if jstr, ok := src.(string); ok {
-		return json.Unmarshal([]byte(jstr), &jo)
-	} else {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), &jo)
+	case []byte:
+		return json.Unmarshal(v, &jo)
+	default:
 		return errors.New("value is not a string")
 	}
 }
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sensitive columns are encrypted with MasterKey using AES-GCM. values written
+// before encryption existed are read as they are and encrypted on the next write.
+// when rotating, the old keys go in PreviousMasterKeys so existing values can
+// still be decrypted.
+
+var (
+	MasterKey          []byte
+	PreviousMasterKeys [][]byte
+)
+
+const encryptedPrefix = "enc1:"
+
+var ErrDecrypt = errors.New("failed to decrypt value, wrong master key?")
+
+func aead(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must have 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt seals the plaintext with the master key. the additional data isn't
+// stored, it must be the same when decrypting.
+func Encrypt(plaintext string, additionalData []byte) (string, error) {
+	gcm, err := aead(MasterKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), additionalData)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func Decrypt(stored string, additionalData []byte) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %w", err)
+	}
+
+	for _, key := range append([][]byte{MasterKey}, PreviousMasterKeys...) {
+		gcm, err := aead(key)
+		if err != nil {
+			return "", err
+		}
+		if len(sealed) < gcm.NonceSize() {
+			return "", errors.New("encrypted value is too short")
+		}
+
+		nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+		if plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData); err == nil {
+			return string(plaintext), nil
+		}
+	}
+
+	return "", ErrDecrypt
+}
+
+func IsEncrypted(stored string) bool {
+	return strings.HasPrefix(stored, encryptedPrefix)
+}
+
+// LookupHash is stored alongside encrypted keys so they can still be searched.
+// the keys are random so a plain hash doesn't reveal anything.
+func LookupHash(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+type EncryptedString string
+
+func (es *EncryptedString) Scan(src interface{}) error {
+	var stored string
+	switch v := src.(type) {
+	case nil:
+		stored = ""
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return errors.New("value is not a string")
+	}
+
+	if !IsEncrypted(stored) {
+		*es = EncryptedString(stored)
+		return nil
+	}
+
+	plaintext, err := Decrypt(stored, nil)
+	if err != nil {
+		return err
+	}
+	*es = EncryptedString(plaintext)
+	return nil
+}
+
+func (es EncryptedString) Value() (driver.Value, error) {
+	if es == "" {
+		return "", nil
+	}
+	return Encrypt(string(es), nil)
+}
@@ -2,63 +2,88 @@ package models
 
 import (
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type User struct {
-	ID        string    `gorm:"primaryKey" json:"id"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID        string         `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time      `json:"-"`
+	UpdatedAt time.Time      `json:"-"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 
-	MasterKey string `gorm:"not null;uniqueIndex" json:"-"`
+	MasterKey     EncryptedString `gorm:"not null" json:"-"`
+	MasterKeyHash string          `gorm:"uniqueIndex" json:"-"`
 
 	// associations
 	Wallets []Wallet   `json:"wallets,omitempty"`
 	Apps    StringList `gorm:"-" json:"apps"`
 }
 
+func (user *User) BeforeSave(tx *gorm.DB) error {
+	user.MasterKeyHash = LookupHash(string(user.MasterKey))
+	return nil
+}
+
 type UserApp struct {
 	UserID string `gorm:"uniqueIndex:userapp;not null"`
 	URL    string `gorm:"uniqueIndex:userapp;not null"`
+
+	// the key that signed the app when it was installed, for trust-on-first-use
+	Signer string `gorm:"not null;default:''"`
 }
 
 type Wallet struct {
-	ID        string    `gorm:"primaryKey" json:"id"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID        string         `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time      `json:"-"`
+	UpdatedAt time.Time      `json:"-"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 
-	Name          string `gorm:"not null" json:"name"`
-	InvoiceKey    string `gorm:"not null" json:"invoicekey"`
-	AdminKey      string `gorm:"not null" json:"adminkey"`
-	BalanceNotify string `json:"balanceNotify"`
+	Name           string          `gorm:"not null" json:"name"`
+	InvoiceKey     EncryptedString `gorm:"not null" json:"invoicekey"`
+	InvoiceKeyHash string          `gorm:"uniqueIndex" json:"-"`
+	AdminKey       EncryptedString `gorm:"not null" json:"adminkey"`
+	AdminKeyHash   string          `gorm:"uniqueIndex" json:"-"`
+	BalanceNotify  string          `json:"balanceNotify"`
 
 	Balance    int64  `gorm:"->" json:"balance"`
 	LNURLDrain string `gorm:"-" json:"drain"`
 
+	// cursor for loading more payments from /api/wallet/payments
+	PaymentsNext string `gorm:"-" json:"paymentsNext,omitempty"`
+
 	// associations
 	UserID        string         `gorm:"index;not null" json:"userID"`
 	Payments      []Payment      `json:"payments,omitempty"`
 	BalanceChecks []BalanceCheck `json:"balanceChecks,omitempty"`
 }
 
+func (wallet *Wallet) BeforeSave(tx *gorm.DB) error {
+	wallet.InvoiceKeyHash = LookupHash(string(wallet.InvoiceKey))
+	wallet.AdminKeyHash = LookupHash(string(wallet.AdminKey))
+	return nil
+}
+
 type Payment struct {
-	CreatedAt time.Time `json:"date"`
+	CreatedAt time.Time `gorm:"index:idx_payments_wallet_history,priority:2" json:"date"`
 	UpdatedAt time.Time `json:"-"`
 
-	CheckingID    string     `gorm:"uniqueIndex;not null" json:"checkingID"`
-	Pending       bool       `gorm:"not null" json:"pending"`
-	Amount        int64      `gorm:"not null" json:"amount"`
-	Fee           int64      `json:"fee"`
-	Description   string     `json:"description"`
-	Bolt11        string     `json:"bolt11"`
-	Preimage      string     `json:"preimage"`
-	Hash          string     `gorm:"index:hash_idx;not null" json:"hash"`
-	Tag           string     `json:"tag"`
-	Extra         JSONObject `json:"extra"`
-	Webhook       string     `json:"webhook"`
-	WebhookStatus int        `json:"webhookStatus"`
+	CheckingID    string          `gorm:"uniqueIndex;index:idx_payments_wallet_history,priority:3;not null" json:"checkingID"`
+	Pending       bool            `gorm:"index;not null" json:"pending"`
+	Amount        int64           `gorm:"not null" json:"amount"`
+	Fee           int64           `json:"fee"`
+	Description   string          `json:"description"`
+	Bolt11        string          `json:"bolt11"`
+	Preimage      EncryptedString `json:"preimage"`
+	Hash          string          `gorm:"index:hash_idx;not null" json:"hash"`
+	Tag           string          `json:"tag"`
+	Extra         JSONObject      `json:"extra"`
+	Webhook       string          `json:"webhook"`
+	WebhookFormat string          `gorm:"not null;default:''" json:"webhookFormat"`
+	WebhookStatus int             `json:"webhookStatus"`
 
 	// associations
-	WalletID string `gorm:"index;not null" json:"walletID"`
+	WalletID string `gorm:"index;index:idx_payments_wallet_history,priority:1;not null" json:"walletID"`
 }
 
 type BalanceCheck struct {
@@ -67,6 +92,16 @@ type BalanceCheck struct {
 	URL      string `json:"-"`
 }
 
+// BalanceSnapshot is the balance of a wallet at the end of a day, made of the
+// ledger entries up to LastEntryID.
+type BalanceSnapshot struct {
+	WalletID    string    `gorm:"primaryKey" json:"-"`
+	Day         string    `gorm:"primaryKey" json:"day"` // 2006-01-02, UTC
+	Balance     int64     `gorm:"not null" json:"balance"`
+	LastEntryID uint      `gorm:"not null" json:"-"`
+	CreatedAt   time.Time `json:"-"`
+}
+
 type AppDataItem struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -76,5 +111,271 @@ type AppDataItem struct {
 	Model    string `gorm:"primaryKey" json:"model"`
 	Key      string `gorm:"primaryKey" json:"key"`
 
-	Value JSONObject `gorm:"not null" json:"value"`
+	Value    JSONObject `gorm:"not null" json:"value"`
+	Revision int64      `gorm:"not null;default:1" json:"revision"`
+}
+
+type AppSchema struct {
+	UpdatedAt time.Time `json:"updated_at"`
+
+	App      string `gorm:"primaryKey" json:"app"`
+	WalletID string `gorm:"primaryKey" json:"walletID"`
+	Version  int    `gorm:"not null" json:"version"`
+}
+
+type AppItemTerm struct {
+	App      string `gorm:"primaryKey;index:idx_app_item_term,priority:1"`
+	WalletID string `gorm:"primaryKey;index:idx_app_item_term,priority:2"`
+	Model    string `gorm:"primaryKey"`
+	Key      string `gorm:"primaryKey"`
+	Term     string `gorm:"primaryKey;index:idx_app_item_term,priority:3"`
+}
+
+type AppSecret struct {
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	App      string `gorm:"primaryKey" json:"-"`
+	WalletID string `gorm:"primaryKey" json:"-"`
+	Name     string `gorm:"primaryKey" json:"name"`
+
+	// encrypted, never sent to clients
+	Value string `gorm:"not null" json:"-"`
+}
+
+// the location of the secret is used as additional data so a ciphertext can't be
+// moved around to another app or wallet.
+func (secret AppSecret) AdditionalData() []byte {
+	return []byte(secret.WalletID + "\x00" + secret.App + "\x00" + secret.Name)
+}
+
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Name      string    `gorm:"not null" json:"name"`
+	AppliedAt time.Time `gorm:"not null" json:"applied_at"`
+}
+
+// audit entries are only ever inserted, never updated or deleted
+type AuditEntry struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+
+	RequestID string `json:"request_id"`
+	UserID    string `gorm:"index" json:"user_id,omitempty"`
+	WalletID  string `gorm:"index" json:"wallet_id,omitempty"`
+	KeyType   string `json:"key_type,omitempty"` // master, admin, invoice or admin-api
+	KeyHash   string `json:"key_hash,omitempty"` // a prefix of the LookupHash of the key
+	IP        string `json:"ip"`
+
+	Action string `gorm:"index" json:"action"` // the route
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+}
+
+// ledger entries are only ever inserted, the legs of each transaction sum to zero
+type LedgerEntry struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+
+	TxID       string `gorm:"index;not null" json:"tx_id"`
+	Kind       string `gorm:"not null" json:"kind"`
+	Account    string `gorm:"index:idx_ledger_account,priority:1;not null" json:"account"`
+	WalletID   string `gorm:"index:idx_ledger_account,priority:2" json:"wallet_id,omitempty"`
+	Amount     int64  `gorm:"not null" json:"amount"`
+	CheckingID string `gorm:"index" json:"checking_id,omitempty"`
+}
+
+// Job is some background work, kept after it is done for a while and forever
+// if it fails too many times, until it is retried or deleted. Key is unique so
+// the same job can't be enqueued twice.
+type Job struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Key         string     `gorm:"uniqueIndex;not null" json:"key"`
+	Kind        string     `gorm:"index;not null" json:"kind"`
+	Payload     string     `gorm:"not null" json:"-"` // JSON
+	Status      string     `gorm:"index:idx_jobs_due,priority:1;not null" json:"status"`
+	RunAt       time.Time  `gorm:"index:idx_jobs_due,priority:2;not null" json:"run_at"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	Attempts    int        `gorm:"not null" json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// Ban blocks requests from an IP or with a key, made by the abuse detection or
+// by the admin. there is at most one for each subject, expired ones are
+// replaced when it is banned again.
+type Ban struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Subject   string     `gorm:"uniqueIndex;not null" json:"subject"` // ip:<address> or key:<prefix of the LookupHash>
+	Reason    string     `json:"reason"`
+	Automatic bool       `json:"automatic"`
+	ExpiresAt *time.Time `gorm:"index" json:"expires_at,omitempty"` // never if nil
+}
+
+// BrandingAsset is a file uploaded by the admin to customize the client, the
+// logo or the custom CSS.
+type BrandingAsset struct {
+	Name        string    `gorm:"primaryKey" json:"name"`
+	ContentType string    `gorm:"not null" json:"content_type"`
+	Data        []byte    `gorm:"not null" json:"-"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Theme is a color theme offered by the client besides the built-in ones.
+type Theme struct {
+	Name      string     `gorm:"primaryKey" json:"name"`
+	Colors    JSONObject `gorm:"not null" json:"colors"` // color name: css color
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// UserPreferences are the client settings of a user, kept on the server so
+// they are the same on every device. empty fields use the client defaults.
+type UserPreferences struct {
+	UserID       string    `gorm:"primaryKey" json:"-"`
+	Denomination string    `gorm:"not null;default:''" json:"denomination"` // sat, msat or btc
+	Currency     string    `gorm:"not null;default:''" json:"currency"`     // fiat, like USD
+	Locale       string    `gorm:"not null;default:''" json:"locale"`       // like en or pt-BR
+	Theme        string    `gorm:"not null;default:''" json:"theme"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// NotificationKinds are the payments someone wants to be told about. amounts
+// are in msat.
+type NotificationKinds struct {
+	Received    bool  `gorm:"not null;default:false" json:"received"`
+	ReceivedMin int64 `gorm:"not null;default:0" json:"received_min"` // only payments of at least this
+	Sent        bool  `gorm:"not null;default:false" json:"sent"`
+	Failed      bool  `gorm:"not null;default:false" json:"failed"`
+	LowBalance  int64 `gorm:"not null;default:0" json:"low_balance"` // when a wallet goes below this, 0 for never
+}
+
+// UserNotifications are what a user is told about the payments of all its
+// wallets and where. emails are only sent once the address is verified.
+// NostrPubKey gets them as encrypted direct messages.
+type UserNotifications struct {
+	UserID        string `gorm:"primaryKey" json:"-"`
+	Email         string `gorm:"not null;default:''" json:"email"`
+	EmailVerified bool   `gorm:"not null;default:false" json:"email_verified"`
+	NostrPubKey   string `gorm:"not null;default:''" json:"nostr_pubkey"` // hex
+
+	NotificationKinds `gorm:"embedded"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NWCConnection lets a nostr client spend from a wallet with Nostr Wallet
+// Connect. the client secret is derived from the instance secret, only its
+// pubkey is kept. Spent is what was paid since RenewedAt, against Budget (in
+// msat, 0 for no limit), which starts again every BudgetRenewal.
+type NWCConnection struct {
+	ID        string     `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	WalletID  string     `gorm:"index;not null" json:"-"`
+	Name      string     `gorm:"not null" json:"name"`
+	PubKey    string     `gorm:"index;not null" json:"pubkey"`
+	ExpiresAt *time.Time `json:"expires_at"`
+
+	Budget        int64     `gorm:"not null;default:0" json:"budget"`
+	BudgetRenewal string    `gorm:"not null;default:''" json:"budget_renewal"` // daily, weekly, monthly, yearly or never
+	Spent         int64     `gorm:"not null;default:0" json:"spent"`
+	RenewedAt     time.Time `json:"renewed_at"`
+
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// TelegramChat is a telegram chat linked to a wallet with a code made for it.
+// it gets the notifications of the wallet and can use the commands of the bot
+// on it. Name is the title of the chat or the name of the user.
+type TelegramChat struct {
+	ChatID    int64     `gorm:"primaryKey;autoIncrement:false" json:"chat_id"`
+	CreatedAt time.Time `json:"created_at"`
+	WalletID  string    `gorm:"index;not null" json:"-"`
+	Name      string    `gorm:"not null;default:''" json:"name"`
+}
+
+// PushSubscription is a browser that gets web push notifications of a wallet,
+// of the kinds it chose. P256DH and Auth are the keys of the subscription, in
+// base64url.
+type PushSubscription struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	WalletID  string    `gorm:"index;not null" json:"-"`
+	Endpoint  string    `gorm:"not null" json:"endpoint"`
+	P256DH    string    `gorm:"not null" json:"-"`
+	Auth      string    `gorm:"not null" json:"-"`
+	UserAgent string    `gorm:"not null;default:''" json:"user_agent"`
+
+	NotificationKinds `gorm:"embedded"`
+}
+
+// AppWithdraw is a k1 given by an lnurl-withdraw endpoint of an app, with the
+// amounts it was given for. it is deleted when a wallet takes it, so each one
+// pays a single invoice. Params is the query string the endpoint got.
+type AppWithdraw struct {
+	K1        string     `gorm:"primaryKey"`
+	CreatedAt time.Time  `gorm:"index"`
+	WalletID  string     `gorm:"index;not null"`
+	App       string     `gorm:"not null"`
+	Endpoint  string     `gorm:"not null"`
+	Min       int64      `gorm:"not null"`
+	Max       int64      `gorm:"not null"`
+	Params    JSONObject `gorm:"not null"`
+}
+
+// CashuQuote is a mint quote (ecash for an invoice paid to the mint wallet) or
+// a melt quote (ecash given for an invoice the mint wallet pays), in sat.
+// State is UNPAID, PENDING, PAID or, for mint quotes whose ecash was given,
+// ISSUED.
+type CashuQuote struct {
+	ID         string    `gorm:"primaryKey" json:"quote"`
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+	Kind       string    `gorm:"not null" json:"-"` // mint or melt
+	Request    string    `gorm:"not null" json:"request"`
+	Hash       string    `gorm:"index;not null" json:"-"`
+	Amount     int64     `gorm:"not null" json:"amount"`
+	FeeReserve int64     `gorm:"not null;default:0" json:"-"`
+	State      string    `gorm:"not null" json:"state"`
+	Expiry     time.Time `json:"-"`
+	Preimage   string    `json:"-"`
+}
+
+// CashuProof is a spent proof, known by Y, the point its secret hashes to, so a
+// proof can't be spent twice.
+type CashuProof struct {
+	Y         string    `gorm:"primaryKey" json:"Y"`
+	CreatedAt time.Time `json:"-"`
+	KeysetID  string    `gorm:"not null" json:"id"`
+	Amount    int64     `gorm:"not null" json:"amount"`
+	Secret    string    `gorm:"not null" json:"secret"`
+	Quote     string    `gorm:"index" json:"-"` // the melt quote it was spent on, if any
+}
+
+// ValueSplit forwards Percent of every payment a wallet receives to a lightning
+// address, like the value splits of podcasting 2.0.
+type ValueSplit struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	WalletID  string    `gorm:"index;not null" json:"-"`
+	Name      string    `gorm:"not null;default:''" json:"name"`
+	Address   string    `gorm:"not null" json:"address"`
+	Percent   float64   `gorm:"not null" json:"percent"`
+}
+
+// SplitPayment is the share of a received payment forwarded by a split, kept so
+// it is never forwarded twice. Hash is of the outgoing payment.
+type SplitPayment struct {
+	Source    string    `gorm:"primaryKey" json:"source"` // checking id of the received payment
+	SplitID   string    `gorm:"primaryKey" json:"split_id"`
+	CreatedAt time.Time `json:"created_at"`
+	WalletID  string    `gorm:"index;not null" json:"-"`
+	Amount    int64     `gorm:"not null" json:"amount"`
+	Hash      string    `gorm:"not null;default:''" json:"hash"`
 }
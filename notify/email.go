@@ -0,0 +1,217 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lnbits/infinity/jobs"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/utils"
+)
+
+var (
+	SMTPHost     string
+	SMTPPort     = 587
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	// SMTPSecurity is starttls, tls for a connection that is TLS from the
+	// start (usually on port 465) or none, for relays on the same machine.
+	SMTPSecurity = "starttls"
+
+	// Templates is a file with templates that replace the ones in
+	// templates.tmpl, it may define only some of them.
+	Templates string
+
+	SMTPTimeout = time.Second * 30
+)
+
+//go:embed templates.tmpl
+var defaultTemplates string
+
+var templates *template.Template
+
+var templateFuncs = template.FuncMap{"sat": sat}
+
+// sat formats msat as sat, with the decimals only when there are any.
+func sat(msat int64) string {
+	if msat < 0 {
+		msat = -msat
+	}
+	s := strconv.FormatInt(msat/1000, 10)
+	if msat%1000 != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%03d", msat%1000), "0")
+	}
+	return s
+}
+
+func EmailEnabled() bool {
+	return SMTPHost != ""
+}
+
+func loadTemplates() error {
+	t, err := template.New("").Funcs(templateFuncs).Parse(defaultTemplates)
+	if err != nil {
+		return err
+	}
+	if Templates != "" {
+		if t, err = t.ParseFiles(Templates); err != nil {
+			return fmt.Errorf("failed to load NOTIFY_TEMPLATES: %w", err)
+		}
+	}
+	templates = t
+	return nil
+}
+
+func init() {
+	jobs.Register("email", sendEmail)
+}
+
+type emailJob struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// enqueueEmail renders the subject and body templates of a kind, the
+// "<kind>.subject" and "<kind>.body" ones.
+func enqueueEmail(to, kind string, data interface{}) error {
+	var subject, body bytes.Buffer
+	if err := templates.ExecuteTemplate(&subject, kind+".subject", data); err != nil {
+		return err
+	}
+	if err := templates.ExecuteTemplate(&body, kind+".body", data); err != nil {
+		return err
+	}
+	return jobs.Enqueue("email", emailJob{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    strings.TrimSpace(body.String()) + "\n",
+	})
+}
+
+// VerificationToken is what proves an email got the verification message.
+func VerificationToken(userID, email string) string {
+	h := hmac.New(sha256.New, []byte(services.Secret+":notifications-email"))
+	h.Write([]byte(userID + ":" + email))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SendVerification sends the link that must be opened before the address gets
+// any notification.
+func SendVerification(userID, email, baseURL string) error {
+	if !EmailEnabled() {
+		return errors.New("email notifications need SMTP_HOST")
+	}
+
+	query := url.Values{}
+	query.Set("user", userID)
+	query.Set("email", email)
+	query.Set("token", VerificationToken(userID, email))
+	return enqueueEmail(email, "verify", struct {
+		Link       string
+		SiteTitle  string
+		ServiceURL string
+	}{baseURL + "/notifications/verify?" + query.Encode(), SiteTitle, ServiceURL})
+}
+
+func sendEmail(ctx context.Context, payload json.RawMessage) error {
+	if !EmailEnabled() {
+		return errors.New("SMTP_HOST is not set on this instance")
+	}
+	var job emailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	from := SMTPFrom
+	if from == "" {
+		from = SMTPUsername
+	}
+	domain := from[strings.LastIndex(from, "@")+1:]
+	fmt.Fprintf(&msg, "From: %s\r\n", mime.QEncoding.Encode("utf-8", SiteTitle)+" <"+from+">")
+	fmt.Fprintf(&msg, "To: %s\r\n", job.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", job.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", utils.RandomHex(16), domain)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(job.Body, "\n", "\r\n"))
+
+	return deliver(ctx, from, job.To, msg.Bytes())
+}
+
+func deliver(ctx context.Context, from, to string, msg []byte) error {
+	addr := net.JoinHostPort(SMTPHost, strconv.Itoa(SMTPPort))
+	dialer := &net.Dialer{Timeout: SMTPTimeout}
+	tlsConfig := &tls.Config{ServerName: SMTPHost}
+
+	var conn net.Conn
+	var err error
+	if SMTPSecurity == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to smtp server: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(SMTPTimeout))
+
+	c, err := smtp.NewClient(conn, SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if SMTPSecurity == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server doesn't support STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if SMTPUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", SMTPUsername, SMTPPassword, SMTPHost)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
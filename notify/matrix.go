@@ -0,0 +1,158 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lnbits/infinity/jobs"
+)
+
+// the received, sent and failed payments of the wallets posted to a matrix
+// room, for the operators and communities watching an instance. this is set by
+// the operator and doesn't depend on what users want. the messages are notices
+// with the "<kind>.matrix" templates as their html and the push ones as their
+// text.
+
+var (
+	// MatrixHomeserver is like https://matrix.org.
+	MatrixHomeserver  string
+	MatrixAccessToken string
+
+	// MatrixRoom is a room id (!abc:matrix.org) or alias (#ops:matrix.org), the
+	// account of the token must have joined it.
+	MatrixRoom string
+
+	// MatrixWallets limits the payments posted to these wallets, all when empty.
+	MatrixWallets []string
+)
+
+var (
+	matrixClient  = &http.Client{Timeout: time.Second * 30}
+	matrixRoomID  string
+	matrixWallets map[string]bool
+)
+
+func init() {
+	jobs.Register("matrix", sendMatrix)
+}
+
+func MatrixEnabled() bool {
+	return MatrixHomeserver != "" && MatrixAccessToken != "" && MatrixRoom != ""
+}
+
+func startMatrix() error {
+	matrixRoomID = MatrixRoom
+	if strings.HasPrefix(MatrixRoom, "#") {
+		var room struct {
+			RoomID string `json:"room_id"`
+		}
+		if err := matrixCall(context.Background(), "GET",
+			"/directory/room/"+url.PathEscape(MatrixRoom), nil, &room); err != nil {
+			return fmt.Errorf("failed to find MATRIX_ROOM: %w", err)
+		}
+		matrixRoomID = room.RoomID
+	}
+
+	if len(MatrixWallets) > 0 {
+		matrixWallets = make(map[string]bool, len(MatrixWallets))
+		for _, id := range MatrixWallets {
+			matrixWallets[id] = true
+		}
+	}
+
+	log.Info().Str("room", matrixRoomID).Msg("posting payments to matrix")
+	return nil
+}
+
+func matrixWants(kind, walletID string) bool {
+	if !MatrixEnabled() || kind == KindLowBalance {
+		return false
+	}
+	return matrixWallets == nil || matrixWallets[walletID]
+}
+
+func matrixCall(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method,
+		strings.TrimSuffix(MatrixHomeserver, "/")+"/_matrix/client/v3"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+MatrixAccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := matrixClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var merr struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&merr)
+		return fmt.Errorf("matrix returned %d: %s %s", resp.StatusCode, merr.ErrCode, merr.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+type matrixJob struct {
+	// TxnID makes the homeserver take the message only once when the job runs
+	// again.
+	TxnID string `json:"txn_id"`
+	Text  string `json:"text"`
+	HTML  string `json:"html"`
+}
+
+func enqueueMatrix(kind string, n Notification) error {
+	var text, html bytes.Buffer
+	if err := templates.ExecuteTemplate(&text, kind+".push", n); err != nil {
+		return err
+	}
+	if err := templates.ExecuteTemplate(&html, kind+".matrix", n); err != nil {
+		return err
+	}
+	return jobs.Enqueue("matrix", matrixJob{
+		TxnID: n.Payment.CheckingID + "." + kind,
+		Text:  strings.TrimSpace(text.String()),
+		HTML:  strings.TrimSpace(html.String()),
+	})
+}
+
+func sendMatrix(ctx context.Context, payload json.RawMessage) error {
+	if !MatrixEnabled() || matrixRoomID == "" {
+		return errors.New("matrix notifications need MATRIX_HOMESERVER, MATRIX_ACCESS_TOKEN and MATRIX_ROOM")
+	}
+	var job matrixJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+
+	return matrixCall(ctx, "PUT", "/rooms/"+url.PathEscape(matrixRoomID)+
+		"/send/m.room.message/"+url.PathEscape(job.TxnID), struct {
+		MsgType       string `json:"msgtype"`
+		Body          string `json:"body"`
+		Format        string `json:"format"`
+		FormattedBody string `json:"formatted_body"`
+	}{"m.notice", job.Text, "org.matrix.custom.html", job.HTML}, nil)
+}
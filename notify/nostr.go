@@ -0,0 +1,89 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	nostr "github.com/fiatjaf/go-nostr"
+	"github.com/lnbits/infinity/jobs"
+	"github.com/lnbits/infinity/utils/nostr_utils"
+)
+
+// notifications sent as nip04 direct messages to the pubkey a user sets, from a
+// key of the instance derived from its secret. they are published to
+// NostrRelays and NOSTR_RELAYS.
+
+// NostrRelays are where the messages are published besides NOSTR_RELAYS.
+var NostrRelays []string
+
+var ErrNostrDisabled = errors.New("nostr notifications need NOSTR_RELAYS or NOTIFY_NOSTR_RELAYS")
+
+func init() {
+	jobs.Register("nostr-dm", sendNostr)
+}
+
+func NostrEnabled() bool {
+	return len(NostrRelays) > 0 || len(nostr_utils.Relays) > 0
+}
+
+func nostrKey() string {
+	return nostr_utils.DeriveKey("nostrkey:notify")
+}
+
+// NostrPubKey is who the messages come from, so users can tell them apart.
+func NostrPubKey() string {
+	pubkey, _ := nostr.GetPublicKey(nostrKey())
+	return pubkey
+}
+
+type nostrJob struct {
+	PubKey string `json:"pubkey"`
+	Text   string `json:"text"`
+}
+
+// enqueueNostr renders the "<kind>.nostr" template.
+func enqueueNostr(pubkey, kind string, data interface{}) error {
+	var text bytes.Buffer
+	if err := templates.ExecuteTemplate(&text, kind+".nostr", data); err != nil {
+		return err
+	}
+	return jobs.Enqueue("nostr-dm", nostrJob{
+		PubKey: pubkey,
+		Text:   strings.TrimSpace(text.String()),
+	})
+}
+
+func sendNostr(ctx context.Context, payload json.RawMessage) error {
+	if !NostrEnabled() {
+		return ErrNostrDisabled
+	}
+	var job nostrJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+
+	key := nostrKey()
+	content, err := nostr_utils.NIP04Encrypt(job.Text, key, job.PubKey)
+	if err != nil {
+		return err
+	}
+	pubkey, _ := nostr.GetPublicKey(key)
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: time.Now(),
+		Kind:      nostr.KindEncryptedDirectMessage,
+		Tags:      nostr.Tags{nostr.StringList{"p", job.PubKey}},
+		Content:   content,
+	}
+	if err := evt.Sign(key); err != nil {
+		return err
+	}
+	if accepted := nostr_utils.Broadcast(evt, NostrRelays); len(accepted) == 0 {
+		return errors.New("no relay took the message")
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package notify
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lnbits/infinity/events"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	"github.com/rs/zerolog"
+)
+
+// notifications tell users about their payments: received ones of at least
+// some amount, sent ones, the ones that failed after being sent and wallets
+// going below a balance. what each user wants is in its UserNotifications,
+// which apply to all its wallets. they go to its email, its nostr pubkey and
+// to the telegram chats linked to the wallet. browsers subscribed to web push
+// on a wallet choose their own kinds instead, and the operator may have all
+// payments posted to a matrix room. everything is sent by background
+// jobs, which are tried again when the server on the other side is down.
+
+const (
+	KindReceived   = "received"
+	KindSent       = "sent"
+	KindFailed     = "failed"
+	KindLowBalance = "low_balance"
+)
+
+var log zerolog.Logger
+
+func SetLogger(logger zerolog.Logger) {
+	log = logger.With().Str("s", "notify").Logger()
+}
+
+var (
+	// SiteTitle and ServiceURL are given to the templates.
+	SiteTitle  string
+	ServiceURL string
+)
+
+// Notification is what the templates get.
+type Notification struct {
+	Kind       string
+	Wallet     models.Wallet
+	Payment    models.Payment
+	Balance    int64 // of the wallet after the payment, msat
+	Threshold  int64 // the low balance set, msat
+	Time       time.Time
+	SiteTitle  string
+	ServiceURL string
+}
+
+// Enabled tells if there is anywhere to send notifications to.
+func Enabled() bool {
+	return EmailEnabled() || TelegramEnabled() || NostrEnabled() || WebPushEnabled() ||
+		MatrixEnabled()
+}
+
+// Start sends notifications for the payments from then on.
+func Start() error {
+	if !Enabled() {
+		return nil
+	}
+	switch SMTPSecurity {
+	case "starttls", "tls", "none":
+	default:
+		return errors.New("SMTP_SECURITY must be starttls, tls or none")
+	}
+	if err := loadTemplates(); err != nil {
+		return err
+	}
+	if TelegramEnabled() {
+		if err := startTelegram(); err != nil {
+			return err
+		}
+	}
+	if MatrixEnabled() {
+		if err := startMatrix(); err != nil {
+			return err
+		}
+	}
+
+	listen := func(register func(chan models.Payment), handle func(models.Payment)) {
+		c := make(chan models.Payment)
+		register(c)
+		go func() {
+			for payment := range c {
+				handle(payment)
+			}
+		}()
+	}
+	listen(events.OnPaymentReceived, func(payment models.Payment) {
+		notify(KindReceived, payment, func(kinds *models.NotificationKinds) bool {
+			return kinds.Received && payment.Amount >= kinds.ReceivedMin
+		})
+	})
+	listen(events.OnPaymentSent, func(payment models.Payment) {
+		notify(KindSent, payment, func(kinds *models.NotificationKinds) bool {
+			return kinds.Sent
+		})
+	})
+	listen(events.OnPaymentFailed, func(payment models.Payment) {
+		notify(KindFailed, payment, func(kinds *models.NotificationKinds) bool {
+			return kinds.Failed
+		})
+	})
+	listen(events.OnPaymentSent, func(payment models.Payment) {
+		notify(KindLowBalance, payment, func(kinds *models.NotificationKinds) bool {
+			return kinds.LowBalance > 0
+		})
+	})
+	return nil
+}
+
+// notify sends a kind of notification of a payment to the user of the wallet
+// and to the push subscriptions of the wallet that want it, each has its own
+// kinds, and to the matrix room.
+func notify(kind string, payment models.Payment, wants func(*models.NotificationKinds) bool) {
+	log := log.With().Str("kind", kind).Str("wallet", payment.WalletID).Logger()
+
+	wallet, err := storage.Default.GetWallet(payment.WalletID)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load wallet to notify")
+		return
+	}
+	settings, err := storage.Default.GetUserNotifications(wallet.UserID)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load notification settings")
+		return
+	}
+	var subscriptions []models.PushSubscription
+	if WebPushEnabled() {
+		if subscriptions, err = ListPushSubscriptions(wallet.ID); err != nil {
+			log.Warn().Err(err).Msg("failed to load push subscriptions")
+		}
+	}
+
+	user := wants(&settings.NotificationKinds)
+	pushed := subscriptions[:0]
+	for _, subscription := range subscriptions {
+		if wants(&subscription.NotificationKinds) {
+			pushed = append(pushed, subscription)
+		}
+	}
+	matrix := matrixWants(kind, wallet.ID)
+	if !user && len(pushed) == 0 && !matrix {
+		return
+	}
+
+	balance, err := services.LoadWalletBalance(wallet.ID)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load balance to notify")
+		return
+	}
+	notification := func(threshold int64) (Notification, bool) {
+		// only when this payment took the balance below the threshold, not on
+		// every payment made while it is low
+		if kind == KindLowBalance {
+			before := balance - payment.Amount + payment.Fee
+			if balance >= threshold || before < threshold {
+				return Notification{}, false
+			}
+		}
+		return Notification{
+			Kind:       kind,
+			Wallet:     *wallet,
+			Payment:    payment,
+			Balance:    balance,
+			Threshold:  threshold,
+			Time:       time.Now(),
+			SiteTitle:  SiteTitle,
+			ServiceURL: ServiceURL,
+		}, true
+	}
+
+	if matrix {
+		n, _ := notification(0)
+		if err := enqueueMatrix(kind, n); err != nil {
+			log.Warn().Err(err).Msg("failed to queue matrix message")
+		}
+	}
+	for _, subscription := range pushed {
+		if n, ok := notification(subscription.LowBalance); ok {
+			if err := enqueuePush(subscription.ID, kind, n); err != nil {
+				log.Warn().Err(err).Msg("failed to queue push notification")
+			}
+		}
+	}
+
+	n, ok := notification(settings.LowBalance)
+	if !user || !ok {
+		return
+	}
+	if settings.Email != "" && settings.EmailVerified {
+		if err := enqueueEmail(settings.Email, kind, n); err != nil {
+			log.Warn().Err(err).Msg("failed to queue email")
+		}
+	}
+	if settings.NostrPubKey != "" && NostrEnabled() {
+		if err := enqueueNostr(settings.NostrPubKey, kind, n); err != nil {
+			log.Warn().Err(err).Msg("failed to queue nostr message")
+		}
+	}
+	if TelegramEnabled() {
+		if err := enqueueTelegram(wallet.ID, kind, n); err != nil {
+			log.Warn().Err(err).Msg("failed to queue telegram messages")
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lnbits/infinity/cluster"
+	"github.com/lnbits/infinity/jobs"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	rp "github.com/lnbits/relampago"
+	"gorm.io/gorm"
+)
+
+// the telegram bot of the instance. a wallet makes a linking code, which is
+// sent to the bot with /start (what the t.me link does) from the chat that
+// should be linked. linked chats get the notifications of the wallet, with the
+// same settings as the emails, and can ask the bot for the balance, the last
+// payments and new invoices. the bot gets its messages by long polling, in a
+// cluster only the leader does it.
+
+var (
+	// TelegramToken is the token of the bot, from @BotFather.
+	TelegramToken string
+
+	TelegramPollTimeout = time.Second * 50
+	TelegramLinkExpiry  = time.Minute * 15
+
+	TelegramAPI = "https://api.telegram.org"
+)
+
+var ErrTelegramDisabled = errors.New("telegram notifications need TELEGRAM_TOKEN")
+
+var (
+	telegramClient   = &http.Client{Timeout: TelegramPollTimeout + time.Second*10}
+	telegramUsername string
+	telegramStop     context.CancelFunc
+	telegramStopped  sync.WaitGroup
+)
+
+func TelegramEnabled() bool {
+	return TelegramToken != ""
+}
+
+// TelegramBot is the username of the bot, known once it is started.
+func TelegramBot() string {
+	return telegramUsername
+}
+
+func init() {
+	jobs.Register("telegram", sendTelegram)
+}
+
+type telegramJob struct {
+	ChatID int64  `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+func startTelegram() error {
+	var me struct {
+		Username string `json:"username"`
+	}
+	if err := telegramCall(context.Background(), "getMe", nil, &me); err != nil {
+		return fmt.Errorf("failed to reach the telegram bot, check TELEGRAM_TOKEN: %w", err)
+	}
+	telegramUsername = me.Username
+	log.Info().Str("bot", me.Username).Msg("telegram bot started")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	telegramStop = cancel
+	telegramStopped.Add(1)
+	go poll(ctx)
+	return nil
+}
+
+// Stop stops getting the messages of the bot.
+func Stop() {
+	if telegramStop == nil {
+		return
+	}
+	telegramStop()
+	telegramStopped.Wait()
+}
+
+func telegramCall(ctx context.Context, method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		TelegramAPI+"/bot"+TelegramToken+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := telegramClient.Do(req)
+	if err != nil {
+		// the error has the url, with the token in it
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("telegram %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("telegram %s: got invalid response (%d): %w", method, resp.StatusCode, err)
+	}
+	if !response.OK {
+		return fmt.Errorf("telegram %s: %s", method, response.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+type telegramMessage struct {
+	Text string `json:"text"`
+	Chat struct {
+		ID        int64  `json:"id"`
+		Type      string `json:"type"`
+		Title     string `json:"title"`
+		FirstName string `json:"first_name"`
+		Username  string `json:"username"`
+	} `json:"chat"`
+}
+
+func poll(ctx context.Context) {
+	defer telegramStopped.Done()
+
+	offset := int64(0)
+	for ctx.Err() == nil {
+		if !cluster.Leading() {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second * 10):
+			}
+			continue
+		}
+
+		var updates []struct {
+			UpdateID int64            `json:"update_id"`
+			Message  *telegramMessage `json:"message"`
+		}
+		if err := telegramCall(ctx, "getUpdates", struct {
+			Offset         int64    `json:"offset"`
+			Timeout        int      `json:"timeout"`
+			AllowedUpdates []string `json:"allowed_updates"`
+		}{offset, int(TelegramPollTimeout.Seconds()), []string{"message"}}, &updates); err != nil {
+			if ctx.Err() == nil {
+				log.Warn().Err(err).Msg("failed to get telegram messages")
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second * 15):
+				}
+			}
+			continue
+		}
+
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message != nil && strings.HasPrefix(update.Message.Text, "/") {
+				handleCommand(ctx, *update.Message)
+			}
+		}
+	}
+}
+
+const telegramHelp = `/balance – the balance of the wallet
+/invoice <sat> [description] – a new invoice
+/payments – the last payments
+/unlink – stop getting notifications here`
+
+func handleCommand(ctx context.Context, msg telegramMessage) {
+	args := strings.Fields(msg.Text)
+	// in groups commands may be /balance@thebot
+	command := strings.SplitN(args[0], "@", 2)[0]
+	args = args[1:]
+	logger := log.With().Int64("chat", msg.Chat.ID).Str("command", command).Logger()
+
+	reply := func(text string) {
+		if err := telegramCall(ctx, "sendMessage", telegramJob{msg.Chat.ID, text}, nil); err != nil {
+			logger.Warn().Err(err).Msg("failed to reply on telegram")
+		}
+	}
+
+	if command == "/start" || command == "/link" {
+		if len(args) == 0 {
+			reply("Send the linking code of a wallet to get its notifications here:\n/link <code>")
+			return
+		}
+		wallet, err := linkChat(msg, args[0])
+		if err != nil {
+			logger.Debug().Err(err).Msg("failed to link telegram chat")
+			reply("This code is invalid or has expired, make a new one on the wallet.")
+			return
+		}
+		logger.Info().Str("wallet", wallet.ID).Msg("linked telegram chat")
+		reply("This chat is now linked to " + wallet.Name + ".\n\n" + telegramHelp)
+		return
+	}
+
+	var chat models.TelegramChat
+	err := storage.DB.
+		Joins("JOIN wallets ON wallets.id = telegram_chats.wallet_id AND wallets.deleted_at IS NULL").
+		Where("telegram_chats.chat_id = ?", msg.Chat.ID).
+		First(&chat).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		reply("This chat isn't linked to any wallet, send /link with the code of one.")
+		return
+	} else if err != nil {
+		logger.Warn().Err(err).Msg("failed to load telegram chat")
+		reply("Something went wrong, try again later.")
+		return
+	}
+	wallet, err := storage.Default.GetWallet(chat.WalletID)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to load wallet of telegram chat")
+		reply("Something went wrong, try again later.")
+		return
+	}
+	logger = logger.With().Str("wallet", wallet.ID).Logger()
+
+	switch command {
+	case "/balance":
+		balance, err := services.LoadWalletBalance(wallet.ID)
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to load balance")
+			reply("Failed to load the balance, try again later.")
+			return
+		}
+		reply(fmt.Sprintf("%s has %s sat.", wallet.Name, sat(balance)))
+	case "/invoice":
+		var amount int64
+		if len(args) > 0 {
+			amount, _ = strconv.ParseInt(args[0], 10, 64)
+		}
+		if amount <= 0 {
+			reply("Send the amount in sat, and optionally a description:\n/invoice 1000 coffee")
+			return
+		}
+		payment, err := services.CreateInvoice(ctx, wallet.ID, services.CreateInvoiceParams{
+			InvoiceParams: rp.InvoiceParams{
+				Msatoshi:    amount * 1000,
+				Description: strings.Join(args[1:], " "),
+			},
+			Tag:   "telegram",
+			Extra: models.JSONObject{"telegram": msg.Chat.ID},
+		})
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to create invoice")
+			reply("Failed to create the invoice: " + err.Error())
+			return
+		}
+		reply(payment.Bolt11)
+	case "/payments":
+		payments, _, err := services.ListWalletPayments(wallet.ID, 10, "", "")
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to load payments")
+			reply("Failed to load the payments, try again later.")
+			return
+		}
+		if len(payments) == 0 {
+			reply(wallet.Name + " has no payments yet.")
+			return
+		}
+		var text strings.Builder
+		for _, payment := range payments {
+			status := ""
+			if payment.Pending {
+				status = " (pending)"
+			}
+			sign := "+"
+			if payment.Amount < 0 {
+				sign = "-"
+			}
+			fmt.Fprintf(&text, "%s %s%s sat%s", payment.CreatedAt.Format("2006-01-02 15:04"),
+				sign, sat(payment.Amount), status)
+			if payment.Description != "" {
+				text.WriteString(" – " + payment.Description)
+			}
+			text.WriteString("\n")
+		}
+		reply(text.String())
+	case "/unlink":
+		if err := UnlinkTelegramChat(wallet.ID, msg.Chat.ID); err != nil {
+			logger.Warn().Err(err).Msg("failed to unlink telegram chat")
+			reply("Something went wrong, try again later.")
+			return
+		}
+		reply("This chat isn't linked to " + wallet.Name + " anymore.")
+	default:
+		reply(telegramHelp)
+	}
+}
+
+// TelegramLinkCode is what the chat sends to the bot to be linked to the
+// wallet until it expires: the wallet id, when it expires and a mac of both.
+func TelegramLinkCode(walletID string) (code string, expires time.Time) {
+	expires = time.Now().Add(TelegramLinkExpiry)
+	code = walletID + "-" + strconv.FormatInt(expires.Unix(), 36)
+	return code + "-" + telegramLinkMAC(code), expires
+}
+
+func telegramLinkMAC(code string) string {
+	h := hmac.New(sha256.New, []byte(services.Secret+":telegram-link"))
+	h.Write([]byte(code))
+	return hex.EncodeToString(h.Sum(nil))[:20]
+}
+
+func linkChat(msg telegramMessage, code string) (*models.Wallet, error) {
+	i := strings.LastIndex(code, "-")
+	if i == -1 || !hmac.Equal([]byte(code[i+1:]), []byte(telegramLinkMAC(code[:i]))) {
+		return nil, errors.New("invalid code")
+	}
+	j := strings.LastIndex(code[:i], "-")
+	if j == -1 {
+		return nil, errors.New("invalid code")
+	}
+	expires, err := strconv.ParseInt(code[j+1:i], 36, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, errors.New("expired code")
+	}
+
+	wallet, err := storage.Default.GetWallet(code[:j])
+	if err != nil {
+		return nil, err
+	}
+
+	name := msg.Chat.Title
+	if name == "" {
+		name = msg.Chat.FirstName
+		if msg.Chat.Username != "" {
+			name = "@" + msg.Chat.Username
+		}
+	}
+	// a chat is linked to a single wallet, the last one
+	if err := storage.DB.Save(&models.TelegramChat{
+		ChatID:    msg.Chat.ID,
+		CreatedAt: time.Now(),
+		WalletID:  wallet.ID,
+		Name:      name,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return wallet, nil
+}
+
+func ListTelegramChats(walletID string) ([]models.TelegramChat, error) {
+	chats := make([]models.TelegramChat, 0)
+	err := storage.DB.Where("wallet_id = ?", walletID).Order("created_at").Find(&chats).Error
+	return chats, err
+}
+
+func UnlinkTelegramChat(walletID string, chatID int64) error {
+	result := storage.DB.Where("wallet_id = ? AND chat_id = ?", walletID, chatID).
+		Delete(&models.TelegramChat{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+// enqueueTelegram renders the "<kind>.telegram" template for each chat of the
+// wallet.
+func enqueueTelegram(walletID, kind string, data interface{}) error {
+	chats, err := ListTelegramChats(walletID)
+	if err != nil || len(chats) == 0 {
+		return err
+	}
+
+	var text bytes.Buffer
+	if err := templates.ExecuteTemplate(&text, kind+".telegram", data); err != nil {
+		return err
+	}
+	for _, chat := range chats {
+		if err := jobs.Enqueue("telegram", telegramJob{
+			ChatID: chat.ChatID,
+			Text:   strings.TrimSpace(text.String()),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendTelegram(ctx context.Context, payload json.RawMessage) error {
+	if !TelegramEnabled() {
+		return ErrTelegramDisabled
+	}
+	var job telegramJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	return telegramCall(ctx, "sendMessage", job, nil)
+}
@@ -0,0 +1,328 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lnbits/infinity/jobs"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lucsky/cuid"
+	"golang.org/x/crypto/hkdf"
+	"gorm.io/gorm"
+)
+
+// web push (rfc 8030) to the browsers that subscribed on a wallet, so they are
+// told about its payments even with the client closed. the messages are
+// encrypted to each subscription (rfc 8291) and signed with a vapid key (rfc
+// 8292) derived from the instance secret, so subscriptions survive restarts.
+// a subscription the push service says is gone is deleted.
+
+var (
+	// WebPushSubject is the contact given to push services, a mailto: or https:
+	// url. push is disabled without it.
+	WebPushSubject string
+
+	WebPushTTL = time.Hour * 24
+)
+
+var ErrWebPushDisabled = errors.New("web push needs WEB_PUSH_SUBJECT or SERVICE_URL")
+
+var webPushClient = &http.Client{Timeout: time.Second * 30}
+
+func init() {
+	jobs.Register("webpush", sendPush)
+}
+
+func WebPushEnabled() bool {
+	return WebPushSubject != ""
+}
+
+func vapidKey() *ecdsa.PrivateKey {
+	curve := elliptic.P256()
+	seed := sha256.Sum256([]byte(services.Secret + ":vapid"))
+	d := new(big.Int).SetBytes(seed[:])
+	d.Mod(d, new(big.Int).Sub(curve.Params().N, big.NewInt(1)))
+	d.Add(d, big.NewInt(1))
+
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(d.Bytes())
+	return key
+}
+
+// VAPIDPublicKey is the applicationServerKey browsers subscribe with.
+func VAPIDPublicKey() string {
+	key := vapidKey()
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y))
+}
+
+// decodeBase64 takes the keys of a subscription, which browsers give in
+// base64url, padded or not.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if b, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// Subscribe saves a subscription for the wallet, or changes the kinds of the
+// one the browser already has.
+func Subscribe(walletID string, subscription models.PushSubscription) (models.PushSubscription, error) {
+	if !WebPushEnabled() {
+		return subscription, ErrWebPushDisabled
+	}
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return subscription, errors.New("endpoint must be an https url")
+	}
+	if key, err := decodeBase64(subscription.P256DH); err != nil || len(key) != 65 {
+		return subscription, errors.New("invalid p256dh key")
+	} else if x, _ := elliptic.Unmarshal(elliptic.P256(), key); x == nil {
+		return subscription, errors.New("invalid p256dh key")
+	}
+	if auth, err := decodeBase64(subscription.Auth); err != nil || len(auth) != 16 {
+		return subscription, errors.New("invalid auth secret")
+	}
+	if subscription.ReceivedMin < 0 || subscription.LowBalance < 0 {
+		return subscription, errors.New("amounts can't be negative")
+	}
+	if len(subscription.UserAgent) > 256 {
+		subscription.UserAgent = subscription.UserAgent[:256]
+	}
+
+	var existing models.PushSubscription
+	err = storage.DB.Where("wallet_id = ? AND endpoint = ?", walletID, subscription.Endpoint).
+		First(&existing).Error
+	switch {
+	case err == nil:
+		subscription.ID = existing.ID
+		subscription.CreatedAt = existing.CreatedAt
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		subscription.ID = cuid.New()
+		subscription.CreatedAt = time.Now()
+	default:
+		return subscription, err
+	}
+	subscription.WalletID = walletID
+	return subscription, storage.DB.Save(&subscription).Error
+}
+
+func ListPushSubscriptions(walletID string) ([]models.PushSubscription, error) {
+	subscriptions := make([]models.PushSubscription, 0)
+	err := storage.DB.Where("wallet_id = ?", walletID).Order("created_at").Find(&subscriptions).Error
+	return subscriptions, err
+}
+
+// Unsubscribe deletes a subscription by its id or its endpoint.
+func Unsubscribe(walletID, idOrEndpoint string) error {
+	result := storage.DB.Where("wallet_id = ? AND (id = ? OR endpoint = ?)",
+		walletID, idOrEndpoint, idOrEndpoint).Delete(&models.PushSubscription{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+type pushJob struct {
+	Subscription string          `json:"subscription"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+// enqueuePush renders the "<kind>.subject" template as the title and
+// "<kind>.push" as the body. the service worker of the client shows them.
+func enqueuePush(subscriptionID, kind string, n Notification) error {
+	var title, body bytes.Buffer
+	if err := templates.ExecuteTemplate(&title, kind+".subject", n); err != nil {
+		return err
+	}
+	if err := templates.ExecuteTemplate(&body, kind+".push", n); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(struct {
+		Title  string `json:"title"`
+		Body   string `json:"body"`
+		Kind   string `json:"kind"`
+		Wallet string `json:"wallet"`
+		Hash   string `json:"hash"`
+	}{
+		strings.TrimSpace(title.String()),
+		strings.TrimSpace(body.String()),
+		kind,
+		n.Wallet.ID,
+		n.Payment.Hash,
+	})
+	if err != nil {
+		return err
+	}
+	return jobs.Enqueue("webpush", pushJob{subscriptionID, payload})
+}
+
+func sendPush(ctx context.Context, data json.RawMessage) error {
+	if !WebPushEnabled() {
+		return ErrWebPushDisabled
+	}
+	var job pushJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return err
+	}
+
+	var subscription models.PushSubscription
+	if err := storage.DB.Where("id = ?", job.Subscription).First(&subscription).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// unsubscribed since
+			return nil
+		}
+		return err
+	}
+
+	body, err := encryptPush(subscription, job.Payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := vapidAuthorization(subscription.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(WebPushTTL.Seconds())))
+	req.Header.Set("Urgency", "normal")
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := webPushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == 404 || resp.StatusCode == 410:
+		log.Info().Str("wallet", subscription.WalletID).Str("subscription", subscription.ID).
+			Msg("push subscription is gone, deleting")
+		return storage.DB.Delete(&subscription).Error
+	case resp.StatusCode >= 300:
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("push service returned %d: %s", resp.StatusCode, text)
+	}
+	return nil
+}
+
+// vapidAuthorization is a jwt for the origin of the endpoint, signed with the
+// vapid key.
+func vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, _ := json.Marshal(struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}{u.Scheme + "://" + u.Host, time.Now().Add(time.Hour * 12).Unix(), WebPushSubject})
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, vapidKey(), digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return "vapid t=" + unsigned + "." + base64.RawURLEncoding.EncodeToString(signature) +
+		", k=" + VAPIDPublicKey(), nil
+}
+
+// encryptPush makes the aes128gcm body of rfc 8291, a single record.
+func encryptPush(subscription models.PushSubscription, payload []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	uaPublic, err := decodeBase64(subscription.P256DH)
+	if err != nil {
+		return nil, err
+	}
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+	authSecret, err := decodeBase64(subscription.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	// a new key for each message
+	local, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, local.X, local.Y)
+	sharedX, _ := curve.ScalarMult(uaX, uaY, local.D.Bytes())
+	shared := make([]byte, 32)
+	sharedX.FillBytes(shared)
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 marks the last record
+	ciphertext := gcm.Seal(nil, nonce, append(payload, 0x02), nil)
+
+	// the header: salt, record size and the key of this message
+	body := make([]byte, 16+4+1, 16+4+1+len(asPublic)+len(ciphertext))
+	copy(body, salt)
+	binary.BigEndian.PutUint32(body[16:], 4096)
+	body[20] = byte(len(asPublic))
+	body = append(body, asPublic...)
+	return append(body, ciphertext...), nil
+}
@@ -0,0 +1,339 @@
+package nwc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nostr "github.com/fiatjaf/go-nostr"
+	"github.com/lnbits/infinity/cluster"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils/nostr_utils"
+	"github.com/lucsky/cuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// each wallet can be used with Nostr Wallet Connect (nip47): it gets a nostr key
+// of its own, derived from the instance secret, and every connection made for
+// it is a client key that may send it requests through NOSTR_RELAYS. wallets
+// with connections are all kept in a single subscription, redone whenever the
+// connections change on any instance. in a cluster only the leader answers.
+
+const (
+	KindInfo     = 13194
+	KindRequest  = nostr_utils.KindNWCRequest
+	KindResponse = nostr_utils.KindNWCResponse
+)
+
+var (
+	// PaymentTimeout is how long pay_invoice waits for the payment to settle,
+	// since the clients expect the preimage in the response.
+	PaymentTimeout = time.Second * 45
+
+	// requests older than this are not answered, the client gave up on them.
+	RequestMaxAge = time.Minute
+)
+
+// siteTitle is the alias given by get_info, it can change on reload.
+var siteTitle atomic.Value
+
+func SetSiteTitle(title string) {
+	siteTitle.Store(title)
+}
+
+func getSiteTitle() string {
+	title, _ := siteTitle.Load().(string)
+	return title
+}
+
+var Methods = []string{"pay_invoice", "make_invoice", "get_balance", "get_info", "list_transactions"}
+
+var Renewals = map[string]func(time.Time) time.Time{
+	"never":   nil,
+	"daily":   func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+	"weekly":  func(t time.Time) time.Time { return t.AddDate(0, 0, 7) },
+	"monthly": func(t time.Time) time.Time { return t.AddDate(0, 1, 0) },
+	"yearly":  func(t time.Time) time.Time { return t.AddDate(1, 0, 0) },
+}
+
+var (
+	ErrDisabled       = errors.New("nostr wallet connect needs NOSTR_RELAYS")
+	ErrQuotaExceeded  = errors.New("the budget of this connection is spent")
+	ErrInvalidRenewal = errors.New("budget renewal must be never, daily, weekly, monthly or yearly")
+)
+
+var log zerolog.Logger
+
+func SetLogger(logger zerolog.Logger) {
+	log = logger.With().Str("s", "nwc").Logger()
+}
+
+func init() {
+	cluster.Subscribe("nwc", func(data json.RawMessage) {
+		go Sync()
+	})
+}
+
+// Enabled tells if there are relays to talk to clients through.
+func Enabled() bool {
+	return len(nostr_utils.Relays) > 0
+}
+
+func walletKey(walletID string) string {
+	return nostr_utils.DeriveKey("nostrkey:nwc:" + walletID)
+}
+
+func clientSecret(walletID, connectionID string) string {
+	return nostr_utils.DeriveKey("nostrkey:nwc:" + walletID + ":" + connectionID)
+}
+
+// WalletPubKey is the nostr pubkey clients talk to for a wallet.
+func WalletPubKey(walletID string) string {
+	pubkey, _ := nostr.GetPublicKey(walletKey(walletID))
+	return pubkey
+}
+
+// ConnectionURI is the nostr+walletconnect:// uri given to the client, with its
+// secret in it.
+func ConnectionURI(conn models.NWCConnection) string {
+	query := url.Values{}
+	for _, relay := range nostr_utils.Relays {
+		query.Add("relay", relay)
+	}
+	query.Set("secret", clientSecret(conn.WalletID, conn.ID))
+	return "nostr+walletconnect://" + WalletPubKey(conn.WalletID) + "?" + query.Encode()
+}
+
+func CreateConnection(walletID string, conn models.NWCConnection) (models.NWCConnection, error) {
+	if !Enabled() {
+		return conn, ErrDisabled
+	}
+	if conn.BudgetRenewal == "" {
+		conn.BudgetRenewal = "never"
+	}
+	if _, ok := Renewals[conn.BudgetRenewal]; !ok {
+		return conn, ErrInvalidRenewal
+	}
+	if conn.Budget < 0 {
+		return conn, errors.New("budget can't be negative")
+	}
+
+	conn.ID = cuid.New()
+	conn.WalletID = walletID
+	conn.Spent = 0
+	conn.RenewedAt = time.Now()
+	conn.LastUsedAt = nil
+	pubkey, err := nostr.GetPublicKey(clientSecret(walletID, conn.ID))
+	if err != nil {
+		return conn, err
+	}
+	conn.PubKey = pubkey
+
+	if err := storage.Default.CreateNWCConnection(&conn); err != nil {
+		return conn, err
+	}
+	cluster.Publish("nwc", nil)
+	return conn, nil
+}
+
+func ListConnections(walletID string) ([]models.NWCConnection, error) {
+	return storage.Default.ListNWCConnections(walletID)
+}
+
+func GetConnection(walletID, id string) (models.NWCConnection, error) {
+	conn, err := storage.Default.GetNWCConnection(walletID, id)
+	if err != nil {
+		return models.NWCConnection{}, err
+	}
+	return *conn, nil
+}
+
+func DeleteConnection(walletID, id string) error {
+	if err := storage.Default.DeleteNWCConnection(walletID, id); err != nil {
+		return err
+	}
+	cluster.Publish("nwc", nil)
+	return nil
+}
+
+var (
+	syncMutex sync.Mutex
+	wallets   = make(map[string]string) // wallet pubkey -> wallet id
+	cancel    context.CancelFunc
+)
+
+// the ids of the requests already taken, until they are too old to be
+// answered, since a new subscription gets again the ones it was sent before.
+var (
+	handledMutex sync.Mutex
+	handled      = make(map[string]time.Time) // request id -> when it expires
+)
+
+// Start subscribes to the requests sent to the wallets that have connections.
+func Start() {
+	if !Enabled() {
+		return
+	}
+	Sync()
+}
+
+// Sync redoes the subscription when the wallets with connections changed, and
+// tells the relays which methods the new ones support.
+func Sync() {
+	if !Enabled() {
+		return
+	}
+
+	var walletIDs []string
+	if err := storage.DB.Model(&models.NWCConnection{}).
+		Joins("JOIN wallets ON wallets.id = nwc_connections.wallet_id AND wallets.deleted_at IS NULL").
+		Distinct("nwc_connections.wallet_id").
+		Pluck("nwc_connections.wallet_id", &walletIDs).Error; err != nil {
+		log.Error().Err(err).Msg("failed to load wallets with connections")
+		return
+	}
+
+	wanted := make(map[string]string, len(walletIDs))
+	pubkeys := make([]string, 0, len(walletIDs))
+	for _, walletID := range walletIDs {
+		pubkey := WalletPubKey(walletID)
+		wanted[pubkey] = walletID
+		pubkeys = append(pubkeys, pubkey)
+	}
+	sort.Strings(pubkeys)
+
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	if len(wanted) == len(wallets) {
+		same := true
+		for pubkey := range wanted {
+			if _, ok := wallets[pubkey]; !ok {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+
+	for pubkey, walletID := range wanted {
+		if _, ok := wallets[pubkey]; !ok {
+			go publishInfo(walletID)
+		}
+	}
+	wallets = wanted
+
+	if cancel != nil {
+		cancel()
+		cancel = nil
+	}
+	if len(pubkeys) == 0 {
+		return
+	}
+
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	nostr_utils.Subscribe(ctx, nil, map[string]interface{}{
+		"kinds": []int{KindRequest},
+		"#p":    pubkeys,
+		"since": time.Now().Add(-RequestMaxAge).Unix(),
+	}, func(evt nostr.Event) {
+		if firstTime(evt) {
+			go handleRequest(evt)
+		}
+	})
+	log.Debug().Int("wallets", len(pubkeys)).Msg("subscribed to nwc requests")
+}
+
+// firstTime tells if a request wasn't seen by any of the subscriptions before.
+func firstTime(evt nostr.Event) bool {
+	handledMutex.Lock()
+	defer handledMutex.Unlock()
+
+	now := time.Now()
+	for id, expires := range handled {
+		if now.After(expires) {
+			delete(handled, id)
+		}
+	}
+
+	if _, ok := handled[evt.ID]; ok {
+		return false
+	}
+	handled[evt.ID] = evt.CreatedAt.Add(RequestMaxAge)
+	return true
+}
+
+func walletFor(evt nostr.Event) (walletID string, ok bool) {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "p" {
+			if walletID, ok := wallets[tag[1]]; ok {
+				return walletID, true
+			}
+		}
+	}
+	return "", false
+}
+
+func publishInfo(walletID string) {
+	evt := nostr.Event{
+		PubKey:    WalletPubKey(walletID),
+		CreatedAt: time.Now(),
+		Kind:      KindInfo,
+		Tags:      nostr.Tags{},
+		Content:   strings.Join(Methods, " "),
+	}
+	if err := evt.Sign(walletKey(walletID)); err != nil {
+		log.Warn().Err(err).Str("wallet", walletID).Msg("failed to sign nwc info event")
+		return
+	}
+	nostr_utils.Broadcast(evt, nil)
+}
+
+// reserve counts amount against the budget of the connection, starting the
+// budget again first when its renewal period is over.
+func reserve(conn models.NWCConnection, amount int64) error {
+	if next := Renewals[conn.BudgetRenewal]; next != nil && time.Now().After(next(conn.RenewedAt)) {
+		// the renewed_at condition makes only one of the concurrent requests renew it
+		if err := storage.DB.Model(&models.NWCConnection{}).
+			Where("id = ? AND renewed_at = ?", conn.ID, conn.RenewedAt).
+			Updates(map[string]interface{}{"spent": 0, "renewed_at": time.Now()}).Error; err != nil {
+			return err
+		}
+	}
+
+	result := storage.DB.Model(&models.NWCConnection{}).
+		Where("id = ? AND (budget = 0 OR spent + ? <= budget)", conn.ID, amount).
+		Update("spent", gorm.Expr("spent + ?", amount))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// release gives back what was reserved and not spent.
+func release(conn models.NWCConnection, amount int64) {
+	if amount <= 0 {
+		return
+	}
+	if err := storage.DB.Model(&models.NWCConnection{}).Where("id = ?", conn.ID).
+		Update("spent", gorm.Expr("CASE WHEN spent > ? THEN spent - ? ELSE 0 END", amount, amount)).
+		Error; err != nil {
+		log.Warn().Err(err).Str("connection", conn.ID).Msg("failed to release nwc budget")
+	}
+}
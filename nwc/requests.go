@@ -0,0 +1,359 @@
+package nwc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	nostr "github.com/fiatjaf/go-nostr"
+	"github.com/lnbits/infinity/cluster"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/utils/nostr_utils"
+	rp "github.com/lnbits/relampago"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+// the error codes of nip47
+const (
+	codeRateLimited         = "RATE_LIMITED"
+	codeNotImplemented      = "NOT_IMPLEMENTED"
+	codeInsufficientBalance = "INSUFFICIENT_BALANCE"
+	codeQuotaExceeded       = "QUOTA_EXCEEDED"
+	codeUnauthorized        = "UNAUTHORIZED"
+	codeInternal            = "INTERNAL"
+	codeOther               = "OTHER"
+	codePaymentFailed       = "PAYMENT_FAILED"
+)
+
+type requestError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type response struct {
+	ResultType string        `json:"result_type"`
+	Error      *requestError `json:"error,omitempty"`
+	Result     interface{}   `json:"result,omitempty"`
+}
+
+func handleRequest(evt nostr.Event) {
+	if !cluster.Leading() || evt.Kind != KindRequest ||
+		time.Since(evt.CreatedAt) > RequestMaxAge {
+		return
+	}
+	walletID, ok := walletFor(evt)
+	if !ok {
+		return
+	}
+	key := walletKey(walletID)
+
+	plaintext, err := nostr_utils.NIP04Decrypt(evt.Content, key, evt.PubKey)
+	if err != nil {
+		return
+	}
+	var req request
+	if err := json.Unmarshal([]byte(plaintext), &req); err != nil {
+		return
+	}
+
+	logger := log.With().Str("wallet", walletID).Str("method", req.Method).
+		Str("request", evt.ID).Logger()
+
+	found, err := storage.Default.GetNWCConnectionByPubKey(walletID, evt.PubKey)
+	if err != nil {
+		respond(key, evt, req.Method, nil, &requestError{codeUnauthorized, "no such connection"})
+		return
+	}
+	conn := *found
+	if conn.ExpiresAt != nil && time.Now().After(*conn.ExpiresAt) {
+		respond(key, evt, req.Method, nil, &requestError{codeUnauthorized, "this connection has expired"})
+		return
+	}
+
+	storage.Default.SetNWCConnectionUsed(conn.ID, time.Now())
+
+	var result interface{}
+	var rerr *requestError
+	switch req.Method {
+	case "pay_invoice":
+		result, rerr = payInvoice(conn, req.Params)
+	case "make_invoice":
+		result, rerr = makeInvoice(conn, req.Params)
+	case "get_balance":
+		result, rerr = getBalance(conn)
+	case "get_info":
+		result, rerr = getInfo(conn)
+	case "list_transactions":
+		result, rerr = listTransactions(conn, req.Params)
+	default:
+		rerr = &requestError{codeNotImplemented, fmt.Sprintf("unknown method '%s'", req.Method)}
+	}
+	if rerr != nil {
+		logger.Debug().Str("code", rerr.Code).Str("error", rerr.Message).Msg("nwc request failed")
+	} else {
+		logger.Debug().Msg("nwc request")
+	}
+
+	respond(key, evt, req.Method, result, rerr)
+}
+
+func respond(key string, req nostr.Event, method string, result interface{}, rerr *requestError) {
+	payload, _ := json.Marshal(response{method, rerr, result})
+	content, err := nostr_utils.NIP04Encrypt(string(payload), key, req.PubKey)
+	if err != nil {
+		log.Warn().Err(err).Str("request", req.ID).Msg("failed to encrypt nwc response")
+		return
+	}
+
+	pubkey, _ := nostr.GetPublicKey(key)
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: time.Now(),
+		Kind:      KindResponse,
+		Tags: nostr.Tags{
+			nostr.StringList{"p", req.PubKey},
+			nostr.StringList{"e", req.ID},
+		},
+		Content: content,
+	}
+	if err := evt.Sign(key); err != nil {
+		log.Warn().Err(err).Str("request", req.ID).Msg("failed to sign nwc response")
+		return
+	}
+	if accepted := nostr_utils.Broadcast(evt, nil); len(accepted) == 0 {
+		log.Warn().Str("request", req.ID).Msg("no relay took the nwc response")
+	}
+}
+
+func payInvoice(conn models.NWCConnection, data json.RawMessage) (interface{}, *requestError) {
+	var params struct {
+		Invoice string `json:"invoice"`
+		Amount  int64  `json:"amount"` // msat, for invoices without one
+	}
+	if err := json.Unmarshal(data, &params); err != nil || params.Invoice == "" {
+		return nil, &requestError{codeOther, "missing invoice"}
+	}
+	inv, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return nil, &requestError{codeOther, "invalid invoice"}
+	}
+
+	amount := inv.MSatoshi
+	if amount == 0 {
+		amount = params.Amount
+	}
+	if amount <= 0 {
+		return nil, &requestError{codeOther, "missing amount"}
+	}
+
+	// the fee reserve of services.PayInvoice counts too, what isn't used is given back
+	reserved := amount + amount/100
+	if err := reserve(conn, reserved); err != nil {
+		if errors.Is(err, ErrQuotaExceeded) {
+			return nil, &requestError{codeQuotaExceeded, err.Error()}
+		}
+		return nil, &requestError{codeInternal, "failed to check budget"}
+	}
+
+	payment := services.PayInvoiceParams{
+		PaymentParams: rp.PaymentParams{Invoice: params.Invoice},
+		Tag:           "nwc",
+		Extra:         models.JSONObject{"nwc": conn.ID},
+	}
+	if inv.MSatoshi == 0 {
+		payment.CustomAmount = amount
+	}
+	if _, err := services.PayInvoice(context.Background(), conn.WalletID, payment); err != nil {
+		release(conn, reserved)
+		switch {
+		case errors.Is(err, services.ErrMaintenance):
+			return nil, &requestError{codeRateLimited, err.Error()}
+		case strings.Contains(err.Error(), "insufficient balance"):
+			return nil, &requestError{codeInsufficientBalance, "not enough balance"}
+		default:
+			return nil, &requestError{codePaymentFailed, err.Error()}
+		}
+	}
+
+	paid, err := services.WaitForPayment(conn.WalletID, inv.PaymentHash, PaymentTimeout)
+	if err != nil {
+		release(conn, reserved)
+		return nil, &requestError{codePaymentFailed, "payment failed"}
+	}
+	if paid.Pending {
+		// the budget stays reserved, we don't know how it will end
+		return nil, &requestError{codeOther, "payment is still pending"}
+	}
+	release(conn, reserved-(amount+paid.Fee))
+
+	return struct {
+		Preimage string `json:"preimage"`
+		FeesPaid int64  `json:"fees_paid"`
+	}{string(paid.Preimage), paid.Fee}, nil
+}
+
+func makeInvoice(conn models.NWCConnection, data json.RawMessage) (interface{}, *requestError) {
+	var params struct {
+		Amount          int64  `json:"amount"` // msat
+		Description     string `json:"description"`
+		DescriptionHash string `json:"description_hash"`
+	}
+	if err := json.Unmarshal(data, &params); err != nil || params.Amount < 0 {
+		return nil, &requestError{codeOther, "invalid params"}
+	}
+
+	invoice := services.CreateInvoiceParams{
+		InvoiceParams: rp.InvoiceParams{
+			Msatoshi:    params.Amount,
+			Description: params.Description,
+		},
+		Tag:   "nwc",
+		Extra: models.JSONObject{"nwc": conn.ID},
+	}
+	if params.DescriptionHash != "" {
+		hash, err := hex.DecodeString(params.DescriptionHash)
+		if err != nil || len(hash) != 32 {
+			return nil, &requestError{codeOther, "invalid description_hash"}
+		}
+		invoice.DescriptionHash = hash
+	}
+
+	payment, err := services.CreateInvoice(context.Background(), conn.WalletID, invoice)
+	if err != nil {
+		return nil, &requestError{codeInternal, "failed to create invoice: " + err.Error()}
+	}
+	return toTransaction(payment), nil
+}
+
+func getBalance(conn models.NWCConnection) (interface{}, *requestError) {
+	balance, err := services.LoadWalletBalance(conn.WalletID)
+	if err != nil {
+		return nil, &requestError{codeInternal, "failed to load balance"}
+	}
+	return struct {
+		Balance int64 `json:"balance"` // msat
+	}{balance}, nil
+}
+
+func getInfo(conn models.NWCConnection) (interface{}, *requestError) {
+	return struct {
+		Alias       string   `json:"alias"`
+		Color       string   `json:"color"`
+		Pubkey      string   `json:"pubkey"`
+		Network     string   `json:"network"`
+		BlockHeight int      `json:"block_height"`
+		BlockHash   string   `json:"block_hash"`
+		Methods     []string `json:"methods"`
+	}{
+		Alias:   getSiteTitle(),
+		Pubkey:  WalletPubKey(conn.WalletID),
+		Network: "mainnet",
+		Methods: Methods,
+	}, nil
+}
+
+func listTransactions(conn models.NWCConnection, data json.RawMessage) (interface{}, *requestError) {
+	var params struct {
+		From   int64  `json:"from"`
+		Until  int64  `json:"until"`
+		Limit  int    `json:"limit"`
+		Offset int    `json:"offset"`
+		Unpaid bool   `json:"unpaid"`
+		Type   string `json:"type"` // incoming or outgoing
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &params); err != nil {
+			return nil, &requestError{codeOther, "invalid params"}
+		}
+	}
+	if params.Limit <= 0 || params.Limit > 1000 {
+		params.Limit = 100
+	}
+	if params.Offset < 0 {
+		params.Offset = 0
+	}
+
+	query := storage.PaymentsQuery{
+		Limit:     params.Limit,
+		Offset:    params.Offset,
+		Direction: params.Type,
+	}
+	if params.From > 0 {
+		query.Since = time.Unix(params.From, 0)
+	}
+	if params.Until > 0 {
+		// until is inclusive and in seconds
+		query.Until = time.Unix(params.Until+1, 0)
+	}
+	if !params.Unpaid {
+		settled := false
+		query.Pending = &settled
+	}
+	if params.Type != "" && params.Type != "incoming" && params.Type != "outgoing" {
+		return nil, &requestError{codeOther, "type must be incoming or outgoing"}
+	}
+
+	payments, _, err := storage.Default.ListPayments(conn.WalletID, query)
+	if err != nil {
+		return nil, &requestError{codeInternal, "failed to load transactions"}
+	}
+
+	txs := make([]transaction, len(payments))
+	for i, payment := range payments {
+		txs[i] = toTransaction(payment)
+	}
+	return struct {
+		Transactions []transaction `json:"transactions"`
+	}{txs}, nil
+}
+
+type transaction struct {
+	Type            string                 `json:"type"`
+	Invoice         string                 `json:"invoice"`
+	Description     string                 `json:"description"`
+	DescriptionHash string                 `json:"description_hash"`
+	Preimage        string                 `json:"preimage"`
+	PaymentHash     string                 `json:"payment_hash"`
+	Amount          int64                  `json:"amount"`
+	FeesPaid        int64                  `json:"fees_paid"`
+	CreatedAt       int64                  `json:"created_at"`
+	ExpiresAt       int64                  `json:"expires_at,omitempty"`
+	SettledAt       int64                  `json:"settled_at,omitempty"`
+	Metadata        map[string]interface{} `json:"metadata"`
+}
+
+func toTransaction(payment models.Payment) transaction {
+	tx := transaction{
+		Type:        "incoming",
+		Invoice:     payment.Bolt11,
+		Description: payment.Description,
+		PaymentHash: payment.Hash,
+		Amount:      payment.Amount,
+		CreatedAt:   payment.CreatedAt.Unix(),
+		Metadata:    map[string]interface{}{},
+	}
+	if payment.Amount < 0 {
+		tx.Type = "outgoing"
+		tx.Amount = -payment.Amount
+		tx.FeesPaid = payment.Fee
+	} else {
+		tx.ExpiresAt = payment.CreatedAt.Add(services.DefaultInvoiceExpiry).Unix()
+	}
+	if !payment.Pending {
+		// the preimage of an unpaid invoice is of no use to anyone but us
+		tx.Preimage = string(payment.Preimage)
+		tx.SettledAt = payment.UpdatedAt.Unix()
+	}
+	return tx
+}
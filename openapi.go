@@ -0,0 +1,782 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/apps"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"gorm.io/gorm"
+)
+
+// the OpenAPI document of everything under /api/, /ext/, /lndhub/, /alby/ and
+// /lnurl, served at /api/openapi.json and browsable with Swagger UI at
+// /api/docs. every route on the router is in it, with its methods, path
+// params and security worked out from the route itself, so nothing can be
+// missing; apiDocs says what they do and what they take and return, as the Go
+// values the handlers read and write, made into JSON schemas by reflection.
+
+type apiDoc struct {
+	Summary  string
+	Methods  []string // POST for audited routes and GET for the others if empty
+	Admin    bool     // needs the admin key of the wallet, not the invoice key
+	Query    []string // "name" for strings, "name:integer" or "name:boolean"
+	Request  interface{}
+	Response interface{}
+	Content  string // when the response isn't JSON
+}
+
+var apiDocs = map[string]apiDoc{
+	"/api/version":      {Summary: "version of the running server and whether there is a newer one"},
+	"/api/openapi.json": {Summary: "this document"},
+
+	// graphql
+	"/api/graphql": {
+		Summary: "run a GraphQL query on the wallets, payments and app items",
+		Methods: []string{"GET", "POST"},
+		Query:   []string{"query", "operationName", "variables"},
+		Request: struct {
+			Query         string                 `json:"query"`
+			OperationName string                 `json:"operationName"`
+			Variables     map[string]interface{} `json:"variables"`
+		}{},
+		Response: struct {
+			Data   json.RawMessage          `json:"data"`
+			Errors []map[string]interface{} `json:"errors,omitempty"`
+		}{},
+	},
+	"/api/graphql/ws": {Summary: "GraphQL queries and payment subscriptions over graphql-transport-ws"},
+
+	// user
+	"/api/user": {Summary: "the user with its wallets and apps", Response: models.User{}},
+	"/api/user/apps": {
+		Summary:  "apps installed by the user",
+		Response: []apps.InstalledApp{},
+	},
+	"/api/user/create-wallet": {
+		Summary: "create a wallet, and a user too when there is no X-MasterKey",
+		Request: struct {
+			Name string `json:"name"`
+		}{},
+		Response: models.User{},
+	},
+	"/api/user/delete":      {Summary: "delete the user and all its wallets"},
+	"/api/user/preferences": {Summary: "display preferences of the user", Response: models.UserPreferences{}},
+	"/api/user/set-preferences": {
+		Summary: "change some of the display preferences",
+		Request: struct {
+			Denomination *string `json:"denomination"`
+			Currency     *string `json:"currency"`
+			Locale       *string `json:"locale"`
+			Theme        *string `json:"theme"`
+		}{},
+		Response: models.UserPreferences{},
+	},
+	"/api/user/notifications": {
+		Summary: "what the user gets notifications about and where",
+		Response: struct {
+			models.UserNotifications
+			EmailEnabled bool   `json:"email_enabled"`
+			NostrEnabled bool   `json:"nostr_enabled"`
+			NostrSender  string `json:"nostr_sender"`
+		}{},
+	},
+	"/api/user/set-notifications": {
+		Summary: "change some of the notification settings, a new email gets a link to verify it",
+		Request: struct {
+			Email       *string `json:"email"`
+			Nostr       *string `json:"nostr"`
+			Received    *bool   `json:"received"`
+			ReceivedMin *int64  `json:"received_min"`
+			Sent        *bool   `json:"sent"`
+			Failed      *bool   `json:"failed"`
+			LowBalance  *int64  `json:"low_balance"`
+		}{},
+		Response: models.UserNotifications{},
+	},
+	"/api/user/add-app": {
+		Summary: "install an app by its url",
+		Request: struct {
+			URL string `json:"url"`
+		}{},
+	},
+	"/api/user/remove-app": {
+		Summary: "uninstall an app",
+		Request: struct {
+			URL string `json:"url"`
+		}{},
+	},
+	"/api/user/publish-app": {
+		Summary: "publish an app to nostr",
+		Request: struct {
+			URL        string      `json:"url"`
+			Identifier string      `json:"d"`
+			Event      interface{} `json:"event"`
+		}{},
+	},
+
+	// wallet
+	"/api/wallet":                   {Summary: "the wallet of the key", Response: models.Wallet{}},
+	"/api/wallet/delete":            {Summary: "delete the wallet", Admin: true},
+	"/api/wallet/rename/{new-name}": {Summary: "rename the wallet", Admin: true},
+	"/api/wallet/create-invoice": {
+		Summary: "create an invoice, in msatoshi or in an amount of a unit (sat, btc or a fiat currency)",
+		Request: struct {
+			services.CreateInvoiceParams
+			Unit               string  `json:"unit"`
+			Amount             float64 `json:"amount"`
+			LnurlCallback      string  `json:"lnurlCallback"`
+			LnurlBalanceCheck  string  `json:"lnurlBalanceCheck"`
+			DescriptionHashHex string  `json:"description_hash"`
+			Memo               string  `json:"memo"`
+		}{},
+		Response: models.Payment{},
+	},
+	"/api/wallet/pay-invoice": {
+		Summary:  "pay an invoice",
+		Admin:    true,
+		Request:  services.PayInvoiceParams{},
+		Response: models.Payment{},
+	},
+	"/api/wallet/lnurlauth": {
+		Summary: "log in to a service with lnurl-auth",
+		Admin:   true,
+		Request: struct {
+			Callback string `json:"callback"`
+		}{},
+	},
+	"/api/wallet/pay-lnurl": {
+		Summary: "pay an lnurl-pay with the params from lnurlscan",
+		Admin:   true,
+		Request: struct {
+			Params   map[string]interface{} `json:"params"`
+			Msatoshi int64                  `json:"msatoshi"`
+			Comment  string                 `json:"comment"`
+		}{},
+	},
+	"/api/wallet/payments": {
+		Summary: "payments of the wallet, newest first, a page at a time",
+		Query:   []string{"limit:integer", "cursor", "q"},
+		Response: struct {
+			Payments []models.Payment `json:"payments"`
+			Next     string           `json:"next,omitempty"`
+		}{},
+	},
+	"/api/wallet/balance-history": {
+		Summary: "balance at the end of each of the last days",
+		Query:   []string{"days:integer"},
+		Response: struct {
+			History []models.BalanceSnapshot `json:"history"`
+			Balance int64                    `json:"balance"`
+		}{},
+	},
+	"/api/wallet/usage": {
+		Summary: "payment volume, counts and fees of each of the last months",
+		Query:   []string{"months:integer"},
+	},
+	"/api/wallet/pairing": {
+		Summary: "uri and QR code to pair a mobile wallet",
+		Query:   []string{"type", "scope", "connection", "size:integer", "format"},
+		Response: struct {
+			Type  string `json:"type"`
+			Scope string `json:"scope"`
+			URI   string `json:"uri"`
+			QR    string `json:"qr"`
+		}{},
+	},
+	"/api/wallet/splits": {
+		Summary: "value splits of the wallet and the latest shares they forwarded",
+		Response: struct {
+			Splits   []models.ValueSplit   `json:"splits"`
+			Payments []models.SplitPayment `json:"payments"`
+		}{},
+	},
+	"/api/wallet/splits/set": {
+		Summary: "replace the value splits of the wallet",
+		Admin:   true,
+		Request: struct {
+			Splits []models.ValueSplit `json:"splits"`
+		}{},
+		Response: struct {
+			Splits []models.ValueSplit `json:"splits"`
+		}{},
+	},
+	"/api/wallet/push": {
+		Summary: "web push subscriptions of the wallet and the key to subscribe with",
+		Response: struct {
+			Enabled       bool                      `json:"enabled"`
+			PublicKey     string                    `json:"public_key"`
+			Subscriptions []models.PushSubscription `json:"subscriptions"`
+		}{},
+	},
+	"/api/wallet/push/subscribe": {
+		Summary: "get web push notifications of the wallet in a browser, or change which ones",
+		Request: struct {
+			Subscription struct {
+				Endpoint string `json:"endpoint"`
+				Keys     struct {
+					P256DH string `json:"p256dh"`
+					Auth   string `json:"auth"`
+				} `json:"keys"`
+			} `json:"subscription"`
+			models.NotificationKinds
+		}{},
+		Response: models.PushSubscription{},
+	},
+	"/api/wallet/push/unsubscribe": {
+		Summary: "stop web push notifications to a browser, by subscription id or endpoint",
+		Request: struct {
+			ID       string `json:"id"`
+			Endpoint string `json:"endpoint"`
+		}{},
+	},
+	"/api/wallet/telegram": {
+		Summary: "telegram chats linked to the wallet",
+		Admin:   true,
+		Response: struct {
+			Enabled bool                  `json:"enabled"`
+			Bot     string                `json:"bot"`
+			Chats   []models.TelegramChat `json:"chats"`
+		}{},
+	},
+	"/api/wallet/telegram/link": {
+		Summary: "a code to link a telegram chat to the wallet, sent to the bot with /start",
+		Admin:   true,
+		Response: struct {
+			Code      string    `json:"code"`
+			Link      string    `json:"link"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}{},
+	},
+	"/api/wallet/telegram/unlink/{chat}": {Summary: "stop sending notifications to a telegram chat", Admin: true},
+	"/api/wallet/nwc": {
+		Summary: "Nostr Wallet Connect connections of the wallet",
+		Admin:   true,
+		Response: struct {
+			Enabled      bool                   `json:"enabled"`
+			WalletPubKey string                 `json:"wallet_pubkey"`
+			Connections  []models.NWCConnection `json:"connections"`
+		}{},
+	},
+	"/api/wallet/nwc/create": {
+		Summary: "create a Nostr Wallet Connect connection, its uri is only given here",
+		Admin:   true,
+		Request: struct {
+			Name          string `json:"name"`
+			Budget        int64  `json:"budget"`
+			BudgetRenewal string `json:"budget_renewal"`
+			ExpiresIn     int64  `json:"expires_in"`
+		}{},
+		Response: struct {
+			models.NWCConnection
+			URI string `json:"uri"`
+		}{},
+	},
+	"/api/wallet/nwc/delete/{id}":     {Summary: "delete a Nostr Wallet Connect connection", Admin: true},
+	"/api/wallet/payment/{id}":        {Summary: "a payment by its hash or checking id", Response: models.Payment{}},
+	"/api/wallet/lnurlscan/{code}":    {Summary: "what an lnurl or lightning address is and its params"},
+	"/api/wallet/sse":                 {Summary: "server-sent events of the payments of the wallet", Content: "text/event-stream"},
+	"/lnurl/wallet/drain":             {Summary: "lnurl-withdraw of the whole balance, with the admin key in api-key", Query: []string{"api-key", "pr", "balanceNotify"}, Methods: []string{"GET"}},
+	"/api/wallet/app/sse":             {Summary: "server-sent events of the apps of the wallet", Content: "text/event-stream"},
+	"/api/wallet/app/{appid}":         {Summary: "the settings of an app", Response: apps.Settings{}},
+	"/api/wallet/app/{appid}/refresh": {Summary: "load the app code again", Query: []string{"accept_signer:boolean"}},
+	"/api/wallet/app/{appid}/clear-data": {
+		Summary: "delete all the data of an app",
+	},
+	"/api/wallet/app/{appid}/logs": {Summary: "latest log lines of an app", Response: []apps.AppLogEntry{}},
+	"/api/wallet/app/{appid}/export": {
+		Summary:  "all the data of an app, as one document or as JSON lines",
+		Query:    []string{"model", "format"},
+		Response: apps.AppDataExport{},
+	},
+	"/api/wallet/app/{appid}/import": {
+		Summary: "load data exported before, adding to or replacing what is there",
+		Query:   []string{"format", "replace:boolean"},
+		Request: apps.AppDataExport{},
+	},
+	"/api/wallet/app/{appid}/search": {Summary: "search the items of an app", Query: []string{"q", "model"}, Response: []apps.SearchResult{}},
+	"/api/wallet/app/{appid}/secrets": {
+		Summary:  "names of the secrets of an app",
+		Response: []models.AppSecret{},
+	},
+	"/api/wallet/app/{appid}/secrets/set/{name}": {
+		Summary: "set a secret of an app",
+		Request: struct {
+			Value string `json:"value"`
+		}{},
+	},
+	"/api/wallet/app/{appid}/secrets/del/{name}": {Summary: "delete a secret of an app"},
+	"/api/wallet/app/{appid}/list/{model}":       {Summary: "items of a model of an app", Response: []models.AppDataItem{}},
+	"/api/wallet/app/{appid}/get/{model}/{key}":  {Summary: "an item of a model of an app", Response: map[string]interface{}{}},
+	"/api/wallet/app/{appid}/set/{model}/{key}":  {Summary: "set an item of a model of an app", Request: map[string]interface{}{}},
+	"/api/wallet/app/{appid}/add/{model}": {
+		Summary:  "add an item to a model of an app, its key is returned",
+		Request:  map[string]interface{}{},
+		Response: "",
+	},
+	"/api/wallet/app/{appid}/del/{model}/{key}": {Summary: "delete an item of a model of an app"},
+
+	// apps
+	"/api/apps/builtin": {Summary: "apps that come with the server", Response: []apps.BuiltinApp{}},
+	"/api/apps/nostr":   {Summary: "apps published to nostr", Query: []string{"author", "limit:integer"}, Response: []apps.NostrApp{}},
+	"/ext/{wallet}/{appid}/action/{action}": {
+		Summary:  "run a public action of an app",
+		Methods:  []string{"POST"},
+		Request:  map[string]interface{}{},
+		Response: map[string]interface{}{},
+	},
+	"/ext/{wallet}/{appid}/sse":                   {Summary: "public server-sent events of an app", Content: "text/event-stream"},
+	"/ext/{wallet}/{appid}/ws":                    {Summary: "public websocket of an app"},
+	"/ext/{wallet}/{appid}/lnurl/{name}":          {Summary: "an lnurl endpoint of an app"},
+	"/ext/{wallet}/{appid}/lnurl/{name}/callback": {Summary: "the callback of an lnurl endpoint of an app", Methods: []string{"GET"}},
+	"/ext/{wallet}/{appid}/api/{path}": {
+		Summary: "a custom route of an app",
+		Methods: []string{"GET", "POST", "PUT", "DELETE"},
+	},
+
+	// lndhub
+	"/lndhub/ext/auth": {
+		Summary: "get a token, which is the wallet key itself",
+		Methods: []string{"POST"},
+		Request: struct {
+			Login        string `json:"login"`
+			Password     string `json:"password"`
+			RefreshToken string `json:"refresh_token"`
+		}{},
+	},
+	"/lndhub/ext/getinfo":             {Summary: "node info"},
+	"/lndhub/ext/getbalance":          {Summary: "balance in sat"},
+	"/lndhub/ext/addinvoice":          {Summary: "create an invoice"},
+	"/lndhub/ext/payinvoice":          {Summary: "pay an invoice"},
+	"/lndhub/ext/gettxs":              {Summary: "outgoing payments"},
+	"/lndhub/ext/getpending":          {Summary: "pending outgoing payments"},
+	"/lndhub/ext/getuserinvoices":     {Summary: "incoming invoices"},
+	"/lndhub/ext/checkpayment/{hash}": {Summary: "whether an invoice is paid"},
+	"/lndhub/ext/decodeinvoice":       {Summary: "decode an invoice", Query: []string{"invoice"}},
+	"/lndhub/ext/getbtc":              {Summary: "onchain addresses, always none"},
+
+	// btcpay greenfield
+	"/api/v1/stores/{storeId}/lightning/{cryptoCode}/info":            {Summary: "node info"},
+	"/api/v1/stores/{storeId}/lightning/{cryptoCode}/balance":         {Summary: "balance in msat"},
+	"/api/v1/stores/{storeId}/lightning/{cryptoCode}/invoices":        {Summary: "create an invoice"},
+	"/api/v1/stores/{storeId}/lightning/{cryptoCode}/invoices/pay":    {Summary: "pay an invoice", Admin: true},
+	"/api/v1/stores/{storeId}/lightning/{cryptoCode}/invoices/{id}":   {Summary: "an invoice by its payment hash"},
+	"/api/v1/stores/{storeId}/lightning/{cryptoCode}/payments/{hash}": {Summary: "a payment by its hash"},
+
+	// alby
+	"/alby/balance":           {Summary: "balance in sat"},
+	"/alby/user/value4value":  {Summary: "keysend info, always empty"},
+	"/alby/invoices":          {Summary: "list invoices on GET, create one on POST", Methods: []string{"GET", "POST"}, Query: []string{"items:integer", "page:integer"}},
+	"/alby/invoices/incoming": {Summary: "incoming invoices", Query: []string{"items:integer", "page:integer"}},
+	"/alby/invoices/outgoing": {Summary: "outgoing payments", Query: []string{"items:integer", "page:integer"}},
+	"/alby/invoices/{hash}":   {Summary: "an invoice by its payment hash"},
+	"/alby/payments/bolt11":   {Summary: "pay an invoice", Admin: true},
+	"/alby/payments/keysend":  {Summary: "not supported", Methods: []string{"POST"}},
+
+	// admin
+	"/api/admin/backups":          {Summary: "database backups"},
+	"/api/admin/backups/create":   {Summary: "make a backup now"},
+	"/api/admin/audit":            {Summary: "audit log", Response: []models.AuditEntry{}},
+	"/api/admin/logs":             {Summary: "latest log lines"},
+	"/api/admin/logs/stream":      {Summary: "log lines as they come", Content: "text/event-stream"},
+	"/api/admin/deleted":          {Summary: "deleted users and wallets that can still be restored"},
+	"/api/admin/db":               {Summary: "database connection pool stats"},
+	"/api/admin/restore":          {Summary: "restore a deleted user or wallet"},
+	"/api/admin/ledger":           {Summary: "ledger totals"},
+	"/api/admin/ledger/entries":   {Summary: "ledger entries", Response: []models.LedgerEntry{}},
+	"/api/admin/ledger/check":     {Summary: "check the ledger against the wallet balances"},
+	"/api/admin/reload":           {Summary: "read the settings again"},
+	"/api/admin/runtime":          {Summary: "memory, goroutines and garbage collector stats"},
+	"/api/admin/stats":            {Summary: "instance stats for the last days", Query: []string{"days:integer"}},
+	"/api/admin/usage":            {Summary: "usage of all the wallets"},
+	"/api/admin/maintenance":      {Summary: "maintenance mode, changed on POST", Methods: []string{"GET", "POST"}, Request: services.MaintenanceState{}, Response: services.MaintenanceState{}},
+	"/api/admin/jobs":             {Summary: "background jobs", Response: []models.Job{}},
+	"/api/admin/jobs/{id}/retry":  {Summary: "run a failed job again"},
+	"/api/admin/jobs/{id}/delete": {Summary: "delete a job"},
+	"/api/admin/bans":             {Summary: "banned ips and keys", Response: []models.Ban{}},
+	"/api/admin/bans/create": {
+		Summary: "ban an ip or a key",
+		Request: struct {
+			IP       string `json:"ip"`
+			Key      string `json:"key"`
+			Duration string `json:"duration"`
+			Reason   string `json:"reason"`
+		}{},
+		Response: models.Ban{},
+	},
+	"/api/admin/bans/{id}/delete":           {Summary: "lift a ban"},
+	"/api/admin/branding":                   {Summary: "branding assets and themes"},
+	"/api/admin/branding/{asset}/upload":    {Summary: "upload a branding asset"},
+	"/api/admin/branding/{asset}/delete":    {Summary: "delete a branding asset"},
+	"/api/admin/branding/themes/set/{name}": {Summary: "create or change a theme", Request: models.Theme{}},
+	"/api/admin/branding/themes/del/{name}": {Summary: "delete a theme"},
+}
+
+// the routes that take the wallet key as a bearer token too.
+var bearerPrefixes = []string{"/lndhub/ext/", "/api/v1/stores/", "/alby/"}
+
+var documentedPrefixes = []string{"/api/", "/ext/", "/lndhub/", "/alby/", "/lnurl"}
+
+var (
+	openAPIOnce     sync.Once
+	openAPIDocument []byte
+)
+
+// serveOpenAPI is built on the first request, when all the routes are there.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		doc, err := json.Marshal(buildOpenAPI(router))
+		if err != nil {
+			log.Error().Err(err).Msg("failed to build the openapi document")
+			return
+		}
+		openAPIDocument = doc
+	})
+	if openAPIDocument == nil {
+		apiutils.SendJSONError(w, 500, "failed to build the openapi document")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// the Swagger UI page loads the files in static/swagger-ui, so it needs a
+// policy of its own instead of the API one.
+const docsContentSecurityPolicy = "default-src 'self'; img-src 'self' data:; " +
+	"style-src 'self' 'unsafe-inline'; frame-ancestors 'none'"
+
+func serveAPIDocs(w http.ResponseWriter, r *http.Request) {
+	base := html.EscapeString(apiutils.BasePath)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", docsContentSecurityPolicy)
+	w.Write([]byte(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>` + html.EscapeString(live().SiteTitle) + ` API</title>
+<link rel="stylesheet" href="` + base + `/static/swagger-ui/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="` + base + `/static/swagger-ui/swagger-ui-bundle.js"></script>
+<script src="` + base + `/static/swagger-ui/init.js"></script>
+</body>
+</html>
+`))
+}
+
+var routeParam = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+func buildOpenAPI(router *mux.Router) map[string]interface{} {
+	schemas := newSchemaSet()
+	paths := make(map[string]interface{})
+	seen := make(map[string]bool)
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil || strings.HasSuffix(template, "/") {
+			// no path or a prefix, like the static files
+			return nil
+		}
+		documented := false
+		for _, prefix := range documentedPrefixes {
+			if strings.HasPrefix(template, prefix) {
+				documented = true
+				break
+			}
+		}
+		if !documented || template == "/api/docs" {
+			return nil
+		}
+
+		path := routeParam.ReplaceAllString(template, "{$1}")
+		seen[path] = true
+		doc := apiDocs[path]
+
+		methods := doc.Methods
+		if len(methods) == 0 {
+			methods = []string{"GET"}
+			if auditedRoutes[template] {
+				methods = []string{"POST"}
+			}
+		}
+
+		var params []interface{}
+		for _, match := range routeParam.FindAllStringSubmatch(template, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]string{"type": "string"},
+			})
+		}
+		for _, query := range doc.Query {
+			name, typ := query, "string"
+			if i := strings.Index(query, ":"); i != -1 {
+				name, typ = query[:i], query[i+1:]
+			}
+			params = append(params, map[string]interface{}{
+				"name":   name,
+				"in":     "query",
+				"schema": map[string]string{"type": typ},
+			})
+		}
+
+		item := make(map[string]interface{})
+		for _, method := range methods {
+			op := map[string]interface{}{
+				"tags":      []string{routeTag(path)},
+				"responses": map[string]interface{}{"200": response(doc, schemas)},
+			}
+			if doc.Summary != "" {
+				op["summary"] = doc.Summary
+			}
+			if doc.Admin {
+				op["description"] = "needs the admin key"
+			}
+			if params != nil {
+				op["parameters"] = params
+			}
+			if security := routeSecurity(path); security != nil {
+				op["security"] = security
+			}
+			if doc.Request != nil && method != "GET" {
+				op["requestBody"] = map[string]interface{}{
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": schemas.of(reflect.TypeOf(doc.Request)),
+						},
+					},
+				}
+			}
+			item[strings.ToLower(method)] = op
+		}
+		paths[path] = item
+		return nil
+	})
+
+	for path := range apiDocs {
+		if !seen[path] {
+			log.Warn().Str("path", path).Msg("documented route is not registered")
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   live().SiteTitle + " API",
+			"version": apiVersion(),
+		},
+		"servers": []map[string]string{{"url": apiutils.BasePath + "/"}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.named,
+			"securitySchemes": map[string]interface{}{
+				"walletKey": map[string]string{"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+				"masterKey": map[string]string{"type": "apiKey", "in": "header", "name": "X-MasterKey"},
+				"adminKey":  map[string]string{"type": "apiKey", "in": "header", "name": "X-Admin-Key"},
+				"bearer":    map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func apiVersion() string {
+	if commit == "" {
+		return "dev"
+	}
+	return commit
+}
+
+func response(doc apiDoc, schemas *schemaSet) map[string]interface{} {
+	resp := map[string]interface{}{"description": "OK"}
+	switch {
+	case doc.Content != "":
+		resp["content"] = map[string]interface{}{doc.Content: map[string]interface{}{}}
+	case doc.Response != nil:
+		resp["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": schemas.of(reflect.TypeOf(doc.Response)),
+			},
+		}
+	}
+	return resp
+}
+
+func routeTag(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/wallet/app/"), strings.HasPrefix(path, "/api/apps/"),
+		strings.HasPrefix(path, "/ext/"):
+		return "apps"
+	case strings.HasPrefix(path, "/api/v1/stores/"):
+		return "greenfield"
+	case strings.HasPrefix(path, "/lndhub/"):
+		return "lndhub"
+	case strings.HasPrefix(path, "/alby/"):
+		return "alby"
+	case strings.HasPrefix(path, "/lnurl"):
+		return "lnurl"
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, "/api/"), "/", 2)
+	return parts[0]
+}
+
+// routeSecurity is what walletMiddleware, userMiddleware and adminMiddleware
+// ask of each route.
+func routeSecurity(path string) []map[string][]string {
+	switch {
+	case path == "/lndhub/ext/auth":
+		return nil
+	case strings.HasPrefix(path, "/api/admin/"):
+		return []map[string][]string{{"adminKey": {}}}
+	case strings.HasPrefix(path, "/api/graphql"):
+		return []map[string][]string{{"walletKey": {}}, {"masterKey": {}}}
+	case path == "/api/user/create-wallet":
+		return []map[string][]string{{"masterKey": {}}, {}}
+	case strings.HasPrefix(path, "/api/user"):
+		return []map[string][]string{{"masterKey": {}}}
+	}
+	for _, prefix := range bearerPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return []map[string][]string{{"bearer": {}}, {"walletKey": {}}}
+		}
+	}
+	if strings.HasPrefix(path, "/api/wallet") || strings.HasPrefix(path, "/api/v1/") {
+		return []map[string][]string{{"walletKey": {}}}
+	}
+	return nil
+}
+
+// schemaSet makes JSON schemas of Go types the way encoding/json writes them,
+// with the named structs in components/schemas.
+type schemaSet struct {
+	named map[string]interface{}
+	names map[reflect.Type]string
+}
+
+func newSchemaSet() *schemaSet {
+	return &schemaSet{
+		named: make(map[string]interface{}),
+		names: make(map[reflect.Type]string),
+	}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	marshalerType  = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	deletedAtType  = reflect.TypeOf(gorm.DeletedAt{})
+)
+
+func (set *schemaSet) of(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType, deletedAtType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+	if t.Implements(marshalerType) {
+		// can't know what it writes
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := set.of(t.Elem())
+		if _, isRef := schema["$ref"]; !isRef {
+			schema["nullable"] = true
+		}
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": set.of(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": set.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return set.object(t)
+		}
+		name, ok := set.names[t]
+		if !ok {
+			name = t.Name()
+			if _, taken := set.named[name]; taken {
+				pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+				name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+			}
+			set.names[t] = name
+			set.named[name] = nil // so types that refer to themselves stop here
+			set.named[name] = set.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (set *schemaSet) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	set.fields(t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// fields adds the fields of embedded structs after the others, since the outer
+// ones win in encoding/json.
+func (set *schemaSet) fields(t reflect.Type, properties map[string]interface{}) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || field.Type.Kind() == reflect.Func || field.Type.Kind() == reflect.Chan {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if field.Anonymous && name == "" {
+			typ := field.Type
+			if typ.Kind() == reflect.Ptr {
+				typ = typ.Elem()
+			}
+			if typ.Kind() == reflect.Struct && typ != timeType {
+				embedded = append(embedded, typ)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = set.of(field.Type)
+	}
+
+	for _, typ := range embedded {
+		inner := make(map[string]interface{})
+		set.fields(typ, inner)
+		for name, schema := range inner {
+			if _, ok := properties[name]; !ok {
+				properties[name] = schema
+			}
+		}
+	}
+}
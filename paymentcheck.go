@@ -1,15 +1,27 @@
 package main
 
 import (
+	"context"
+	"time"
+
 	"gorm.io/gorm"
 
 	"github.com/lnbits/infinity/events"
+	"github.com/lnbits/infinity/jobs"
 	"github.com/lnbits/infinity/lightning"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/storage"
 	"github.com/lnbits/relampago"
 )
 
+func init() {
+	// invoices paid or payments finished while we weren't listening to the
+	// backend, or that it didn't tell us about
+	jobs.Recurring("reconcile_payments", func(last time.Time) time.Time {
+		return last.Truncate(time.Hour).Add(time.Hour)
+	}, reconcilePayments)
+}
+
 func initialPaymentCheck() {
 	log.Info().Msg("performing startup check for pending payments and invoice")
 
@@ -22,49 +34,62 @@ func initialPaymentCheck() {
 
 	log.Info().Msgf("will check %d payments", len(payments))
 	for _, payment := range payments {
-		log := log.With().Str("id", payment.CheckingID).Logger()
-		log.Info().Int64("amount", payment.Amount).Msg("checking")
+		checkPendingPayment(payment)
+	}
+}
+
+// reconcilePayments checks the outgoing payments still pending and the
+// invoices of the last day that weren't paid yet, older ones have expired.
+func reconcilePayments(ctx context.Context, at time.Time) error {
+	var payments []models.Payment
+	if err := storage.DB.
+		Where("pending AND created_at < ?", time.Now().Add(-time.Minute*10)).
+		Where("amount < 0 OR created_at > ?", time.Now().AddDate(0, 0, -1)).
+		Find(&payments).Error; err != nil {
+		return err
+	}
 
-		if payment.Amount > 0 {
-			status, err := lightning.LN.GetInvoiceStatus(payment.CheckingID)
-			if err != nil {
-				log.Warn().Err(err).Msg("failed to get invoice status")
-				continue
-			}
-			if status.Paid {
-				log.Info().Msg("invoice paid, updating")
-				result = storage.DB.Where("checkingID = ?", payment.CheckingID).Update("pending", false)
-			} else {
-				continue
-			}
+	for _, payment := range payments {
+		if ctx.Err() != nil {
+			// the next run will get the others
+			break
+		}
+		checkPendingPayment(payment)
+	}
+	return nil
+}
 
-			if result.Error != nil {
-				log.Error().Err(result.Error).Interface("status", status).Msg("failed to update invoice status")
-			} else {
-				events.NotifyInvoicePaid(status)
-			}
-		} else {
-			status, err := lightning.LN.GetPaymentStatus(payment.CheckingID)
-			if err != nil {
-				log.Warn().Err(err).Msg("failed to get payment status")
-				continue
-			}
-			if status.Status == relampago.Complete {
-				log.Info().Str("preimage", status.Preimage).Msg("payment complete, updating")
-				result = storage.DB.Where("checkingID = ?", payment.CheckingID).Update("pending", false)
-			} else if status.Status == relampago.Failed {
-				log.Info().Msg("payment failed, deleting")
-				result = storage.DB.Where("checkingID = ?", payment.CheckingID).Delete(&models.Payment{})
-			} else {
-				log.Info().Interface("status", status.Status).Msg("payment not complete or failed")
-				continue
-			}
+func checkPendingPayment(payment models.Payment) {
+	log := log.With().Str("id", payment.CheckingID).Logger()
+	log.Info().Int64("amount", payment.Amount).Msg("checking")
 
-			if result.Error != nil {
-				log.Error().Err(result.Error).Interface("status", status).Msg("failed to update payment status")
-			} else {
-				events.NotifyPaymentSentStatus(status)
-			}
+	if payment.Amount > 0 {
+		status, err := lightning.LN.GetInvoiceStatus(payment.CheckingID)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to get invoice status")
+			return
 		}
+		if status.Paid {
+			log.Info().Msg("invoice paid, updating")
+			events.NotifyInvoicePaid(status)
+		}
+	} else {
+		status, err := lightning.LN.GetPaymentStatus(payment.CheckingID)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to get payment status")
+			return
+		}
+		switch status.Status {
+		case relampago.Complete:
+			log.Info().Str("preimage", status.Preimage).Msg("payment complete, updating")
+		case relampago.Failed:
+			log.Info().Msg("payment failed, deleting")
+		default:
+			log.Info().Interface("status", status.Status).Msg("payment not complete or failed")
+			return
+		}
+
+		// the ledger is updated when the event is handled
+		events.NotifyPaymentSentStatus(status)
 	}
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// the client address, scheme and host given by a reverse proxy in
+// X-Forwarded-For, X-Real-Ip, X-Forwarded-Proto, X-Forwarded-Host or Forwarded
+// are only used when the request comes from one of TRUSTED_PROXIES (loopback by
+// default), otherwise anyone could pretend to be someone else to the rate
+// limits, the audit log and the apps. in a chain of proxies the client is the
+// last address before the trusted ones.
+
+var trustedProxies []*net.IPNet
+
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %w", entry, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func proxyHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(peer); err == nil {
+			peer = host
+		}
+		if !isTrustedProxy(peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if client := forwardedClient(r); client != "" {
+			r.RemoteAddr = client
+		}
+		if scheme := forwardedScheme(r); scheme != "" {
+			r.URL.Scheme = scheme
+		}
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			r.Host = host
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient is the first address that isn't a trusted proxy, going
+// backwards through the chain.
+func forwardedClient(r *http.Request) string {
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) == 0 {
+		for _, directive := range forwardedDirectives(r, "for") {
+			hops = append(hops, forwardedAddress(directive))
+		}
+	}
+	if len(hops) == 0 {
+		if realIP := strings.TrimSpace(r.Header.Get("X-Real-Ip")); realIP != "" {
+			hops = append(hops, realIP)
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// garbage or an obfuscated identifier, we can't go further
+			return ""
+		}
+		if i == 0 || !isTrustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	return ""
+}
+
+func forwardedScheme(r *http.Request) string {
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = r.Header.Get("X-Forwarded-Scheme")
+	}
+	if scheme == "" {
+		if protos := forwardedDirectives(r, "proto"); len(protos) > 0 {
+			scheme = protos[len(protos)-1]
+		}
+	}
+	scheme = strings.ToLower(strings.TrimSpace(scheme))
+	if scheme != "http" && scheme != "https" {
+		return ""
+	}
+	return scheme
+}
+
+// forwardedDirectives returns the values of a directive in the RFC 7239
+// Forwarded headers, one for each proxy that added it.
+func forwardedDirectives(r *http.Request, name string) []string {
+	var values []string
+	for _, header := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				spl := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(spl) == 2 && strings.EqualFold(spl[0], name) {
+					values = append(values, strings.Trim(spl[1], `"`))
+				}
+			}
+		}
+	}
+	return values
+}
+
+// forwardedAddress takes the port and brackets out of a Forwarded for=, like
+// "[2001:db8::1]:4711" or "192.0.2.43:47011".
+func forwardedAddress(value string) string {
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/models"
+	"golang.org/x/time/rate"
+)
+
+// requests are limited with token buckets, one for each client IP and one for
+// each key used, per class of route. a bucket holds the number of requests per
+// minute set for its class and is refilled at that rate, so a client can make
+// them all at once and then has to wait. a limit of 0 disables the class.
+const (
+	classReads    = "reads"
+	classWrites   = "writes"
+	classPayments = "payments"
+)
+
+var paymentRoutes = map[string]bool{
+	"/api/wallet/pay-invoice":                     true,
+	"/api/wallet/pay-lnurl":                       true,
+	"/lnurl/wallet/drain":                         true,
+	"/lnurlwallet":                                true,
+	"/ext/{wallet}/{appid}/lnurl/{name}/callback": true,
+	"/lndhub/ext/payinvoice":                      true,
+
+	// btcpay greenfield
+	"/api/v1/stores/{storeId}/lightning/{cryptoCode}/invoices/pay": true,
+
+	// alby
+	"/alby/payments/bolt11": true,
+
+	// cashu
+	"/cashu/v1/melt/bolt11": true,
+}
+
+// static files, health checks and metrics aren't limited
+var unlimitedRoutes = map[string]bool{
+	"/":           true,
+	"/static/":    true,
+	"/metrics":    true,
+	"/healthz":    true,
+	"/readyz":     true,
+	"/v/settings": true,
+
+	"/branding/logo":       true,
+	"/branding/custom.css": true,
+}
+
+func routeClass(route string) string {
+	switch {
+	case unlimitedRoutes[route]:
+		return ""
+	case paymentRoutes[route]:
+		return classPayments
+	case auditedRoutes[route], route == "/ext/{wallet}/{appid}/action/{action}":
+		return classWrites
+	default:
+		return classReads
+	}
+}
+
+func classLimit(class string) int {
+	switch class {
+	case classReads:
+		return live().RateLimitReads
+	case classWrites:
+		return live().RateLimitWrites
+	case classPayments:
+		return live().RateLimitPayments
+	}
+	return 0
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*bucket)}
+
+func (rl *rateLimiter) reserve(id string, perMinute int, now time.Time) *rate.Reservation {
+	rl.Lock()
+	defer rl.Unlock()
+
+	b, ok := rl.buckets[id]
+	if !ok {
+		b = &bucket{
+			limiter: rate.NewLimiter(rate.Limit(float64(perMinute)/60), perMinute),
+		}
+		rl.buckets[id] = b
+	}
+	b.lastSeen = now
+	return b.limiter.ReserveN(now, 1)
+}
+
+// reset drops all buckets, called on reload since the limits may have changed.
+func (rl *rateLimiter) reset() {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.buckets = make(map[string]*bucket)
+}
+
+// forget drops the buckets of clients we haven't seen for a while, by then
+// they are full again anyway.
+func (rl *rateLimiter) forget(idle time.Duration) {
+	rl.Lock()
+	defer rl.Unlock()
+	for id, b := range rl.buckets {
+		if time.Since(b.lastSeen) > idle {
+			delete(rl.buckets, id)
+		}
+	}
+}
+
+func forgetIdleRateLimits() {
+	for range time.Tick(time.Minute * 5) {
+		limiter.forget(time.Minute * 5)
+	}
+}
+
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := routeClass(apiutils.RouteTemplate(r))
+		limit := classLimit(class)
+		if class == "" || limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if wait := limiter.wait(class, limit, apiutils.ClientIP(r), requestKey(r)); wait > 0 {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			apiutils.SendJSONError(w, 429, "too many requests, try again in %d seconds", seconds)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wait takes a request from the buckets of the ip and of the key, and says how
+// long to wait when one of them is empty, in which case nothing is taken.
+func (rl *rateLimiter) wait(class string, limit int, ip, key string) time.Duration {
+	ids := []string{class + ":ip:" + ip}
+	if key != "" {
+		ids = append(ids, class+":key:"+models.LookupHash(key)[0:16])
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	reservations := make([]*rate.Reservation, len(ids))
+	for i, id := range ids {
+		reservations[i] = rl.reserve(id, limit, now)
+		if delay := reservations[i].DelayFrom(now); delay > wait {
+			wait = delay
+		}
+	}
+	if wait > 0 {
+		for _, res := range reservations {
+			res.CancelAt(now)
+		}
+	}
+	return wait
+}
+
+// requestKey is whatever key the request is authenticated with, valid or not.
+func requestKey(r *http.Request) string {
+	for _, key := range []string{
+		r.Header.Get("X-Api-Key"),
+		r.URL.Query().Get("api-key"),
+		r.Header.Get("X-MasterKey"),
+		r.Header.Get("X-Admin-Key"),
+		bearerToken(r),
+	} {
+		if key != "" {
+			return key
+		}
+	}
+	return ""
+}
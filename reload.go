@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/lnbits/infinity/api"
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/apps"
+	"github.com/lnbits/infinity/chaos"
+	"github.com/lnbits/infinity/jobs"
+	"github.com/lnbits/infinity/metrics"
+	"github.com/lnbits/infinity/nwc"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/systemd"
+	"github.com/rs/cors"
+)
+
+// on SIGHUP or POST /api/admin/reload the config file and the environment are
+// read again and the settings below are applied. everything else (ports,
+// database, lightning backend, keys) needs a restart.
+var reloadableSettings = []string{
+	"SiteTitle",
+	"SiteTagline",
+	"SiteDescription",
+	"LuaQuota",
+	"LuaTimeout",
+	"LuaMemoryLimit",
+	"AppFetchTimeout",
+	"AppFetchMaxBytes",
+	"AppUpdateInterval",
+	"PaymentRetentionDays",
+	"DeletedRetentionDays",
+	"BackupKeep",
+	"MetricsToken",
+	"CORSOrigins",
+	"ContentSecurityPolicy",
+	"AppContentSecurityPolicy",
+	"FrameOptions",
+	"ReferrerPolicy",
+	"HSTSMaxAge",
+	"ShutdownTimeout",
+	"LogLevel",
+	"AccessLog",
+	"AccessLogMaxBody",
+	"HTTPWriteTimeout",
+	"HTTPLongTimeout",
+	"RateLimitReads",
+	"RateLimitWrites",
+	"RateLimitPayments",
+	"BanAuthFailures",
+	"BanLNURLScans",
+	"BanInvoices",
+	"BanWindow",
+	"BanDuration",
+	"JobMaxAttempts",
+	"JobTimeout",
+	"JobRetentionDays",
+	"Maintenance",
+	"MaintenanceMessage",
+	"ChaosInvoiceFailure",
+	"ChaosPaymentFailure",
+	"ChaosEventDrop",
+	"ChaosMaxDelay",
+}
+
+// liveSettings has the *Settings as they were last loaded. s isn't changed
+// after the start, a reload stores a new copy here, so what is read while
+// serving requests comes from live().
+var liveSettings atomic.Value
+
+func live() *Settings {
+	return liveSettings.Load().(*Settings)
+}
+
+// applySettings passes the reloadable settings to the packages that use them,
+// changed being the names of the ones that are different from before. the
+// packages keep them in atomics, since requests read them while this runs.
+func applySettings(cfg *Settings, changed []string) {
+	liveSettings.Store(cfg)
+	apps.SetLimits(apps.Limits{
+		LuaQuota:            cfg.LuaQuota,
+		LuaTimeout:          cfg.LuaTimeout,
+		LuaMemoryLimit:      cfg.LuaMemoryLimit,
+		FetchTimeout:        cfg.AppFetchTimeout,
+		FetchMaxBytes:       cfg.AppFetchMaxBytes,
+		UpdateCheckInterval: cfg.AppUpdateInterval,
+	})
+	api.SetSiteTitle(cfg.SiteTitle)
+	nwc.SetSiteTitle(cfg.SiteTitle)
+	metrics.SetToken(cfg.MetricsToken)
+	services.SetDeletedRetention(time.Hour * 24 * time.Duration(cfg.DeletedRetentionDays))
+	storage.SetBackupKeep(cfg.BackupKeep)
+	services.ConfigureMaintenance(cfg.Maintenance, cfg.MaintenanceMessage)
+	jobs.SetLimits(cfg.JobMaxAttempts, cfg.JobTimeout)
+	chaos.SetRates(chaos.Rates{
+		InvoiceFailure: cfg.ChaosInvoiceFailure,
+		PaymentFailure: cfg.ChaosPaymentFailure,
+		EventDrop:      cfg.ChaosEventDrop,
+		MaxDelay:       cfg.ChaosMaxDelay,
+	})
+	corsOrigins.Store(cfg.CORSOrigins)
+	setSecurityHeaders(cfg)
+	setLogLevel(cfg.LogLevel)
+	for _, name := range changed {
+		if strings.HasPrefix(name, "RateLimit") {
+			// the buckets were filled for the old limits
+			limiter.reset()
+			break
+		}
+	}
+}
+
+// reloadMutex keeps a SIGHUP and a reload from the admin from both starting
+// from the same live() and one of them losing what the other changed.
+var reloadMutex sync.Mutex
+
+// reloadSettings returns the names of the settings that changed.
+func reloadSettings() ([]string, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	if configPath != "" {
+		if err := loadConfigFile(configPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := loadSecretFiles(); err != nil {
+		return nil, err
+	}
+	if err := loadProviderSecrets(); err != nil {
+		return nil, err
+	}
+
+	var next Settings
+	if err := envconfig.Process("", &next); err != nil {
+		return nil, err
+	}
+
+	// only the reloadable ones are taken from what was read again
+	cfg := *live()
+	current := reflect.ValueOf(&cfg).Elem()
+	updated := reflect.ValueOf(next)
+	changed := make([]string, 0)
+	for _, name := range reloadableSettings {
+		value := updated.FieldByName(name)
+		if !reflect.DeepEqual(current.FieldByName(name).Interface(), value.Interface()) {
+			current.FieldByName(name).Set(value)
+			changed = append(changed, name)
+		}
+	}
+	applySettings(&cfg, changed)
+
+	return changed, nil
+}
+
+func reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		systemd.Notify("RELOADING=1")
+		changed, err := reloadSettings()
+		systemd.Notify("READY=1")
+		if err != nil {
+			log.Error().Err(err).Msg("failed to reload settings")
+			continue
+		}
+		log.Info().Strs("changed", changed).Msg("reloaded settings")
+	}
+}
+
+func reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiutils.SendJSONError(w, 405, "use POST to reload the settings")
+		return
+	}
+
+	changed, err := reloadSettings()
+	if err != nil {
+		apiutils.SendJSONError(w, 400, "failed to reload settings: %s", err.Error())
+		return
+	}
+	log.Info().Strs("changed", changed).Msg("reloaded settings")
+
+	apiutils.SendJSON(w, struct {
+		Changed []string `json:"changed"`
+	}{changed})
+}
+
+// CORS_ORIGINS can change on reload, so origins are checked on each request.
+// when it is empty any origin is allowed.
+var corsOrigins atomic.Value
+
+func corsMiddleware() func(http.Handler) http.Handler {
+	return cors.New(cors.Options{
+		AllowOriginFunc: func(origin string) bool {
+			origins, _ := corsOrigins.Load().([]string)
+			if len(origins) == 0 {
+				return true
+			}
+			for _, allowed := range origins {
+				if allowed == "*" || allowed == origin {
+					return true
+				}
+			}
+			return false
+		},
+		AllowedMethods: []string{
+			http.MethodHead,
+			http.MethodGet,
+			http.MethodPost,
+			http.MethodPut,
+			http.MethodPatch,
+			http.MethodDelete,
+		},
+		AllowedHeaders: []string{"*"},
+	}).Handler
+}
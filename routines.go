@@ -1,10 +1,17 @@
 package main
 
 import (
+	"io"
+	"os"
+	"path/filepath"
 	"time"
 
 	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/lnbits/infinity/cluster"
+	"github.com/lnbits/infinity/jobs"
+	"github.com/lnbits/infinity/ledger"
 	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
 	"github.com/lnbits/infinity/storage"
 )
 
@@ -12,7 +19,14 @@ func routines() {
 	time.Sleep(15 * time.Minute)
 
 	for {
-		deleteExpiredInvoices()
+		if cluster.Leading() {
+			deleteExpiredInvoices()
+			if live().PaymentRetentionDays > 0 {
+				prunePayments()
+			}
+			purgeDeleted()
+			purgeJobs()
+		}
 
 		time.Sleep(12 * time.Hour)
 	}
@@ -41,3 +55,90 @@ func deleteExpiredInvoices() {
 		}
 	}
 }
+
+// snapshotBalances keeps today's balance snapshot up to date, so the last one
+// taken each day is the balance at the end of that day.
+func snapshotBalances() {
+	for {
+		if cluster.Leading() {
+			drifts, err := ledger.Snapshot()
+			for _, drift := range drifts {
+				log.Error().Interface("drift", drift).
+					Msg("wallet balance doesn't match its snapshot, past ledger entries were changed")
+			}
+			if err != nil {
+				log.Error().Err(err).Msg("failed to snapshot balances")
+			}
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+func backups() {
+	for {
+		time.Sleep(s.BackupInterval)
+		if !cluster.Leading() {
+			continue
+		}
+
+		backup, err := storage.CreateBackup()
+		if err != nil {
+			log.Error().Err(err).Msg("database backup failed")
+		}
+		if backup != nil {
+			log.Info().Str("name", backup.Name).Int64("size", backup.Size).
+				Str("location", backup.Location).Msg("database backup created")
+		}
+	}
+}
+
+func prunePayments() {
+	cutoff := time.Now().AddDate(0, 0, -live().PaymentRetentionDays)
+	log.Info().Time("before", cutoff).Msg("pruning old payments")
+
+	var archive io.Writer
+	if s.PaymentArchiveDir != "" {
+		if err := os.MkdirAll(s.PaymentArchiveDir, 0700); err != nil {
+			log.Error().Err(err).Msg("failed to create payment archive dir, not pruning")
+			return
+		}
+		file, err := os.Create(filepath.Join(s.PaymentArchiveDir,
+			"payments-"+time.Now().UTC().Format("20060102T150405Z")+".jsonl.gz"))
+		if err != nil {
+			log.Error().Err(err).Msg("failed to create payment archive, not pruning")
+			return
+		}
+		defer file.Close()
+		archive = file
+	}
+
+	count, err := services.PrunePayments(cutoff, archive)
+	if err != nil {
+		log.Error().Err(err).Int("pruned", count).Msg("failed to prune payments")
+		return
+	}
+	log.Info().Int("pruned", count).Msg("pruned old payments")
+}
+
+func purgeDeleted() {
+	purged, err := services.PurgeDeleted()
+	if err != nil {
+		log.Error().Err(err).Int("purged", purged).Msg("failed to purge deleted wallets")
+		return
+	}
+	if purged > 0 {
+		log.Info().Int("purged", purged).Msg("purged deleted wallets")
+	}
+}
+
+func purgeJobs() {
+	purged, err := jobs.Purge(time.Now().AddDate(0, 0, -live().JobRetentionDays))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to purge finished jobs")
+		return
+	}
+	if purged > 0 {
+		log.Info().Int64("purged", purged).Msg("purged finished jobs")
+	}
+}
@@ -0,0 +1,137 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/lnbits/infinity/apps"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/rpc/pb"
+	"github.com/lnbits/infinity/storage"
+	"google.golang.org/grpc/codes"
+)
+
+// apps are known by their url here, not by the encoded id of the http routes.
+
+type appsServer struct {
+	pb.UnimplementedAppsServer
+}
+
+func (appsServer) ListApps(ctx context.Context, _ *pb.ListAppsRequest) (*pb.ListAppsResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	list, err := storage.Default.ListUserApps(walletFrom(ctx).UserID)
+	if err != nil {
+		return nil, statusError(codes.Internal, "failed to load apps", err)
+	}
+	return &pb.ListAppsResponse{Apps: list}, nil
+}
+
+func (appsServer) ListItems(ctx context.Context, req *pb.ListItemsRequest) (*pb.ListItemsResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	params := map[string]interface{}{
+		"startkey": req.StartKey,
+		"endkey":   req.EndKey,
+		"prefix":   req.Prefix,
+		"cursor":   req.Cursor,
+		"limit":    int(req.Limit),
+		"offset":   int(req.Offset),
+		"sort":     req.Sort,
+	}
+	items, err := apps.DBList(walletFrom(ctx).ID, req.App, req.Model, params)
+	if err != nil {
+		return nil, statusError(codes.InvalidArgument, "failed to list items", err)
+	}
+
+	resp := &pb.ListItemsResponse{Items: make([]*pb.Item, len(items))}
+	for i, item := range items {
+		resp.Items[i] = toItem(item)
+	}
+	if req.Limit > 0 && len(items) == int(req.Limit) && (req.Sort == "" || req.Sort == "key") {
+		resp.Next = items[len(items)-1].Key
+	}
+	return resp, nil
+}
+
+func (appsServer) GetItem(ctx context.Context, req *pb.GetItemRequest) (*pb.Item, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	value, err := apps.DBGet(walletFrom(ctx).ID, req.App, req.Model, req.Key)
+	if err != nil {
+		return nil, statusError(codes.Internal, "failed to get item", err)
+	}
+	return &pb.Item{Model: req.Model, Key: req.Key, Value: toStruct(value)}, nil
+}
+
+func (appsServer) SetItem(ctx context.Context, req *pb.SetItemRequest) (*pb.Item, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	wallet := walletFrom(ctx)
+
+	value := fromStruct(req.Value)
+	if err := apps.DBSet(wallet.ID, req.App, req.Model, req.Key, value); err != nil {
+		return nil, statusError(codes.InvalidArgument, "failed to set item", err)
+	}
+
+	go apps.TriggerEventOnSpecificAppWallet(
+		apps.AppWallet{WalletID: wallet.ID, URL: req.App},
+		"api_db_set",
+		apps.KeyValue{Model: req.Model, Key: req.Key, Value: value},
+	)
+	return &pb.Item{Model: req.Model, Key: req.Key, Value: req.Value}, nil
+}
+
+func (appsServer) AddItem(ctx context.Context, req *pb.AddItemRequest) (*pb.Item, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	wallet := walletFrom(ctx)
+
+	value := fromStruct(req.Value)
+	key, err := apps.DBAdd(wallet.ID, req.App, req.Model, value)
+	if err != nil {
+		return nil, statusError(codes.InvalidArgument, "failed to add item", err)
+	}
+
+	go apps.TriggerEventOnSpecificAppWallet(
+		apps.AppWallet{WalletID: wallet.ID, URL: req.App},
+		"api_db_set",
+		apps.KeyValue{Model: req.Model, Key: key, Value: value},
+	)
+	return &pb.Item{Model: req.Model, Key: key, Value: req.Value}, nil
+}
+
+func (appsServer) DeleteItem(ctx context.Context, req *pb.DeleteItemRequest) (*pb.DeleteItemResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	wallet := walletFrom(ctx)
+
+	if err := apps.DBDelete(wallet.ID, req.App, req.Model, req.Key); err != nil {
+		return nil, statusError(codes.Internal, "failed to delete item", err)
+	}
+
+	go apps.TriggerEventOnSpecificAppWallet(
+		apps.AppWallet{WalletID: wallet.ID, URL: req.App},
+		"api_db_delete",
+		apps.KeyValue{Model: req.Model, Key: req.Key},
+	)
+	return &pb.DeleteItemResponse{}, nil
+}
+
+func toItem(item models.AppDataItem) *pb.Item {
+	return &pb.Item{
+		Model:     item.Model,
+		Key:       item.Key,
+		Value:     toStruct(item.Value),
+		CreatedAt: timestamp(item.CreatedAt),
+		UpdatedAt: timestamp(item.UpdatedAt),
+	}
+}
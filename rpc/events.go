@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/lnbits/infinity/cluster"
+	"github.com/lnbits/infinity/events"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/rpc/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// payment events go through the cluster, so a stream gets the payments of its
+// wallet no matter which instance handled them. the payment goes already made
+// into its protobuf message.
+
+type paymentEvent struct {
+	Type     pb.PaymentEvent_Type `json:"type"`
+	WalletID string               `json:"wallet"`
+	Payment  []byte               `json:"payment"`
+}
+
+var (
+	streamsMutex sync.Mutex
+	streams      = make(map[string]map[chan *pb.PaymentEvent]bool) // wallet id -> streams
+	stopping     = make(chan struct{})
+	stopOnce     sync.Once
+)
+
+func init() {
+	cluster.Subscribe("rpc_payments", func(data json.RawMessage) {
+		var event paymentEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return
+		}
+		dispatch(event)
+	})
+}
+
+// Start sends the payments of this instance to the streams.
+func Start() {
+	forward := func(typ pb.PaymentEvent_Type, register func(chan models.Payment)) {
+		c := make(chan models.Payment)
+		register(c)
+		go func() {
+			for payment := range c {
+				encoded, err := proto.Marshal(toPayment(payment))
+				if err != nil {
+					log.Warn().Err(err).Str("payment", payment.CheckingID).Msg("failed to encode payment event")
+					continue
+				}
+				cluster.Publish("rpc_payments", paymentEvent{typ, payment.WalletID, encoded})
+			}
+		}()
+	}
+	forward(pb.PaymentEvent_RECEIVED, events.OnPaymentReceived)
+	forward(pb.PaymentEvent_SENT, events.OnPaymentSent)
+	forward(pb.PaymentEvent_FAILED, events.OnPaymentFailed)
+}
+
+// Stop ends the streams, the server doesn't wait for them when stopping.
+func Stop() {
+	stopOnce.Do(func() { close(stopping) })
+}
+
+func subscribe(walletID string) (<-chan *pb.PaymentEvent, func()) {
+	c := make(chan *pb.PaymentEvent, 16)
+
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	if streams[walletID] == nil {
+		streams[walletID] = make(map[chan *pb.PaymentEvent]bool)
+	}
+	streams[walletID][c] = true
+
+	return c, func() {
+		streamsMutex.Lock()
+		defer streamsMutex.Unlock()
+		delete(streams[walletID], c)
+		if len(streams[walletID]) == 0 {
+			delete(streams, walletID)
+		}
+	}
+}
+
+func dispatch(event paymentEvent) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	if len(streams[event.WalletID]) == 0 {
+		return
+	}
+
+	var payment pb.Payment
+	if err := proto.Unmarshal(event.Payment, &payment); err != nil {
+		log.Warn().Err(err).Msg("failed to decode payment event")
+		return
+	}
+	for c := range streams[event.WalletID] {
+		select {
+		case c <- &pb.PaymentEvent{Type: event.Type, Payment: &payment}:
+		default:
+			// a stream that doesn't keep up misses events instead of holding the others
+			log.Warn().Str("wallet", event.WalletID).Msg("rpc payment stream is full")
+		}
+	}
+}
+
+// Streams counts the clients subscribed to payments on this instance.
+func Streams() int {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	count := 0
+	for _, set := range streams {
+		count += len(set)
+	}
+	return count
+}
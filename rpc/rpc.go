@@ -0,0 +1,138 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/rpc/pb"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+// the services of infinity.proto, for backends that want typed clients and a
+// stream of payment events. they do what the REST API does through the same
+// services, with the wallet key of the call found by Authenticate; the server
+// itself, with bans and the audit log, is set up in main.
+
+var log zerolog.Logger
+
+func SetLogger(logger zerolog.Logger) {
+	log = logger.With().Str("s", "rpc").Logger()
+}
+
+// Register adds the services to a server.
+func Register(server *grpc.Server) {
+	pb.RegisterWalletsServer(server, walletsServer{})
+	pb.RegisterAppsServer(server, appsServer{})
+}
+
+// Key is the wallet key of a call, from its x-api-key metadata.
+func Key(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-api-key"); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// Authenticate puts the wallet of the key and the permission it gives in the
+// context, as "wallet" and "permission" like walletMiddleware does.
+func Authenticate(ctx context.Context) (context.Context, error) {
+	key := Key(ctx)
+	if key == "" {
+		return ctx, status.Error(codes.Unauthenticated, "x-api-key metadata not provided")
+	}
+	wallet, err := storage.Default.GetWalletByKey(key)
+	if err != nil {
+		return ctx, status.Error(codes.Unauthenticated, "invalid x-api-key")
+	}
+
+	permission := "invoice"
+	if string(wallet.AdminKey) == key {
+		permission = "admin"
+	}
+	ctx = context.WithValue(ctx, "wallet", wallet)
+	ctx = context.WithValue(ctx, "permission", permission)
+	return ctx, nil
+}
+
+func walletFrom(ctx context.Context) *models.Wallet {
+	return ctx.Value("wallet").(*models.Wallet)
+}
+
+func requireAdmin(ctx context.Context) error {
+	if ctx.Value("permission").(string) != "admin" {
+		return status.Error(codes.PermissionDenied, "this needs the admin key")
+	}
+	return nil
+}
+
+// statusError gives the errors of the services their gRPC codes, or fallback.
+func statusError(fallback codes.Code, message string, err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return status.Error(codes.NotFound, message+": not found")
+	case errors.Is(err, services.ErrMaintenance), errors.Is(err, services.ErrShuttingDown):
+		return status.Error(codes.Unavailable, err.Error())
+	case strings.Contains(err.Error(), "insufficient balance"):
+		return status.Error(codes.FailedPrecondition, message+": "+err.Error())
+	}
+	return status.Error(fallback, message+": "+err.Error())
+}
+
+func toPayment(payment models.Payment) *pb.Payment {
+	return &pb.Payment{
+		CheckingId:  payment.CheckingID,
+		Hash:        payment.Hash,
+		Pending:     payment.Pending,
+		Amount:      payment.Amount,
+		Fee:         payment.Fee,
+		Description: payment.Description,
+		Bolt11:      payment.Bolt11,
+		Preimage:    string(payment.Preimage),
+		Tag:         payment.Tag,
+		Extra:       toStruct(payment.Extra),
+		Webhook:     payment.Webhook,
+		CreatedAt:   timestamp(payment.CreatedAt),
+		WalletId:    payment.WalletID,
+	}
+}
+
+// toStruct is nil for what can't be a Struct, which has only JSON in it.
+func toStruct(value map[string]interface{}) *structpb.Struct {
+	if value == nil {
+		return nil
+	}
+	s, err := structpb.NewStruct(value)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to convert to a protobuf struct")
+		return nil
+	}
+	return s
+}
+
+func fromStruct(s *structpb.Struct) map[string]interface{} {
+	if s == nil {
+		return map[string]interface{}{}
+	}
+	return s.AsMap()
+}
+
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
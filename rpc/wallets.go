@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/lnbits/infinity/rpc/pb"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	rp "github.com/lnbits/relampago"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type walletsServer struct {
+	pb.UnimplementedWalletsServer
+}
+
+// PaymentsPageSize is the limit of ListPayments when none is given.
+var PaymentsPageSize = 200
+
+func (walletsServer) GetWallet(ctx context.Context, _ *pb.GetWalletRequest) (*pb.Wallet, error) {
+	wallet := walletFrom(ctx)
+
+	balance, err := services.LoadWalletBalance(wallet.ID)
+	if err != nil {
+		return nil, statusError(codes.Internal, "failed to load balance", err)
+	}
+
+	return &pb.Wallet{
+		Id:      wallet.ID,
+		Name:    wallet.Name,
+		Balance: balance,
+		UserId:  wallet.UserID,
+	}, nil
+}
+
+func (walletsServer) CreateInvoice(ctx context.Context, req *pb.CreateInvoiceRequest) (*pb.Payment, error) {
+	wallet := walletFrom(ctx)
+
+	if req.Msatoshi < 0 {
+		return nil, status.Error(codes.InvalidArgument, "msatoshi can't be negative")
+	}
+	if len(req.DescriptionHash) != 0 && len(req.DescriptionHash) != 32 {
+		return nil, status.Error(codes.InvalidArgument, "description_hash must have 32 bytes")
+	}
+
+	params := services.CreateInvoiceParams{
+		InvoiceParams: rp.InvoiceParams{
+			Msatoshi:        req.Msatoshi,
+			Description:     req.Description,
+			DescriptionHash: req.DescriptionHash,
+		},
+		Tag:     req.Tag,
+		Extra:   fromStruct(req.Extra),
+		Webhook: req.Webhook,
+	}
+	if req.Expiry > 0 {
+		expiry := time.Second * time.Duration(req.Expiry)
+		params.Expiry = &expiry
+	}
+
+	payment, err := services.CreateInvoice(ctx, wallet.ID, params)
+	if err != nil {
+		return nil, statusError(codes.InvalidArgument, "failed to create invoice", err)
+	}
+
+	return toPayment(payment), nil
+}
+
+func (walletsServer) PayInvoice(ctx context.Context, req *pb.PayInvoiceRequest) (*pb.Payment, error) {
+	wallet := walletFrom(ctx)
+
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	payment, err := services.PayInvoice(ctx, wallet.ID, services.PayInvoiceParams{
+		PaymentParams: rp.PaymentParams{
+			Invoice:      req.Invoice,
+			CustomAmount: req.CustomAmount,
+		},
+		Tag:     req.Tag,
+		Extra:   fromStruct(req.Extra),
+		Webhook: req.Webhook,
+	})
+	if err != nil {
+		return nil, statusError(codes.InvalidArgument, "failed to pay invoice", err)
+	}
+
+	return toPayment(payment), nil
+}
+
+func (walletsServer) ListPayments(ctx context.Context, req *pb.ListPaymentsRequest) (*pb.ListPaymentsResponse, error) {
+	wallet := walletFrom(ctx)
+
+	limit := PaymentsPageSize
+	if req.Limit > 0 && req.Limit <= 1000 {
+		limit = int(req.Limit)
+	}
+
+	payments, next, err := services.ListWalletPayments(wallet.ID, limit, req.Cursor, req.Query)
+	if err != nil {
+		return nil, statusError(codes.InvalidArgument, "failed to load payments", err)
+	}
+
+	resp := &pb.ListPaymentsResponse{
+		Payments: make([]*pb.Payment, len(payments)),
+		Next:     next,
+	}
+	for i, payment := range payments {
+		resp.Payments[i] = toPayment(payment)
+	}
+	return resp, nil
+}
+
+func (walletsServer) GetPayment(ctx context.Context, req *pb.GetPaymentRequest) (*pb.Payment, error) {
+	wallet := walletFrom(ctx)
+
+	payment, err := storage.Default.GetPayment(wallet.ID, req.Id)
+	if err != nil {
+		return nil, statusError(codes.Internal, "failed to load payment", err)
+	}
+
+	return toPayment(*payment), nil
+}
+
+func (walletsServer) SubscribePayments(_ *pb.SubscribePaymentsRequest, stream pb.Wallets_SubscribePaymentsServer) error {
+	wallet := walletFrom(stream.Context())
+
+	events, cancel := subscribe(wallet.ID)
+	defer cancel()
+
+	for {
+		select {
+		case event := <-events:
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-stopping:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the secret settings (and MASTER_KEY) can also come from an external provider,
+// set with SECRETS_PROVIDER: "vault" reads them from a KV secret in HashiCorp
+// Vault, at VAULT_PATH (like secret/data/lnbits) on VAULT_ADDR with VAULT_TOKEN,
+// and "exec" runs SECRETS_COMMAND and reads them from its output. either way
+// they are a JSON object keyed by the names of the variables. they are fetched
+// on startup and again on reload, and every SECRETS_REFRESH_INTERVAL if set.
+// environment variables and _FILE variables take precedence.
+//
+// these settings are read directly from the environment since they are needed
+// before the others are processed.
+
+var providerSecrets = append([]string{"MASTER_KEY"}, secretSettings...)
+
+// the variables we took from the provider and their values, so on reload they
+// are replaced and we can tell which ones changed.
+var providerVars = make(map[string]string)
+
+func loadProviderSecrets() error {
+	provider := os.Getenv("SECRETS_PROVIDER")
+	if provider == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	var values map[string]interface{}
+	var err error
+	switch provider {
+	case "vault":
+		values, err = fetchVaultSecrets(ctx)
+	case "exec":
+		values, err = execSecretsCommand(ctx)
+	default:
+		return fmt.Errorf("unknown SECRETS_PROVIDER '%s', must be vault or exec", provider)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get secrets from %s: %w", provider, err)
+	}
+
+	vars := make(map[string]string)
+	flattenConfig("", values, vars)
+
+	previous := providerVars
+	for name := range previous {
+		os.Unsetenv(name)
+	}
+	providerVars = make(map[string]string)
+
+	var changed []string
+	for _, name := range providerSecrets {
+		value, ok := vars[name]
+		if !ok {
+			continue
+		}
+		if _, set := os.LookupEnv(name); set {
+			continue
+		}
+		os.Setenv(name, value)
+		providerVars[name] = value
+
+		if old, had := previous[name]; had && old != value {
+			changed = append(changed, name)
+		}
+	}
+	for name := range vars {
+		if _, ok := providerVars[name]; !ok && !isProviderSecret(name) {
+			log.Warn().Str("name", name).Msg("ignoring a value from the secrets provider that isn't a secret setting")
+		}
+	}
+
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		log.Warn().Strs("changed", changed).
+			Msg("secrets changed in the provider, those that aren't reloadable need a restart")
+	}
+	return nil
+}
+
+func isProviderSecret(name string) bool {
+	for _, secret := range providerSecrets {
+		if secret == name {
+			return true
+		}
+	}
+	return false
+}
+
+func fetchVaultSecrets(ctx context.Context) (map[string]interface{}, error) {
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	path := strings.Trim(os.Getenv("VAULT_PATH"), "/")
+	token := os.Getenv("VAULT_TOKEN")
+	if addr == "" || path == "" || token == "" {
+		return nil, errors.New("VAULT_ADDR, VAULT_PATH and VAULT_TOKEN must be set")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", addr+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("vault returned %d: %s", resp.StatusCode, body)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, fmt.Errorf("invalid response from vault: %w", err)
+	}
+
+	// version 2 of the KV engine has the values inside another data, with
+	// metadata beside them
+	if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return inner, nil
+		}
+	}
+	return secret.Data, nil
+}
+
+func execSecretsCommand(ctx context.Context) (map[string]interface{}, error) {
+	command := os.Getenv("SECRETS_COMMAND")
+	if command == "" {
+		return nil, errors.New("SECRETS_COMMAND must be set")
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(output, &values); err != nil {
+		return nil, fmt.Errorf("output must be a JSON object: %w", err)
+	}
+	return values, nil
+}
+
+// refreshSecrets reloads the settings periodically, so secrets rotated in the
+// provider are picked up.
+func refreshSecrets(interval time.Duration) {
+	for range time.Tick(interval) {
+		changed, err := reloadSettings()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to refresh secrets")
+			continue
+		}
+		if len(changed) > 0 {
+			log.Info().Strs("changed", changed).Msg("reloaded settings")
+		}
+	}
+}
@@ -1,15 +1,20 @@
 package services
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"time"
 
 	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/lnbits/infinity/events"
 	"github.com/lnbits/infinity/lightning"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/tracing"
+	"github.com/lnbits/infinity/webhook"
 	rp "github.com/lnbits/relampago"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var DefaultInvoiceExpiry = time.Minute * 15
@@ -20,6 +25,8 @@ type CreateInvoiceParams struct {
 	Tag     string            `json:"tag"`
 	Extra   models.JSONObject `json:"extra"`
 	Webhook string            `json:"webhook"`
+	// WebhookFormat is how the webhook is sent, see the webhook package.
+	WebhookFormat string `json:"webhookFormat"`
 }
 
 func CreateInvoiceFromApp(walletID string, params map[string]interface{}) (interface{}, error) {
@@ -33,13 +40,24 @@ func CreateInvoiceFromApp(walletID string, params map[string]interface{}) (inter
 			s.Msatoshi = int64(f)
 		}
 	}
-	return CreateInvoice(walletID, s)
+	return CreateInvoice(context.Background(), walletID, s)
 }
 
-func CreateInvoice(walletID string, params CreateInvoiceParams) (models.Payment, error) {
+func CreateInvoice(ctx context.Context, walletID string, params CreateInvoiceParams) (payment models.Payment, err error) {
+	// a payment or invoice shouldn't be left half-done because the client left
+	ctx, span := tracing.Span(tracing.Detach(ctx), "services.CreateInvoice",
+		attribute.String("wallet", walletID), attribute.Int64("msat", params.Msatoshi))
+	defer func() { tracing.End(span, err) }()
+
+	if !webhook.Known(params.WebhookFormat) {
+		return models.Payment{}, fmt.Errorf("unknown webhook format '%s'", params.WebhookFormat)
+	}
+
 	params.InvoiceParams.Expiry = &DefaultInvoiceExpiry
 
+	_, lnspan := tracing.Span(ctx, "lightning.CreateInvoice")
 	data, err := lightning.LN.CreateInvoice(params.InvoiceParams)
+	tracing.End(lnspan, err)
 	if err != nil {
 		return models.Payment{}, fmt.Errorf("failed to create invoice: %w", err)
 	}
@@ -50,21 +68,24 @@ func CreateInvoice(walletID string, params CreateInvoiceParams) (models.Payment,
 			"failed to parse created invoice (%s): %w", data.Invoice, err)
 	}
 
-	payment := models.Payment{
-		CheckingID:  data.CheckingID,
-		Pending:     true,
-		Preimage:    data.Preimage,
-		Hash:        inv.PaymentHash,
-		Bolt11:      data.Invoice,
-		Amount:      params.Msatoshi,
-		WalletID:    walletID,
-		Description: params.Description,
-		Extra:       params.Extra,
-		Tag:         params.Tag,
+	payment = models.Payment{
+		CheckingID:    data.CheckingID,
+		Pending:       true,
+		Preimage:      models.EncryptedString(data.Preimage),
+		Hash:          inv.PaymentHash,
+		Bolt11:        data.Invoice,
+		Amount:        params.Msatoshi,
+		WalletID:      walletID,
+		Description:   params.Description,
+		Extra:         params.Extra,
+		Tag:           params.Tag,
+		Webhook:       params.Webhook,
+		WebhookFormat: params.WebhookFormat,
 	}
-	if result := storage.DB.Create(&payment); result.Error != nil {
+	if result := storage.DB.WithContext(ctx).Create(&payment); result.Error != nil {
 		return payment, fmt.Errorf("failed to save invoice: %w", result.Error)
 	}
 
+	events.EmitInvoiceCreated(payment)
 	return payment, nil
 }
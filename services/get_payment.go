@@ -1,17 +1,37 @@
 package services
 
 import (
+	"errors"
+	"time"
+
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/storage"
 )
 
-func GetWalletPayment(walletID string, hashOrCheckingID string) (models.Payment, error) {
-	var payment models.Payment
+var ErrPaymentFailed = errors.New("payment failed")
 
-	result := storage.DB.
-		Where("wallet_id = ?", walletID).
-		Where("hash = ?", hashOrCheckingID).Or("checking_id = ?", hashOrCheckingID).
-		First(&payment)
+func GetWalletPayment(walletID string, hashOrCheckingID string) (models.Payment, error) {
+	payment, err := storage.Default.GetPayment(walletID, hashOrCheckingID)
+	if err != nil {
+		return models.Payment{}, err
+	}
+	return *payment, nil
+}
 
-	return payment, result.Error
+// WaitForPayment waits up to timeout for the outgoing payment with the given
+// hash to settle, for the APIs whose clients expect the preimage right away.
+// failed payments are deleted, so when the payment is gone it has failed. if it
+// is still pending after the timeout it is returned as it is.
+func WaitForPayment(walletID string, hash string, timeout time.Duration) (models.Payment, error) {
+	var payment models.Payment
+	for deadline := time.Now().Add(timeout); ; time.Sleep(time.Millisecond * 500) {
+		result := storage.DB.Where("wallet_id = ? AND hash = ? AND amount < 0", walletID, hash).
+			Order("created_at desc").Limit(1).Find(&payment)
+		if result.Error == nil && result.RowsAffected == 0 {
+			return payment, ErrPaymentFailed
+		}
+		if (result.Error == nil && !payment.Pending) || time.Now().After(deadline) {
+			return payment, nil
+		}
+	}
 }
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"github.com/lnbits/infinity/ledger"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/storage"
 	"github.com/lnbits/infinity/utils"
@@ -8,6 +9,10 @@ import (
 )
 
 func Transfer(walletID string, toWalletID string, msatoshi int64, desc string) error {
+	if err := checkMaintenance(); err != nil {
+		return err
+	}
+
 	sharedHash := utils.RandomHex(16)
 
 	leaving := models.Payment{
@@ -29,13 +34,16 @@ func Transfer(walletID string, toWalletID string, msatoshi int64, desc string) e
 	}
 
 	err := storage.DB.Transaction(func(tx *gorm.DB) error {
-		if err := tx.Create(leaving).Error; err != nil {
+		if err := tx.Create(&leaving).Error; err != nil {
 			return err
 		}
-		if err := tx.Create(entering).Error; err != nil {
+		if err := tx.Create(&entering).Error; err != nil {
 			return err
 		}
-		return nil
+		return ledger.Post(tx, ledger.KindTransfer, leaving.CheckingID,
+			ledger.Wallet(walletID, -msatoshi),
+			ledger.Wallet(toWalletID, msatoshi),
+		)
 	})
 
 	return err
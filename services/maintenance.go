@@ -0,0 +1,74 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/lnbits/infinity/cluster"
+)
+
+// in maintenance mode no money leaves the wallets: paying invoices and LNURLs,
+// app payments and transfers fail with ErrMaintenance, while balances, history
+// and invoices (new ones too) keep working. MAINTENANCE sets it at the start,
+// then the admin can turn it on or off, which goes to all the instances of a
+// cluster and counts instead of MAINTENANCE from then on.
+
+var ErrMaintenance = errors.New("payments are paused for maintenance, try again later")
+
+type MaintenanceState struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+}
+
+var (
+	maintenanceMutex sync.RWMutex
+	configured       MaintenanceState
+	toggled          *MaintenanceState // nil until the admin chooses
+)
+
+func init() {
+	cluster.Subscribe("maintenance", func(data json.RawMessage) {
+		var state MaintenanceState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return
+		}
+		maintenanceMutex.Lock()
+		toggled = &state
+		maintenanceMutex.Unlock()
+	})
+}
+
+// ConfigureMaintenance sets the state given by the settings.
+func ConfigureMaintenance(enabled bool, message string) {
+	maintenanceMutex.Lock()
+	defer maintenanceMutex.Unlock()
+	configured = MaintenanceState{enabled, message}
+}
+
+// ToggleMaintenance sets the state chosen by the admin, on all instances.
+func ToggleMaintenance(enabled bool, message string) {
+	cluster.Publish("maintenance", MaintenanceState{enabled, message})
+}
+
+// Maintenance returns the state in effect.
+func Maintenance() MaintenanceState {
+	maintenanceMutex.RLock()
+	defer maintenanceMutex.RUnlock()
+	if toggled != nil {
+		return *toggled
+	}
+	return configured
+}
+
+func checkMaintenance() error {
+	state := Maintenance()
+	if !state.Enabled {
+		return nil
+	}
+	if state.Message != "" {
+		return fmt.Errorf("%w: %s", ErrMaintenance, state.Message)
+	}
+	return ErrMaintenance
+}
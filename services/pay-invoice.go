@@ -1,17 +1,22 @@
 package services
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
 	decodepay "github.com/nbd-wtf/ln-decodepay"
 	"github.com/lnbits/infinity/events"
+	"github.com/lnbits/infinity/ledger"
 	"github.com/lnbits/infinity/lightning"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/storage"
+	"github.com/lnbits/infinity/tracing"
 	"github.com/lnbits/infinity/utils"
+	"github.com/lnbits/infinity/webhook"
 	rp "github.com/lnbits/relampago"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/gorm"
 )
 
@@ -21,15 +26,31 @@ type PayInvoiceParams struct {
 	Tag     string            `json:"tag"`
 	Extra   models.JSONObject `json:"extra"`
 	Webhook string            `json:"webhook"`
+	// WebhookFormat is how the webhook is sent, see the webhook package.
+	WebhookFormat string `json:"webhookFormat"`
 }
 
 func PayInvoiceFromApp(walletID string, params map[string]interface{}) (interface{}, error) {
 	var s PayInvoiceParams
 	mapToStruct(params, &s)
-	return PayInvoice(walletID, s)
+	return PayInvoice(context.Background(), walletID, s)
 }
 
-func PayInvoice(walletID string, params PayInvoiceParams) (payment models.Payment, err error) {
+func PayInvoice(ctx context.Context, walletID string, params PayInvoiceParams) (payment models.Payment, err error) {
+	if err := startPayment(); err != nil {
+		return payment, err
+	}
+	defer inflight.Done()
+
+	// a payment or invoice shouldn't be left half-done because the client left
+	ctx, span := tracing.Span(tracing.Detach(ctx), "services.PayInvoice", attribute.String("wallet", walletID))
+	defer func() { tracing.End(span, err) }()
+	db := storage.DB.WithContext(ctx)
+
+	if !webhook.Known(params.WebhookFormat) {
+		return payment, fmt.Errorf("unknown webhook format '%s'", params.WebhookFormat)
+	}
+
 	// parse invoice
 	inv, err := decodepay.Decodepay(params.Invoice)
 	if err != nil {
@@ -53,28 +74,33 @@ func PayInvoice(walletID string, params PayInvoiceParams) (payment models.Paymen
 	// add payment to database first
 	temp := "tmp_" + utils.RandomHex(16)
 	payment = models.Payment{
-		CheckingID:  temp,
-		Pending:     true,
-		Amount:      -invoiceAmount,
-		Hash:        inv.PaymentHash,
-		Bolt11:      params.Invoice,
-		Tag:         params.Tag,
-		Extra:       params.Extra,
-		Webhook:     params.Webhook,
-		WalletID:    walletID,
-		Description: inv.Description,
-		Fee:         invoiceAmount / 100,
+		CheckingID:    temp,
+		Pending:       true,
+		Amount:        -invoiceAmount,
+		Hash:          inv.PaymentHash,
+		Bolt11:        params.Invoice,
+		Tag:           params.Tag,
+		Extra:         params.Extra,
+		Webhook:       params.Webhook,
+		WebhookFormat: params.WebhookFormat,
+		WalletID:      walletID,
+		Description:   inv.Description,
+		Fee:           invoiceAmount / 100,
 	}
-	if result := storage.DB.Create(&payment); result.Error != nil {
-		return payment, fmt.Errorf("failed to save temp payment: %w", result.Error)
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&payment).Error; err != nil {
+			return err
+		}
+		return ledger.RecordOutgoing(tx, payment)
+	}); err != nil {
+		return payment, fmt.Errorf("failed to save temp payment: %w", err)
 	}
 
 	defer func() {
 		if err != nil {
-			result := storage.DB.Where("checking_id", temp).Delete(&payment)
-			if result.Error != nil {
+			if _, ferr := ledger.FailOutgoing(temp); ferr != nil {
 				panic("failed to delete temp payment " + payment.CheckingID + ": " +
-					result.Error.Error())
+					ferr.Error())
 			}
 		}
 	}()
@@ -88,7 +114,7 @@ func PayInvoice(walletID string, params PayInvoiceParams) (payment models.Paymen
 
 	// check if this is an internal payment
 	var internal models.Payment
-	result := storage.DB.
+	result := db.
 		Where("hash = ?", payment.Hash).
 		Where("amount > 0").
 		Where("pending"). // search for a pending incoming payment with this same hash
@@ -100,16 +126,15 @@ func PayInvoice(walletID string, params PayInvoiceParams) (payment models.Paymen
 		// if internal, settle it
 		newSenderCheckingID := strings.Replace(payment.CheckingID, "tmp_", "int_", 1)
 
+		inflight.Add(1)
 		go func() {
+			defer inflight.Done()
 			err := storage.DB.Transaction(func(tx *gorm.DB) error {
-				result := tx.Model(&models.Payment{}).
-					Where("checking_id", internal.CheckingID).
-					Update("pending", false)
-				if result.Error != nil {
-					return result.Error
+				if err := ledger.SettleInternal(tx, internal); err != nil {
+					return err
 				}
 
-				result = tx.Model(&models.Payment{}).
+				result := tx.Model(&models.Payment{}).
 					Where("checking_id", payment.CheckingID).
 					Updates(map[string]interface{}{
 						"checking_id": newSenderCheckingID,
@@ -122,7 +147,7 @@ func PayInvoice(walletID string, params PayInvoiceParams) (payment models.Paymen
 				return nil
 			})
 			if err != nil {
-				log.Error().Err(err).Str("receiving", internal.CheckingID).
+				zerolog.Ctx(ctx).Error().Err(err).Str("receiving", internal.CheckingID).
 					Str("paying", payment.CheckingID).
 					Msg("failed to settle internal payment")
 				return
@@ -139,13 +164,16 @@ func PayInvoice(walletID string, params PayInvoiceParams) (payment models.Paymen
 	}
 
 	// actually perform the payment
+	_, lnspan := tracing.Span(ctx, "lightning.MakePayment",
+		attribute.String("hash", payment.Hash), attribute.Int64("msat", invoiceAmount))
 	data, err := lightning.LN.MakePayment(params.PaymentParams)
+	tracing.End(lnspan, err)
 	if err != nil {
 		return payment, fmt.Errorf("failed to pay: %w", err)
 	}
 
 	// update checking_id
-	result = storage.DB.
+	result = db.
 		Model(&models.Payment{}).
 		Where("checking_id", temp).
 		Update("checking_id", data.CheckingID)
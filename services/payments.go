@@ -20,3 +20,17 @@ func LoadWalletPayments(walletID string) ([]models.Payment, error) {
 
 	return payments, result.Error
 }
+
+// ListWalletPayments returns up to limit payments, newest first, starting after
+// the given cursor (or from the latest if it's empty). next is the cursor for the
+// following page, empty if there are no more payments. if search is given only
+// payments with a description or tag matching it are returned.
+func ListWalletPayments(walletID string, limit int, cursor string, search string) (
+	payments []models.Payment, next string, err error,
+) {
+	return storage.Default.ListPayments(walletID, storage.PaymentsQuery{
+		Limit:  limit,
+		Cursor: cursor,
+		Search: search,
+	})
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+	"gorm.io/gorm"
+)
+
+// settled payments older than the retention period are removed and replaced by
+// a single checkpoint payment per wallet with their total, so balances stay the
+// same. pending payments are never touched.
+
+const CheckpointTag = "checkpoint"
+
+// PrunePayments removes the settled payments created before the cutoff. if
+// archive is given they are written to it as gzipped JSON lines first. it
+// returns the number of payments removed.
+func PrunePayments(cutoff time.Time, archive io.Writer) (int, error) {
+	var walletIDs []string
+	if err := storage.DB.Model(&models.Payment{}).
+		Where("NOT pending AND created_at < ? AND (tag IS NULL OR tag != ?)",
+			cutoff, CheckpointTag).
+		Distinct("wallet_id").
+		Pluck("wallet_id", &walletIDs).Error; err != nil {
+		return 0, err
+	}
+
+	var enc *json.Encoder
+	if archive != nil {
+		gz := gzip.NewWriter(archive)
+		defer gz.Close()
+		enc = json.NewEncoder(gz)
+	}
+
+	total := 0
+	for _, walletID := range walletIDs {
+		err := storage.DB.Transaction(func(tx *gorm.DB) error {
+			old := tx.Model(&models.Payment{}).
+				Where("wallet_id = ? AND NOT pending AND created_at < ?", walletID, cutoff)
+
+			var payments []models.Payment
+			if err := old.Session(&gorm.Session{}).Find(&payments).Error; err != nil {
+				return err
+			}
+
+			var sum int64
+			for _, payment := range payments {
+				sum += payment.Amount
+				if enc != nil {
+					if err := enc.Encode(payment); err != nil {
+						return fmt.Errorf("failed to archive payment: %w", err)
+					}
+				}
+			}
+
+			if err := old.Session(&gorm.Session{}).Delete(&models.Payment{}).Error; err != nil {
+				return err
+			}
+
+			// just before the cutoff so it is included in the next prune
+			checkpointDate := cutoff.Add(-time.Second)
+			if err := tx.Create(&models.Payment{
+				CreatedAt:   checkpointDate,
+				CheckingID:  fmt.Sprintf("%s_%s_%d", CheckpointTag, walletID, cutoff.Unix()),
+				Pending:     false,
+				Amount:      sum,
+				Description: "balance of payments before " + cutoff.Format("2006-01-02"),
+				Hash:        CheckpointTag,
+				Tag:         CheckpointTag,
+				WalletID:    walletID,
+			}).Error; err != nil {
+				return err
+			}
+
+			total += len(payments)
+			return nil
+		})
+		if err != nil {
+			return total, fmt.Errorf("failed to prune payments for wallet %s: %w", walletID, err)
+		}
+	}
+
+	return total, nil
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// payments being made are tracked so the server can wait for them to reach the
+// lightning backend before exiting. once it starts shutting down no new ones are
+// accepted.
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+var (
+	inflightMutex sync.Mutex
+	inflight      sync.WaitGroup
+	draining      bool
+)
+
+func startPayment() error {
+	inflightMutex.Lock()
+	defer inflightMutex.Unlock()
+
+	if draining {
+		return ErrShuttingDown
+	}
+	if err := checkMaintenance(); err != nil {
+		return err
+	}
+	inflight.Add(1)
+	return nil
+}
+
+// Drain stops accepting payments and waits for the ones in flight to finish or
+// for ctx to be done.
+func Drain(ctx context.Context) error {
+	inflightMutex.Lock()
+	draining = true
+	inflightMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,10 +1,17 @@
 package services
 
 import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/lnbits/infinity/ledger"
 	"github.com/lnbits/infinity/models"
 	"github.com/lnbits/infinity/storage"
 	"github.com/lnbits/infinity/utils"
 	"github.com/lucsky/cuid"
+	"gorm.io/gorm"
 )
 
 func CreateUser() (*models.User, error) {
@@ -12,9 +19,9 @@ func CreateUser() (*models.User, error) {
 	user.ID = cuid.Slug()
 	user.Apps = make(models.StringList, 0)
 	masterKey := utils.RandomHex(32)
-	user.MasterKey = masterKey
-	result := storage.DB.Create(&user)
-	return &user, result.Error
+	user.MasterKey = models.EncryptedString(masterKey)
+	err := storage.Default.CreateUser(&user)
+	return &user, err
 }
 
 func CreateWallet(userID string, name string) (*models.Wallet, error) {
@@ -22,9 +29,156 @@ func CreateWallet(userID string, name string) (*models.Wallet, error) {
 		ID:         cuid.Slug(),
 		Name:       name,
 		UserID:     userID,
-		InvoiceKey: utils.RandomHex(32),
-		AdminKey:   utils.RandomHex(32),
+		InvoiceKey: models.EncryptedString(utils.RandomHex(32)),
+		AdminKey:   models.EncryptedString(utils.RandomHex(32)),
+	}
+	err := storage.Default.CreateWallet(&wallet)
+	return &wallet, err
+}
+
+// deleted users and wallets are only marked as deleted, they can be restored
+// until they are purged after the retention period, which can change on reload.
+
+var deletedRetention = int64(time.Hour * 24 * 30)
+
+func SetDeletedRetention(retention time.Duration) {
+	atomic.StoreInt64(&deletedRetention, int64(retention))
+}
+
+var ErrOwnerDeleted = errors.New("the user that owns this wallet is deleted, restore the user")
+
+func DeleteWallet(walletID string) error {
+	return storage.DB.Delete(&models.Wallet{}, "id = ?", walletID).Error
+}
+
+// DeleteUser deletes the user and all its wallets at the same time, so they can
+// be restored together.
+func DeleteUser(userID string) error {
+	now := time.Now()
+	return storage.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Wallet{}).Where("user_id = ?", userID).
+			Update("deleted_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ?", userID).
+			Update("deleted_at", now).Error
+	})
+}
+
+func RestoreWallet(walletID string) error {
+	var wallet models.Wallet
+	if err := storage.DB.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", walletID).
+		First(&wallet).Error; err != nil {
+		return err
+	}
+
+	var owners int64
+	storage.DB.Model(&models.User{}).Where("id = ?", wallet.UserID).Count(&owners)
+	if owners == 0 {
+		return ErrOwnerDeleted
 	}
-	result := storage.DB.Create(&wallet)
-	return &wallet, result.Error
+
+	return storage.DB.Unscoped().Model(&wallet).Update("deleted_at", nil).Error
+}
+
+// RestoreUser restores the user and the wallets that were deleted with it.
+func RestoreUser(userID string) error {
+	var user models.User
+	if err := storage.DB.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", userID).
+		First(&user).Error; err != nil {
+		return err
+	}
+
+	return storage.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&models.Wallet{}).
+			Where("user_id = ? AND deleted_at = ?", userID, user.DeletedAt).
+			Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Model(&user).Update("deleted_at", nil).Error
+	})
+}
+
+// PurgeDeleted permanently removes the users and wallets deleted before the
+// retention period, with their payments and app data. whatever was left in a
+// wallet goes to the equity:forfeited ledger account. it returns the number of
+// wallets purged.
+func PurgeDeleted() (int, error) {
+	cutoff := time.Now().Add(-time.Duration(atomic.LoadInt64(&deletedRetention)))
+
+	var walletIDs []string
+	if err := storage.DB.Unscoped().Model(&models.Wallet{}).
+		Where("deleted_at < ?", cutoff).
+		Pluck("id", &walletIDs).Error; err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, walletID := range walletIDs {
+		err := storage.DB.Transaction(func(tx *gorm.DB) error {
+			var balance int64
+			if err := tx.Model(&models.LedgerEntry{}).
+				Select("coalesce(sum(amount), 0)").
+				Where("account = ? AND wallet_id = ?", ledger.AccountWallet, walletID).
+				Scan(&balance).Error; err != nil {
+				return err
+			}
+			if err := ledger.Post(tx, ledger.KindPurge, "",
+				ledger.Wallet(walletID, -balance),
+				ledger.Account(ledger.AccountForfeited, balance),
+			); err != nil {
+				return err
+			}
+
+			for _, model := range []interface{}{
+				&models.Payment{},
+				&models.BalanceCheck{},
+				&models.BalanceSnapshot{},
+				&models.NWCConnection{},
+				&models.TelegramChat{},
+				&models.PushSubscription{},
+				&models.ValueSplit{},
+				&models.SplitPayment{},
+				&models.AppSecret{},
+				&models.AppWithdraw{},
+			} {
+				if err := tx.Where("wallet_id = ?", walletID).Delete(model).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Scopes(storage.AppItems(walletID)).
+				Where("wallet_id = ?", walletID).Delete(&models.AppDataItem{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Scopes(storage.AppItemTerms(walletID)).
+				Where("wallet_id = ?", walletID).Delete(&models.AppItemTerm{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(&models.Wallet{}, "id = ?", walletID).Error
+		})
+		if err != nil {
+			return purged, fmt.Errorf("failed to purge wallet %s: %w", walletID, err)
+		}
+		purged++
+	}
+
+	// users can only be purged when all their wallets are gone
+	err := storage.DB.Unscoped().
+		Where("deleted_at < ?", cutoff).
+		Where("id NOT IN (?)", storage.DB.Unscoped().Model(&models.Wallet{}).Select("user_id")).
+		Delete(&models.User{}).Error
+	for _, model := range []interface{}{
+		&models.UserApp{},
+		&models.UserPreferences{},
+		&models.UserNotifications{},
+	} {
+		if err != nil {
+			break
+		}
+		err = storage.DB.
+			Where("user_id NOT IN (?)", storage.DB.Unscoped().Model(&models.User{}).Select("id")).
+			Delete(model).Error
+	}
+
+	return purged, err
 }
@@ -0,0 +1,249 @@
+package splits
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/go-lnurl"
+	"github.com/lnbits/infinity/events"
+	"github.com/lnbits/infinity/jobs"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/storage"
+	rp "github.com/lnbits/relampago"
+	"github.com/lucsky/cuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// value splits, as in podcasting 2.0: a wallet may have a list of lightning
+// addresses that get a percentage of every payment it receives. the shares are
+// paid by a job, one per received payment, and each is remembered as a
+// SplitPayment so retries don't pay anyone twice.
+//
+// the boosts themselves, keysend payments with the podcast metadata in TLV
+// records, can't be received since none of the lightning backends can be given
+// keysend payments, so splits are applied to invoices.
+
+// MaxSplits is how many splits a wallet may have.
+var MaxSplits = 20
+
+// PaymentTimeout is how long a share is waited for before the next one is paid.
+var PaymentTimeout = time.Second * 45
+
+// Tag is set on the payments that forward a share.
+const Tag = "split"
+
+var log zerolog.Logger
+
+func SetLogger(logger zerolog.Logger) {
+	log = logger.With().Str("s", "splits").Logger()
+}
+
+func init() {
+	go func() {
+		c := make(chan models.Payment)
+		events.OnPaymentReceived(c)
+		for payment := range c {
+			enqueue(payment)
+		}
+	}()
+
+	jobs.Register("value_split", forward)
+}
+
+func List(walletID string) ([]models.ValueSplit, error) {
+	splits := make([]models.ValueSplit, 0)
+	err := storage.DB.Where("wallet_id = ?", walletID).Order("created_at").Order("id").
+		Find(&splits).Error
+	return splits, err
+}
+
+// Set replaces all the splits of a wallet. their percentages can't add up to
+// more than 100.
+func Set(walletID string, splits []models.ValueSplit) ([]models.ValueSplit, error) {
+	if len(splits) > MaxSplits {
+		return nil, fmt.Errorf("a wallet can't have more than %d splits", MaxSplits)
+	}
+
+	var total float64
+	now := time.Now()
+	for i := range splits {
+		split := &splits[i]
+		split.Address = strings.ToLower(strings.TrimSpace(split.Address))
+		if name, domain, ok := strings.Cut(split.Address, "@"); !ok || name == "" ||
+			!strings.Contains(domain, ".") {
+			return nil, fmt.Errorf("'%s' is not a lightning address", split.Address)
+		}
+		if len(split.Name) > 64 {
+			return nil, errors.New("split names can't have more than 64 characters")
+		}
+		if split.Percent <= 0 || split.Percent > 100 {
+			return nil, errors.New("percent must be more than 0 and at most 100")
+		}
+		total += split.Percent
+
+		split.ID = cuid.New()
+		split.WalletID = walletID
+		split.CreatedAt = now
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("percentages add up to %g, more than 100", total)
+	}
+
+	err := storage.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("wallet_id = ?", walletID).Delete(&models.ValueSplit{}).Error; err != nil {
+			return err
+		}
+		if len(splits) == 0 {
+			return nil
+		}
+		return tx.Create(&splits).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return splits, nil
+}
+
+// ListPayments gives the latest shares forwarded from the payments of a wallet.
+func ListPayments(walletID string, limit int) ([]models.SplitPayment, error) {
+	payments := make([]models.SplitPayment, 0)
+	err := storage.DB.Where("wallet_id = ?", walletID).Order("created_at desc").
+		Limit(limit).Find(&payments).Error
+	return payments, err
+}
+
+type splitJob struct {
+	WalletID   string `json:"wallet_id"`
+	CheckingID string `json:"checking_id"`
+}
+
+func enqueue(payment models.Payment) {
+	var count int64
+	if err := storage.DB.Model(&models.ValueSplit{}).
+		Where("wallet_id = ?", payment.WalletID).Count(&count).Error; err != nil {
+		log.Error().Err(err).Str("wallet", payment.WalletID).Msg("failed to load splits")
+		return
+	} else if count == 0 {
+		return
+	}
+
+	// a share paid to another wallet here is not split again, as wallets
+	// splitting to each other would pass the same sats around forever
+	var forwarded int64
+	storage.DB.Model(&models.Payment{}).
+		Where("hash = ? AND amount < 0 AND tag = ?", payment.Hash, Tag).
+		Count(&forwarded)
+	if forwarded > 0 {
+		return
+	}
+
+	jobs.EnqueueAt("value_split", splitJob{payment.WalletID, payment.CheckingID},
+		time.Now(), "value_split:"+payment.CheckingID)
+}
+
+// forward pays the shares of a payment that weren't paid yet. a share that
+// fails is released so the retry of the job tries it again, one that is still
+// pending after PaymentTimeout is left as forwarded.
+func forward(ctx context.Context, payload json.RawMessage) error {
+	var job splitJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	payment, err := storage.Default.GetPayment(job.WalletID, job.CheckingID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to load payment: %w", err)
+	}
+	splits, err := List(job.WalletID)
+	if err != nil {
+		return fmt.Errorf("failed to load splits: %w", err)
+	}
+
+	var failed []string
+	for _, split := range splits {
+		// whole sats, since many servers don't take millisatoshis
+		amount := int64(float64(payment.Amount)*split.Percent/100) / 1000 * 1000
+		if amount <= 0 {
+			continue
+		}
+
+		share := models.SplitPayment{
+			Source:   payment.CheckingID,
+			SplitID:  split.ID,
+			WalletID: job.WalletID,
+			Amount:   amount,
+		}
+		result := storage.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&share)
+		if result.Error != nil {
+			return fmt.Errorf("failed to save split payment: %w", result.Error)
+		} else if result.RowsAffected == 0 {
+			continue // already forwarded
+		}
+
+		hash, err := pay(ctx, job.WalletID, split, amount, payment)
+		if err != nil {
+			log.Warn().Err(err).Str("wallet", job.WalletID).Str("address", split.Address).
+				Int64("msat", amount).Msg("failed to forward split")
+			storage.DB.Delete(&share)
+			failed = append(failed, split.Address)
+			continue
+		}
+		storage.DB.Model(&share).Update("hash", hash)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to forward to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func pay(
+	ctx context.Context,
+	walletID string,
+	split models.ValueSplit,
+	amount int64,
+	source *models.Payment,
+) (string, error) {
+	_, params, err := lnurl.HandleLNURL(split.Address)
+	if err != nil {
+		return "", err
+	}
+	payParams, ok := params.(lnurl.LNURLPayParams)
+	if !ok {
+		return "", errors.New("address is not lnurl-pay")
+	}
+	if amount < payParams.MinSendable || amount > payParams.MaxSendable {
+		return "", fmt.Errorf("%d msat is out of the range the address takes", amount)
+	}
+
+	values, err := payParams.Call(amount, "", nil)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = services.PayInvoice(ctx, walletID, services.PayInvoiceParams{
+		PaymentParams: rp.PaymentParams{Invoice: values.PR},
+		Tag:           Tag,
+		Extra: models.JSONObject{
+			"split":   split.ID,
+			"address": split.Address,
+			"source":  source.CheckingID,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	hash := values.ParsedInvoice.PaymentHash
+	if _, err := services.WaitForPayment(walletID, hash, PaymentTimeout); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
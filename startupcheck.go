@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lnbits/infinity/ledger"
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/storage"
+)
+
+// on boot we make sure the lightning backend holds at least what the wallets
+// have, give or take STARTUP_CHECK_TOLERANCE, since anything above that is the
+// operator's. we also look for outgoing payments stuck pending for longer than
+// STARTUP_CHECK_PENDING_AGE, asking the backend about them first since they may
+// have finished while we were down. with STARTUP_CHECK=strict the server
+// refuses to start if something is wrong, with warn it only complains and with
+// off nothing is checked.
+
+func startupCheck(backendBalance int64) {
+	switch s.StartupCheck {
+	case "off":
+		return
+	case "warn", "strict":
+	default:
+		log.Fatal().Str("STARTUP_CHECK", s.StartupCheck).
+			Msg("invalid STARTUP_CHECK, must be off, warn or strict.")
+		return
+	}
+
+	var problems []string
+
+	owed, err := ledger.TotalWalletBalance()
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't get the total wallet balance for the startup check.")
+		return
+	}
+	tolerance := s.StartupCheckTolerance * 1000
+	if shortfall := owed - backendBalance; shortfall > tolerance {
+		log.Error().Int64("wallets", owed).Int64("backend", backendBalance).
+			Int64("shortfall", shortfall).
+			Msg("the lightning backend holds less than the wallets have")
+		problems = append(problems, fmt.Sprintf("backend is short %d msat", shortfall))
+	} else {
+		log.Info().Int64("wallets", owed).Int64("backend", backendBalance).
+			Msg("the lightning backend covers the wallet balances")
+	}
+
+	if s.StartupCheckPendingAge > 0 {
+		stuck, err := stuckPayments(time.Now().Add(-s.StartupCheckPendingAge))
+		if err != nil {
+			log.Fatal().Err(err).Msg("couldn't look for stuck payments for the startup check.")
+			return
+		}
+		for _, payment := range stuck {
+			log.Error().Str("id", payment.CheckingID).Str("wallet", payment.WalletID).
+				Int64("amount", payment.Amount).Time("created", payment.CreatedAt).
+				Msg("payment has been pending for too long")
+		}
+		if len(stuck) > 0 {
+			problems = append(problems, fmt.Sprintf("%d payments pending for more than %s",
+				len(stuck), s.StartupCheckPendingAge))
+		}
+	}
+
+	if len(problems) > 0 && s.StartupCheck == "strict" {
+		log.Fatal().Str("problems", strings.Join(problems, ", ")).
+			Msg("startup check failed, set STARTUP_CHECK=warn to start anyway.")
+	}
+}
+
+func stuckPayments(before time.Time) ([]models.Payment, error) {
+	var payments []models.Payment
+	if err := storage.DB.Where("pending AND amount < 0 AND created_at < ?", before).
+		Find(&payments).Error; err != nil {
+		return nil, err
+	}
+
+	stuck := payments[:0]
+	for _, payment := range payments {
+		checkPendingPayment(payment)
+
+		var current models.Payment
+		if err := storage.DB.Select("pending").
+			Where("checking_id = ?", payment.CheckingID).Limit(1).Find(&current).Error; err != nil {
+			return nil, err
+		}
+		if current.Pending {
+			stuck = append(stuck, payment)
+		}
+	}
+	return stuck, nil
+}
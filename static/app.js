@@ -2,8 +2,14 @@ const api = {}
 
 api._es = null
 
+// the /ext/<wallet>/<appid> part of the current url, wherever the server is mounted
+api._base = function () {
+  const match = location.pathname.match(/^(.*?\/ext\/[^/]+\/[^/]+)/)
+  return location.origin + (match ? match[1] : '')
+}
+
 api._openEventSource = function () {
-  const base = location.href.split('/').slice(0, 6).join('/')
+  const base = api._base()
   api._es = new EventSource(base + '/sse')
 }
 
@@ -38,7 +44,7 @@ api.off = function (eventName, cb) {
 }
 
 api.action = async (actionName, params) => {
-  const base = location.href.split('/').slice(0, 6).join('/')
+  const base = api._base()
 
   const r = await fetch(base + '/action/' + actionName, {
     method: 'POST',
@@ -109,8 +109,12 @@ function API({
     return appSettings
   }
 
-  api.listAppItems = async (appURL, model) =>
-    await request(`/api/wallet/app/${btoa(appURL)}/list/${model}`)
+  api.listAppItems = async (appURL, model, params = {}) =>
+    await request(
+      `/api/wallet/app/${btoa(appURL)}/list/${model}?${new URLSearchParams(
+        params
+      )}`
+    )
 
   api.getAppItem = async (appURL, model, key) =>
     await request(`/api/wallet/app/${btoa(appURL)}/set/${model}/${key}`)
@@ -0,0 +1,6 @@
+// the document is next to this page, wherever the server is mounted
+window.ui = SwaggerUIBundle({
+  url: location.pathname.replace(/\/docs\/?$/, '/openapi.json'),
+  dom_id: '#swagger-ui',
+  deepLinking: true
+})
@@ -4,11 +4,18 @@
 package main
 
 import (
+	"bytes"
 	"embed"
+	"encoding/json"
+	"html"
 	"io/fs"
 	"net/http"
+	"os"
+	"path"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/lnbits/infinity/api/apiutils"
 )
 
 //go:embed client/dist/spa
@@ -22,24 +29,77 @@ func serveStaticClient(router *mux.Router) {
 	router.PathPrefix("/static/").Handler(http.FileServer(http.FS(static)))
 
 	// serve static client
-	if clientFS, err := fs.Sub(client, "client/dist/spa"); err != nil {
+	clientFS, err := fs.Sub(client, "client/dist/spa")
+	if err != nil {
 		log.Fatal().Err(err).Msg("failed to load static files subdir")
 		return
-	} else {
-		spaFS := SpaFS{clientFS}
-		httpFS := http.FS(spaFS)
-		router.PathPrefix("/").Handler(http.FileServer(httpFS))
 	}
+	if s.StaticDir != "" {
+		if info, err := os.Stat(s.StaticDir); err != nil || !info.IsDir() {
+			log.Fatal().Err(err).Str("dir", s.StaticDir).Msg("LNBITS_STATIC_DIR is not a directory")
+			return
+		}
+		clientFS = overlayFS{os.DirFS(s.StaticDir), clientFS}
+		log.Info().Str("dir", s.StaticDir).Msg("serving client files from directory")
+	}
+	index, err := fs.ReadFile(clientFS, "index.html")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load client index.html")
+		return
+	}
+	index = injectBasePath(index, apiutils.BasePath)
+	index = injectBrandingCSS(index)
+
+	files := http.FileServer(http.FS(clientFS))
+	router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name != "" && name != "index.html" {
+			if info, err := fs.Stat(clientFS, name); err == nil && !info.IsDir() {
+				files.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		// every other path is a client route
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(index)
+	})
+}
+
+// overlayFS has the files of an operator's LNBITS_STATIC_DIR over the embedded
+// client, so a customized frontend only needs the files it changes.
+type overlayFS struct {
+	dir      fs.FS
+	embedded fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if f, err := o.dir.Open(name); err == nil {
+		return f, nil
+	}
+	return o.embedded.Open(name)
 }
 
-type SpaFS struct {
-	base fs.FS
+// injectBasePath tells the client where it is mounted, so relative asset urls
+// and its api calls, SSE streams and routes all go under BASE_URL.
+func injectBasePath(index []byte, basePath string) []byte {
+	value, _ := json.Marshal(basePath)
+	tags := []byte(`<base href="` + html.EscapeString(basePath) + `/"><script>window.BASE_URL = ` +
+		string(value) + `</script>`)
+
+	if i := bytes.Index(index, []byte("<head>")); i != -1 {
+		i += len("<head>")
+		return append(index[:i:i], append(tags, index[i:]...)...)
+	}
+	return append(tags, index...)
 }
 
-func (s SpaFS) Open(name string) (fs.File, error) {
-	if file, err := s.base.Open(name); err == nil {
-		return file, nil
-	} else {
-		return s.base.Open("index.html")
+// injectBrandingCSS loads the admin's custom CSS and themes after the client
+// stylesheets, so its rules win.
+func injectBrandingCSS(index []byte) []byte {
+	tag := []byte(`<link rel="stylesheet" href="branding/custom.css">`)
+	if i := bytes.Index(index, []byte("</head>")); i != -1 {
+		return append(index[:i:i], append(tag, index[i:]...)...)
 	}
+	return append(index, tag...)
 }
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// an archive is gzipped JSON lines: a header followed by one line for each row
+// of each table. values are stored decrypted so the archive can be imported on
+// an instance with a different master key or database engine, which also means
+// the archive must be kept as safe as the keys themselves.
+
+const archiveFormat = "lnbits-infinity-archive"
+
+type archiveHeader struct {
+	Format        string    `json:"format"`
+	SchemaVersion int       `json:"schema_version"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type archiveLine struct {
+	Table string                 `json:"table"`
+	Row   map[string]interface{} `json:"row"`
+}
+
+// in the order they must be imported
+var archiveTables = []interface{}{
+	&models.User{},
+	&models.Wallet{},
+	&models.UserApp{},
+	&models.UserPreferences{},
+	&models.UserNotifications{},
+	&models.Payment{},
+	&models.BalanceCheck{},
+	&models.NWCConnection{},
+	&models.TelegramChat{},
+	&models.PushSubscription{},
+	&models.CashuQuote{},
+	&models.CashuProof{},
+	&models.ValueSplit{},
+	&models.SplitPayment{},
+	&models.AppDataItem{},
+	&models.AppSchema{},
+	&models.AppItemTerm{},
+	&models.AppSecret{},
+	&models.AppWithdraw{},
+	&models.AuditEntry{},
+	&models.LedgerEntry{},
+	&models.BalanceSnapshot{},
+}
+
+func archiveSchemas() (map[string]*schema.Schema, []*schema.Schema, error) {
+	byTable := make(map[string]*schema.Schema)
+	ordered := make([]*schema.Schema, 0, len(archiveTables))
+	cache := &sync.Map{}
+	for _, model := range archiveTables {
+		sch, err := schema.Parse(model, cache, DB.NamingStrategy)
+		if err != nil {
+			return nil, nil, err
+		}
+		byTable[sch.Table] = sch
+		ordered = append(ordered, sch)
+	}
+	return byTable, ordered, nil
+}
+
+// Export writes all the data in the database to the archive. it returns the
+// number of rows written.
+func Export(w io.Writer) (int, error) {
+	version, err := SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	_, schemas, err := archiveSchemas()
+	if err != nil {
+		return 0, err
+	}
+	tenants, err := tenantSchemaNames()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list tenant schemas: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	if err := enc.Encode(archiveHeader{archiveFormat, version, time.Now()}); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, sch := range schemas {
+		// the rows of the tables kept for each user are also in their schemas,
+		// they are all archived as if they were in the shared table
+		tables := []string{sch.Table}
+		if isTenantTable(sch.Table) {
+			for _, tenant := range tenants {
+				tables = append(tables, tenant+"."+sch.Table)
+			}
+		}
+
+		for _, table := range tables {
+			n, err := exportTable(enc, sch, table)
+			count += n
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+
+	return count, gz.Close()
+}
+
+// exportTable writes the rows of table, which has the columns of sch.
+func exportTable(enc *json.Encoder, sch *schema.Schema, table string) (int, error) {
+	rows, err := DB.Table(table).Rows()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		item := reflect.New(sch.ModelType)
+		if err := DB.ScanRows(rows, item.Interface()); err != nil {
+			return count, fmt.Errorf("failed to read %s: %w", table, err)
+		}
+
+		row := make(map[string]interface{})
+		for _, field := range sch.Fields {
+			if field.DBName == "" || !field.Creatable {
+				continue
+			}
+			row[field.DBName], _ = field.ValueOf(item.Elem())
+		}
+
+		if secret, ok := item.Interface().(*models.AppSecret); ok &&
+			models.IsEncrypted(secret.Value) {
+			if row["value"], err = models.Decrypt(secret.Value, secret.AdditionalData()); err != nil {
+				return count, fmt.Errorf("failed to decrypt secret: %w", err)
+			}
+		}
+
+		if err := enc.Encode(archiveLine{sch.Table, row}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Import loads an archive into an empty database. it returns the number of
+// rows imported.
+func Import(r io.Reader) (int, error) {
+	var users int64
+	if err := DB.Unscoped().Model(&models.User{}).Count(&users).Error; err != nil {
+		return 0, err
+	}
+	if users > 0 {
+		return 0, errors.New("can only import into an empty database")
+	}
+
+	byTable, _, err := archiveSchemas()
+	if err != nil {
+		return 0, err
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("not a gzipped archive: %w", err)
+	}
+	dec := json.NewDecoder(bufio.NewReader(gz))
+
+	var header archiveHeader
+	if err := dec.Decode(&header); err != nil || header.Format != archiveFormat {
+		return 0, errors.New("not an infinity archive")
+	}
+	if header.SchemaVersion > latestMigration() {
+		return 0, fmt.Errorf("%w (archive is at %d, we only know up to %d)",
+			ErrDatabaseNewer, header.SchemaVersion, latestMigration())
+	}
+
+	count := 0
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		for {
+			var line archiveLine
+			if err := dec.Decode(&line); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("invalid archive line %d: %w", count+1, err)
+			}
+
+			sch, ok := byTable[line.Table]
+			if !ok {
+				return fmt.Errorf("unknown table '%s' on line %d", line.Table, count+1)
+			}
+
+			item := reflect.New(sch.ModelType)
+			for _, field := range sch.Fields {
+				value, ok := line.Row[field.DBName]
+				if field.DBName == "" || !field.Creatable || !ok {
+					continue
+				}
+				if err := setArchiveField(field, item.Elem(), value); err != nil {
+					return fmt.Errorf("invalid %s.%s on line %d: %w",
+						line.Table, field.DBName, count+1, err)
+				}
+			}
+
+			if secret, ok := item.Interface().(*models.AppSecret); ok &&
+				!models.IsEncrypted(secret.Value) && !isLegacySecret(secret.Value) {
+				if secret.Value, err = models.Encrypt(secret.Value, secret.AdditionalData()); err != nil {
+					return err
+				}
+			}
+
+			create := tx
+			if walletID, _ := line.Row["wallet_id"].(string); isTenantTable(line.Table) {
+				create = tx.Scopes(tenantScope(walletID, item.Interface()))
+			}
+			if err := create.Create(item.Interface()).Error; err != nil {
+				return fmt.Errorf("failed to insert into %s on line %d: %w",
+					line.Table, count+1, err)
+			}
+			count++
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func setArchiveField(field *schema.Field, target reflect.Value, value interface{}) error {
+	if s, ok := value.(string); ok && field.FieldType == reflect.TypeOf(time.Time{}) {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		return field.Set(target, t)
+	}
+
+	if _, ok := reflect.New(field.FieldType).Interface().(sql.Scanner); ok {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			// json columns are scanned from their string form
+			j, _ := json.Marshal(value)
+			value = string(j)
+		}
+	}
+
+	return field.Set(target, value)
+}
+
+// secrets written before the master key existed are kept as they are
+func isLegacySecret(value string) bool {
+	return len(value) > 3 && value[0:3] == "v1:"
+}
@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// backups are written to BackupDir and, if BackupS3 is set, uploaded to an
+// S3-compatible bucket instead of being kept locally. only the latest backups
+// are kept on the destination, as many as SetBackupKeep says (it can change
+// on reload).
+
+var (
+	BackupDir = "backups"
+	BackupS3  *S3Config
+
+	backupKeep int64 = 7
+)
+
+func SetBackupKeep(keep int) {
+	atomic.StoreInt64(&backupKeep, int64(keep))
+}
+
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.us-east-1.amazonaws.com
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+type Backup struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Location  string    `json:"location"`
+}
+
+const backupNamePrefix = "infinity-"
+
+var (
+	backupMutex      sync.Mutex
+	connectionString string
+)
+
+var ErrBackupRunning = errors.New("a backup is already running")
+
+// CreateBackup dumps the database, stores it and removes the old backups.
+func CreateBackup() (*Backup, error) {
+	if !backupMutex.TryLock() {
+		return nil, ErrBackupRunning
+	}
+	defer backupMutex.Unlock()
+
+	if err := os.MkdirAll(BackupDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create backup dir: %w", err)
+	}
+
+	var ext string
+	var dump func(path string) error
+	switch {
+	case strings.HasPrefix(connectionString, "postgres"):
+		ext = ".pgdump"
+		dump = dumpPostgres
+	case isSQLite(connectionString):
+		ext = ".sqlite"
+		dump = dumpSQLite
+	default:
+		return nil, fmt.Errorf("backups are not supported on %s", DB.Dialector.Name())
+	}
+
+	name := backupNamePrefix + time.Now().UTC().Format("20060102T150405Z") + ext
+	path := filepath.Join(BackupDir, name)
+	if err := dump(path); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to dump database: %w", err)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	backup := &Backup{
+		Name:      name,
+		Size:      stat.Size(),
+		CreatedAt: stat.ModTime(),
+		Location:  "local",
+	}
+
+	if BackupS3 != nil {
+		client, err := BackupS3.client()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := client.FPutObject(context.Background(),
+			BackupS3.Bucket, BackupS3.Prefix+name, path, minio.PutObjectOptions{
+				ContentType: "application/octet-stream",
+			}); err != nil {
+			return nil, fmt.Errorf("failed to upload backup (kept at %s): %w", path, err)
+		}
+		os.Remove(path)
+		backup.Location = "s3"
+	}
+
+	if err := pruneBackups(); err != nil {
+		return backup, fmt.Errorf("backup created but failed to remove old ones: %w", err)
+	}
+
+	return backup, nil
+}
+
+// an online backup that doesn't block writers for long
+func dumpSQLite(path string) error {
+	return DB.Exec("VACUUM INTO ?", path).Error
+}
+
+func dumpPostgres(path string) error {
+	cmd := exec.Command("pg_dump", "--format=custom", "--file="+path,
+		"--dbname="+connectionString)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pg_dump: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// RestoreBackup replaces the database with the given backup, which can be the
+// name of one of the backups on the destination or the path to a backup file.
+// it must be called with the server stopped. on sqlite the current database is
+// kept next to it with a .before-restore suffix.
+func RestoreBackup(databaseConnectionString string, name string) error {
+	path := name
+	if _, err := os.Stat(path); err != nil {
+		if BackupS3 != nil {
+			client, err := BackupS3.client()
+			if err != nil {
+				return err
+			}
+			tmp, err := os.CreateTemp("", backupNamePrefix+"restore-")
+			if err != nil {
+				return err
+			}
+			tmp.Close()
+			defer os.Remove(tmp.Name())
+			if err := client.FGetObject(context.Background(), BackupS3.Bucket,
+				BackupS3.Prefix+name, tmp.Name(), minio.GetObjectOptions{}); err != nil {
+				return fmt.Errorf("failed to download backup: %w", err)
+			}
+			path = tmp.Name()
+		} else {
+			path = filepath.Join(BackupDir, name)
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("backup not found: %w", err)
+	}
+
+	switch {
+	case strings.HasPrefix(databaseConnectionString, "postgres"):
+		cmd := exec.Command("pg_restore", "--clean", "--if-exists", "--no-owner",
+			"--dbname="+databaseConnectionString, path)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("pg_restore: %w: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	case isSQLite(databaseConnectionString):
+		return restoreSQLiteBackup(sqlitePath(databaseConnectionString), path)
+	default:
+		return errors.New("backups can only be restored on sqlite and postgres")
+	}
+}
+
+func restoreSQLiteBackup(dbPath, backupPath string) error {
+	suffix := ".before-restore-" + time.Now().UTC().Format("20060102T150405Z")
+	for _, ext := range []string{"", "-wal", "-shm"} {
+		if err := os.Rename(dbPath+ext, dbPath+ext+suffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to move current database away: %w", err)
+		}
+	}
+
+	backup, err := os.Open(backupPath)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	db, err := os.OpenFile(dbPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(db, backup); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// ListBackups returns the backups on the destination, newest first.
+func ListBackups() ([]Backup, error) {
+	var backups []Backup
+
+	if BackupS3 != nil {
+		client, err := BackupS3.client()
+		if err != nil {
+			return nil, err
+		}
+		for object := range client.ListObjects(context.Background(), BackupS3.Bucket,
+			minio.ListObjectsOptions{Prefix: BackupS3.Prefix + backupNamePrefix}) {
+			if object.Err != nil {
+				return nil, fmt.Errorf("failed to list backups: %w", object.Err)
+			}
+			backups = append(backups, Backup{
+				Name:      strings.TrimPrefix(object.Key, BackupS3.Prefix),
+				Size:      object.Size,
+				CreatedAt: object.LastModified,
+				Location:  "s3",
+			})
+		}
+	} else {
+		entries, err := os.ReadDir(BackupDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to list backups: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasPrefix(entry.Name(), backupNamePrefix) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			backups = append(backups, Backup{
+				Name:      entry.Name(),
+				Size:      info.Size(),
+				CreatedAt: info.ModTime(),
+				Location:  "local",
+			})
+		}
+	}
+
+	// names have the timestamp so they sort chronologically
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	return backups, nil
+}
+
+func pruneBackups() error {
+	keep := int(atomic.LoadInt64(&backupKeep))
+	if keep <= 0 {
+		return nil
+	}
+
+	backups, err := ListBackups()
+	if err != nil {
+		return err
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+
+	for _, backup := range backups[keep:] {
+		if backup.Location == "s3" {
+			client, err := BackupS3.client()
+			if err != nil {
+				return err
+			}
+			err = client.RemoveObject(context.Background(), BackupS3.Bucket,
+				BackupS3.Prefix+backup.Name, minio.RemoveObjectOptions{})
+			if err != nil {
+				return err
+			}
+		} else if err := os.Remove(filepath.Join(BackupDir, backup.Name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cfg S3Config) client() (*minio.Client, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint '%s'", cfg.Endpoint)
+	}
+
+	return minio.New(endpoint.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: endpoint.Scheme != "http",
+		Region: cfg.Region,
+	})
+}
@@ -1,9 +1,12 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
 	"strings"
+	"time"
 
-	"github.com/lnbits/infinity/models"
+	"github.com/rs/zerolog"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -11,7 +14,55 @@ import (
 
 var DB *gorm.DB
 
+var log zerolog.Logger
+
+func SetLogger(logger zerolog.Logger) {
+	log = logger
+}
+
+// connection pool settings, only used for postgres, cockroach and mysql since
+// sqlite has a single writer anyway.
+var (
+	MaxOpenConns    = 20
+	MaxIdleConns    = 5
+	ConnMaxLifetime = time.Minute * 30
+	ConnMaxIdleTime = time.Minute * 5
+)
+
+func isSQLite(databaseConnectionString string) bool {
+	return !strings.HasPrefix(databaseConnectionString, "postgres") &&
+		!strings.HasPrefix(databaseConnectionString, "cockroach") &&
+		!strings.HasPrefix(databaseConnectionString, "mysql")
+}
+
+// Connect opens the database and applies or checks the migrations.
 func Connect(databaseConnectionString string) error {
+	if err := Open(databaseConnectionString); err != nil {
+		return err
+	}
+
+	if AutoMigrate {
+		if _, err := Migrate(); err != nil {
+			return err
+		}
+	} else {
+		pending, err := PendingMigrations()
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("database has %d pending migrations, run `lnbits migrate`",
+				len(pending))
+		}
+	}
+
+	return nil
+}
+
+// Open only opens the database, without touching the schema.
+func Open(databaseConnectionString string) error {
+	connectionString = databaseConnectionString
+
 	var err error
 	opts := &gorm.Config{
 		SkipDefaultTransaction: true,
@@ -23,25 +74,60 @@ func Connect(databaseConnectionString string) error {
 	} else if strings.HasPrefix(databaseConnectionString, "cockroach") {
 		// cockroach
 		DB, err = gorm.Open(postgres.Open(databaseConnectionString), opts)
+	} else if strings.HasPrefix(databaseConnectionString, "mysql") {
+		// mysql or mariadb
+		DB, err = gorm.Open(openMySQL(databaseConnectionString), opts)
 	} else {
 		// sqlite
-		DB, err = gorm.Open(sqlite.Open(databaseConnectionString), opts)
+		if LitestreamReplica != "" {
+			if !strings.EqualFold(SQLiteJournalMode, "WAL") {
+				return errors.New("replication with litestream requires SQLITE_JOURNAL_MODE=WAL")
+			}
+			if err := restoreSQLite(sqlitePath(databaseConnectionString)); err != nil {
+				return err
+			}
+		}
+		DB, err = gorm.Open(sqlite.Open(sqliteDSN(databaseConnectionString)), opts)
 	}
 	if err != nil {
 		return err
 	}
-
-	// migration
-	if err := DB.AutoMigrate(
-		&models.User{},
-		&models.Wallet{},
-		&models.UserApp{},
-		&models.Payment{},
-		&models.BalanceCheck{},
-		&models.AppDataItem{},
-	); err != nil {
+	if err := checkTenantSchemas(); err != nil {
 		return err
 	}
 
+	if isSQLite(databaseConnectionString) && SQLiteCheckpointInterval > 0 &&
+		strings.EqualFold(SQLiteJournalMode, "WAL") {
+		go checkpointSQLite()
+	}
+
+	if !isSQLite(databaseConnectionString) {
+		sqlDB, err := DB.DB()
+		if err != nil {
+			return err
+		}
+		sqlDB.SetMaxOpenConns(MaxOpenConns)
+		sqlDB.SetMaxIdleConns(MaxIdleConns)
+		sqlDB.SetConnMaxLifetime(ConnMaxLifetime)
+		sqlDB.SetConnMaxIdleTime(ConnMaxIdleTime)
+
+		if err := sqlDB.Ping(); err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", DB.Dialector.Name(), err)
+		}
+
+		if PoolStatsInterval > 0 {
+			go monitorPool()
+		}
+	}
+
 	return nil
 }
+
+// Close closes the database, on sqlite this also checkpoints the WAL.
+func Close() error {
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"github.com/lnbits/infinity/models"
+	"gorm.io/gorm"
+)
+
+// ReencryptAll rewrites every encrypted column with the current master key,
+// which also encrypts the values stored before encryption existed.
+func ReencryptAll(tx *gorm.DB) (int, error) {
+	count := 0
+
+	// deleted users and wallets too, they may still be restored
+	var users []models.User
+	if err := tx.Unscoped().Find(&users).Error; err != nil {
+		return count, err
+	}
+	for _, user := range users {
+		if err := tx.Unscoped().Model(&models.User{}).Where("id = ?", user.ID).
+			Updates(map[string]interface{}{
+				"master_key":      user.MasterKey,
+				"master_key_hash": models.LookupHash(string(user.MasterKey)),
+			}).Error; err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	var wallets []models.Wallet
+	if err := tx.Unscoped().Find(&wallets).Error; err != nil {
+		return count, err
+	}
+	for _, wallet := range wallets {
+		if err := tx.Unscoped().Model(&models.Wallet{}).Where("id = ?", wallet.ID).
+			Updates(map[string]interface{}{
+				"invoice_key":      wallet.InvoiceKey,
+				"invoice_key_hash": models.LookupHash(string(wallet.InvoiceKey)),
+				"admin_key":        wallet.AdminKey,
+				"admin_key_hash":   models.LookupHash(string(wallet.AdminKey)),
+			}).Error; err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	// there can be a lot of payments, so go through them in batches
+	last := ""
+	for {
+		var payments []models.Payment
+		if err := tx.Select("checking_id", "preimage").
+			Where("checking_id > ? AND preimage != ''", last).
+			Order("checking_id").Limit(500).
+			Find(&payments).Error; err != nil {
+			return count, err
+		}
+		if len(payments) == 0 {
+			break
+		}
+		for _, payment := range payments {
+			if err := tx.Model(&models.Payment{}).
+				Where("checking_id = ?", payment.CheckingID).
+				Update("preimage", payment.Preimage).Error; err != nil {
+				return count, err
+			}
+			count++
+		}
+		last = payments[len(payments)-1].CheckingID
+	}
+
+	var secrets []models.AppSecret
+	if err := tx.Find(&secrets).Error; err != nil {
+		return count, err
+	}
+	for _, secret := range secrets {
+		if !models.IsEncrypted(secret.Value) {
+			// secrets from before the master key, read with the old scheme
+			continue
+		}
+		value, err := models.Decrypt(secret.Value, secret.AdditionalData())
+		if err != nil {
+			return count, err
+		}
+		if secret.Value, err = models.Encrypt(value, secret.AdditionalData()); err != nil {
+			return count, err
+		}
+		if err := tx.Model(&models.AppSecret{}).
+			Where(&models.AppSecret{App: secret.App, WalletID: secret.WalletID, Name: secret.Name}).
+			Update("value", secret.Value).Error; err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// sqlite databases can be continuously replicated to S3-compatible storage by
+// running litestream (https://litestream.io) as a subprocess. when the database
+// file doesn't exist on boot it is restored from the replica first.
+
+var (
+	LitestreamReplica string // e.g. s3://bucket/infinity.sqlite
+	LitestreamBinary  = "litestream"
+)
+
+func sqlitePath(databaseConnectionString string) string {
+	path := strings.TrimPrefix(databaseConnectionString, "file:")
+	if i := strings.Index(path, "?"); i != -1 {
+		path = path[0:i]
+	}
+	return path
+}
+
+func restoreSQLite(path string) error {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return nil
+	}
+
+	log.Info().Str("replica", LitestreamReplica).Str("path", path).
+		Msg("database file not found, restoring from replica")
+
+	cmd := exec.Command(LitestreamBinary, "restore",
+		"-if-replica-exists", "-o", path, LitestreamReplica)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("litestream restore: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// StartReplication starts litestream if a replica is configured. it is only
+// called when running the server, not for one-off commands.
+func StartReplication() {
+	if isSQLite(connectionString) && LitestreamReplica != "" {
+		go replicateSQLite(sqlitePath(connectionString))
+	}
+}
+
+var replication struct {
+	sync.Mutex
+	cmd      *exec.Cmd
+	stopping bool
+	stopped  chan struct{}
+}
+
+// StopReplication sends SIGTERM to litestream so it replicates what is left of
+// the WAL, and waits for it to exit.
+func StopReplication(ctx context.Context) error {
+	replication.Lock()
+	replication.stopping = true
+	cmd, stopped := replication.cmd, replication.stopped
+	replication.Unlock()
+
+	if cmd == nil {
+		return nil
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return ctx.Err()
+	}
+}
+
+// replicateSQLite keeps litestream running for as long as we are, restarting it
+// if it exits.
+func replicateSQLite(path string) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		cmd := exec.Command(LitestreamBinary, "replicate", path, LitestreamReplica)
+		stderr, _ := cmd.StderrPipe()
+		cmd.Stdout = cmd.Stderr
+
+		replication.Lock()
+		if replication.stopping {
+			replication.Unlock()
+			return
+		}
+		err := cmd.Start()
+		if err == nil {
+			replication.cmd = cmd
+			replication.stopped = make(chan struct{})
+		}
+		replication.Unlock()
+
+		if err == nil {
+			log.Info().Str("replica", LitestreamReplica).Msg("replicating database")
+			scanner := bufio.NewScanner(stderr)
+			for scanner.Scan() {
+				log.Debug().Str("process", "litestream").Msg(scanner.Text())
+			}
+			err = cmd.Wait()
+
+			replication.Lock()
+			replication.cmd = nil
+			close(replication.stopped)
+			stopping := replication.stopping
+			replication.Unlock()
+			if stopping {
+				log.Info().Msg("litestream stopped")
+				return
+			}
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		log.Error().Err(err).Dur("restarting-in", backoff).Msg("litestream stopped")
+		time.Sleep(backoff)
+		if backoff < time.Minute*5 {
+			backoff *= 2
+		}
+	}
+}
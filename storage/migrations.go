@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/utils"
+	"gorm.io/gorm"
+)
+
+// schema changes are applied by ordered migrations, each one recorded in the
+// schema_migrations table. new migrations must only ever be appended to this
+// list, never changed or reordered after being released.
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+var Migrations = []Migration{
+	{1, "initial schema", func(tx *gorm.DB) error {
+		// databases created before migrations existed already have these tables,
+		// automigrate just leaves them as they are.
+		return tx.AutoMigrate(
+			&models.User{},
+			&models.Wallet{},
+			&models.UserApp{},
+			&models.Payment{},
+			&models.BalanceCheck{},
+			&models.AppDataItem{},
+			&models.AppSchema{},
+			&models.AppItemTerm{},
+			&models.AppSecret{},
+		)
+	}},
+	{2, "encrypt sensitive columns", func(tx *gorm.DB) error {
+		if err := tx.AutoMigrate(&models.User{}, &models.Wallet{}); err != nil {
+			return err
+		}
+		_, err := ReencryptAll(tx)
+		return err
+	}},
+	{3, "add audit log", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.AuditEntry{})
+	}},
+	{4, "index payments for history and status queries", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.Payment{})
+	}},
+	{5, "add ledger with opening balances", func(tx *gorm.DB) error {
+		if err := tx.AutoMigrate(&models.LedgerEntry{}); err != nil {
+			return err
+		}
+
+		// wallet balances as they were computed before the ledger
+		var balances []struct {
+			WalletID string
+			Balance  int64
+		}
+		if err := tx.Raw(`
+          SELECT wallet_id, sum(amount) AS balance
+          FROM payments
+          WHERE (amount < 0 OR (amount > 0 AND NOT pending))
+          GROUP BY wallet_id
+        `).Scan(&balances).Error; err != nil {
+			return err
+		}
+
+		for _, b := range balances {
+			if b.Balance == 0 {
+				continue
+			}
+			txID := utils.RandomHex(16)
+			if err := tx.Create([]models.LedgerEntry{
+				{TxID: txID, Kind: "opening", Account: "wallet", WalletID: b.WalletID, Amount: b.Balance},
+				{TxID: txID, Kind: "opening", Account: "equity:opening", Amount: -b.Balance},
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{6, "soft delete users and wallets", func(tx *gorm.DB) error {
+		if err := tx.AutoMigrate(&models.User{}, &models.Wallet{}); err != nil {
+			return err
+		}
+
+		// wallets used to be deleted by prefixing their keys and user with "del:"
+		var wallets []models.Wallet
+		if err := tx.Where("user_id LIKE 'del:%'").Find(&wallets).Error; err != nil {
+			return err
+		}
+		for _, wallet := range wallets {
+			wallet.UserID = strings.TrimPrefix(wallet.UserID, "del:")
+			wallet.AdminKey = models.EncryptedString(
+				strings.TrimPrefix(string(wallet.AdminKey), "del:"))
+			wallet.InvoiceKey = models.EncryptedString(
+				strings.TrimPrefix(string(wallet.InvoiceKey), "del:"))
+			wallet.DeletedAt = gorm.DeletedAt{Time: wallet.UpdatedAt, Valid: true}
+			if err := tx.Save(&wallet).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{7, "full-text index on payment descriptions and tags", createPaymentSearchIndex},
+	{8, "daily balance snapshots", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.BalanceSnapshot{})
+	}},
+	{9, "background jobs", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.Job{})
+	}},
+	{10, "bans", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.Ban{})
+	}},
+	{11, "branding", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.BrandingAsset{}, &models.Theme{})
+	}},
+	{12, "user preferences", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.UserPreferences{})
+	}},
+	{13, "nostr wallet connect", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.NWCConnection{})
+	}},
+	{14, "cashu mint", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.CashuQuote{}, &models.CashuProof{})
+	}},
+	{15, "value splits", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.ValueSplit{}, &models.SplitPayment{})
+	}},
+	{16, "user notifications", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.UserNotifications{})
+	}},
+	{17, "telegram chats", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.TelegramChat{})
+	}},
+	{18, "nostr notifications", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.UserNotifications{})
+	}},
+	{19, "web push subscriptions", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.PushSubscription{})
+	}},
+	{20, "webhook formats", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.Payment{})
+	}},
+	{21, "app lnurl-withdraw k1s", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&models.AppWithdraw{})
+	}},
+	{22, "unique key hashes", func(tx *gorm.DB) error {
+		// the keys are looked up by these, so two users or wallets must never
+		// share one. the old indexes have the same names and automigrate would
+		// leave them as they were.
+		indexes := []struct {
+			model interface{}
+			field string
+		}{
+			{&models.User{}, "MasterKeyHash"},
+			{&models.Wallet{}, "InvoiceKeyHash"},
+			{&models.Wallet{}, "AdminKeyHash"},
+		}
+		for _, index := range indexes {
+			if tx.Migrator().HasIndex(index.model, index.field) {
+				if err := tx.Migrator().DropIndex(index.model, index.field); err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().CreateIndex(index.model, index.field); err != nil {
+				return fmt.Errorf("failed to make %s unique: %w", index.field, err)
+			}
+		}
+		return nil
+	}},
+}
+
+// AutoMigrate makes Connect apply pending migrations, otherwise it refuses to
+// start until they are applied with the migrate command.
+var AutoMigrate = true
+
+var ErrDatabaseNewer = errors.New("database schema is newer than this version of infinity")
+
+func latestMigration() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the last migration applied to the database.
+func SchemaVersion() (int, error) {
+	if err := DB.AutoMigrate(&models.SchemaMigration{}); err != nil {
+		return 0, fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	var version int
+	if err := DB.Model(&models.SchemaMigration{}).
+		Select("coalesce(max(version), 0)").
+		Scan(&version).Error; err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// PendingMigrations returns the migrations that weren't applied yet, or
+// ErrDatabaseNewer if the database was migrated by a newer release.
+func PendingMigrations() ([]Migration, error) {
+	version, err := SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > latestMigration() {
+		return nil, fmt.Errorf("%w (database is at %d, we only know up to %d)",
+			ErrDatabaseNewer, version, latestMigration())
+	}
+
+	var pending []Migration
+	for _, migration := range Migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies all pending migrations in order and returns the ones applied.
+func Migrate() ([]Migration, error) {
+	pending, err := PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, migration := range pending {
+		if err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&models.SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		}); err != nil {
+			return pending[0:i], fmt.Errorf("migration %d (%s) failed: %w",
+				migration.Version, migration.Name, err)
+		}
+	}
+
+	return pending, nil
+}
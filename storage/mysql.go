@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"strings"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/migrator"
+	"gorm.io/gorm/schema"
+)
+
+// mysql can't index text columns and limits an index to 3072 bytes, so string
+// columns that are part of a key get a varchar type small enough that even our
+// widest primary key (app_item_terms) fits with utf8mb4.
+type mysqlDialector struct {
+	mysql.Dialector
+}
+
+func openMySQL(databaseConnectionString string) gorm.Dialector {
+	dsn := strings.TrimPrefix(databaseConnectionString, "mysql://")
+	if !strings.Contains(dsn, "parseTime=") {
+		if strings.Contains(dsn, "?") {
+			dsn += "&parseTime=true"
+		} else {
+			dsn += "?parseTime=true"
+		}
+	}
+	if !strings.Contains(dsn, "charset=") {
+		dsn += "&charset=utf8mb4"
+	}
+
+	return mysqlDialector{*mysql.New(mysql.Config{DSN: dsn}).(*mysql.Dialector)}
+}
+
+func (dialector mysqlDialector) DataTypeOf(field *schema.Field) string {
+	if field.DataType == schema.String && field.Size == 0 && isKeyColumn(field) {
+		switch field.DBName {
+		case "id", "user_id", "wallet_id", "model":
+			return "varchar(64)"
+		default:
+			return "varchar(191)"
+		}
+	}
+	return dialector.Dialector.DataTypeOf(field)
+}
+
+func isKeyColumn(field *schema.Field) bool {
+	if field.PrimaryKey {
+		return true
+	}
+	for _, setting := range []string{"INDEX", "UNIQUE", "UNIQUEINDEX"} {
+		if _, ok := field.TagSettings[setting]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// the migrator has to be built around our dialector, otherwise it would use the
+// column types from the original one.
+func (dialector mysqlDialector) Migrator(db *gorm.DB) gorm.Migrator {
+	return mysql.Migrator{
+		Migrator: migrator.Migrator{
+			Config: migrator.Config{
+				DB:        db,
+				Dialector: dialector,
+			},
+		},
+		Dialector: dialector.Dialector,
+	}
+}
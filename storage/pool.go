@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PoolStatsInterval is how often the connection pool is checked for requests
+// that had to wait for a connection, which means MaxOpenConns is too low.
+var PoolStatsInterval = time.Minute
+
+type PoolStats struct {
+	Driver            string        `json:"driver"`
+	MaxOpenConns      int           `json:"max_open_conns"`
+	OpenConns         int           `json:"open_conns"`
+	InUse             int           `json:"in_use"`
+	Idle              int           `json:"idle"`
+	WaitCount         int64         `json:"wait_count"`
+	WaitDuration      time.Duration `json:"wait_duration"`
+	MaxIdleClosed     int64         `json:"max_idle_closed"`
+	MaxIdleTimeClosed int64         `json:"max_idle_time_closed"`
+	MaxLifetimeClosed int64         `json:"max_lifetime_closed"`
+}
+
+func poolStats() (sql.DBStats, error) {
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return sql.DBStats{}, err
+	}
+	return sqlDB.Stats(), nil
+}
+
+// Pool returns the current usage of the database connection pool.
+func Pool() (PoolStats, error) {
+	stats, err := poolStats()
+	if err != nil {
+		return PoolStats{}, err
+	}
+	return PoolStats{
+		Driver:            DB.Dialector.Name(),
+		MaxOpenConns:      stats.MaxOpenConnections,
+		OpenConns:         stats.OpenConnections,
+		InUse:             stats.InUse,
+		Idle:              stats.Idle,
+		WaitCount:         stats.WaitCount,
+		WaitDuration:      stats.WaitDuration,
+		MaxIdleClosed:     stats.MaxIdleClosed,
+		MaxIdleTimeClosed: stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed: stats.MaxLifetimeClosed,
+	}, nil
+}
+
+func monitorPool() {
+	var last sql.DBStats
+	for {
+		time.Sleep(PoolStatsInterval)
+
+		stats, err := poolStats()
+		if err != nil {
+			continue
+		}
+		if waited := stats.WaitCount - last.WaitCount; waited > 0 {
+			log.Warn().
+				Int64("waited", waited).
+				Dur("wait", stats.WaitDuration-last.WaitDuration).
+				Int("open", stats.OpenConnections).
+				Int("max", stats.MaxOpenConnections).
+				Msg("queries had to wait for a database connection, consider raising DATABASE_MAX_OPEN_CONNS")
+		}
+		last = stats
+	}
+}
+
+// Ping checks that the database can be reached.
+func Ping(ctx context.Context) error {
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
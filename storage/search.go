@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// payment descriptions and tags are indexed for full-text search with whatever
+// the database offers: an fts5 table kept up to date by triggers on sqlite (the
+// binary must be built with the sqlite_fts5 tag), a generated tsvector column on
+// postgres and a FULLTEXT index on mysql. cockroach, or sqlite without fts5,
+// fall back to LIKE.
+
+const sqliteSearchSchema = `
+CREATE TABLE payments_fts_rows (
+  id INTEGER PRIMARY KEY,
+  checking_id TEXT NOT NULL UNIQUE
+);
+CREATE VIRTUAL TABLE payments_fts USING fts5(description, tag);
+
+-- payments have no stable integer key, so fts rows are mapped to them here
+CREATE TRIGGER payments_fts_insert AFTER INSERT ON payments BEGIN
+  INSERT INTO payments_fts_rows (checking_id) VALUES (new.checking_id);
+  INSERT INTO payments_fts (rowid, description, tag)
+    VALUES (last_insert_rowid(), new.description, new.tag);
+END;
+CREATE TRIGGER payments_fts_update AFTER UPDATE OF description, tag ON payments BEGIN
+  UPDATE payments_fts SET description = new.description, tag = new.tag
+    WHERE rowid = (SELECT id FROM payments_fts_rows WHERE checking_id = new.checking_id);
+END;
+CREATE TRIGGER payments_fts_delete AFTER DELETE ON payments BEGIN
+  DELETE FROM payments_fts
+    WHERE rowid = (SELECT id FROM payments_fts_rows WHERE checking_id = old.checking_id);
+  DELETE FROM payments_fts_rows WHERE checking_id = old.checking_id;
+END;
+
+INSERT INTO payments_fts_rows (checking_id) SELECT checking_id FROM payments;
+INSERT INTO payments_fts (rowid, description, tag)
+  SELECT r.id, p.description, p.tag
+  FROM payments AS p INNER JOIN payments_fts_rows AS r ON r.checking_id = p.checking_id;
+`
+
+func createPaymentSearchIndex(tx *gorm.DB) error {
+	switch {
+	case isSQLite(connectionString):
+		var fts5 int
+		tx.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5)
+		if fts5 == 0 {
+			log.Warn().Msg("sqlite was built without fts5, payment search will be slow")
+			return nil
+		}
+		for _, stmt := range splitStatements(sqliteSearchSchema) {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasPrefix(connectionString, "postgres"):
+		if err := tx.Exec(`
+          ALTER TABLE payments ADD COLUMN search tsvector
+          GENERATED ALWAYS AS (to_tsvector('simple',
+            coalesce(description, '') || ' ' || coalesce(tag, ''))) STORED
+        `).Error; err != nil {
+			return err
+		}
+		return tx.Exec("CREATE INDEX idx_payments_search ON payments USING gin (search)").Error
+	case strings.HasPrefix(connectionString, "mysql"):
+		return tx.Exec("ALTER TABLE payments ADD FULLTEXT INDEX idx_payments_search (description, tag)").Error
+	}
+	return nil
+}
+
+// splitStatements splits sql on the semicolons that end statements, which for
+// triggers are the ones after END.
+func splitStatements(sql string) []string {
+	var stmts []string
+	var current strings.Builder
+	inTrigger := false
+	for _, line := range strings.Split(sql, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line + "\n")
+		if strings.HasPrefix(trimmed, "CREATE TRIGGER") {
+			inTrigger = true
+		}
+		if strings.HasSuffix(trimmed, ";") && (!inTrigger || trimmed == "END;") {
+			stmts = append(stmts, current.String())
+			current.Reset()
+			inTrigger = false
+		}
+	}
+	return stmts
+}
+
+func searchWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// SearchPayments restricts the query on payments to the ones whose description
+// or tag contain all the words in text, matching words by prefix.
+func SearchPayments(q *gorm.DB, text string) *gorm.DB {
+	words := searchWords(text)
+	if len(words) == 0 {
+		return q
+	}
+
+	switch {
+	case isSQLite(connectionString) && DB.Migrator().HasTable("payments_fts"):
+		terms := make([]string, len(words))
+		for i, word := range words {
+			terms[i] = `"` + word + `"*`
+		}
+		return q.Where(`checking_id IN (
+          SELECT r.checking_id FROM payments_fts AS f
+          INNER JOIN payments_fts_rows AS r ON r.id = f.rowid
+          WHERE payments_fts MATCH ?)`, strings.Join(terms, " "))
+	case strings.HasPrefix(connectionString, "postgres"):
+		terms := make([]string, len(words))
+		for i, word := range words {
+			terms[i] = strings.ToLower(word) + ":*"
+		}
+		return q.Where("search @@ to_tsquery('simple', ?)", strings.Join(terms, " & "))
+	case strings.HasPrefix(connectionString, "mysql"):
+		terms := make([]string, len(words))
+		for i, word := range words {
+			terms[i] = "+" + word + "*"
+		}
+		return q.Where("MATCH (description, tag) AGAINST (? IN BOOLEAN MODE)",
+			strings.Join(terms, " "))
+	}
+
+	for _, word := range words {
+		like := "%" + strings.ToLower(word) + "%"
+		q = q.Where("lower(description) LIKE ? OR lower(tag) LIKE ?", like, like)
+	}
+	return q
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// pragmas set on every sqlite connection. WAL lets readers (like the SSE streams)
+// keep going while someone writes, and the busy timeout makes writers wait for
+// each other instead of failing right away with "database is locked".
+var (
+	SQLiteJournalMode        = "WAL"
+	SQLiteBusyTimeout        = time.Second * 5
+	SQLiteSynchronous        = "NORMAL"
+	SQLiteCheckpointInterval = time.Minute * 5
+)
+
+func sqliteDSN(databaseConnectionString string) string {
+	params := []string{}
+	add := func(name, value string) {
+		if value != "" && !strings.Contains(databaseConnectionString, name+"=") {
+			params = append(params, name+"="+value)
+		}
+	}
+	add("_journal_mode", SQLiteJournalMode)
+	add("_busy_timeout", fmt.Sprint(SQLiteBusyTimeout.Milliseconds()))
+	add("_synchronous", SQLiteSynchronous)
+	if len(params) == 0 {
+		return databaseConnectionString
+	}
+
+	separator := "?"
+	if strings.Contains(databaseConnectionString, "?") {
+		separator = "&"
+	}
+	return databaseConnectionString + separator + strings.Join(params, "&")
+}
+
+// the WAL is only checkpointed automatically when no one is reading, which with
+// long-lived connections may not happen for a while, so it is done here.
+func checkpointSQLite() {
+	for {
+		time.Sleep(SQLiteCheckpointInterval)
+
+		if err := DB.Exec("PRAGMA wal_checkpoint(PASSIVE)").Error; err != nil {
+			log.Warn().Err(err).Msg("sqlite checkpoint failed")
+		}
+	}
+}
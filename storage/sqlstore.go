@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lnbits/infinity/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sqlStore is the Store backed by DB.
+type sqlStore struct{}
+
+func (sqlStore) CreateUser(user *models.User) error {
+	return DB.Create(user).Error
+}
+
+func (sqlStore) GetUserByMasterKey(masterKey string) (*models.User, error) {
+	var user models.User
+	if err := DB.Where("master_key_hash", models.LookupHash(masterKey)).
+		First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (sqlStore) ListUserWallets(userID string) ([]models.Wallet, error) {
+	var wallets []models.Wallet
+	err := DB.Raw(`
+      SELECT *,
+        (SELECT coalesce(sum(amount), 0) FROM ledger_entries AS l
+         WHERE l.account = 'wallet' AND l.wallet_id = w.id
+        ) AS balance FROM wallets AS w
+      WHERE w.user_id = ? AND w.deleted_at IS NULL
+    `, userID).Scan(&wallets).Error
+	return wallets, err
+}
+
+func (sqlStore) ListUserApps(userID string) ([]string, error) {
+	var urls []string
+	err := DB.Raw("SELECT url FROM user_apps WHERE user_id = ?", userID).
+		Scan(&urls).Error
+	return urls, err
+}
+
+func (sqlStore) AddUserApp(userApp *models.UserApp) error {
+	return DB.Create(userApp).Error
+}
+
+func (sqlStore) RemoveUserApp(userID, url string) error {
+	return DB.Where("url = ? AND user_id = ?", url, userID).
+		Delete(&models.UserApp{}).Error
+}
+
+func (sqlStore) GetUserPreferences(userID string) (*models.UserPreferences, error) {
+	preferences := models.UserPreferences{UserID: userID}
+	if err := DB.Where("user_id = ?", userID).Limit(1).Find(&preferences).Error; err != nil {
+		return nil, err
+	}
+	return &preferences, nil
+}
+
+func (sqlStore) SetUserPreferences(preferences *models.UserPreferences) error {
+	return DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(preferences).Error
+}
+
+func (sqlStore) GetUserNotifications(userID string) (*models.UserNotifications, error) {
+	notifications := models.UserNotifications{UserID: userID}
+	if err := DB.Where("user_id = ?", userID).Limit(1).Find(&notifications).Error; err != nil {
+		return nil, err
+	}
+	return &notifications, nil
+}
+
+func (sqlStore) SetUserNotifications(notifications *models.UserNotifications) error {
+	return DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(notifications).Error
+}
+
+func (sqlStore) CreateWallet(wallet *models.Wallet) error {
+	return DB.Create(wallet).Error
+}
+
+func (sqlStore) GetWalletByKey(key string) (*models.Wallet, error) {
+	var wallet models.Wallet
+	hash := models.LookupHash(key)
+	if err := DB.Where("admin_key_hash", hash).Or("invoice_key_hash", hash).
+		First(&wallet).Error; err != nil {
+		return nil, err
+	}
+	return &wallet, nil
+}
+
+func (sqlStore) GetWalletByAdminKey(key string) (*models.Wallet, error) {
+	var wallet models.Wallet
+	if err := DB.Where("admin_key_hash", models.LookupHash(key)).
+		First(&wallet).Error; err != nil {
+		return nil, err
+	}
+	return &wallet, nil
+}
+
+func (sqlStore) GetWallet(walletID string) (*models.Wallet, error) {
+	var wallet models.Wallet
+	if err := DB.Where("id = ?", walletID).First(&wallet).Error; err != nil {
+		return nil, err
+	}
+	return &wallet, nil
+}
+
+func (sqlStore) RenameWallet(walletID, name string) error {
+	return DB.Model(&models.Wallet{}).Where("id = ?", walletID).
+		Update("name", name).Error
+}
+
+func (sqlStore) SetBalanceNotify(walletID, url string) error {
+	return DB.Model(&models.Wallet{}).Where("id = ?", walletID).
+		Update("balance_notify", url).Error
+}
+
+func (sqlStore) ListBalanceChecks(walletID string) ([]models.BalanceCheck, error) {
+	var checks []models.BalanceCheck
+	err := DB.Where("wallet_id = ?", walletID).Find(&checks).Error
+	return checks, err
+}
+
+func (sqlStore) GetPayment(walletID, hashOrCheckingID string) (*models.Payment, error) {
+	var payment models.Payment
+	if err := DB.
+		Where("wallet_id = ?", walletID).
+		Where("hash = ? OR checking_id = ?", hashOrCheckingID, hashOrCheckingID).
+		First(&payment).Error; err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// payments are paginated by (created_at, checking_id) so pages stay fast no matter
+// how deep they are and don't skip or repeat payments when new ones arrive.
+func paymentsCursor(payment models.Payment) string {
+	return strconv.FormatInt(payment.CreatedAt.UnixNano(), 10) + ":" + payment.CheckingID
+}
+
+func parsePaymentsCursor(cursor string) (time.Time, string, error) {
+	spl := strings.SplitN(cursor, ":", 2)
+	if len(spl) != 2 {
+		return time.Time{}, "", fmt.Errorf("invalid cursor '%s'", cursor)
+	}
+	nanos, err := strconv.ParseInt(spl[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid cursor '%s': %w", cursor, err)
+	}
+	return time.Unix(0, nanos), spl[1], nil
+}
+
+func (sqlStore) ListPayments(walletID string, query PaymentsQuery) (
+	payments []models.Payment, next string, err error,
+) {
+	q := SearchPayments(DB, query.Search).
+		Where("wallet_id = ?", walletID).
+		Order("created_at desc").
+		Order("checking_id desc").
+		Limit(query.Limit + 1)
+
+	if query.Offset > 0 {
+		q = q.Offset(query.Offset)
+	}
+	if query.Cursor != "" {
+		createdAt, checkingID, err := parsePaymentsCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Where("created_at < ? OR (created_at = ? AND checking_id < ?)",
+			createdAt, createdAt, checkingID)
+	}
+
+	if query.Pending != nil {
+		q = q.Where("pending = ?", *query.Pending)
+	}
+	switch query.Direction {
+	case "incoming":
+		q = q.Where("amount > 0")
+	case "outgoing":
+		q = q.Where("amount < 0")
+	case "":
+	default:
+		return nil, "", fmt.Errorf("invalid direction '%s'", query.Direction)
+	}
+	if query.Tag != "" {
+		q = q.Where("tag = ?", query.Tag)
+	}
+	if !query.Since.IsZero() {
+		q = q.Where("created_at >= ?", query.Since)
+	}
+	if !query.Until.IsZero() {
+		q = q.Where("created_at < ?", query.Until)
+	}
+
+	payments = make([]models.Payment, 0, query.Limit+1)
+	if err := q.Find(&payments).Error; err != nil {
+		return nil, "", err
+	}
+
+	if len(payments) > query.Limit {
+		payments = payments[0:query.Limit]
+		next = paymentsCursor(payments[query.Limit-1])
+	}
+
+	return payments, next, nil
+}
+
+func (sqlStore) SetWebhookStatus(checkingID string, status int) error {
+	return DB.Model(&models.Payment{}).Where("checking_id = ?", checkingID).
+		Update("webhook_status", status).Error
+}
+
+func (sqlStore) CreateNWCConnection(conn *models.NWCConnection) error {
+	return DB.Create(conn).Error
+}
+
+func (sqlStore) ListNWCConnections(walletID string) ([]models.NWCConnection, error) {
+	conns := make([]models.NWCConnection, 0)
+	err := DB.Where("wallet_id = ?", walletID).Order("created_at").Find(&conns).Error
+	return conns, err
+}
+
+func (sqlStore) GetNWCConnection(walletID, id string) (*models.NWCConnection, error) {
+	var conn models.NWCConnection
+	if err := DB.Where("wallet_id = ? AND id = ?", walletID, id).
+		First(&conn).Error; err != nil {
+		return nil, err
+	}
+	return &conn, nil
+}
+
+func (sqlStore) GetNWCConnectionByPubKey(walletID, pubKey string) (*models.NWCConnection, error) {
+	var conn models.NWCConnection
+	if err := DB.
+		Joins("JOIN wallets ON wallets.id = nwc_connections.wallet_id AND wallets.deleted_at IS NULL").
+		Where("nwc_connections.wallet_id = ? AND nwc_connections.pub_key = ?", walletID, pubKey).
+		First(&conn).Error; err != nil {
+		return nil, err
+	}
+	return &conn, nil
+}
+
+func (sqlStore) DeleteNWCConnection(walletID, id string) error {
+	result := DB.Where("wallet_id = ? AND id = ?", walletID, id).
+		Delete(&models.NWCConnection{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (sqlStore) SetNWCConnectionUsed(id string, at time.Time) error {
+	return DB.Model(&models.NWCConnection{}).Where("id = ?", id).
+		Update("last_used_at", &at).Error
+}
+
+// "key" is a reserved word on mysql, so it must be quoted by the dialect
+var keyColumn = clause.Column{Name: "key"}
+
+func (sqlStore) GetAppItem(wallet, app, model, key string) (*models.AppDataItem, error) {
+	item := models.AppDataItem{
+		WalletID: wallet,
+		App:      app,
+		Model:    model,
+		Key:      key,
+	}
+	if err := DB.Scopes(AppItems(wallet)).First(&item).Error; err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (sqlStore) ListAppItems(wallet, app, model string, query ItemsQuery) (
+	[]models.AppDataItem, error,
+) {
+	q := DB.Scopes(AppItems(wallet)).
+		Where(&models.AppDataItem{WalletID: wallet, App: app, Model: model})
+
+	if query.StartKey != "" {
+		q = q.Where("? > ?", keyColumn, query.StartKey)
+	}
+	if query.EndKey != "" {
+		q = q.Where("? < ?", keyColumn, query.EndKey)
+	}
+	if query.Prefix != "" {
+		q = q.Where("? LIKE ? ESCAPE '!'", keyColumn, escapeLike(query.Prefix)+"%")
+	}
+	if query.Cursor != "" {
+		if query.Descending {
+			q = q.Where("? < ?", keyColumn, query.Cursor)
+		} else {
+			q = q.Where("? > ?", keyColumn, query.Cursor)
+		}
+	}
+
+	sortBy := query.SortBy
+	if sortBy == "" {
+		sortBy = "key"
+	}
+	q = q.Order(clause.OrderByColumn{
+		Column: clause.Column{Name: sortBy},
+		Desc:   query.Descending,
+	})
+	if sortBy != "key" {
+		// stable ordering for items with the same timestamp
+		q = q.Order(clause.OrderByColumn{Column: keyColumn})
+	}
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+	if query.Offset > 0 {
+		q = q.Offset(query.Offset)
+	}
+
+	var items []models.AppDataItem
+	err := q.Find(&items).Error
+	return items, err
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+func (sqlStore) SetAppItem(item *models.AppDataItem) error {
+	return DB.Scopes(AppItems(item.WalletID)).Clauses(UpsertAppItemClause()).Create(item).Error
+}
+
+// UpsertAppItemClause replaces the value of an existing item and bumps its
+// revision.
+func UpsertAppItemClause() clause.OnConflict {
+	return clause.OnConflict{
+		Columns: []clause.Column{
+			{Name: "app"}, {Name: "wallet_id"}, {Name: "model"}, {Name: "key"},
+		},
+		DoUpdates: append(
+			clause.AssignmentColumns([]string{"value", "updated_at"}),
+			clause.Assignment{
+				Column: clause.Column{Name: "revision"},
+				Value:  gorm.Expr("app_data_items.revision + 1"),
+			},
+		),
+	}
+}
+
+func (sqlStore) DeleteAppItem(wallet, app, model, key string) error {
+	return DB.Scopes(AppItems(wallet)).Delete(&models.AppDataItem{}, models.AppDataItem{
+		WalletID: wallet,
+		App:      app,
+		Model:    model,
+		Key:      key,
+	}).Error
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/lnbits/infinity/models"
+)
+
+// Store has the lookups and writes of single users, wallets, payments, app items
+// and nwc connections that the handlers make. the default one is backed by the
+// SQL database opened with Connect, other backends can be used by setting
+// Default before starting the server. only what is listed here goes through
+// it: the ledger and everything that moves funds (creating, paying and settling
+// invoices, nwc budgets) depend on the transactions of the SQL database, and
+// reports, admin listings, exports, search, jobs and the tables of the other
+// features still use DB directly.
+type Store interface {
+	CreateUser(user *models.User) error
+	GetUserByMasterKey(masterKey string) (*models.User, error)
+	ListUserWallets(userID string) ([]models.Wallet, error)
+	ListUserApps(userID string) ([]string, error)
+	AddUserApp(userApp *models.UserApp) error
+	RemoveUserApp(userID, url string) error
+	// GetUserPreferences returns empty preferences if the user never set any.
+	GetUserPreferences(userID string) (*models.UserPreferences, error)
+	SetUserPreferences(preferences *models.UserPreferences) error
+	// GetUserNotifications returns all notifications off if the user never set
+	// any.
+	GetUserNotifications(userID string) (*models.UserNotifications, error)
+	SetUserNotifications(notifications *models.UserNotifications) error
+
+	CreateWallet(wallet *models.Wallet) error
+	// GetWalletByKey finds the wallet that has key as its admin or invoice key.
+	GetWalletByKey(key string) (*models.Wallet, error)
+	GetWalletByAdminKey(key string) (*models.Wallet, error)
+	GetWallet(walletID string) (*models.Wallet, error)
+	RenameWallet(walletID, name string) error
+	SetBalanceNotify(walletID, url string) error
+	ListBalanceChecks(walletID string) ([]models.BalanceCheck, error)
+
+	// GetPayment finds a payment by its hash or checking id.
+	GetPayment(walletID, hashOrCheckingID string) (*models.Payment, error)
+	// ListPayments returns the payments newest first and the cursor for the next
+	// page, empty if there are no more.
+	ListPayments(walletID string, query PaymentsQuery) ([]models.Payment, string, error)
+	SetWebhookStatus(checkingID string, status int) error
+
+	CreateNWCConnection(conn *models.NWCConnection) error
+	ListNWCConnections(walletID string) ([]models.NWCConnection, error)
+	GetNWCConnection(walletID, id string) (*models.NWCConnection, error)
+	// GetNWCConnectionByPubKey only finds connections of wallets that aren't
+	// deleted.
+	GetNWCConnectionByPubKey(walletID, pubKey string) (*models.NWCConnection, error)
+	// DeleteNWCConnection returns gorm.ErrRecordNotFound if there is none.
+	DeleteNWCConnection(walletID, id string) error
+	SetNWCConnectionUsed(id string, at time.Time) error
+
+	GetAppItem(wallet, app, model, key string) (*models.AppDataItem, error)
+	ListAppItems(wallet, app, model string, query ItemsQuery) ([]models.AppDataItem, error)
+	// SetAppItem creates or replaces an item, bumping its revision.
+	SetAppItem(item *models.AppDataItem) error
+	DeleteAppItem(wallet, app, model, key string) error
+}
+
+var Default Store = sqlStore{}
+
+type PaymentsQuery struct {
+	Limit  int
+	Cursor string
+	// Offset skips that many payments, for clients that don't use the cursor
+	Offset int
+	// words to look for in descriptions and tags
+	Search string
+
+	// filters, the zero values don't filter
+	Pending   *bool
+	Direction string // "incoming" or "outgoing"
+	Tag       string
+	Since     time.Time
+	Until     time.Time
+}
+
+// ItemsQuery selects app items by key range or prefix, paginated by key (with
+// Cursor) or by offset.
+type ItemsQuery struct {
+	StartKey   string
+	EndKey     string
+	Prefix     string
+	Cursor     string
+	Limit      int
+	Offset     int
+	SortBy     string // key, created_at or updated_at
+	Descending bool
+}
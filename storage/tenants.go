@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/lnbits/infinity/models"
+	"gorm.io/gorm"
+)
+
+// with TenantSchemas (TENANT_SCHEMAS=true, postgres only) the items apps keep
+// for each user and their search terms live in a schema of that user,
+// tenant_<user id>, instead of the shared tables. that is the data untrusted
+// app code writes and queries, so it is the only thing kept apart. users,
+// wallets, payments, the ledger, app secrets and the other tables stay shared
+// since internal payments, the ledger accounts of the node and the jobs of the
+// whole instance need them together.
+// the tables of a schema are created, or given the new columns, the first
+// time it is used after a start.
+
+var TenantSchemas bool
+
+// the tables that are kept in the schema of each user
+var tenantModels = []interface{}{
+	&models.AppDataItem{},
+	&models.AppItemTerm{},
+}
+
+var (
+	walletSchemas  sync.Map // wallet id -> schema of its user
+	createdSchemas sync.Map // schema -> struct{}
+)
+
+var plainUserID = regexp.MustCompile(`^[a-z0-9]{1,40}$`)
+
+func checkTenantSchemas() error {
+	if TenantSchemas && DB.Dialector.Name() != "postgres" {
+		return errors.New("TENANT_SCHEMAS needs a postgres database")
+	}
+	return nil
+}
+
+// AppItems makes a query run on the app items of a wallet, wherever they are.
+func AppItems(walletID string) func(*gorm.DB) *gorm.DB {
+	return tenantScope(walletID, &models.AppDataItem{})
+}
+
+// AppItemTerms is like AppItems, for the search terms of the items.
+func AppItemTerms(walletID string) func(*gorm.DB) *gorm.DB {
+	return tenantScope(walletID, &models.AppItemTerm{})
+}
+
+func tenantScope(walletID string, model interface{}) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if !TenantSchemas {
+			return db
+		}
+
+		// the wallet is looked up on the same connection, it may have been created
+		// by the transaction this query is part of
+		schema, err := walletSchema(db.Session(&gorm.Session{NewDB: true}), walletID)
+		if err != nil {
+			db.AddError(err)
+			return db
+		}
+		return db.Table(schema + "." + tableName(model))
+	}
+}
+
+func walletSchema(db *gorm.DB, walletID string) (string, error) {
+	if schema, ok := walletSchemas.Load(walletID); ok {
+		return schema.(string), nil
+	}
+
+	var wallet models.Wallet
+	if err := db.Unscoped().Select("user_id").
+		Where("id = ?", walletID).First(&wallet).Error; err != nil {
+		return "", fmt.Errorf("failed to find the user of wallet %s: %w", walletID, err)
+	}
+
+	schema := tenantSchema(wallet.UserID)
+	if err := createTenantSchema(schema); err != nil {
+		return "", err
+	}
+	walletSchemas.Store(walletID, schema)
+	return schema, nil
+}
+
+func tenantSchema(userID string) string {
+	if plainUserID.MatchString(userID) {
+		return "tenant_" + userID
+	}
+	// ids imported from elsewhere may not be valid names
+	hash := sha256.Sum256([]byte(userID))
+	return "tenant_" + hex.EncodeToString(hash[:16])
+}
+
+// createTenantSchema works outside of any transaction, so the schema stays even
+// if the transaction that first needed it fails.
+func createTenantSchema(schema string) error {
+	if _, ok := createdSchemas.Load(schema); ok {
+		return nil
+	}
+
+	if err := DB.Exec(`CREATE SCHEMA IF NOT EXISTS "` + schema + `"`).Error; err != nil {
+		return fmt.Errorf("failed to create schema %s: %w", schema, err)
+	}
+	for _, model := range tenantModels {
+		if err := DB.Table(schema + "." + tableName(model)).AutoMigrate(model); err != nil {
+			return fmt.Errorf("failed to migrate %s.%s: %w", schema, tableName(model), err)
+		}
+	}
+
+	createdSchemas.Store(schema, struct{}{})
+	return nil
+}
+
+// tenantSchemaNames returns the schemas of all the users that have one.
+func tenantSchemaNames() ([]string, error) {
+	if !TenantSchemas {
+		return nil, nil
+	}
+
+	var names []string
+	err := DB.Raw(`SELECT nspname FROM pg_namespace WHERE nspname LIKE 'tenant!_%' ESCAPE '!'`).
+		Scan(&names).Error
+	return names, err
+}
+
+func isTenantTable(table string) bool {
+	for _, model := range tenantModels {
+		if tableName(model) == table {
+			return true
+		}
+	}
+	return false
+}
+
+func tableName(model interface{}) string {
+	stmt := &gorm.Statement{DB: DB}
+	stmt.Parse(model)
+	return stmt.Table
+}
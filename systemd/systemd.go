@@ -0,0 +1,89 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// just enough of the systemd protocols for a Type=notify unit: telling the
+// service manager when we are ready, reloading or stopping, pinging its
+// watchdog, and taking the sockets it opened for us with socket activation.
+// everything here does nothing when we weren't started by systemd.
+
+// Notify sends a state like "READY=1" to the service manager.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Watchdog pings the service manager at half the interval it expects, if the
+// unit has WatchdogSec set. it keeps going until we exit, shutting down has
+// its own timeout.
+func Watchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+		Notify("WATCHDOG=1")
+	}
+}
+
+// the first passed file descriptor, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// Listeners returns the sockets passed by systemd, in the order of the
+// ListenStream= lines of the socket unit, or nil if there are none.
+func Listeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	// so they aren't passed again to processes we start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, n)
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d from systemd: %w", fd, err)
+		}
+		listeners[i] = listener
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/utils"
+)
+
+// the server itself has no write timeout, since that would cut SSE streams,
+// websockets and exports after a few seconds. instead each request gets a
+// deadline here depending on its route: streaming routes have none, the ones
+// that wait for payments or do heavy admin work get HTTP_LONG_TIMEOUT and all
+// the others HTTP_WRITE_TIMEOUT.
+var streamingRoutes = map[string]bool{
+	"/api/wallet/sse":                true,
+	"/api/wallet/app/sse":            true,
+	"/api/wallet/app/{appid}/export": true,
+	"/ext/{wallet}/{appid}/sse":      true,
+	"/ext/{wallet}/{appid}/ws":       true,
+	"/api/admin/logs/stream":         true,
+
+	// graphql subscriptions
+	"/api/graphql/ws": true,
+}
+
+var longRoutes = map[string]bool{
+	"/api/wallet/pay-invoice":                     true,
+	"/api/wallet/pay-lnurl":                       true,
+	"/lnurl/wallet/drain":                         true,
+	"/lnurlwallet":                                true,
+	"/ext/{wallet}/{appid}/lnurl/{name}/callback": true,
+	"/lndhub/ext/payinvoice":                      true,
+	"/api/wallet/app/{appid}/import":              true,
+	"/api/admin/backups/create":                   true,
+	"/api/admin/restore":                          true,
+	"/api/admin/ledger/check":                     true,
+	"/api/admin/debug/pprof/":                     true,
+
+	// btcpay greenfield
+	"/api/v1/stores/{storeId}/lightning/{cryptoCode}/invoices/pay": true,
+
+	// alby
+	"/alby/payments/bolt11": true,
+
+	// cashu
+	"/cashu/v1/melt/bolt11": true,
+}
+
+var timeoutMessage = func() string {
+	b, _ := utils.JSONMarshal(apiutils.JSONError{Ok: false, Message: "request timed out"})
+	return string(b)
+}()
+
+func timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := apiutils.RouteTemplate(r)
+		if streamingRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout := live().HTTPWriteTimeout
+		if longRoutes[route] {
+			timeout = live().HTTPLongTimeout
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		http.TimeoutHandler(next, timeout, timeoutMessage).ServeHTTP(w, r)
+	})
+}
+
+// serverTimeouts sets the connection-level timeouts on srv. only the headers
+// are read under HTTP_READ_TIMEOUT: a deadline for the whole request would also
+// cancel the streams, so reading the body counts against the route timeout.
+func serverTimeouts(srv *http.Server) *http.Server {
+	srv.ReadHeaderTimeout = s.HTTPReadTimeout
+	srv.IdleTimeout = s.HTTPIdleTimeout
+	return srv
+}
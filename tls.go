@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// https can be served with certificates from let's encrypt for TLS_DOMAINS, kept
+// in TLS_CACHE_DIR, or with a certificate and key given in TLS_CERT_FILE and
+// TLS_KEY_FILE. in both cases TLS_HTTP_PORT, if set, serves plain http
+// redirecting to https (and answering the ACME http-01 challenges).
+
+func tlsEnabled() bool {
+	return len(s.TLSDomains) > 0 || s.TLSCertFile != ""
+}
+
+// configureTLS sets the tls config on srv and returns the server for the http
+// port, if any.
+func configureTLS(srv *http.Server) (*http.Server, error) {
+	var challenges func(http.Handler) http.Handler
+	switch {
+	case len(s.TLSDomains) > 0 && s.TLSCertFile != "":
+		return nil, errors.New("set either TLS_DOMAINS or TLS_CERT_FILE, not both")
+	case len(s.TLSDomains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(s.TLSDomains...),
+			Cache:      autocert.DirCache(s.TLSCacheDir),
+			Email:      s.TLSEmail,
+		}
+		srv.TLSConfig = m.TLSConfig()
+		challenges = m.HTTPHandler
+	default:
+		if s.TLSKeyFile == "" {
+			return nil, errors.New("TLS_CERT_FILE is set but TLS_KEY_FILE isn't")
+		}
+		cert, err := tls.LoadX509KeyPair(s.TLSCertFile, s.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		challenges = func(fallback http.Handler) http.Handler { return fallback }
+	}
+	srv.TLSConfig.MinVersion = tls.VersionTLS12
+
+	if s.TLSHTTPPort == "" {
+		return nil, nil
+	}
+	return serverTimeouts(&http.Server{
+		Addr:         s.Host + ":" + s.TLSHTTPPort,
+		Handler:      challenges(http.HandlerFunc(redirectToHTTPS)),
+		WriteTimeout: s.HTTPWriteTimeout,
+	}), nil
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[0:i]
+	}
+	if s.Port != "443" {
+		host += ":" + s.Port
+	}
+
+	target := "https://" + host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
@@ -0,0 +1,106 @@
+package tor
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// just enough of the tor control protocol
+// (https://spec.torproject.org/control-spec) to authenticate and add an onion
+// service.
+
+type controlConn struct {
+	text *textproto.Conn
+}
+
+func dialControl(addr string) (*controlConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &controlConn{textproto.NewConn(conn)}, nil
+}
+
+// command sends a line and returns the reply lines without the status code.
+func (c *controlConn) command(format string, args ...interface{}) ([]string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 4 {
+			return nil, fmt.Errorf("invalid reply from tor: '%s'", line)
+		}
+		if line[0:3] != "250" {
+			return nil, fmt.Errorf("tor: %s", line[4:])
+		}
+		lines = append(lines, line[4:])
+		if line[3] == ' ' {
+			return lines, nil
+		}
+	}
+}
+
+// authenticate uses the password if one is given, otherwise whatever tor
+// accepts out of no authentication and the cookie file.
+func (c *controlConn) authenticate(password string) error {
+	if password != "" {
+		_, err := c.command("AUTHENTICATE %s", quote(password))
+		return err
+	}
+
+	lines, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	var methods, cookieFile string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		for _, field := range strings.Fields(line[5:]) {
+			if strings.HasPrefix(field, "METHODS=") {
+				methods = strings.TrimPrefix(field, "METHODS=")
+			}
+		}
+		if i := strings.Index(line, `COOKIEFILE="`); i != -1 {
+			cookieFile = line[i+12:]
+			cookieFile = cookieFile[0:strings.Index(cookieFile, `"`)]
+		}
+	}
+
+	for _, method := range strings.Split(methods, ",") {
+		switch method {
+		case "NULL":
+			_, err := c.command("AUTHENTICATE")
+			return err
+		case "COOKIE":
+			cookie, err := os.ReadFile(cookieFile)
+			if err != nil {
+				return fmt.Errorf("failed to read tor cookie: %w", err)
+			}
+			_, err = c.command("AUTHENTICATE %s", hex.EncodeToString(cookie))
+			return err
+		}
+	}
+
+	return fmt.Errorf("no supported authentication method among '%s', set TOR_CONTROL_PASSWORD", methods)
+}
+
+func (c *controlConn) Close() error {
+	return c.text.Close()
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
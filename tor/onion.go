@@ -0,0 +1,82 @@
+package tor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// the http server is published as a v3 onion service through the control port
+// of a tor daemon we don't manage. the service key is saved to KeyFile so the
+// address stays the same across restarts, and tor removes the service when our
+// control connection closes.
+
+var (
+	ControlAddr     = "127.0.0.1:9051"
+	ControlPassword string
+	KeyFile         = "onion.key"
+)
+
+var conn *controlConn
+
+// Address is the .onion host name once the service is published.
+var Address string
+
+// Publish makes tor forward port 80 of the onion service to target (host:port).
+func Publish(target string) error {
+	c, err := dialControl(ControlAddr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to tor control port: %w", err)
+	}
+	if err := c.authenticate(ControlPassword); err != nil {
+		c.Close()
+		return err
+	}
+
+	key := "NEW:ED25519-V3"
+	saved, err := os.ReadFile(KeyFile)
+	if err == nil {
+		key = strings.TrimSpace(string(saved))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		c.Close()
+		return fmt.Errorf("failed to read onion key: %w", err)
+	}
+
+	lines, err := c.command("ADD_ONION %s Port=80,%s", key, target)
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	var serviceID, privateKey string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "ServiceID=") {
+			serviceID = strings.TrimPrefix(line, "ServiceID=")
+		} else if strings.HasPrefix(line, "PrivateKey=") {
+			privateKey = strings.TrimPrefix(line, "PrivateKey=")
+		}
+	}
+	if serviceID == "" {
+		c.Close()
+		return errors.New("tor didn't return the onion address")
+	}
+	if privateKey != "" {
+		if err := os.WriteFile(KeyFile, []byte(privateKey+"\n"), 0600); err != nil {
+			c.Close()
+			return fmt.Errorf("failed to save onion key: %w", err)
+		}
+	}
+
+	conn = c
+	Address = serviceID + ".onion"
+	return nil
+}
+
+// Close removes the onion service.
+func Close() error {
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
@@ -6,61 +6,130 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rif/cache2go"
 	"github.com/tidwall/gjson"
 )
 
-var priceCache = cache2go.New(15, time.Minute)
+var priceCache = cache2go.New(len(CURRENCIES), time.Minute)
+
+// lastPrices keeps the last price fetched for each currency, it is used when
+// all the price sources fail so callers don't break on a temporary outage.
+var lastPrices = sync.Map{}
+
+type lastPrice struct {
+	fiatPerBTC float64
+	time       time.Time
+}
+
+const maxStalePrice = time.Hour
 
 func GetMsatsPerFiatUnit(currencyCode string) (int64, error) {
 	if currencyCode == "sat" {
 		return 1000, nil
 	}
 
-	if cachedPrice, ok := priceCache.Get(currencyCode); ok {
-		return cachedPrice.(int64), nil
+	fiatPerBTC, err := GetBTCPrice(currencyCode)
+	if err != nil {
+		return 0, err
 	}
 
-	lower := strings.ToLower(currencyCode)
+	return int64(100000000000 / fiatPerBTC), nil
+}
+
+// GetBTCPrice returns how many units of the given currency one bitcoin is worth.
+func GetBTCPrice(currencyCode string) (float64, error) {
 	upper := strings.ToUpper(currencyCode)
 
+	if cachedPrice, ok := priceCache.Get(upper); ok {
+		return cachedPrice.(float64), nil
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	defer func() {
 		cancel()
 	}()
 
-	bitfinex := getPrice(ctx, "https://api.bitfinex.com/v1/pubticker/btc"+lower, "last_price")
-	bitstamp := getPrice(ctx, "https://www.bitstamp.net/api/v2/ticker/btc"+lower, "last")
-	coinbase := getPrice(ctx, "https://api.coinbase.com/v2/exchange-rates?currency=BTC", "data.rates."+upper)
-	coinmate := getPrice(ctx, "https://coinmate.io/api/ticker?currencyPair=BTC_"+upper, "data.last")
-	kraken := getPrice(ctx, "https://api.kraken.com/0/public/Ticker?pair=XBT"+upper, "result.XXBTZ"+upper+".c.0")
-	exir := getPrice(ctx, "https://api.exir.io/v1/ticker?symbol=btc-"+lower, "last")
+	results := make([]<-chan float64, len(providers))
+	for i, provider := range providers {
+		results[i] = getPrice(ctx,
+			provider.replace(provider.URL, currencyCode),
+			provider.replace(provider.Path, currencyCode))
+	}
+
+	// the first provider in order with a sane price, waiting for each one
+	// until the timeout and after it only taking those that have answered
+	wait, stop := context.WithTimeout(ctx, RateTimeout)
+	defer stop()
 
 	var fiatPerBTC float64
+	for _, result := range results {
+		var price float64
+		var ok bool
+		select {
+		case price, ok = <-result:
+		case <-wait.Done():
+			select {
+			case price, ok = <-result:
+			default:
+			}
+		}
+		if ok && saneRate(upper, price) {
+			fiatPerBTC = price
+			break
+		}
+	}
 
-	select {
-	case fiatPerBTC = <-bitfinex:
-	case fiatPerBTC = <-bitstamp:
-	case fiatPerBTC = <-coinbase:
-	case fiatPerBTC = <-coinmate:
-	case fiatPerBTC = <-kraken:
-	case fiatPerBTC = <-exir:
-	case <-time.After(time.Second * 3):
+	if fiatPerBTC == 0 {
+		if last, ok := lastPrices.Load(upper); ok &&
+			time.Since(last.(lastPrice).time) < maxStalePrice {
+			return last.(lastPrice).fiatPerBTC, nil
+		}
 		return 0, errors.New("couldn't get BTC price for " + currencyCode)
 	}
 
-	msatPerFiat := 100000000000 / fiatPerBTC
+	priceCache.Set(upper, fiatPerBTC)
+	lastPrices.Store(upper, lastPrice{fiatPerBTC, time.Now()})
+	return fiatPerBTC, nil
+}
+
+// FiatToMsats converts an amount in the given currency to millisatoshis.
+func FiatToMsats(amount float64, currencyCode string) (int64, error) {
+	if currencyCode == "sat" {
+		return int64(amount * 1000), nil
+	}
+
+	fiatPerBTC, err := GetBTCPrice(currencyCode)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(amount / fiatPerBTC * 100000000000), nil
+}
+
+// MsatsToFiat converts millisatoshis to an amount in the given currency.
+func MsatsToFiat(msats int64, currencyCode string) (float64, error) {
+	if currencyCode == "sat" {
+		return float64(msats) / 1000, nil
+	}
+
+	fiatPerBTC, err := GetBTCPrice(currencyCode)
+	if err != nil {
+		return 0, err
+	}
 
-	priceCache.Set(currencyCode, int64(msatPerFiat))
-	return int64(msatPerFiat), nil
+	return float64(msats) / 100000000000 * fiatPerBTC, nil
 }
 
 func getPrice(ctx context.Context, url string, pattern string) <-chan float64 {
-	result := make(chan float64)
+	// buffered so the sources that aren't needed don't hang around forever,
+	// closed when there is no price
+	result := make(chan float64, 1)
 	go func() {
+		defer close(result)
 		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 		if err != nil {
 			return
@@ -34,14 +34,20 @@ func ParseFeed(feedURL string) (map[string]interface{}, string, error) {
 	}
 
 	bodyString := string(body)
-	feed, err := fp.ParseString(bodyString)
+	mapfeed, err := ParseFeedString(bodyString)
+	return mapfeed, bodyString, err
+}
+
+// ParseFeedString parses a feed that was already fetched.
+func ParseFeedString(body string) (map[string]interface{}, error) {
+	feed, err := fp.ParseString(body)
 	if err != nil {
-		return nil, "", fmt.Errorf("error parsing feed: %w", err)
+		return nil, fmt.Errorf("error parsing feed: %w", err)
 	}
 
 	var mapfeed map[string]interface{}
 	j, _ := json.Marshal(feed)
 	json.Unmarshal(j, &mapfeed)
 
-	return mapfeed, bodyString, err
+	return mapfeed, nil
 }
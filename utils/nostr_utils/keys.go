@@ -0,0 +1,13 @@
+package nostr_utils
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// DeriveKey returns a nostr private key (hex) deterministically derived from
+// the instance secret and the given label.
+func DeriveKey(label string) string {
+	privateKeyBytes := sha256.Sum256([]byte(Secret + ":" + label))
+	return fmt.Sprintf("%x", privateKeyBytes[:])
+}
@@ -0,0 +1,101 @@
+package nostr_utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// nip04 encrypted direct messages: aes-256-cbc with the ecdh shared point as key,
+// encoded as "<base64 ciphertext>?iv=<base64 iv>".
+
+func sharedSecret(privateKey, publicKey string) ([]byte, error) {
+	skb, err := hex.DecodeString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	sk, _ := btcec.PrivKeyFromBytes(skb)
+
+	pkb, err := hex.DecodeString("02" + publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	pk, err := btcec.ParsePubKey(pkb)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	return btcec.GenerateSharedSecret(sk, pk), nil
+}
+
+func NIP04Encrypt(message, privateKey, publicKey string) (string, error) {
+	key, err := sharedSecret(privateKey, publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	padding := aes.BlockSize - len(message)%aes.BlockSize
+	plaintext := append([]byte(message), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	return base64.StdEncoding.EncodeToString(ciphertext) + "?iv=" +
+		base64.StdEncoding.EncodeToString(iv), nil
+}
+
+func NIP04Decrypt(content, privateKey, publicKey string) (string, error) {
+	parts := strings.Split(content, "?iv=")
+	if len(parts) != 2 {
+		return "", errors.New("invalid encrypted content")
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid ciphertext: %w", err)
+	}
+	iv, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(iv) != aes.BlockSize {
+		return "", errors.New("invalid iv")
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return "", errors.New("invalid ciphertext size")
+	}
+
+	key, err := sharedSecret(privateKey, publicKey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return "", errors.New("invalid padding")
+	}
+
+	return string(plaintext[0 : len(plaintext)-padding]), nil
+}
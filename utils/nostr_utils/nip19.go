@@ -0,0 +1,211 @@
+package nostr_utils
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+)
+
+// nip19 entities with tlv data, used to reference events and replaceable events.
+
+const (
+	tlvDefault = 0
+	tlvRelay   = 1
+	tlvAuthor  = 2
+	tlvKind    = 3
+)
+
+type EventPointer struct {
+	ID     string   `json:"id"`
+	Relays []string `json:"relays,omitempty"`
+	Author string   `json:"author,omitempty"`
+	Kind   int      `json:"kind,omitempty"`
+}
+
+type AddressPointer struct {
+	Identifier string   `json:"identifier"`
+	PubKey     string   `json:"pubkey"`
+	Kind       int      `json:"kind"`
+	Relays     []string `json:"relays,omitempty"`
+}
+
+func decodeTLV(code string) (string, map[uint8][][]byte, error) {
+	prefix, data5, err := bech32.DecodeNoLimit(code)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid bech32: %w", err)
+	}
+	data, err := bech32.ConvertBits(data5, 5, 8, false)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid bech32 data: %w", err)
+	}
+
+	tlv := make(map[uint8][][]byte)
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return "", nil, errors.New("invalid tlv")
+		}
+		t, l := data[0], int(data[1])
+		tlv[t] = append(tlv[t], data[2:2+l])
+		data = data[2+l:]
+	}
+
+	return prefix, tlv, nil
+}
+
+func encodeTLV(prefix string, entries [][2]interface{}) (string, error) {
+	var data []byte
+	for _, entry := range entries {
+		value := entry[1].([]byte)
+		if len(value) > 255 {
+			return "", errors.New("tlv value too long")
+		}
+		data = append(data, entry[0].(uint8), uint8(len(value)))
+		data = append(data, value...)
+	}
+
+	data5, err := bech32.ConvertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32.Encode(prefix, data5)
+}
+
+func tlvHex32(tlv map[uint8][][]byte, t uint8) (string, error) {
+	values := tlv[t]
+	if len(values) == 0 {
+		return "", nil
+	}
+	if len(values[0]) != 32 {
+		return "", errors.New("invalid key or id length")
+	}
+	return hex.EncodeToString(values[0]), nil
+}
+
+func tlvCommon(tlv map[uint8][][]byte) (author string, kind int, relays []string, err error) {
+	author, err = tlvHex32(tlv, tlvAuthor)
+	if err != nil {
+		return
+	}
+	if k := tlv[tlvKind]; len(k) > 0 {
+		if len(k[0]) != 4 {
+			err = errors.New("invalid kind")
+			return
+		}
+		kind = int(binary.BigEndian.Uint32(k[0]))
+	}
+	for _, relay := range tlv[tlvRelay] {
+		relays = append(relays, string(relay))
+	}
+	return
+}
+
+func DecodeNevent(code string) (*EventPointer, error) {
+	prefix, tlv, err := decodeTLV(code)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "nevent" {
+		return nil, fmt.Errorf("expected nevent, got %s", prefix)
+	}
+
+	id, err := tlvHex32(tlv, tlvDefault)
+	if err != nil || id == "" {
+		return nil, errors.New("nevent is missing the event id")
+	}
+
+	author, kind, relays, err := tlvCommon(tlv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EventPointer{ID: id, Relays: relays, Author: author, Kind: kind}, nil
+}
+
+func DecodeNaddr(code string) (*AddressPointer, error) {
+	prefix, tlv, err := decodeTLV(code)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "naddr" {
+		return nil, fmt.Errorf("expected naddr, got %s", prefix)
+	}
+
+	if len(tlv[tlvDefault]) == 0 {
+		return nil, errors.New("naddr is missing the identifier")
+	}
+
+	author, kind, relays, err := tlvCommon(tlv)
+	if err != nil {
+		return nil, err
+	}
+	if author == "" || kind == 0 {
+		return nil, errors.New("naddr is missing the author or kind")
+	}
+
+	return &AddressPointer{
+		Identifier: string(tlv[tlvDefault][0]),
+		PubKey:     author,
+		Kind:       kind,
+		Relays:     relays,
+	}, nil
+}
+
+func EncodeNaddr(pointer AddressPointer) (string, error) {
+	pubkey, err := hex.DecodeString(pointer.PubKey)
+	if err != nil || len(pubkey) != 32 {
+		return "", errors.New("invalid pubkey")
+	}
+
+	kind := make([]byte, 4)
+	binary.BigEndian.PutUint32(kind, uint32(pointer.Kind))
+
+	entries := [][2]interface{}{
+		{uint8(tlvDefault), []byte(pointer.Identifier)},
+	}
+	for _, relay := range pointer.Relays {
+		entries = append(entries, [2]interface{}{uint8(tlvRelay), []byte(relay)})
+	}
+	entries = append(entries,
+		[2]interface{}{uint8(tlvAuthor), pubkey},
+		[2]interface{}{uint8(tlvKind), kind},
+	)
+
+	return encodeTLV("naddr", entries)
+}
+
+// DecodePubKey takes an npub or a hex pubkey and returns it as hex.
+func DecodePubKey(code string) (string, error) {
+	if len(code) == 64 {
+		if b, err := hex.DecodeString(code); err == nil {
+			return hex.EncodeToString(b), nil
+		}
+	}
+
+	prefix, data5, err := bech32.Decode(code)
+	if err != nil {
+		return "", fmt.Errorf("invalid bech32: %w", err)
+	}
+	if prefix != "npub" {
+		return "", fmt.Errorf("expected npub, got %s", prefix)
+	}
+	data, err := bech32.ConvertBits(data5, 5, 8, false)
+	if err != nil || len(data) != 32 {
+		return "", errors.New("invalid npub")
+	}
+	return hex.EncodeToString(data), nil
+}
+
+func EncodeNpub(pubkey string) (string, error) {
+	data, err := hex.DecodeString(pubkey)
+	if err != nil || len(data) != 32 {
+		return "", errors.New("invalid pubkey")
+	}
+	data5, err := bech32.ConvertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32.Encode("npub", data5)
+}
@@ -3,7 +3,7 @@ package nostr_utils
 import "github.com/fiatjaf/go-nostr"
 
 var (
-	pool   = nostr.RelayPool{}
+	pool   = nostr.NewRelayPool()
 	Secret string
 	Relays []string
 )
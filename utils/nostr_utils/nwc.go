@@ -0,0 +1,179 @@
+package nostr_utils
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	nostr "github.com/fiatjaf/go-nostr"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	KindNWCRequest  = 23194
+	KindNWCResponse = 23195
+)
+
+var NWCTimeout = 60 * time.Second
+
+type NWCConnection struct {
+	WalletPubKey string
+	Relay        string
+	Secret       string
+}
+
+// ParseNWC parses a nostr+walletconnect://<pubkey>?relay=<url>&secret=<hex> uri.
+func ParseNWC(uri string) (*NWCConnection, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uri: %w", err)
+	}
+	if u.Scheme != "nostr+walletconnect" && u.Scheme != "nostrwalletconnect" {
+		return nil, fmt.Errorf("invalid scheme '%s'", u.Scheme)
+	}
+
+	conn := &NWCConnection{
+		WalletPubKey: u.Host,
+		Relay:        u.Query().Get("relay"),
+		Secret:       u.Query().Get("secret"),
+	}
+	if conn.WalletPubKey == "" {
+		conn.WalletPubKey = strings.TrimPrefix(u.Opaque, "//")
+	}
+
+	if b, err := hex.DecodeString(conn.WalletPubKey); err != nil || len(b) != 32 {
+		return nil, errors.New("invalid wallet pubkey")
+	}
+	if b, err := hex.DecodeString(conn.Secret); err != nil || len(b) != 32 {
+		return nil, errors.New("invalid secret")
+	}
+	if conn.Relay == "" {
+		return nil, errors.New("missing relay")
+	}
+
+	return conn, nil
+}
+
+type nwcResponse struct {
+	ResultType string `json:"result_type"`
+	Error      *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Result json.RawMessage `json:"result"`
+}
+
+// Request sends a nip47 request to the wallet and waits for its response.
+func (conn *NWCConnection) Request(method string, params interface{}) (json.RawMessage, error) {
+	pubkey, err := nostr.GetPublicKey(conn.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret: %w", err)
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"method": method,
+		"params": params,
+	})
+	content, err := NIP04Encrypt(string(payload), conn.Secret, conn.WalletPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt request: %w", err)
+	}
+
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: time.Now(),
+		Kind:      KindNWCRequest,
+		Tags:      nostr.Tags{nostr.StringList{"p", conn.WalletPubKey}},
+		Content:   content,
+	}
+	if err := evt.Sign(conn.Secret); err != nil {
+		return nil, fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(nostr.NormalizeURL(conn.Relay), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", conn.Relay, err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(NWCTimeout))
+
+	// subscribe to the response before sending the request so we don't miss it
+	if err := ws.WriteJSON([]interface{}{"REQ", "nwc", map[string]interface{}{
+		"kinds":   []int{KindNWCResponse},
+		"authors": []string{conn.WalletPubKey},
+		"#e":      []string{evt.ID},
+	}}); err != nil {
+		return nil, err
+	}
+	if err := ws.WriteJSON([]interface{}{"EVENT", evt}); err != nil {
+		return nil, err
+	}
+
+	for {
+		var message []json.RawMessage
+		if err := ws.ReadJSON(&message); err != nil {
+			return nil, fmt.Errorf("no response from wallet: %w", err)
+		}
+		if len(message) < 3 {
+			continue
+		}
+
+		var label string
+		json.Unmarshal(message[0], &label)
+		if label != "EVENT" {
+			continue
+		}
+
+		var response nostr.Event
+		if err := json.Unmarshal(message[2], &response); err != nil {
+			continue
+		}
+		if response.PubKey != conn.WalletPubKey || response.Kind != KindNWCResponse {
+			continue
+		}
+		if ok, _ := response.CheckSignature(); !ok {
+			continue
+		}
+
+		plaintext, err := NIP04Decrypt(response.Content, conn.Secret, conn.WalletPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt response: %w", err)
+		}
+
+		var res nwcResponse
+		if err := json.Unmarshal([]byte(plaintext), &res); err != nil {
+			return nil, fmt.Errorf("invalid response: %w", err)
+		}
+		if res.Error != nil {
+			return nil, fmt.Errorf("%s: %s", res.Error.Code, res.Error.Message)
+		}
+
+		return res.Result, nil
+	}
+}
+
+// NWCPayInvoice asks the wallet behind a nostr wallet connect uri to pay an
+// invoice and returns the preimage.
+func NWCPayInvoice(uri string, invoice string) (string, error) {
+	conn, err := ParseNWC(uri)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := conn.Request("pay_invoice", map[string]interface{}{
+		"invoice": invoice,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var payment struct {
+		Preimage string `json:"preimage"`
+	}
+	json.Unmarshal(result, &payment)
+	return payment.Preimage, nil
+}
@@ -13,6 +13,18 @@ type EventRelay struct {
 	Relay string       `json:"relay"`
 }
 
+// AppKey is the nostr private key (hex) an app uses on a given wallet.
+func AppKey(app, wallet string) string {
+	return DeriveKey("nostrkey:app:" + wallet + ":" + app)
+}
+
+func AppPublicKey(app, wallet string) (string, error) {
+	return nostr.GetPublicKey(AppKey(app, wallet))
+}
+
+// Publish signs an event with the app key and sends it to the configured relays
+// (plus the ones in eventData.relays), emitting nostr_event_confirmed or
+// nostr_event_failed to the app for each relay.
 func Publish(app, wallet string, eventData map[string]interface{}) (string, error) {
 	evt := &nostr.Event{
 		CreatedAt: time.Now(),
@@ -22,24 +34,35 @@ func Publish(app, wallet string, eventData map[string]interface{}) (string, erro
 	}
 
 	if ikind, ok := eventData["kind"]; ok {
-		if kind, ok := ikind.(int); ok {
+		switch kind := ikind.(type) {
+		case float64:
+			evt.Kind = int(kind)
+		case int:
 			evt.Kind = kind
-		} else {
+		default:
 			return "", fmt.Errorf("invalid kind: %v", ikind)
 		}
 	}
 
 	if itags, ok := eventData["tags"]; ok {
-		if tags, ok := itags.([]interface{}); ok {
-			for i, itag := range tags {
-				if tag, ok := itag.(nostr.StringList); ok {
-					evt.Tags = append(evt.Tags, tag)
-				} else {
+		tags, ok := itags.([]interface{})
+		if !ok {
+			if m, isMap := itags.(map[string]interface{}); !isMap || len(m) > 0 {
+				return "", fmt.Errorf("invalid tags: %v", itags)
+			}
+		}
+		for i, itag := range tags {
+			items, ok := itag.([]interface{})
+			if !ok {
+				return "", fmt.Errorf("invalid tag at %d: %v", i, itag)
+			}
+			tag := make(nostr.StringList, len(items))
+			for j, item := range items {
+				if tag[j], ok = item.(string); !ok {
 					return "", fmt.Errorf("invalid tag at %d: %v", i, itag)
 				}
 			}
-		} else {
-			return "", fmt.Errorf("invalid tags: %v", itags)
+			evt.Tags = append(evt.Tags, tag)
 		}
 	}
 
@@ -51,33 +74,35 @@ func Publish(app, wallet string, eventData map[string]interface{}) (string, erro
 		}
 	}
 
-	evt, statuses, err := pool.PublishEvent(evt)
-	if err != nil {
-		return "", err
+	if icreated, ok := eventData["created_at"].(float64); ok {
+		evt.CreatedAt = time.Unix(int64(icreated), 0)
+	}
+
+	var relays []string
+	if irelays, ok := eventData["relays"].([]interface{}); ok {
+		for _, irelay := range irelays {
+			if relay, ok := irelay.(string); ok {
+				relays = append(relays, relay)
+			}
+		}
+	}
+
+	if err := evt.Sign(AppKey(app, wallet)); err != nil {
+		return "", fmt.Errorf("failed to sign: %w", err)
 	}
 
 	go func() {
-		for status := range statuses {
-			switch status.Status {
-			case nostr.PublishStatusSent:
-				events.EmitGenericAppWalletEvent(
-					app, wallet,
-					"nostr_event_sent",
-					EventRelay{evt, status.Relay},
-				)
-			case nostr.PublishStatusFailed:
-				events.EmitGenericAppWalletEvent(
-					app, wallet,
-					"nostr_event_failed",
-					EventRelay{evt, status.Relay},
-				)
-			case nostr.PublishStatusSucceeded:
-				events.EmitGenericAppWalletEvent(
-					app, wallet,
-					"nostr_event_confirmed",
-					EventRelay{evt, status.Relay},
-				)
+		accepted := make(map[string]bool)
+		for _, relay := range Broadcast(*evt, relays) {
+			accepted[relay] = true
+		}
+
+		for _, relay := range normalizeRelays(relays) {
+			name := "nostr_event_failed"
+			if accepted[relay] {
+				name = "nostr_event_confirmed"
 			}
+			events.EmitGenericAppWalletEvent(app, wallet, name, EventRelay{evt, relay})
 		}
 	}()
 
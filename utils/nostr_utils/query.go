@@ -0,0 +1,158 @@
+package nostr_utils
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	nostr "github.com/fiatjaf/go-nostr"
+	"github.com/gorilla/websocket"
+)
+
+var QueryTimeout = 5 * time.Second
+
+// QueryEvents asks each of the given relays (plus the configured ones) for the
+// events matching filter and returns all of them after the relays have sent
+// their stored events or the timeout is reached.
+// this is separate from the pool because the pool is for long-lived subscriptions.
+func QueryEvents(relays []string, filter map[string]interface{}) []nostr.Event {
+	urls := normalizeRelays(relays)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string]struct{})
+	results := make([]nostr.Event, 0)
+
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+
+			for _, evt := range queryRelay(url, filter) {
+				mu.Lock()
+				if _, ok := seen[evt.ID]; !ok {
+					seen[evt.ID] = struct{}{}
+					results = append(results, evt)
+				}
+				mu.Unlock()
+			}
+		}(url)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// normalizeRelays returns the given relays plus the configured ones, normalized
+// and without duplicates.
+func normalizeRelays(relays []string) []string {
+	seen := make(map[string]struct{})
+	urls := make([]string, 0, len(relays)+len(Relays))
+	for _, relay := range append(append([]string{}, relays...), Relays...) {
+		if nm := nostr.NormalizeURL(relay); nm != "" {
+			if _, ok := seen[nm]; !ok {
+				seen[nm] = struct{}{}
+				urls = append(urls, nm)
+			}
+		}
+	}
+	return urls
+}
+
+func queryRelay(url string, filter map[string]interface{}) []nostr.Event {
+	dialer := websocket.Dialer{HandshakeTimeout: QueryTimeout}
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(QueryTimeout))
+
+	if err := ws.WriteJSON([]interface{}{"REQ", "q", filter}); err != nil {
+		return nil
+	}
+
+	var events []nostr.Event
+	for {
+		var message []json.RawMessage
+		if err := ws.ReadJSON(&message); err != nil || len(message) < 2 {
+			return events
+		}
+
+		var label string
+		json.Unmarshal(message[0], &label)
+		switch label {
+		case "EOSE":
+			return events
+		case "EVENT":
+			if len(message) < 3 {
+				continue
+			}
+			var evt nostr.Event
+			if err := json.Unmarshal(message[2], &evt); err != nil {
+				continue
+			}
+			if ok, _ := evt.CheckSignature(); !ok || evt.ID != evt.GetID() {
+				continue
+			}
+			events = append(events, evt)
+		}
+	}
+}
+
+// Broadcast sends an already signed event to the given relays (plus the configured
+// ones) and returns the list of relays that accepted it.
+func Broadcast(evt nostr.Event, relays []string) []string {
+	urls := normalizeRelays(relays)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	accepted := make([]string, 0, len(urls))
+
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+
+			dialer := websocket.Dialer{HandshakeTimeout: QueryTimeout}
+			ws, _, err := dialer.Dial(url, nil)
+			if err != nil {
+				return
+			}
+			defer ws.Close()
+			ws.SetReadDeadline(time.Now().Add(QueryTimeout))
+
+			if err := ws.WriteJSON([]interface{}{"EVENT", evt}); err != nil {
+				return
+			}
+
+			for {
+				var message []json.RawMessage
+				if err := ws.ReadJSON(&message); err != nil {
+					return
+				}
+				if len(message) == 0 {
+					continue
+				}
+
+				var label string
+				json.Unmarshal(message[0], &label)
+				if label != "OK" || len(message) < 3 {
+					continue
+				}
+
+				var ok bool
+				json.Unmarshal(message[2], &ok)
+				if ok {
+					mu.Lock()
+					accepted = append(accepted, url)
+					mu.Unlock()
+				}
+				return
+			}
+		}(url)
+	}
+	wg.Wait()
+
+	return accepted
+}
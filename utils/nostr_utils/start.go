@@ -1,11 +1,11 @@
 package nostr_utils
 
 import (
-	"crypto/sha256"
 	"fmt"
 	"log"
 
 	nostr "github.com/fiatjaf/go-nostr"
+	"github.com/lnbits/infinity/cluster"
 	"github.com/lnbits/infinity/events"
 )
 
@@ -14,8 +14,7 @@ func Start() {
 		return
 	}
 
-	privateKeyBytes := sha256.Sum256([]byte(Secret + ":nostrkey"))
-	privateKeyHex := fmt.Sprintf("%x", privateKeyBytes[:])
+	privateKeyHex := DeriveKey("nostrkey")
 	publicKey, err := nostr.GetPublicKey(privateKeyHex)
 	if err != nil {
 		log.Fatal("failed to get nostr public key from private: ", err)
@@ -38,7 +37,9 @@ func Start() {
 
 	go func() {
 		for event := range sub.UniqueEvents {
-			events.EmitGenericEvent("nostr_event", event)
+			if cluster.Leading() {
+				events.EmitGenericEvent("nostr_event", event)
+			}
 		}
 	}()
 }
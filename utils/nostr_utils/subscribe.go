@@ -0,0 +1,163 @@
+package nostr_utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	nostr "github.com/fiatjaf/go-nostr"
+	"github.com/gorilla/websocket"
+	"github.com/lucsky/cuid"
+)
+
+const seenEventsLimit = 1000
+
+// Subscribe keeps a subscription open on the given relays (plus the configured
+// ones) until ctx is done, reconnecting when a relay goes away, and calls handle
+// once for each new event with a valid signature that matches the filter.
+func Subscribe(
+	ctx context.Context,
+	relays []string,
+	filter map[string]interface{},
+	handle func(nostr.Event),
+) error {
+	// relays can send anything, what doesn't match is dropped
+	var matcher nostr.Filter
+	j, err := json.Marshal(filter)
+	if err != nil {
+		return fmt.Errorf("invalid filter: %w", err)
+	}
+	if err := json.Unmarshal(j, &matcher); err != nil {
+		return fmt.Errorf("invalid filter: %w", err)
+	}
+
+	var mu sync.Mutex
+	seen := make(map[string]struct{})
+	order := make([]string, 0, seenEventsLimit)
+
+	dispatch := func(evt nostr.Event) {
+		if !matcher.Matches(&evt) {
+			return
+		}
+
+		mu.Lock()
+		if _, ok := seen[evt.ID]; ok {
+			mu.Unlock()
+			return
+		}
+		seen[evt.ID] = struct{}{}
+		order = append(order, evt.ID)
+		if len(order) > seenEventsLimit {
+			delete(seen, order[0])
+			order = order[1:]
+		}
+		mu.Unlock()
+
+		handle(evt)
+	}
+
+	for _, url := range normalizeRelays(relays) {
+		go subscribeRelay(ctx, url, filter, dispatch)
+	}
+	return nil
+}
+
+func subscribeRelay(
+	ctx context.Context,
+	url string,
+	filter map[string]interface{},
+	dispatch func(nostr.Event),
+) {
+	backoff := time.Second * 5
+	var since int64
+
+	for {
+		started := time.Now()
+		last := readSubscription(ctx, url, filter, since, dispatch)
+		if last > since {
+			since = last
+		}
+
+		if time.Since(started) > time.Minute {
+			backoff = time.Second * 5
+		} else if backoff < time.Minute*5 {
+			backoff *= 2
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// readSubscription returns the created_at of the newest event seen, so when we
+// reconnect we don't get everything again.
+func readSubscription(
+	ctx context.Context,
+	url string,
+	filter map[string]interface{},
+	since int64,
+	dispatch func(nostr.Event),
+) (newest int64) {
+	dialer := websocket.Dialer{HandshakeTimeout: QueryTimeout}
+	ws, _, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return since
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		ws.Close()
+	}()
+
+	f := make(map[string]interface{}, len(filter)+1)
+	for k, v := range filter {
+		f[k] = v
+	}
+	if since > 0 {
+		f["since"] = since
+	}
+
+	if err := ws.WriteJSON([]interface{}{"REQ", cuid.Slug(), f}); err != nil {
+		return since
+	}
+
+	newest = since
+	for {
+		var message []json.RawMessage
+		if err := ws.ReadJSON(&message); err != nil {
+			return newest
+		}
+		if len(message) < 3 {
+			continue
+		}
+
+		var label string
+		json.Unmarshal(message[0], &label)
+		if label != "EVENT" {
+			continue
+		}
+
+		var evt nostr.Event
+		if err := json.Unmarshal(message[2], &evt); err != nil {
+			continue
+		}
+		if ok, _ := evt.CheckSignature(); !ok || evt.ID != evt.GetID() {
+			continue
+		}
+
+		if ts := evt.CreatedAt.Unix(); ts > newest {
+			newest = ts
+		}
+		dispatch(evt)
+	}
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// the sources of the bitcoin price. they are all asked at the same time and
+// the first one in RateProviders that answers with a sane price is taken, the
+// others only when the ones before fail or don't answer in RateTimeout.
+
+// RateProvider gets the price from a json api. {currency} and {CURRENCY} in
+// the URL and the Path are the currency in lowercase and uppercase, Path is a
+// gjson path or a simple jsonpath ($.data.rates.USD).
+type RateProvider struct {
+	URL  string
+	Path string
+}
+
+var rateProviders = map[string]RateProvider{
+	"coingecko": {"https://api.coingecko.com/api/v3/simple/price?ids=bitcoin&vs_currencies={currency}", "bitcoin.{currency}"},
+	"kraken":    {"https://api.kraken.com/0/public/Ticker?pair=XBT{CURRENCY}", "result.XXBTZ{CURRENCY}.c.0"},
+	"bitstamp":  {"https://www.bitstamp.net/api/v2/ticker/btc{currency}", "last"},
+	"coinbase":  {"https://api.coinbase.com/v2/exchange-rates?currency=BTC", "data.rates.{CURRENCY}"},
+	"bitfinex":  {"https://api.bitfinex.com/v1/pubticker/btc{currency}", "last_price"},
+	"coinmate":  {"https://coinmate.io/api/ticker?currencyPair=BTC_{CURRENCY}", "data.last"},
+	"exir":      {"https://api.exir.io/v1/ticker?symbol=btc-{currency}", "last"},
+}
+
+var (
+	// RateProviders are the names of the providers in the order they are
+	// preferred, "custom" being RateURL.
+	RateProviders = []string{"coingecko", "kraken", "bitstamp", "coinbase", "bitfinex", "coinmate", "exir"}
+
+	// RateURL and RatePath are the custom provider, which comes before the
+	// others when it isn't in RateProviders.
+	RateURL  string
+	RatePath string
+
+	RateTimeout = time.Second * 3
+
+	// RateMaxChange is how far, as a fraction, a price can be from the last one
+	// taken for the currency before it is thought to be wrong, 0 for no limit.
+	RateMaxChange = 0.25
+)
+
+// providers is RateProviders checked by SetupRateProviders.
+var providers []RateProvider
+
+func init() {
+	SetupRateProviders()
+}
+
+// SetupRateProviders checks the settings for the providers.
+func SetupRateProviders() error {
+	names := RateProviders
+	if RateURL != "" && !contains(names, "custom") {
+		names = append([]string{"custom"}, names...)
+	}
+	if len(names) == 0 {
+		return errors.New("no rate providers")
+	}
+	if RateMaxChange < 0 {
+		return errors.New("the maximum rate change can't be negative")
+	}
+
+	list := make([]RateProvider, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "custom" {
+			if RateURL == "" || RatePath == "" {
+				return errors.New("the custom rate provider needs RATE_URL and RATE_PATH")
+			}
+			list = append(list, RateProvider{RateURL, jsonPathToGJSON(RatePath)})
+			continue
+		}
+		provider, ok := rateProviders[name]
+		if !ok {
+			return fmt.Errorf("unknown rate provider '%s'", name)
+		}
+		list = append(list, provider)
+	}
+
+	providers = list
+	return nil
+}
+
+func (p RateProvider) replace(s, currencyCode string) string {
+	return strings.NewReplacer(
+		"{currency}", strings.ToLower(currencyCode),
+		"{CURRENCY}", strings.ToUpper(currencyCode),
+	).Replace(s)
+}
+
+var jsonPathIndex = regexp.MustCompile(`\[(\d+)\]`)
+var jsonPathKey = regexp.MustCompile(`\[['"]([^'"]+)['"]\]`)
+
+// jsonPathToGJSON takes the simple jsonpaths, dots, keys in brackets and
+// indexes, leaving gjson paths as they are.
+func jsonPathToGJSON(path string) string {
+	if !strings.HasPrefix(path, "$") {
+		return path
+	}
+	path = jsonPathKey.ReplaceAllString(path, ".$1")
+	path = jsonPathIndex.ReplaceAllString(path, ".$1")
+	return strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+}
+
+// saneRate tells if a price isn't too far from the last one of the currency.
+func saneRate(currencyCode string, fiatPerBTC float64) bool {
+	if RateMaxChange == 0 {
+		return true
+	}
+	last, ok := lastPrices.Load(currencyCode)
+	if !ok || time.Since(last.(lastPrice).time) >= maxStalePrice {
+		return true
+	}
+	previous := last.(lastPrice).fiatPerBTC
+	change := (fiatPerBTC - previous) / previous
+	return change <= RateMaxChange && change >= -RateMaxChange
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if strings.ToLower(strings.TrimSpace(item)) == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/antage/eventsource.v1"
+)
+
+// eventsource panics if anything is sent to a stream after it is closed, which
+// happens when the server is shutting down and events are still being emitted,
+// so streams are wrapped to ignore everything after Close.
+
+type closableStream struct {
+	eventsource.EventSource
+	sync.RWMutex
+	closed bool
+}
+
+func ClosableStream(es eventsource.EventSource) eventsource.EventSource {
+	return &closableStream{EventSource: es}
+}
+
+func (cs *closableStream) SendEventMessage(data, event, id string) {
+	cs.RLock()
+	defer cs.RUnlock()
+	if !cs.closed {
+		cs.EventSource.SendEventMessage(data, event, id)
+	}
+}
+
+func (cs *closableStream) SendRetryMessage(duration time.Duration) {
+	cs.RLock()
+	defer cs.RUnlock()
+	if !cs.closed {
+		cs.EventSource.SendRetryMessage(duration)
+	}
+}
+
+func (cs *closableStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cs.RLock()
+	defer cs.RUnlock()
+	if cs.closed {
+		http.Error(w, "server is shutting down", 503)
+		return
+	}
+	cs.EventSource.ServeHTTP(w, r)
+}
+
+func (cs *closableStream) Close() {
+	cs.Lock()
+	defer cs.Unlock()
+	if !cs.closed {
+		cs.closed = true
+		cs.EventSource.Close()
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/lightning"
+	"github.com/mmcdole/gofeed"
+)
+
+// the commit and the build time are set with -ldflags by the Makefile, or
+// taken from the version control info go keeps in binaries built from a
+// checkout. with UPDATE_CHECK_FEED set to a releases feed (like the atom feed
+// of the releases on github) it is fetched every UPDATE_CHECK_INTERVAL, and a
+// release published after this build is logged and shown to the admin by
+// /api/version.
+
+var buildTime string // will be set at compile time
+
+type release struct {
+	Title       string    `json:"title"`
+	URL         string    `json:"url"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+var availableUpdate atomic.Value // *release
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		case "vcs.time":
+			if buildTime == "" {
+				buildTime = setting.Value
+			}
+		}
+	}
+	if commit == "" && revision != "" {
+		commit = revision
+		if modified == "true" {
+			commit += "-dirty"
+		}
+	}
+}
+
+func builtAt() *time.Time {
+	t, err := time.Parse(time.RFC3339, buildTime)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+func versionInfo(w http.ResponseWriter, r *http.Request) {
+	result := struct {
+		Commit    string     `json:"commit"`
+		BuildTime *time.Time `json:"build_time,omitempty"`
+		GoVersion string     `json:"go_version"`
+		Backend   string     `json:"backend"`
+		Update    *release   `json:"update,omitempty"`
+	}{
+		Commit:    commit,
+		BuildTime: builtAt(),
+		GoVersion: runtime.Version(),
+		Backend:   lightning.LN.Kind(),
+	}
+
+	// whether the instance is outdated is only for the admin to know
+	if hasAdminKey(r) {
+		result.Update, _ = availableUpdate.Load().(*release)
+	}
+
+	apiutils.SendJSON(w, result)
+}
+
+func checkForUpdates() {
+	built := builtAt()
+	if built == nil {
+		log.Info().Msg("build time unknown, not checking for updates")
+		return
+	}
+
+	parser := gofeed.NewParser()
+	parser.Client = &http.Client{Timeout: time.Second * 30}
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		feed, err := parser.ParseURLWithContext(s.UpdateCheckFeed, ctx)
+		cancel()
+		if err != nil {
+			log.Warn().Err(err).Str("feed", s.UpdateCheckFeed).Msg("failed to check for updates")
+		} else {
+			var latest *release
+			for _, item := range feed.Items {
+				published := item.PublishedParsed
+				if published == nil {
+					published = item.UpdatedParsed
+				}
+				if published == nil || (latest != nil && !published.After(latest.PublishedAt)) {
+					continue
+				}
+				latest = &release{item.Title, item.Link, *published}
+			}
+
+			// a release is published some time after its binaries are built
+			if latest != nil && latest.PublishedAt.After(built.Add(time.Hour*24)) {
+				if previous, _ := availableUpdate.Load().(*release); previous == nil ||
+					previous.URL != latest.URL {
+					log.Warn().Str("release", latest.Title).Str("url", latest.URL).
+						Msg("an update is available")
+				}
+				availableUpdate.Store(latest)
+			}
+		}
+
+		time.Sleep(s.UpdateCheckInterval)
+	}
+}
+
+func updateAvailable() float64 {
+	if update, _ := availableUpdate.Load().(*release); update != nil {
+		return 1
+	}
+	return 0
+}
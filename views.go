@@ -3,24 +3,51 @@ package main
 import (
 	"net/http"
 
+	"github.com/lnbits/infinity/api"
 	"github.com/lnbits/infinity/api/apiutils"
+	"github.com/lnbits/infinity/services"
+	"github.com/lnbits/infinity/tor"
 	"github.com/lnbits/infinity/utils"
 )
 
 func viewSettings(w http.ResponseWriter, r *http.Request) {
+	logo, themes := api.ClientBranding()
 	apiutils.SendJSON(w, struct {
-		ServiceURL      string   `json:"serviceURL"`
-		SiteTitle       string   `json:"siteTitle"`
-		SiteTagLine     string   `json:"siteTagline"`
-		SiteDescription string   `json:"siteDescription"`
-		SiteVersion     string   `json:"siteVersion"`
-		Currencies      []string `json:"currencies"`
+		ServiceURL      string                     `json:"serviceURL"`
+		OnionURL        string                     `json:"onionURL,omitempty"`
+		SiteTitle       string                     `json:"siteTitle"`
+		SiteTagLine     string                     `json:"siteTagline"`
+		SiteDescription string                     `json:"siteDescription"`
+		SiteVersion     string                     `json:"siteVersion"`
+		Currencies      []string                   `json:"currencies"`
+		Maintenance     *services.MaintenanceState `json:"maintenance,omitempty"`
+		SiteLogo        string                     `json:"siteLogo,omitempty"`
+		Themes          []api.ClientTheme          `json:"themes,omitempty"`
 	}{
 		s.ServiceURL,
-		s.SiteTitle,
-		s.SiteTagline,
-		s.SiteDescription,
+		onionURL(),
+		live().SiteTitle,
+		live().SiteTagline,
+		live().SiteDescription,
 		commit,
 		utils.CURRENCIES,
+		maintenance(),
+		logo,
+		themes,
 	})
 }
+
+// maintenance is shown so the client can tell users why they can't pay.
+func maintenance() *services.MaintenanceState {
+	if state := services.Maintenance(); state.Enabled {
+		return &state
+	}
+	return nil
+}
+
+func onionURL() string {
+	if tor.Address == "" {
+		return ""
+	}
+	return "http://" + tor.Address
+}
@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/lnbits/infinity/models"
+	"github.com/lnbits/infinity/utils"
+)
+
+// the webhook of a payment is sent the json of the payment by default, as the
+// api gives it. a payment may instead have a format, the name of a template
+// that renders the body: the presets are for services that take their own json
+// (slack, discord, zapier and ifttt) or a form, and the operator may add more
+// in Templates. a template "<format>.content-type" gives the content type of a
+// format, json otherwise. templates starting with _ are only used by others.
+
+// Default is the json of the payment.
+const Default = "json"
+
+var (
+	// Templates is a file with templates that are added to the presets or
+	// replace them.
+	Templates string
+
+	SiteTitle string
+)
+
+//go:embed presets.tmpl
+var presets string
+
+var templates *template.Template
+
+var funcs = template.FuncMap{
+	// sat formats msat as sat, with the decimals only when there are any, and
+	// without the sign of payments sent
+	"sat": func(msat int64) string {
+		if msat < 0 {
+			msat = -msat
+		}
+		s := strconv.FormatInt(msat/1000, 10)
+		if msat%1000 != 0 {
+			s += strings.TrimRight(fmt.Sprintf(".%03d", msat%1000), "0")
+		}
+		return s
+	},
+	// json encodes anything, strings in templates are quoted with it
+	"json": func(v interface{}) (string, error) {
+		return utils.JSONEncode(v)
+	},
+	// include renders another template, to pass its text to a function
+	"include": func(name string, data interface{}) (string, error) {
+		var b bytes.Buffer
+		err := templates.ExecuteTemplate(&b, name, data)
+		return b.String(), err
+	},
+}
+
+// Data is what the templates get. Event is payment-received or payment-sent.
+type Data struct {
+	Event      string
+	Payment    models.Payment
+	WalletName string
+	SiteTitle  string
+}
+
+func init() {
+	if err := Load(); err != nil {
+		panic(err)
+	}
+}
+
+// Load parses the presets and the templates of the operator.
+func Load() error {
+	t, err := template.New("").Funcs(funcs).Parse(presets)
+	if err != nil {
+		return err
+	}
+	if Templates != "" {
+		if t, err = t.ParseFiles(Templates); err != nil {
+			return fmt.Errorf("failed to load WEBHOOK_TEMPLATES: %w", err)
+		}
+	}
+	templates = t
+	return nil
+}
+
+// Known tells if a format can be given to payments, empty being the default.
+func Known(format string) bool {
+	if format == "" || format == Default {
+		return true
+	}
+	if templates == nil || strings.HasPrefix(format, "_") ||
+		strings.HasSuffix(format, ".content-type") {
+		return false
+	}
+	return templates.Lookup(format) != nil
+}
+
+// Render makes the body of the webhook in a format.
+func Render(format string, data Data) (body []byte, contentType string, err error) {
+	data.SiteTitle = SiteTitle
+	if format == "" || format == Default {
+		body, err = utils.JSONMarshal(data.Payment)
+		return body, "application/json", err
+	}
+	if !Known(format) {
+		return nil, "", fmt.Errorf("unknown webhook format '%s'", format)
+	}
+
+	var b bytes.Buffer
+	if err := templates.ExecuteTemplate(&b, format, data); err != nil {
+		return nil, "", err
+	}
+	contentType = "application/json"
+	if t := templates.Lookup(format + ".content-type"); t != nil {
+		var ct bytes.Buffer
+		if err := t.Execute(&ct, data); err != nil {
+			return nil, "", err
+		}
+		contentType = strings.TrimSpace(ct.String())
+	}
+	return bytes.TrimSpace(b.Bytes()), contentType, nil
+}